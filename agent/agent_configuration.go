@@ -1,17 +1,117 @@
 package agent
 
+import "time"
+
 type AgentConfiguration struct {
 	BootstrapScript            string
 	BuildPath                  string
 	HooksPath                  string
+	HooksOverlays              []string
+	AllowedJobExperiments      []string
 	PluginsPath                string
 	GitCloneFlags              string
 	GitCleanFlags              string
+	GitCloneDepth              int
+	GitFetchDepth              int
+	GitSparseCheckoutPaths     []string
+	GitSubmoduleRecursionDepth int
+	GitSubmoduleURLRewrites    []string
+	GitCredentialsFile         string
+	GitMirrorsPath             string
+	GitMirrorsLockTimeout      int
+	GitMirrorsStaleAfter       int
+	GitRetries                 int
+	GitRetryReclone            bool
 	SSHFingerprintVerification bool
+	SSHKnownHosts              []string
+	SSHHostKeyVerification     string
 	CommandEval                bool
+	Shell                      string
 	PluginsEnabled             bool
+	StrictPluginVerification   bool
+	PipelineVerificationKey    string
+	AllowedPlugins             []string
+	DeniedPlugins              []string
+	DeniedPluginPhases         []string
+	HookTimeout                int
+	CancelGracePeriod          int
+	CgroupParent               string
+	JobCPULimit                string
+	JobMemoryLimit             string
+	JobSandbox                 string
+	JobSandboxWritablePaths    []string
+	JobSandboxPullRequestsOnly bool
+	JobExecutor                string
+	KubernetesImage            string
+	KubernetesNamespace        string
+	KubernetesCPU              string
+	KubernetesMemory           string
+	KubernetesNodeSelector     []string
+	Proxy                      string
+	ProxyAuth                  string
+	ProxyUsername              string
+	ProxyPassword              string
+	ProxyAuthForJobs           bool
+	NoProxy                    []string
+	TLSClientCert              string
+	TLSClientKey               string
+	TLSCA                      string
+	S3ACL                      string
+	S3SSE                      string
+	S3SSEKMSKeyID              string
+	S3Endpoint                 string
+	S3ForcePathStyle           bool
+	VaultAddr                  string
+	VaultNamespace             string
+	VaultAuthMethod            string
+	VaultAuthMount             string
+	VaultRoleID                string
+	VaultSecretID              string
+	VaultKubernetesRole        string
+	VaultKubernetesTokenPath   string
+	SecretsFromAWS             bool
+	RedactedVars               []string
+	ProtectedEnv               []string
+	ProtectedEnvFatal          bool
+	PreflightMinDiskSpace      int
+	PreflightRequiredBinaries  []string
+	PreflightDocker            bool
+	JanitorKeepBuilds          time.Duration
+	JanitorMinFreeSpace        int
+	JanitorInterval            time.Duration
+	DockerGCTTL                time.Duration
+	DockerGCMinFreeSpace       int
+	DockerGCInterval           time.Duration
+	EphemeralWorkspace         string
+	EphemeralWorkspacePath     string
+	EphemeralWorkspaceSize     int
+	JobUser                    string
+	JobUserCommandOnly         bool
+	DevEnvironment             string
+	Toolchain                  string
+	ToolchainCachePath         string
+	DockerLogins               []string
+	SSHKeys                    []string
+	GitCredentialsProvider     string
+	GitHubAppID                string
+	GitHubAppPrivateKeyPath    string
+	GitHubAppInstallationID    int
+	GitHubAppHost              string
+	JobAPIToken                bool
+	JobAPITokenScopes          []string
+	AgentStartupHookFatal      bool
 	RunInPty                   bool
 	TimestampLines             bool
+	TimestampLinesFormat       string
+	ANSIOutput                 string
+	ControlSocket              string
+	LogChunkSize               int
+	LogFlushInterval           int
+	MaxLogSize                 int
 	DisconnectAfterJob         bool
 	DisconnectAfterJobTimeout  int
+	DisconnectAfterIdleTimeout int
+	LongPoll                   bool
+	AdaptiveIntervals          bool
+	AcquireJob                 string
 }
@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/bootstrap/shell"
+	"github.com/buildkite/agent/env"
+	"github.com/buildkite/agent/logger"
+)
+
+// Agent hooks live alongside the global job hooks in the hooks path, but are
+// run by the agent itself rather than the bootstrap. The agent-startup hook is
+// run once the agent is registered and before it connects and starts
+// accepting jobs, and the agent-shutdown hook is run once the agent has
+// stopped.
+const (
+	AgentStartupHook  = "agent-startup"
+	AgentShutdownHook = "agent-shutdown"
+)
+
+// Returns the platform specific path of an agent hook, or an empty string if
+// it doesn't exist
+func agentHookPath(hooksPath string, name string) string {
+	if hooksPath == "" {
+		return ""
+	}
+
+	if runtime.GOOS == "windows" {
+		name = name + ".bat"
+	}
+
+	path := filepath.Join(hooksPath, name)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+
+	return path
+}
+
+// RunAgentHook runs one of the agent hooks if it exists, logging it's output
+// through the agent's logger. It returns an error if the hook fails or runs
+// for longer than the agent's hook-timeout.
+func RunAgentHook(config *AgentConfiguration, agent *api.Agent, name string) error {
+	path := agentHookPath(config.HooksPath, name)
+	if path == "" {
+		logger.Debug("Skipping %s hook, no script in \"%s\"", name, config.HooksPath)
+		return nil
+	}
+
+	logger.Info("Running %s hook \"%s\"", name, path)
+
+	sh, err := shell.New()
+	if err != nil {
+		return err
+	}
+
+	output := &agentHookLogWriter{name: name}
+	defer output.Flush()
+
+	sh.Writer = output
+	sh.Logger = &shell.WriterLogger{Writer: output, Ansi: false}
+
+	extra := env.FromSlice([]string{
+		"BUILDKITE_AGENT_NAME=" + agent.Name,
+		"BUILDKITE_AGENT_TAGS=" + strings.Join(agent.Tags, ","),
+		"BUILDKITE_BUILD_PATH=" + config.BuildPath,
+		"BUILDKITE_HOOKS_PATH=" + config.HooksPath,
+		"BUILDKITE_PLUGINS_PATH=" + config.PluginsPath,
+	})
+
+	ctx := context.Background()
+	timeout := time.Duration(config.HookTimeout) * time.Second
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if err = sh.RunScript(ctx, path, extra); err != nil {
+		if _, ok := err.(*shell.TimeoutError); ok {
+			return fmt.Errorf("The %s hook timed out after %v", name, timeout)
+		}
+		return fmt.Errorf("The %s hook exited with an error: %v", name, err)
+	}
+
+	return nil
+}
+
+// Logs each line of a hook's output as it's written
+type agentHookLogWriter struct {
+	name string
+	buf  bytes.Buffer
+	mu   sync.Mutex
+}
+
+func (w *agentHookLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf.Write(p)
+
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Keep a partial line around until the rest of it
+			// is written
+			w.buf.WriteString(line)
+			break
+		}
+		w.log(line)
+	}
+
+	return len(p), nil
+}
+
+// Flush logs anything left over that didn't end with a new line
+func (w *agentHookLogWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buf.Len() > 0 {
+		w.log(w.buf.String())
+		w.buf.Reset()
+	}
+}
+
+func (w *agentHookLogWriter) log(line string) {
+	line = strings.TrimRight(line, "\r\n")
+	if line != "" {
+		logger.Info("[%s] %s", w.name, line)
+	}
+}
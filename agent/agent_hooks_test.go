@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunningAgentHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not tested on windows yet")
+	}
+
+	hooksPath, err := ioutil.TempDir("", "agent-hooks-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hooksPath)
+
+	config := &AgentConfiguration{HooksPath: hooksPath}
+	agent := &api.Agent{Name: "my-agent", Tags: []string{"queue=default", "llamas=true"}}
+
+	// A missing hook isn't an error
+	assert.NoError(t, RunAgentHook(config, agent, AgentStartupHook))
+
+	output := filepath.Join(hooksPath, "output")
+	startup := "#!/bin/bash\necho \"$BUILDKITE_AGENT_NAME $BUILDKITE_AGENT_TAGS\" > " + output + "\n"
+	if err = ioutil.WriteFile(filepath.Join(hooksPath, AgentStartupHook), []byte(startup), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, RunAgentHook(config, agent, AgentStartupHook))
+
+	data, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Equal(t, "my-agent queue=default,llamas=true\n", string(data))
+
+	if err = ioutil.WriteFile(filepath.Join(hooksPath, AgentShutdownHook), []byte("#!/bin/bash\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Error(t, RunAgentHook(config, agent, AgentShutdownHook))
+}
+
+func TestAgentsWhoseStartupHookFailsAreDisconnected(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not tested on windows yet")
+	}
+
+	hooksPath, err := ioutil.TempDir("", "agent-hooks-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hooksPath)
+
+	if err = ioutil.WriteFile(filepath.Join(hooksPath, AgentStartupHook), []byte("#!/bin/bash\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	disconnected := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /register":
+			w.Write([]byte(`{"name": "my-agent", "access_token": "llamas"}`))
+		case "POST /disconnect":
+			assert.Equal(t, "Token llamas", r.Header.Get("Authorization"))
+			disconnected = true
+			w.Write([]byte(`{}`))
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	pool := &AgentPool{
+		AgentConfiguration: &AgentConfiguration{HooksPath: hooksPath, AgentStartupHookFatal: true},
+		APIClient:          APIClient{Endpoint: server.URL, Token: "registration"}.Create(),
+		Endpoint:           server.URL,
+	}
+
+	_, err = pool.createWorker(&api.Agent{Name: "my-agent"})
+	assert.Error(t, err)
+	assert.True(t, disconnected)
+}
+
+func TestAgentHookTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not tested on windows yet")
+	}
+
+	hooksPath, err := ioutil.TempDir("", "agent-hooks-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hooksPath)
+
+	if err = ioutil.WriteFile(filepath.Join(hooksPath, AgentStartupHook), []byte("#!/bin/bash\nsleep 30\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &AgentConfiguration{HooksPath: hooksPath, HookTimeout: 1}
+
+	err = RunAgentHook(config, &api.Agent{Name: "my-agent"}, AgentStartupHook)
+	assert.EqualError(t, err, "The agent-startup hook timed out after 1s")
+}
+
+func TestAgentHookLogWriterSplitsLines(t *testing.T) {
+	w := &agentHookLogWriter{name: "agent-startup"}
+
+	w.Write([]byte("llamas\nalp"))
+	assert.Equal(t, "alp", w.buf.String())
+
+	w.Write([]byte("acas\n"))
+	assert.Equal(t, "", w.buf.String())
+
+	w.Write([]byte("no new line"))
+	w.Flush()
+	assert.Equal(t, "", w.buf.String())
+}
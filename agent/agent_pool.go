@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/events"
 	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/metrics"
 	"github.com/buildkite/agent/retry"
 	"github.com/buildkite/agent/signalwatcher"
 	"github.com/buildkite/agent/system"
@@ -27,90 +30,445 @@ type AgentPool struct {
 	TagsFromGCP           bool
 	WaitForEC2TagsTimeout time.Duration
 	Endpoint              string
+	MetricsAddr           string
+	MetricsDatadogHost    string
+	CloudWatchNamespace   string
+	EventTargets          []string
+	HealthCheckAddr       string
+	ControlSocket         string
 	AgentConfiguration    *AgentConfiguration
+	Spawn                 int
+	WorkerPools           []WorkerPool
+
+	// Reload is called to load the configuration again when the agent is
+	// sent a SIGHUP. The agent doesn't reload if it's nil.
+	Reload func() (*ReloadableConfiguration, error)
 
 	interruptCount int
 	signalLock     sync.Mutex
+
+	// The template the workers are created from, and the workers that
+	// are running, along with the template each was created from
+	template    *api.Agent
+	health      *HealthCheck
+	workers     []*poolWorker
+	workersLock sync.Mutex
+	workersWG   sync.WaitGroup
+	stopping    bool
+	draining    bool
+	restarting  bool
+	reloadLock  sync.Mutex
+
+	// The control socket, and when the agent started for its status
+	control   controlListener
+	startedAt time.Time
+
+	// The locks held by jobs, which are shared by all of the workers
+	locks *localLocks
+
+	// Cleans up the build path for all of the workers, if it's turned on
+	janitor *Janitor
+
+	// Cleans up after Docker for all of the workers, if it's turned on
+	dockerGC *DockerGC
+
+	// Mints the tokens of the git credentials helper, if it's configured
+	gitHubApp *GitHubApp
+}
+
+// A worker run by the pool, which is replaced if its template changes when
+// the configuration is reloaded
+type poolWorker struct {
+	template *api.Agent
+	worker   *AgentWorker
+	retired  bool
 }
 
 func (r *AgentPool) Start() error {
+	r.startedAt = time.Now()
+	r.locks = newLocalLocks()
+
+	if c := r.AgentConfiguration; c.JanitorKeepBuilds > 0 || c.JanitorMinFreeSpace > 0 {
+		r.janitor = &Janitor{BuildPath: c.BuildPath, KeepBuilds: c.JanitorKeepBuilds, MinFreeSpace: c.JanitorMinFreeSpace}
+		r.janitor.Start(c.JanitorInterval)
+	}
+
+	if c := r.AgentConfiguration; (c.DockerGCTTL > 0 || c.DockerGCMinFreeSpace > 0) && c.JobExecutor != JobExecutorKubernetes {
+		r.dockerGC = &DockerGC{TTL: c.DockerGCTTL, MinFreeSpace: c.DockerGCMinFreeSpace}
+		r.dockerGC.Start(c.DockerGCInterval)
+	}
+
+	if c := r.AgentConfiguration; c.GitCredentialsProvider == GitCredentialsGitHubApp {
+		app, err := NewGitHubApp(c.GitHubAppID, c.GitHubAppPrivateKeyPath, c.GitHubAppInstallationID, c.GitHubAppHost)
+		if err != nil {
+			return err
+		}
+		r.gitHubApp = app
+	}
+
 	// Show the welcome banner and config options used
 	r.ShowBanner()
 
-	// Create the agent registration API Client
-	r.APIClient = APIClient{Endpoint: r.Endpoint, Token: r.Token}.Create()
+	// Serve metrics before registering, so a bad address is found before
+	// the agent is visible in Buildkite
+	if r.MetricsAddr != "" {
+		if err := metrics.Serve(r.MetricsAddr); err != nil {
+			logger.Fatal("Failed to serve metrics on %s: %s", r.MetricsAddr, err)
+		}
+	}
 
-	// Create the agent template. We use pass this template to the register
-	// call, at which point we get back a real agent.
-	template := r.CreateAgentTemplate()
+	if r.MetricsDatadogHost != "" {
+		statsd, err := metrics.NewStatsD(r.MetricsDatadogHost, true)
+		if err != nil {
+			logger.Fatal("Failed to send metrics to %s: %s", r.MetricsDatadogHost, err)
+		}
+		defer statsd.Close()
 
-	logger.Info("Registering agent with Buildkite...")
+		metrics.AddSink(statsd)
+		logger.Info("Sending metrics to DogStatsD at %s", r.MetricsDatadogHost)
+	}
 
-	// Register the agent
-	registered, err := r.RegisterAgent(template)
-	if err != nil {
-		logger.Fatal("%s", err)
+	// Published from the agent's queue, which is what fleets are usually
+	// scaled by
+	if r.CloudWatchNamespace != "" {
+		cloudWatch, err := newCloudWatchSink(r.CloudWatchNamespace, map[string]string{"Queue": agentQueue(r.Tags)})
+		if err != nil {
+			logger.Fatal("Failed to publish metrics to CloudWatch: %s", err)
+		}
+		cloudWatch.Start()
+		defer cloudWatch.Stop()
+
+		metrics.AddSink(cloudWatch)
+		logger.Info("Publishing metrics to the %s namespace in CloudWatch", r.CloudWatchNamespace)
 	}
 
-	logger.Info("Successfully registered agent \"%s\" with tags %s", registered.Name, registered.Tags)
+	// Send the events of the jobs the agent runs, giving the last of them
+	// a little time to be sent once it's finished
+	if len(r.EventTargets) > 0 {
+		if err := events.Start(r.EventTargets); err != nil {
+			logger.Fatal("Failed to send events: %s", err)
+		}
+		defer events.Stop(10 * time.Second)
+	}
 
-	logger.Debug("Ping interval: %ds", registered.PingInterval)
-	logger.Debug("Job status interval: %ds", registered.JobStatusInterval)
-	logger.Debug("Heartbeat interval: %ds", registered.HearbeatInterval)
+	// Serve the health checks before registering, so probes can tell the
+	// agent is live while it's starting up
+	health := &HealthCheck{}
+	if r.HealthCheckAddr != "" {
+		if err := health.Serve(r.HealthCheckAddr); err != nil {
+			logger.Fatal("Failed to serve health checks on %s: %s", r.HealthCheckAddr, err)
+		}
+	}
 
-	// Now that we have a registered agent, we can connect it to the API,
-	// and start running jobs.
-	worker := AgentWorker{Agent: registered, AgentConfiguration: r.AgentConfiguration, Endpoint: r.Endpoint}.Create()
+	// Create the agent registration API Client
+	r.APIClient = APIClient{Endpoint: r.Endpoint, Token: r.Token}.Create()
 
-	logger.Info("Connecting to Buildkite...")
-	if err := worker.Connect(); err != nil {
-		logger.Fatal("%s", err)
+	// Create the agent templates. We use pass these templates to the
+	// register call, at which point we get back real agents.
+	r.health = health
+	r.template = r.CreateAgentTemplate()
+	templates := r.CreateWorkerTemplates(r.template)
+
+	// The configuration can change once the agent is reloaded, but what
+	// it was started to do can't
+	acquireJob := r.AgentConfiguration.AcquireJob
+	if acquireJob != "" && len(templates) > 1 {
+		logger.Fatal("An agent that acquires a job can only have one worker")
 	}
 
-	logger.Info("Agent successfully connected")
+	for _, template := range templates {
+		worker, err := r.createWorker(template)
+		if err != nil {
+			// The workers that were started are disconnected
+			// before the agent stops, as they would be if it was
+			// stopped
+			for _, w := range r.workers {
+				r.disconnectWorker(w.worker)
+			}
+			return err
+		}
+		r.workers = append(r.workers, &poolWorker{template: template, worker: worker})
+	}
+
+	health.Registered()
+	// Heartbeats can back off, which shouldn't make the agent look wedged
+	heartbeatInterval := time.Second * time.Duration(r.workers[0].worker.Agent.HearbeatInterval)
+	if r.AgentConfiguration.AdaptiveIntervals {
+		heartbeatInterval *= maxIntervalBackoff
+	}
+	health.Connected(heartbeatInterval)
+
+	// Let `buildkite-agent status`, `drain` and `stop` talk to the agent
+	if r.ControlSocket != "" {
+		r.serveControl(r.ControlSocket)
+		defer r.closeControl()
+	}
 	logger.Info("You can press Ctrl-C to stop the agent")
 
-	if r.AgentConfiguration.DisconnectAfterJob {
+	if acquireJob != "" {
+		logger.Info("The agent will run job %s and then disconnect", acquireJob)
+	} else if r.AgentConfiguration.DisconnectAfterJob {
 		logger.Info("Waiting for job to be assigned...")
 		logger.Info("The agent will automatically disconnect after %d seconds if no job is assigned", r.AgentConfiguration.DisconnectAfterJobTimeout)
 	} else {
 		logger.Info("Waiting for work...")
 	}
 
+	if r.AgentConfiguration.DisconnectAfterIdleTimeout > 0 {
+		logger.Info("The agent will automatically disconnect after being idle for %d seconds", r.AgentConfiguration.DisconnectAfterIdleTimeout)
+	}
+
 	// Start a signalwatcher so we can monitor signals and handle shutdowns
 	signalwatcher.Watch(func(sig signalwatcher.Signal) {
+		if sig == signalwatcher.HUP && acquireJob == "" {
+			logger.Debug("Received signal `%s`", sig.String())
+			r.reload()
+			return
+		}
+
 		r.signalLock.Lock()
 		defer r.signalLock.Unlock()
 
 		if sig == signalwatcher.QUIT {
 			logger.Debug("Received signal `%s`", sig.String())
-			worker.Stop(false)
-		} else if sig == signalwatcher.TERM || sig == signalwatcher.INT {
+			r.stop(false)
+		} else if sig == signalwatcher.TERM {
+			// Schedulers send a TERM before killing the agent, so any
+			// running job is cancelled while there's still time for
+			// it's hooks to run and for it to be reported as canceled
+			logger.Debug("Received signal `%s`", sig.String())
+			logger.Info("Received SIGTERM, cancelling any running job and stopping the agent")
+			r.stop(false)
+		} else if sig == signalwatcher.INT {
 			logger.Debug("Received signal `%s`", sig.String())
 			if r.interruptCount == 0 {
 				r.interruptCount++
 				logger.Info("Received CTRL-C, send again to forcefully kill the agent")
-				worker.Stop(true)
+				r.stop(true)
 			} else {
 				logger.Info("Forcefully stopping running jobs and stopping the agent")
-				worker.Stop(false)
+				r.stop(false)
 			}
 		} else {
 			logger.Debug("Ignoring signal `%s`", sig.String())
 		}
 	})
 
-	// Starts the agent worker. This will block until the agent has
-	// finished or is stopped.
-	if err := worker.Start(); err != nil {
-		logger.Fatal("%s", err)
+	// Either run the one job the agent was started for, or start the
+	// agent workers. Both block until the agent has finished or is
+	// stopped.
+	var result error
+	if acquireJob != "" {
+		worker := r.workers[0].worker
+		exitStatus, err := worker.AcquireAndRunJob(acquireJob)
+		if err != nil {
+			result = err
+		} else if exitStatus != 0 {
+			result = &JobExitError{ExitStatus: exitStatus}
+		}
+		r.disconnectWorker(worker)
+	} else {
+		r.workersLock.Lock()
+		for _, w := range r.workers {
+			r.runWorker(w)
+		}
+		r.workersLock.Unlock()
+
+		r.workersWG.Wait()
+	}
+
+	health.Disconnected()
+
+	r.workersLock.Lock()
+	restarting := r.restarting
+	r.workersLock.Unlock()
+
+	if result == nil && restarting {
+		return ErrRestart
 	}
 
-	// Now that the agent has stopped, we can disconnect it
+	return result
+}
+
+// Registers an agent from the template and connects it, ready to be started
+func (r *AgentPool) createWorker(template *api.Agent) (*AgentWorker, error) {
+	logger.Info("Registering agent with Buildkite...")
+
+	// Register the agent
+	registered, err := r.RegisterAgent(template)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Successfully registered agent \"%s\" with tags %s", registered.Name, registered.Tags)
+
+	logger.Debug("Ping interval: %ds", registered.PingInterval)
+	logger.Debug("Job status interval: %ds", registered.JobStatusInterval)
+	logger.Debug("Heartbeat interval: %ds", registered.HearbeatInterval)
+
+	worker := AgentWorker{Agent: registered, AgentConfiguration: r.AgentConfiguration, Endpoint: r.Endpoint, HealthCheck: r.health, locks: r.locks, janitor: r.janitor, dockerGC: r.dockerGC}.Create()
+
+	// Give the agent-startup hook a chance to provision things before
+	// the agent connects and starts accepting jobs. An agent that isn't
+	// started is disconnected, so it doesn't stay registered.
+	if err := RunAgentHook(r.AgentConfiguration, registered, AgentStartupHook); err != nil {
+		if r.AgentConfiguration.AgentStartupHookFatal {
+			worker.Disconnect()
+			return nil, err
+		}
+		logger.Error("%s", err)
+	}
+
+	// Now that we have a registered agent, we can connect it to the API,
+	// and start running jobs.
+
+	logger.Info("Connecting to Buildkite...")
+	if err := worker.Connect(); err != nil {
+		return nil, err
+	}
+
+	logger.Info("Agent successfully connected")
+
+	return &worker, nil
+}
+
+// Starts a worker in the background, disconnecting it and removing it from
+// the pool once it stops. It's called with the workers locked.
+func (r *AgentPool) runWorker(w *poolWorker) {
+	r.workersWG.Add(1)
+	go func() {
+		defer r.workersWG.Done()
+
+		workersRunning.Inc()
+		updateUtilization()
+		defer func() {
+			workersRunning.Dec()
+			updateUtilization()
+		}()
+
+		if err := w.worker.Start(); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		r.disconnectWorker(w.worker)
+
+		r.workersLock.Lock()
+		defer r.workersLock.Unlock()
+		for i := range r.workers {
+			if r.workers[i] == w {
+				r.workers = append(r.workers[:i], r.workers[i+1:]...)
+				break
+			}
+		}
+	}()
+}
+
+// Now that the agent has stopped, we can disconnect it
+func (r *AgentPool) disconnectWorker(worker *AgentWorker) {
 	logger.Info("Disconnecting %s...", worker.Agent.Name)
 	worker.Disconnect()
 
-	return nil
+	if err := RunAgentHook(worker.configuration(), worker.Agent, AgentShutdownHook); err != nil {
+		logger.Error("%s", err)
+	}
+}
+
+// Stops all of the workers together
+func (r *AgentPool) stop(graceful bool) {
+	r.workersLock.Lock()
+	defer r.workersLock.Unlock()
+
+	r.stopping = true
+	for _, w := range r.workers {
+		w.worker.Stop(graceful)
+	}
+}
+
+// Stops the workers once their jobs have finished, so the agent can be
+// restarted with a new binary without cancelling any of them
+func (r *AgentPool) restart() {
+	r.workersLock.Lock()
+	if !r.restarting {
+		logger.Info("Restarting the agent once its jobs have finished, as requested by `buildkite-agent self-update`")
+		r.restarting = true
+	}
+	r.workersLock.Unlock()
+
+	r.stop(true)
+}
+
+// JobExitError is returned from Start when the agent was started to run a
+// specific job, and that job failed
+type JobExitError struct {
+	ExitStatus int
+}
+
+func (e *JobExitError) Error() string {
+	return fmt.Sprintf("The job exited with status %d", e.ExitStatus)
+}
+
+// WorkerPool is a group of identical workers run by the agent, such as the
+// workers for one queue. Tags replace the agent's tags, and the name and
+// priority default to the agent's.
+type WorkerPool struct {
+	Name      string
+	Spawn     int
+	AgentName string
+	Priority  string
+	Tags      []string
+}
+
+// Takes the agent template and returns a template for each of the workers the
+// agent runs, which is Spawn copies of it unless worker pools are configured.
+// "%spawn" in the name of a worker is replaced with its number, which is added
+// to the end of the name if there's more than one worker and the name isn't
+// otherwise made unique.
+func (r *AgentPool) CreateWorkerTemplates(template *api.Agent) []*api.Agent {
+	pools := r.WorkerPools
+	if len(pools) == 0 {
+		spawn := r.Spawn
+		if spawn < 1 {
+			spawn = 1
+		}
+		pools = []WorkerPool{{Spawn: spawn}}
+	}
+
+	total := 0
+	for _, pool := range pools {
+		total += pool.Spawn
+	}
+
+	// Tags found from EC2 and GCP are added after the agent's own, and
+	// every worker gets those
+	discovered := template.Tags[len(r.Tags):]
+
+	var templates []*api.Agent
+	for _, pool := range pools {
+		for i := 1; i <= pool.Spawn; i++ {
+			worker := *template
+
+			if pool.AgentName != "" {
+				worker.Name = pool.AgentName
+			}
+			if pool.Priority != "" {
+				worker.Priority = pool.Priority
+			}
+			if pool.Tags != nil {
+				worker.Tags = append(append([]string{}, pool.Tags...), discovered...)
+			}
+
+			number := fmt.Sprintf("%d", len(templates)+1)
+			if strings.Contains(worker.Name, "%spawn") {
+				worker.Name = strings.Replace(worker.Name, "%spawn", number, -1)
+			} else if total > 1 && worker.Name != "" && !strings.Contains(worker.Name, "%n") {
+				worker.Name = worker.Name + "-" + number
+			}
+
+			templates = append(templates, &worker)
+		}
+	}
+
+	return templates
 }
 
 // Takes the options passed to the CLI, and creates an api.Agent record that
@@ -232,8 +590,8 @@ func (r *AgentPool) RegisterAgent(agent *api.Agent) (*api.Agent, error) {
 		return err
 	}
 
-	// Try to register, retrying every 10 seconds for a maximum of 30 attempts (5 minutes)
-	err = retry.Do(register, &retry.Config{Maximum: 30, Interval: 10 * time.Second})
+	// Try to register, backing off from 10 seconds for a maximum of 30 attempts
+	err = retry.Do(register, apiRetryConfig("register", 30, 10*time.Second))
 
 	return registered, err
 }
@@ -252,10 +610,13 @@ func (r *AgentPool) ShowBanner() {
 			"                                                __/ |\n" +
 			" http://buildkite.com/agent                    |___/\n%s\n"
 
-	if logger.ColorsEnabled() {
-		fmt.Fprintf(logger.OutputPipe(), welcomeMessage, "\x1b[32m", "\x1b[0m")
-	} else {
-		fmt.Fprintf(logger.OutputPipe(), welcomeMessage, "", "")
+	// The banner would just get in the way of structured logs
+	if logger.GetFormat() != logger.JSONFormat {
+		if logger.ColorsEnabled() {
+			fmt.Fprintf(logger.OutputPipe(), welcomeMessage, "\x1b[32m", "\x1b[0m")
+		} else {
+			fmt.Fprintf(logger.OutputPipe(), welcomeMessage, "", "")
+		}
 	}
 
 	logger.Notice("Starting buildkite-agent v%s with PID: %s", Version(), fmt.Sprintf("%d", os.Getpid()))
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateWorkerTemplatesSpawnsCopiesOfTheAgent(t *testing.T) {
+	t.Parallel()
+
+	pool := &AgentPool{Spawn: 3, Tags: []string{"queue=default"}}
+	templates := pool.CreateWorkerTemplates(&api.Agent{Name: "llama", Tags: []string{"queue=default"}})
+
+	var names []string
+	for _, template := range templates {
+		names = append(names, template.Name)
+		assert.Equal(t, []string{"queue=default"}, template.Tags)
+	}
+	assert.Equal(t, []string{"llama-1", "llama-2", "llama-3"}, names)
+}
+
+func TestCreateWorkerTemplatesForWorkerPools(t *testing.T) {
+	t.Parallel()
+
+	pool := &AgentPool{
+		Tags: []string{"queue=default"},
+		WorkerPools: []WorkerPool{
+			{Name: "linux", Spawn: 2, Tags: []string{"queue=linux"}},
+			{Name: "deploy", Spawn: 1, AgentName: "deploy-%spawn", Priority: "10", Tags: []string{"queue=deploy"}},
+		},
+	}
+
+	// The agent has an EC2 tag as well as its own, which every worker gets
+	templates := pool.CreateWorkerTemplates(&api.Agent{
+		Name:     "%hostname-%n",
+		Priority: "1",
+		Tags:     []string{"queue=default", "aws:instance-id=i-123"},
+	})
+
+	if len(templates) != 3 {
+		t.Fatalf("Expected 3 workers, got %d", len(templates))
+	}
+
+	assert.Equal(t, "%hostname-%n", templates[0].Name)
+	assert.Equal(t, "1", templates[0].Priority)
+	assert.Equal(t, []string{"queue=linux", "aws:instance-id=i-123"}, templates[0].Tags)
+	assert.Equal(t, []string{"queue=linux", "aws:instance-id=i-123"}, templates[1].Tags)
+
+	assert.Equal(t, "deploy-3", templates[2].Name)
+	assert.Equal(t, "10", templates[2].Priority)
+	assert.Equal(t, []string{"queue=deploy", "aws:instance-id=i-123"}, templates[2].Tags)
+}
+
+func TestReloadKeepsWorkersThatHaveNotChanged(t *testing.T) {
+	pool := &AgentPool{
+		Spawn:              3,
+		Tags:               []string{"queue=default"},
+		AgentConfiguration: &AgentConfiguration{HooksPath: "/old/hooks"},
+		template:           &api.Agent{Name: "llama", Tags: []string{"queue=default"}},
+		health:             &HealthCheck{},
+	}
+
+	for _, template := range pool.CreateWorkerTemplates(pool.template) {
+		worker := &AgentWorker{Agent: &api.Agent{Name: template.Name}, AgentConfiguration: pool.AgentConfiguration, HealthCheck: pool.health}
+		pool.workers = append(pool.workers, &poolWorker{template: template, worker: worker})
+	}
+
+	// One less worker is wanted now, and the hooks have moved
+	pool.Reload = func() (*ReloadableConfiguration, error) {
+		return &ReloadableConfiguration{Spawn: 2, Tags: []string{"queue=default"}, HooksPath: "/new/hooks"}, nil
+	}
+	pool.reload()
+
+	assert.False(t, pool.workers[0].retired)
+	assert.False(t, pool.workers[1].retired)
+	assert.True(t, pool.workers[2].retired)
+	assert.True(t, pool.workers[2].worker.stopping)
+
+	for _, w := range pool.workers {
+		assert.Equal(t, "/new/hooks", w.worker.configuration().HooksPath)
+	}
+
+	// Replacing a worker doesn't stop the agent being ready for jobs
+	pool.health.Registered()
+	pool.health.Connected(time.Minute)
+	assert.NoError(t, pool.health.Ready())
+}
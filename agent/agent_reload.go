@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"reflect"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+)
+
+// ReloadableConfiguration is the configuration that can be changed while the
+// agent is running, by sending it a SIGHUP
+type ReloadableConfiguration struct {
+	Tags          []string
+	Spawn         int
+	WorkerPools   []WorkerPool
+	HooksPath     string
+	HooksOverlays []string
+	PluginsPath   string
+	Debug         bool
+}
+
+// Loads the configuration again and applies it without dropping any jobs that
+// are running. The log level and paths are changed straight away, and when the
+// tags or number of workers change, workers that are no longer needed finish
+// their current job before disconnecting, and new workers are registered.
+func (r *AgentPool) reload() {
+	if r.Reload == nil {
+		logger.Info("Ignoring SIGHUP, as the agent's configuration can't be reloaded")
+		return
+	}
+
+	// Only one reload at a time, as registering new workers takes a while
+	r.reloadLock.Lock()
+	defer r.reloadLock.Unlock()
+
+	logger.Info("Reloading the agent's configuration...")
+
+	reloaded, err := r.Reload()
+	if err != nil {
+		logger.Error("Failed to reload the agent's configuration: %s", err)
+		return
+	}
+
+	if reloaded.Debug {
+		logger.SetLevel(logger.DEBUG)
+	} else {
+		logger.SetLevel(logger.INFO)
+	}
+
+	config := *r.AgentConfiguration
+	config.HooksPath = reloaded.HooksPath
+	config.HooksOverlays = reloaded.HooksOverlays
+	config.PluginsPath = reloaded.PluginsPath
+
+	r.workersLock.Lock()
+
+	if r.stopping {
+		r.workersLock.Unlock()
+		logger.Info("Not reloading the agent's configuration, as it's stopping")
+		return
+	}
+
+	r.AgentConfiguration = &config
+	for _, w := range r.workers {
+		w.worker.SetConfiguration(&config)
+	}
+
+	// Tags found from EC2 and GCP aren't looked up again, and stay after
+	// the agent's own tags
+	template := *r.template
+	discovered := r.template.Tags[len(r.Tags):]
+	template.Tags = append(append([]string{}, reloaded.Tags...), discovered...)
+
+	r.Tags = reloaded.Tags
+	r.Spawn = reloaded.Spawn
+	r.WorkerPools = reloaded.WorkerPools
+	r.template = &template
+
+	// Keep the workers that are still wanted, and retire the rest
+	wanted := r.CreateWorkerTemplates(r.template)
+	for _, w := range r.workers {
+		if w.retired {
+			continue
+		}
+
+		if i := indexOfTemplate(wanted, w.template); i >= 0 {
+			wanted = append(wanted[:i], wanted[i+1:]...)
+			continue
+		}
+
+		logger.Info("Stopping %s, as it's no longer in the configuration", w.worker.Agent.Name)
+		w.retired = true
+		w.worker.Retire()
+	}
+
+	r.workersLock.Unlock()
+
+	// Register the new workers without the workers locked, so the agent
+	// can still be stopped while they're registering
+	for _, template := range wanted {
+		worker, err := r.createWorker(template)
+		if err != nil {
+			logger.Error("Failed to start a new agent: %s", err)
+			continue
+		}
+
+		r.workersLock.Lock()
+		if r.stopping {
+			r.workersLock.Unlock()
+			r.disconnectWorker(worker)
+			continue
+		}
+
+		if r.draining {
+			worker.Drain()
+		}
+
+		w := &poolWorker{template: template, worker: worker}
+		r.workers = append(r.workers, w)
+		r.runWorker(w)
+		r.workersLock.Unlock()
+	}
+
+	logger.Info("Successfully reloaded the agent's configuration")
+}
+
+// Returns the index of the template with the same name, priority and tags, or
+// -1 if there isn't one
+func indexOfTemplate(templates []*api.Agent, template *api.Agent) int {
+	for i, t := range templates {
+		if t.Name == template.Name && t.Priority == template.Priority && reflect.DeepEqual(t.Tags, template.Tags) {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -1,7 +1,9 @@
 package agent
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -12,6 +14,9 @@ import (
 	"github.com/buildkite/agent/retry"
 )
 
+// How long the API is asked to hold a long poll open waiting for a job
+const longPollWait = 30 * time.Second
+
 type AgentWorker struct {
 	// The API Client used when this agent is communicating with the API
 	APIClient *api.Client
@@ -25,15 +30,49 @@ type AgentWorker struct {
 	// The configuration of the agent from the CLI
 	AgentConfiguration *AgentConfiguration
 
+	// Tracks whether the agent is healthy, and ready to run jobs
+	HealthCheck *HealthCheck
+
 	// Whether or not the agent is running
 	running bool
 
-	// Used by the Start call to control the looping of the pings
-	ticker *time.Ticker
+	// Whether the agent has been stopped because it's being replaced after
+	// the configuration was reloaded
+	retired bool
+
+	// Whether the agent has stopped accepting jobs, while staying connected
+	draining bool
+
+	// Whether the last ping was long polled, so the next one can start
+	// straight away, and whether the API has said it doesn't support it
+	longPolling         bool
+	longPollUnsupported bool
+
+	// Cancels the long poll in progress, so stopping or draining doesn't
+	// wait for it to be answered
+	pollCancel context.CancelFunc
+
+	// Locks the configuration, which can be changed when it's reloaded
+	configLock sync.Mutex
+
+	// Backs off the pings and heartbeats while the agent is idle, if the
+	// intervals are adaptive
+	backoff *intervalBackoff
+
+	// The jobs the server pushes to the agent, which are pinged for
+	// straight away rather than waiting for the next ping
+	jobsAssigned <-chan string
 
 	// Tracking the auto disconnect timer
 	disconnectTimeoutTimer *time.Timer
 
+	// When the agent last finished a job, or started if it hasn't run one,
+	// which is used to disconnect after being idle
+	idleSince time.Time
+
+	// Whether job acceptance has been paused because the API is failing
+	paused bool
+
 	// Stop controls
 	stop      chan struct{}
 	stopping  bool
@@ -42,6 +81,17 @@ type AgentWorker struct {
 	// When this worker runs a job, we'll store an instance of the
 	// JobRunner here
 	jobRunner *JobRunner
+
+	// The locks jobs hold on this machine, which the job releases when it
+	// finishes if it hasn't already
+	locks *localLocks
+
+	// Removes old checkouts from the build path between jobs, if it's
+	// turned on
+	janitor *Janitor
+
+	// Removes what Docker jobs leave behind between jobs, if it's turned on
+	dockerGC *DockerGC
 }
 
 // Creates the agent worker and initializes it's API Client
@@ -53,7 +103,9 @@ func (a AgentWorker) Create() AgentWorker {
 		endpoint = a.Endpoint
 	}
 
-	a.APIClient = APIClient{Endpoint: endpoint, Token: a.Agent.AccessToken}.Create()
+	apiClient := APIClient{Endpoint: endpoint, Token: a.Agent.AccessToken}
+	a.APIClient = apiClient.Create()
+	a.jobsAssigned = apiClient.JobsAssigned()
 
 	return a
 }
@@ -62,34 +114,28 @@ func (a AgentWorker) Create() AgentWorker {
 func (a *AgentWorker) Start() error {
 	// Mark the agent as running
 	a.running = true
+	a.idleSince = time.Now()
 
 	// Create the intervals we'll be using
 	pingInterval := time.Second * time.Duration(a.Agent.PingInterval)
 	heartbeatInterval := time.Second * time.Duration(a.Agent.HearbeatInterval)
 
-	// Setup and start the heartbeater
-	go func() {
-		// Keep the heartbeat running as long as the agent is
-		for a.running {
-			err := a.Heartbeat()
-			if err != nil {
-				logger.Error("Failed to heartbeat %s. Will try again in %s", err, heartbeatInterval)
-			}
+	if a.configuration().AdaptiveIntervals {
+		a.backoff = newIntervalBackoff()
+	}
 
-			time.Sleep(heartbeatInterval)
-		}
-	}()
+	// Setup and start the heartbeater
+	a.startHeartbeats(heartbeatInterval)
 
-	// Create the ticker and stop channels
-	a.ticker = time.NewTicker(pingInterval)
+	// Create the stop channel
 	a.stop = make(chan struct{})
 
 	// Setup a timer to automatically disconnect if no job has started
-	if a.AgentConfiguration.DisconnectAfterJob {
-		a.disconnectTimeoutTimer = time.NewTimer(time.Second * time.Duration(a.AgentConfiguration.DisconnectAfterJobTimeout))
+	if a.configuration().DisconnectAfterJob {
+		a.disconnectTimeoutTimer = time.NewTimer(time.Second * time.Duration(a.configuration().DisconnectAfterJobTimeout))
 		go func() {
 			<-a.disconnectTimeoutTimer.C
-			logger.Debug("[DisconnectionTimer] Reached %d seconds...", a.AgentConfiguration.DisconnectAfterJobTimeout)
+			logger.Debug("[DisconnectionTimer] Reached %d seconds...", a.configuration().DisconnectAfterJobTimeout)
 
 			// Just double check that the agent isn't running a
 			// job. The timer is stopped just after this is
@@ -104,29 +150,132 @@ func (a *AgentWorker) Start() error {
 			}
 		}()
 
-		logger.Debug("[DisconnectionTimer] Started for %d seconds...", a.AgentConfiguration.DisconnectAfterJobTimeout)
+		logger.Debug("[DisconnectionTimer] Started for %d seconds...", a.configuration().DisconnectAfterJobTimeout)
 	}
 
-	// Continue this loop until the the ticker is stopped, and we received
-	// a message on the stop channel.
+	// Continue this loop until we receive a message on the stop channel
 	for {
-		if !a.stopping {
+		if !a.stopping && !a.isDraining() {
 			a.Ping()
 		}
 
+		// Long polls have already waited for a job, so the next one
+		// starts straight away
+		if a.longPolling {
+			select {
+			case <-a.stop:
+			default:
+				continue
+			}
+		}
+
+		// Wait for the next ping, which is later while the agent's
+		// backed off
+		timer := time.NewTimer(a.backoff.Apply(pingInterval))
+
 		select {
-		case <-a.ticker.C:
+		case <-timer.C:
+			continue
+		case id := <-a.jobsAssigned:
+			timer.Stop()
+			logger.Debug("Job %s was assigned to the agent, pinging for it", id)
 			continue
 		case <-a.stop:
-			a.ticker.Stop()
+			timer.Stop()
+
+			// Mark the agent as not running anymore, which stops
+			// the heartbeats before the agent disconnects
+			a.running = false
+
 			return nil
 		}
 	}
+}
 
-	// Mark the agent as not running anymore
-	a.running = false
+// Heartbeats in the background for as long as the agent is running
+func (a *AgentWorker) startHeartbeats(interval time.Duration) {
+	go func() {
+		// Keep the heartbeat running as long as the agent is
+		for a.running {
+			next := a.backoff.Apply(interval)
 
-	return nil
+			err := a.Heartbeat()
+			if err != nil {
+				logger.Error("Failed to heartbeat %s. Will try again in %s", err, next)
+			}
+
+			time.Sleep(next)
+		}
+	}()
+}
+
+// How long to wait before trying to acquire a job again, which is a variable
+// so the tests don't have to wait
+var acquireJobRetryInterval = 5 * time.Second
+
+// AcquireAndRunJob acquires a specific job, rather than pinging to be
+// assigned one, and runs it. It returns the job's exit status, or an error if
+// the job couldn't be acquired or run.
+func (a *AgentWorker) AcquireAndRunJob(id string) (int, error) {
+	a.running = true
+	defer func() { a.running = false }()
+
+	a.startHeartbeats(time.Second * time.Duration(a.Agent.HearbeatInterval))
+
+	a.UpdateProcTitle(fmt.Sprintf("acquiring job %s", strings.Split(id, "-")[0]))
+	logger.Info("Acquiring job %s...", id)
+
+	// The job might not be ready to run yet, i.e. it's waiting on another
+	// step, in which case Buildkite says it's locked and it's tried again
+	var acquired *api.Job
+	err := retry.Do(func(s *retry.Stats) error {
+		var resp *api.Response
+		var err error
+
+		acquired, resp, err = a.APIClient.Jobs.Acquire(id)
+		if err != nil {
+			if a.stopping {
+				s.Break()
+			} else if resp != nil && resp.StatusCode == 423 {
+				logger.Warn("Job %s isn't ready to run yet (%s)", id, s)
+			} else if api.IsRetryableError(err) {
+				logger.Warn("%s (%s)", err, s)
+			} else {
+				s.Break()
+			}
+		}
+
+		return err
+	}, &retry.Config{Maximum: 10, Interval: acquireJobRetryInterval, Exponential: true, MaxInterval: time.Minute})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to acquire job %s: %v", id, err)
+	}
+
+	a.UpdateProcTitle(fmt.Sprintf("job %s", strings.Split(acquired.ID, "-")[0]))
+
+	a.jobRunner, err = JobRunner{
+		Endpoint:           acquired.Endpoint,
+		Agent:              a.Agent,
+		AgentConfiguration: a.configuration(),
+		Job:                acquired,
+	}.Create()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to initialize job: %v", err)
+	}
+
+	if err = a.runJob(acquired); err != nil {
+		return 0, fmt.Errorf("Failed to run job: %v", err)
+	}
+
+	exitStatus, err := strconv.Atoi(a.jobRunner.process.ExitStatus)
+	a.jobRunner = nil
+	if err != nil {
+		// The job finished without an exit status, i.e. it couldn't
+		// be started
+		return 1, nil
+	}
+
+	return exitStatus, nil
 }
 
 // Stops the agent from accepting new work and cancels any current work it's
@@ -157,7 +306,7 @@ func (a *AgentWorker) Stop(graceful bool) {
 			// Kill the current job. Doesn't do anything if the job
 			// is already being killed, so it's safe to call
 			// multiple times.
-			a.jobRunner.Kill()
+			a.jobRunner.Kill(CancelReasonAgentStopping)
 		} else {
 			logger.Info("Forcefully stopping agent. Since there is no job running, the agent will disconnect immediately")
 		}
@@ -172,17 +321,116 @@ func (a *AgentWorker) Stop(graceful bool) {
 	// Update the proc title
 	a.UpdateProcTitle("stopping")
 
-	// If we have a ticker, stop it, and send a signal to the stop channel,
-	// which will cause the agent worker to stop looping immediatly.
-	if a.ticker != nil {
+	// Stop being ready for jobs while the agent drains, unless it's only
+	// this agent that's being replaced
+	if !a.retired {
+		a.HealthCheck.Draining()
+	}
+
+	// If the agent worker has started, send a signal to the stop channel,
+	// which will cause it to stop looping immediatly.
+	if a.stop != nil {
 		close(a.stop)
 	}
 
+	if a.pollCancel != nil {
+		a.pollCancel()
+	}
+
 	// Mark the agent as stopping
 	a.stopping = true
 }
 
-// Connects the agent to the Buildkite Agent API, retrying up to 30 times if it
+// Drain stops the agent accepting new jobs, letting any job it's running
+// finish. It stays connected until it's stopped.
+func (a *AgentWorker) Drain() {
+	a.stopMutex.Lock()
+	defer a.stopMutex.Unlock()
+
+	if a.draining {
+		return
+	}
+
+	if a.jobRunner != nil {
+		logger.Info("Draining %s. It will finish the current job and then not accept any more", a.Agent.Name)
+	} else {
+		logger.Info("Draining %s. It won't accept any more jobs", a.Agent.Name)
+	}
+
+	if a.pollCancel != nil {
+		a.pollCancel()
+	}
+
+	a.draining = true
+	a.UpdateProcTitle("draining")
+}
+
+func (a *AgentWorker) isDraining() bool {
+	a.stopMutex.Lock()
+	defer a.stopMutex.Unlock()
+
+	return a.draining
+}
+
+// WorkerStatus is what an agent is doing, as shown by `buildkite-agent status`
+type WorkerStatus struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	JobID string `json:"job_id,omitempty"`
+}
+
+// Status returns what the agent is doing
+func (a *AgentWorker) Status() WorkerStatus {
+	a.stopMutex.Lock()
+	defer a.stopMutex.Unlock()
+
+	status := WorkerStatus{Name: a.Agent.Name, State: "idle"}
+	if runner := a.jobRunner; runner != nil {
+		status.State = "running"
+		status.JobID = runner.Job.ID
+	}
+
+	if a.stopping {
+		status.State = "stopping"
+	} else if a.draining {
+		status.State = "draining"
+	} else if a.paused {
+		status.State = "paused"
+	} else if !a.running {
+		status.State = "connecting"
+	}
+
+	return status
+}
+
+// Gracefully stops an agent that's being replaced after the configuration was
+// reloaded, letting any job it's running finish
+func (a *AgentWorker) Retire() {
+	a.stopMutex.Lock()
+	a.retired = true
+	a.stopMutex.Unlock()
+
+	a.Stop(true)
+}
+
+// Returns the configuration the agent runs jobs with
+func (a *AgentWorker) configuration() *AgentConfiguration {
+	a.configLock.Lock()
+	defer a.configLock.Unlock()
+
+	return a.AgentConfiguration
+}
+
+// SetConfiguration changes the configuration that jobs the agent runs from now
+// on are run with. Any job that's already running keeps using the old one.
+func (a *AgentWorker) SetConfiguration(config *AgentConfiguration) {
+	a.configLock.Lock()
+	defer a.configLock.Unlock()
+
+	a.AgentConfiguration = config
+}
+
+// Connects the agent to the Buildkite Agent API, retrying up to 10 times if it
 // fails.
 func (a *AgentWorker) Connect() error {
 	// Update the proc title
@@ -195,7 +443,7 @@ func (a *AgentWorker) Connect() error {
 		}
 
 		return err
-	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+	}, apiRetryConfig("connect", 10, 5*time.Second))
 }
 
 // Performs a heatbeat
@@ -205,12 +453,18 @@ func (a *AgentWorker) Heartbeat() error {
 
 	// Retry the heartbeat a few times
 	err = retry.Do(func(s *retry.Stats) error {
+		ts := time.Now()
+
 		beat, _, err = a.APIClient.Heartbeats.Beat()
 		if err != nil {
 			logger.Warn("%s (%s)", err, s)
+			return err
 		}
-		return err
-	}, &retry.Config{Maximum: 5, Interval: 5 * time.Second})
+
+		heartbeatDuration.Observe(time.Since(ts).Seconds())
+		a.HealthCheck.Heartbeat()
+		return nil
+	}, apiRetryConfig("heartbeat", 5, 5*time.Second))
 
 	if err != nil {
 		return err
@@ -220,30 +474,64 @@ func (a *AgentWorker) Heartbeat() error {
 	return nil
 }
 
+// Called when the agent couldn't ping Buildkite
+func (a *AgentWorker) resetTimeouts() {
+	// We wan't to reset our disconnection timer. It wouldnt' be very nice
+	// if we just killed the agent because Buildkite was having some
+	// connection issues.
+	if a.disconnectTimeoutTimer != nil {
+		jobTimeoutSeconds := time.Second * time.Duration(a.configuration().DisconnectAfterJobTimeout)
+		a.disconnectTimeoutTimer.Reset(jobTimeoutSeconds)
+
+		logger.Debug("[DisconnectionTimer] Reset back to %d seconds because of ping failure...", a.configuration().DisconnectAfterJobTimeout)
+	}
+
+	// Same goes for the idle timeout, Buildkite might have had a job for us
+	a.idleSince = time.Now()
+}
+
 // Performs a ping, which returns what action the agent should take next.
 func (a *AgentWorker) Ping() {
+	a.longPolling = false
+
+	// Don't ask for jobs while the API is failing, it'll be tried again
+	// once the circuit breaker's cooldown is up
+	if apiIsFailing() {
+		if !a.paused {
+			logger.Warn("The Buildkite API is failing, pausing job acceptance until it recovers")
+			a.paused = true
+		}
+		a.UpdateProcTitle("paused")
+		a.resetTimeouts()
+		return
+	}
+
 	// Update the proc title
 	a.UpdateProcTitle("pinging")
 
-	ping, _, err := a.APIClient.Pings.Get()
+	var ping *api.Ping
+	var err error
+	if a.configuration().LongPoll && !a.longPollUnsupported {
+		ping, err = a.longPoll()
+	} else {
+		ping, _, err = a.APIClient.Pings.Get()
+	}
 	if err != nil {
 		// If a ping fails, we don't really care, because it'll
-		// ping again after the interval.
-		logger.Warn("Failed to ping: %s", err)
-
-		// When the ping fails, we wan't to reset our disconnection
-		// timer. It wouldnt' be very nice if we just killed the agent
-		// because Buildkite was having some connection issues.
-		if a.disconnectTimeoutTimer != nil {
-			jobTimeoutSeconds := time.Second * time.Duration(a.AgentConfiguration.DisconnectAfterJobTimeout)
-			a.disconnectTimeoutTimer.Reset(jobTimeoutSeconds)
-
-			logger.Debug("[DisconnectionTimer] Reset back to %d seconds because of ping failure...", a.AgentConfiguration.DisconnectAfterJobTimeout)
+		// ping again after the interval. Long polls are canceled
+		// when the agent stops, which isn't worth warning about.
+		if !a.stopping && !a.isDraining() {
+			logger.Warn("Failed to ping: %s", err)
 		}
-
+		a.resetTimeouts()
 		return
 	}
 
+	if a.paused {
+		logger.Info("The Buildkite API has recovered, resuming job acceptance")
+		a.paused = false
+	}
+
 	// Should we switch endpoints?
 	if ping.Endpoint != "" && ping.Endpoint != a.Agent.Endpoint {
 		// Before switching to the new one, do a ping test to make sure it's
@@ -277,11 +565,27 @@ func (a *AgentWorker) Ping() {
 		// Update the proc title
 		a.UpdateProcTitle("idle")
 
+		// Back off while there's nothing for the agent, but not if
+		// there are jobs that it could be given soon
+		if ping.JobsQueued {
+			a.backoff.Busy()
+		} else if a.backoff.Idle() {
+			logger.Debug("Nothing to do, backing off to pinging every %s", a.backoff.Apply(time.Second*time.Duration(a.Agent.PingInterval)))
+		}
+
+		// Has the agent been idle for too long?
+		idleTimeout := time.Second * time.Duration(a.configuration().DisconnectAfterIdleTimeout)
+		if idleTimeout > 0 && time.Since(a.idleSince) >= idleTimeout {
+			logger.Info("Agent has been idle for %d seconds. Disconnecting...", a.configuration().DisconnectAfterIdleTimeout)
+			a.Stop(true)
+		}
+
 		return
 	}
 
 	// Update the proc title
 	a.UpdateProcTitle(fmt.Sprintf("job %s", strings.Split(ping.Job.ID, "-")[0]))
+	a.backoff.Busy()
 
 	logger.Info("Assigned job %s. Accepting...", ping.Job.ID)
 
@@ -302,7 +606,7 @@ func (a *AgentWorker) Ping() {
 		}
 
 		return err
-	}, &retry.Config{Maximum: 30, Interval: 5 * time.Second})
+	}, apiRetryConfig("accept", 30, 5*time.Second))
 
 	// If `accepted` is nil, then the job was never accepted
 	if accepted == nil {
@@ -314,7 +618,7 @@ func (a *AgentWorker) Ping() {
 	a.jobRunner, err = JobRunner{
 		Endpoint:           accepted.Endpoint,
 		Agent:              a.Agent,
-		AgentConfiguration: a.AgentConfiguration,
+		AgentConfiguration: a.configuration(),
 		Job:                accepted,
 	}.Create()
 
@@ -331,14 +635,17 @@ func (a *AgentWorker) Ping() {
 	}
 
 	// Start running the job
-	if err = a.jobRunner.Run(); err != nil {
+	if err = a.runJob(accepted); err != nil {
 		logger.Error("Failed to run job: %s", err)
 	}
 
-	// No more job, no more runner.
+	// No more job, no more runner. The job runner has waited for the
+	// job's logs to finish uploading, so it's safe to disconnect from
+	// here on.
 	a.jobRunner = nil
+	a.idleSince = time.Now()
 
-	if a.AgentConfiguration.DisconnectAfterJob {
+	if a.configuration().DisconnectAfterJob {
 		logger.Info("Job finished. Disconnecting...")
 
 		// We can just kill this timer now as well
@@ -351,6 +658,40 @@ func (a *AgentWorker) Ping() {
 	}
 }
 
+// Pings with a long poll, which the API holds open until there's a job. If
+// the API doesn't support them, it goes back to pinging at the interval.
+func (a *AgentWorker) longPoll() (*api.Ping, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a.stopMutex.Lock()
+	if a.stopping || a.draining {
+		a.stopMutex.Unlock()
+		return nil, context.Canceled
+	}
+	a.pollCancel = cancel
+	a.stopMutex.Unlock()
+
+	defer func() {
+		a.stopMutex.Lock()
+		a.pollCancel = nil
+		a.stopMutex.Unlock()
+	}()
+
+	ping, _, err := a.APIClient.WithContext(ctx).Pings.Poll(longPollWait)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ping.LongPolled {
+		logger.Info("The Buildkite API doesn't support long polling, pinging every %d seconds instead", a.Agent.PingInterval)
+		a.longPollUnsupported = true
+	}
+
+	a.longPolling = ping.LongPolled
+	return ping, nil
+}
+
 // Disconnects the agent from the Buildkite Agent API, doesn't bother retrying
 // because we want to disconnect as fast as possible.
 func (a *AgentWorker) Disconnect() error {
@@ -368,3 +709,27 @@ func (a *AgentWorker) Disconnect() error {
 func (a *AgentWorker) UpdateProcTitle(action string) {
 	proctitle.Replace(fmt.Sprintf("buildkite-agent v%s [%s]", Version(), action))
 }
+
+// Runs the job, with the janitor making room for it first and cleaning up
+// after it along with the Docker GC, and releases any locks it still holds
+// once it's finished
+func (a *AgentWorker) runJob(job *api.Job) error {
+	checkout := jobCheckoutPath(a.configuration().BuildPath, a.Agent.Name, job.Env)
+
+	a.janitor.BeforeJob(checkout, job.Env)
+	a.dockerGC.BeforeJob(job.ID)
+	err := a.jobRunner.Run()
+	a.dockerGC.AfterJob(job.ID)
+	a.janitor.AfterJob(checkout, job.Env)
+	a.releaseLocks(job.ID)
+
+	return err
+}
+
+// Releases any locks the job didn't release itself, so they aren't held
+// forever by a job that failed or was cancelled before it could
+func (a *AgentWorker) releaseLocks(jobID string) {
+	if a.locks != nil {
+		a.locks.ReleaseJob(jobID)
+	}
+}
@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/api"
+)
+
+func TestAcquireAndRunJobRetriesUntilTheJobIsReady(t *testing.T) {
+	defer func(interval time.Duration) { acquireJobRetryInterval = interval }(acquireJobRetryInterval)
+	acquireJobRetryInterval = time.Millisecond
+
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/jobs/abc/acquire" {
+			rw.WriteHeader(http.StatusOK)
+			rw.Write([]byte(`{}`))
+			return
+		}
+
+		// The job is locked the first time, then can't be found
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			http.Error(rw, `{"message":"Job isn't ready"}`, http.StatusLocked)
+			return
+		}
+		http.Error(rw, `{"message":"Not found"}`, http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	worker := AgentWorker{
+		Agent:              &api.Agent{AccessToken: "llamas", HearbeatInterval: 60},
+		AgentConfiguration: &AgentConfiguration{},
+		Endpoint:           server.URL,
+	}.Create()
+
+	_, err := worker.AcquireAndRunJob("abc")
+	if err == nil {
+		t.Fatal("Expected an error acquiring a job that can't be found")
+	}
+
+	if got := atomic.LoadInt32(&attempts); got != 2 {
+		t.Fatalf("Expected 2 attempts to acquire the job, got %d", got)
+	}
+}
+
+func TestPingLongPollsUntilTheAPIDoesntSupportIt(t *testing.T) {
+	var polls []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		polls = append(polls, req.URL.Query().Get("wait"))
+
+		// Only the first ping is long polled
+		if len(polls) == 1 {
+			rw.Header().Set("Buildkite-Long-Poll", "true")
+		}
+		rw.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	worker := AgentWorker{
+		Agent:              &api.Agent{AccessToken: "llamas", PingInterval: 10},
+		AgentConfiguration: &AgentConfiguration{LongPoll: true},
+		Endpoint:           server.URL,
+	}.Create()
+
+	worker.Ping()
+	if !worker.longPolling {
+		t.Fatal("Expected the agent to be long polling")
+	}
+
+	worker.Ping()
+	if worker.longPolling || !worker.longPollUnsupported {
+		t.Fatal("Expected the agent to stop long polling once the API didn't hold the ping open")
+	}
+
+	worker.Ping()
+	if len(polls) != 3 || polls[0] != "30" || polls[1] != "30" || polls[2] != "" {
+		t.Fatalf("Expected 2 long polls then a ping, got waits of %q", polls)
+	}
+}
+
+func TestStopCancelsALongPoll(t *testing.T) {
+	polled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		close(polled)
+		<-req.Context().Done()
+	}))
+	defer server.Close()
+
+	worker := AgentWorker{
+		Agent:              &api.Agent{AccessToken: "llamas"},
+		AgentConfiguration: &AgentConfiguration{LongPoll: true},
+		HealthCheck:        &HealthCheck{},
+		Endpoint:           server.URL,
+	}.Create()
+
+	done := make(chan struct{})
+	go func() {
+		worker.Ping()
+		close(done)
+	}()
+
+	<-polled
+	worker.Stop(false)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The long poll wasn't canceled when the agent stopped")
+	}
+}
+
+func TestPingBacksOffUntilJobsAreQueued(t *testing.T) {
+	var queued int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&queued) == 1 {
+			rw.Write([]byte(`{"jobs_queued":true}`))
+			return
+		}
+		rw.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	worker := AgentWorker{
+		Agent:              &api.Agent{AccessToken: "llamas", PingInterval: 10},
+		AgentConfiguration: &AgentConfiguration{AdaptiveIntervals: true},
+		Endpoint:           server.URL,
+		backoff:            newIntervalBackoff(),
+	}.Create()
+
+	worker.Ping()
+	worker.Ping()
+	if got := worker.backoff.Apply(10 * time.Second); got != 40*time.Second {
+		t.Fatalf("Expected the idle agent to back off to 40s, got %s", got)
+	}
+
+	atomic.StoreInt32(&queued, 1)
+	worker.Ping()
+	if got := worker.backoff.Apply(10 * time.Second); got != 10*time.Second {
+		t.Fatalf("Expected the agent to stop backing off once jobs were queued, got %s", got)
+	}
+}
@@ -1,18 +1,48 @@
 package agent
 
 import (
+	"crypto/tls"
 	"net"
 	"net/http"
 	"net/url"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/proxy"
+	"github.com/buildkite/agent/retry"
 	"golang.org/x/net/http2"
 )
 
 var debug = false
 
+// The longest an API call waits between retries
+const apiRetryMaxInterval = 30 * time.Second
+
+var (
+	// The proxy requests go through, if one has been configured
+	httpProxy *proxy.Proxy
+
+	// The client certificate and CA used for mutual TLS, if configured
+	tlsConfig *tls.Config
+
+	// Shared by every API client, so the agent knows when the API is failing
+	breaker *api.CircuitBreaker
+
+	// How many times each endpoint can be retried a minute, across all the
+	// calls to it
+	retryBudget   int
+	retryBudgets  = map[string]*retry.Budget{}
+	retryBudgetMu sync.Mutex
+
+	// The gRPC transports for each endpoint and token, so an agent's
+	// requests and the jobs pushed to it share one stream
+	grpcTransports   = map[string]*api.GRPCTransport{}
+	grpcTransportsMu sync.Mutex
+)
+
 type APIClient struct {
 	Endpoint string
 	Token    string
@@ -22,7 +52,131 @@ func APIClientEnableHTTPDebug() {
 	debug = true
 }
 
+// APIClientConfigureProxy sets up the proxy that API calls go through. It's
+// also used by the default HTTP transport, which artifacts are uploaded and
+// downloaded with.
+func APIClientConfigureProxy(c proxy.Config) error {
+	p, err := proxy.New(c)
+	if err != nil {
+		return err
+	}
+
+	p.Debug = debug
+	httpProxy = p
+
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		p.Configure(t)
+	}
+
+	return nil
+}
+
+// APIClientConfigureTLS sets the client certificate and key that API calls
+// authenticate with, and a CA to trust as well as the system's ones. It's also
+// used by the default HTTP transport, so artifact uploads and downloads can
+// use them too.
+func APIClientConfigureTLS(certFile, keyFile, caFile string) error {
+	config, err := loadTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig = config
+
+	if t, ok := http.DefaultTransport.(*http.Transport); ok && config != nil {
+		t.TLSClientConfig = config.Clone()
+	}
+
+	return nil
+}
+
+// APIClientConfigureRetries sets how many retries each endpoint gets a minute,
+// and how many failed requests in a row mean the API is failing, after which
+// the agent stops accepting jobs until the cooldown is up. Zero disables
+// either of them.
+func APIClientConfigureRetries(budget int, threshold int, cooldown time.Duration) {
+	retryBudgetMu.Lock()
+	retryBudget = budget
+	retryBudgets = map[string]*retry.Budget{}
+	retryBudgetMu.Unlock()
+
+	breaker = nil
+	if threshold > 0 {
+		breaker = api.NewCircuitBreaker(threshold, cooldown)
+	}
+}
+
+// Returns whether the API has been persistently failing
+func apiIsFailing() bool {
+	return breaker.IsOpen()
+}
+
+// Returns the retry budget shared by calls to the endpoint
+func apiRetryBudget(endpoint string) *retry.Budget {
+	retryBudgetMu.Lock()
+	defer retryBudgetMu.Unlock()
+
+	if retryBudget <= 0 {
+		return nil
+	}
+
+	budget, ok := retryBudgets[endpoint]
+	if !ok {
+		budget = retry.NewBudget(retryBudget, time.Minute)
+		retryBudgets[endpoint] = budget
+	}
+	return budget
+}
+
+// Returns the config for retrying calls to the endpoint, which backs off with
+// jitter and gives up early if the endpoint's retry budget has been used up
+func apiRetryConfig(endpoint string, maximum int, interval time.Duration) *retry.Config {
+	return &retry.Config{
+		Maximum:     maximum,
+		Interval:    interval,
+		Exponential: true,
+		Jitter:      true,
+		MaxInterval: apiRetryMaxInterval,
+		Budget:      apiRetryBudget(endpoint),
+	}
+}
+
 func (a APIClient) Create() *api.Client {
+	var transport *api.AuthenticatedTransport
+
+	if api.IsGRPCEndpoint(a.Endpoint) {
+		grpcTransport, err := a.grpcTransport()
+		if err != nil {
+			logger.Fatal("Failed to set up the gRPC transport for %s: %s", a.Endpoint, err)
+		}
+
+		transport = &api.AuthenticatedTransport{
+			Token:     a.Token,
+			Transport: grpcTransport,
+		}
+	} else {
+		transport = &api.AuthenticatedTransport{
+			Token:     a.Token,
+			Transport: a.httpTransport(),
+		}
+	}
+
+	// From the transport, create the a http client
+	httpClient := transport.Client()
+	httpClient.Timeout = 60 * time.Second
+
+	// Create the Buildkite Agent API Client
+	client := api.NewClient(httpClient)
+	client.BaseURL, _ = url.Parse(a.Endpoint)
+	client.UserAgent = a.UserAgent()
+	client.DebugHTTP = debug
+	client.Breaker = breaker
+
+	return client
+}
+
+// Returns the transport used when making the Buildkite Agent API calls
+func (a APIClient) httpTransport() http.RoundTripper {
 	httpTransport := &http.Transport{
 		Proxy:              http.ProxyFromEnvironment,
 		DisableKeepAlives:  false,
@@ -33,25 +187,52 @@ func (a APIClient) Create() *api.Client {
 		}).Dial,
 		TLSHandshakeTimeout: 30 * time.Second,
 	}
+	httpProxy.Configure(httpTransport)
+	if tlsConfig != nil {
+		httpTransport.TLSClientConfig = tlsConfig.Clone()
+	}
 	http2.ConfigureTransport(httpTransport)
 
-	// Create the transport used when making the Buildkite Agent API calls
-	transport := &api.AuthenticatedTransport{
-		Token:     a.Token,
-		Transport: httpTransport,
+	return httpTransport
+}
+
+// Returns the gRPC transport shared by the clients of the endpoint with the
+// same token. Proxies aren't used, but the client certificate is.
+func (a APIClient) grpcTransport() (*api.GRPCTransport, error) {
+	grpcTransportsMu.Lock()
+	defer grpcTransportsMu.Unlock()
+
+	key := a.Endpoint + " " + a.Token
+	if t, ok := grpcTransports[key]; ok {
+		return t, nil
 	}
 
-	// From the transport, create the a http client
-	httpClient := transport.Client()
-	httpClient.Timeout = 60 * time.Second
+	var config *tls.Config
+	if tlsConfig != nil {
+		config = tlsConfig.Clone()
+	}
 
-	// Create the Buildkite Agent API Client
-	client := api.NewClient(httpClient)
-	client.BaseURL, _ = url.Parse(a.Endpoint)
-	client.UserAgent = a.UserAgent()
-	client.DebugHTTP = debug
+	t, err := api.NewGRPCTransport(a.Endpoint, config)
+	if err != nil {
+		return nil, err
+	}
 
-	return client
+	grpcTransports[key] = t
+	return t, nil
+}
+
+// JobsAssigned returns the IDs of jobs the server pushes to the agent with
+// the token, or nil if the endpoint doesn't push them
+func (a APIClient) JobsAssigned() <-chan string {
+	if !api.IsGRPCEndpoint(a.Endpoint) {
+		return nil
+	}
+
+	t, err := a.grpcTransport()
+	if err != nil {
+		return nil
+	}
+	return t.JobsAssigned()
 }
 
 func (a APIClient) UserAgent() string {
@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/untar"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	ArtifactCompressionGzip = "gzip"
+	ArtifactCompressionZstd = "zstd"
+)
+
+// Returns an error if artifacts can't be compressed with the compression,
+// an empty one meaning they aren't compressed at all
+func ValidateArtifactCompression(compression string) error {
+	switch compression {
+	case "", ArtifactCompressionGzip, ArtifactCompressionZstd:
+		return nil
+	default:
+		return fmt.Errorf("Unknown artifact compression %q, it needs to be either gzip or zstd", compression)
+	}
+}
+
+// The extension that's added to the path of a compressed artifact
+func artifactCompressionExtension(compression string) string {
+	if compression == ArtifactCompressionZstd {
+		return ".zst"
+	}
+	return ".gz"
+}
+
+// Returns the path an artifact was uploaded from, if it was compressed
+func uncompressedArtifactPath(path string, compression string, archived bool) string {
+	path = strings.TrimSuffix(path, artifactCompressionExtension(compression))
+	if archived {
+		path = strings.TrimSuffix(path, ".tar")
+	}
+	return path
+}
+
+func newCompressWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case ArtifactCompressionGzip:
+		return gzip.NewWriter(w), nil
+	case ArtifactCompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("Unknown artifact compression %q", compression)
+	}
+}
+
+// The zstd decoder doesn't return an error when it's closed
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+func newDecompressReader(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case ArtifactCompressionGzip:
+		return gzip.NewReader(r)
+	case ArtifactCompressionZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{decoder}, nil
+	default:
+		return nil, fmt.Errorf("Unknown artifact compression %q", compression)
+	}
+}
+
+// Compresses the file at src into a new file at dst
+func compressFile(src string, dst string, compression string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return writeCompressed(dst, compression, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
+
+// Archives the directory at src into a new compressed tar at dst. The paths
+// in the archive are relative to the directory.
+func archiveDir(src string, dst string, compression string, exclude func(path string) string) error {
+	return writeCompressed(dst, compression, func(w io.Writer) error {
+		tw := tar.NewWriter(w)
+		if err := addToTar(tw, src, src, exclude); err != nil {
+			return err
+		}
+		return tw.Close()
+	})
+}
+
+// Adds the file or directory at path to the tar, named relative to base.
+// Files and directories that exclude returns a pattern for are left out.
+func addToTar(tw *tar.Writer, base string, path string, exclude func(path string) string) error {
+	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if exclude != nil {
+			if pattern := exclude(path); pattern != "" {
+				logger.Debug("Skipping %s, it's excluded by %s", path, pattern)
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		rel, err := filepath.Rel(base, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+func writeCompressed(dst string, compression string, write func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	cw, err := newCompressWriter(out, compression)
+	if err != nil {
+		return err
+	}
+
+	if err := write(cw); err != nil {
+		cw.Close()
+		return err
+	}
+
+	if err := cw.Close(); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// Decompresses a downloaded artifact into the path it was uploaded from,
+// alongside it, and removes the compressed file
+func decompressArtifact(path string, compression string, archived bool) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r, err := newDecompressReader(in, compression)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	dst := uncompressedArtifactPath(path, compression, archived)
+	if dst == path {
+		return fmt.Errorf("Can't decompress %s, it doesn't end with %s", path, artifactCompressionExtension(compression))
+	}
+
+	if archived {
+		err = extractArchive(r, dst)
+	} else {
+		err = writeFile(r, dst)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to decompress %s (%v)", path, err)
+	}
+
+	in.Close()
+	return os.Remove(path)
+}
+
+func writeFile(r io.Reader, path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, r); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// Extracts a tar into a directory, refusing anything that would end up
+// outside of it
+func extractArchive(r io.Reader, dir string) error {
+	return untar.Extract(r, dir, nil)
+}
+
+func isWithinDir(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
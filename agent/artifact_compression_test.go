@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateArtifactCompression(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, ValidateArtifactCompression(""))
+	assert.NoError(t, ValidateArtifactCompression("gzip"))
+	assert.NoError(t, ValidateArtifactCompression("zstd"))
+	assert.Error(t, ValidateArtifactCompression("bzip2"))
+}
+
+func TestCollectCompressesFilesAndArchivesDirectories(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "compress-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "dist", "assets"), 0777)
+	ioutil.WriteFile(filepath.Join(dir, "dist", "assets", "llamas.js"), []byte("llamas"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "build.log"), []byte("alpacas"), 0644)
+
+	uploader := ArtifactUploader{
+		Paths:       filepath.Join(dir, "dist") + ";" + filepath.Join(dir, "dist", "assets", "*.js") + ";" + filepath.Join(dir, "*.log"),
+		Compression: "zstd",
+	}
+
+	artifacts, err := uploader.Collect()
+	defer os.RemoveAll(uploader.compressDir)
+	if !assert.NoError(t, err) || !assert.Len(t, artifacts, 2) {
+		return
+	}
+
+	archive := findArtifact(artifacts, "dist.tar.zst")
+	if assert.NotNil(t, archive) {
+		assert.Equal(t, "zstd", archive.Compression)
+		assert.True(t, archive.Archived)
+	}
+
+	log := findArtifact(artifacts, "build.log.zst")
+	if assert.NotNil(t, log) {
+		assert.Equal(t, "zstd", log.Compression)
+		assert.False(t, log.Archived)
+	}
+}
+
+func TestCompressedArtifactsRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, compression := range []string{"gzip", "zstd"} {
+		dir, err := ioutil.TempDir("", "compress-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		src := filepath.Join(dir, "src")
+		os.MkdirAll(filepath.Join(src, "assets"), 0777)
+		ioutil.WriteFile(filepath.Join(src, "llamas.txt"), []byte("llamas"), 0644)
+		ioutil.WriteFile(filepath.Join(src, "assets", "alpacas.txt"), []byte("alpacas"), 0644)
+
+		ext := artifactCompressionExtension(compression)
+
+		// A single file
+		file := filepath.Join(dir, "out", "llamas.txt"+ext)
+		assert.NoError(t, compressFile(filepath.Join(src, "llamas.txt"), file, compression))
+		assert.NoError(t, decompressArtifact(file, compression, false))
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, "out", "llamas.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "llamas", string(data))
+
+		_, err = os.Stat(file)
+		assert.True(t, os.IsNotExist(err), "The compressed file should be removed")
+
+		// A directory
+		archive := filepath.Join(dir, "out", "src.tar"+ext)
+		assert.NoError(t, archiveDir(src, archive, compression, nil))
+		assert.NoError(t, decompressArtifact(archive, compression, true))
+
+		data, err = ioutil.ReadFile(filepath.Join(dir, "out", "src", "assets", "alpacas.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "alpacas", string(data))
+	}
+}
+
+func TestExtractArchiveRefusesPathsOutsideIt(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "compress-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, header := range []*tar.Header{
+		{Name: "../llamas.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "llamas", Typeflag: tar.TypeSymlink, Linkname: "../../etc"},
+		{Name: "llamas", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(header)
+		tw.Close()
+
+		err := extractArchive(&buf, filepath.Join(dir, "out"))
+		assert.Error(t, err, header.Name)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "llamas.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestExtractArchiveRefusesToEscapeThroughSymlinks(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("Symlinks need to be enabled on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "compress-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each of the links is within the archive, but together they're not
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "."})
+	tw.WriteHeader(&tar.Header{Name: "x/y", Typeflag: tar.TypeSymlink, Linkname: ".."})
+	tw.WriteHeader(&tar.Header{Name: "y/llamas.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 6})
+	tw.Write([]byte("llamas"))
+	tw.Close()
+
+	assert.Error(t, extractArchive(&buf, filepath.Join(dir, "out")))
+
+	_, err = os.Stat(filepath.Join(dir, "llamas.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadDecompressesArtifacts(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "download-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	compressed := filepath.Join(dir, "llamas.txt.gz")
+	ioutil.WriteFile(filepath.Join(dir, "llamas.txt"), []byte("llamas"), 0644)
+	if err := compressFile(filepath.Join(dir, "llamas.txt"), compressed, "gzip"); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, compressed)
+	}))
+	defer server.Close()
+
+	err = Download{
+		URL:         server.URL + "/llamas.txt.gz",
+		Path:        "pkg/llamas.txt.gz",
+		Destination: dir,
+		Retries:     1,
+		Compression: "gzip",
+	}.Start()
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "pkg", "llamas.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "llamas", string(data))
+}
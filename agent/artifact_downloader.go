@@ -1,12 +1,14 @@
 package agent
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/buildkite/agent/api"
 	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/metrics"
 	"github.com/buildkite/agent/pool"
 )
 
@@ -25,9 +27,36 @@ type ArtifactDownloader struct {
 
 	// Where we'll be downloading artifacts to
 	Destination string
+
+	// How many artifacts to download at once, defaults to the number of CPUs
+	Concurrency int
+
+	// How many times each artifact is retried before giving up, which can be
+	// 0 to only try once, or -1 for the default
+	Retries int
+
+	// Whether artifacts have to match the SHA256 checksum recorded when
+	// they were uploaded
+	Verify bool
+
+	// Print a URL for each artifact instead of downloading them
+	URLOnly bool
+}
+
+// Returns how many times an artifact is tried, which is the first time
+// along with each retry, as that's what the downloads are given
+func downloadTries(retries int) int {
+	if retries < 0 {
+		retries = 5
+	}
+	return retries + 1
 }
 
 func (a *ArtifactDownloader) Download() error {
+	if a.URLOnly {
+		return a.printURLs()
+	}
+
 	// Turn the download destination into an absolute path and confirm it exists
 	downloadDestination, _ := filepath.Abs(a.Destination)
 	fileInfo, err := os.Stat(downloadDestination)
@@ -52,7 +81,14 @@ func (a *ArtifactDownloader) Download() error {
 	} else {
 		logger.Info("Found %d artifacts. Starting to download to: %s", artifactCount, downloadDestination)
 
-		p := pool.New(pool.MaxConcurrencyLimit)
+		concurrency := a.Concurrency
+		if concurrency <= 0 {
+			concurrency = pool.MaxConcurrencyLimit
+		}
+
+		tries := downloadTries(a.Retries)
+
+		p := pool.New(concurrency)
 		errors := []error{}
 
 		for _, artifact := range artifacts {
@@ -63,30 +99,58 @@ func (a *ArtifactDownloader) Download() error {
 			p.Spawn(func() {
 				var err error
 
-				// Handle downloading from S3 and GS
+				// Handle downloading from S3, GS and Azure Blob Storage
 				if strings.HasPrefix(artifact.UploadDestination, "s3://") {
 					err = S3Downloader{
 						Path:        artifact.Path,
 						Bucket:      artifact.UploadDestination,
 						Destination: downloadDestination,
-						Retries:     5,
+						Retries:     tries,
 						DebugHTTP:   a.APIClient.DebugHTTP,
+						Sha1Sum:     artifact.Sha1Sum,
+						Sha256Sum:   artifact.Sha256Sum,
+						Verify:      a.Verify,
+						Compression: artifact.Compression,
+						Archived:    artifact.Archived,
 					}.Start()
 				} else if strings.HasPrefix(artifact.UploadDestination, "gs://") {
 					err = GSDownloader{
 						Path:        artifact.Path,
 						Bucket:      artifact.UploadDestination,
 						Destination: downloadDestination,
-						Retries:     5,
+						Retries:     tries,
 						DebugHTTP:   a.APIClient.DebugHTTP,
+						Sha1Sum:     artifact.Sha1Sum,
+						Sha256Sum:   artifact.Sha256Sum,
+						Verify:      a.Verify,
+						Compression: artifact.Compression,
+						Archived:    artifact.Archived,
+					}.Start()
+				} else if strings.HasPrefix(artifact.UploadDestination, "azblob://") {
+					err = AzureBlobDownloader{
+						Path:        artifact.Path,
+						Bucket:      artifact.UploadDestination,
+						Destination: downloadDestination,
+						Retries:     tries,
+						DebugHTTP:   a.APIClient.DebugHTTP,
+						Sha1Sum:     artifact.Sha1Sum,
+						Sha256Sum:   artifact.Sha256Sum,
+						Verify:      a.Verify,
+						Compression: artifact.Compression,
+						Archived:    artifact.Archived,
 					}.Start()
 				} else {
 					err = Download{
 						URL:         artifact.URL,
 						Path:        artifact.Path,
 						Destination: downloadDestination,
-						Retries:     5,
+						Retries:     tries,
 						DebugHTTP:   a.APIClient.DebugHTTP,
+						Sha1Sum:     artifact.Sha1Sum,
+						Sha256Sum:   artifact.Sha256Sum,
+						Verify:      a.Verify,
+						Compression: artifact.Compression,
+						Archived:    artifact.Archived,
 					}.Start()
 				}
 
@@ -99,6 +163,8 @@ func (a *ArtifactDownloader) Download() error {
 					p.Lock()
 					errors = append(errors, err)
 					p.Unlock()
+				} else {
+					metrics.Report(ArtifactBytesMetric, float64(artifact.FileSize), "download")
 				}
 			})
 		}
@@ -112,3 +178,38 @@ func (a *ArtifactDownloader) Download() error {
 
 	return nil
 }
+
+// Prints a URL for each of the artifacts. Artifacts in S3 and Google Cloud
+// Storage get signed URLs that work for an hour, so whatever fetches them
+// doesn't need any credentials.
+func (a *ArtifactDownloader) printURLs() error {
+	searcher := ArtifactSearcher{BuildID: a.BuildID, APIClient: a.APIClient}
+	artifacts, err := searcher.Search(a.Query, a.Step)
+	if err != nil {
+		return err
+	}
+
+	if len(artifacts) == 0 {
+		logger.Info("No artifacts found")
+	}
+
+	for _, artifact := range artifacts {
+		var artifactURL string
+
+		if strings.HasPrefix(artifact.UploadDestination, "s3://") {
+			artifactURL, err = S3Downloader{Path: artifact.Path, Bucket: artifact.UploadDestination}.SignedURL()
+		} else if strings.HasPrefix(artifact.UploadDestination, "gs://") {
+			artifactURL, err = GSDownloader{Path: artifact.Path, Bucket: artifact.UploadDestination}.SignedURL()
+		} else {
+			artifactURL = artifact.URL
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to get a URL for %s (%v)", artifact.Path, err)
+		}
+
+		fmt.Println(artifactURL)
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	zglob "github.com/mattn/go-zglob"
+)
+
+const (
+	// Paths that start with this are excluded from the upload
+	ArtifactExcludePrefix = "!"
+
+	// Separates a path from the destination it's uploaded to, which
+	// overrides the destination of the upload
+	ArtifactDestinationSeparator = "->"
+
+	// The file in the working directory listing paths that are never
+	// uploaded, one pattern on each line
+	ArtifactIgnoreFile = ".buildkite-artifact-ignore"
+)
+
+// One of the paths being uploaded, and where its files are uploaded to
+type artifactGlob struct {
+	pattern     string
+	destination string
+}
+
+// Splits the upload paths into the globs that are uploaded and the patterns
+// that are excluded from them, for example:
+//
+//	log/**/*.log;!log/debug/**;coverage/** -> s3://bucket/coverage
+func parseArtifactPaths(paths string, destination string) ([]artifactGlob, []string) {
+	var globs []artifactGlob
+	var excludes []string
+
+	for _, path := range strings.Split(paths, ArtifactPathDelimiter) {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		if strings.HasPrefix(path, ArtifactExcludePrefix) {
+			if pattern := strings.TrimSpace(strings.TrimPrefix(path, ArtifactExcludePrefix)); pattern != "" {
+				excludes = append(excludes, pattern)
+			}
+			continue
+		}
+
+		glob := artifactGlob{pattern: path, destination: destination}
+		if i := strings.LastIndex(path, ArtifactDestinationSeparator); i >= 0 {
+			glob.pattern = strings.TrimSpace(path[:i])
+			glob.destination = strings.TrimSpace(path[i+len(ArtifactDestinationSeparator):])
+		}
+
+		globs = append(globs, glob)
+	}
+
+	return globs, excludes
+}
+
+// Reads the patterns from the ignore file in the directory, if there is one.
+// Blank lines and lines starting with # are skipped.
+func readArtifactIgnoreFile(dir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(dir, ArtifactIgnoreFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	return patterns, scanner.Err()
+}
+
+// Patterns of files that aren't uploaded, relative to the working directory
+// unless they're absolute
+type artifactExcludes struct {
+	wd       string
+	patterns []string
+}
+
+// Returns the pattern that excludes the file, or a directory it's in, or ""
+// if it isn't excluded
+func (e artifactExcludes) match(absolutePath string) string {
+	for _, pattern := range e.patterns {
+		for path := absolutePath; ; path = filepath.Dir(path) {
+			if e.matches(pattern, path) {
+				return pattern
+			}
+
+			if parent := filepath.Dir(path); parent == path {
+				break
+			}
+		}
+	}
+
+	return ""
+}
+
+func (e artifactExcludes) matches(pattern string, absolutePath string) bool {
+	path := absolutePath
+	if !filepath.IsAbs(pattern) {
+		rel, err := filepath.Rel(e.wd, absolutePath)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return false
+		}
+		path = rel
+	}
+
+	// Trailing slashes mean the same directory
+	pattern = strings.TrimSuffix(filepath.ToSlash(pattern), "/")
+
+	matched, err := zglob.Match(pattern, filepath.ToSlash(path))
+	return err == nil && matched
+}
@@ -1,6 +1,11 @@
 package agent
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
 	"github.com/buildkite/agent/api"
 	"github.com/buildkite/agent/logger"
 )
@@ -25,3 +30,52 @@ func (a *ArtifactSearcher) Search(query string, scope string) ([]*api.Artifact,
 
 	return artifacts, err
 }
+
+// The fields of an artifact that are printed by artifact search
+type artifactSearchResult struct {
+	Path              string `json:"path"`
+	FileSize          int64  `json:"file_size"`
+	Sha1Sum           string `json:"sha1sum"`
+	Sha256Sum         string `json:"sha256sum,omitempty"`
+	URL               string `json:"url,omitempty"`
+	UploadDestination string `json:"upload_destination,omitempty"`
+}
+
+// Writes the artifacts as a JSON array, which is empty if there aren't any
+func WriteArtifactsJSON(w io.Writer, artifacts []*api.Artifact) error {
+	results := []artifactSearchResult{}
+	for _, artifact := range artifacts {
+		results = append(results, artifactSearchResult{
+			Path:              artifact.Path,
+			FileSize:          artifact.FileSize,
+			Sha1Sum:           artifact.Sha1Sum,
+			Sha256Sum:         artifact.Sha256Sum,
+			URL:               artifact.URL,
+			UploadDestination: artifact.UploadDestination,
+		})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(results)
+}
+
+// Writes the artifacts as a table with a row for each of them. The SHA-256
+// checksum is used when there is one, since older agents only recorded the
+// SHA-1.
+func WriteArtifactsTable(w io.Writer, artifacts []*api.Artifact) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "PATH\tSIZE\tCHECKSUM\tURL")
+	for _, artifact := range artifacts {
+		checksum := "sha1:" + artifact.Sha1Sum
+		if artifact.Sha256Sum != "" {
+			checksum = "sha256:" + artifact.Sha256Sum
+		}
+
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", artifact.Path, artifact.FileSize, checksum, artifact.URL)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+var testSearchedArtifacts = []*api.Artifact{
+	{
+		Path:      "pkg/llamas.tar.gz",
+		FileSize:  1024,
+		Sha1Sum:   "a8b3e2ee0c0a8ba4b3e1acb6c0d4a8e9e32bd089",
+		Sha256Sum: "3d4ac0a3e8319e8e4a6f6c7f4fb36cd8a0b5f3e3b2b8e3d9cbd7a78a9c1f7e02",
+		URL:       "https://example.com/llamas.tar.gz",
+	},
+	{
+		Path:     "pkg/alpacas.tar.gz",
+		FileSize: 2048,
+		Sha1Sum:  "b1946ac92492d2347c6235b4d2611184d8b8e2c7",
+		URL:      "https://example.com/alpacas.tar.gz",
+	},
+}
+
+func TestWriteArtifactsTable(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	err := WriteArtifactsTable(&buf, testSearchedArtifacts)
+	assert.NoError(t, err)
+
+	assert.Equal(t, ""+
+		"PATH                SIZE  CHECKSUM                                                                 URL\n"+
+		"pkg/llamas.tar.gz   1024  sha256:3d4ac0a3e8319e8e4a6f6c7f4fb36cd8a0b5f3e3b2b8e3d9cbd7a78a9c1f7e02  https://example.com/llamas.tar.gz\n"+
+		"pkg/alpacas.tar.gz  2048  sha1:b1946ac92492d2347c6235b4d2611184d8b8e2c7                            https://example.com/alpacas.tar.gz\n",
+		buf.String())
+}
+
+func TestWriteArtifactsJSON(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	err := WriteArtifactsJSON(&buf, testSearchedArtifacts[1:])
+	assert.NoError(t, err)
+
+	assert.JSONEq(t, `[{
+		"path": "pkg/alpacas.tar.gz",
+		"file_size": 2048,
+		"sha1sum": "b1946ac92492d2347c6235b4d2611184d8b8e2c7",
+		"url": "https://example.com/alpacas.tar.gz"
+	}]`, buf.String())
+
+	buf.Reset()
+	err = WriteArtifactsJSON(&buf, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "[]\n", buf.String())
+}
@@ -2,9 +2,11 @@ package agent
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -13,7 +15,9 @@ import (
 	"time"
 
 	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/events"
 	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/metrics"
 	"github.com/buildkite/agent/pool"
 	"github.com/buildkite/agent/retry"
 	zglob "github.com/mattn/go-zglob"
@@ -23,6 +27,9 @@ const (
 	ArtifactPathDelimiter = ";"
 )
 
+// The most artifact states that are updated in one request
+const artifactStateBatchSize = 100
+
 type ArtifactUploader struct {
 	// The APIClient that will be used when uploading jobs
 	APIClient *api.Client
@@ -35,22 +42,57 @@ type ArtifactUploader struct {
 
 	// Where we'll be uploading artifacts
 	Destination string
+
+	// Files larger than this are uploaded in parts by uploaders that
+	// support it
+	PartSize int64
+
+	// Where the state of multipart uploads is kept so they can be resumed
+	StateDir string
+
+	// How to compress the files before they're uploaded, either gzip or
+	// zstd. Directories that match are uploaded as a single tar when the
+	// files are compressed.
+	Compression string
+
+	// Where the compressed files are written before they're uploaded
+	compressDir string
+
+	// The files that aren't uploaded, including those inside directories
+	// that are archived
+	excludes artifactExcludes
 }
 
 func (a *ArtifactUploader) Upload() error {
 	// Create artifact structs for all the files we need to upload
 	artifacts, err := a.Collect()
+	if a.compressDir != "" {
+		defer os.RemoveAll(a.compressDir)
+	}
 	if err != nil {
 		return err
 	}
 
 	if len(artifacts) == 0 {
 		logger.Info("No files matched paths: %s", a.Paths)
-	} else {
-		logger.Info("Found %d files that match \"%s\"", len(artifacts), a.Paths)
+		return nil
+	}
 
-		err := a.upload(artifacts)
-		if err != nil {
+	logger.Info("Found %d files that match \"%s\"", len(artifacts), a.Paths)
+
+	// Paths can have destinations of their own, and each destination is
+	// uploaded to separately
+	var destinations []string
+	byDestination := map[string][]*api.Artifact{}
+	for _, artifact := range artifacts {
+		if _, ok := byDestination[artifact.UploadDestination]; !ok {
+			destinations = append(destinations, artifact.UploadDestination)
+		}
+		byDestination[artifact.UploadDestination] = append(byDestination[artifact.UploadDestination], artifact)
+	}
+
+	for _, destination := range destinations {
+		if err := a.upload(destination, byDestination[destination]); err != nil {
 			return err
 		}
 	}
@@ -66,17 +108,33 @@ func isDir(path string) bool {
 	return fi.IsDir()
 }
 
+// A file or directory that matched one of the upload paths
+type artifactMatch struct {
+	path         string
+	absolutePath string
+	globPath     string
+	destination  string
+	dir          bool
+}
+
 func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
 	wd, err := os.Getwd()
 	if err != nil {
 		return nil, err
 	}
 
-	for _, globPath := range strings.Split(a.Paths, ArtifactPathDelimiter) {
-		globPath = strings.TrimSpace(globPath)
-		if globPath == "" {
-			continue
-		}
+	ignored, err := readArtifactIgnoreFile(wd)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s (%v)", ArtifactIgnoreFile, err)
+	}
+
+	globs, excludes := parseArtifactPaths(a.Paths, a.Destination)
+	a.excludes = artifactExcludes{wd: wd, patterns: append(excludes, ignored...)}
+
+	var matches []artifactMatch
+
+	for _, glob := range globs {
+		globPath := glob.pattern
 
 		logger.Debug("Searching for %s", globPath)
 
@@ -93,8 +151,15 @@ func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
 				return nil, err
 			}
 
-			// Ignore directories, we only want files
-			if isDir(absolutePath) {
+			if pattern := a.excludes.match(absolutePath); pattern != "" {
+				logger.Debug("Skipping %s, it's excluded by %s", file, pattern)
+				continue
+			}
+
+			// Ignore directories unless they're being archived, we
+			// only want files
+			dir := isDir(absolutePath)
+			if dir && a.Compression == "" {
 				logger.Debug("Skipping directory %s", file)
 				continue
 			}
@@ -104,32 +169,138 @@ func (a *ArtifactUploader) Collect() (artifacts []*api.Artifact, err error) {
 			// This is possibly weird and crazy, this logic dates back to
 			// https://github.com/buildkite/agent/commit/8ae46d975aa60d1ae0e2cc0bff7a43d3bf960935
 			// from 2014, so I'm replicating it here to avoid breaking things
+			base := wd
 			if filepath.IsAbs(globPath) {
 				if runtime.GOOS == "windows" {
-					wd = filepath.VolumeName(absolutePath) + "/"
+					base = filepath.VolumeName(absolutePath) + "/"
 				} else {
-					wd = "/"
+					base = "/"
 				}
 			}
 
-			path, err := filepath.Rel(wd, absolutePath)
+			path, err := filepath.Rel(base, absolutePath)
 			if err != nil {
 				return nil, err
 			}
 
+			matches = append(matches, artifactMatch{path, absolutePath, globPath, glob.destination, dir})
+		}
+	}
+
+	// Only directories can have other matches archived in them, and there
+	// are usually far fewer of them than files
+	var dirs []artifactMatch
+	for _, match := range matches {
+		if match.dir {
+			dirs = append(dirs, match)
+		}
+	}
+
+	var build []artifactMatch
+	for _, match := range matches {
+		// Anything in a directory that's being archived is already
+		// uploaded as part of it
+		if archive := archivingDir(dirs, match); archive != "" {
+			logger.Debug("Skipping %s, it's archived with %s", match.path, archive)
+			continue
+		}
+
+		build = append(build, match)
+	}
+
+	if a.Compression != "" && len(build) > 0 && a.compressDir == "" {
+		if a.compressDir, err = ioutil.TempDir("", "buildkite-artifacts"); err != nil {
+			return nil, err
+		}
+	}
+
+	// Hashing and compressing the files is done in parallel, as it's most
+	// of the time spent collecting lots of small files
+	artifacts = make([]*api.Artifact, len(build))
+	var buildErr error
+	p := pool.New(pool.MaxConcurrencyLimit)
+
+	for i, match := range build {
+		i, match := i, match
+
+		p.Spawn(func() {
 			// Build an artifact object using the paths we have.
-			artifact, err := a.build(path, absolutePath, globPath)
+			var artifact *api.Artifact
+			var err error
+			if a.Compression != "" {
+				artifact, err = a.buildCompressed(match, i)
+			} else {
+				artifact, err = a.build(match.path, match.absolutePath, match.globPath)
+			}
+
+			p.Lock()
+			defer p.Unlock()
+
 			if err != nil {
-				return nil, err
+				if buildErr == nil {
+					buildErr = err
+				}
+				return
 			}
+			artifact.UploadDestination = match.destination
+			artifacts[i] = artifact
+		})
+	}
 
-			artifacts = append(artifacts, artifact)
-		}
+	p.Wait()
+
+	if buildErr != nil {
+		return nil, buildErr
 	}
 
 	return artifacts, nil
 }
 
+// Returns the path of the directory the match is archived in, if there is one
+func archivingDir(dirs []artifactMatch, match artifactMatch) string {
+	for _, dir := range dirs {
+		if dir.absolutePath != match.absolutePath &&
+			strings.HasPrefix(match.absolutePath, dir.absolutePath+string(filepath.Separator)) {
+			return dir.path
+		}
+	}
+	return ""
+}
+
+// Compresses the file, or archives the directory, and builds an artifact to
+// upload it with. Its path gets the extension of the compression, which is
+// removed again when it's downloaded.
+func (a *ArtifactUploader) buildCompressed(match artifactMatch, index int) (*api.Artifact, error) {
+	ext := artifactCompressionExtension(a.Compression)
+	if match.dir {
+		ext = ".tar" + ext
+	}
+
+	path := match.path + ext
+	compressedPath := filepath.Join(a.compressDir, fmt.Sprintf("%d-%s", index, filepath.Base(path)))
+
+	var err error
+	if match.dir {
+		logger.Debug("Archiving %s to %s", match.path, compressedPath)
+		err = archiveDir(match.absolutePath, compressedPath, a.Compression, a.excludes.match)
+	} else {
+		logger.Debug("Compressing %s to %s", match.path, compressedPath)
+		err = compressFile(match.absolutePath, compressedPath, a.Compression)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to compress %s (%v)", match.path, err)
+	}
+
+	artifact, err := a.build(path, compressedPath, match.globPath)
+	if err != nil {
+		return nil, err
+	}
+	artifact.Compression = a.Compression
+	artifact.Archived = match.dir
+
+	return artifact, nil
+}
+
 func (a *ArtifactUploader) build(path string, absolutePath string, globPath string) (*api.Artifact, error) {
 	// Temporarily open the file to get it's size
 	file, err := os.Open(absolutePath)
@@ -144,10 +315,12 @@ func (a *ArtifactUploader) build(path string, absolutePath string, globPath stri
 		return nil, err
 	}
 
-	// Generate a sha1 checksum for the file
-	hash := sha1.New()
-	io.Copy(hash, file)
-	checksum := fmt.Sprintf("%x", hash.Sum(nil))
+	// Generate sha1 and sha256 checksums for the file
+	sha1Hash := sha1.New()
+	sha256Hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(sha1Hash, sha256Hash), file); err != nil {
+		return nil, err
+	}
 
 	// Create our new artifact data structure
 	artifact := &api.Artifact{
@@ -155,30 +328,15 @@ func (a *ArtifactUploader) build(path string, absolutePath string, globPath stri
 		AbsolutePath: absolutePath,
 		GlobPath:     globPath,
 		FileSize:     fileInfo.Size(),
-		Sha1Sum:      checksum,
+		Sha1Sum:      fmt.Sprintf("%x", sha1Hash.Sum(nil)),
+		Sha256Sum:    fmt.Sprintf("%x", sha256Hash.Sum(nil)),
 	}
 
 	return artifact, nil
 }
 
-func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
-	var uploader Uploader
-
-	// Determine what uploader to use
-	if a.Destination != "" {
-		if strings.HasPrefix(a.Destination, "s3://") {
-			uploader = new(S3Uploader)
-		} else if strings.HasPrefix(a.Destination, "gs://") {
-			uploader = new(GSUploader)
-		} else {
-			return errors.New("Unknown upload destination: " + a.Destination)
-		}
-	} else {
-		uploader = new(FormUploader)
-	}
-
-	// Setup the uploader
-	err := uploader.Setup(a.Destination, a.APIClient.DebugHTTP)
+func (a *ArtifactUploader) upload(destination string, artifacts []*api.Artifact) error {
+	uploader, err := newUploader(destination, a.APIClient.DebugHTTP)
 	if err != nil {
 		return err
 	}
@@ -193,7 +351,7 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 		APIClient:         a.APIClient,
 		JobID:             a.JobID,
 		Artifacts:         artifacts,
-		UploadDestination: a.Destination,
+		UploadDestination: destination,
 	}
 	artifacts, err = batchCreator.Create()
 	if err != nil {
@@ -227,11 +385,19 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 			// Since we mutate the artifactStates variable in
 			// multiple routines, we need to lock it to make sure
 			// nothing else is changing it at the same time.
+			//
+			// There's a limit on how many are sent at once so the
+			// requests stay small when lots of small files finish
+			// uploading together.
 			artifactStatesMutex.Lock()
 			for id, state := range artifactStates {
+				if len(statesToUpload) >= artifactStateBatchSize {
+					break
+				}
 				statesToUpload[id] = state
 				delete(artifactStates, id)
 			}
+			remaining := len(artifactStates)
 			artifactStatesMutex.Unlock()
 
 			if len(statesToUpload) > 0 {
@@ -241,8 +407,8 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 				}
 
 				// Update the states of the artifacts in bulk.
-				err = retry.Do(func(s *retry.Stats) error {
-					_, err = a.APIClient.Artifacts.Update(a.JobID, statesToUpload)
+				err := retry.Do(func(s *retry.Stats) error {
+					_, err := a.APIClient.Artifacts.Update(a.JobID, statesToUpload)
 					if err != nil {
 						logger.Warn("%s (%s)", err, s)
 					}
@@ -264,8 +430,11 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 				logger.Debug("Uploaded %d artfact states (%d/%d)", len(statesToUpload), artifactStatesUploaded, len(artifacts))
 			}
 
-			// Check again for states to upload in a few seconds
-			time.Sleep(1 * time.Second)
+			// Check again for states to upload in a few seconds,
+			// unless there are more waiting already
+			if remaining == 0 {
+				time.Sleep(1 * time.Second)
+			}
 		}
 
 		stateUploaderWaitGroup.Done()
@@ -283,8 +452,8 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 			// Upload the artifact and then set the state depending
 			// on whether or not it passed. We'll retry the upload
 			// a couple of times before giving up.
-			err = retry.Do(func(s *retry.Stats) error {
-				err := uploader.Upload(artifact)
+			err := retry.Do(func(s *retry.Stats) error {
+				err := a.uploadArtifact(uploader, artifact)
 				if err != nil {
 					logger.Warn("%s (%s)", err, s)
 				}
@@ -308,6 +477,17 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 				state = "error"
 			} else {
 				state = "finished"
+				metrics.Report(ArtifactBytesMetric, float64(artifact.FileSize), "upload")
+				events.Report(events.Event{
+					Type:  events.ArtifactUploaded,
+					JobID: a.JobID,
+					Artifact: &events.Artifact{
+						ID:       artifact.ID,
+						Path:     artifact.Path,
+						FileSize: artifact.FileSize,
+						URL:      artifact.URL,
+					},
+				})
 			}
 
 			// Since we mutate the artifactStates variable in
@@ -331,3 +511,59 @@ func (a *ArtifactUploader) upload(artifacts []*api.Artifact) error {
 
 	return nil
 }
+
+// Returns the uploader for the destination, which is set up and ready to
+// upload artifacts
+func newUploader(destination string, debugHTTP bool) (Uploader, error) {
+	var uploader Uploader
+
+	// Determine what uploader to use
+	if destination != "" {
+		if strings.HasPrefix(destination, "s3://") {
+			uploader = new(S3Uploader)
+		} else if strings.HasPrefix(destination, "gs://") {
+			uploader = new(GSUploader)
+		} else if strings.HasPrefix(destination, "azblob://") {
+			uploader = new(AzureBlobUploader)
+		} else {
+			return nil, errors.New("Unknown upload destination: " + destination)
+		}
+	} else {
+		uploader = new(FormUploader)
+	}
+
+	// Setup the uploader
+	if err := uploader.Setup(destination, debugHTTP); err != nil {
+		return nil, err
+	}
+
+	return uploader, nil
+}
+
+// Uploads the artifact in parts if it's large enough and the uploader
+// supports it, otherwise in one go
+func (a *ArtifactUploader) uploadArtifact(uploader Uploader, artifact *api.Artifact) error {
+	partSize := a.PartSize
+	if partSize <= 0 {
+		partSize = DefaultMultipartPartSize
+	}
+
+	transport, ok := uploader.(MultipartTransport)
+	if !ok || artifact.FileSize <= partSize {
+		return uploader.Upload(artifact)
+	}
+
+	stateDir := a.StateDir
+	if stateDir == "" {
+		stateDir = filepath.Join(os.TempDir(), "buildkite-artifact-uploads")
+	}
+
+	multipart := &MultipartUpload{
+		Transport: transport,
+		Artifact:  artifact,
+		PartSize:  partSize,
+		StateDir:  stateDir,
+	}
+
+	return multipart.Upload()
+}
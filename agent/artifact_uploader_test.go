@@ -1,13 +1,16 @@
 package agent
 
 import (
+	"archive/tar"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"testing"
 
 	"github.com/buildkite/agent/api"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -45,6 +48,7 @@ func TestCollect(t *testing.T) {
 	assert.Equal(t, a.GlobPath, "test/fixtures/artifacts/**/*.jpg")
 	assert.Equal(t, int(a.FileSize), 362371)
 	assert.Equal(t, a.Sha1Sum, "f5bc7bc9f5f9c3e543dde0eb44876c6f9acbfb6b")
+	assert.Equal(t, a.Sha256Sum, "0c657a363d92093e68224e0716ed8b8b5d4bbc3dfe9b026e32b241fc9b369d47")
 
 	a = findArtifact(artifacts, "Commando.jpg")
 	assert.NotNil(t, a)
@@ -73,3 +77,118 @@ func TestCollect(t *testing.T) {
 	assert.Equal(t, int(a.FileSize), 2038453)
 	assert.Equal(t, a.Sha1Sum, "bd4caf2e01e59777744ac1d52deafa01c2cb9bfd")
 }
+
+// Creates the files, with the directories they're in, relative to dir
+func writeArtifactFiles(t *testing.T, dir string, files ...string) {
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseArtifactPaths(t *testing.T) {
+	t.Parallel()
+
+	globs, excludes := parseArtifactPaths("log/**/*.log; !log/debug/** ;coverage/** -> s3://llamas/coverage;;!", "s3://alpacas")
+
+	assert.Equal(t, []artifactGlob{
+		{pattern: "log/**/*.log", destination: "s3://alpacas"},
+		{pattern: "coverage/**", destination: "s3://llamas/coverage"},
+	}, globs)
+	assert.Equal(t, []string{"log/debug/**"}, excludes)
+}
+
+// Not parallel, as the ignore file is read from the working directory
+func TestCollectExcludesAndIgnoresFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collect-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeArtifactFiles(t, dir,
+		"log/build.log",
+		"log/debug/trace.log",
+		"log/debug/deeper/trace.log",
+		"coverage/index.html",
+		"coverage/secrets/token.txt",
+		"tmp/scratch.log",
+	)
+	ioutil.WriteFile(filepath.Join(dir, ArtifactIgnoreFile), []byte("# Never upload these\n\ncoverage/secrets\ntmp/**\n"), 0644)
+
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	uploader := ArtifactUploader{
+		Paths:       "**/*.log;!log/debug;coverage/**/* -> s3://llamas/coverage",
+		Destination: "s3://alpacas",
+	}
+
+	artifacts, err := uploader.Collect()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	destinations := map[string]string{}
+	for _, artifact := range artifacts {
+		destinations[filepath.ToSlash(artifact.Path)] = artifact.UploadDestination
+	}
+
+	assert.Equal(t, map[string]string{
+		"log/build.log":       "s3://alpacas",
+		"coverage/index.html": "s3://llamas/coverage",
+	}, destinations)
+}
+
+func TestCollectLeavesExcludedFilesOutOfArchives(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "collect-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeArtifactFiles(t, dir, "dist/app.js", "dist/app.js.map", "dist/cache/llamas.bin")
+
+	uploader := ArtifactUploader{
+		Paths:       filepath.Join(dir, "dist") + ";!" + filepath.Join(dir, "dist", "cache") + ";!" + filepath.Join(dir, "**", "*.map"),
+		Compression: "zstd",
+	}
+
+	artifacts, err := uploader.Collect()
+	defer os.RemoveAll(uploader.compressDir)
+	if !assert.NoError(t, err) || !assert.Len(t, artifacts, 1) {
+		return
+	}
+
+	f, err := os.Open(artifacts[0].AbsolutePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	var names []string
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+	}
+
+	assert.Equal(t, []string{"app.js"}, names)
+}
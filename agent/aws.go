@@ -4,7 +4,7 @@ import (
 	"os"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/buildkite/agent/logger"
 )
@@ -23,24 +23,14 @@ func awsRegion() (string, error) {
 		return r, nil
 	}
 
-	// The metadata service seems to want a session
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String("us-east-1"),
-	})
+	region, err := ec2Metadata.get("placement/region")
 	if err != nil {
-		return "", err
+		logger.Debug("Failed to detect the AWS region from the instance metadata (%s)", err)
+		return "", aws.ErrMissingRegion
 	}
 
-	meta := ec2metadata.New(sess)
-	if meta.Available() {
-		region, err := meta.Region()
-		if err == nil {
-			logger.Debug("Detected AWS region %s", region)
-		}
-		return region, err
-	}
-
-	return "", aws.ErrMissingRegion
+	logger.Debug("Detected AWS region %s", region)
+	return region, nil
 }
 
 func awsSession() (*session.Session, error) {
@@ -56,6 +46,13 @@ func awsSession() (*session.Session, error) {
 		if err != nil {
 			return nil, err
 		}
+
+		// The SDK can only get the instance's role credentials with
+		// IMDSv1, so they're found with IMDSv2 when it can't
+		awsSess.Config.Credentials = credentials.NewChainCredentials([]credentials.Provider{
+			sessionCredentials{awsSess.Config.Credentials},
+			&ec2RoleCredentials{metadata: ec2Metadata},
+		})
 	}
 
 	return awsSess, nil
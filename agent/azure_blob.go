@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The version of the Blob service REST API we talk to. Anything since
+	// 2017-11-09 supports authenticating with Azure AD tokens.
+	azureBlobAPIVersion = "2018-03-28"
+
+	// Where managed identity tokens come from inside Azure
+	azureInstanceMetadataTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+)
+
+// The base URL of the storage account's blob service, e.g.
+// https://myaccount.blob.core.windows.net
+func azureBlobEndpoint() (string, error) {
+	if endpoint := os.Getenv("BUILDKITE_AZURE_BLOB_ENDPOINT"); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/"), nil
+	}
+
+	account := os.Getenv("BUILDKITE_AZURE_STORAGE_ACCOUNT")
+	if account == "" {
+		return "", errors.New("BUILDKITE_AZURE_STORAGE_ACCOUNT not found in environment")
+	}
+
+	return "https://" + account + ".blob.core.windows.net", nil
+}
+
+// Splits an azblob://container/path destination into the container name and
+// the path within it
+func azureBlobDestinationParts(destination string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(destination, "azblob://"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], strings.Trim(parts[1], "/")
+}
+
+// Creates a HTTP client that authenticates requests to the blob service,
+// either with the SAS token in BUILDKITE_AZURE_BLOB_SAS_TOKEN, or otherwise
+// with the managed identity of the machine the agent is running on
+func newAzureBlobClient() *http.Client {
+	return &http.Client{
+		Transport: &azureBlobTransport{
+			SASToken: strings.TrimPrefix(os.Getenv("BUILDKITE_AZURE_BLOB_SAS_TOKEN"), "?"),
+			ClientID: os.Getenv("AZURE_CLIENT_ID"),
+			Base:     http.DefaultTransport,
+		},
+	}
+}
+
+type azureBlobTransport struct {
+	// A shared access signature, appended to the query of every request
+	SASToken string
+
+	// The client id of a user assigned managed identity
+	ClientID string
+
+	// The transport that actually sends the requests
+	Base http.RoundTripper
+
+	token        string
+	tokenExpires time.Time
+	tokenMutex   sync.Mutex
+}
+
+func (t *azureBlobTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers aren't allowed to modify the request they're given
+	authed := new(http.Request)
+	*authed = *req
+	authed.URL = new(url.URL)
+	*authed.URL = *req.URL
+	authed.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		authed.Header[k] = v
+	}
+
+	authed.Header.Set("x-ms-version", azureBlobAPIVersion)
+
+	if t.SASToken != "" {
+		if authed.URL.RawQuery == "" {
+			authed.URL.RawQuery = t.SASToken
+		} else {
+			authed.URL.RawQuery += "&" + t.SASToken
+		}
+	} else {
+		token, err := t.managedIdentityToken()
+		if err != nil {
+			return nil, err
+		}
+		authed.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return t.Base.RoundTrip(authed)
+}
+
+// Fetches an access token for the storage service from the instance metadata
+// service, and holds on to it until it's about to expire
+func (t *azureBlobTransport) managedIdentityToken() (string, error) {
+	t.tokenMutex.Lock()
+	defer t.tokenMutex.Unlock()
+
+	if t.token != "" && time.Now().Add(5*time.Minute).Before(t.tokenExpires) {
+		return t.token, nil
+	}
+
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", "https://storage.azure.com/")
+	if t.ClientID != "" {
+		query.Set("client_id", t.ClientID)
+	}
+
+	req, err := http.NewRequest("GET", azureInstanceMetadataTokenURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get a managed identity token (%v)", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Failed to get a managed identity token (%s)", resp.Status)
+	}
+
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", fmt.Errorf("Failed to parse managed identity token (%v)", err)
+	}
+
+	expiresOn, err := strconv.ParseInt(payload.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse managed identity token expiry %q (%v)", payload.ExpiresOn, err)
+	}
+
+	t.token = payload.AccessToken
+	t.tokenExpires = time.Unix(expiresOn, 0)
+
+	return t.token, nil
+}
+
+// Turns a failed response from the blob service into an error, including the
+// error code the service sends back
+func azureBlobResponseError(resp *http.Response) error {
+	if code := resp.Header.Get("x-ms-error-code"); code != "" {
+		return fmt.Errorf("%s (%s)", resp.Status, code)
+	}
+
+	return errors.New(resp.Status)
+}
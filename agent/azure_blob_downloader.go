@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"net/url"
+	"strings"
+)
+
+type AzureBlobDownloader struct {
+	// The container name and the path, e.g azblob://my-container/foo/bar
+	Bucket string
+
+	// The root directory of the download
+	Destination string
+
+	// The relative path that should be preserved in the download folder,
+	// also it's location in the container
+	Path string
+
+	// How many times should it retry the download before giving up
+	Retries int
+
+	// If failed responses should be dumped to the log
+	DebugHTTP bool
+
+	// The checksums recorded when the file was uploaded
+	Sha1Sum   string
+	Sha256Sum string
+
+	// Whether a missing SHA256 checksum should fail the download, as well
+	// as a mismatched one, which always does
+	Verify bool
+
+	// How the file was compressed when it was uploaded, and whether it's a
+	// tar of a directory
+	Compression string
+	Archived    bool
+}
+
+func (d AzureBlobDownloader) Start() error {
+	endpoint, err := azureBlobEndpoint()
+	if err != nil {
+		return err
+	}
+
+	blobURL := &url.URL{Path: "/" + d.ContainerName() + "/" + d.ContainerFileLocation()}
+
+	// We can now cheat and pass the URL onto our regular downloader
+	return Download{
+		Client:      *newAzureBlobClient(),
+		URL:         endpoint + blobURL.String(),
+		Path:        d.Path,
+		Destination: d.Destination,
+		Retries:     d.Retries,
+		DebugHTTP:   d.DebugHTTP,
+		Sha1Sum:     d.Sha1Sum,
+		Sha256Sum:   d.Sha256Sum,
+		Verify:      d.Verify,
+		Compression: d.Compression,
+		Archived:    d.Archived,
+	}.Start()
+}
+
+func (d AzureBlobDownloader) ContainerFileLocation() string {
+	if d.ContainerPath() != "" {
+		return strings.TrimSuffix(d.ContainerPath(), "/") + "/" + strings.TrimPrefix(d.Path, "/")
+	} else {
+		return d.Path
+	}
+}
+
+func (d AzureBlobDownloader) ContainerPath() string {
+	_, path := azureBlobDestinationParts(d.Bucket)
+	return path
+}
+
+func (d AzureBlobDownloader) ContainerName() string {
+	container, _ := azureBlobDestinationParts(d.Bucket)
+	return container
+}
@@ -0,0 +1,221 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/mime"
+)
+
+type AzureBlobUploader struct {
+	// The destination which includes the container name and the path.
+	// e.g azblob://my-container/foo/bar
+	Destination string
+
+	// Whether or not HTTP calls should be debugged
+	DebugHTTP bool
+
+	// The base URL of the blob service
+	endpoint string
+
+	// The authenticated HTTP client
+	client *http.Client
+}
+
+func (u *AzureBlobUploader) Setup(destination string, debugHTTP bool) error {
+	u.Destination = destination
+	u.DebugHTTP = debugHTTP
+
+	endpoint, err := azureBlobEndpoint()
+	if err != nil {
+		return err
+	}
+
+	u.endpoint = endpoint
+	u.client = newAzureBlobClient()
+
+	return nil
+}
+
+func (u *AzureBlobUploader) URL(artifact *api.Artifact) string {
+	baseUrl := u.endpoint
+
+	if os.Getenv("BUILDKITE_AZURE_BLOB_ACCESS_URL") != "" {
+		baseUrl = strings.TrimSuffix(os.Getenv("BUILDKITE_AZURE_BLOB_ACCESS_URL"), "/")
+	}
+
+	url, _ := url.Parse(baseUrl)
+
+	url.Path += "/" + u.ContainerName() + "/" + u.artifactPath(artifact)
+
+	return url.String()
+}
+
+func (u *AzureBlobUploader) Upload(artifact *api.Artifact) error {
+	logger.Debug("Reading file \"%s\"", artifact.AbsolutePath)
+	f, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
+	}
+	defer f.Close()
+
+	req, err := http.NewRequest("PUT", u.blobURL(artifact, nil), f)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = artifact.FileSize
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("Content-Type", u.mimeType(artifact))
+	if ce := u.contentEncoding(artifact); ce != "" {
+		req.Header.Set("Content-Encoding", ce)
+	}
+
+	logger.Debug("Uploading \"%s\" to container \"%s\"", u.artifactPath(artifact), u.ContainerName())
+	return u.do(req)
+}
+
+func (u *AzureBlobUploader) MultipartKey(artifact *api.Artifact) string {
+	return u.blobURL(artifact, nil)
+}
+
+// Blob storage has no concept of an upload id, blocks are staged against the
+// blob itself. A random id is used as the prefix of every block id so blocks
+// from an abandoned upload never get mixed into a new one.
+func (u *AzureBlobUploader) CreateMultipartUpload(artifact *api.Artifact) (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", id), nil
+}
+
+func (u *AzureBlobUploader) UploadPart(artifact *api.Artifact, uploadID string, partNumber int, body io.ReadSeeker) (string, error) {
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	if _, err = body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	// Block ids have to be base64 and all the same length within a blob
+	blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s-%05d", uploadID, partNumber)))
+
+	req, err := http.NewRequest("PUT", u.blobURL(artifact, url.Values{
+		"comp":    {"block"},
+		"blockid": {blockID},
+	}), body)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+
+	return blockID, u.do(req)
+}
+
+func (u *AzureBlobUploader) CompleteMultipartUpload(artifact *api.Artifact, uploadID string, parts []MultipartPart) error {
+	blockList := struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{}
+	for _, part := range parts {
+		blockList.Latest = append(blockList.Latest, part.ETag)
+	}
+
+	body, err := xml.Marshal(blockList)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", u.blobURL(artifact, url.Values{"comp": {"blocklist"}}),
+		bytes.NewReader(append([]byte(xml.Header), body...)))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("x-ms-blob-content-type", u.mimeType(artifact))
+	if ce := u.contentEncoding(artifact); ce != "" {
+		req.Header.Set("x-ms-blob-content-encoding", ce)
+	}
+
+	err = u.do(req)
+
+	// Uncommitted blocks are garbage collected after a week
+	if err != nil && strings.Contains(err.Error(), "InvalidBlockList") {
+		return ErrMultipartUploadExpired
+	}
+
+	return err
+}
+
+func (u *AzureBlobUploader) do(req *http.Request) error {
+	logger.Debug("%s %s", req.Method, req.URL)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return azureBlobResponseError(resp)
+	}
+
+	return nil
+}
+
+func (u *AzureBlobUploader) blobURL(artifact *api.Artifact, query url.Values) string {
+	blobURL := &url.URL{
+		Path:     "/" + u.ContainerName() + "/" + u.artifactPath(artifact),
+		RawQuery: query.Encode(),
+	}
+
+	return u.endpoint + blobURL.String()
+}
+
+func (u *AzureBlobUploader) artifactPath(artifact *api.Artifact) string {
+	if u.ContainerPath() == "" {
+		return artifact.Path
+	}
+
+	return u.ContainerPath() + "/" + artifact.Path
+}
+
+func (u *AzureBlobUploader) ContainerName() string {
+	container, _ := azureBlobDestinationParts(u.Destination)
+	return container
+}
+
+func (u *AzureBlobUploader) ContainerPath() string {
+	_, path := azureBlobDestinationParts(u.Destination)
+	return path
+}
+
+func (u *AzureBlobUploader) mimeType(a *api.Artifact) string {
+	extension := filepath.Ext(a.Path)
+	mimeType := mime.TypeByExtension(extension)
+
+	if mimeType != "" {
+		return mimeType
+	} else {
+		return "binary/octet-stream"
+	}
+}
+
+func (u *AzureBlobUploader) contentEncoding(a *api.Artifact) string {
+	extension := filepath.Ext(a.Path)
+	return mime.EncodingByExtension(extension)
+}
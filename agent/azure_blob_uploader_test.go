@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAzureBlobUploaderURL(t *testing.T) {
+	os.Setenv("BUILDKITE_AZURE_STORAGE_ACCOUNT", "llamas")
+	defer os.Unsetenv("BUILDKITE_AZURE_STORAGE_ACCOUNT")
+
+	uploader := AzureBlobUploader{}
+	assert.NoError(t, uploader.Setup("azblob://my-container/foo/bar/", false))
+
+	assert.Equal(t, "my-container", uploader.ContainerName())
+	assert.Equal(t, "foo/bar", uploader.ContainerPath())
+	assert.Equal(t, "https://llamas.blob.core.windows.net/my-container/foo/bar/a/b/c.txt",
+		uploader.URL(&api.Artifact{Path: "a/b/c.txt"}))
+}
+
+func TestAzureBlobUploaderRequiresAnAccount(t *testing.T) {
+	uploader := AzureBlobUploader{}
+	assert.Error(t, uploader.Setup("azblob://my-container", false))
+}
+
+func TestAzureBlobUploaderUploadsWithSASToken(t *testing.T) {
+	var requests []*http.Request
+	var bodies []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	os.Setenv("BUILDKITE_AZURE_BLOB_ENDPOINT", server.URL)
+	os.Setenv("BUILDKITE_AZURE_BLOB_SAS_TOKEN", "?sv=2018-03-28&sig=secret")
+	defer os.Unsetenv("BUILDKITE_AZURE_BLOB_ENDPOINT")
+	defer os.Unsetenv("BUILDKITE_AZURE_BLOB_SAS_TOKEN")
+
+	dir, err := ioutil.TempDir("", "azure-blob-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "llamas.txt")
+	if err := ioutil.WriteFile(path, []byte("llamas"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	uploader := AzureBlobUploader{}
+	assert.NoError(t, uploader.Setup("azblob://my-container/builds", false))
+	assert.NoError(t, uploader.Upload(&api.Artifact{Path: "llamas.txt", AbsolutePath: path, FileSize: 6}))
+
+	if assert.Len(t, requests, 1) {
+		assert.Equal(t, "PUT", requests[0].Method)
+		assert.Equal(t, "/my-container/builds/llamas.txt", requests[0].URL.Path)
+		assert.Equal(t, "secret", requests[0].URL.Query().Get("sig"))
+		assert.Equal(t, "BlockBlob", requests[0].Header.Get("x-ms-blob-type"))
+		assert.Equal(t, azureBlobAPIVersion, requests[0].Header.Get("x-ms-version"))
+		assert.Equal(t, "", requests[0].Header.Get("Authorization"))
+		assert.Equal(t, "llamas", bodies[0])
+	}
+}
@@ -0,0 +1,265 @@
+package agent
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/retry"
+	zglob "github.com/mattn/go-zglob"
+)
+
+// Cache saves archives of files between builds, and restores them again,
+// keeping them alongside artifacts in S3, Google Cloud Storage or Azure
+// Blob Storage
+type Cache struct {
+	// Where the caches are kept, the same as an artifact upload destination
+	Destination string
+
+	// The pipeline the caches belong to, which keeps them apart from the
+	// caches of other pipelines
+	Pipeline string
+
+	// How the archives are compressed, either gzip or zstd
+	Compression string
+
+	// The directory that paths are relative to, and that caches are
+	// restored into. Defaults to the working directory.
+	Dir string
+
+	// If failed responses should be dumped to the log
+	DebugHTTP bool
+}
+
+// Archives the files and directories that match the paths and saves them
+// under each of the keys
+func (c Cache) Save(keys []string, paths string) error {
+	destination, err := c.destination()
+	if err != nil {
+		return err
+	}
+
+	wd, err := c.dir()
+	if err != nil {
+		return err
+	}
+
+	matches, err := c.collect(wd, paths)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		logger.Warn("No files matched paths: %s, there's nothing to cache", paths)
+		return nil
+	}
+
+	archive, err := ioutil.TempFile("", "buildkite-cache")
+	if err != nil {
+		return err
+	}
+	archive.Close()
+	defer os.Remove(archive.Name())
+
+	logger.Info("Archiving %s", strings.Join(matches, ", "))
+
+	err = writeCompressed(archive.Name(), c.compression(), func(w io.Writer) error {
+		tw := tar.NewWriter(w)
+		for _, match := range matches {
+			if err := addToTar(tw, wd, filepath.Join(wd, match), nil); err != nil {
+				return err
+			}
+		}
+		return tw.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to archive the cache (%v)", err)
+	}
+
+	fileInfo, err := os.Stat(archive.Name())
+	if err != nil {
+		return err
+	}
+
+	uploader, err := newUploader(destination, c.DebugHTTP)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		artifact := &api.Artifact{
+			Path:         c.path(key),
+			AbsolutePath: archive.Name(),
+			FileSize:     fileInfo.Size(),
+		}
+
+		err = retry.Do(func(s *retry.Stats) error {
+			err := (&ArtifactUploader{}).uploadArtifact(uploader, artifact)
+			if err != nil {
+				logger.Warn("%s (%s)", err, s)
+			}
+			return err
+		}, &retry.Config{Maximum: 3, Interval: 5 * time.Second})
+		if err != nil {
+			return fmt.Errorf("Failed to save cache %s (%v)", key, err)
+		}
+
+		logger.Info("Saved cache %s (%d bytes)", key, fileInfo.Size())
+	}
+
+	return nil
+}
+
+// Restores the cache of the first key that has one, and returns the key. It's
+// empty if none of them did.
+func (c Cache) Restore(keys []string) (string, error) {
+	destination, err := c.destination()
+	if err != nil {
+		return "", err
+	}
+
+	wd, err := c.dir()
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := ioutil.TempDir("", "buildkite-cache")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, key := range keys {
+		err := c.download(destination, c.path(key), dir)
+		if isMissingDownload(err) {
+			logger.Info("No cache was found for %s", key)
+			continue
+		} else if err != nil {
+			return "", fmt.Errorf("Failed to download cache %s (%v)", key, err)
+		}
+
+		if err := c.extract(filepath.Join(dir, c.path(key)), wd); err != nil {
+			return "", fmt.Errorf("Failed to restore cache %s (%v)", key, err)
+		}
+
+		logger.Info("Restored cache %s", key)
+		return key, nil
+	}
+
+	return "", nil
+}
+
+// Returns the paths that match, relative to the directory. Anything outside
+// of it can't be cached, since it couldn't be restored again.
+func (c Cache) collect(wd string, paths string) ([]string, error) {
+	var matches []string
+
+	for _, globPath := range strings.Split(paths, ArtifactPathDelimiter) {
+		globPath = strings.TrimSpace(globPath)
+		if globPath == "" {
+			continue
+		}
+
+		if !filepath.IsAbs(globPath) {
+			globPath = filepath.Join(wd, globPath)
+		}
+
+		files, err := zglob.Glob(globPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		for _, file := range files {
+			absolutePath, err := filepath.Abs(file)
+			if err != nil {
+				return nil, err
+			}
+
+			if !isWithinDir(wd, absolutePath) || absolutePath == wd {
+				return nil, fmt.Errorf("Can't cache %s, it needs to be inside %s", file, wd)
+			}
+
+			path, err := filepath.Rel(wd, absolutePath)
+			if err != nil {
+				return nil, err
+			}
+
+			matches = append(matches, path)
+		}
+	}
+
+	return matches, nil
+}
+
+func (c Cache) download(destination string, path string, dir string) error {
+	if strings.HasPrefix(destination, "s3://") {
+		return S3Downloader{Path: path, Bucket: destination, Destination: dir, Retries: 3, DebugHTTP: c.DebugHTTP}.Start()
+	} else if strings.HasPrefix(destination, "gs://") {
+		return GSDownloader{Path: path, Bucket: destination, Destination: dir, Retries: 3, DebugHTTP: c.DebugHTTP}.Start()
+	}
+	return AzureBlobDownloader{Path: path, Bucket: destination, Destination: dir, Retries: 3, DebugHTTP: c.DebugHTTP}.Start()
+}
+
+func (c Cache) extract(path string, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := newDecompressReader(f, c.compression())
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return extractArchive(r, dir)
+}
+
+// Returns where the caches of the pipeline are kept, keeping any options
+// for the destination at the end
+func (c Cache) destination() (string, error) {
+	if !strings.HasPrefix(c.Destination, "s3://") &&
+		!strings.HasPrefix(c.Destination, "gs://") &&
+		!strings.HasPrefix(c.Destination, "azblob://") {
+		return "", errors.New("Caches are kept in S3, Google Cloud Storage or Azure Blob Storage, which needs to be set as the cache or artifact upload destination")
+	}
+
+	destination, query := c.Destination, ""
+	if i := strings.Index(destination, "?"); i != -1 {
+		destination, query = destination[:i], destination[i:]
+	}
+
+	destination = strings.TrimSuffix(destination, "/")
+	if c.Pipeline != "" {
+		destination += "/" + sanitizeCacheKey(c.Pipeline)
+	}
+
+	return destination + query, nil
+}
+
+func (c Cache) dir() (string, error) {
+	if c.Dir == "" {
+		return os.Getwd()
+	}
+	return filepath.Abs(c.Dir)
+}
+
+func (c Cache) compression() string {
+	if c.Compression == "" {
+		return ArtifactCompressionGzip
+	}
+	return c.Compression
+}
+
+// The path of the cache for the key, relative to the destination
+func (c Cache) path(key string) string {
+	return key + ".tar" + artifactCompressionExtension(c.compression())
+}
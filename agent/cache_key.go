@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"text/template"
+
+	zglob "github.com/mattn/go-zglob"
+)
+
+// The values that cache key templates can use
+type cacheKeyData struct {
+	Branch        string
+	DefaultBranch string
+	Pipeline      string
+	OS            string
+	Arch          string
+}
+
+// Expands a cache key template, which can use the branch and pipeline of the
+// build, and the checksum of files that decide what's cached, like
+// node-{{ .Branch }}-{{ checksum "yarn.lock" }}. Anything that can't be used
+// in the path of the cache is replaced with a dash.
+func ExpandCacheKey(key string, getenv func(string) string) (string, error) {
+	tmpl, err := template.New("key").Funcs(template.FuncMap{
+		"checksum": checksumFiles,
+		"env":      getenv,
+	}).Parse(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse cache key %q (%v)", key, err)
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, cacheKeyData{
+		Branch:        getenv("BUILDKITE_BRANCH"),
+		DefaultBranch: getenv("BUILDKITE_PIPELINE_DEFAULT_BRANCH"),
+		Pipeline:      getenv("BUILDKITE_PIPELINE_SLUG"),
+		OS:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to expand cache key %q (%v)", key, err)
+	}
+
+	expanded := sanitizeCacheKey(buf.String())
+	if expanded == "" || strings.Trim(expanded, ".") == "" {
+		return "", fmt.Errorf("Cache key %q is empty once it's expanded", key)
+	}
+
+	return expanded, nil
+}
+
+func sanitizeCacheKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '-'
+	}, key)
+}
+
+// Returns a SHA256 checksum of the paths and contents of the files that
+// match the globs
+func checksumFiles(globs ...string) (string, error) {
+	var files []string
+	for _, glob := range globs {
+		matches, err := zglob.Glob(glob)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		for _, match := range matches {
+			if !isDir(match) {
+				files = append(files, match)
+			}
+		}
+	}
+
+	if len(files) == 0 {
+		return "", fmt.Errorf("No files match %s", strings.Join(globs, ", "))
+	}
+
+	sort.Strings(files)
+
+	h := sha256.New()
+	for i, file := range files {
+		if i > 0 && files[i-1] == file {
+			continue
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(h, "%s\x00", file)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
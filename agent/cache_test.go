@@ -0,0 +1,173 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandCacheKey(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lockfile := filepath.Join(dir, "yarn.lock")
+	ioutil.WriteFile(lockfile, []byte("llamas"), 0644)
+
+	env := map[string]string{
+		"BUILDKITE_BRANCH":                  "feature/llamas",
+		"BUILDKITE_PIPELINE_DEFAULT_BRANCH": "master",
+		"NODE_VERSION":                      "10",
+	}
+	getenv := func(name string) string { return env[name] }
+
+	key, err := ExpandCacheKey("node-{{ .Branch }}-{{ env \"NODE_VERSION\" }}", getenv)
+	assert.NoError(t, err)
+	assert.Equal(t, "node-feature-llamas-10", key)
+
+	key, err = ExpandCacheKey("node-{{ .DefaultBranch }}", getenv)
+	assert.NoError(t, err)
+	assert.Equal(t, "node-master", key)
+
+	// The checksum changes with the content of the files
+	first, err := ExpandCacheKey("node-{{ checksum \""+lockfile+"\" }}", getenv)
+	assert.NoError(t, err)
+	assert.Len(t, first, len("node-")+64)
+
+	ioutil.WriteFile(lockfile, []byte("alpacas"), 0644)
+	second, err := ExpandCacheKey("node-{{ checksum \""+lockfile+"\" }}", getenv)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+
+	_, err = ExpandCacheKey("node-{{ checksum \""+filepath.Join(dir, "missing.lock")+"\" }}", getenv)
+	assert.Error(t, err)
+
+	_, err = ExpandCacheKey("{{ .Llamas }}", getenv)
+	assert.Error(t, err)
+
+	_, err = ExpandCacheKey("{{ .Branch", getenv)
+	assert.Error(t, err)
+
+	_, err = ExpandCacheKey("..", getenv)
+	assert.Error(t, err)
+}
+
+func TestCacheDestination(t *testing.T) {
+	t.Parallel()
+
+	destination, err := Cache{Destination: "s3://my-bucket/caches/?sse=AES256", Pipeline: "my-pipeline"}.destination()
+	assert.NoError(t, err)
+	assert.Equal(t, "s3://my-bucket/caches/my-pipeline?sse=AES256", destination)
+
+	_, err = Cache{}.destination()
+	assert.Error(t, err)
+}
+
+// A fake S3 that keeps objects in memory
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	switch {
+	case r.Method == "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		f.objects[r.URL.Path] = body
+	case r.Method == "GET" && strings.Count(r.URL.Path, "/") == 1:
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><ListBucketResult></ListBucketResult>`))
+	case r.Method == "GET":
+		body, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code></Error>`))
+			return
+		}
+		w.Write(body)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestCacheSaveAndRestore(t *testing.T) {
+	s3 := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	os.Setenv("BUILDKITE_S3_ACCESS_KEY_ID", "llamas")
+	os.Setenv("BUILDKITE_S3_SECRET_ACCESS_KEY", "alpacas")
+	defer os.Unsetenv("BUILDKITE_S3_ACCESS_KEY_ID")
+	defer os.Unsetenv("BUILDKITE_S3_SECRET_ACCESS_KEY")
+
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(filepath.Join(src, "node_modules", "llamas"), 0777)
+	ioutil.WriteFile(filepath.Join(src, "node_modules", "llamas", "index.js"), []byte("llamas"), 0644)
+
+	cache := Cache{
+		Destination: "s3://my-bucket/caches?endpoint=" + server.URL + "&path_style=true",
+		Pipeline:    "my-pipeline",
+		Compression: "zstd",
+		Dir:         src,
+	}
+
+	err = cache.Save([]string{"node-abc123", "node-master"}, "node_modules")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Contains(t, s3.objects, "/my-bucket/caches/my-pipeline/node-abc123.tar.zst")
+	assert.Contains(t, s3.objects, "/my-bucket/caches/my-pipeline/node-master.tar.zst")
+
+	// Restoring falls back to the keys after the first
+	cache.Dir = filepath.Join(dir, "dst")
+	os.MkdirAll(cache.Dir, 0777)
+
+	key, err := cache.Restore([]string{"node-def456", "node-master"})
+	assert.NoError(t, err)
+	assert.Equal(t, "node-master", key)
+
+	data, err := ioutil.ReadFile(filepath.Join(cache.Dir, "node_modules", "llamas", "index.js"))
+	assert.NoError(t, err)
+	assert.Equal(t, "llamas", string(data))
+
+	// And there's nothing to restore if none of them have a cache
+	key, err = cache.Restore([]string{"node-def456"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", key)
+}
+
+func TestCacheCantSaveOutsideOfDir(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "src"), 0777)
+	ioutil.WriteFile(filepath.Join(dir, "llamas.txt"), []byte("llamas"), 0644)
+
+	_, err = Cache{Dir: filepath.Join(dir, "src")}.collect(filepath.Join(dir, "src"), "../llamas.txt")
+	assert.Error(t, err)
+}
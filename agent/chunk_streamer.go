@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+)
+
+// The experiment that uploads log chunks over a single HTTP/2 stream
+const ChunkStreamingExperiment = "log-chunk-streaming"
+
+// ChunkStreamer uploads log chunks over a persistent stream to the API. Chunks
+// stay pending until the API acknowledges them, and no more than
+// MaxInFlight chunks can be pending at once. If the stream ends early, any
+// pending chunks and every chunk after them are uploaded with Fallback.
+type ChunkStreamer struct {
+	// The stream chunks are written to
+	Stream *api.ChunkStream
+
+	// Uploads a chunk on it's own, used once the stream has ended
+	Fallback func(chunk *LogStreamerChunk) error
+
+	// The maximum number of chunks waiting on acknowledgement
+	MaxInFlight int
+
+	// How long to wait for the last chunks to be acknowledged
+	StopTimeout time.Duration
+
+	// A counter of how many chunks failed to upload after falling back
+	ChunksFailedCount int32
+
+	// The chunks that have been written but not acknowledged
+	pending map[int]*LogStreamerChunk
+
+	// Holds a value for each pending chunk
+	inFlight chan struct{}
+
+	// Closed once chunks need to be uploaded with the fallback
+	ended chan struct{}
+
+	// Closed once the pending chunks have been uploaded after the stream
+	// ended
+	finished chan struct{}
+
+	// Set once the stream has ended
+	failed bool
+
+	// Protects pending and failed
+	mutex sync.Mutex
+}
+
+// Starts reading acknowledgements from the stream
+func (cs *ChunkStreamer) Start() {
+	if cs.MaxInFlight == 0 {
+		cs.MaxInFlight = 64
+	}
+	if cs.StopTimeout == 0 {
+		cs.StopTimeout = 60 * time.Second
+	}
+
+	cs.pending = make(map[int]*LogStreamerChunk)
+	cs.inFlight = make(chan struct{}, cs.MaxInFlight)
+	cs.ended = make(chan struct{})
+	cs.finished = make(chan struct{})
+
+	go cs.readAcks()
+}
+
+// Upload writes a chunk to the stream, blocking while too many chunks are
+// waiting to be acknowledged. Once the stream has ended it uploads the chunk
+// with the fallback instead.
+func (cs *ChunkStreamer) Upload(chunk *LogStreamerChunk) error {
+	select {
+	case cs.inFlight <- struct{}{}:
+	case <-cs.ended:
+		return cs.Fallback(chunk)
+	}
+
+	cs.mutex.Lock()
+	if cs.failed {
+		cs.mutex.Unlock()
+		return cs.Fallback(chunk)
+	}
+	cs.pending[chunk.Order] = chunk
+	cs.mutex.Unlock()
+
+	err := cs.Stream.Write(&api.Chunk{
+		Data:     chunk.Data,
+		Sequence: chunk.Order,
+		Offset:   chunk.Offset,
+		Size:     chunk.Size,
+	})
+	if err != nil {
+		// The chunk is still pending, so it'll be uploaded once
+		// the stream has finished ending
+		logger.Warn("[ChunkStreamer] Failed to write chunk %d to the stream (%s)", chunk.Order, err)
+		cs.Stream.Cancel()
+	}
+
+	return nil
+}
+
+// Stop ends the stream and waits for the last chunks to be acknowledged, or
+// uploaded with the fallback if they weren't
+func (cs *ChunkStreamer) Stop() error {
+	logger.Debug("[ChunkStreamer] Waiting for all the chunks to be acknowledged")
+
+	if err := cs.Stream.Close(); err != nil {
+		logger.Warn("[ChunkStreamer] Failed to close the stream (%s)", err)
+		cs.Stream.Cancel()
+	}
+
+	select {
+	case <-cs.finished:
+	case <-time.After(cs.StopTimeout):
+		logger.Warn("[ChunkStreamer] Timed out waiting for chunks to be acknowledged")
+		cs.Stream.Cancel()
+		<-cs.finished
+	}
+
+	return nil
+}
+
+func (cs *ChunkStreamer) readAcks() {
+	defer close(cs.finished)
+
+	for sequence := range cs.Stream.Acks() {
+		cs.mutex.Lock()
+		if _, ok := cs.pending[sequence]; ok {
+			delete(cs.pending, sequence)
+			<-cs.inFlight
+		}
+		cs.mutex.Unlock()
+	}
+
+	cs.mutex.Lock()
+	cs.failed = true
+	remaining := []*LogStreamerChunk{}
+	for _, chunk := range cs.pending {
+		remaining = append(remaining, chunk)
+	}
+	cs.pending = make(map[int]*LogStreamerChunk)
+	cs.mutex.Unlock()
+
+	close(cs.ended)
+
+	if err := cs.Stream.Err(); err != nil {
+		logger.Warn("[ChunkStreamer] Stream ended unexpectedly (%s), uploading chunks individually instead", err)
+	}
+
+	if len(remaining) == 0 {
+		return
+	}
+
+	logger.Debug("[ChunkStreamer] Uploading %d unacknowledged chunks individually", len(remaining))
+
+	sort.Slice(remaining, func(i, j int) bool {
+		return remaining[i].Order < remaining[j].Order
+	})
+
+	for _, chunk := range remaining {
+		if err := cs.Fallback(chunk); err != nil {
+			atomic.AddInt32(&cs.ChunksFailedCount, 1)
+
+			logger.Error("Giving up on uploading chunk %d, this will result in only a partial build log on Buildkite", chunk.Order)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// Starts an HTTP/2 server that reads streamed chunks, acknowledging at most
+// ackLimit of them before ending the stream
+func createChunkStreamServer(t *testing.T, ackLimit int) (*httptest.Server, *api.Client, func() []string) {
+	var received []string
+	var mutex sync.Mutex
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/jobs/my-job/chunks/stream" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		scanner := bufio.NewScanner(gz)
+		for acks := 0; acks < ackLimit && scanner.Scan(); acks++ {
+			var chunk struct {
+				Data     string `json:"data"`
+				Sequence int    `json:"sequence"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+				t.Error(err)
+				return
+			}
+
+			mutex.Lock()
+			received = append(received, chunk.Data)
+			mutex.Unlock()
+
+			fmt.Fprintf(w, "{\"sequence\":%d}\n", chunk.Sequence)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+
+	client := api.NewClient(server.Client())
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+
+	return server, client, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, received...)
+	}
+}
+
+func TestStreamingChunks(t *testing.T) {
+	t.Parallel()
+
+	server, client, received := createChunkStreamServer(t, 100)
+	defer server.Close()
+
+	stream, err := client.Chunks.Stream("my-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs := &ChunkStreamer{
+		Stream:      stream,
+		MaxInFlight: 2,
+		Fallback: func(chunk *LogStreamerChunk) error {
+			t.Errorf("Chunk %d shouldn't have fallen back", chunk.Order)
+			return nil
+		},
+	}
+	cs.Start()
+
+	for i := 1; i <= 5; i++ {
+		assert.NoError(t, cs.Upload(&LogStreamerChunk{Data: fmt.Sprintf("chunk %d", i), Order: i}))
+	}
+
+	assert.NoError(t, cs.Stop())
+	assert.Equal(t, []string{"chunk 1", "chunk 2", "chunk 3", "chunk 4", "chunk 5"}, received())
+	assert.Equal(t, int32(0), cs.ChunksFailedCount)
+}
+
+func TestStreamingChunksFallsBackWhenTheStreamEnds(t *testing.T) {
+	t.Parallel()
+
+	server, client, received := createChunkStreamServer(t, 2)
+	defer server.Close()
+
+	stream, err := client.Chunks.Stream("my-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fallbacks []int
+	var mutex sync.Mutex
+
+	cs := &ChunkStreamer{
+		Stream: stream,
+		Fallback: func(chunk *LogStreamerChunk) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			fallbacks = append(fallbacks, chunk.Order)
+			return nil
+		},
+	}
+	cs.Start()
+
+	for i := 1; i <= 2; i++ {
+		assert.NoError(t, cs.Upload(&LogStreamerChunk{Data: fmt.Sprintf("chunk %d", i), Order: i}))
+	}
+
+	// Wait for the server to end the stream after acknowledging both
+	<-cs.ended
+
+	for i := 3; i <= 4; i++ {
+		assert.NoError(t, cs.Upload(&LogStreamerChunk{Data: fmt.Sprintf("chunk %d", i), Order: i}))
+	}
+
+	assert.NoError(t, cs.Stop())
+	assert.Equal(t, []string{"chunk 1", "chunk 2"}, received())
+	assert.Equal(t, []int{3, 4}, fallbacks)
+}
+
+func TestStreamingChunksIsUnsupported(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	client := api.NewClient(server.Client())
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+
+	_, err := client.Chunks.Stream("my-job")
+	assert.Error(t, err)
+}
@@ -0,0 +1,327 @@
+package agent
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol"
+	"github.com/aws/aws-sdk-go/private/protocol/query"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/metrics"
+)
+
+// How often the metrics are published to CloudWatch, which keeps them at
+// its standard resolution
+var cloudWatchInterval = time.Minute
+
+// A metric of the agent's that's published to CloudWatch, under another name
+type cloudWatchMetric struct {
+	Name string
+	Unit string
+
+	// Converts the metric's value to the one that's published
+	convert func(v float64) float64
+}
+
+// The metrics that are published to CloudWatch. Each is a custom metric that
+// costs money, so it's only the ones that fleets are scaled on and alarmed
+// about.
+var cloudWatchMetrics = map[string]cloudWatchMetric{
+	"buildkite_agent_jobs_running": {Name: "JobsRunning", Unit: "Count"},
+	"buildkite_agent_utilization_ratio": {Name: "IdlePercent", Unit: "Percent", convert: func(v float64) float64 {
+		return (1 - v) * 100
+	}},
+	JobWaitDurationMetric: {Name: "JobWaitTime", Unit: "Seconds"},
+}
+
+// The values a gauge had since it was last published, weighted by how long
+// they were had for, so the average is what it usually was rather than what
+// it happened to be when it was published
+type cloudWatchGauge struct {
+	value    float64
+	since    time.Time
+	weighted float64
+	elapsed  time.Duration
+}
+
+func (g *cloudWatchGauge) set(v float64, at time.Time) {
+	g.add(at)
+	g.value = v
+}
+
+func (g *cloudWatchGauge) add(until time.Time) {
+	if d := until.Sub(g.since); d > 0 {
+		g.weighted += g.value * d.Seconds()
+		g.elapsed += d
+	}
+	g.since = until
+}
+
+// Returns the average since it was last published, and starts again
+func (g *cloudWatchGauge) average(now time.Time) float64 {
+	g.add(now)
+
+	average := g.value
+	if g.elapsed > 0 {
+		average = g.weighted / g.elapsed.Seconds()
+	}
+
+	g.weighted, g.elapsed = 0, 0
+	return average
+}
+
+// A cloudWatchSink publishes some of the agent's metrics to CloudWatch every
+// minute: the jobs running and how much of the time the agent's workers were
+// idle, as averages, and how long jobs waited for an agent. They're all in
+// the namespace, with the dimensions given, i.e. the agent's queue.
+type cloudWatchSink struct {
+	Namespace  string
+	Dimensions []cloudWatchDimension
+
+	put func(*cloudWatchPutMetricDataInput) error
+
+	mu     sync.Mutex
+	gauges map[string]*cloudWatchGauge
+	stats  map[string]*cloudWatchStatisticSet
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newCloudWatchSink(namespace string, dimensions map[string]string) (*cloudWatchSink, error) {
+	sess, err := awsSession()
+	if err != nil {
+		return nil, err
+	}
+	c := newCloudWatchClient(sess)
+
+	s := &cloudWatchSink{
+		Namespace: namespace,
+		put:       c.PutMetricData,
+		gauges:    map[string]*cloudWatchGauge{},
+		stats:     map[string]*cloudWatchStatisticSet{},
+	}
+
+	// Dimensions are sorted so the metrics are always the same ones
+	names := []string{}
+	for name := range dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s.Dimensions = append(s.Dimensions, cloudWatchDimension{Name: name, Value: dimensions[name]})
+	}
+
+	return s, nil
+}
+
+// Count does nothing, as none of the published metrics are counters
+func (s *cloudWatchSink) Count(name string, value float64, tags []metrics.Tag) {}
+
+// Gauge records the new value of a gauge
+func (s *cloudWatchSink) Gauge(name string, value float64, tags []metrics.Tag) {
+	s.setGauge(name, value, time.Now())
+}
+
+func (s *cloudWatchSink) setGauge(name string, value float64, at time.Time) {
+	if _, ok := cloudWatchMetrics[name]; !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g, ok := s.gauges[name]
+	if !ok {
+		g = &cloudWatchGauge{since: at}
+		s.gauges[name] = g
+	}
+	g.set(value, at)
+}
+
+// Histogram adds an observed value to the statistics that are published
+func (s *cloudWatchSink) Histogram(name string, value float64, tags []metrics.Tag) {
+	if _, ok := cloudWatchMetrics[name]; !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats, ok := s.stats[name]
+	if !ok {
+		s.stats[name] = &cloudWatchStatisticSet{SampleCount: 1, Sum: value, Minimum: value, Maximum: value}
+		return
+	}
+	stats.SampleCount++
+	stats.Sum += value
+	stats.Minimum = math.Min(stats.Minimum, value)
+	stats.Maximum = math.Max(stats.Maximum, value)
+}
+
+// Start publishes the metrics in the background until it's stopped
+func (s *cloudWatchSink) Start() {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(cloudWatchInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				s.publish(time.Now())
+				return
+			}
+			s.publish(time.Now())
+		}
+	}()
+}
+
+// Stop publishes what's been recorded since the metrics were last published,
+// and stops publishing them
+func (s *cloudWatchSink) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *cloudWatchSink) publish(now time.Time) {
+	data := s.data(now)
+	if len(data) == 0 {
+		return
+	}
+
+	err := s.put(&cloudWatchPutMetricDataInput{Namespace: s.Namespace, MetricData: data})
+	if err != nil {
+		logger.Warn("Failed to publish metrics to CloudWatch (%s)", err)
+	}
+}
+
+// Returns the data to publish, and starts the next period
+func (s *cloudWatchSink) data(now time.Time) []cloudWatchDatum {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var data []cloudWatchDatum
+
+	for name, g := range s.gauges {
+		m := cloudWatchMetrics[name]
+
+		value := g.average(now)
+		if m.convert != nil {
+			value = m.convert(value)
+		}
+
+		data = append(data, cloudWatchDatum{
+			MetricName: m.Name,
+			Dimensions: s.Dimensions,
+			Timestamp:  now,
+			Unit:       m.Unit,
+			Value:      &value,
+		})
+	}
+
+	for name, stats := range s.stats {
+		m := cloudWatchMetrics[name]
+
+		data = append(data, cloudWatchDatum{
+			MetricName:      m.Name,
+			Dimensions:      s.Dimensions,
+			Timestamp:       now,
+			Unit:            m.Unit,
+			StatisticValues: stats,
+		})
+	}
+	s.stats = map[string]*cloudWatchStatisticSet{}
+
+	sort.Slice(data, func(i, j int) bool { return data[i].MetricName < data[j].MetricName })
+	return data
+}
+
+// The SDK the agent uses doesn't have a CloudWatch client, so this is the
+// one call of its API that's needed, made the same way as the SDK's own
+// clients make theirs
+type cloudWatchClient struct {
+	*client.Client
+}
+
+func newCloudWatchClient(p client.ConfigProvider) *cloudWatchClient {
+	c := p.ClientConfig("monitoring")
+
+	svc := &cloudWatchClient{
+		Client: client.New(
+			*c.Config,
+			metadata.ClientInfo{
+				ServiceName:   "monitoring",
+				SigningName:   c.SigningName,
+				SigningRegion: c.SigningRegion,
+				Endpoint:      c.Endpoint,
+				APIVersion:    "2010-08-01",
+			},
+			c.Handlers,
+		),
+	}
+
+	svc.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	svc.Handlers.Build.PushBackNamed(query.BuildHandler)
+	svc.Handlers.Unmarshal.PushBackNamed(protocol.UnmarshalDiscardBodyHandler)
+	svc.Handlers.UnmarshalMeta.PushBackNamed(query.UnmarshalMetaHandler)
+	svc.Handlers.UnmarshalError.PushBackNamed(query.UnmarshalErrorHandler)
+
+	return svc
+}
+
+// PutMetricData publishes data points to CloudWatch
+func (c *cloudWatchClient) PutMetricData(input *cloudWatchPutMetricDataInput) error {
+	op := &request.Operation{
+		Name:       "PutMetricData",
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+
+	return c.NewRequest(op, input, nil).Send()
+}
+
+type cloudWatchPutMetricDataInput struct {
+	_ struct{} `type:"structure"`
+
+	Namespace  string            `type:"string"`
+	MetricData []cloudWatchDatum `type:"list"`
+}
+
+type cloudWatchDatum struct {
+	_ struct{} `type:"structure"`
+
+	MetricName      string                  `type:"string"`
+	Dimensions      []cloudWatchDimension   `type:"list"`
+	Timestamp       time.Time               `type:"timestamp" timestampFormat:"iso8601"`
+	Unit            string                  `type:"string"`
+	Value           *float64                `type:"double"`
+	StatisticValues *cloudWatchStatisticSet `type:"structure"`
+}
+
+type cloudWatchDimension struct {
+	_ struct{} `type:"structure"`
+
+	Name  string `type:"string"`
+	Value string `type:"string"`
+}
+
+type cloudWatchStatisticSet struct {
+	_ struct{} `type:"structure"`
+
+	SampleCount float64 `type:"double"`
+	Sum         float64 `type:"double"`
+	Minimum     float64 `type:"double"`
+	Maximum     float64 `type:"double"`
+}
@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloudWatchAveragesGaugesOverThePeriod(t *testing.T) {
+	t.Parallel()
+
+	var published []*cloudWatchPutMetricDataInput
+	s := &cloudWatchSink{
+		Namespace:  "Buildkite",
+		Dimensions: []cloudWatchDimension{{Name: "Queue", Value: "default"}},
+		put: func(input *cloudWatchPutMetricDataInput) error {
+			published = append(published, input)
+			return nil
+		},
+		gauges: map[string]*cloudWatchGauge{},
+		stats:  map[string]*cloudWatchStatisticSet{},
+	}
+
+	start := time.Now()
+
+	// Busy for a quarter of the minute
+	s.setGauge("buildkite_agent_utilization_ratio", 1, start)
+	s.setGauge("buildkite_agent_utilization_ratio", 0, start.Add(15*time.Second))
+	s.setGauge("buildkite_agent_workers_running", 1, start)
+	s.Histogram(JobWaitDurationMetric, 2, nil)
+	s.Histogram(JobWaitDurationMetric, 10, nil)
+
+	s.publish(start.Add(time.Minute))
+
+	if !assert.Len(t, published, 1) || !assert.Len(t, published[0].MetricData, 2) {
+		return
+	}
+	assert.Equal(t, "Buildkite", published[0].Namespace)
+
+	idle := published[0].MetricData[0]
+	assert.Equal(t, "IdlePercent", idle.MetricName)
+	assert.Equal(t, "Percent", idle.Unit)
+	assert.InDelta(t, 75, *idle.Value, 0.001)
+	assert.Equal(t, s.Dimensions, idle.Dimensions)
+
+	wait := published[0].MetricData[1]
+	assert.Equal(t, "JobWaitTime", wait.MetricName)
+	assert.Equal(t, &cloudWatchStatisticSet{SampleCount: 2, Sum: 12, Minimum: 2, Maximum: 10}, wait.StatisticValues)
+
+	// Gauges carry on at their last value, and the statistics start again
+	s.publish(start.Add(2 * time.Minute))
+	if assert.Len(t, published, 2) && assert.Len(t, published[1].MetricData, 1) {
+		assert.InDelta(t, 100, *published[1].MetricData[0].Value, 0.001)
+	}
+}
+
+func TestPuttingMetricDataToCloudWatch(t *testing.T) {
+	t.Parallel()
+
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		form, _ = url.ParseQuery(string(body))
+		assert.Contains(t, req.Header.Get("Authorization"), "/us-east-1/monitoring/aws4_request")
+	}))
+	defer server.Close()
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("AKIA", "secret", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := 1.5
+	err = newCloudWatchClient(sess).PutMetricData(&cloudWatchPutMetricDataInput{
+		Namespace: "Buildkite",
+		MetricData: []cloudWatchDatum{{
+			MetricName: "JobsRunning",
+			Dimensions: []cloudWatchDimension{{Name: "Queue", Value: "default"}},
+			Timestamp:  time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+			Unit:       "Count",
+			Value:      &value,
+		}},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, url.Values{
+		"Action":                         {"PutMetricData"},
+		"Version":                        {"2010-08-01"},
+		"Namespace":                      {"Buildkite"},
+		"MetricData.member.1.MetricName": {"JobsRunning"},
+		"MetricData.member.1.Dimensions.member.1.Name":  {"Queue"},
+		"MetricData.member.1.Dimensions.member.1.Value": {"default"},
+		"MetricData.member.1.Timestamp":                 {"2018-01-02T03:04:05Z"},
+		"MetricData.member.1.Unit":                      {"Count"},
+		"MetricData.member.1.Value":                     {"1.5"},
+	}, form)
+}
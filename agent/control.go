@@ -0,0 +1,357 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// The running agent can be controlled by `buildkite-agent status`, `drain` and
+// `stop`, which talk to it over a unix socket, or a named pipe on Windows.
+// Each connection sends one request and gets one response, both a line of
+// JSON, which is all a named pipe can do without overlapped IO. Jobs use it
+// for `buildkite-agent lock` too, which waits for its response until it has
+// the lock, and `buildkite-agent git-credentials-helper` for the tokens of
+// the agent's GitHub App.
+
+// ControlRequest is sent to the running agent
+type ControlRequest struct {
+	Command  string `json:"command"`
+	Graceful bool   `json:"graceful,omitempty"`
+
+	// The lock being acquired or released, the job acquiring it, the
+	// token it was acquired with, and how many seconds to wait for it
+	LockKey     string  `json:"lock_key,omitempty"`
+	LockJobID   string  `json:"lock_job_id,omitempty"`
+	LockToken   string  `json:"lock_token,omitempty"`
+	LockTimeout float64 `json:"lock_timeout,omitempty"`
+
+	// The host and path of the repository git wants credentials for,
+	// and the secret of the job that's asking
+	GitHost   string `json:"git_host,omitempty"`
+	GitPath   string `json:"git_path,omitempty"`
+	GitSecret string `json:"git_secret,omitempty"`
+}
+
+// ControlResponse is sent back by the running agent
+type ControlResponse struct {
+	Status    *AgentStatus `json:"status,omitempty"`
+	LockToken string       `json:"lock_token,omitempty"`
+	Error     string       `json:"error,omitempty"`
+
+	// The credentials for the repository, which are empty if the agent
+	// has none for its host
+	GitUsername string `json:"git_username,omitempty"`
+	GitPassword string `json:"git_password,omitempty"`
+}
+
+// AgentStatus is the state of the running agent
+type AgentStatus struct {
+	PID        int             `json:"pid"`
+	Version    string          `json:"version"`
+	StartedAt  time.Time       `json:"started_at"`
+	Uptime     float64         `json:"uptime"`
+	State      string          `json:"state"`
+	APIHealthy bool            `json:"api_healthy"`
+	Workers    []WorkerStatus  `json:"workers"`
+	Locks      []LocalLockInfo `json:"locks"`
+}
+
+// The commands the running agent understands
+const (
+	ControlStatus = "status"
+	ControlDrain  = "drain"
+	ControlStop   = "stop"
+
+	ControlLockAcquire = "lock-acquire"
+	ControlLockRelease = "lock-release"
+
+	ControlGitCredentials = "git-credentials"
+
+	ControlRestart = "restart"
+)
+
+// Accepts control connections, from either a unix socket or a named pipe
+type controlListener interface {
+	Accept() (io.ReadWriteCloser, error)
+	Close() error
+}
+
+// Where jobs find the control socket of the agent running them
+const ControlSocketEnv = "BUILDKITE_AGENT_CONTROL_SOCKET"
+
+// How long a control connection has to send its request
+var controlRequestTimeout = 10 * time.Second
+
+// Serves the control socket in the background. The socket can't be served if
+// another agent is already using it, so that's only a warning.
+func (r *AgentPool) serveControl(path string) {
+	listener, err := listenControl(path)
+	if err != nil {
+		logger.Warn("Failed to serve the control socket at %s, so `buildkite-agent status`, `drain` and `stop` won't work: %s", path, err)
+		return
+	}
+
+	logger.Debug("Serving the control socket at %s", path)
+	r.control = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				logger.Debug("Stopped serving the control socket: %s", err)
+				return
+			}
+
+			go r.handleControl(conn)
+		}
+	}()
+}
+
+// Stops serving the control socket and removes it
+func (r *AgentPool) closeControl() {
+	if r.control != nil {
+		r.control.Close()
+	}
+}
+
+// Reads a request from the connection and writes back the response
+func (r *AgentPool) handleControl(conn io.ReadWriteCloser) {
+	defer conn.Close()
+
+	var request ControlRequest
+	var response ControlResponse
+
+	line, err := readLineWithTimeout(conn, controlRequestTimeout)
+	if err == nil {
+		err = json.Unmarshal(line, &request)
+	}
+
+	if err != nil {
+		response.Error = fmt.Sprintf("Failed to read the request: %s", err)
+	} else {
+		logger.Debug("Received control command `%s`", request.Command)
+
+		switch request.Command {
+		case ControlStatus:
+			response.Status = r.status()
+		case ControlDrain:
+			r.drain()
+			response.Status = r.status()
+		case ControlStop:
+			if request.Graceful {
+				logger.Info("Gracefully stopping the agent, as requested by `buildkite-agent stop`")
+			} else {
+				logger.Info("Stopping the agent, as requested by `buildkite-agent stop`")
+			}
+			r.stop(request.Graceful)
+			response.Status = r.status()
+		case ControlLockAcquire:
+			token, err := r.acquireLock(request)
+			if err != nil {
+				response.Error = err.Error()
+			} else {
+				response.LockToken = token
+			}
+		case ControlLockRelease:
+			if err := r.locks.Release(request.LockKey, request.LockToken); err != nil {
+				response.Error = err.Error()
+			}
+		case ControlRestart:
+			r.restart()
+			response.Status = r.status()
+		case ControlGitCredentials:
+			if username, password, err := r.gitCredentials(request); err != nil {
+				response.Error = err.Error()
+			} else {
+				response.GitUsername = username
+				response.GitPassword = password
+			}
+		default:
+			response.Error = fmt.Sprintf("Unknown command %q", request.Command)
+		}
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		logger.Error("Failed to write the control response: %s", err)
+		return
+	}
+
+	// Nothing has a lock if the response with its token doesn't make it
+	// back, so it's released again
+	if _, err := conn.Write(append(data, '\n')); err != nil && response.LockToken != "" {
+		logger.Warn("Releasing the lock %q, job %s stopped waiting for it", request.LockKey, request.LockJobID)
+		r.locks.Release(request.LockKey, response.LockToken)
+	}
+}
+
+// Waits for the lock. A client that goes away while it's waiting doesn't get
+// the response, which releases the lock again.
+func (r *AgentPool) acquireLock(request ControlRequest) (string, error) {
+	if request.LockKey == "" {
+		return "", errors.New("A lock needs a key")
+	}
+
+	logger.Debug("Job %s is waiting for the lock %q", request.LockJobID, request.LockKey)
+
+	timeout := time.Duration(request.LockTimeout * float64(time.Second))
+	token, err := r.locks.Acquire(request.LockKey, request.LockJobID, timeout)
+	if err != nil {
+		return "", err
+	}
+
+	logger.Debug("Job %s acquired the lock %q", request.LockJobID, request.LockKey)
+	return token, nil
+}
+
+// Returns the credentials for the repository git is asking for, which are only
+// given to a job the agent is running for the job's own repository
+func (r *AgentPool) gitCredentials(request ControlRequest) (string, string, error) {
+	if r.gitHubApp == nil {
+		return "", "", errors.New("The agent isn't configured with a GitHub App")
+	}
+
+	repo, ok := runningGitCredentialsJobs.repo(request.GitSecret)
+	if !ok {
+		return "", "", errors.New("Git credentials are only given to the jobs the agent is running")
+	}
+
+	// Git carries on to its other helpers for other hosts
+	if !strings.EqualFold(request.GitHost, r.gitHubApp.Host) {
+		return "", "", nil
+	}
+
+	if !gitRepositoryIs(repo, request.GitHost, request.GitPath) {
+		return "", "", fmt.Errorf("Git credentials are only given for the job's repository, %s", repo)
+	}
+
+	return r.gitHubApp.Credentials(request.GitHost, request.GitPath)
+}
+
+// Reads a line, giving up if it takes too long so a stuck client doesn't keep
+// the connection open forever
+func readLineWithTimeout(conn io.ReadWriteCloser, timeout time.Duration) ([]byte, error) {
+	type result struct {
+		line []byte
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		line, err := bufio.NewReader(conn).ReadBytes('\n')
+		done <- result{line, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.line, res.err
+	case <-time.After(timeout):
+		conn.Close()
+		return nil, fmt.Errorf("Timed out after %s", timeout)
+	}
+}
+
+// Returns the state of the agent and each of its workers
+func (r *AgentPool) status() *AgentStatus {
+	r.workersLock.Lock()
+	defer r.workersLock.Unlock()
+
+	status := &AgentStatus{
+		PID:        os.Getpid(),
+		Version:    Version(),
+		StartedAt:  r.startedAt,
+		Uptime:     time.Since(r.startedAt).Seconds(),
+		State:      "running",
+		APIHealthy: !apiIsFailing(),
+		Workers:    []WorkerStatus{},
+		Locks:      r.locks.Held(),
+	}
+
+	if r.restarting {
+		status.State = "restarting"
+	} else if r.stopping {
+		status.State = "stopping"
+	} else if r.draining {
+		status.State = "draining"
+	}
+
+	for _, w := range r.workers {
+		status.Workers = append(status.Workers, w.worker.Status())
+	}
+
+	return status
+}
+
+// Stops all of the workers accepting new jobs, without disconnecting them
+func (r *AgentPool) drain() {
+	r.workersLock.Lock()
+	defer r.workersLock.Unlock()
+
+	if !r.draining {
+		logger.Info("Draining the agent, as requested by `buildkite-agent drain`")
+		r.draining = true
+		r.health.Draining()
+	}
+
+	for _, w := range r.workers {
+		w.worker.Drain()
+	}
+}
+
+// ControlClient sends commands to a running agent over its control socket
+type ControlClient struct {
+	Path string
+}
+
+// Send sends the request to the agent and returns its status
+func (c ControlClient) Send(request ControlRequest) (*AgentStatus, error) {
+	response, err := c.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Status, nil
+}
+
+// Do sends the request to the agent and returns its response
+func (c ControlClient) Do(request ControlRequest) (*ControlResponse, error) {
+	conn, err := dialControl(c.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to the agent at %s, is it running? (%s)", c.Path, err)
+	}
+	defer conn.Close()
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return nil, fmt.Errorf("Failed to send the request to the agent: %s", err)
+	}
+
+	var response ControlResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, fmt.Errorf("Failed to read the response from the agent: %s", err)
+	}
+
+	if response.Error != "" {
+		return nil, fmt.Errorf("%s", response.Error)
+	}
+
+	return &response, nil
+}
+
+// DefaultControlSocketPath returns where the control socket is unless
+// it's configured
+func DefaultControlSocketPath() string {
+	return defaultControlSocketPath()
+}
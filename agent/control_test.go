@@ -0,0 +1,233 @@
+// +build !windows
+
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func newControlTestPool(t *testing.T) (*AgentPool, string) {
+	dir, err := ioutil.TempDir("", "control-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := &AgentPool{health: &HealthCheck{}, startedAt: time.Now(), locks: newLocalLocks()}
+	worker := &AgentWorker{Agent: &api.Agent{Name: "llama"}, HealthCheck: pool.health, running: true}
+	pool.workers = []*poolWorker{{worker: worker}}
+
+	path := filepath.Join(dir, "agent.sock")
+	pool.serveControl(path)
+	if pool.control == nil {
+		t.Fatalf("Expected the control socket to be served at %s", path)
+	}
+
+	return pool, dir
+}
+
+func TestControlStatusAndDrain(t *testing.T) {
+	pool, dir := newControlTestPool(t)
+	defer os.RemoveAll(dir)
+	defer pool.closeControl()
+
+	client := ControlClient{Path: filepath.Join(dir, "agent.sock")}
+
+	status, err := client.Send(ControlRequest{Command: ControlStatus})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.Getpid(), status.PID)
+	assert.Equal(t, "running", status.State)
+	assert.Equal(t, []WorkerStatus{{Name: "llama", State: "idle"}}, status.Workers)
+
+	status, err = client.Send(ControlRequest{Command: ControlDrain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "draining", status.State)
+	assert.Equal(t, []WorkerStatus{{Name: "llama", State: "draining"}}, status.Workers)
+
+	if _, err = client.Send(ControlRequest{Command: "llamas"}); err == nil {
+		t.Fatal("Expected an error for an unknown command")
+	}
+}
+
+func TestControlRestart(t *testing.T) {
+	pool, dir := newControlTestPool(t)
+	defer os.RemoveAll(dir)
+	defer pool.closeControl()
+
+	client := ControlClient{Path: filepath.Join(dir, "agent.sock")}
+
+	status, err := client.Send(ControlRequest{Command: ControlRestart})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "restarting", status.State)
+	assert.True(t, pool.stopping)
+}
+
+func TestControlSocketIsOnlyTheAgentUsers(t *testing.T) {
+	pool, dir := newControlTestPool(t)
+	defer os.RemoveAll(dir)
+	defer pool.closeControl()
+
+	info, err := os.Stat(filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Only the socket is left where it was made, and it's removed when
+	// it's closed
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	pool.closeControl()
+	_, err = os.Stat(filepath.Join(dir, "agent.sock"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPrivateControlDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, "private")
+	assert.NoError(t, privateControlDir(private))
+	assert.NoError(t, privateControlDir(private))
+
+	info, err := os.Stat(private)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	}
+
+	// Directories others can use aren't, nor are links to them
+	shared := filepath.Join(dir, "shared")
+	assert.NoError(t, os.Mkdir(shared, 0777))
+	assert.NoError(t, os.Chmod(shared, 0777))
+	assert.Error(t, privateControlDir(shared))
+
+	link := filepath.Join(dir, "link")
+	assert.NoError(t, os.Symlink(private, link))
+	assert.Error(t, privateControlDir(link))
+}
+
+func TestControlSocketInUse(t *testing.T) {
+	pool, dir := newControlTestPool(t)
+	defer os.RemoveAll(dir)
+	defer pool.closeControl()
+
+	if _, err := listenControl(filepath.Join(dir, "agent.sock")); err == nil {
+		t.Fatal("Expected an error listening on a socket another agent is using")
+	}
+}
+
+func TestControlReplacesStaleSocket(t *testing.T) {
+	pool, dir := newControlTestPool(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent.sock")
+
+	// Leave a file behind like an agent that was killed
+	pool.closeControl()
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := listenControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+}
+
+func TestControlLocks(t *testing.T) {
+	pool, dir := newControlTestPool(t)
+	defer os.RemoveAll(dir)
+	defer pool.closeControl()
+
+	client := ControlClient{Path: filepath.Join(dir, "agent.sock")}
+
+	response, err := client.Do(ControlRequest{Command: ControlLockAcquire, LockKey: "simulator", LockJobID: "job-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := response.LockToken
+	assert.NotEmpty(t, token)
+
+	status, err := client.Send(ControlRequest{Command: ControlStatus})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []LocalLockInfo{{Key: "simulator", JobID: "job-1"}}, status.Locks)
+
+	// Another job waits for it, until it gives up
+	_, err = client.Do(ControlRequest{Command: ControlLockAcquire, LockKey: "simulator", LockJobID: "job-2", LockTimeout: 0.01})
+	assert.Error(t, err)
+
+	_, err = client.Do(ControlRequest{Command: ControlLockRelease, LockKey: "simulator", LockToken: "llamas"})
+	assert.Error(t, err)
+
+	_, err = client.Do(ControlRequest{Command: ControlLockRelease, LockKey: "simulator", LockToken: token})
+	assert.NoError(t, err)
+
+	_, err = client.Do(ControlRequest{Command: ControlLockAcquire, LockKey: "simulator", LockJobID: "job-2", LockTimeout: 1})
+	assert.NoError(t, err)
+}
+
+func TestControlOnlyGivesJobsCredentialsForTheirRepository(t *testing.T) {
+	pool, dir := newControlTestPool(t)
+	defer os.RemoveAll(dir)
+	defer pool.closeControl()
+
+	app, _, cleanup := newTestGitHubApp(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /repos/buildkite/agent/installation":
+			w.Write([]byte(`{"id": 42}`))
+		case "POST /app/installations/42/access_tokens":
+			json.NewEncoder(w).Encode(gitHubToken{Token: "ghs_llamas", ExpiresAt: time.Now().Add(time.Hour)})
+		default:
+			t.Errorf("Unexpected request to %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer cleanup()
+	pool.gitHubApp = app
+
+	secret, err := runningGitCredentialsJobs.add("git@github.com:buildkite/agent.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := ControlClient{Path: filepath.Join(dir, "agent.sock")}
+
+	response, err := client.Do(ControlRequest{Command: ControlGitCredentials, GitHost: "github.com", GitPath: "buildkite/agent.git", GitSecret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "ghs_llamas", response.GitPassword)
+
+	// Not even the job can have the credentials of other repositories
+	_, err = client.Do(ControlRequest{Command: ControlGitCredentials, GitHost: "github.com", GitPath: "buildkite/secrets.git", GitSecret: secret})
+	assert.Error(t, err)
+
+	// Nor can anything that isn't a job the agent is running
+	_, err = client.Do(ControlRequest{Command: ControlGitCredentials, GitHost: "github.com", GitPath: "buildkite/agent.git", GitSecret: "llamas"})
+	assert.Error(t, err)
+
+	runningGitCredentialsJobs.remove(secret)
+	_, err = client.Do(ControlRequest{Command: ControlGitCredentials, GitHost: "github.com", GitPath: "buildkite/agent.git", GitSecret: secret})
+	assert.Error(t, err)
+}
@@ -0,0 +1,134 @@
+// +build !windows
+
+package agent
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// The socket is in a directory of the agent user's own within the temp
+// directory, so nobody else can put anything where it's expected to be
+func defaultControlSocketPath() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("buildkite-agent-%d", os.Getuid()), "agent.sock")
+}
+
+// Creates the directory only the agent's user can use, or checks that's what
+// it is if it's already there. The temp directory is anyone's to create
+// things in, so it could have been made by someone else to put their own
+// socket in, or be a link to somewhere else.
+func privateControlDir(dir string) error {
+	if err := os.Mkdir(dir, 0700); err == nil || !os.IsExist(err) {
+		return err
+	}
+
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	switch {
+	case !info.IsDir():
+		return fmt.Errorf("%s isn't a directory", dir)
+	case !ok || int(stat.Uid) != os.Getuid():
+		return fmt.Errorf("%s belongs to another user", dir)
+	case info.Mode().Perm()&0077 != 0:
+		return fmt.Errorf("%s can be used by other users, it's permissions need to be 0700", dir)
+	}
+
+	return nil
+}
+
+type unixControlListener struct {
+	net.Listener
+
+	// Where the socket is, if it was moved there after it was created, in
+	// which case it's removed when the listener is closed
+	path string
+}
+
+func (l unixControlListener) Accept() (io.ReadWriteCloser, error) {
+	return l.Listener.Accept()
+}
+
+func (l unixControlListener) Close() error {
+	err := l.Listener.Close()
+	if l.path != "" {
+		os.Remove(l.path)
+	}
+	return err
+}
+
+// Listens on a unix socket that only the agent's user can connect to. A socket
+// left behind by an agent that's no longer running is replaced.
+func listenControl(path string) (controlListener, error) {
+	isDefault := filepath.Dir(path) == filepath.Dir(defaultControlSocketPath())
+	if isDefault {
+		if err := privateControlDir(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("Another agent is already using it")
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// The default socket is in a directory only the agent's user can use
+	if isDefault {
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		return unixControlListener{Listener: listener}, nil
+	}
+
+	return listenControlPrivately(path)
+}
+
+// Creates the socket in a directory only the agent's user can use, then moves
+// it into place once only they can connect to it, so it's never connectable by
+// anyone else, even briefly
+func listenControlPrivately(path string) (controlListener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".buildkite-agent-control-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket's removed from where it ends up when it's closed instead
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return unixControlListener{Listener: listener, path: path}, nil
+}
+
+func dialControl(path string) (io.ReadWriteCloser, error) {
+	return net.Dial("unix", path)
+}
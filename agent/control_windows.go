@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	modkernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+	procCreateNamedPipeW = modkernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe = modkernel32.NewProc("ConnectNamedPipe")
+)
+
+const (
+	pipeAccessDuplex       = 0x00000003
+	fileFlagFirstInstance  = 0x00080000
+	pipeTypeByte           = 0x00000000
+	pipeRejectRemote       = 0x00000008
+	pipeUnlimitedInstances = 255
+	pipeBufferSize         = 4096
+
+	errorPipeConnected = syscall.Errno(535)
+	errorPipeBusy      = syscall.Errno(231)
+)
+
+func defaultControlSocketPath() string {
+	return `\\.\pipe\buildkite-agent`
+}
+
+// Listens on a named pipe that can only be connected to from this machine.
+// Each connection is a new instance of the pipe, and the next instance is
+// created as soon as one is connected to, so clients don't find it missing.
+type pipeControlListener struct {
+	path string
+
+	mu     sync.Mutex
+	next   syscall.Handle
+	closed bool
+}
+
+func listenControl(path string) (controlListener, error) {
+	// Creating the first instance fails if another agent has the pipe
+	handle, err := createNamedPipe(path, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pipeControlListener{path: path, next: handle}, nil
+}
+
+func (l *pipeControlListener) Accept() (io.ReadWriteCloser, error) {
+	l.mu.Lock()
+	handle := l.next
+	l.mu.Unlock()
+
+	// Blocks until a client connects, which is also how Close stops it
+	if ok, _, err := procConnectNamedPipe.Call(uintptr(handle), 0); ok == 0 && err != errorPipeConnected {
+		syscall.CloseHandle(handle)
+		return nil, os.NewSyscallError("ConnectNamedPipe", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		syscall.CloseHandle(handle)
+		return nil, errors.New("The control pipe has been closed")
+	}
+
+	next, err := createNamedPipe(l.path, false)
+	if err != nil {
+		syscall.CloseHandle(handle)
+		return nil, err
+	}
+	l.next = next
+
+	return os.NewFile(uintptr(handle), l.path), nil
+}
+
+// Close stops accepting connections, connecting to the pipe so an Accept
+// that's waiting for a client returns
+func (l *pipeControlListener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+
+	if f, err := os.OpenFile(l.path, os.O_RDWR, 0); err == nil {
+		f.Close()
+	}
+
+	return nil
+}
+
+func createNamedPipe(path string, first bool) (syscall.Handle, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return syscall.InvalidHandle, err
+	}
+
+	mode := uintptr(pipeAccessDuplex)
+	if first {
+		mode |= fileFlagFirstInstance
+	}
+
+	handle, _, err := procCreateNamedPipeW.Call(
+		uintptr(unsafe.Pointer(name)),
+		mode,
+		pipeTypeByte|pipeRejectRemote,
+		pipeUnlimitedInstances,
+		pipeBufferSize,
+		pipeBufferSize,
+		0,
+		0,
+	)
+	if syscall.Handle(handle) == syscall.InvalidHandle {
+		return syscall.InvalidHandle, os.NewSyscallError("CreateNamedPipe", err)
+	}
+
+	return syscall.Handle(handle), nil
+}
+
+// Connects to the pipe, waiting a little while if there isn't an instance to
+// connect to yet because the agent is still creating it
+func dialControl(path string) (io.ReadWriteCloser, error) {
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		var f *os.File
+		if f, err = os.OpenFile(path, os.O_RDWR, 0); err == nil {
+			return f, nil
+		}
+
+		if pathErr, ok := err.(*os.PathError); !ok || (pathErr.Err != errorPipeBusy && pathErr.Err != syscall.ERROR_FILE_NOT_FOUND) {
+			return nil, err
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return nil, err
+}
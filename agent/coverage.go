@@ -0,0 +1,348 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/agent/logger"
+	zglob "github.com/mattn/go-zglob"
+)
+
+// The file a coverage summary is kept in when it's saved as a baseline
+const coverageBaselineFile = "coverage-summary.json"
+
+// CoverageSummary is the line coverage of a set of lcov or Cobertura reports.
+// Reports of the same source file are merged, so a line is covered if any of
+// them covered it.
+type CoverageSummary struct {
+	Reports int     `json:"reports"`
+	Files   int     `json:"files"`
+	Lines   int     `json:"lines"`
+	Covered int     `json:"covered"`
+	Percent float64 `json:"percent"`
+}
+
+// The coverage of one source file. Lines are tracked individually when the
+// report has them, and otherwise only the totals are known.
+type coverageFile struct {
+	lines   map[int]bool
+	found   int
+	hit     int
+	byLines bool
+}
+
+func newCoverageFile() *coverageFile {
+	return &coverageFile{lines: map[int]bool{}}
+}
+
+func (f *coverageFile) addLine(line int, hits int) {
+	f.byLines = true
+	f.lines[line] = f.lines[line] || hits > 0
+}
+
+func (f *coverageFile) totals() (int, int) {
+	if !f.byLines {
+		return f.found, f.hit
+	}
+
+	covered := 0
+	for _, hit := range f.lines {
+		if hit {
+			covered++
+		}
+	}
+	return len(f.lines), covered
+}
+
+// SummarizeCoverage finds the reports matching the paths, separated like
+// artifact upload paths, and merges them into a summary. Reports that can't be
+// parsed are skipped with a warning.
+func SummarizeCoverage(paths string) (*CoverageSummary, error) {
+	reports := map[string]bool{}
+
+	for _, path := range strings.Split(paths, ArtifactPathDelimiter) {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		matches, err := zglob.Glob(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		for _, match := range matches {
+			if !isDir(match) {
+				reports[match] = true
+			}
+		}
+	}
+
+	var sorted []string
+	for report := range reports {
+		sorted = append(sorted, report)
+	}
+	sort.Strings(sorted)
+
+	summary := &CoverageSummary{}
+	files := map[string]*coverageFile{}
+
+	for _, report := range sorted {
+		logger.Debug("Reading coverage from %s", report)
+
+		if err := readCoverageReport(report, files); err != nil {
+			logger.Warn("Skipping %s, its coverage couldn't be read (%s)", report, err)
+			continue
+		}
+
+		summary.Reports++
+	}
+
+	for _, file := range files {
+		lines, covered := file.totals()
+		summary.Files++
+		summary.Lines += lines
+		summary.Covered += covered
+	}
+
+	if summary.Lines > 0 {
+		summary.Percent = float64(summary.Covered) * 100 / float64(summary.Lines)
+	}
+
+	return summary, nil
+}
+
+func readCoverageReport(path string, files map[string]*coverageFile) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	// Reports are lcov unless they're XML, since they have all sorts of
+	// extensions
+	switch {
+	case strings.ToLower(filepath.Ext(path)) == ".xml", looksLikeXML(r):
+		return parseCobertura(r, files)
+	default:
+		return parseLcov(r, files)
+	}
+}
+
+// Adds the coverage from an lcov tracefile
+func parseLcov(r io.Reader, files map[string]*coverageFile) error {
+	var current *coverageFile
+	records := 0
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		i := strings.IndexByte(line, ':')
+		if line == "end_of_record" {
+			current = nil
+			continue
+		} else if i < 0 {
+			continue
+		}
+
+		field, value := line[:i], line[i+1:]
+
+		if field == "SF" {
+			current = coverageFileFor(files, value)
+			records++
+			continue
+		} else if current == nil {
+			continue
+		}
+
+		switch field {
+		case "DA":
+			// DA:<line>,<hits>[,<checksum>]
+			parts := strings.Split(value, ",")
+			if len(parts) < 2 {
+				return fmt.Errorf("%q isn't a line's coverage", line)
+			}
+			number, err := strconv.Atoi(parts[0])
+			if err != nil {
+				return fmt.Errorf("%q isn't a line's coverage", line)
+			}
+			hits, _ := strconv.ParseFloat(parts[1], 64)
+			current.addLine(number, int(hits))
+		case "LF":
+			if n, err := strconv.Atoi(value); err == nil && n > current.found {
+				current.found = n
+			}
+		case "LH":
+			if n, err := strconv.Atoi(value); err == nil && n > current.hit {
+				current.hit = n
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if records == 0 {
+		return fmt.Errorf("It doesn't have any source files")
+	}
+
+	return nil
+}
+
+type coberturaClass struct {
+	Filename string          `xml:"filename,attr"`
+	Lines    []coberturaLine `xml:"lines>line"`
+}
+
+type coberturaLine struct {
+	Number int    `xml:"number,attr"`
+	Hits   string `xml:"hits,attr"`
+}
+
+// Adds the coverage from a Cobertura XML report. Classes have their lines,
+// and the lines of each of their methods again, so only the class's are used.
+func parseCobertura(r io.Reader, files map[string]*coverageFile) error {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+
+	foundRoot := false
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "coverage":
+			foundRoot = true
+		case "class":
+			var class coberturaClass
+			if err := decoder.DecodeElement(&class, &start); err != nil {
+				return err
+			}
+
+			file := coverageFileFor(files, class.Filename)
+			for _, line := range class.Lines {
+				hits, _ := strconv.ParseFloat(line.Hits, 64)
+				file.addLine(line.Number, int(hits))
+			}
+		}
+	}
+
+	if !foundRoot {
+		return fmt.Errorf("It isn't a Cobertura report")
+	}
+
+	return nil
+}
+
+func coverageFileFor(files map[string]*coverageFile, path string) *coverageFile {
+	path = filepath.ToSlash(filepath.Clean(path))
+
+	file, ok := files[path]
+	if !ok {
+		file = newCoverageFile()
+		files[path] = file
+	}
+	return file
+}
+
+// Annotation returns a Markdown annotation of the coverage, and how it's
+// changed since the baseline if there is one
+func (s *CoverageSummary) Annotation(heading string, baseline *CoverageSummary, baseBranch string) string {
+	body := fmt.Sprintf("**%s:** %.2f%% of %d lines covered, in %d files\n", heading, s.Percent, s.Lines, s.Files)
+
+	if baseline == nil {
+		return body
+	}
+
+	delta := s.Percent - baseline.Percent
+	switch {
+	case delta >= 0.005:
+		body += fmt.Sprintf("\n:arrow_up: Up %.2f%% from %.2f%% on `%s`\n", delta, baseline.Percent, baseBranch)
+	case delta <= -0.005:
+		body += fmt.Sprintf("\n:arrow_down: Down %.2f%% from %.2f%% on `%s`\n", -delta, baseline.Percent, baseBranch)
+	default:
+		body += fmt.Sprintf("\nThe same as `%s`\n", baseBranch)
+	}
+
+	return body
+}
+
+// CoverageBaselineKey is the key of the cache the coverage of the branch is
+// kept in, so builds of other branches can compare theirs with it
+func CoverageBaselineKey(name string, branch string) string {
+	return sanitizeCacheKey("coverage-" + name + "-" + branch)
+}
+
+// SaveCoverageBaseline saves the summary in the cache, under the key
+func SaveCoverageBaseline(cache Cache, key string, summary *CoverageSummary) error {
+	dir, err := ioutil.TempDir("", "buildkite-coverage")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, coverageBaselineFile), data, 0600); err != nil {
+		return err
+	}
+
+	cache.Dir = dir
+	return cache.Save([]string{key}, coverageBaselineFile)
+}
+
+// LoadCoverageBaseline returns the summary saved in the cache under the key,
+// or nil if there isn't one
+func LoadCoverageBaseline(cache Cache, key string) (*CoverageSummary, error) {
+	dir, err := ioutil.TempDir("", "buildkite-coverage")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	cache.Dir = dir
+	restored, err := cache.Restore([]string{key})
+	if err != nil || restored == "" {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, coverageBaselineFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var baseline CoverageSummary
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return nil, fmt.Errorf("Failed to read the coverage baseline (%v)", err)
+	}
+
+	return &baseline, nil
+}
@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const lcovReport = `TN:
+SF:src/llamas.js
+DA:1,1
+DA:2,0
+DA:3,4
+LF:3
+LH:2
+end_of_record
+SF:src/alpacas.js
+LF:10
+LH:5
+end_of_record
+`
+
+const coberturaReport = `<?xml version="1.0" ?>
+<coverage line-rate="0.5" version="1.9">
+  <packages>
+    <package name="src">
+      <classes>
+        <class filename="src/llamas.js" name="llamas">
+          <methods>
+            <method name="spit">
+              <lines><line hits="1" number="2"/></lines>
+            </method>
+          </methods>
+          <lines>
+            <line hits="1" number="2"/>
+            <line hits="0" number="4"/>
+          </lines>
+        </class>
+        <class filename="src/camels.py" name="camels">
+          <lines>
+            <line hits="0" number="1"/>
+          </lines>
+        </class>
+      </classes>
+    </package>
+  </packages>
+</coverage>`
+
+func TestParseLcov(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]*coverageFile{}
+	assert.NoError(t, parseLcov(strings.NewReader(lcovReport), files))
+
+	lines, covered := files["src/llamas.js"].totals()
+	assert.Equal(t, 3, lines)
+	assert.Equal(t, 2, covered)
+
+	// Without the lines, the totals are used
+	lines, covered = files["src/alpacas.js"].totals()
+	assert.Equal(t, 10, lines)
+	assert.Equal(t, 5, covered)
+
+	assert.Error(t, parseLcov(strings.NewReader("llamas\n"), files))
+	assert.Error(t, parseLcov(strings.NewReader("SF:llamas.js\nDA:one,1\n"), files))
+}
+
+func TestParseCobertura(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]*coverageFile{}
+	assert.NoError(t, parseCobertura(strings.NewReader(coberturaReport), files))
+
+	// The lines of methods are already in their class's
+	lines, covered := files["src/llamas.js"].totals()
+	assert.Equal(t, 2, lines)
+	assert.Equal(t, 1, covered)
+
+	assert.Error(t, parseCobertura(strings.NewReader(`<testsuite></testsuite>`), files))
+}
+
+func TestSummarizeCoverageMergesReports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coverage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	assert.NoError(t, os.Chdir(dir))
+
+	assert.NoError(t, ioutil.WriteFile("lcov.info", []byte(lcovReport), 0666))
+	assert.NoError(t, ioutil.WriteFile("cobertura.xml", []byte(coberturaReport), 0666))
+	assert.NoError(t, ioutil.WriteFile("broken.info", []byte("llamas"), 0666))
+
+	summary, err := SummarizeCoverage("*.info;*.xml")
+	assert.NoError(t, err)
+
+	// Line 2 of llamas.js is covered by the Cobertura report, and line 4
+	// is only in it
+	assert.Equal(t, &CoverageSummary{
+		Reports: 2,
+		Files:   3,
+		Lines:   4 + 10 + 1,
+		Covered: 3 + 5,
+		Percent: float64(8) * 100 / 15,
+	}, summary)
+}
+
+func TestCoverageSummaryAnnotation(t *testing.T) {
+	t.Parallel()
+
+	summary := &CoverageSummary{Files: 3, Lines: 200, Covered: 150, Percent: 75}
+
+	assert.Equal(t, "**Coverage:** 75.00% of 200 lines covered, in 3 files\n",
+		summary.Annotation("Coverage", nil, "master"))
+	assert.Contains(t, summary.Annotation("Coverage", &CoverageSummary{Percent: 80}, "master"),
+		":arrow_down: Down 5.00% from 80.00% on `master`")
+	assert.Contains(t, summary.Annotation("Coverage", &CoverageSummary{Percent: 72.5}, "master"),
+		":arrow_up: Up 2.50% from 72.50% on `master`")
+	assert.Contains(t, summary.Annotation("Coverage", &CoverageSummary{Percent: 75.001}, "master"),
+		"The same as `master`")
+}
+
+func TestSaveAndLoadCoverageBaseline(t *testing.T) {
+	s3 := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	os.Setenv("BUILDKITE_S3_ACCESS_KEY_ID", "llamas")
+	os.Setenv("BUILDKITE_S3_SECRET_ACCESS_KEY", "alpacas")
+	defer os.Unsetenv("BUILDKITE_S3_ACCESS_KEY_ID")
+	defer os.Unsetenv("BUILDKITE_S3_SECRET_ACCESS_KEY")
+
+	cache := Cache{
+		Destination: "s3://my-bucket/caches?endpoint=" + server.URL + "&path_style=true",
+		Pipeline:    "my-pipeline",
+	}
+
+	key := CoverageBaselineKey(":jest: Tests", "master")
+	assert.Equal(t, "coverage--jest--Tests-master", key)
+
+	baseline, err := LoadCoverageBaseline(cache, key)
+	assert.NoError(t, err)
+	assert.Nil(t, baseline)
+
+	summary := &CoverageSummary{Reports: 1, Files: 3, Lines: 200, Covered: 150, Percent: 75}
+	assert.NoError(t, SaveCoverageBaseline(cache, key, summary))
+
+	baseline, err = LoadCoverageBaseline(cache, key)
+	assert.NoError(t, err)
+	assert.Equal(t, summary, baseline)
+}
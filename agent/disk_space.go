@@ -0,0 +1,16 @@
+// +build !windows
+
+package agent
+
+import "syscall"
+
+// Returns how many bytes are free for the agent to use on the disk the path
+// is on
+func freeDiskSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,25 @@
+package agent
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Returns how many bytes are free for the agent to use on the disk the path
+// is on
+func freeDiskSpace(path string) (uint64, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	dll := syscall.MustLoadDLL("kernel32.dll")
+	proc := dll.MustFindProc("GetDiskFreeSpaceExW")
+
+	var available uint64
+	if r, _, err := proc.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&available)), 0, 0); r == 0 {
+		return 0, err
+	}
+
+	return available, nil
+}
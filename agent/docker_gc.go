@@ -0,0 +1,261 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// How long each docker command has to finish before it's given up on
+var dockerGCCommandTimeout = 5 * time.Minute
+
+// DockerGC removes what Docker jobs leave behind, so agents that run a lot of
+// them don't fill their disks. Dangling images, stopped buildkite containers
+// and unused volumes are removed once they're older than TTL, and when
+// Docker's disk has less than MinFreeSpace MB free, everything unused is
+// removed whatever its age, including images that are still tagged.
+//
+// It runs after each job, and every interval while no jobs are running. The
+// containers of jobs this agent process is running are left alone.
+type DockerGC struct {
+	TTL          time.Duration
+	MinFreeSpace int
+
+	mu      sync.Mutex
+	running map[string]bool
+
+	// Whether a collection is running in the background
+	collecting bool
+
+	// Runs docker with the arguments, and is replaced in tests
+	docker func(args ...string) (string, error)
+}
+
+// BeforeJob marks the job as running, so its containers aren't removed
+func (g *DockerGC) BeforeJob(jobID string) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.running == nil {
+		g.running = map[string]bool{}
+	}
+	g.running[jobID] = true
+}
+
+// AfterJob marks the job as finished and collects in the background
+func (g *DockerGC) AfterJob(jobID string) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	delete(g.running, jobID)
+	g.mu.Unlock()
+
+	g.collectInBackground()
+}
+
+// Start collects every interval while no jobs are running
+func (g *DockerGC) Start(interval time.Duration) {
+	if g == nil || interval <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			g.mu.Lock()
+			idle := len(g.running) == 0
+			g.mu.Unlock()
+
+			if idle {
+				g.collectInBackground()
+			}
+		}
+	}()
+}
+
+// Starts a collection, unless one is already running
+func (g *DockerGC) collectInBackground() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.collecting {
+		return
+	}
+	g.collecting = true
+
+	go func() {
+		if err := g.collect(); err != nil {
+			logger.Warn("Failed to clean up after Docker: %s", err)
+		}
+
+		g.mu.Lock()
+		g.collecting = false
+		g.mu.Unlock()
+	}()
+}
+
+// Removes the stopped containers, then the dangling images and unused volumes
+func (g *DockerGC) collect() error {
+	ttl := g.TTL
+
+	pressure := g.underPressure()
+	if pressure {
+		ttl = 0
+	}
+
+	if err := g.removeContainers(); err != nil {
+		return err
+	}
+
+	// With the containers gone, the images and volumes they used are unused
+	args := []string{"image", "prune", "--force"}
+	if pressure {
+		args = append(args, "--all")
+	} else if ttl > 0 {
+		args = append(args, "--filter", "until="+ttl.String())
+	}
+	if _, err := g.run(args...); err != nil {
+		return err
+	}
+
+	return g.removeVolumes(ttl)
+}
+
+// Returns whether Docker's disk has less free than the agent keeps free. It's
+// never under pressure if the disk can't be found, like with remote daemons.
+func (g *DockerGC) underPressure() bool {
+	if g.MinFreeSpace <= 0 {
+		return false
+	}
+
+	root, err := g.run("info", "--format", "{{.DockerRootDir}}")
+	if err != nil || root == "" {
+		logger.Debug("Couldn't find where Docker keeps its data, so ignoring its free space (%v)", err)
+		return false
+	}
+
+	free, err := freeDiskSpace(root)
+	if err != nil {
+		logger.Debug("Couldn't check the free space on %s, so ignoring it (%v)", root, err)
+		return false
+	}
+
+	if free < uint64(g.MinFreeSpace)*1024*1024 {
+		logger.Info("Removing everything Docker isn't using, there's %d MB free on %s and the agent keeps %d MB free", free/1024/1024, root, g.MinFreeSpace)
+		return true
+	}
+
+	return false
+}
+
+// Removes the stopped containers started by jobs, which are named after the
+// job they were started by, except the ones of jobs that are still running
+func (g *DockerGC) removeContainers() error {
+	output, err := g.run("ps", "--all", "--filter", "status=exited", "--filter", "name=buildkite", "--format", "{{.ID}} {{.Names}}")
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	var ids []string
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "buildkite") || g.startedByRunningJob(fields[1]) {
+			continue
+		}
+		ids = append(ids, fields[0])
+	}
+	g.mu.Unlock()
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	logger.Debug("Removing %d stopped Docker containers", len(ids))
+
+	_, err = g.run(append([]string{"rm", "--volumes"}, ids...)...)
+	return err
+}
+
+// Returns whether the container was started by a job that's running. Compose
+// takes the dashes out of the job ID when it names the containers.
+func (g *DockerGC) startedByRunningJob(name string) bool {
+	for jobID := range g.running {
+		if strings.Contains(name, jobID) || strings.Contains(name, strings.Replace(jobID, "-", "", -1)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the volumes that no container uses and that are older than the TTL
+func (g *DockerGC) removeVolumes(ttl time.Duration) error {
+	output, err := g.run("volume", "ls", "--quiet", "--filter", "dangling=true")
+	if err != nil {
+		return err
+	}
+
+	volumes := strings.Fields(output)
+	if len(volumes) == 0 {
+		return nil
+	}
+
+	if ttl > 0 {
+		output, err = g.run(append([]string{"volume", "inspect", "--format", "{{.Name}} {{.CreatedAt}}"}, volumes...)...)
+		if err != nil {
+			return err
+		}
+
+		volumes = nil
+		for _, line := range strings.Split(output, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+
+			created, err := time.Parse(time.RFC3339, fields[1])
+			if err != nil || time.Since(created) < ttl {
+				continue
+			}
+			volumes = append(volumes, fields[0])
+		}
+
+		if len(volumes) == 0 {
+			return nil
+		}
+	}
+
+	logger.Debug("Removing %d unused Docker volumes", len(volumes))
+
+	_, err = g.run(append([]string{"volume", "rm"}, volumes...)...)
+	return err
+}
+
+func (g *DockerGC) run(args ...string) (string, error) {
+	if g.docker != nil {
+		return g.docker(args...)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dockerGCCommandTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "docker", args...).CombinedOutput()
+	if err != nil {
+		if message := strings.TrimSpace(string(output)); message != "" {
+			return "", fmt.Errorf("docker %s failed: %s", args[0], message)
+		}
+		return "", fmt.Errorf("docker %s failed: %v", args[0], err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Answers docker commands like a daemon would, and records the ones run
+type fakeDocker struct {
+	mu       sync.Mutex
+	commands []string
+	outputs  map[string]string
+}
+
+func (d *fakeDocker) run(args ...string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	command := strings.Join(args, " ")
+	d.commands = append(d.commands, command)
+
+	for prefix, output := range d.outputs {
+		if strings.HasPrefix(command, prefix) {
+			return output, nil
+		}
+	}
+	return "", nil
+}
+
+func (d *fakeDocker) ran(prefix string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var commands []string
+	for _, command := range d.commands {
+		if strings.HasPrefix(command, prefix) {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+func TestDockerGCRemovesOldResources(t *testing.T) {
+	t.Parallel()
+
+	old := time.Now().Add(-48 * time.Hour).Format(time.RFC3339)
+	recent := time.Now().Format(time.RFC3339)
+
+	docker := &fakeDocker{outputs: map[string]string{
+		"ps ":             "aaa buildkite_1234_container\nbbb buildkite5678_app_1\nccc my-database\nddd buildkite_running-job_container",
+		"volume ls ":      "old-volume\nrecent-volume",
+		"volume inspect ": fmt.Sprintf("old-volume %s\nrecent-volume %s", old, recent),
+	}}
+
+	g := &DockerGC{TTL: 24 * time.Hour, docker: docker.run}
+	g.BeforeJob("running-job")
+
+	assert.NoError(t, g.collect())
+
+	assert.Equal(t, []string{"rm --volumes aaa bbb"}, docker.ran("rm "))
+	assert.Equal(t, []string{"image prune --force --filter until=24h0m0s"}, docker.ran("image prune "))
+	assert.Equal(t, []string{"volume rm old-volume"}, docker.ran("volume rm "))
+
+	// Without the disk filling up, there's no need to check it
+	assert.Empty(t, docker.ran("info "))
+}
+
+func TestDockerGCRemovesEverythingUnusedWhenTheDiskIsFull(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "docker-gc")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	docker := &fakeDocker{outputs: map[string]string{
+		"info ":      dir,
+		"volume ls ": "recent-volume",
+	}}
+
+	// No disk has this much free
+	g := &DockerGC{TTL: 24 * time.Hour, MinFreeSpace: 1 << 40, docker: docker.run}
+	assert.NoError(t, g.collect())
+
+	assert.Equal(t, []string{"image prune --force --all"}, docker.ran("image prune "))
+	assert.Empty(t, docker.ran("volume inspect "))
+	assert.Equal(t, []string{"volume rm recent-volume"}, docker.ran("volume rm "))
+}
+
+func TestDockerGCIgnoresTheDiskOfRemoteDaemons(t *testing.T) {
+	t.Parallel()
+
+	docker := &fakeDocker{outputs: map[string]string{
+		"info ": "/var/lib/docker/that/isnt/here",
+	}}
+
+	g := &DockerGC{TTL: time.Hour, MinFreeSpace: 1 << 40, docker: docker.run}
+	assert.False(t, g.underPressure())
+}
+
+func TestNilDockerGCDoesNothing(t *testing.T) {
+	t.Parallel()
+
+	var g *DockerGC
+	g.BeforeJob("llamas")
+	g.AfterJob("llamas")
+	g.Start(time.Second)
+}
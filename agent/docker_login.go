@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/secrets"
+	homedir "github.com/mitchellh/go-homedir"
+	"golang.org/x/oauth2/google"
+)
+
+// Where the credentials for a registry come from, other than a secret
+const (
+	// A token from ECR's GetAuthorizationToken, with the agent's AWS
+	// credentials
+	DockerLoginECR = "ecr"
+
+	// An access token for the agent's Google credentials, which Artifact
+	// Registry and Container Registry accept
+	DockerLoginGCP = "gcp"
+)
+
+// DockerLogin is a registry the agent logs each job in to, and where its
+// credentials come from, which is ecr, gcp, or a secret with the
+// username:password, i.e. vault://secret/data/registry#login
+type DockerLogin struct {
+	Registry string
+	Source   string
+}
+
+// ParseDockerLogin reads a registry to log in to in the form registry=source,
+// i.e. 012345678910.dkr.ecr.us-east-1.amazonaws.com=ecr
+func ParseDockerLogin(s string) (*DockerLogin, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return nil, fmt.Errorf("Invalid docker login %q, expected registry=ecr, registry=gcp or registry=provider://path#field", s)
+	}
+
+	login := &DockerLogin{Registry: strings.TrimSpace(parts[0]), Source: strings.TrimSpace(parts[1])}
+	if login.Source != DockerLoginECR && login.Source != DockerLoginGCP && !strings.Contains(login.Source, "://") {
+		return nil, fmt.Errorf("Invalid docker login %q, the credentials come from ecr, gcp or a secret like provider://path#field", s)
+	}
+
+	return login, nil
+}
+
+// Logs the job in to the agent's registries with a docker config of its own,
+// which starts as a copy of the agent user's and is removed when the job
+// finishes. The credentials are fetched for each job, so they're fresh, and
+// the job never sees the credentials they came from.
+func (r *JobRunner) dockerLogin() error {
+	if len(r.AgentConfiguration.DockerLogins) == 0 || r.AgentConfiguration.JobExecutor == JobExecutorKubernetes {
+		return nil
+	}
+
+	config := existingDockerConfig()
+
+	auths, _ := config["auths"].(map[string]interface{})
+	if auths == nil {
+		auths = map[string]interface{}{}
+	}
+	helpers, _ := config["credHelpers"].(map[string]interface{})
+
+	for _, s := range r.AgentConfiguration.DockerLogins {
+		login, err := ParseDockerLogin(s)
+		if err != nil {
+			return err
+		}
+
+		username, password, err := r.registryCredentials(login)
+		if err != nil {
+			return fmt.Errorf("Failed to log in to %s: %v", login.Registry, err)
+		}
+		r.logStreamer.Redactor.Add(password)
+
+		auths[login.Registry] = map[string]string{
+			"auth": base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+		}
+
+		// A helper for the registry would be used instead of the login
+		delete(helpers, login.Registry)
+	}
+	config["auths"] = auths
+
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "buildkite-docker-config-")
+	if err != nil {
+		return fmt.Errorf("Failed to create the job's docker config (%v)", err)
+	}
+	r.dockerConfig = dir
+
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("Failed to write the job's docker config (%v)", err)
+	}
+	if err := r.chownForJobUser(dir, path); err != nil {
+		return err
+	}
+
+	r.process.Env = append(r.process.Env, "DOCKER_CONFIG="+dir)
+
+	r.log("start").Info("Logged job %s in to %d docker registries", r.Job.ID, len(r.AgentConfiguration.DockerLogins))
+
+	return nil
+}
+
+// Removes the job's docker config along with the credentials in it
+func (r *JobRunner) removeDockerConfig() {
+	if r.dockerConfig == "" {
+		return
+	}
+
+	if err := os.RemoveAll(r.dockerConfig); err != nil {
+		r.log("finish").Warn("Failed to remove the docker config of job %s (%s)", r.Job.ID, err)
+	}
+	r.dockerConfig = ""
+}
+
+// Returns the username and password for the registry from its source
+func (r *JobRunner) registryCredentials(login *DockerLogin) (string, string, error) {
+	switch login.Source {
+	case DockerLoginECR:
+		sess, err := awsSession()
+		if err != nil {
+			return "", "", err
+		}
+		return secrets.NewECR(sess).Login(login.Registry)
+
+	case DockerLoginGCP:
+		source, err := google.DefaultTokenSource(context.Background(), "https://www.googleapis.com/auth/cloud-platform")
+		if err != nil {
+			return "", "", err
+		}
+		token, err := source.Token()
+		if err != nil {
+			return "", "", err
+		}
+		return "oauth2accesstoken", token.AccessToken, nil
+
+	default:
+		requested, err := secrets.Parse("DOCKER_LOGIN=" + login.Source)
+		if err != nil {
+			return "", "", err
+		}
+
+		providers, err := r.secretsProviders()
+		if err != nil {
+			return "", "", err
+		}
+
+		env, err := providers.Fetch(requested)
+		if err != nil {
+			return "", "", err
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(env[0], "DOCKER_LOGIN="), ":", 2)
+		if len(parts) != 2 {
+			return "", "", fmt.Errorf("The secret %s isn't a username:password", login.Source)
+		}
+		return parts[0], parts[1], nil
+	}
+}
+
+// Returns the agent user's docker config, so the job still has everything
+// it's configured with, or an empty config if it doesn't have one
+func existingDockerConfig() map[string]interface{} {
+	config := map[string]interface{}{}
+
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := homedir.Dir()
+		if err != nil {
+			return config
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "config.json")); err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return map[string]interface{}{}
+		}
+	}
+
+	return config
+}
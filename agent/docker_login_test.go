@@ -0,0 +1,40 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDockerLogin(t *testing.T) {
+	t.Parallel()
+
+	login, err := ParseDockerLogin("012345678910.dkr.ecr.us-east-1.amazonaws.com=ecr")
+	assert.NoError(t, err)
+	assert.Equal(t, &DockerLogin{Registry: "012345678910.dkr.ecr.us-east-1.amazonaws.com", Source: DockerLoginECR}, login)
+
+	login, err = ParseDockerLogin("registry.example.com=vault://secret/data/registry#login")
+	assert.NoError(t, err)
+	assert.Equal(t, &DockerLogin{Registry: "registry.example.com", Source: "vault://secret/data/registry#login"}, login)
+
+	for _, invalid := range []string{"registry.example.com", "=ecr", "registry.example.com=azure", "registry.example.com="} {
+		_, err = ParseDockerLogin(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestDockerLoginFailsWithoutTheSecretsProvider(t *testing.T) {
+	t.Parallel()
+
+	r := &JobRunner{
+		Job: &api.Job{ID: "1234"},
+		AgentConfiguration: &AgentConfiguration{
+			DockerLogins: []string{"registry.example.com=vault://secret/data/registry#login"},
+		},
+	}
+
+	err := r.dockerLogin()
+	assert.EqualError(t, err, "Failed to log in to registry.example.com: Failed to fetch DOCKER_LOGIN from vault://secret/data/registry#login, the vault secrets provider isn't configured")
+	assert.Empty(t, r.dockerConfig)
+}
@@ -1,6 +1,8 @@
 package agent
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"net/http"
@@ -32,16 +34,35 @@ type Download struct {
 
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// The checksums recorded when the file was uploaded
+	Sha1Sum   string
+	Sha256Sum string
+
+	// Whether a missing SHA256 checksum should fail the download, as well
+	// as a mismatched one, which always does
+	Verify bool
+
+	// How the file was compressed when it was uploaded, and whether it's a
+	// tar of a directory
+	Compression string
+	Archived    bool
 }
 
 func (d Download) Start() error {
 	return retry.Do(func(s *retry.Stats) error {
 		err := d.try()
 		if err != nil {
+			// There's no point retrying a file that isn't there, or
+			// one we aren't allowed to read
+			if isMissingDownload(err) {
+				s.Break()
+			}
+
 			logger.Warn("Error trying to download %s (%s) %s", d.URL, err, s)
 		}
 		return err
-	}, &retry.Config{Maximum: d.Retries, Interval: 5 * time.Second})
+	}, &retry.Config{Maximum: d.Retries, Interval: 2 * time.Second, Exponential: true, Jitter: true})
 }
 
 func (d Download) try() error {
@@ -90,7 +111,7 @@ func (d Download) try() error {
 			logger.Debug("\nERR: %s\n%s", err, string(responseDump))
 		}
 
-		return &downloadError{response.Status}
+		return &downloadError{response.Status, response.StatusCode}
 	}
 
 	// Now make the folder for our file
@@ -106,21 +127,71 @@ func (d Download) try() error {
 	}
 	defer fileBuffer.Close()
 
-	// Copy the data to the file
-	bytes, err := io.Copy(fileBuffer, response.Body)
+	// Copy the data to the file, checksumming it on the way through
+	sha1Hash := sha1.New()
+	sha256Hash := sha256.New()
+	bytes, err := io.Copy(io.MultiWriter(fileBuffer, sha1Hash, sha256Hash), response.Body)
 	if err != nil {
 		return fmt.Errorf("Error when copying data %s (%T: %v)", d.URL, err, err)
 	}
 
+	err = d.verify(fmt.Sprintf("%x", sha1Hash.Sum(nil)), fmt.Sprintf("%x", sha256Hash.Sum(nil)))
+	if err != nil {
+		// Don't leave a corrupted file lying around for something else
+		// to pick up
+		fileBuffer.Close()
+		os.Remove(targetFile)
+		return err
+	}
+
 	logger.Info("Successfully downloaded \"%s\" %d bytes", d.Path, bytes)
 
+	if d.Compression != "" {
+		if err := fileBuffer.Close(); err != nil {
+			return err
+		}
+
+		if err := decompressArtifact(targetFile, d.Compression, d.Archived); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Compares the checksums of the downloaded file with the ones recorded when
+// it was uploaded, preferring sha256 where there is one
+func (d Download) verify(sha1Sum string, sha256Sum string) error {
+	if d.Sha256Sum != "" {
+		if d.Sha256Sum != sha256Sum {
+			return fmt.Errorf("SHA256 checksum of %s doesn't match (expected %s, got %s)", d.Path, d.Sha256Sum, sha256Sum)
+		}
+		return nil
+	}
+
+	if d.Verify {
+		return fmt.Errorf("No SHA256 checksum recorded for %s so it can't be verified", d.Path)
+	}
+
+	if d.Sha1Sum != "" && d.Sha1Sum != sha1Sum {
+		return fmt.Errorf("SHA1 checksum of %s doesn't match (expected %s, got %s)", d.Path, d.Sha1Sum, sha1Sum)
+	}
+
 	return nil
 }
 
 type downloadError struct {
-	s string
+	s    string
+	code int
 }
 
 func (e *downloadError) Error() string {
 	return e.s
 }
+
+// Whether the download failed because the file doesn't exist. S3 responds
+// with a 403 instead of a 404 when it isn't allowed to list the bucket.
+func isMissingDownload(err error) bool {
+	derr, ok := err.(*downloadError)
+	return ok && (derr.code == http.StatusNotFound || derr.code == http.StatusForbidden)
+}
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadDoesntRetryMissingFiles(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "download-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = Download{
+		URL:         server.URL + "/llamas.txt",
+		Path:        "llamas.txt",
+		Destination: dir,
+		Retries:     5,
+	}.Start()
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, requests)
+}
+
+func TestDownloadRetriesFailures(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("llamas"))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "download-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = Download{
+		URL:         server.URL + "/llamas.txt",
+		Path:        "llamas.txt",
+		Destination: dir,
+		Retries:     2,
+	}.Start()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "llamas.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "llamas", string(data))
+}
+
+func TestDownloadVerifiesChecksums(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("llamas"))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "download-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		Name      string
+		Sha256Sum string
+		Verify    bool
+		Succeeds  bool
+	}{
+		{"matching checksum", "66f0d436b0469c570b3b8d7e11a681881d9a7bcd8b12d5c2db426015d3ddfd1c", true, true},
+		{"mismatched checksum", "0000000000000000000000000000000000000000000000000000000000000000", true, false},
+		{"mismatched checksum without verify", "0000000000000000000000000000000000000000000000000000000000000000", false, false},
+		{"missing checksum", "", true, false},
+		{"missing checksum without verify", "", false, true},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := Download{
+				URL:         server.URL + "/llamas.txt",
+				Path:        "llamas.txt",
+				Destination: dir,
+				Retries:     1,
+				Sha256Sum:   tc.Sha256Sum,
+				Verify:      tc.Verify,
+			}.Start()
+
+			_, statErr := os.Stat(filepath.Join(dir, "llamas.txt"))
+			if tc.Succeeds {
+				assert.NoError(t, err)
+				assert.NoError(t, statErr)
+			} else {
+				assert.Error(t, err)
+				assert.True(t, os.IsNotExist(statErr))
+			}
+		})
+	}
+}
+
+func TestDownloadTriesIncludeTheFirst(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, 1, downloadTries(0))
+	assert.Equal(t, 3, downloadTries(2))
+	assert.Equal(t, 6, downloadTries(-1))
+}
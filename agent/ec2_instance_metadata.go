@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// Where every EC2 instance can reach its instance metadata
+const ec2InstanceMetadataEndpoint = "http://169.254.169.254"
+
+// The instance metadata, which is shared so its session token is too
+var ec2Metadata = newEC2InstanceMetadata()
+
+// How long the session tokens from the instance metadata service are valid
+// for, which is the longest it allows
+const ec2MetadataTokenTTL = 6 * time.Hour
+
+var errEC2MetadataNotFound = errors.New("It isn't in the instance metadata")
+
+// The instance metadata service of the EC2 instance the agent is running on.
+// Requests use IMDSv2, where they need a session token, which instances can
+// be configured to require. The SDK the agent uses only knows IMDSv1, which it
+// falls back to if there's no token to be had.
+type ec2InstanceMetadata struct {
+	endpoint string
+	client   *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+
+	// When to try for a token again, after not getting one
+	retryAt time.Time
+}
+
+func newEC2InstanceMetadata() *ec2InstanceMetadata {
+	return &ec2InstanceMetadata{
+		endpoint: ec2InstanceMetadataEndpoint,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Gets a path from the instance's metadata, i.e. placement/region
+func (m *ec2InstanceMetadata) get(path string) (string, error) {
+	req, err := http.NewRequest("GET", m.endpoint+"/latest/meta-data/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token := m.sessionToken(); token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", errEC2MetadataNotFound
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("The instance metadata service responded with %s for %s", resp.Status, path)
+	}
+
+	return string(body), nil
+}
+
+// Returns a session token for IMDSv2, which is empty if there isn't one and
+// requests should be made with IMDSv1
+func (m *ec2InstanceMetadata) sessionToken() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Tokens from a little while ago might expire before they're used
+	if m.token != "" && m.expiresAt.Sub(time.Now()) > time.Minute {
+		return m.token
+	}
+
+	// Without IMDSv2 every request would otherwise wait on the token
+	// first
+	if time.Now().Before(m.retryAt) {
+		return ""
+	}
+
+	token, err := m.fetchToken()
+	if err != nil {
+		m.token, m.retryAt = "", time.Now().Add(time.Minute)
+		return ""
+	}
+
+	m.token, m.expiresAt = token, time.Now().Add(ec2MetadataTokenTTL)
+	return m.token
+}
+
+func (m *ec2InstanceMetadata) fetchToken() (string, error) {
+	req, err := http.NewRequest("PUT", m.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", fmt.Sprintf("%d", int(ec2MetadataTokenTTL.Seconds())))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("The instance metadata service responded with %s", resp.Status)
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+// ec2RoleCredentials are the credentials of the instance's IAM role, read
+// from the instance metadata with IMDSv2, for instances that the SDK can't
+// get them from
+type ec2RoleCredentials struct {
+	credentials.Expiry
+
+	metadata *ec2InstanceMetadata
+}
+
+// Retrieve gets the role's credentials, which are renewed from five minutes
+// before they expire
+func (p *ec2RoleCredentials) Retrieve() (credentials.Value, error) {
+	roles, err := p.metadata.get("iam/security-credentials/")
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("The instance's IAM role couldn't be found (%v)", err)
+	}
+
+	role := strings.TrimSpace(strings.Split(roles, "\n")[0])
+	if role == "" {
+		return credentials.Value{}, errors.New("The instance doesn't have an IAM role")
+	}
+
+	body, err := p.metadata.get("iam/security-credentials/" + role)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("The credentials of the %s role couldn't be read (%v)", role, err)
+	}
+
+	var creds struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal([]byte(body), &creds); err != nil {
+		return credentials.Value{}, fmt.Errorf("The credentials of the %s role couldn't be read (%v)", role, err)
+	}
+
+	p.SetExpiration(creds.Expiration, 5*time.Minute)
+
+	return credentials.Value{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+		ProviderName:    "EC2RoleProviderIMDSv2",
+	}, nil
+}
+
+// The credentials a session finds itself as a credentials.Provider, so the
+// instance's role credentials can be tried once they can't be found
+type sessionCredentials struct {
+	*credentials.Credentials
+}
+
+func (c sessionCredentials) Retrieve() (credentials.Value, error) {
+	return c.Get()
+}
@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Serves instance metadata, which needs a session token if requireToken is
+// true. Tokens can't be had at all without tokens.
+func fakeInstanceMetadata(t *testing.T, tokens bool, requireToken bool, values map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/latest/api/token" {
+			if !tokens {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			assert.Equal(t, "PUT", req.Method)
+			assert.Equal(t, "21600", req.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"))
+			fmt.Fprint(w, "llamas")
+			return
+		}
+
+		if requireToken && req.Header.Get("X-aws-ec2-metadata-token") != "llamas" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		value, ok := values[strings.TrimPrefix(req.URL.Path, "/latest/meta-data/")]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		fmt.Fprint(w, value)
+	}))
+}
+
+func TestReadingInstanceMetadataWithIMDSv2(t *testing.T) {
+	t.Parallel()
+
+	server := fakeInstanceMetadata(t, true, true, map[string]string{"placement/region": "ap-southeast-2"})
+	defer server.Close()
+
+	m := &ec2InstanceMetadata{endpoint: server.URL, client: server.Client()}
+
+	region, err := m.get("placement/region")
+	assert.NoError(t, err)
+	assert.Equal(t, "ap-southeast-2", region)
+
+	_, err = m.get("placement/llamas")
+	assert.Equal(t, errEC2MetadataNotFound, err)
+}
+
+func TestReadingInstanceMetadataFallsBackToIMDSv1(t *testing.T) {
+	t.Parallel()
+
+	server := fakeInstanceMetadata(t, false, false, map[string]string{"instance-id": "i-1234"})
+	defer server.Close()
+
+	m := &ec2InstanceMetadata{endpoint: server.URL, client: server.Client()}
+
+	id, err := m.get("instance-id")
+	assert.NoError(t, err)
+	assert.Equal(t, "i-1234", id)
+
+	// It doesn't keep asking for a token it can't have
+	assert.True(t, m.retryAt.After(time.Now()))
+}
+
+func TestGettingRoleCredentialsWithIMDSv2(t *testing.T) {
+	t.Parallel()
+
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	server := fakeInstanceMetadata(t, true, true, map[string]string{
+		"iam/security-credentials/":                     "buildkite-agent-role\n",
+		"iam/security-credentials/buildkite-agent-role": `{"AccessKeyId":"AKIA","SecretAccessKey":"secret","Token":"token","Expiration":"` + expiration + `"}`,
+	})
+	defer server.Close()
+
+	p := &ec2RoleCredentials{metadata: &ec2InstanceMetadata{endpoint: server.URL, client: server.Client()}}
+
+	creds, err := p.Retrieve()
+	assert.NoError(t, err)
+	assert.Equal(t, "AKIA", creds.AccessKeyID)
+	assert.Equal(t, "secret", creds.SecretAccessKey)
+	assert.Equal(t, "token", creds.SessionToken)
+	assert.False(t, p.IsExpired())
+}
+
+func TestEC2MetaDataTags(t *testing.T) {
+	server := fakeInstanceMetadata(t, true, true, map[string]string{
+		"instance-id":                 "i-1234",
+		"instance-type":               "c5.large",
+		"ami-id":                      "ami-5678",
+		"placement/availability-zone": "us-east-1a",
+		"tags/instance/aws:autoscaling:groupName": "buildkite-agents",
+	})
+	defer server.Close()
+
+	defer func(m *ec2InstanceMetadata) { ec2Metadata = m }(ec2Metadata)
+	ec2Metadata = &ec2InstanceMetadata{endpoint: server.URL, client: server.Client()}
+
+	tags, err := EC2MetaData{}.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"aws:instance-id":            "i-1234",
+		"aws:instance-type":          "c5.large",
+		"aws:ami-id":                 "ami-5678",
+		"aws:availability-zone":      "us-east-1a",
+		"aws:autoscaling-group-name": "buildkite-agents",
+	}, tags)
+}
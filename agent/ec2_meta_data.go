@@ -1,39 +1,66 @@
 package agent
 
 import (
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/buildkite/agent/logger"
 )
 
 type EC2MetaData struct {
 }
 
 func (e EC2MetaData) Get() (map[string]string, error) {
-	sess, err := awsSession()
-	if err != nil {
-		return nil, err
-	}
-
 	metaData := make(map[string]string)
-	ec2metadataClient := ec2metadata.New(sess)
 
-	instanceId, err := ec2metadataClient.GetMetadata("instance-id")
-	if err != nil {
-		return metaData, err
+	for tag, path := range map[string]string{
+		"aws:instance-id":       "instance-id",
+		"aws:instance-type":     "instance-type",
+		"aws:ami-id":            "ami-id",
+		"aws:availability-zone": "placement/availability-zone",
+	} {
+		value, err := ec2Metadata.get(path)
+		if err != nil {
+			return metaData, err
+		}
+		metaData[tag] = value
+	}
+
+	// Instances that aren't in an auto scaling group don't get the tag
+	if name := autoScalingGroupName(metaData["aws:instance-id"]); name != "" {
+		metaData["aws:autoscaling-group-name"] = name
 	}
 
-	metaData["aws:instance-id"] = string(instanceId)
+	return metaData, nil
+}
+
+// Returns the name of the auto scaling group the instance is in. It's in the
+// instance metadata when the instance's tags are, otherwise it's looked up
+// with the EC2 API, which needs the ec2:DescribeTags permission.
+func autoScalingGroupName(instanceID string) string {
+	name, err := ec2Metadata.get("tags/instance/aws:autoscaling:groupName")
+	if err == nil {
+		return name
+	}
 
-	instanceType, err := ec2metadataClient.GetMetadata("instance-type")
+	sess, err := awsSession()
 	if err != nil {
-		return metaData, err
+		logger.Debug("Failed to find the auto scaling group of the instance (%s)", err)
+		return ""
 	}
-	metaData["aws:instance-type"] = string(instanceType)
 
-	amiId, err := ec2metadataClient.GetMetadata("ami-id")
+	resp, err := ec2.New(sess).DescribeTags(&ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("resource-id"), Values: []*string{aws.String(instanceID)}},
+			{Name: aws.String("key"), Values: []*string{aws.String("aws:autoscaling:groupName")}},
+		},
+	})
 	if err != nil {
-		return metaData, err
+		logger.Debug("Failed to find the auto scaling group of the instance (%s)", err)
+		return ""
 	}
-	metaData["aws:ami-id"] = string(amiId)
 
-	return metaData, nil
+	for _, tag := range resp.Tags {
+		return aws.StringValue(tag.Value)
+	}
+	return ""
 }
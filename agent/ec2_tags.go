@@ -2,7 +2,6 @@ package agent
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
@@ -16,10 +15,9 @@ func (e EC2Tags) Get() (map[string]string, error) {
 	}
 
 	tags := make(map[string]string)
-	ec2metadataClient := ec2metadata.New(sess)
 
 	// Grab the current instances id
-	instanceId, err := ec2metadataClient.GetMetadata("instance-id")
+	instanceId, err := ec2Metadata.get("instance-id")
 	if err != nil {
 		return tags, err
 	}
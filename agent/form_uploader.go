@@ -39,10 +39,11 @@ func (u *FormUploader) URL(artifact *api.Artifact) string {
 
 func (u *FormUploader) Upload(artifact *api.Artifact) error {
 	// Create a HTTP request for uploading the file
-	request, err := createUploadRequest(artifact)
+	request, file, err := createUploadRequest(artifact)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
 	// Create the client
 	client := &http.Client{}
@@ -80,16 +81,34 @@ func (u *FormUploader) Upload(artifact *api.Artifact) error {
 	return nil
 }
 
-// Creates a new file upload http request with optional extra params
-func createUploadRequest(artifact *api.Artifact) (*http.Request, error) {
+// Creates a new file upload http request with optional extra params. The
+// file is streamed into the request rather than read into memory, so it's
+// returned to be closed once the request is done.
+func createUploadRequest(artifact *api.Artifact) (*http.Request, *os.File, error) {
 	file, err := os.Open(artifact.AbsolutePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := newUploadRequest(artifact, file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return req, file, nil
+}
+
+func newUploadRequest(artifact *api.Artifact, file *os.File) (*http.Request, error) {
+	fileInfo, err := file.Stat()
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
+	// The form is written up to the file, which is read straight into
+	// the request, and then the end of the form is written after it
+	buf := &bytes.Buffer{}
+	writer := multipart.NewWriter(buf)
 
 	// Set the post data for the request
 	for key, val := range artifact.UploadInstructions.Data {
@@ -107,21 +126,21 @@ func createUploadRequest(artifact *api.Artifact) (*http.Request, error) {
 	// It's important that we add the form field last because when
 	// uploading to an S3 form, they are really nit-picky about the field
 	// order, and the file needs to be the last one other it doesn't work.
-	part, err := writer.CreateFormFile(artifact.UploadInstructions.Action.FileInput, artifact.Path)
+	_, err = writer.CreateFormFile(artifact.UploadInstructions.Action.FileInput, artifact.Path)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = io.Copy(part, file)
-	if err != nil {
-		return nil, err
-	}
+	head := append([]byte{}, buf.Bytes()...)
+	buf.Reset()
 
 	err = writer.Close()
 	if err != nil {
 		return nil, err
 	}
 
+	tail := buf.Bytes()
+
 	// Create the URL that we'll send data to
 	uri, err := url.Parse(artifact.UploadInstructions.Action.URL)
 	if err != nil {
@@ -131,11 +150,15 @@ func createUploadRequest(artifact *api.Artifact) (*http.Request, error) {
 	uri.Path = artifact.UploadInstructions.Action.Path
 
 	// Create the request
+	body := io.MultiReader(bytes.NewReader(head), file, bytes.NewReader(tail))
 	req, err := http.NewRequest(artifact.UploadInstructions.Action.Method, uri.String(), body)
 	if err != nil {
 		return nil, err
 	}
 
+	// S3 forms need to know how big the upload is up front
+	req.ContentLength = int64(len(head)) + fileInfo.Size() + int64(len(tail))
+
 	// Finally add the multipart content type to the request
 	req.Header.Add("Content-Type", writer.FormDataContentType())
 
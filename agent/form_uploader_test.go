@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormUploaderStreamsTheFileIntoTheForm(t *testing.T) {
+	t.Parallel()
+
+	type received struct {
+		contentLength int64
+		key           string
+		file          string
+		filename      string
+	}
+	requests := make(chan received, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req received
+		req.contentLength = r.ContentLength
+
+		if err := r.ParseMultipartForm(1024); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.key = r.FormValue("key")
+
+		if f, header, err := r.FormFile("file"); err == nil {
+			data, _ := ioutil.ReadAll(f)
+			req.file = string(data)
+			req.filename = header.Filename
+			f.Close()
+		}
+
+		requests <- req
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "form-uploader-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "llamas.txt")
+	if err := ioutil.WriteFile(path, []byte("llamas are excellent"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	artifact := &api.Artifact{Path: "llamas.txt", AbsolutePath: path, UploadInstructions: &api.ArtifactUploadInstructions{
+		Data: map[string]string{"key": "uploads/${artifact:path}"},
+	}}
+	artifact.UploadInstructions.Action.URL = server.URL
+	artifact.UploadInstructions.Action.Method = "POST"
+	artifact.UploadInstructions.Action.Path = "/upload"
+	artifact.UploadInstructions.Action.FileInput = "file"
+
+	uploader := FormUploader{}
+	if !assert.NoError(t, uploader.Upload(artifact)) {
+		return
+	}
+
+	req := <-requests
+	assert.True(t, req.contentLength > int64(len("llamas are excellent")), "The request should have a content length")
+	assert.Equal(t, "uploads/llamas.txt", req.key)
+	assert.Equal(t, "llamas are excellent", req.file)
+	assert.Equal(t, "llamas.txt", req.filename)
+}
@@ -0,0 +1,375 @@
+package agent
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where the git credentials helper gets the credentials for the checkout
+const (
+	// Installation tokens of a GitHub App, which the agent mints for each
+	// repository
+	GitCredentialsGitHubApp = "github-app"
+
+	// The CI_JOB_TOKEN of the job, which GitLab accepts for the
+	// repositories the job's project can read
+	GitCredentialsGitLabJobToken = "gitlab-job-token"
+)
+
+// The environment variable with the secret a job's git credentials helper
+// sends with its requests, which only that job has
+const GitCredentialsSecretEnv = "BUILDKITE_GIT_CREDENTIALS_SECRET"
+
+// gitCredentialsJobs are the repositories of the jobs that are running, by
+// the secret each job was given, so a job can only get credentials for its
+// own repository and not those of every other pipeline the app can read
+type gitCredentialsJobs struct {
+	mu    sync.Mutex
+	repos map[string]string
+}
+
+var runningGitCredentialsJobs = &gitCredentialsJobs{repos: map[string]string{}}
+
+// Adds a job's repository, returning the secret the job asks for its
+// credentials with
+func (j *gitCredentialsJobs) add(repo string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(b)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.repos[secret] = repo
+	return secret, nil
+}
+
+// Removes a job once it's finished, so its secret no longer works
+func (j *gitCredentialsJobs) remove(secret string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.repos, secret)
+}
+
+// Returns the repository of the job with the secret
+func (j *gitCredentialsJobs) repo(secret string) (string, bool) {
+	if secret == "" {
+		return "", false
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	repo, ok := j.repos[secret]
+	return repo, ok
+}
+
+// Returns whether a repository, as it's given in BUILDKITE_REPO, is the one
+// at the host and path git wants credentials for
+func gitRepositoryIs(repo string, host string, path string) bool {
+	repoHost, repoPath, ok := parseGitRepository(repo)
+	if !ok {
+		return false
+	}
+
+	return strings.EqualFold(repoHost, host) && normalizeGitPath(repoPath) == normalizeGitPath(path)
+}
+
+// Splits a repository into its host and path, from either a URL or the scp
+// like git@github.com:buildkite/agent.git
+func parseGitRepository(repo string) (string, string, bool) {
+	if strings.Contains(repo, "://") {
+		u, err := url.Parse(repo)
+		if err != nil {
+			return "", "", false
+		}
+		return u.Hostname(), u.Path, true
+	}
+
+	parts := strings.SplitN(repo, ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	host := parts[0]
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		host = host[i+1:]
+	}
+	return host, parts[1], true
+}
+
+func normalizeGitPath(path string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.Trim(path, "/"), ".git"))
+}
+
+// How long before an installation token expires that a new one is minted, so
+// a token is never handed out just before it stops working
+var gitHubTokenExpiryMargin = 5 * time.Minute
+
+// GitHubApp mints installation tokens for the repositories its installations
+// can read, which are only valid for an hour, so agents don't need a personal
+// access token that works for as long as it's on the disk. The tokens are
+// cached until they're about to expire, and only ever for the one host the
+// app is on.
+type GitHubApp struct {
+	AppID          string
+	InstallationID int
+	Host           string
+
+	key    *rsa.PrivateKey
+	client *http.Client
+
+	// The API to use instead of the host's, in tests
+	apiURL string
+
+	mu     sync.Mutex
+	tokens map[string]gitHubToken
+}
+
+type gitHubToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewGitHubApp loads the app's private key, which is the PEM file GitHub
+// gives you when the key is generated
+func NewGitHubApp(appID string, keyPath string, installationID int, host string) (*GitHubApp, error) {
+	if appID == "" {
+		return nil, errors.New("A GitHub App needs an app ID")
+	}
+
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("The private key of the GitHub App couldn't be read (%v)", err)
+	}
+
+	key, err := parseRSAPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("The private key in %s couldn't be read (%v)", keyPath, err)
+	}
+
+	if host == "" {
+		host = "github.com"
+	}
+
+	return &GitHubApp{
+		AppID:          appID,
+		InstallationID: installationID,
+		Host:           host,
+		key:            key,
+		client:         &http.Client{Timeout: 30 * time.Second},
+		tokens:         map[string]gitHubToken{},
+	}, nil
+}
+
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("it isn't a PEM file")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("it isn't an RSA key")
+	}
+	return key, nil
+}
+
+// Credentials returns the username and installation token that clone the
+// repository at path, i.e. buildkite/agent.git, on host. Hosts other than the
+// app's get no credentials, so a checkout from anywhere else never sees them.
+func (a *GitHubApp) Credentials(host string, path string) (string, string, error) {
+	if !strings.EqualFold(host, a.Host) {
+		return "", "", nil
+	}
+
+	parts := strings.Split(strings.TrimSuffix(strings.Trim(path, "/"), ".git"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("%q isn't the path of a GitHub repository, is credential.useHttpPath set?", path)
+	}
+	owner, repo := parts[0], parts[1]
+	key := strings.ToLower(owner + "/" + repo)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if token, ok := a.tokens[key]; ok && token.ExpiresAt.Sub(time.Now()) > gitHubTokenExpiryMargin {
+		return "x-access-token", token.Token, nil
+	}
+
+	token, err := a.mintToken(owner, repo)
+	if err != nil {
+		return "", "", err
+	}
+
+	a.tokens[key] = *token
+	return "x-access-token", token.Token, nil
+}
+
+// Mints a token that can only read the one repository, from the app's
+// installation in the repository's account unless it's configured
+func (a *GitHubApp) mintToken(owner string, repo string) (*gitHubToken, error) {
+	jwt, err := a.jwt(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	installationID := a.InstallationID
+	if installationID == 0 {
+		var installation struct {
+			ID int `json:"id"`
+		}
+		if err := a.request("GET", fmt.Sprintf("/repos/%s/%s/installation", owner, repo), jwt, nil, &installation); err != nil {
+			return nil, fmt.Errorf("The GitHub App isn't installed for %s/%s (%v)", owner, repo, err)
+		}
+		installationID = installation.ID
+	}
+
+	body := map[string]interface{}{
+		"repositories": []string{repo},
+		"permissions":  map[string]string{"contents": "read"},
+	}
+
+	var token gitHubToken
+	if err := a.request("POST", fmt.Sprintf("/app/installations/%d/access_tokens", installationID), jwt, body, &token); err != nil {
+		return nil, fmt.Errorf("A token for %s/%s couldn't be minted (%v)", owner, repo, err)
+	}
+
+	return &token, nil
+}
+
+// Returns the JWT the app authenticates as itself with. GitHub allows them to
+// be valid for 10 minutes, and they're backdated in case the clocks differ.
+func (a *GitHubApp) jwt(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.AppID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Where the app's API is, which is under /api/v3 on GitHub Enterprise
+func (a *GitHubApp) api() string {
+	if a.apiURL != "" {
+		return a.apiURL
+	}
+	if strings.EqualFold(a.Host, "github.com") {
+		return "https://api.github.com"
+	}
+	return "https://" + a.Host + "/api/v3"
+}
+
+func (a *GitHubApp) request(method string, path string, jwt string, body interface{}, result interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, a.api()+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("User-Agent", "buildkite-agent/"+Version())
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		var message struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(respBody, &message) == nil && message.Message != "" {
+			return fmt.Errorf("%s %s", resp.Status, message.Message)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	return json.Unmarshal(respBody, result)
+}
+
+// Lets the job ask for the credentials of its repository, with a secret
+// that's only in its environment
+func (r *JobRunner) addGitCredentialsJob() error {
+	if r.AgentConfiguration.GitCredentialsProvider != GitCredentialsGitHubApp {
+		return nil
+	}
+
+	secret, err := runningGitCredentialsJobs.add(r.Job.Env["BUILDKITE_REPO"])
+	if err != nil {
+		return err
+	}
+
+	r.gitCredentialsSecret = secret
+	r.logStreamer.Redactor.Add(secret)
+	r.process.Env = append(r.process.Env, GitCredentialsSecretEnv+"="+secret)
+
+	return nil
+}
+
+// Stops the job's secret working once it's finished
+func (r *JobRunner) removeGitCredentialsJob() {
+	if r.gitCredentialsSecret != "" {
+		runningGitCredentialsJobs.remove(r.gitCredentialsSecret)
+	}
+}
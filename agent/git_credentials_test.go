@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestGitHubApp(t *testing.T, handler http.Handler) (*GitHubApp, *rsa.PrivateKey, func()) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "github-app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := filepath.Join(dir, "app.pem")
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app, err := NewGitHubApp("1234", keyPath, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(handler)
+	app.apiURL = server.URL
+
+	return app, key, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGitHubAppMintsTokensForTheRepository(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var minted int
+	var key *rsa.PrivateKey
+
+	app, key, cleanup := newTestGitHubApp(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every request is signed by the app
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		if assert.Len(t, parts, 3) {
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature))
+
+			claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			assert.Contains(t, string(claims), `"iss":"1234"`)
+		}
+
+		switch r.Method + " " + r.URL.Path {
+		case "GET /repos/buildkite/agent/installation":
+			w.Write([]byte(`{"id": 42}`))
+		case "POST /app/installations/42/access_tokens":
+			var body struct {
+				Repositories []string `json:"repositories"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			assert.Equal(t, []string{"agent"}, body.Repositories)
+
+			mu.Lock()
+			minted++
+			mu.Unlock()
+
+			json.NewEncoder(w).Encode(gitHubToken{Token: "ghs_llamas", ExpiresAt: time.Now().Add(time.Hour)})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer cleanup()
+
+	username, password, err := app.Credentials("github.com", "buildkite/agent.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "x-access-token", username)
+	assert.Equal(t, "ghs_llamas", password)
+
+	// The token is cached until it's about to expire
+	_, password, err = app.Credentials("GitHub.com", "/buildkite/agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "ghs_llamas", password)
+	assert.Equal(t, 1, minted)
+}
+
+func TestGitHubAppOnlyGivesTokensToItsHost(t *testing.T) {
+	t.Parallel()
+
+	app, _, cleanup := newTestGitHubApp(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected request to %s", r.URL.Path)
+	}))
+	defer cleanup()
+
+	username, password, err := app.Credentials("github.com.evil.example", "buildkite/agent.git")
+	assert.NoError(t, err)
+	assert.Empty(t, username)
+	assert.Empty(t, password)
+
+	_, _, err = app.Credentials("github.com", "agent.git")
+	assert.Error(t, err)
+}
+
+func TestGitHubAppReportsWhyTokensCantBeMinted(t *testing.T) {
+	t.Parallel()
+
+	app, _, cleanup := newTestGitHubApp(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "Not Found"}`))
+	}))
+	defer cleanup()
+
+	_, _, err := app.Credentials("github.com", "buildkite/agent.git")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "isn't installed for buildkite/agent")
+		assert.Contains(t, err.Error(), "Not Found")
+	}
+}
+
+func TestGitRepositoriesAreMatchedByHostAndPath(t *testing.T) {
+	t.Parallel()
+
+	for _, repo := range []string{
+		"https://github.com/buildkite/agent.git",
+		"https://GitHub.com/Buildkite/Agent",
+		"git@github.com:buildkite/agent.git",
+		"ssh://git@github.com/buildkite/agent.git",
+	} {
+		assert.True(t, gitRepositoryIs(repo, "github.com", "buildkite/agent.git"), repo)
+	}
+
+	for _, repo := range []string{
+		"https://github.com/buildkite/agent-secrets.git",
+		"https://github.com.evil.example/buildkite/agent.git",
+		"git@github.com:buildkite/other.git",
+		"agent",
+	} {
+		assert.False(t, gitRepositoryIs(repo, "github.com", "buildkite/agent.git"), repo)
+	}
+}
@@ -0,0 +1,262 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/buildkite/agent/logger"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const gsCloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// Returns a client for Google Cloud Storage. A service account key in
+// BUILDKITE_GS_APPLICATION_CREDENTIALS is used if there is one, otherwise
+// it's the default credentials, i.e. GOOGLE_APPLICATION_CREDENTIALS or the
+// metadata server, which is how GKE Workload Identity works without a key.
+func newGSClient(scope string) (*http.Client, error) {
+	if path := os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		conf, err := google.JWTConfigFromJSON(data, scope)
+		if err != nil {
+			return nil, err
+		}
+		logger.Debug("Authenticating with Google Cloud Storage using the key in %s", path)
+		return conf.Client(oauth2.NoContext), nil
+	}
+
+	return google.DefaultClient(context.Background(), scope)
+}
+
+// Signs the strings for V4 signed URLs as a service account
+type gsURLSigner interface {
+	Email() string
+	Sign(b []byte) ([]byte, error)
+}
+
+// Returns the signer for the same credentials as newGSClient. With a key it
+// signs locally, otherwise the IAM Credentials API signs as the metadata
+// server's service account, which needs to be allowed to create tokens for
+// itself (roles/iam.serviceAccountTokenCreator).
+func newGSURLSigner() (gsURLSigner, error) {
+	path := os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS")
+	if path == "" {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return newGSKeySigner(data)
+	}
+
+	if !metadata.OnGCE() {
+		return nil, errors.New("Signing Google Cloud Storage URLs needs a service account key in BUILDKITE_GS_APPLICATION_CREDENTIALS, or the metadata server")
+	}
+
+	email, err := metadata.Get("instance/service-accounts/default/email")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find the service account from the metadata server: %v", err)
+	}
+
+	client, err := newGSClient(gsCloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gsIAMSigner{
+		email:    strings.TrimSpace(email),
+		client:   client,
+		endpoint: "https://iamcredentials.googleapis.com",
+	}, nil
+}
+
+// Signs with the private key of a service account
+type gsKeySigner struct {
+	email string
+	key   *rsa.PrivateKey
+}
+
+func newGSKeySigner(data []byte) (*gsKeySigner, error) {
+	var creds struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("Failed to parse the Google service account key (%v)", err)
+	}
+	if creds.ClientEmail == "" || creds.PrivateKey == "" {
+		return nil, errors.New("The Google credentials aren't a service account key, which is needed to sign URLs")
+	}
+
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, errors.New("Failed to decode the private key of the Google service account")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("Failed to parse the private key of the Google service account (%v)", err)
+		}
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("The private key of the Google service account isn't an RSA key")
+	}
+
+	return &gsKeySigner{email: creds.ClientEmail, key: key}, nil
+}
+
+func (s *gsKeySigner) Email() string {
+	return s.email
+}
+
+func (s *gsKeySigner) Sign(b []byte) ([]byte, error) {
+	sum := sha256.Sum256(b)
+	return rsa.SignPKCS1v15(nil, s.key, crypto.SHA256, sum[:])
+}
+
+// Signs with the IAM Credentials API
+type gsIAMSigner struct {
+	email    string
+	client   *http.Client
+	endpoint string
+}
+
+func (s *gsIAMSigner) Email() string {
+	return s.email
+}
+
+func (s *gsIAMSigner) Sign(b []byte) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{"payload": base64.StdEncoding.EncodeToString(b)})
+	if err != nil {
+		return nil, err
+	}
+
+	u := s.endpoint + "/v1/projects/-/serviceAccounts/" + url.PathEscape(s.email) + ":signBlob"
+	resp, err := s.client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign the URL as %s (%v)", s.email, err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		SignedBlob string `json:"signedBlob"`
+		Error      struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("Failed to sign the URL as %s (%s)", s.email, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || result.SignedBlob == "" {
+		return nil, fmt.Errorf("Failed to sign the URL as %s (%s: %s)", s.email, resp.Status, result.Error.Message)
+	}
+
+	return base64.StdEncoding.DecodeString(result.SignedBlob)
+}
+
+// Returns a V4 signed URL that anyone can download the object with until it
+// expires. See https://cloud.google.com/storage/docs/access-control/signing-urls-manually
+func gsSignedURL(signer gsURLSigner, bucket, object string, expires time.Duration, now time.Time) (string, error) {
+	const host = "storage.googleapis.com"
+
+	now = now.UTC()
+	datetime := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/auto/storage/goog4_request"
+
+	path := "/" + bucket + "/" + gsEscapePath(object)
+
+	query := map[string]string{
+		"X-Goog-Algorithm":     "GOOG4-RSA-SHA256",
+		"X-Goog-Credential":    signer.Email() + "/" + scope,
+		"X-Goog-Date":          datetime,
+		"X-Goog-Expires":       fmt.Sprintf("%d", int(expires.Seconds())),
+		"X-Goog-SignedHeaders": "host",
+	}
+
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var canonicalQuery []string
+	for _, k := range keys {
+		canonicalQuery = append(canonicalQuery, gsEscape(k)+"="+gsEscape(query[k]))
+	}
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		path,
+		strings.Join(canonicalQuery, "&"),
+		"host:" + host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"GOOG4-RSA-SHA256",
+		datetime,
+		scope,
+		hex.EncodeToString(hashed[:]),
+	}, "\n")
+
+	signature, err := signer.Sign([]byte(stringToSign))
+	if err != nil {
+		return "", err
+	}
+
+	return "https://" + host + path + "?" + strings.Join(canonicalQuery, "&") +
+		"&X-Goog-Signature=" + hex.EncodeToString(signature), nil
+}
+
+// Percent-encodes everything but the unreserved characters
+func gsEscape(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Percent-encodes each part of a path
+func gsEscapePath(s string) string {
+	parts := strings.Split(s, "/")
+	for i := range parts {
+		parts[i] = gsEscape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
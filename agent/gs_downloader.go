@@ -1,12 +1,11 @@
 package agent
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
-	"golang.org/x/oauth2/google"
 	storage "google.golang.org/api/storage/v1"
 )
 
@@ -26,10 +25,23 @@ type GSDownloader struct {
 
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// The checksums recorded when the file was uploaded
+	Sha1Sum   string
+	Sha256Sum string
+
+	// Whether a missing SHA256 checksum should fail the download, as well
+	// as a mismatched one, which always does
+	Verify bool
+
+	// How the file was compressed when it was uploaded, and whether it's a
+	// tar of a directory
+	Compression string
+	Archived    bool
 }
 
 func (d GSDownloader) Start() error {
-	client, err := google.DefaultClient(context.Background(), storage.DevstorageReadOnlyScope)
+	client, err := newGSClient(storage.DevstorageReadOnlyScope)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error creating Google Cloud Storage client: %v", err))
 	}
@@ -44,9 +56,25 @@ func (d GSDownloader) Start() error {
 		Destination: d.Destination,
 		Retries:     d.Retries,
 		DebugHTTP:   d.DebugHTTP,
+		Sha1Sum:     d.Sha1Sum,
+		Sha256Sum:   d.Sha256Sum,
+		Verify:      d.Verify,
+		Compression: d.Compression,
+		Archived:    d.Archived,
 	}.Start()
 }
 
+// SignedURL returns a URL the artifact can be downloaded with for the next
+// hour, without any credentials
+func (d GSDownloader) SignedURL() (string, error) {
+	signer, err := newGSURLSigner()
+	if err != nil {
+		return "", err
+	}
+
+	return gsSignedURL(signer, d.BucketName(), d.BucketFileLocation(), time.Hour, time.Now())
+}
+
 func (d GSDownloader) BucketFileLocation() string {
 	if d.BucketPath() != "" {
 		return strings.TrimSuffix(d.BucketPath(), "/") + "/" + strings.TrimPrefix(d.Path, "/")
@@ -1,11 +1,8 @@
 package agent
 
 import (
-	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -14,8 +11,6 @@ import (
 	"github.com/buildkite/agent/api"
 	"github.com/buildkite/agent/logger"
 	"github.com/buildkite/agent/mime"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 	"google.golang.org/api/googleapi"
 	storage "google.golang.org/api/storage/v1"
 )
@@ -36,7 +31,7 @@ func (u *GSUploader) Setup(destination string, debugHTTP bool) error {
 	u.Destination = destination
 	u.DebugHTTP = debugHTTP
 
-	client, err := u.getClient(storage.DevstorageFullControlScope)
+	client, err := newGSClient(storage.DevstorageFullControlScope)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error creating Google Cloud Storage client: %v", err))
 	}
@@ -91,6 +86,7 @@ func (u *GSUploader) Upload(artifact *api.Artifact) error {
 	if err != nil {
 		return errors.New(fmt.Sprintf("Failed to open file \"%q\" (%v)", artifact.AbsolutePath, err))
 	}
+	defer file.Close()
 	call := u.Service.Objects.Insert(u.BucketName(), object)
 	if permission != "" {
 		call = call.PredefinedAcl(permission)
@@ -124,21 +120,6 @@ func (u *GSUploader) destinationParts() []string {
 	return strings.Split(trimmed, "/")
 }
 
-func (u *GSUploader) getClient(scope string) (*http.Client, error) {
-	if os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS") != "" {
-		data, err := ioutil.ReadFile(os.Getenv("BUILDKITE_GS_APPLICATION_CREDENTIALS"))
-		if err != nil {
-			return nil, err
-		}
-		conf, err := google.JWTConfigFromJSON(data, scope)
-		if err != nil {
-			return nil, err
-		}
-		return conf.Client(oauth2.NoContext), nil
-	}
-	return google.DefaultClient(context.Background(), scope)
-}
-
 func (u *GSUploader) mimeType(a *api.Artifact) string {
 	extension := filepath.Ext(a.Path)
 	mimeType := mime.TypeByExtension(extension)
@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// How many heartbeat intervals can pass without a successful heartbeat
+// before the agent is considered unhealthy. Failed heartbeats are retried for
+// a while, so there's some leeway for them to catch up.
+const healthCheckMissedHeartbeats = 3
+
+// HealthCheck tracks the state of the agent for liveness and readiness
+// probes, like the ones Kubernetes uses. The agent is live as long as it's
+// heartbeats are succeeding, and ready once it's registered and connected
+// until it starts stopping. A nil HealthCheck ignores any changes.
+type HealthCheck struct {
+	registered        bool
+	connected         bool
+	draining          bool
+	heartbeatInterval time.Duration
+	lastHeartbeat     time.Time
+
+	// Used instead of time.Now, for tests
+	now func() time.Time
+
+	mutex sync.Mutex
+}
+
+// Registered marks the agent as registered with Buildkite
+func (h *HealthCheck) Registered() {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.registered = true
+}
+
+// Connected marks the agent as connected and expecting to heartbeat every
+// interval. The time it connected counts as it's first heartbeat.
+func (h *HealthCheck) Connected(heartbeatInterval time.Duration) {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.connected = true
+	h.heartbeatInterval = heartbeatInterval
+	h.lastHeartbeat = h.time()
+}
+
+// Disconnected marks the agent as no longer connected, after which it won't
+// heartbeat
+func (h *HealthCheck) Disconnected() {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.connected = false
+}
+
+// Draining marks the agent as stopping, so it won't accept any more jobs
+func (h *HealthCheck) Draining() {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.draining = true
+}
+
+// Heartbeat records that a heartbeat succeeded
+func (h *HealthCheck) Heartbeat() {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.lastHeartbeat = h.time()
+}
+
+// Live returns an error if the agent is wedged, i.e. it's connected but
+// heartbeats haven't succeeded for a while
+func (h *HealthCheck) Live() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if !h.connected || h.heartbeatInterval <= 0 {
+		return nil
+	}
+
+	since := h.time().Sub(h.lastHeartbeat)
+	if since > healthCheckMissedHeartbeats*h.heartbeatInterval {
+		return fmt.Errorf("The last successful heartbeat was %s ago", since/time.Second*time.Second)
+	}
+
+	return nil
+}
+
+// Ready returns an error if the agent can't accept jobs
+func (h *HealthCheck) Ready() error {
+	if err := h.Live(); err != nil {
+		return err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	switch {
+	case h.draining:
+		return fmt.Errorf("The agent is stopping")
+	case !h.registered:
+		return fmt.Errorf("The agent hasn't registered yet")
+	case !h.connected:
+		return fmt.Errorf("The agent isn't connected")
+	}
+
+	return nil
+}
+
+// Handler serves the liveness probe at /healthz and the readiness one at
+// /readyz, which respond with a 503 when they fail
+func (h *HealthCheck) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthCheck(w, h.Live())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthCheck(w, h.Ready())
+	})
+	return mux
+}
+
+// Serve listens on the address and serves the health checks in the
+// background, returning an error if it can't listen on the address
+func (h *HealthCheck) Serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := http.Serve(listener, h.Handler()); err != nil {
+			logger.Error("Health check server stopped: %s", err)
+		}
+	}()
+
+	logger.Info("Serving health checks at http://%s/healthz and /readyz", listener.Addr())
+
+	return nil
+}
+
+func (h *HealthCheck) time() time.Time {
+	if h.now != nil {
+		return h.now()
+	}
+	return time.Now()
+}
+
+func writeHealthCheck(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	fmt.Fprintln(w, "OK")
+}
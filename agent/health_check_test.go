@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func checkHealth(t *testing.T, h *HealthCheck, path string) int {
+	rec := httptest.NewRecorder()
+	h.Handler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec.Code
+}
+
+func TestHealthCheckReadiness(t *testing.T) {
+	t.Parallel()
+
+	h := &HealthCheck{}
+
+	assert.Equal(t, http.StatusOK, checkHealth(t, h, "/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, checkHealth(t, h, "/readyz"))
+
+	h.Registered()
+	assert.Equal(t, http.StatusServiceUnavailable, checkHealth(t, h, "/readyz"))
+
+	h.Connected(time.Minute)
+	assert.Equal(t, http.StatusOK, checkHealth(t, h, "/readyz"))
+
+	h.Draining()
+	assert.Equal(t, http.StatusServiceUnavailable, checkHealth(t, h, "/readyz"))
+	assert.Equal(t, http.StatusOK, checkHealth(t, h, "/healthz"))
+}
+
+func TestHealthCheckFailsWhenHeartbeatsStop(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	h := &HealthCheck{now: func() time.Time { return now }}
+
+	h.Registered()
+	h.Connected(time.Minute)
+
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, http.StatusOK, checkHealth(t, h, "/healthz"))
+
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, http.StatusServiceUnavailable, checkHealth(t, h, "/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, checkHealth(t, h, "/readyz"))
+
+	h.Heartbeat()
+	assert.Equal(t, http.StatusOK, checkHealth(t, h, "/healthz"))
+	assert.Equal(t, http.StatusOK, checkHealth(t, h, "/readyz"))
+
+	// Once disconnected there aren't any heartbeats to miss
+	h.Disconnected()
+	now = now.Add(time.Hour)
+	assert.Equal(t, http.StatusOK, checkHealth(t, h, "/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, checkHealth(t, h, "/readyz"))
+}
+
+func TestNilHealthCheckIgnoresChanges(t *testing.T) {
+	t.Parallel()
+
+	var h *HealthCheck
+	h.Registered()
+	h.Connected(time.Minute)
+	h.Heartbeat()
+	h.Draining()
+	h.Disconnected()
+}
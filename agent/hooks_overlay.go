@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HooksOverlay is a directory of hooks for the jobs of the pipelines, or
+// repositories, that its pattern matches. They're run after the global hooks,
+// so teams sharing agents can have hooks of their own.
+type HooksOverlay struct {
+	// The pattern pipeline slugs are matched against, if it matches
+	// pipelines
+	Pipeline string
+
+	// The pattern repository URLs are matched against, if it matches
+	// repositories. ** matches across slashes, and * doesn't.
+	Repository string
+
+	// The directory the hooks are in
+	Path string
+}
+
+// ParseHooksOverlay parses an overlay in the form of pipeline:<pattern>=<path>
+// or repository:<pattern>=<path>
+func ParseHooksOverlay(overlay string) (*HooksOverlay, error) {
+	separator := strings.LastIndex(overlay, "=")
+	if separator == -1 || separator == len(overlay)-1 {
+		return nil, fmt.Errorf("The hooks overlay %q doesn't have a path, expected pipeline:<pattern>=<path> or repository:<pattern>=<path>", overlay)
+	}
+
+	match, path := overlay[:separator], overlay[separator+1:]
+
+	var o *HooksOverlay
+	switch {
+	case strings.HasPrefix(match, "pipeline:"):
+		o = &HooksOverlay{Pipeline: strings.TrimPrefix(match, "pipeline:"), Path: path}
+	case strings.HasPrefix(match, "repository:"):
+		o = &HooksOverlay{Repository: strings.TrimPrefix(match, "repository:"), Path: path}
+	default:
+		return nil, fmt.Errorf("The hooks overlay %q doesn't match pipelines or repositories, expected pipeline:<pattern>=<path> or repository:<pattern>=<path>", overlay)
+	}
+
+	if _, err := globToRegexp(o.Pipeline + o.Repository); err != nil {
+		return nil, fmt.Errorf("The pattern of hooks overlay %q is invalid (%v)", overlay, err)
+	}
+
+	return o, nil
+}
+
+// Matches returns whether the overlay's hooks are run for jobs of the pipeline
+// and repository
+func (o *HooksOverlay) Matches(pipelineSlug string, repository string) bool {
+	pattern, subject := o.Pipeline, pipelineSlug
+	if o.Repository != "" {
+		pattern, subject = o.Repository, repository
+	}
+
+	if pattern == "" {
+		return false
+	}
+
+	re, err := globToRegexp(pattern)
+	return err == nil && re.MatchString(subject)
+}
@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHooksOverlay(t *testing.T) {
+	t.Parallel()
+
+	overlay, err := ParseHooksOverlay("pipeline:team-a-*=/etc/buildkite-agent/hooks/team-a")
+	assert.NoError(t, err)
+	assert.Equal(t, &HooksOverlay{Pipeline: "team-a-*", Path: "/etc/buildkite-agent/hooks/team-a"}, overlay)
+
+	overlay, err = ParseHooksOverlay("repository:https://github.com/acme/**=/etc/buildkite-agent/hooks/acme")
+	assert.NoError(t, err)
+	assert.Equal(t, &HooksOverlay{Repository: "https://github.com/acme/**", Path: "/etc/buildkite-agent/hooks/acme"}, overlay)
+
+	for _, invalid := range []string{"team-a-*=/hooks", "pipeline:team-a-*", "pipeline:team-a-*=", "branch:master=/hooks"} {
+		_, err = ParseHooksOverlay(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestHooksOverlayMatches(t *testing.T) {
+	t.Parallel()
+
+	pipeline := &HooksOverlay{Pipeline: "team-a-*"}
+	assert.True(t, pipeline.Matches("team-a-llamas", "git@github.com:acme/llamas.git"))
+	assert.False(t, pipeline.Matches("team-b-llamas", "git@github.com:acme/llamas.git"))
+
+	repository := &HooksOverlay{Repository: "git@github.com:acme/**"}
+	assert.True(t, repository.Matches("team-b-llamas", "git@github.com:acme/llamas.git"))
+	assert.False(t, repository.Matches("team-a-llamas", "git@github.com:other/llamas.git"))
+
+	// * doesn't match across slashes
+	assert.False(t, (&HooksOverlay{Repository: "https://github.com/*"}).Matches("", "https://github.com/acme/llamas.git"))
+}
@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Runs the bootstrap within the agent instead of starting a process for it
+// for each job, which saves starting it and lets the agent signal it directly
+const InProcessBootstrapExperiment = "in-process-bootstrap"
+
+// InProcessBootstrap runs the bootstrap within the agent with the job's
+// environment, output and signals, and returns the job's exit status. The
+// agent's command sets it, as the bootstrap imports this package.
+var InProcessBootstrap func(ctx context.Context, env []string, output io.Writer, signals <-chan os.Signal) int
+
+// Has the job's bootstrap run within the agent if the experiment is enabled
+// and it can be, otherwise the reason it can't is kept so the job can be told
+func (r *JobRunner) useInProcessBootstrap() {
+	if !r.experimentEnabled(InProcessBootstrapExperiment) {
+		return
+	}
+
+	c := r.AgentConfiguration
+	limits, _ := r.resourceLimits()
+
+	switch {
+	case InProcessBootstrap == nil:
+		r.inProcessBootstrapUnsupported = "this agent can't run it"
+	case c.JobExecutor == JobExecutorKubernetes:
+		r.inProcessBootstrapUnsupported = "jobs are run in Kubernetes"
+	case !isDefaultBootstrapScript(c.BootstrapScript):
+		r.inProcessBootstrapUnsupported = "the bootstrap script is " + c.BootstrapScript
+	case r.process.Credential != nil:
+		r.inProcessBootstrapUnsupported = "the bootstrap is run as the job's user"
+	case !limits.IsZero():
+		r.inProcessBootstrapUnsupported = "the job's resources are limited"
+	default:
+		r.process.Func = InProcessBootstrap
+	}
+}
+
+// Whether the bootstrap script is the agent's own bootstrap command, which is
+// the only one that can be run within the agent
+func isDefaultBootstrapScript(script string) bool {
+	fields := strings.Fields(script)
+	if len(fields) != 2 || fields[1] != "bootstrap" {
+		return false
+	}
+
+	name := strings.TrimSuffix(filepath.Base(fields[0]), ".exe")
+	return name == "buildkite-agent"
+}
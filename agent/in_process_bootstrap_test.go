@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/process"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnlyTheAgentsBootstrapIsRunInProcess(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, isDefaultBootstrapScript("buildkite-agent bootstrap"))
+	assert.True(t, isDefaultBootstrapScript("/usr/bin/buildkite-agent bootstrap"))
+	assert.False(t, isDefaultBootstrapScript("/usr/local/bin/my-bootstrap.sh"))
+	assert.False(t, isDefaultBootstrapScript("buildkite-agent bootstrap --debug"))
+}
+
+func TestJobsWithTheExperimentRunTheBootstrapInProcess(t *testing.T) {
+	defer func(f func(context.Context, []string, io.Writer, <-chan os.Signal) int) { InProcessBootstrap = f }(InProcessBootstrap)
+	InProcessBootstrap = func(context.Context, []string, io.Writer, <-chan os.Signal) int { return 0 }
+
+	for _, tc := range []struct {
+		name        string
+		experiments []string
+		config      AgentConfiguration
+		credential  *process.Credential
+		inProcess   bool
+		unsupported string
+	}{
+		{
+			name:        "enabled",
+			experiments: []string{InProcessBootstrapExperiment},
+			config:      AgentConfiguration{BootstrapScript: "buildkite-agent bootstrap"},
+			inProcess:   true,
+		},
+		{
+			name:   "not enabled",
+			config: AgentConfiguration{BootstrapScript: "buildkite-agent bootstrap"},
+		},
+		{
+			name:        "custom bootstrap",
+			experiments: []string{InProcessBootstrapExperiment},
+			config:      AgentConfiguration{BootstrapScript: "my-bootstrap.sh"},
+			unsupported: "the bootstrap script is my-bootstrap.sh",
+		},
+		{
+			name:        "job user",
+			experiments: []string{InProcessBootstrapExperiment},
+			config:      AgentConfiguration{BootstrapScript: "buildkite-agent bootstrap"},
+			credential:  &process.Credential{Username: "llamas"},
+			unsupported: "the bootstrap is run as the job's user",
+		},
+		{
+			name:        "resource limits",
+			experiments: []string{InProcessBootstrapExperiment},
+			config:      AgentConfiguration{BootstrapScript: "buildkite-agent bootstrap", JobMemoryLimit: "1G"},
+			unsupported: "the job's resources are limited",
+		},
+	} {
+		runner := &JobRunner{
+			Job:                &api.Job{Env: map[string]string{}},
+			AgentConfiguration: &tc.config,
+			experiments:        tc.experiments,
+			process:            &process.Process{Credential: tc.credential},
+		}
+		runner.useInProcessBootstrap()
+
+		assert.Equal(t, tc.inProcess, runner.process.Func != nil, tc.name)
+		assert.Equal(t, tc.unsupported, runner.inProcessBootstrapUnsupported, tc.name)
+	}
+}
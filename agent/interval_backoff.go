@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+// The most the ping and heartbeat intervals back off to, as a multiple of
+// the intervals the API gave the agent
+const maxIntervalBackoff = 4
+
+// Backs off how often an idle agent pings and heartbeats, to take load off
+// the API when there's a large fleet with nothing to do. The intervals double
+// each time the agent pings and there's nothing for it, and go straight back
+// when it's assigned a job or the API says there are jobs queued for it. A nil
+// backoff never backs off.
+type intervalBackoff struct {
+	mu     sync.Mutex
+	factor int
+}
+
+func newIntervalBackoff() *intervalBackoff {
+	return &intervalBackoff{factor: 1}
+}
+
+// Idle backs off further, returning whether it did, or whether it's already
+// backed off as far as it goes
+func (b *intervalBackoff) Idle() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.factor >= maxIntervalBackoff {
+		return false
+	}
+
+	b.factor *= 2
+	return true
+}
+
+// Busy goes back to the intervals from the API
+func (b *intervalBackoff) Busy() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.factor = 1
+}
+
+// Apply returns the interval, backed off
+func (b *intervalBackoff) Apply(interval time.Duration) time.Duration {
+	if b == nil {
+		return interval
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return interval * time.Duration(b.factor)
+}
@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntervalBackoff(t *testing.T) {
+	t.Parallel()
+
+	b := newIntervalBackoff()
+	assert.Equal(t, 10*time.Second, b.Apply(10*time.Second))
+
+	assert.True(t, b.Idle())
+	assert.Equal(t, 20*time.Second, b.Apply(10*time.Second))
+
+	// It stops backing off at the most it goes to
+	assert.True(t, b.Idle())
+	assert.False(t, b.Idle())
+	assert.Equal(t, 40*time.Second, b.Apply(10*time.Second))
+
+	b.Busy()
+	assert.Equal(t, 10*time.Second, b.Apply(10*time.Second))
+}
+
+func TestNilIntervalBackoffDoesntBackOff(t *testing.T) {
+	t.Parallel()
+
+	var b *intervalBackoff
+	assert.False(t, b.Idle())
+	b.Busy()
+	assert.Equal(t, 10*time.Second, b.Apply(10*time.Second))
+}
@@ -0,0 +1,290 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// The file in the build path the janitor keeps when each checkout was last
+// used in, which is more reliable than the checkout's modification time
+const janitorStateFile = ".buildkite-janitor.json"
+
+// Janitor removes old checkouts from the build path, so it doesn't need a
+// cron job to stop it filling the disk. Checkouts that haven't been used for
+// longer than KeepBuilds are removed, and when the disk has less than
+// MinFreeSpace MB free, the least recently used are removed until it has.
+// Pipelines can keep their checkouts for longer, or ask for more space
+// before their jobs run, with BUILDKITE_JANITOR_KEEP_BUILDS and
+// BUILDKITE_JANITOR_MIN_FREE_SPACE.
+//
+// Checkouts are the pipeline directories of each agent in the build path.
+// Only the checkouts of jobs run by this agent process are known to be in
+// use, so agents in other processes shouldn't share the build path.
+type Janitor struct {
+	BuildPath    string
+	KeepBuilds   time.Duration
+	MinFreeSpace int
+
+	mu    sync.Mutex
+	inUse map[string]int
+
+	// Whether a clean is running in the background
+	cleaning bool
+}
+
+type janitorState struct {
+	Checkouts map[string]*janitorCheckout `json:"checkouts"`
+}
+
+type janitorCheckout struct {
+	LastUsed   time.Time     `json:"last_used"`
+	KeepBuilds time.Duration `json:"keep_builds,omitempty"`
+}
+
+// A checkout found in the build path
+type janitorCandidate struct {
+	path       string
+	lastUsed   time.Time
+	keepBuilds time.Duration
+}
+
+// Returns where the bootstrap checks out the job, unless a hook changes it
+func jobCheckoutPath(buildPath string, agentName string, env map[string]string) string {
+	agentDir := regexp.MustCompile("[[:^alnum:]]").ReplaceAllString(agentName, "-")
+	return filepath.Join(buildPath, agentDir, env["BUILDKITE_ORGANIZATION_SLUG"], env["BUILDKITE_PIPELINE_SLUG"])
+}
+
+// BeforeJob marks the job's checkout as in use, and makes room for it if the
+// job's pipeline needs more space free than the agent usually keeps
+func (j *Janitor) BeforeJob(checkout string, env map[string]string) {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	if j.inUse == nil {
+		j.inUse = map[string]int{}
+	}
+	j.inUse[checkout]++
+	j.mu.Unlock()
+
+	if minFree, _ := strconv.Atoi(env["BUILDKITE_JANITOR_MIN_FREE_SPACE"]); minFree > j.MinFreeSpace {
+		if err := j.clean(minFree); err != nil {
+			logger.Warn("Failed to clean up the build path: %s", err)
+		}
+	}
+}
+
+// AfterJob records that the job's checkout was used, and how long its
+// pipeline wants it kept, then cleans up in the background
+func (j *Janitor) AfterJob(checkout string, env map[string]string) {
+	if j == nil {
+		return
+	}
+
+	var keepBuilds time.Duration
+	if value := env["BUILDKITE_JANITOR_KEEP_BUILDS"]; value != "" {
+		var err error
+		if keepBuilds, err = time.ParseDuration(value); err != nil {
+			logger.Warn("Ignoring BUILDKITE_JANITOR_KEEP_BUILDS, %q isn't a duration", value)
+		}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.inUse[checkout] > 1 {
+		j.inUse[checkout]--
+	} else {
+		delete(j.inUse, checkout)
+	}
+
+	state := j.loadState()
+	state.Checkouts[checkout] = &janitorCheckout{LastUsed: time.Now(), KeepBuilds: keepBuilds}
+	if err := j.saveState(state); err != nil {
+		logger.Warn("Failed to record when %s was used: %s", checkout, err)
+	}
+
+	if !j.cleaning {
+		j.cleaning = true
+		go func() {
+			if err := j.clean(j.MinFreeSpace); err != nil {
+				logger.Warn("Failed to clean up the build path: %s", err)
+			}
+
+			j.mu.Lock()
+			j.cleaning = false
+			j.mu.Unlock()
+		}()
+	}
+}
+
+// Start cleans up every interval, as well as between jobs
+func (j *Janitor) Start(interval time.Duration) {
+	if j == nil || interval <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			if err := j.clean(j.MinFreeSpace); err != nil {
+				logger.Warn("Failed to clean up the build path: %s", err)
+			}
+		}
+	}()
+}
+
+// Removes the checkouts that are too old, then the least recently used until
+// there's minFree MB free, leaving the ones in use
+func (j *Janitor) clean(minFree int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	state := j.loadState()
+
+	candidates, err := j.checkouts(state)
+	if err != nil {
+		return err
+	}
+
+	// Oldest first, so the least recently used are removed first
+	sort.Slice(candidates, func(a, b int) bool {
+		return candidates[a].lastUsed.Before(candidates[b].lastUsed)
+	})
+
+	var kept []janitorCandidate
+	for _, c := range candidates {
+		keep := c.keepBuilds
+		if keep == 0 {
+			keep = j.KeepBuilds
+		}
+
+		if keep > 0 && time.Since(c.lastUsed) > keep {
+			logger.Info("Removing %s, it hasn't been used since %s", c.path, c.lastUsed.Format(time.RFC3339))
+			if err := j.remove(c.path, state); err != nil {
+				return err
+			}
+			continue
+		}
+
+		kept = append(kept, c)
+	}
+
+	if minFree > 0 {
+		for _, c := range kept {
+			free, err := freeDiskSpace(existingParent(j.BuildPath))
+			if err != nil {
+				return err
+			}
+			if free >= uint64(minFree)*1024*1024 {
+				break
+			}
+
+			logger.Info("Removing %s to free up disk space, there's %d MB free and the agent keeps %d MB free", c.path, free/1024/1024, minFree)
+			if err := j.remove(c.path, state); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Forget about checkouts that have been removed by something else
+	for path := range state.Checkouts {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			delete(state.Checkouts, path)
+		}
+	}
+
+	return j.saveState(state)
+}
+
+// Returns the checkouts in the build path that aren't in use, with when they
+// were last used, or modified if the janitor doesn't know
+func (j *Janitor) checkouts(state *janitorState) ([]janitorCandidate, error) {
+	matches, err := filepath.Glob(filepath.Join(j.BuildPath, "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []janitorCandidate
+	for _, path := range matches {
+		if isHidden(path, j.BuildPath) || j.inUse[path] > 0 {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+
+		c := janitorCandidate{path: path, lastUsed: info.ModTime()}
+		if recorded, ok := state.Checkouts[path]; ok {
+			c.lastUsed = recorded.LastUsed
+			c.keepBuilds = recorded.KeepBuilds
+		}
+		candidates = append(candidates, c)
+	}
+
+	return candidates, nil
+}
+
+func (j *Janitor) remove(path string, state *janitorState) error {
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+
+	delete(state.Checkouts, path)
+	return nil
+}
+
+// Returns whether any part of the path below the root is hidden
+func isHidden(path string, root string) bool {
+	for path != root && path != filepath.Dir(path) {
+		if filepath.Base(path)[0] == '.' {
+			return true
+		}
+		path = filepath.Dir(path)
+	}
+	return false
+}
+
+func (j *Janitor) loadState() *janitorState {
+	state := &janitorState{}
+
+	if data, err := ioutil.ReadFile(filepath.Join(j.BuildPath, janitorStateFile)); err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			logger.Warn("Ignoring when checkouts were last used, %s couldn't be read (%s)", janitorStateFile, err)
+		}
+	}
+
+	if state.Checkouts == nil {
+		state.Checkouts = map[string]*janitorCheckout{}
+	}
+	return state
+}
+
+// Writes the state to a temporary file first so it's never half written
+func (j *Janitor) saveState(state *janitorState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(j.BuildPath, 0777); err != nil {
+		return err
+	}
+
+	path := filepath.Join(j.BuildPath, janitorStateFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
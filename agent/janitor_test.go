@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Creates checkouts in the build path, last modified the given time ago
+func createCheckouts(t *testing.T, buildPath string, checkouts map[string]time.Duration) {
+	for name, age := range checkouts {
+		path := filepath.Join(buildPath, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Join(path, "src"), 0777))
+
+		modified := time.Now().Add(-age)
+		assert.NoError(t, os.Chtimes(path, modified, modified))
+	}
+}
+
+func TestJanitorRemovesOldCheckouts(t *testing.T) {
+	t.Parallel()
+
+	buildPath, err := ioutil.TempDir("", "janitor")
+	assert.NoError(t, err)
+	defer os.RemoveAll(buildPath)
+
+	createCheckouts(t, buildPath, map[string]time.Duration{
+		"my-agent-1/llamas/old":      48 * time.Hour,
+		"my-agent-1/llamas/new":      time.Minute,
+		"my-agent-1/llamas/kept":     48 * time.Hour,
+		"my-agent-1/llamas/running":  48 * time.Hour,
+		"my-agent-1/.hidden/old":     48 * time.Hour,
+		"my-agent-2/alpacas/old-too": 48 * time.Hour,
+	})
+
+	j := &Janitor{BuildPath: buildPath, KeepBuilds: 24 * time.Hour}
+
+	// The pipeline keeps its checkout for longer
+	kept := filepath.Join(buildPath, "my-agent-1", "llamas", "kept")
+	state := j.loadState()
+	state.Checkouts[kept] = &janitorCheckout{LastUsed: time.Now().Add(-48 * time.Hour), KeepBuilds: 72 * time.Hour}
+	assert.NoError(t, j.saveState(state))
+
+	running := filepath.Join(buildPath, "my-agent-1", "llamas", "running")
+	j.BeforeJob(running, map[string]string{})
+
+	assert.NoError(t, j.clean(0))
+
+	for name, exists := range map[string]bool{
+		"my-agent-1/llamas/old":      false,
+		"my-agent-1/llamas/new":      true,
+		"my-agent-1/llamas/kept":     true,
+		"my-agent-1/llamas/running":  true,
+		"my-agent-1/.hidden/old":     true,
+		"my-agent-2/alpacas/old-too": false,
+	} {
+		_, err := os.Stat(filepath.Join(buildPath, filepath.FromSlash(name)))
+		assert.Equal(t, exists, err == nil, name)
+	}
+}
+
+func TestJanitorFreesUpSpace(t *testing.T) {
+	t.Parallel()
+
+	buildPath, err := ioutil.TempDir("", "janitor")
+	assert.NoError(t, err)
+	defer os.RemoveAll(buildPath)
+
+	createCheckouts(t, buildPath, map[string]time.Duration{
+		"my-agent-1/llamas/one":   time.Hour,
+		"my-agent-1/llamas/two":   time.Minute,
+		"my-agent-1/llamas/three": 2 * time.Hour,
+	})
+
+	j := &Janitor{BuildPath: buildPath}
+
+	// There's never that much space free, so everything but the job's
+	// checkout is removed
+	checkout := filepath.Join(buildPath, "my-agent-1", "llamas", "two")
+	j.BeforeJob(checkout, map[string]string{"BUILDKITE_JANITOR_MIN_FREE_SPACE": "1099511627776"})
+
+	matches, _ := filepath.Glob(filepath.Join(buildPath, "*", "*", "*"))
+	assert.Equal(t, []string{checkout}, matches)
+}
+
+func TestJobCheckoutPath(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, filepath.Join("builds", "my-agent-1", "llamas", "alpacas"),
+		jobCheckoutPath("builds", "my agent.1", map[string]string{
+			"BUILDKITE_ORGANIZATION_SLUG": "llamas",
+			"BUILDKITE_PIPELINE_SLUG":     "alpacas",
+		}))
+}
+
+func TestNilJanitorDoesNothing(t *testing.T) {
+	t.Parallel()
+
+	var j *Janitor
+	j.BeforeJob("llamas", map[string]string{"BUILDKITE_JANITOR_MIN_FREE_SPACE": "1"})
+	j.AfterJob("llamas", map[string]string{})
+	j.Start(time.Second)
+}
+
+func TestJanitorRecordsWhenCheckoutsAreUsed(t *testing.T) {
+	t.Parallel()
+
+	buildPath, err := ioutil.TempDir("", "janitor")
+	assert.NoError(t, err)
+	defer os.RemoveAll(buildPath)
+
+	// Nothing's old enough to be removed by the clean after the job
+	j := &Janitor{BuildPath: buildPath, KeepBuilds: time.Hour}
+	checkout := filepath.Join(buildPath, "my-agent-1", "llamas", "alpacas")
+	assert.NoError(t, os.MkdirAll(checkout, 0777))
+
+	j.BeforeJob(checkout, map[string]string{})
+	j.AfterJob(checkout, map[string]string{"BUILDKITE_JANITOR_KEEP_BUILDS": "72h"})
+
+	// Wait for the clean, so it's finished before the build path's removed
+	for {
+		j.mu.Lock()
+		cleaning := j.cleaning
+		j.mu.Unlock()
+
+		if !cleaning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	state := j.loadState()
+
+	if assert.NotNil(t, state.Checkouts[checkout]) {
+		assert.Equal(t, 72*time.Hour, state.Checkouts[checkout].KeepBuilds)
+		assert.WithinDuration(t, time.Now(), state.Checkouts[checkout].LastUsed, time.Minute)
+	}
+}
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"os"
+	"time"
+
+	"github.com/buildkite/agent/events"
+)
+
+// How often the events reported by the job's processes are sent on
+var jobEventsInterval = time.Second
+
+// Sends an event about the job, if the agent is sending events
+func (r *JobRunner) emitEvent(event events.Event) {
+	event.JobID = r.Job.ID
+	if r.Agent != nil {
+		event.AgentName = r.Agent.Name
+	}
+	events.Emit(event)
+}
+
+// Follows the file the job's processes report their events to, sending them
+// on as they're reported. The returned func stops following it, once the
+// last of them have been sent.
+func (r *JobRunner) followEventsReports() func() {
+	if r.eventsReportPath == "" {
+		return func() {}
+	}
+
+	var offset int64
+	send := func() {
+		reported, next, err := events.ReadReports(r.eventsReportPath, offset)
+		if err != nil {
+			r.log("run").Warn("Failed to read the events reported by job %s (%s)", r.Job.ID, err)
+		}
+		offset = next
+
+		for _, event := range reported {
+			r.emitEvent(event)
+		}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(jobEventsInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				send()
+			case <-stop:
+				send()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// Removes the file the job's processes reported their events to
+func (r *JobRunner) removeEventsReports() {
+	if r.eventsReportPath != "" {
+		os.Remove(r.eventsReportPath)
+	}
+}
@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The variable a pipeline sets to the comma separated experiments it wants
+// enabled for its jobs, which the agent needs to allow
+const JobExperimentsEnv = "BUILDKITE_AGENT_EXPERIMENTS"
+
+// Returns whether the experiment is enabled for the job
+func (r *JobRunner) experimentEnabled(experiment string) bool {
+	for _, name := range r.experiments {
+		if name == experiment {
+			return true
+		}
+	}
+	return false
+}
+
+// Says which experiments are enabled at the top of the job's log, and which
+// the job asked for that this agent doesn't allow
+func (r *JobRunner) logExperiments() {
+	if len(r.experiments) > 0 {
+		r.logStreamer.Append(fmt.Sprintf("\033[90m# Experiments enabled for this job: %s\033[0m\n", strings.Join(r.experiments, ", ")))
+	}
+
+	if len(r.deniedExperiments) > 0 {
+		names := strings.Join(r.deniedExperiments, ", ")
+		r.log("start").Warn("Job %s asked for experiments that aren't allowed: %s", r.Job.ID, names)
+		r.logStreamer.Append(fmt.Sprintf("\033[33m⚠️ Warning: These experiments aren't allowed on this agent, so they haven't been enabled: %s\033[0m\n", names))
+	}
+
+	if r.inProcessBootstrapUnsupported != "" {
+		r.logStreamer.Append(fmt.Sprintf("\033[33m⚠️ Warning: The bootstrap can't be run within the agent as %s, so it's run as a process of its own\033[0m\n", r.inProcessBootstrapUnsupported))
+	}
+}
@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobExperimentsAreLogged(t *testing.T) {
+	t.Parallel()
+
+	var log []string
+	var mu sync.Mutex
+
+	runner := &JobRunner{
+		Job:               &api.Job{ID: "abc"},
+		experiments:       []string{"llamas", ChunkStreamingExperiment},
+		deniedExperiments: []string{"alpacas"},
+	}
+	runner.logStreamer = LogStreamer{
+		MaxChunkSizeBytes: 100 * 1024,
+		Callback: func(chunk *LogStreamerChunk) error {
+			mu.Lock()
+			defer mu.Unlock()
+			log = append(log, chunk.Data)
+			return nil
+		},
+	}.New()
+
+	assert.True(t, runner.experimentEnabled(ChunkStreamingExperiment))
+	assert.False(t, runner.experimentEnabled("alpacas"))
+
+	assert.NoError(t, runner.logStreamer.Start())
+	runner.logExperiments()
+	runner.logStreamer.Stop()
+
+	output := strings.Join(log, "")
+	assert.Contains(t, output, "Experiments enabled for this job: llamas, log-chunk-streaming")
+	assert.Contains(t, output, "aren't allowed on this agent, so they haven't been enabled: alpacas")
+}
@@ -2,17 +2,61 @@ package agent
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/cgroup"
+	"github.com/buildkite/agent/events"
+	"github.com/buildkite/agent/experiments"
 	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/metrics"
 	"github.com/buildkite/agent/process"
 	"github.com/buildkite/agent/retry"
+	"github.com/buildkite/agent/secrets"
+	"github.com/buildkite/agent/tracing"
 )
 
+// Why a job was cancelled, which is sent to Buildkite when it finishes
+const (
+	// The job was cancelled in Buildkite
+	CancelReasonJobCancelled = "cancel"
+
+	// The agent was stopped while running the job
+	CancelReasonAgentStopping = "agent_stop"
+)
+
+// Where jobs are run
+const (
+	// On the agent's machine, with the bootstrap script
+	JobExecutorLocal = "local"
+
+	// In a Kubernetes pod of their own
+	JobExecutorKubernetes = "kubernetes"
+)
+
+// The job's environment variables that only make sense on the agent's
+// machine, so aren't passed on to kubernetes pods
+var kubernetesHostEnv = map[string]bool{
+	"BUILDKITE_BIN_PATH":    true,
+	"BUILDKITE_AGENT_PID":   true,
+	ControlSocketEnv:        true,
+	GitCredentialsSecretEnv: true,
+	metrics.ReportFileEnv:   true,
+	FailureReasonFileEnv:    true,
+}
+
+// The environment variable with the file the bootstrap writes why the job
+// failed to, e.g. checkout_failed, which is sent to Buildkite when the job
+// finishes
+const FailureReasonFileEnv = "BUILDKITE_FAILURE_REASON_FILE"
+
 type JobRunner struct {
 	// The job being run
 	Job *api.Job
@@ -38,8 +82,73 @@ type JobRunner struct {
 	// The internal log streamer
 	logStreamer *LogStreamer
 
-	// If the job is being cancelled
-	cancelled bool
+	// Set once the job's log has been marked as truncated, so it's only
+	// done once
+	logTruncated int32
+
+	// Streams the log chunks to the API, if the experiment is enabled and
+	// the stream could be opened
+	chunkStreamer *ChunkStreamer
+
+	// Traces the job, if an OpenTelemetry collector has been configured
+	tracer *tracing.Tracer
+
+	// The span covering the whole job, which everything else in the job's
+	// trace is a child of
+	span *tracing.Span
+
+	// The file that the job's processes report their metrics to, if the
+	// agent is serving metrics
+	metricsReportPath string
+
+	// The file that the job's processes report their events to, if the
+	// agent is sending events
+	eventsReportPath string
+
+	// The file that the bootstrap writes why the job failed to
+	failureReasonPath string
+
+	// The cgroup the job's processes are run in, if it's resources are
+	// limited
+	cgroup *cgroup.Cgroup
+
+	// The protected variables that were removed from the job's environment
+	protectedEnvRemoved []string
+
+	// Whether the agent's machine failed the checks before the job started
+	preflightFailed bool
+
+	// The experiments enabled for the job, which are the agent's and the
+	// ones the job asked for that the agent allows, and the ones it asked
+	// for that aren't allowed
+	experiments       []string
+	deniedExperiments []string
+
+	// Why the bootstrap isn't run within the agent, when the experiment
+	// for it is enabled
+	inProcessBootstrapUnsupported string
+
+	// The build path of the job's ephemeral workspace, if it has one, and
+	// whether a tmpfs has been mounted on it
+	workspace        string
+	workspaceMounted bool
+
+	// The job's own docker config, if it's logged in to any registries
+	dockerConfig string
+
+	// The job's own ssh-agent, and the directory with it's socket
+	sshAgent    *exec.Cmd
+	sshAgentDir string
+
+	// The job's own access token, until it's revoked
+	jobToken string
+
+	// The secret the job asks for the credentials of its repository with
+	gitCredentialsSecret string
+
+	// If the job is being cancelled, and why
+	cancelled    bool
+	cancelReason string
 
 	// Used to wait on various routines that we spin up
 	routineWaitGroup sync.WaitGroup
@@ -55,58 +164,199 @@ func (r JobRunner) Create() (runner *JobRunner, err error) {
 	// Our own APIClient using the endpoint and the agents access token
 	runner.APIClient = APIClient{Endpoint: r.Endpoint, Token: r.Agent.AccessToken}.Create()
 
+	// Trace the job, and the API calls made for it, if the OTEL_*
+	// environment variables have been set up
+	tracer, tracerErr := tracing.NewTracerFromEnv("buildkite-agent")
+	if tracerErr != nil {
+		r.log("start").Warn("Not tracing job %s (%s)", r.Job.ID, tracerErr)
+	}
+	runner.tracer = tracer
+	runner.span = tracer.StartSpan("job", "")
+	runner.span.SetAttribute("buildkite.job_id", r.Job.ID)
+	runner.span.SetAttribute("buildkite.agent", r.Agent.Name)
+	runner.span.SetAttribute("buildkite.pipeline", r.Job.Env["BUILDKITE_PIPELINE_SLUG"])
+	runner.span.SetAttribute("buildkite.build_number", r.Job.Env["BUILDKITE_BUILD_NUMBER"])
+	runner.APIClient.Span = runner.span
+
 	// // Create our header times struct
 	runner.headerTimesStreamer = &HeaderTimesStreamer{UploadCallback: r.onUploadHeaderTime}
 
+	// Processes run for the job report metrics to a file, which are added
+	// to the agent's once the job has finished
+	if metrics.IsCollecting() {
+		file, err := ioutil.TempFile("", "buildkite-agent-metrics")
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+		runner.metricsReportPath = file.Name()
+	}
+
+	// And their events to another, which are sent on as they're reported
+	if events.IsEmitting() {
+		file, err := ioutil.TempFile("", "buildkite-agent-events")
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+		runner.eventsReportPath = file.Name()
+	}
+
+	// The bootstrap says why the job failed in a file, as all that can be
+	// told from it's exit status is that it did
+	file, err := ioutil.TempFile("", "buildkite-agent-failure-reason")
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	runner.failureReasonPath = file.Name()
+
+	runner.workspace = r.workspacePath()
+
+	runner.experiments, runner.deniedExperiments = experiments.ForJob(r.Job.Env[JobExperimentsEnv], r.AgentConfiguration.AllowedJobExperiments)
+	runner.Job.Experiments = runner.experiments
+
+	env := r.createEnvironment()
+
 	// The log streamer that will take the output chunks, and send them to
 	// the Buildkite Agent API
-	runner.logStreamer = LogStreamer{MaxChunkSizeBytes: r.Job.ChunksMaxSizeBytes, Callback: r.onUploadChunk}.New()
+	runner.logStreamer = LogStreamer{
+		MaxChunkSizeBytes: r.logChunkSize(),
+		Callback:          r.onUploadChunk,
+		Redactor:          NewRedactor(r.AgentConfiguration.RedactedVars, env),
+	}.New()
+
+	// The process that will run the bootstrap script, or start the job's
+	// pod which runs the bootstrap in it
+	script := r.AgentConfiguration.BootstrapScript
+	if r.AgentConfiguration.JobExecutor == JobExecutorKubernetes {
+		executable, err := os.Executable()
+		if err != nil {
+			executable = "buildkite-agent"
+		}
+		script = executable + " kubernetes-bootstrap"
+	}
 
-	// The process that will run the bootstrap script
 	runner.process = &process.Process{
-		Script:             r.AgentConfiguration.BootstrapScript,
-		Env:                r.createEnvironment(),
+		Script:             script,
+		Env:                env,
+		GracePeriod:        time.Second * time.Duration(r.AgentConfiguration.CancelGracePeriod),
 		PTY:                r.AgentConfiguration.RunInPty,
 		Timestamp:          r.AgentConfiguration.TimestampLines,
+		TimestampFormat:    r.AgentConfiguration.TimestampLinesFormat,
+		ANSIOutput:         r.ansiOutput(),
+		MaxOutputBytes:     r.AgentConfiguration.MaxLogSize,
 		StartCallback:      r.onProcessStartCallback,
+		RunningCallback:    runner.limitResources,
 		LineCallback:       runner.headerTimesStreamer.Scan,
 		LinePreProcessor:   runner.headerTimesStreamer.LinePreProcessor,
 		LineCallbackFilter: runner.headerTimesStreamer.LineIsHeader,
 	}
 
+	// The bootstrap is run as the job's user if there is one, who needs to
+	// be able to write to the files it's given
+	if runner.process.Credential, err = runner.bootstrapCredential(); err != nil {
+		return nil, err
+	}
+
+	runner.useInProcessBootstrap()
+	if err = runner.chownForJobUser(runner.metricsReportPath, runner.eventsReportPath, runner.failureReasonPath); err != nil {
+		return nil, err
+	}
+
+	if err = runner.addGitCredentialsJob(); err != nil {
+		return nil, err
+	}
+
 	return
 }
 
 // Runs the job
-func (r *JobRunner) Run() error {
-	logger.Info("Starting job %s", r.Job.ID)
+func (r *JobRunner) Run() (err error) {
+	r.log("start").Info("Starting job %s", r.Job.ID)
+
+	// Export the job's trace once everything, including finishing the
+	// job, is done
+	defer func() { r.finishTrace(err) }()
+
+	jobsRunning.Inc()
+	updateUtilization()
+	defer func() {
+		jobsRunning.Dec()
+		updateUtilization()
+	}()
+
+	// Also cleans up the report files if the job doesn't get to run
+	defer r.applyMetricsReports()
+	defer r.removeEventsReports()
+	defer r.removeGitCredentialsJob()
 
 	// Start the build in the Buildkite Agent API. This is the first thing
 	// we do so if it fails, we don't have to worry about cleaning things
 	// up like started log streamer workers, etc.
-	if err := r.startJob(time.Now()); err != nil {
+	startedAt := time.Now()
+	if err := r.startJob(startedAt); err != nil {
 		return err
 	}
+	r.observeJobWait(startedAt)
+
+	// Let the agent's event targets know, and pass on the events that
+	// the job's processes report until it's finished
+	r.emitEvent(events.Event{Type: events.JobStarted})
+	stopFollowingEvents := r.followEventsReports()
 
 	// Start the header time streamer
 	if err := r.headerTimesStreamer.Start(); err != nil {
 		return err
 	}
 
+	// Open a stream for the log chunks, otherwise they're uploaded one
+	// at a time
+	if r.experimentEnabled(ChunkStreamingExperiment) {
+		r.startChunkStreamer()
+	}
+
 	// Start the log streamer
 	if err := r.logStreamer.Start(); err != nil {
 		return err
 	}
 
-	// Start the process. This will block until it finishes.
-	if err := r.process.Start(); err != nil {
+	r.logExperiments()
+
+	// Check the agent can run the job and create its workspace, check the
+	// job's environment, and fetch its secrets, then start the process.
+	// This will block until it finishes. The secrets are fetched first so
+	// they're redacted from all of the job's output, and it fails without
+	// running if they can't be.
+	if err := r.prepareJob(); err != nil {
+		// Only the agent's own failures are logged, the job's are in
+		// its log
+		if r.preflightFailed {
+			r.log("start").Error("%s", err)
+		}
+		r.logStreamer.Process(fmt.Sprintf("\033[31m🚨 Error: %s\033[0m\n", err))
+		r.process.ExitStatus = "1"
+	} else if err := r.process.Start(); err != nil {
 		// Send the error as output
 		r.logStreamer.Process(fmt.Sprintf("%s", err))
 	} else {
-		// Add the final output to the streamer
-		r.logStreamer.Process(r.process.Output())
+		// Add the final output to the streamer, with why the job was
+		// killed if it ran out of memory
+		r.logStreamer.Process(r.process.Output() + r.oomKillMessage())
+		r.checkLogTruncated()
 	}
 
+	// Also kills anything the job left running, which has to be done
+	// before the workspace can be removed
+	r.removeCgroup()
+	r.removeWorkspace()
+	r.removeDockerConfig()
+	r.stopSSHAgent()
+	r.revokeJobToken()
+
+	// Send the last of the events the job's processes reported
+	stopFollowingEvents()
+
 	// Store the finished at time
 	finishedAt := time.Now()
 
@@ -118,41 +368,356 @@ func (r *JobRunner) Run() error {
 	// been uploaded
 	r.logStreamer.Stop()
 
+	chunksFailedCount := int(r.logStreamer.ChunksFailedCount)
+
+	// Wait for the last of the streamed chunks to be acknowledged
+	if r.chunkStreamer != nil {
+		r.chunkStreamer.Stop()
+		chunksFailedCount += int(r.chunkStreamer.ChunksFailedCount)
+	}
+
 	// Warn about failed chunks
-	if r.logStreamer.ChunksFailedCount > 0 {
-		logger.Warn("%d chunks failed to upload for this job", r.logStreamer.ChunksFailedCount)
+	if chunksFailedCount > 0 {
+		r.log("finish").Warn("%d chunks failed to upload for this job", chunksFailedCount)
 	}
 
 	// Finish the build in the Buildkite Agent API
-	r.finishJob(finishedAt, r.process.ExitStatus, int(r.logStreamer.ChunksFailedCount))
+	r.finishJob(finishedAt, r.process.ExitStatus, chunksFailedCount)
+
+	r.emitEvent(events.Event{Type: events.JobFinished, ExitStatus: r.process.ExitStatus, Signal: r.process.Signal})
+
+	jobsCompleted.Inc(r.process.ExitStatus)
+	jobDuration.Observe(finishedAt.Sub(startedAt).Seconds(), r.Job.Env["BUILDKITE_PIPELINE_SLUG"], agentQueue(r.Agent.Tags), r.process.ExitStatus)
 
 	// Wait for the routines that we spun up to finish
-	logger.Debug("[JobRunner] Waiting for all other routines to finish")
+	r.log("finish").Debug("[JobRunner] Waiting for all other routines to finish")
 	r.routineWaitGroup.Wait()
 
-	logger.Info("Finished job %s", r.Job.ID)
+	r.log("finish").Info("Finished job %s", r.Job.ID)
+
+	return nil
+}
+
+// Ends the job's span and exports it's trace
+func (r *JobRunner) finishTrace(err error) {
+	if r.process != nil {
+		r.span.SetAttribute("buildkite.exit_status", r.process.ExitStatus)
+	}
+	r.span.End(err)
+
+	if err := r.tracer.Flush(); err != nil {
+		r.log("finish").Warn("Failed to export the trace for job %s (%s)", r.Job.ID, err)
+	}
+}
+
+// Runs each of the steps that get the job ready to start, stopping at the
+// first that fails. The ones that fail because of the agent's machine rather
+// than the job are reported as infrastructure failures.
+func (r *JobRunner) prepareJob() error {
+	steps := []struct {
+		run            func() error
+		infrastructure bool
+	}{
+		{r.preflightChecks, true},
+		{r.createWorkspace, true},
+		{r.createBuildPathForJobUser, true},
+		{r.checkProtectedEnv, false},
+		{r.fetchSecrets, false},
+		{r.dockerLogin, false},
+		{r.startSSHAgent, false},
+		{r.createJobToken, true},
+	}
+
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			r.preflightFailed = step.infrastructure
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns why the bootstrap said the job failed, if it did, removing the file
+// it was written to
+func (r *JobRunner) failureReason() string {
+	if r.preflightFailed {
+		return failureReasonInfrastructure
+	}
+
+	if r.failureReasonPath == "" {
+		return ""
+	}
+	defer os.Remove(r.failureReasonPath)
+
+	reason, err := ioutil.ReadFile(r.failureReasonPath)
+	if err != nil {
+		r.log("finish").Warn("Failed to read why job %s failed (%s)", r.Job.ID, err)
+		return ""
+	}
+
+	return strings.TrimSpace(string(reason))
+}
+
+// Records how long the job waited to be started since it was ready to run,
+// when Buildkite says when that was
+func (r *JobRunner) observeJobWait(startedAt time.Time) {
+	if r.Job.RunnableAt == "" {
+		return
+	}
+
+	runnableAt, err := time.Parse(time.RFC3339Nano, r.Job.RunnableAt)
+	if err != nil {
+		r.log("start").Debug("Failed to parse when job %s was runnable (%s)", r.Job.ID, err)
+		return
+	}
+
+	if wait := startedAt.Sub(runnableAt); wait >= 0 {
+		jobWaitDuration.Observe(wait.Seconds(), agentQueue(r.Agent.Tags))
+	}
+}
+
+// Adds the metrics reported by the job's processes to the agent's
+func (r *JobRunner) applyMetricsReports() {
+	if r.metricsReportPath == "" {
+		return
+	}
+	defer os.Remove(r.metricsReportPath)
+
+	if err := metrics.ApplyReports(r.metricsReportPath); err != nil {
+		r.log("finish").Warn("Failed to read the metrics reported by job %s (%s)", r.Job.ID, err)
+	}
+}
+
+// The resources the job can use. Pipelines can lower the limits the agent
+// has been configured with, but not raise them.
+func (r *JobRunner) resourceLimits() (cgroup.Limits, error) {
+	max, err := cgroup.ParseLimits(r.AgentConfiguration.JobCPULimit, r.AgentConfiguration.JobMemoryLimit)
+	if err != nil {
+		return max, err
+	}
+
+	limits, err := cgroup.ParseLimits(r.Job.Env["BUILDKITE_JOB_CPU_LIMIT"], r.Job.Env["BUILDKITE_JOB_MEMORY_LIMIT"])
+	if err != nil {
+		return limits, err
+	}
+
+	return limits.Within(max), nil
+}
+
+// What's done with escape sequences in the job's output. Pipelines can choose
+// with BUILDKITE_ANSI_OUTPUT, otherwise it's what the agent is configured with.
+func (r *JobRunner) ansiOutput() string {
+	if mode := r.Job.Env["BUILDKITE_ANSI_OUTPUT"]; mode != "" {
+		if err := process.ValidateANSIOutput(mode); err != nil {
+			r.log("start").Warn("Ignoring BUILDKITE_ANSI_OUTPUT for job %s (%s)", r.Job.ID, err)
+		} else {
+			return mode
+		}
+	}
+
+	return r.AgentConfiguration.ANSIOutput
+}
+
+// Runs the job's processes in a cgroup with it's resource limits, if it has
+// any. This is called as soon as the bootstrap starts, before it's started
+// anything else.
+func (r *JobRunner) limitResources(pid int) error {
+	limits, err := r.resourceLimits()
+	if err != nil {
+		return err
+	}
+	if limits.IsZero() {
+		return nil
+	}
+
+	r.cgroup, err = cgroup.New(r.AgentConfiguration.CgroupParent, "job-"+r.Job.ID, limits)
+	if err != nil {
+		return fmt.Errorf("Failed to limit the job's resources: %v", err)
+	}
+
+	if err := r.cgroup.Add(pid); err != nil {
+		return fmt.Errorf("Failed to limit the job's resources: %v", err)
+	}
+
+	r.log("start").Info("Limiting job %s to %s", r.Job.ID, limits)
 
 	return nil
 }
 
-func (r *JobRunner) Kill() error {
+// The providers the job's secrets can come from
+func (r *JobRunner) secretsProviders() (secrets.Providers, error) {
+	providers := secrets.Providers{}
+
+	if c := r.AgentConfiguration; c.VaultAddr != "" {
+		vault, err := secrets.NewVault(secrets.VaultConfig{
+			Address:             c.VaultAddr,
+			Namespace:           c.VaultNamespace,
+			AuthMethod:          c.VaultAuthMethod,
+			AuthMount:           c.VaultAuthMount,
+			RoleID:              c.VaultRoleID,
+			SecretID:            c.VaultSecretID,
+			KubernetesRole:      c.VaultKubernetesRole,
+			KubernetesTokenPath: c.VaultKubernetesTokenPath,
+		})
+		if err != nil {
+			return nil, err
+		}
+		providers["vault"] = vault
+	}
+
+	if r.AgentConfiguration.SecretsFromAWS {
+		sess, err := awsSession()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to set up the AWS secrets providers: %v", err)
+		}
+		providers["ssm"] = secrets.NewSSM(sess)
+		providers["aws-secrets"] = secrets.NewSecretsManager(sess)
+	}
+
+	return providers, nil
+}
+
+// Fetches the secrets the job asks for in BUILDKITE_SECRETS into it's
+// environment, and redacts their values from the log. With AWS secrets on,
+// variables set to ssm:/path or aws-secrets:name are fetched too. They're
+// fetched by the agent so the job never sees the credentials for the
+// providers.
+func (r *JobRunner) fetchSecrets() error {
+	requested, err := secrets.Parse(r.Job.Env["BUILDKITE_SECRETS"])
+	if err != nil {
+		return err
+	}
+	if r.AgentConfiguration.SecretsFromAWS {
+		requested = append(requested, secrets.FromEnvironment(r.Job.Env, "ssm", "aws-secrets")...)
+	}
+	if len(requested) == 0 {
+		return nil
+	}
+
+	providers, err := r.secretsProviders()
+	if err != nil {
+		return err
+	}
+
+	env, err := providers.Fetch(requested)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for i, pair := range env {
+		value := strings.SplitN(pair, "=", 2)[1]
+		if skipped := r.logStreamer.Redactor.Add(value); len(skipped) > 0 {
+			r.logStreamer.Process(fmt.Sprintf("\033[33m⚠️ Warning: %s is too short to be redacted from the log\033[0m\n", requested[i].Name))
+		}
+		names = append(names, requested[i].Name)
+	}
+
+	r.process.Env = append(r.process.Env, env...)
+
+	// The pod only gets the variables it's told about, and gets the secrets
+	// from the job's secret
+	if r.AgentConfiguration.JobExecutor == JobExecutorKubernetes {
+		for _, name := range []string{"BUILDKITE_KUBERNETES_JOB_ENV", "BUILDKITE_KUBERNETES_SECRET_ENV"} {
+			r.process.Env = append(r.process.Env, name+"="+appendEnvNames(r.process.Env, name, names))
+		}
+	}
+
+	r.log("start").Info("Fetched %d secrets for job %s", len(env), r.Job.ID)
+
+	return nil
+}
+
+// Returns the comma separated names in the environment variable with the
+// names added
+func appendEnvNames(environ []string, name string, names []string) string {
+	var existing []string
+	for _, pair := range environ {
+		if strings.HasPrefix(pair, name+"=") && pair != name+"=" {
+			existing = []string{strings.TrimPrefix(pair, name+"=")}
+		}
+	}
+	return strings.Join(append(existing, names...), ",")
+}
+
+// Returns an error for the job log if any of the job's processes were killed
+// for going over it's memory limit, which otherwise just exit with 137
+func (r *JobRunner) oomKillMessage() string {
+	if r.cgroup == nil || r.cgroup.Limits.Memory == 0 {
+		return ""
+	}
+
+	kills, err := r.cgroup.OOMKills()
+	if err != nil {
+		r.log("finish").Warn("Failed to check job %s for OOM kills (%s)", r.Job.ID, err)
+		return ""
+	}
+	if kills == 0 {
+		return ""
+	}
+
+	message := fmt.Sprintf("\033[31m🚨 Error: %d of the job's processes ran out of memory and were killed, it's limited to %s\033[0m\n",
+		kills, cgroup.FormatMemory(r.cgroup.Limits.Memory))
+
+	if output := r.process.Output(); output != "" && !strings.HasSuffix(output, "\n") {
+		message = "\n" + message
+	}
+
+	return message
+}
+
+func (r *JobRunner) removeCgroup() {
+	if r.cgroup == nil {
+		return
+	}
+
+	if err := r.cgroup.Remove(); err != nil {
+		r.log("finish").Warn("Failed to clean up after job %s (%s)", r.Job.ID, err)
+	}
+}
+
+// Kill cancels the job, giving the bootstrap the grace period to run any
+// hooks before it's killed
+func (r *JobRunner) Kill(reason string) error {
 	r.killLock.Lock()
 	defer r.killLock.Unlock()
 
 	if !r.cancelled {
-		logger.Info("Canceling job %s", r.Job.ID)
+		r.log("cancel").Info("Canceling job %s", r.Job.ID)
 		r.cancelled = true
+		r.cancelReason = reason
 
 		if r.process != nil {
 			r.process.Kill()
 		} else {
-			logger.Error("No process to kill")
+			r.log("cancel").Error("No process to kill")
 		}
 	}
 
 	return nil
 }
 
+// Returns a logger that tags entries with the job and the phase of it that's
+// running, which are included in structured logs
+func (r *JobRunner) log(phase string) *logger.FieldLogger {
+	return logger.WithFields(logger.Fields{"job_id": r.Job.ID, "phase": phase})
+}
+
+// The directory buildkite-agent is in, which is the currently running file
+// (there is only 1 binary)
+func binPath() string {
+	dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
+	return dir
+}
+
+// Sets an environment variable unless the job already has it
+func setDefaultEnv(env map[string]string, key string, value string) {
+	if _, exists := env[key]; !exists {
+		env[key] = value
+	}
+}
+
 // Creates the environment variables that will be used in the process
 func (r *JobRunner) createEnvironment() []string {
 	// Create a clone of our jobs environment. We'll then set the
@@ -164,26 +729,196 @@ func (r *JobRunner) createEnvironment() []string {
 		env[key] = value
 	}
 
+	// Pipelines can't override the agent's credentials or the like, which
+	// is checked before the agent's own variables are added
+	r.protectedEnvRemoved = removeProtectedEnv(env, r.AgentConfiguration.ProtectedEnv)
+
+	// So the bootstrap can tell which variables came from the job when it
+	// checks they were all signed
+	if r.AgentConfiguration.PipelineVerificationKey != "" {
+		names := []string{}
+		for name := range env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		env[JobEnvNamesEnv] = strings.Join(names, ",")
+	}
+
 	// Add agent environment variables
 	env["BUILDKITE_AGENT_ENDPOINT"] = r.Endpoint
 	env["BUILDKITE_AGENT_ACCESS_TOKEN"] = r.Agent.AccessToken
 	env["BUILDKITE_AGENT_DEBUG"] = fmt.Sprintf("%t", logger.GetLevel() == logger.DEBUG)
 	env["BUILDKITE_AGENT_PID"] = fmt.Sprintf("%d", os.Getpid())
 
-	// We know the BUILDKITE_BIN_PATH dir, because it's the path to the
-	// currently running file (there is only 1 binary)
-	dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
-	env["BUILDKITE_BIN_PATH"] = dir
+	// So `buildkite-agent lock` can find the agent that's running the job
+	if r.AgentConfiguration.ControlSocket != "" {
+		env[ControlSocketEnv] = r.AgentConfiguration.ControlSocket
+	}
+
+	if r.metricsReportPath != "" {
+		env[metrics.ReportFileEnv] = r.metricsReportPath
+	}
+
+	if r.eventsReportPath != "" {
+		env[events.ReportFileEnv] = r.eventsReportPath
+	}
+
+	if r.failureReasonPath != "" {
+		env[FailureReasonFileEnv] = r.failureReasonPath
+	}
+
+	// So the bootstrap's trace joins the job's one
+	if r.span != nil {
+		env[tracing.TraceparentEnv] = r.span.Traceparent()
+	}
+
+	env["BUILDKITE_BIN_PATH"] = binPath()
 
 	// Add misc options
 	env["BUILDKITE_BUILD_PATH"] = r.AgentConfiguration.BuildPath
+	if r.workspace != "" {
+		env["BUILDKITE_BUILD_PATH"] = r.workspace
+	}
 	env["BUILDKITE_HOOKS_PATH"] = r.AgentConfiguration.HooksPath
+	env["BUILDKITE_HOOKS_OVERLAYS"] = strings.Join(r.AgentConfiguration.HooksOverlays, ",")
+
+	// So the job's processes can tell which experiments are enabled for
+	// it, replacing any the job set itself
+	env["BUILDKITE_AGENT_EXPERIMENT"] = strings.Join(r.experiments, ",")
 	env["BUILDKITE_PLUGINS_PATH"] = r.AgentConfiguration.PluginsPath
 	env["BUILDKITE_SSH_FINGERPRINT_VERIFICATION"] = fmt.Sprintf("%t", r.AgentConfiguration.SSHFingerprintVerification)
+	env["BUILDKITE_SSH_KNOWN_HOSTS"] = strings.Join(r.AgentConfiguration.SSHKnownHosts, ",")
+	env["BUILDKITE_SSH_HOST_KEY_VERIFICATION"] = r.AgentConfiguration.SSHHostKeyVerification
+	env["BUILDKITE_GIT_CREDENTIALS_PROVIDER"] = r.AgentConfiguration.GitCredentialsProvider
 	env["BUILDKITE_COMMAND_EVAL"] = fmt.Sprintf("%t", r.AgentConfiguration.CommandEval)
+	env["BUILDKITE_SHELL"] = r.AgentConfiguration.Shell
 	env["BUILDKITE_PLUGINS_ENABLED"] = fmt.Sprintf("%t", r.AgentConfiguration.PluginsEnabled)
+	env["BUILDKITE_STRICT_PLUGIN_VERIFICATION"] = fmt.Sprintf("%t", r.AgentConfiguration.StrictPluginVerification)
+	env["BUILDKITE_PIPELINE_VERIFICATION_KEY"] = r.AgentConfiguration.PipelineVerificationKey
+	env["BUILDKITE_ALLOWED_PLUGINS"] = strings.Join(r.AgentConfiguration.AllowedPlugins, ",")
+	env["BUILDKITE_DENIED_PLUGINS"] = strings.Join(r.AgentConfiguration.DeniedPlugins, ",")
+	env["BUILDKITE_DENIED_PLUGIN_PHASES"] = strings.Join(r.AgentConfiguration.DeniedPluginPhases, ",")
+	env["BUILDKITE_HOOK_TIMEOUT"] = fmt.Sprintf("%d", r.AgentConfiguration.HookTimeout)
+	env["BUILDKITE_CANCEL_GRACE_PERIOD"] = fmt.Sprintf("%d", r.AgentConfiguration.CancelGracePeriod)
+	env["BUILDKITE_JOB_SANDBOX"] = r.AgentConfiguration.JobSandbox
+	env["BUILDKITE_JOB_SANDBOX_WRITABLE_PATHS"] = strings.Join(r.AgentConfiguration.JobSandboxWritablePaths, ",")
+	env["BUILDKITE_JOB_SANDBOX_PULL_REQUESTS_ONLY"] = fmt.Sprintf("%t", r.AgentConfiguration.JobSandboxPullRequestsOnly)
+
+	// The bootstrap runs the command as the job's user itself, otherwise
+	// the whole bootstrap is run as them
+	if r.AgentConfiguration.JobUserCommandOnly {
+		env["BUILDKITE_JOB_USER"] = r.AgentConfiguration.JobUser
+	}
+
+	// Pipelines can choose the environment their jobs run in
+	if r.Job.Env["BUILDKITE_DEV_ENVIRONMENT"] == "" {
+		env["BUILDKITE_DEV_ENVIRONMENT"] = r.AgentConfiguration.DevEnvironment
+	}
+	if r.Job.Env["BUILDKITE_TOOLCHAIN"] == "" {
+		env["BUILDKITE_TOOLCHAIN"] = r.AgentConfiguration.Toolchain
+	}
+
+	// Tools are cached in the agent's build path, even when the job has a
+	// workspace of its own
+	env["BUILDKITE_TOOLCHAIN_CACHE_PATH"] = r.AgentConfiguration.ToolchainCachePath
+	if env["BUILDKITE_TOOLCHAIN_CACHE_PATH"] == "" {
+		env["BUILDKITE_TOOLCHAIN_CACHE_PATH"] = filepath.Join(r.AgentConfiguration.BuildPath, ".toolchains")
+	}
 	env["BUILDKITE_GIT_CLONE_FLAGS"] = r.AgentConfiguration.GitCloneFlags
 	env["BUILDKITE_GIT_CLEAN_FLAGS"] = r.AgentConfiguration.GitCleanFlags
+	env["BUILDKITE_GIT_SUBMODULE_URL_REWRITES"] = strings.Join(r.AgentConfiguration.GitSubmoduleURLRewrites, ",")
+	env["BUILDKITE_GIT_CREDENTIALS_FILE"] = r.AgentConfiguration.GitCredentialsFile
+	env["BUILDKITE_GIT_MIRRORS_PATH"] = r.AgentConfiguration.GitMirrorsPath
+	env["BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT"] = fmt.Sprintf("%d", r.AgentConfiguration.GitMirrorsLockTimeout)
+	env["BUILDKITE_GIT_MIRRORS_STALE_AFTER"] = fmt.Sprintf("%d", r.AgentConfiguration.GitMirrorsStaleAfter)
+	env["BUILDKITE_GIT_RETRIES"] = fmt.Sprintf("%d", r.AgentConfiguration.GitRetries)
+	env["BUILDKITE_GIT_RETRY_RECLONE"] = fmt.Sprintf("%t", r.AgentConfiguration.GitRetryReclone)
+
+	// So artifact uploads and the like from the job use the agent's proxy
+	if r.AgentConfiguration.Proxy != "" {
+		env["BUILDKITE_PROXY"] = r.AgentConfiguration.Proxy
+	}
+	// The proxy's credentials could be read by anything the job runs, so
+	// they're only passed on if the agent's told to
+	if r.AgentConfiguration.ProxyAuth != "" && r.AgentConfiguration.ProxyAuthForJobs {
+		env["BUILDKITE_PROXY_AUTH"] = r.AgentConfiguration.ProxyAuth
+		env["BUILDKITE_PROXY_USERNAME"] = r.AgentConfiguration.ProxyUsername
+		env["BUILDKITE_PROXY_PASSWORD"] = r.AgentConfiguration.ProxyPassword
+	}
+	if len(r.AgentConfiguration.NoProxy) > 0 {
+		env["BUILDKITE_NO_PROXY"] = strings.Join(r.AgentConfiguration.NoProxy, ",")
+	}
+
+	// And the agent's client certificate, for talking to the API
+	if r.AgentConfiguration.TLSClientCert != "" {
+		env["BUILDKITE_TLS_CLIENT_CERT"] = r.AgentConfiguration.TLSClientCert
+		env["BUILDKITE_TLS_CLIENT_KEY"] = r.AgentConfiguration.TLSClientKey
+	}
+	if r.AgentConfiguration.TLSCA != "" {
+		env["BUILDKITE_TLS_CA"] = r.AgentConfiguration.TLSCA
+	}
+
+	// How artifacts are stored in S3, which pipelines can change, i.e. to
+	// upload to a bucket of their own
+	if r.AgentConfiguration.S3ACL != "" {
+		setDefaultEnv(env, "BUILDKITE_S3_ACL", r.AgentConfiguration.S3ACL)
+	}
+	if r.AgentConfiguration.S3SSE != "" {
+		setDefaultEnv(env, "BUILDKITE_S3_SSE", r.AgentConfiguration.S3SSE)
+	}
+	if r.AgentConfiguration.S3SSEKMSKeyID != "" {
+		setDefaultEnv(env, "BUILDKITE_S3_SSE_KMS_KEY_ID", r.AgentConfiguration.S3SSEKMSKeyID)
+	}
+	if r.AgentConfiguration.S3Endpoint != "" {
+		setDefaultEnv(env, "BUILDKITE_S3_ENDPOINT", r.AgentConfiguration.S3Endpoint)
+	}
+	if r.AgentConfiguration.S3ForcePathStyle {
+		setDefaultEnv(env, "BUILDKITE_S3_FORCE_PATH_STYLE", "true")
+	}
+
+	// Pipelines can choose how much of the repository they need, so these
+	// are only set if the agent has been configured with them
+	if r.AgentConfiguration.GitCloneDepth > 0 {
+		setDefaultEnv(env, "BUILDKITE_GIT_CLONE_DEPTH", fmt.Sprintf("%d", r.AgentConfiguration.GitCloneDepth))
+	}
+	if r.AgentConfiguration.GitFetchDepth > 0 {
+		setDefaultEnv(env, "BUILDKITE_GIT_FETCH_DEPTH", fmt.Sprintf("%d", r.AgentConfiguration.GitFetchDepth))
+	}
+	if r.AgentConfiguration.GitSubmoduleRecursionDepth > 0 {
+		setDefaultEnv(env, "BUILDKITE_GIT_SUBMODULE_RECURSION_DEPTH", fmt.Sprintf("%d", r.AgentConfiguration.GitSubmoduleRecursionDepth))
+	}
+	if len(r.AgentConfiguration.GitSparseCheckoutPaths) > 0 {
+		setDefaultEnv(env, "BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS", strings.Join(r.AgentConfiguration.GitSparseCheckoutPaths, ","))
+	}
+
+	// The job's pod is configured by the agent, unless the pipeline wants
+	// something different, and gets the job's environment. It's namespace is
+	// only the agent's to choose, as the pipeline could otherwise put it in
+	// any the agent can get to.
+	if r.AgentConfiguration.JobExecutor == JobExecutorKubernetes {
+		setDefaultEnv(env, "BUILDKITE_KUBERNETES_IMAGE", r.AgentConfiguration.KubernetesImage)
+		env["BUILDKITE_KUBERNETES_NAMESPACE"] = r.AgentConfiguration.KubernetesNamespace
+		setDefaultEnv(env, "BUILDKITE_KUBERNETES_CPU", r.AgentConfiguration.KubernetesCPU)
+		setDefaultEnv(env, "BUILDKITE_KUBERNETES_MEMORY", r.AgentConfiguration.KubernetesMemory)
+		setDefaultEnv(env, "BUILDKITE_KUBERNETES_NODE_SELECTOR", strings.Join(r.AgentConfiguration.KubernetesNodeSelector, ","))
+
+		// The ones that look like secrets, like the agent's token, are
+		// kept out of the pod
+		var names, secretNames []string
+		for name := range env {
+			if kubernetesHostEnv[name] {
+				continue
+			}
+			names = append(names, name)
+			if isRedactedVar(r.AgentConfiguration.RedactedVars, name) {
+				secretNames = append(secretNames, name)
+			}
+		}
+		sort.Strings(names)
+		sort.Strings(secretNames)
+		env["BUILDKITE_KUBERNETES_JOB_ENV"] = strings.Join(names, ",")
+		env["BUILDKITE_KUBERNETES_SECRET_ENV"] = strings.Join(secretNames, ",")
+	}
 
 	// Convert the env map into a slice (which is what the script gear
 	// needs)
@@ -207,15 +942,15 @@ func (r *JobRunner) startJob(startedAt time.Time) error {
 
 		if err != nil {
 			if api.IsRetryableError(err) {
-				logger.Warn("%s (%s)", err, s)
+				r.log("start").Warn("%s (%s)", err, s)
 			} else {
-				logger.Warn("Buildkite rejected the call to start the job (%s)", err)
+				r.log("start").Warn("Buildkite rejected the call to start the job (%s)", err)
 				s.Break()
 			}
 		}
 
 		return err
-	}, &retry.Config{Maximum: 30, Interval: 5 * time.Second})
+	}, apiRetryConfig("start", 30, 5*time.Second))
 }
 
 // Finishes the job in the Buildkite Agent API. This call will keep on retrying
@@ -224,6 +959,14 @@ func (r *JobRunner) finishJob(finishedAt time.Time, exitStatus string, failedChu
 	r.Job.FinishedAt = finishedAt.UTC().Format(time.RFC3339Nano)
 	r.Job.ExitStatus = exitStatus
 	r.Job.ChunksFailedCount = failedChunkCount
+	r.Job.Signal = r.process.Signal
+	r.Job.FailureReason = r.failureReason()
+
+	// Let Buildkite know the job was cancelled, rather than failing by
+	// itself
+	r.killLock.Lock()
+	r.Job.SignalReason = r.cancelReason
+	r.killLock.Unlock()
 
 	return retry.Do(func(s *retry.Stats) error {
 		response, err := r.APIClient.Jobs.Finish(r.Job)
@@ -238,15 +981,15 @@ func (r *JobRunner) finishJob(finishedAt time.Time, exitStatus string, failedChu
 			// to finish the job forever so we'll just bail out and
 			// go find some more work to do.
 			if response != nil && response.StatusCode == 422 {
-				logger.Warn("Buildkite rejected the call to finish the job (%s)", err)
+				r.log("finish").Warn("Buildkite rejected the call to finish the job (%s)", err)
 				s.Break()
 			} else {
-				logger.Warn("%s (%s)", err, s)
+				r.log("finish").Warn("%s (%s)", err, s)
 			}
 		}
 
 		return err
-	}, &retry.Config{Forever: true, Interval: 1 * time.Second})
+	}, &retry.Config{Forever: true, Interval: 1 * time.Second, Exponential: true, Jitter: true, MaxInterval: apiRetryMaxInterval})
 }
 
 func (r *JobRunner) onProcessStartCallback() {
@@ -261,15 +1004,16 @@ func (r *JobRunner) onProcessStartCallback() {
 			// Send the output of the process to the log streamer
 			// for processing
 			r.logStreamer.Process(r.process.Output())
+			r.checkLogTruncated()
 
-			// Check the output in another second
-			time.Sleep(1 * time.Second)
+			// Check the output again soon
+			time.Sleep(r.logFlushInterval())
 		}
 
 		// Mark this routine as done in the wait group
 		r.routineWaitGroup.Done()
 
-		logger.Debug("[JobRunner] Routine that processes the log has finished")
+		r.log("run").Debug("[JobRunner] Routine that processes the log has finished")
 	}()
 
 	// Start a routine that will constantly ping Buildkite to see if the
@@ -282,9 +1026,9 @@ func (r *JobRunner) onProcessStartCallback() {
 			if err != nil {
 				// We don't really care if it fails, we'll just
 				// try again soon anyway
-				logger.Warn("Problem with getting job state %s (%s)", r.Job.ID, err)
+				r.log("run").Warn("Problem with getting job state %s (%s)", r.Job.ID, err)
 			} else if jobState.State == "canceling" || jobState.State == "canceled" {
-				r.Kill()
+				r.Kill(CancelReasonJobCancelled)
 			}
 
 			// Check for cancellations
@@ -294,7 +1038,7 @@ func (r *JobRunner) onProcessStartCallback() {
 		// Mark this routine as done in the wait group
 		r.routineWaitGroup.Done()
 
-		logger.Debug("[JobRunner] Routine that refreshes the job has finished")
+		r.log("run").Debug("[JobRunner] Routine that refreshes the job has finished")
 	}()
 }
 
@@ -302,16 +1046,38 @@ func (r *JobRunner) onUploadHeaderTime(cursor int, total int, times map[string]s
 	retry.Do(func(s *retry.Stats) error {
 		_, err := r.APIClient.HeaderTimes.Save(r.Job.ID, &api.HeaderTimes{Times: times})
 		if err != nil {
-			logger.Warn("%s (%s)", err, s)
+			r.log("run").Warn("%s (%s)", err, s)
 		}
 
 		return err
-	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+	}, apiRetryConfig("header-times", 10, 5*time.Second))
 }
 
-// Call when a chunk is ready for upload. It retry the chunk upload with an
-// interval before giving up.
+// Opens the stream that log chunks are uploaded over. If the stream can't be
+// opened the chunks are uploaded individually.
+func (r *JobRunner) startChunkStreamer() {
+	stream, err := r.APIClient.Chunks.Stream(r.Job.ID)
+	if err != nil {
+		r.log("upload").Warn("Failed to open a stream for log chunks, uploading them individually instead (%s)", err)
+		return
+	}
+
+	r.chunkStreamer = &ChunkStreamer{Stream: stream, Fallback: r.uploadChunk}
+	r.chunkStreamer.Start()
+}
+
+// Call when a chunk is ready for upload
 func (r *JobRunner) onUploadChunk(chunk *LogStreamerChunk) error {
+	if r.chunkStreamer != nil {
+		return r.chunkStreamer.Upload(chunk)
+	}
+
+	return r.uploadChunk(chunk)
+}
+
+// Uploads a chunk on it's own. It retry the chunk upload with an interval
+// before giving up.
+func (r *JobRunner) uploadChunk(chunk *LogStreamerChunk) error {
 	return retry.Do(func(s *retry.Stats) error {
 		_, err := r.APIClient.Chunks.Upload(r.Job.ID, &api.Chunk{
 			Data:     chunk.Data,
@@ -320,9 +1086,9 @@ func (r *JobRunner) onUploadChunk(chunk *LogStreamerChunk) error {
 			Size:     chunk.Size,
 		})
 		if err != nil {
-			logger.Warn("%s (%s)", err, s)
+			r.log("upload").Warn("%s (%s)", err, s)
 		}
 
 		return err
-	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+	}, apiRetryConfig("chunks", 10, 5*time.Second))
 }
@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateEnvironmentForKubernetesPods(t *testing.T) {
+	t.Parallel()
+
+	runner := &JobRunner{
+		Agent: &api.Agent{AccessToken: "llamas"},
+		AgentConfiguration: &AgentConfiguration{
+			JobExecutor:         JobExecutorKubernetes,
+			KubernetesNamespace: "builds",
+			KubernetesImage:     "buildkite/agent:3",
+			RedactedVars:        []string{"*_TOKEN", "*_PASSWORD"},
+		},
+		Job: &api.Job{Env: map[string]string{
+			"BUILDKITE_KUBERNETES_NAMESPACE": "kube-system",
+			"BUILDKITE_KUBERNETES_IMAGE":     "alpacas:latest",
+			"DATABASE_PASSWORD":              "hunter2",
+		}},
+	}
+
+	env := runner.createEnvironment()
+
+	// Pipelines can choose their image, but not their namespace
+	assert.Contains(t, env, "BUILDKITE_KUBERNETES_IMAGE=alpacas:latest")
+	assert.Contains(t, env, "BUILDKITE_KUBERNETES_NAMESPACE=builds")
+
+	// Anything that looks like a secret is kept out of the pod
+	assert.Contains(t, env, "BUILDKITE_KUBERNETES_SECRET_ENV=BUILDKITE_AGENT_ACCESS_TOKEN,DATABASE_PASSWORD")
+}
+
+func TestCreateEnvironmentOnlyPassesOnProxyCredentialsIfAsked(t *testing.T) {
+	t.Parallel()
+
+	config := &AgentConfiguration{Proxy: "http://proxy.example.com:3128", ProxyAuth: "ntlm", ProxyUsername: `CORP\buildkite`, ProxyPassword: "secret"}
+	runner := &JobRunner{Agent: &api.Agent{}, AgentConfiguration: config, Job: &api.Job{Env: map[string]string{}}}
+
+	env := runner.createEnvironment()
+	assert.Contains(t, env, "BUILDKITE_PROXY=http://proxy.example.com:3128")
+	assert.NotContains(t, env, "BUILDKITE_PROXY_PASSWORD=secret")
+
+	config.ProxyAuthForJobs = true
+	assert.Contains(t, runner.createEnvironment(), "BUILDKITE_PROXY_PASSWORD=secret")
+}
+
+func TestAppendEnvNames(t *testing.T) {
+	t.Parallel()
+
+	environ := []string{"BUILDKITE_KUBERNETES_SECRET_ENV=", "BUILDKITE_KUBERNETES_JOB_ENV=A,B"}
+
+	assert.Equal(t, "A,B,C", appendEnvNames(environ, "BUILDKITE_KUBERNETES_JOB_ENV", []string{"C"}))
+	assert.Equal(t, "C", appendEnvNames(environ, "BUILDKITE_KUBERNETES_SECRET_ENV", []string{"C"}))
+}
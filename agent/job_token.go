@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/retry"
+)
+
+// The scopes a job's token has when the agent isn't configured with any
+var defaultJobAPITokenScopes = []string{"log", "artifacts", "meta-data"}
+
+// Swaps the agent's access token in the job's environment for one that only
+// works for the job, and only for the parts of the API its scopes allow, so
+// nothing the job runs can use the agent's token for anything else. It's
+// revoked once the job finishes. The agent keeps using its own token for the
+// job's log and to finish it.
+func (r *JobRunner) createJobToken() error {
+	if !r.AgentConfiguration.JobAPIToken {
+		return nil
+	}
+
+	scopes := r.AgentConfiguration.JobAPITokenScopes
+	if len(scopes) == 0 {
+		scopes = defaultJobAPITokenScopes
+	}
+
+	request := &api.JobTokenRequest{Scopes: scopes}
+
+	var token *api.JobToken
+	err := retry.Do(func(s *retry.Stats) error {
+		var err error
+		token, _, err = r.APIClient.Jobs.CreateToken(r.Job.ID, request)
+		if err != nil {
+			if api.IsRetryableError(err) {
+				r.log("start").Warn("%s (%s)", err, s)
+			} else {
+				s.Break()
+			}
+		}
+
+		return err
+	}, apiRetryConfig("token", 10, 5*time.Second))
+	if err != nil {
+		return fmt.Errorf("A token for the job couldn't be created (%v)", err)
+	}
+	if token.Token == "" {
+		return fmt.Errorf("Buildkite didn't create a token for the job")
+	}
+
+	r.jobToken = token.Token
+	r.logStreamer.Redactor.Add(token.Token)
+
+	// The agent's token is removed rather than overridden, so it isn't
+	// passed on to the job at all
+	environ := []string{}
+	for _, e := range r.process.Env {
+		if !strings.HasPrefix(e, "BUILDKITE_AGENT_ACCESS_TOKEN=") {
+			environ = append(environ, e)
+		}
+	}
+	r.process.Env = append(environ, "BUILDKITE_AGENT_ACCESS_TOKEN="+token.Token)
+
+	r.log("start").Debug("Created a token for job %s", r.Job.ID)
+
+	return nil
+}
+
+// Revokes the job's token, so anything the job left behind can't use it
+func (r *JobRunner) revokeJobToken() {
+	if r.jobToken == "" {
+		return
+	}
+
+	err := retry.Do(func(s *retry.Stats) error {
+		_, err := r.APIClient.Jobs.RevokeToken(r.Job.ID)
+		if err != nil && !api.IsRetryableError(err) {
+			s.Break()
+		}
+
+		return err
+	}, apiRetryConfig("token", 10, 5*time.Second))
+	if err != nil {
+		r.log("finish").Warn("Failed to revoke the token of job %s (%s)", r.Job.ID, err)
+		return
+	}
+
+	r.jobToken = ""
+}
@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/process"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobTokenReplacesTheAgentsAndIsRevoked(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var revoked bool
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "Token llamas", req.Header.Get("Authorization"))
+
+		switch req.Method + " " + req.URL.Path {
+		case "POST /jobs/abc/token":
+			var request api.JobTokenRequest
+			json.NewDecoder(req.Body).Decode(&request)
+			assert.Equal(t, []string{"artifacts", "meta-data"}, request.Scopes)
+			rw.Write([]byte(`{"token": "alpacas-only-for-abc"}`))
+		case "DELETE /jobs/abc/token":
+			mu.Lock()
+			revoked = true
+			mu.Unlock()
+			rw.Write([]byte(`{}`))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	r := &JobRunner{
+		Job:                &api.Job{ID: "abc"},
+		AgentConfiguration: &AgentConfiguration{JobAPIToken: true, JobAPITokenScopes: []string{"artifacts", "meta-data"}},
+		APIClient:          APIClient{Endpoint: server.URL, Token: "llamas"}.Create(),
+		process:            &process.Process{Env: []string{"BUILDKITE_AGENT_ACCESS_TOKEN=llamas"}},
+		logStreamer:        LogStreamer{Redactor: NewRedactor(nil, nil)}.New(),
+	}
+
+	assert.NoError(t, r.createJobToken())
+
+	// The job only gets it's own token
+	assert.Equal(t, []string{"BUILDKITE_AGENT_ACCESS_TOKEN=alpacas-only-for-abc"}, r.process.Env)
+	redactor := r.logStreamer.Redactor
+	assert.NotContains(t, redactor.Redact("token: alpacas-only-for-abc\n")+redactor.Flush(), "alpacas")
+
+	r.revokeJobToken()
+
+	mu.Lock()
+	assert.True(t, revoked)
+	mu.Unlock()
+}
+
+func TestJobTokenIsOnlyCreatedWhenTurnedOn(t *testing.T) {
+	t.Parallel()
+
+	r := &JobRunner{
+		Job:                &api.Job{ID: "abc"},
+		AgentConfiguration: &AgentConfiguration{},
+		process:            &process.Process{},
+	}
+
+	assert.NoError(t, r.createJobToken())
+	assert.Empty(t, r.process.Env)
+
+	// Nothing to revoke, so the API isn't needed
+	r.revokeJobToken()
+}
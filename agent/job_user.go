@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/process"
+)
+
+// Returns the user the job's bootstrap is run as, or nil if it's run as the
+// agent's user. Only the command and the job's hooks are run as the user if
+// the agent's configured to, which the bootstrap does itself.
+func (r *JobRunner) bootstrapCredential() (*process.Credential, error) {
+	c := r.AgentConfiguration
+	if c.JobUser == "" || c.JobUserCommandOnly || c.JobExecutor == JobExecutorKubernetes {
+		return nil, nil
+	}
+
+	return process.LookupCredential(c.JobUser)
+}
+
+// Gives the job's user the files the agent creates for the bootstrap to
+// write to, which are otherwise only writable by the agent's user
+func (r *JobRunner) chownForJobUser(paths ...string) error {
+	if r.process == nil || r.process.Credential == nil {
+		return nil
+	}
+	cred := r.process.Credential
+
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := os.Chown(path, int(cred.UID), int(cred.GID)); err != nil {
+			return fmt.Errorf("%s couldn't be given to %s (%v)", path, cred.Username, err)
+		}
+	}
+
+	return nil
+}
+
+// Creates the build path for the job's user if it doesn't exist yet. Build
+// paths that already exist need to be writable by the user.
+func (r *JobRunner) createBuildPathForJobUser() error {
+	if r.process == nil || r.process.Credential == nil || r.workspace != "" {
+		return nil
+	}
+
+	path := r.AgentConfiguration.BuildPath
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("The build path %s couldn't be created (%v)", path, err)
+	}
+	return r.chownForJobUser(path)
+}
@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+)
+
+// Locks that jobs on this machine hold while they use something they can't
+// share, like a simulator or a license server. They're served over the
+// control socket by `buildkite-agent lock`, so they're shared by every job the
+// agent runs, and any a job still holds when it finishes are released.
+type localLocks struct {
+	mu    sync.Mutex
+	locks map[string]*localLock
+}
+
+type localLock struct {
+	token string
+	jobID string
+
+	// Closed once the lock is released, which wakes anything waiting
+	released chan struct{}
+}
+
+// LocalLockInfo describes a held lock
+type LocalLockInfo struct {
+	Key   string `json:"key"`
+	JobID string `json:"job_id,omitempty"`
+}
+
+var errLockTimeout = errors.New("Timed out waiting for the lock")
+
+func newLocalLocks() *localLocks {
+	return &localLocks{locks: map[string]*localLock{}}
+}
+
+// Waits for the lock to be free and takes it, returning the token that
+// releases it. It gives up once the timeout has passed, if there is one.
+func (l *localLocks) Acquire(key string, jobID string, timeout time.Duration) (string, error) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		l.mu.Lock()
+		held, ok := l.locks[key]
+		if !ok {
+			token := api.NewUUID()
+			l.locks[key] = &localLock{token: token, jobID: jobID, released: make(chan struct{})}
+			l.mu.Unlock()
+			return token, nil
+		}
+		l.mu.Unlock()
+
+		select {
+		case <-held.released:
+		case <-deadline:
+			return "", errLockTimeout
+		}
+	}
+}
+
+// Releases the lock, if the token is the one it was acquired with
+func (l *localLocks) Release(key string, token string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	held, ok := l.locks[key]
+	if !ok || held.token != token {
+		return fmt.Errorf("The lock %q isn't held with that token", key)
+	}
+
+	l.release(key, held)
+	return nil
+}
+
+// Releases every lock the job still holds
+func (l *localLocks) ReleaseJob(jobID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, held := range l.locks {
+		if held.jobID == jobID {
+			logger.Warn("Releasing the lock %q, job %s finished without releasing it", key, jobID)
+			l.release(key, held)
+		}
+	}
+}
+
+func (l *localLocks) release(key string, held *localLock) {
+	delete(l.locks, key)
+	close(held.released)
+}
+
+// Returns the locks that are held, in order of their keys
+func (l *localLocks) Held() []LocalLockInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	held := []LocalLockInfo{}
+	for key, lock := range l.locks {
+		held = append(held, LocalLockInfo{Key: key, JobID: lock.jobID})
+	}
+
+	sort.Slice(held, func(i, j int) bool {
+		return held[i].Key < held[j].Key
+	})
+	return held
+}
@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalLocksWaitForRelease(t *testing.T) {
+	t.Parallel()
+
+	locks := newLocalLocks()
+
+	token, err := locks.Acquire("simulator", "job-1", 0)
+	assert.NoError(t, err)
+
+	acquired := make(chan string)
+	go func() {
+		token, err := locks.Acquire("simulator", "job-2", 0)
+		assert.NoError(t, err)
+		acquired <- token
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Expected the lock to be waited for")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Only the token it was acquired with releases it
+	assert.Error(t, locks.Release("simulator", "llamas"))
+	assert.NoError(t, locks.Release("simulator", token))
+
+	select {
+	case next := <-acquired:
+		assert.NotEqual(t, token, next)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the lock to be acquired once it was released")
+	}
+
+	assert.Equal(t, []LocalLockInfo{{Key: "simulator", JobID: "job-2"}}, locks.Held())
+}
+
+func TestLocalLocksTimeout(t *testing.T) {
+	t.Parallel()
+
+	locks := newLocalLocks()
+
+	_, err := locks.Acquire("simulator", "job-1", 0)
+	assert.NoError(t, err)
+
+	_, err = locks.Acquire("simulator", "job-2", 10*time.Millisecond)
+	assert.Equal(t, errLockTimeout, err)
+
+	// Other locks aren't affected
+	_, err = locks.Acquire("license-server", "job-2", 10*time.Millisecond)
+	assert.NoError(t, err)
+}
+
+func TestLocalLocksReleasedWhenJobFinishes(t *testing.T) {
+	t.Parallel()
+
+	locks := newLocalLocks()
+
+	_, err := locks.Acquire("simulator", "job-1", 0)
+	assert.NoError(t, err)
+	_, err = locks.Acquire("license-server", "job-2", 0)
+	assert.NoError(t, err)
+
+	locks.ReleaseJob("job-1")
+
+	assert.Equal(t, []LocalLockInfo{{Key: "license-server", JobID: "job-2"}}, locks.Held())
+
+	_, err = locks.Acquire("simulator", "job-3", 10*time.Millisecond)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/retry"
+)
+
+// The annotation that says which jobs had their logs truncated
+const logTruncatedAnnotationContext = "buildkite-agent-log-truncated"
+
+// Returns the size of the chunks the log is uploaded in, which is what the
+// agent is configured with as long as Buildkite allows chunks that big
+func (r *JobRunner) logChunkSize() int {
+	size := r.Job.ChunksMaxSizeBytes
+	if configured := r.AgentConfiguration.LogChunkSize; configured > 0 && (size == 0 || configured < size) {
+		size = configured
+	}
+	return size
+}
+
+// Returns how often new output from the job is uploaded
+func (r *JobRunner) logFlushInterval() time.Duration {
+	if r.AgentConfiguration.LogFlushInterval <= 0 {
+		return time.Second
+	}
+	return time.Duration(r.AgentConfiguration.LogFlushInterval) * time.Second
+}
+
+// Once the job has more output than the maximum log size, the rest of it is
+// dropped, and both the log and the build say so
+func (r *JobRunner) checkLogTruncated() {
+	if !r.process.OutputTruncated() || !atomic.CompareAndSwapInt32(&r.logTruncated, 0, 1) {
+		return
+	}
+
+	size := fmt.Sprintf("%d MiB", r.AgentConfiguration.MaxLogSize/1024/1024)
+	r.logStreamer.Append(fmt.Sprintf("\n\033[31m🚨 Error: The rest of this log has been truncated, as the job's output is more than the maximum of %s\033[0m\n", size))
+
+	err := retry.Do(func(s *retry.Stats) error {
+		_, err := r.APIClient.Annotations.Create(r.Job.ID, &api.Annotation{
+			Context: logTruncatedAnnotationContext,
+			Section: r.Job.ID,
+			Style:   "warning",
+			Body:    fmt.Sprintf("The log of job `%s` was truncated, as it had more than %s of output", r.Job.ID, size),
+		})
+		if err != nil {
+			r.log("run").Warn("%s (%s)", err, s)
+		}
+
+		return err
+	}, apiRetryConfig("annotations", 3, 5*time.Second))
+	if err != nil {
+		r.log("run").Warn("Failed to annotate the build with the truncated log (%s)", err)
+	}
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/process"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogChunkSize(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		allowed, configured, expected int
+	}{
+		{allowed: 100 * 1024, configured: 0, expected: 100 * 1024},
+		{allowed: 100 * 1024, configured: 10 * 1024, expected: 10 * 1024},
+		{allowed: 100 * 1024, configured: 1024 * 1024, expected: 100 * 1024},
+		{allowed: 0, configured: 10 * 1024, expected: 10 * 1024},
+	} {
+		runner := &JobRunner{
+			Job:                &api.Job{ChunksMaxSizeBytes: tc.allowed},
+			AgentConfiguration: &AgentConfiguration{LogChunkSize: tc.configured},
+		}
+		assert.Equal(t, tc.expected, runner.logChunkSize())
+	}
+}
+
+func TestLogIsTruncatedAtTheMaximumSize(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Uses a shell to write the output")
+	}
+
+	var annotations []api.Annotation
+	var mu sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/jobs/abc/annotations" {
+			var annotation api.Annotation
+			json.NewDecoder(req.Body).Decode(&annotation)
+			mu.Lock()
+			annotations = append(annotations, annotation)
+			mu.Unlock()
+		}
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	var log []string
+	runner := &JobRunner{
+		Job:                &api.Job{ID: "abc"},
+		AgentConfiguration: &AgentConfiguration{MaxLogSize: 1024 * 1024},
+		APIClient:          APIClient{Endpoint: server.URL, Token: "llamas"}.Create(),
+		process: &process.Process{
+			Script:             "/bin/sh -c 'while :; do echo llamas; done | head -c 2000000'",
+			MaxOutputBytes:     1024 * 1024,
+			StartCallback:      func() {},
+			LineCallback:       func(string) {},
+			LinePreProcessor:   func(line string) string { return line },
+			LineCallbackFilter: func(string) bool { return false },
+		},
+	}
+	runner.logStreamer = LogStreamer{
+		MaxChunkSizeBytes: 100 * 1024,
+		Callback: func(chunk *LogStreamerChunk) error {
+			mu.Lock()
+			defer mu.Unlock()
+			log = append(log, chunk.Data)
+			return nil
+		},
+	}.New()
+
+	if err := runner.logStreamer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	runner.logStreamer.Process(runner.process.Output())
+	runner.checkLogTruncated()
+	runner.checkLogTruncated()
+	runner.logStreamer.Stop()
+
+	output := strings.Join(log, "")
+	lines := strings.SplitN(output, "\n\033[31m🚨", 2)
+	if !assert.Len(t, lines, 2, "The log should end with the truncated message") {
+		return
+	}
+	assert.Len(t, lines[0], 1024*1024)
+	assert.Contains(t, lines[1], "more than the maximum of 1 MiB")
+
+	if assert.Len(t, annotations, 1) {
+		assert.Equal(t, "warning", annotations[0].Style)
+		assert.Equal(t, "abc", annotations[0].Section)
+	}
+}
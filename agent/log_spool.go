@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// A queue of log chunks waiting to be uploaded. Chunks are kept in memory up
+// to a limit, and after that their data is written to a spool file on disk
+// until the queue has caught up, so a job with lots of output doesn't use
+// more and more memory when chunks can't be uploaded as fast as they're made.
+// Chunks come out in the order they went in, wherever they're kept.
+type chunkSpool struct {
+	// The most bytes of chunk data kept in memory
+	maxMemoryBytes int
+
+	// Where the spool file is created
+	dir string
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	entries     []*spooledChunk
+	memoryBytes int
+	closed      bool
+
+	// The spool file, created the first time it's needed, and how much of
+	// it is used by chunks that are still queued
+	file         *os.File
+	fileOffset   int64
+	spooledCount int
+}
+
+type spooledChunk struct {
+	chunk *LogStreamerChunk
+
+	// Whether the chunk's data is in the spool file, and where
+	onDisk bool
+	offset int64
+	length int
+}
+
+func newChunkSpool(maxMemoryBytes int, dir string) *chunkSpool {
+	s := &chunkSpool{maxMemoryBytes: maxMemoryBytes, dir: dir}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Adds the chunk to the end of the queue
+func (s *chunkSpool) Push(chunk *LogStreamerChunk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = append(s.entries, s.spool(chunk))
+	s.cond.Signal()
+}
+
+// Puts a chunk back at the front of the queue, so it's the next one out
+func (s *chunkSpool) Unshift(chunk *LogStreamerChunk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries = append([]*spooledChunk{s.spool(chunk)}, s.entries...)
+	s.cond.Signal()
+}
+
+// Keeps the chunk in memory if there's room, otherwise writes it's data to
+// the spool file. If the spool file can't be written the chunk stays in
+// memory, as it's better to use more memory than lose part of the log.
+func (s *chunkSpool) spool(chunk *LogStreamerChunk) *spooledChunk {
+	entry := &spooledChunk{chunk: chunk, length: len(chunk.Data)}
+
+	if s.memoryBytes+len(chunk.Data) <= s.maxMemoryBytes {
+		s.memoryBytes += len(chunk.Data)
+		return entry
+	}
+
+	if err := s.writeToDisk(entry); err != nil {
+		logger.Warn("[LogStreamer] Failed to spool chunk %d to disk, keeping it in memory (%s)", chunk.Order, err)
+		s.memoryBytes += len(chunk.Data)
+	}
+
+	return entry
+}
+
+func (s *chunkSpool) writeToDisk(entry *spooledChunk) error {
+	if s.file == nil {
+		file, err := ioutil.TempFile(s.dir, "buildkite-log-spool")
+		if err != nil {
+			return err
+		}
+		logger.Debug("[LogStreamer] Spooling log chunks to %s", file.Name())
+		s.file = file
+	}
+
+	if _, err := s.file.WriteAt([]byte(entry.chunk.Data), s.fileOffset); err != nil {
+		return err
+	}
+
+	spooled := *entry.chunk
+	spooled.Data = ""
+
+	entry.chunk = &spooled
+	entry.onDisk = true
+	entry.offset = s.fileOffset
+	s.fileOffset += int64(entry.length)
+	s.spooledCount++
+
+	return nil
+}
+
+// Returns the chunk at the front of the queue, waiting for one if the queue
+// is empty. Once the spool is closed and empty it returns nil.
+func (s *chunkSpool) Pop() (*LogStreamerChunk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.entries) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+
+	if len(s.entries) == 0 {
+		return nil, nil
+	}
+
+	entry := s.entries[0]
+	s.entries[0] = nil
+	s.entries = s.entries[1:]
+
+	if !entry.onDisk {
+		s.memoryBytes -= entry.length
+		return entry.chunk, nil
+	}
+
+	data := make([]byte, entry.length)
+	_, err := s.file.ReadAt(data, entry.offset)
+
+	// The spool file is started again once everything in it is out,
+	// so it doesn't grow for as long as the job runs
+	s.spooledCount--
+	if s.spooledCount == 0 {
+		s.fileOffset = 0
+		s.file.Truncate(0)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	chunk := *entry.chunk
+	chunk.Data = string(data)
+	return &chunk, nil
+}
+
+// Returns how many chunks are queued, and how many of those are on disk
+func (s *chunkSpool) Len() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.entries), s.spooledCount
+}
+
+// Wakes anything waiting for a chunk, and removes the spool file
+func (s *chunkSpool) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.cond.Broadcast()
+
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}
+}
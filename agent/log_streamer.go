@@ -5,10 +5,25 @@ import (
 	"math"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/buildkite/agent/logger"
 )
 
+const (
+	// How many bytes of chunks are queued in memory before they're spooled
+	// to disk
+	DefaultLogStreamerMemoryBytes = 16 * 1024 * 1024
+
+	// How long a chunk keeps being tried again after it first fails to
+	// upload, which is how long an outage of the API can be without losing
+	// any of the log
+	DefaultLogStreamerRetryTimeout = 10 * time.Minute
+
+	// How long to wait before trying a chunk again
+	DefaultLogStreamerRetryInterval = 5 * time.Second
+)
+
 type LogStreamer struct {
 	// How many log streamer workers are running at any one time
 	Concurrency int
@@ -22,12 +37,31 @@ type LogStreamer struct {
 	// The callback called when a chunk is ready for upload
 	Callback func(chunk *LogStreamerChunk) error
 
+	// Replaces secrets in the output before it's uploaded, if set
+	Redactor *Redactor
+
+	// How many bytes of chunks are queued in memory, after which they're
+	// spooled to disk until the uploads catch up
+	MaxMemoryBytes int
+
+	// Where chunks are spooled to, defaulting to the system temp directory
+	SpoolDir string
+
+	// How long chunks that fail to upload keep being tried again, and how
+	// long to wait between tries
+	RetryTimeout  time.Duration
+	RetryInterval time.Duration
+
 	// The queue of chunks that are needing to be uploaded
-	queue chan *LogStreamerChunk
+	queue *chunkSpool
 
 	// Total size in bytes of the log
 	bytes int
 
+	// Total size in bytes of the log that's been queued for upload, which
+	// is different to the size of the log once it's been redacted
+	offset int
+
 	// Each chunk is assigned an order
 	order int
 
@@ -52,12 +86,26 @@ type LogStreamerChunk struct {
 
 	// The byte size of this chunk
 	Size int
+
+	// When the chunk first failed to upload
+	failedAt time.Time
 }
 
 // Creates a new instance of the log streamer
 func (ls LogStreamer) New() *LogStreamer {
 	ls.Concurrency = 3
-	ls.queue = make(chan *LogStreamerChunk, 1024)
+
+	if ls.MaxMemoryBytes == 0 {
+		ls.MaxMemoryBytes = DefaultLogStreamerMemoryBytes
+	}
+	if ls.RetryTimeout == 0 {
+		ls.RetryTimeout = DefaultLogStreamerRetryTimeout
+	}
+	if ls.RetryInterval == 0 {
+		ls.RetryInterval = DefaultLogStreamerRetryInterval
+	}
+
+	ls.queue = newChunkSpool(ls.MaxMemoryBytes, ls.SpoolDir)
 
 	return &ls
 }
@@ -87,57 +135,87 @@ func (ls *LogStreamer) Process(output string) error {
 		// Grab the part of the log that we haven't seen yet
 		blob := output[ls.bytes:bytes]
 
-		// How many chunks do we have that fit within the MaxChunkSizeBytes?
-		numberOfChunks := int(math.Ceil(float64(len(blob)) / float64(ls.MaxChunkSizeBytes)))
+		if ls.Redactor != nil {
+			blob = ls.Redactor.Redact(blob)
+		}
 
-		// Increase the wait group by the amount of chunks we're going
-		// to add
-		ls.chunkWaitGroup.Add(numberOfChunks)
+		ls.queueChunks(blob)
 
-		for i := 0; i < numberOfChunks; i++ {
-			// Find the upper limit of the blob
-			upperLimit := (i + 1) * ls.MaxChunkSizeBytes
-			if upperLimit > len(blob) {
-				upperLimit = len(blob)
-			}
+		// Save the new amount of bytes
+		ls.bytes = bytes
+	}
 
-			// Grab the 100kb section of the blob
-			partialChunk := blob[i*ls.MaxChunkSizeBytes : upperLimit]
+	ls.processMutex.Unlock()
 
-			// Increment the order
-			ls.order += 1
+	return nil
+}
 
-			// Create the chunk and append it to our list
-			chunk := LogStreamerChunk{
-				Data:   partialChunk,
-				Order:  ls.order,
-				Offset: ls.bytes,
-				Size:   bytes - ls.bytes,
-			}
+// Adds text to the end of the log that isn't part of the process output, like
+// a message from the agent
+func (ls *LogStreamer) Append(text string) {
+	ls.processMutex.Lock()
+	defer ls.processMutex.Unlock()
 
-			ls.queue <- &chunk
+	if ls.Redactor != nil {
+		text = ls.Redactor.Redact(text)
+	}
+
+	ls.queueChunks(text)
+}
+
+// Splits the blob into chunks and adds them to the upload queue
+func (ls *LogStreamer) queueChunks(blob string) {
+	// How many chunks do we have that fit within the MaxChunkSizeBytes?
+	numberOfChunks := int(math.Ceil(float64(len(blob)) / float64(ls.MaxChunkSizeBytes)))
+
+	// Increase the wait group by the amount of chunks we're going
+	// to add
+	ls.chunkWaitGroup.Add(numberOfChunks)
+
+	for i := 0; i < numberOfChunks; i++ {
+		// Find the upper limit of the blob
+		upperLimit := (i + 1) * ls.MaxChunkSizeBytes
+		if upperLimit > len(blob) {
+			upperLimit = len(blob)
 		}
 
-		// Save the new amount of bytes
-		ls.bytes = bytes
-	}
+		// Grab the 100kb section of the blob
+		partialChunk := blob[i*ls.MaxChunkSizeBytes : upperLimit]
 
-	ls.processMutex.Unlock()
+		// Increment the order
+		ls.order += 1
 
-	return nil
+		// Create the chunk and append it to our list
+		chunk := LogStreamerChunk{
+			Data:   partialChunk,
+			Order:  ls.order,
+			Offset: ls.offset,
+			Size:   len(blob),
+		}
+
+		ls.queue.Push(&chunk)
+	}
+
+	ls.offset += len(blob)
 }
 
 // Waits for all the chunks to be uploaded, then shuts down all the workers
 func (ls *LogStreamer) Stop() error {
+	// Anything held back by the redactor can be uploaded now that there's
+	// no more output
+	if ls.Redactor != nil {
+		ls.processMutex.Lock()
+		ls.queueChunks(ls.Redactor.Flush())
+		ls.processMutex.Unlock()
+	}
+
 	logger.Debug("[LogStreamer] Waiting for all the chunks to be uploaded")
 
 	ls.chunkWaitGroup.Wait()
 
 	logger.Debug("[LogStreamer] Shutting down all workers")
 
-	for n := 0; n < ls.Concurrency; n++ {
-		ls.queue <- nil
-	}
+	ls.queue.Close()
 
 	return nil
 }
@@ -146,11 +224,16 @@ func (ls *LogStreamer) Stop() error {
 func Worker(id int, ls *LogStreamer) {
 	logger.Debug("[LogStreamer/Worker#%d] Worker is starting...", id)
 
-	var chunk *LogStreamerChunk
 	for {
-		// Get the next chunk (pointer) from the queue. This will block
-		// until something is returned.
-		chunk = <-ls.queue
+		// Get the next chunk from the queue. This will block until
+		// something is returned.
+		chunk, err := ls.queue.Pop()
+		if err != nil {
+			atomic.AddInt32(&ls.ChunksFailedCount, 1)
+			logger.Error("Failed to read a log chunk back from disk, this will result in only a partial build log on Buildkite (%s)", err)
+			ls.chunkWaitGroup.Done()
+			continue
+		}
 
 		// If the next chunk is nil, then there is no more work to do
 		if chunk == nil {
@@ -158,8 +241,21 @@ func Worker(id int, ls *LogStreamer) {
 		}
 
 		// Upload the chunk
-		err := ls.Callback(chunk)
-		if err != nil {
+		if err := ls.Callback(chunk); err != nil {
+			if chunk.failedAt.IsZero() {
+				chunk.failedAt = time.Now()
+			}
+
+			// Chunks are tried again until they've been failing
+			// for too long, so the log survives the API being
+			// unavailable for a little while
+			if time.Since(chunk.failedAt) < ls.RetryTimeout {
+				logger.Warn("Failed to upload chunk %d, trying it again in %s (%s)", chunk.Order, ls.RetryInterval, err)
+				ls.queue.Unshift(chunk)
+				time.Sleep(ls.RetryInterval)
+				continue
+			}
+
 			atomic.AddInt32(&ls.ChunksFailedCount, 1)
 
 			logger.Error("Giving up on uploading chunk %d, this will result in only a partial build log on Buildkite", chunk.Order)
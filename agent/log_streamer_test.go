@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkSpoolKeepsOrderWhenSpoolingToDisk(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "log-spool-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Only one chunk fits in memory
+	spool := newChunkSpool(10, dir)
+	for i := 1; i <= 5; i++ {
+		spool.Push(&LogStreamerChunk{Data: fmt.Sprintf("chunk%d", i), Order: i})
+	}
+
+	queued, onDisk := spool.Len()
+	assert.Equal(t, 5, queued)
+	assert.Equal(t, 4, onDisk)
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1, "There should be a spool file")
+
+	for i := 1; i <= 5; i++ {
+		chunk, err := spool.Pop()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, i, chunk.Order)
+		assert.Equal(t, fmt.Sprintf("chunk%d", i), chunk.Data)
+	}
+
+	spool.Close()
+
+	chunk, err := spool.Pop()
+	assert.NoError(t, err)
+	assert.Nil(t, chunk, "A closed spool should have no more chunks")
+
+	files, _ = ioutil.ReadDir(dir)
+	assert.Len(t, files, 0, "The spool file should be removed")
+}
+
+func TestLogStreamerTriesFailedChunksAgain(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	failures := 0
+	uploaded := map[int]string{}
+
+	streamer := LogStreamer{
+		MaxChunkSizeBytes: 4,
+		MaxMemoryBytes:    8,
+		SpoolDir:          os.TempDir(),
+		RetryInterval:     time.Millisecond,
+		Callback: func(chunk *LogStreamerChunk) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			// The API is down for the first few uploads
+			if failures < 5 {
+				failures++
+				return errors.New("Service Unavailable")
+			}
+			uploaded[chunk.Order] = chunk.Data
+			return nil
+		},
+	}.New()
+
+	if err := streamer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	streamer.Process("llamasalpacasvicunas")
+	streamer.Stop()
+
+	assert.Equal(t, int32(0), streamer.ChunksFailedCount)
+
+	var log []string
+	for i := 1; i <= len(uploaded); i++ {
+		log = append(log, uploaded[i])
+	}
+	assert.Equal(t, "llamasalpacasvicunas", strings.Join(log, ""))
+}
+
+func TestLogStreamerGivesUpOnChunksThatKeepFailing(t *testing.T) {
+	t.Parallel()
+
+	streamer := LogStreamer{
+		MaxChunkSizeBytes: 100,
+		RetryTimeout:      10 * time.Millisecond,
+		RetryInterval:     time.Millisecond,
+		Callback: func(chunk *LogStreamerChunk) error {
+			return errors.New("Service Unavailable")
+		},
+	}.New()
+
+	if err := streamer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	streamer.Process("llamas")
+	streamer.Stop()
+
+	assert.Equal(t, int32(1), streamer.ChunksFailedCount)
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"strings"
+
+	"github.com/buildkite/agent/metrics"
+)
+
+// The names of metrics that are reported by the processes run for a job, see
+// metrics.Report
+const (
+	JobPhaseDurationMetric = "buildkite_agent_job_phase_duration_seconds"
+	ArtifactBytesMetric    = "buildkite_agent_artifact_bytes_total"
+	HookDurationMetric     = "buildkite_agent_hook_duration_seconds"
+)
+
+// How long jobs waited to be run, which is also published to CloudWatch
+const JobWaitDurationMetric = "buildkite_agent_job_wait_seconds"
+
+// Jobs can take anything from seconds to hours, so phases are bucketed up to
+// a couple of hours
+var jobPhaseBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200}
+
+// Most hooks take seconds, but some install things and take minutes
+var hookBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600}
+
+var (
+	jobsRunning = metrics.NewGauge(
+		"buildkite_agent_jobs_running",
+		"The number of jobs the agent is running")
+
+	jobsCompleted = metrics.NewCounter(
+		"buildkite_agent_jobs_completed_total",
+		"The number of jobs the agent has finished, by the exit status of the job",
+		"exit_status")
+
+	jobDuration = metrics.NewHistogram(
+		"buildkite_agent_job_duration_seconds",
+		"How long jobs took to run, in seconds, by the pipeline, the queue of the agent and the exit status of the job",
+		jobPhaseBuckets,
+		"pipeline", "queue", "exit_status")
+
+	jobWaitDuration = metrics.NewHistogram(
+		JobWaitDurationMetric,
+		"How long jobs waited between being ready to run and being started by the agent, in seconds, by the queue of the agent",
+		jobPhaseBuckets,
+		"queue")
+
+	workersRunning = metrics.NewGauge(
+		"buildkite_agent_workers_running",
+		"The number of workers the agent is running, each of which runs one job at a time")
+
+	utilization = metrics.NewGauge(
+		"buildkite_agent_utilization_ratio",
+		"The fraction of the agent's workers that are running a job")
+
+	jobPhaseDuration = metrics.NewHistogram(
+		JobPhaseDurationMetric,
+		"How long each phase of a job took, in seconds",
+		jobPhaseBuckets,
+		"phase")
+
+	hookDuration = metrics.NewHistogram(
+		HookDurationMetric,
+		"How long each hook of a job took, in seconds, by the hook, where it came from (global, local, overlay or plugin) and its exit status",
+		hookBuckets,
+		"hook", "source", "exit_status")
+
+	artifactBytes = metrics.NewCounter(
+		ArtifactBytesMetric,
+		"The number of bytes of artifacts that have been uploaded or downloaded by jobs",
+		"direction")
+
+	heartbeatDuration = metrics.NewHistogram(
+		"buildkite_agent_heartbeat_duration_seconds",
+		"How long heartbeats took to be sent to Buildkite, in seconds",
+		nil)
+)
+
+// Sets the utilization from the jobs and workers that are running, which is
+// called whenever either of them changes
+func updateUtilization() {
+	workers := workersRunning.Value()
+	if workers <= 0 {
+		utilization.Set(0)
+		return
+	}
+	utilization.Set(jobsRunning.Value() / workers)
+}
+
+// The queue the agent's tags put it on, which is the default queue if they
+// don't say
+func agentQueue(tags []string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, "queue=") {
+			return strings.TrimPrefix(tag, "queue=")
+		}
+	}
+	return "default"
+}
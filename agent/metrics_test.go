@@ -0,0 +1,15 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobsAreTaggedWithTheQueueOfTheAgent(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "deploy", agentQueue([]string{"os=linux", "queue=deploy"}))
+	assert.Equal(t, "default", agentQueue([]string{"os=linux"}))
+	assert.Equal(t, "default", agentQueue(nil))
+}
@@ -0,0 +1,255 @@
+package agent
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/retry"
+)
+
+const (
+	// The default size of each part of a multipart upload. Files smaller
+	// than this are uploaded in one request.
+	DefaultMultipartPartSize = 16 * 1024 * 1024
+)
+
+// ErrMultipartUploadExpired is returned by a MultipartTransport when the
+// upload it's been asked to continue no longer exists on the remote end
+var ErrMultipartUploadExpired = errors.New("Multipart upload no longer exists")
+
+// MultipartTransport is implemented by uploaders that are able to transfer
+// an artifact in separate parts
+type MultipartTransport interface {
+	// A key that uniquely identifies where the artifact is being uploaded
+	// to, used to find the state of a previous upload attempt
+	MultipartKey(*api.Artifact) string
+
+	// Starts a new multipart upload and returns it's id
+	CreateMultipartUpload(*api.Artifact) (string, error)
+
+	// Uploads a single part and returns the identifier the remote end
+	// assigned to it
+	UploadPart(artifact *api.Artifact, uploadID string, partNumber int, body io.ReadSeeker) (string, error)
+
+	// Assembles all the uploaded parts into the final file
+	CompleteMultipartUpload(artifact *api.Artifact, uploadID string, parts []MultipartPart) error
+}
+
+type MultipartPart struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+// The state that's persisted to disk after each part is uploaded so an
+// interrupted upload can carry on where it left off
+type multipartUploadState struct {
+	Key      string          `json:"key"`
+	UploadID string          `json:"upload_id"`
+	Sha1Sum  string          `json:"sha1sum"`
+	FileSize int64           `json:"file_size"`
+	PartSize int64           `json:"part_size"`
+	Parts    []MultipartPart `json:"parts"`
+}
+
+type MultipartUpload struct {
+	// The transport that parts will be sent with
+	Transport MultipartTransport
+
+	// The artifact being uploaded
+	Artifact *api.Artifact
+
+	// The size of each part
+	PartSize int64
+
+	// Where upload state is stored between attempts
+	StateDir string
+
+	// How each part is retried
+	RetryConfig *retry.Config
+}
+
+func (m *MultipartUpload) Upload() error {
+	key := m.Transport.MultipartKey(m.Artifact)
+
+	state, err := m.loadState(key)
+	if err != nil {
+		logger.Warn("Ignoring previous upload state for %s (%s)", m.Artifact.Path, err)
+		state = nil
+	}
+
+	if state == nil {
+		uploadID, err := m.Transport.CreateMultipartUpload(m.Artifact)
+		if err != nil {
+			return err
+		}
+
+		state = &multipartUploadState{
+			Key:      key,
+			UploadID: uploadID,
+			Sha1Sum:  m.Artifact.Sha1Sum,
+			FileSize: m.Artifact.FileSize,
+			PartSize: m.PartSize,
+		}
+
+		if err = m.saveState(state); err != nil {
+			return err
+		}
+	} else {
+		logger.Info("Resuming upload of %s (%d/%d parts already uploaded)",
+			m.Artifact.Path, len(state.Parts), m.partCount(state))
+	}
+
+	f, err := os.Open(m.Artifact.AbsolutePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	uploaded := make(map[int]bool)
+	for _, part := range state.Parts {
+		uploaded[part.Number] = true
+	}
+
+	for number := 1; number <= m.partCount(state); number++ {
+		if uploaded[number] {
+			continue
+		}
+
+		offset := int64(number-1) * state.PartSize
+		size := state.PartSize
+		if offset+size > state.FileSize {
+			size = state.FileSize - offset
+		}
+
+		body := io.NewSectionReader(f, offset, size)
+
+		var etag string
+		err = retry.Do(func(s *retry.Stats) error {
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+
+			var err error
+			etag, err = m.Transport.UploadPart(m.Artifact, state.UploadID, number, body)
+			if err == ErrMultipartUploadExpired {
+				s.Break()
+			} else if err != nil {
+				logger.Warn("Failed to upload part %d of %s: %s (%s)", number, m.Artifact.Path, err, s)
+			}
+
+			return err
+		}, m.retryConfig())
+		if err != nil {
+			return m.fail(state, err)
+		}
+
+		logger.Debug("Uploaded part %d/%d of %s", number, m.partCount(state), m.Artifact.Path)
+
+		state.Parts = append(state.Parts, MultipartPart{Number: number, ETag: etag})
+		if err = m.saveState(state); err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(state.Parts, func(i, j int) bool {
+		return state.Parts[i].Number < state.Parts[j].Number
+	})
+
+	if err = m.Transport.CompleteMultipartUpload(m.Artifact, state.UploadID, state.Parts); err != nil {
+		return m.fail(state, err)
+	}
+
+	return m.removeState(key)
+}
+
+// When the remote end has forgotten about the upload there's no point
+// resuming it, so the state is thrown away and the next attempt starts over
+func (m *MultipartUpload) fail(state *multipartUploadState, err error) error {
+	if err == ErrMultipartUploadExpired {
+		m.removeState(state.Key)
+	}
+
+	return err
+}
+
+func (m *MultipartUpload) partCount(state *multipartUploadState) int {
+	return int((state.FileSize + state.PartSize - 1) / state.PartSize)
+}
+
+func (m *MultipartUpload) retryConfig() *retry.Config {
+	if m.RetryConfig != nil {
+		return m.RetryConfig
+	}
+
+	return &retry.Config{Maximum: 5, Interval: 1 * time.Second, Exponential: true, Jitter: true}
+}
+
+func (m *MultipartUpload) statePath(key string) string {
+	return filepath.Join(m.StateDir, fmt.Sprintf("%x.json", sha1.Sum([]byte(key))))
+}
+
+// Returns the state of a previous attempt at uploading the same file to the
+// same place, or nil if there isn't one that can be resumed
+func (m *MultipartUpload) loadState(key string) (*multipartUploadState, error) {
+	data, err := ioutil.ReadFile(m.statePath(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var state multipartUploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+
+	// The file has changed since the last attempt
+	if state.Key != key ||
+		state.Sha1Sum != m.Artifact.Sha1Sum ||
+		state.FileSize != m.Artifact.FileSize ||
+		state.PartSize != m.PartSize {
+		logger.Debug("Previous upload state for %s is stale", m.Artifact.Path)
+		return nil, nil
+	}
+
+	return &state, nil
+}
+
+func (m *MultipartUpload) saveState(state *multipartUploadState) error {
+	if err := os.MkdirAll(m.StateDir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so an interruption never leaves a
+	// half written state file behind
+	path := m.statePath(state.Key)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func (m *MultipartUpload) removeState(key string) error {
+	err := os.Remove(m.statePath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
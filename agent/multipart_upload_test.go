@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/retry"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMultipartTransport struct {
+	uploads   int
+	parts     map[int]string
+	failParts map[int]bool
+	completed []MultipartPart
+}
+
+func (t *fakeMultipartTransport) MultipartKey(artifact *api.Artifact) string {
+	return "fake://" + artifact.Path
+}
+
+func (t *fakeMultipartTransport) CreateMultipartUpload(artifact *api.Artifact) (string, error) {
+	t.uploads++
+	return fmt.Sprintf("upload-%d", t.uploads), nil
+}
+
+func (t *fakeMultipartTransport) UploadPart(artifact *api.Artifact, uploadID string, partNumber int, body io.ReadSeeker) (string, error) {
+	if t.failParts[partNumber] {
+		return "", errors.New("connection reset by peer")
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+
+	t.parts[partNumber] = string(data)
+	return fmt.Sprintf("etag-%d", partNumber), nil
+}
+
+func (t *fakeMultipartTransport) CompleteMultipartUpload(artifact *api.Artifact, uploadID string, parts []MultipartPart) error {
+	t.completed = parts
+	return nil
+}
+
+func TestMultipartUploadResumesFromSavedState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multipart-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "llamas.txt")
+	if err := ioutil.WriteFile(path, []byte("aaaabbbbccccd"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	artifact := &api.Artifact{Path: "llamas.txt", AbsolutePath: path, FileSize: 13, Sha1Sum: "abc123"}
+	transport := &fakeMultipartTransport{parts: map[int]string{}, failParts: map[int]bool{3: true}}
+
+	upload := MultipartUpload{
+		Transport:   transport,
+		Artifact:    artifact,
+		PartSize:    4,
+		StateDir:    filepath.Join(dir, "state"),
+		RetryConfig: &retry.Config{Maximum: 1},
+	}
+
+	// The first attempt gets interrupted part way through
+	assert.Error(t, upload.Upload())
+	assert.Equal(t, map[int]string{1: "aaaa", 2: "bbbb"}, transport.parts)
+	assert.Nil(t, transport.completed)
+
+	// The second attempt only sends the parts that are left
+	transport.parts = map[int]string{}
+	transport.failParts = map[int]bool{}
+
+	assert.NoError(t, upload.Upload())
+	assert.Equal(t, 1, transport.uploads)
+	assert.Equal(t, map[int]string{3: "cccc", 4: "d"}, transport.parts)
+	assert.Equal(t, []MultipartPart{
+		{Number: 1, ETag: "etag-1"},
+		{Number: 2, ETag: "etag-2"},
+		{Number: 3, ETag: "etag-3"},
+		{Number: 4, ETag: "etag-4"},
+	}, transport.completed)
+
+	// Once it's finished the state is cleaned up
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "state"))
+	assert.Len(t, files, 0)
+}
+
+func TestMultipartUploadStartsOverWhenFileChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multipart-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "llamas.txt")
+	if err := ioutil.WriteFile(path, []byte("aaaabbbb"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	artifact := &api.Artifact{Path: "llamas.txt", AbsolutePath: path, FileSize: 8, Sha1Sum: "abc123"}
+	transport := &fakeMultipartTransport{parts: map[int]string{}, failParts: map[int]bool{2: true}}
+
+	upload := MultipartUpload{
+		Transport:   transport,
+		Artifact:    artifact,
+		PartSize:    4,
+		StateDir:    filepath.Join(dir, "state"),
+		RetryConfig: &retry.Config{Maximum: 1},
+	}
+
+	assert.Error(t, upload.Upload())
+
+	artifact.Sha1Sum = "def456"
+	transport.failParts = map[int]bool{}
+
+	assert.NoError(t, upload.Upload())
+	assert.Equal(t, 2, transport.uploads)
+	assert.Len(t, transport.completed, 2)
+}
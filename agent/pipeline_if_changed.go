@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	zglob "github.com/mattn/go-zglob"
+)
+
+// PipelineUsesIfChanged returns whether any of the pipeline's steps only run
+// when certain files change, so the changes only need to be found if they do
+func PipelineUsesIfChanged(pipeline interface{}) bool {
+	for _, step := range pipelineSteps(pipeline) {
+		if s, ok := step.(map[string]interface{}); ok {
+			if _, ok := s["if_changed"]; ok {
+				return true
+			}
+			if PipelineUsesIfChanged(s["steps"]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FilterPipelineIfChanged removes the steps with if_changed globs that none of
+// the changed files match, and returns the pipeline along with the labels of
+// the steps that were removed. Groups are filtered by their own globs as well
+// as their steps'. If changed is nil, because the changes aren't known, every
+// step is kept. The if_changed globs are removed from the steps that are kept,
+// as they're only used by the agent.
+func FilterPipelineIfChanged(pipeline interface{}, changed []string) (interface{}, []string, error) {
+	f := &ifChangedFilter{changed: changed}
+
+	switch p := pipeline.(type) {
+	case map[string]interface{}:
+		steps, ok := p["steps"].([]interface{})
+		if !ok {
+			return pipeline, nil, nil
+		}
+
+		filtered, err := f.filterSteps("steps", steps)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		copied := map[string]interface{}{}
+		for k, v := range p {
+			copied[k] = v
+		}
+		copied["steps"] = filtered
+		return copied, f.removed, nil
+	case []interface{}:
+		filtered, err := f.filterSteps("steps", p)
+		if err != nil {
+			return nil, nil, err
+		}
+		return filtered, f.removed, nil
+	default:
+		return pipeline, nil, nil
+	}
+}
+
+type ifChangedFilter struct {
+	changed []string
+	removed []string
+}
+
+func (f *ifChangedFilter) filterSteps(path string, steps []interface{}) ([]interface{}, error) {
+	filtered := []interface{}{}
+
+	for i, step := range steps {
+		s, ok := step.(map[string]interface{})
+		if !ok {
+			filtered = append(filtered, step)
+			continue
+		}
+
+		stepPath := fmt.Sprintf("%s[%d]", path, i)
+
+		keep, err := f.matches(stepPath, s["if_changed"])
+		if err != nil {
+			return nil, err
+		}
+		if !keep {
+			f.removed = append(f.removed, stepLabel(stepPath, s))
+			continue
+		}
+
+		copied := map[string]interface{}{}
+		for k, v := range s {
+			if k != "if_changed" {
+				copied[k] = v
+			}
+		}
+
+		if groupSteps, ok := s["steps"].([]interface{}); ok {
+			if copied["steps"], err = f.filterSteps(stepPath+".steps", groupSteps); err != nil {
+				return nil, err
+			}
+		}
+
+		filtered = append(filtered, copied)
+	}
+
+	return filtered, nil
+}
+
+// Returns whether any of the changed files match the globs
+func (f *ifChangedFilter) matches(path string, value interface{}) (bool, error) {
+	if value == nil {
+		return true, nil
+	}
+
+	var globs []string
+	switch v := value.(type) {
+	case string:
+		globs = []string{v}
+	case []interface{}:
+		for _, glob := range v {
+			s, ok := glob.(string)
+			if !ok {
+				return false, fmt.Errorf("%s.if_changed needs to be a glob, or a list of them", path)
+			}
+			globs = append(globs, s)
+		}
+	default:
+		return false, fmt.Errorf("%s.if_changed needs to be a glob, or a list of them", path)
+	}
+
+	for _, glob := range globs {
+		// Globs are relative to the root of the repository, and a directory
+		// matches everything in it
+		glob = strings.TrimPrefix(glob, "/")
+		if strings.HasSuffix(glob, "/") {
+			glob += "**/*"
+		} else if strings.HasSuffix(glob, "/**") {
+			glob += "/*"
+		}
+
+		for _, file := range f.changed {
+			matched, err := zglob.Match(glob, file)
+			if err != nil {
+				return false, fmt.Errorf("%s.if_changed has an invalid glob %q (%v)", path, glob, err)
+			}
+			if matched {
+				return true, nil
+			}
+		}
+	}
+
+	// The changes aren't known, so the step has to be kept to be safe
+	return f.changed == nil, nil
+}
+
+// ChangedFiles returns the files that have changed in the repository in dir
+// since it diverged from base, relative to the repository's root
+func ChangedFiles(dir string, base string) ([]string, error) {
+	cmd := exec.Command("git", "diff", "--name-only", "--no-renames", base+"...HEAD")
+	cmd.Dir = dir
+
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			message := strings.SplitN(strings.TrimSpace(string(exitErr.Stderr)), "\n", 2)[0]
+			return nil, fmt.Errorf("Failed to find the files changed since %s (%s)", base, message)
+		}
+		return nil, fmt.Errorf("Failed to find the files changed since %s (%v)", base, err)
+	}
+
+	changed := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			changed = append(changed, line)
+		}
+	}
+	return changed, nil
+}
+
+// Returns the steps of a pipeline, in either of it's formats
+func pipelineSteps(pipeline interface{}) []interface{} {
+	switch p := pipeline.(type) {
+	case map[string]interface{}:
+		steps, _ := p["steps"].([]interface{})
+		return steps
+	case []interface{}:
+		return p
+	default:
+		return nil
+	}
+}
+
+// Returns how a step is described in the logs
+func stepLabel(path string, step map[string]interface{}) string {
+	for _, field := range []string{"label", "name", "group", "key"} {
+		if label, ok := step[field].(string); ok && label != "" {
+			return label
+		}
+	}
+	return path
+}
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterPipelineIfChanged(t *testing.T) {
+	pipeline, err := PipelineParser{Filename: "pipeline.yml", Pipeline: []byte(`steps:
+  - label: Always
+    command: make lint
+  - label: Frontend
+    command: make frontend
+    if_changed: "web/**"
+  - label: Backend
+    command: make backend
+    if_changed:
+      - "**/*.go"
+      - go.mod
+  - group: Docs
+    if_changed: docs/
+    steps:
+      - command: make docs
+  - group: Services
+    steps:
+      - label: Billing
+        command: make billing
+        if_changed: services/billing/
+      - label: Search
+        command: make search
+        if_changed: services/search/
+`)}.Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.True(t, PipelineUsesIfChanged(pipeline))
+
+	filtered, removed, err := FilterPipelineIfChanged(pipeline, []string{"cmd/agent/main.go", "services/search/index.rb"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, []string{"Frontend", "Docs", "Billing"}, removed)
+
+	j, _ := json.Marshal(filtered)
+	assert.Equal(t, `{"steps":[{"command":"make lint","label":"Always"},{"command":"make backend","label":"Backend"},{"group":"Services","steps":[{"command":"make search","label":"Search"}]}]}`, string(j))
+}
+
+func TestFilterPipelineIfChangedKeepsEverythingWhenTheChangesArentKnown(t *testing.T) {
+	pipeline := []interface{}{
+		map[string]interface{}{"command": "make", "if_changed": "web/**"},
+	}
+
+	filtered, removed, err := FilterPipelineIfChanged(pipeline, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+	assert.Equal(t, []interface{}{map[string]interface{}{"command": "make"}}, filtered)
+}
+
+func TestFilterPipelineIfChangedChecksTheGlobs(t *testing.T) {
+	pipeline := []interface{}{
+		map[string]interface{}{"command": "make", "if_changed": 1.0},
+	}
+
+	_, _, err := FilterPipelineIfChanged(pipeline, []string{"main.go"})
+	assert.EqualError(t, err, "steps[0].if_changed needs to be a glob, or a list of them")
+}
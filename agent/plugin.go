@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -27,10 +28,17 @@ type Plugin struct {
 
 	// Configuration for the plugin
 	Configuration map[string]interface{}
+
+	// The expected sha256 checksum of the plugin's files once checked out
+	Sha256 string
 }
 
 var locationSchemeRegex = regexp.MustCompile(`^[a-z\+]+://`)
 
+var commitShaRegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+var imageDigestRegex = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
 func CreatePlugin(location string, config map[string]interface{}) (*Plugin, error) {
 	plugin := &Plugin{Configuration: config}
 
@@ -51,6 +59,21 @@ func CreatePlugin(location string, config map[string]interface{}) (*Plugin, erro
 		plugin.Authentication = u.User.String()
 	}
 
+	// OCI plugins are versioned with a tag or digest, the same as images
+	if plugin.IsOCI() {
+		if plugin.Version != "" {
+			return nil, fmt.Errorf("OCI plugins are versioned with a :tag or @digest, not a # in \"%s\"", location)
+		}
+
+		if i := strings.LastIndex(plugin.Location, "@"); i != -1 {
+			plugin.Version = plugin.Location[i+1:]
+			plugin.Location = plugin.Location[:i]
+		} else if i := strings.LastIndex(plugin.Location, ":"); i > strings.LastIndex(plugin.Location, "/") {
+			plugin.Version = plugin.Location[i+1:]
+			plugin.Location = plugin.Location[:i]
+		}
+	}
+
 	return plugin, nil
 }
 
@@ -85,6 +108,20 @@ func CreatePluginsFromJSON(j string) ([]*Plugin, error) {
 			}
 			plugins = append(plugins, plugin)
 		case map[string]interface{}:
+			// A checksum can be given alongside the plugin, i.e.
+			// {"foo#v1.0.0": {...}, "sha256": "..."}
+			var sha256 string
+			if checksum, ok := vv["sha256"]; ok {
+				if sha256, ok = checksum.(string); !ok {
+					return nil, fmt.Errorf("The sha256 for a plugin must be a string")
+				}
+				delete(vv, "sha256")
+
+				if len(vv) != 1 {
+					return nil, fmt.Errorf("A sha256 can only be given alongside a single plugin")
+				}
+			}
+
 			for location, config := range vv {
 				// Ensure the config is a hash
 				config, ok := config.(map[string]interface{})
@@ -97,6 +134,7 @@ func CreatePluginsFromJSON(j string) ([]*Plugin, error) {
 				if err != nil {
 					return nil, err
 				}
+				plugin.Sha256 = sha256
 				plugins = append(plugins, plugin)
 			}
 		default:
@@ -107,6 +145,24 @@ func CreatePluginsFromJSON(j string) ([]*Plugin, error) {
 	return plugins, nil
 }
 
+// Whether the plugin's version is an exact commit, rather than a branch or
+// tag that could be moved
+func (p *Plugin) IsPinnedToCommit() bool {
+	return !p.IsOCI() && commitShaRegex.MatchString(p.Version)
+}
+
+// Whether the plugin is distributed as an OCI image rather than a git
+// repository, i.e. oci://ghcr.io/my-org/my-plugin:1.2.0
+func (p *Plugin) IsOCI() bool {
+	return p.Scheme == "oci"
+}
+
+// Whether an OCI plugin's version is a digest, rather than a tag that could
+// be moved
+func (p *Plugin) IsPinnedToDigest() bool {
+	return p.IsOCI() && imageDigestRegex.MatchString(p.Version)
+}
+
 // Returns the name of the plugin
 func (p *Plugin) Name() string {
 	if p.Location != "" {
@@ -137,6 +193,11 @@ func (p *Plugin) Identifier() (string, error) {
 	id = removeDoubleUnderscore.ReplaceAllString(id, "-")
 	id = strings.Trim(id, "-")
 
+	// Keep OCI plugins apart from git plugins at the same location
+	if p.IsOCI() {
+		id = "oci-" + id
+	}
+
 	return id, nil
 }
 
@@ -164,6 +225,67 @@ func (p *Plugin) Repository() (string, error) {
 	return s, nil
 }
 
+// Whether the plugin's repository URL (without any authentication) matches
+// any of the glob patterns. A * matches within a single path segment, and a
+// ** matches across them, i.e. "https://github.com/my-org/*"
+func (p *Plugin) MatchesAny(patterns []string) (bool, error) {
+	repository, err := p.constructRepositoryHost()
+	if err != nil {
+		return false, err
+	}
+
+	if !strings.HasPrefix(repository, "/") {
+		if p.Scheme != "" {
+			repository = p.Scheme + "://" + repository
+		} else {
+			repository = "https://" + repository
+		}
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		re, err := globToRegexp(pattern)
+		if err != nil {
+			return false, err
+		}
+
+		if re.MatchString(repository) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var expr bytes.Buffer
+	expr.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				expr.WriteString(".*")
+				i++
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	expr.WriteString("$")
+
+	return regexp.Compile(expr.String())
+}
+
 // Returns the subdirectory path that the plugin is in
 func (p *Plugin) RepositorySubdirectory() (string, error) {
 	repository, err := p.constructRepositoryHost()
@@ -226,7 +348,12 @@ func (p *Plugin) ConfigurationToEnvironment() (*env.Environment, error) {
 
 // Pretty name for the plugin
 func (p *Plugin) Label() string {
-	if p.Version != "" {
+	if p.IsOCI() && strings.Contains(p.Version, ":") {
+		// Tags can't contain a colon, so this is a digest
+		return p.Location + "@" + p.Version
+	} else if p.IsOCI() && p.Version != "" {
+		return p.Location + ":" + p.Version
+	} else if p.Version != "" {
 		return p.Location + "#" + p.Version
 	} else {
 		return p.Location
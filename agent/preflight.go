@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The failure reason of jobs that the agent's machine couldn't run, so they
+// can be retried on another agent rather than counted against the job
+const failureReasonInfrastructure = "infrastructure"
+
+// How long the Docker daemon has to answer before the job fails
+var preflightDockerTimeout = 30 * time.Second
+
+// Checks the agent's machine can run the job before it starts, so it fails
+// straight away with what's wrong rather than part way through checking out.
+// It checks there's enough disk free on the build path, that the binaries the
+// agent needs are installed, and that Docker is running if the job uses it.
+func (r *JobRunner) preflightChecks() error {
+	// Jobs run in Kubernetes don't use this machine
+	if r.AgentConfiguration.JobExecutor == JobExecutorKubernetes {
+		return nil
+	}
+
+	var problems []string
+
+	if min := r.AgentConfiguration.PreflightMinDiskSpace; min > 0 {
+		path := existingParent(r.AgentConfiguration.BuildPath)
+
+		free, err := freeDiskSpace(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("The free disk space on %s couldn't be checked (%v)", path, err))
+		} else if free < uint64(min)*1024*1024 {
+			problems = append(problems, fmt.Sprintf("There's %d MB free on %s, and the agent needs at least %d MB", free/1024/1024, path, min))
+		}
+	}
+
+	for _, binary := range r.AgentConfiguration.PreflightRequiredBinaries {
+		if binary = strings.TrimSpace(binary); binary == "" {
+			continue
+		}
+		if _, err := exec.LookPath(binary); err != nil {
+			problems = append(problems, fmt.Sprintf("%s isn't installed", binary))
+		}
+	}
+
+	if r.AgentConfiguration.PreflightDocker && jobUsesDocker(r.Job.Env) {
+		if err := checkDocker(); err != nil {
+			problems = append(problems, fmt.Sprintf("The job uses Docker, which isn't running (%v)", err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("This agent can't run the job: %s", strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// Returns whether the job uses Docker, either with a Docker plugin or the
+// older BUILDKITE_DOCKER variables
+func jobUsesDocker(env map[string]string) bool {
+	for name := range env {
+		if strings.HasPrefix(name, "BUILDKITE_DOCKER") {
+			return true
+		}
+	}
+
+	if env["BUILDKITE_PLUGINS"] == "" {
+		return false
+	}
+
+	plugins, err := CreatePluginsFromJSON(env["BUILDKITE_PLUGINS"])
+	if err != nil {
+		return false
+	}
+
+	for _, plugin := range plugins {
+		if strings.Contains(plugin.Name(), "docker") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns an error if the Docker daemon doesn't answer
+func checkDocker() error {
+	ctx, cancel := context.WithTimeout(context.Background(), preflightDockerTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "docker", "version", "--format", "{{.Server.Version}}").CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("it didn't answer within %s", preflightDockerTimeout)
+	} else if err != nil {
+		if message := strings.TrimSpace(string(output)); message != "" {
+			return fmt.Errorf("%s", message)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Returns the path, or the closest directory above it that exists, since the
+// build path is created by the first job that's run
+func existingParent(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreflightChecks(t *testing.T) {
+	t.Parallel()
+
+	dir := os.TempDir()
+
+	r := &JobRunner{
+		AgentConfiguration: &AgentConfiguration{
+			BuildPath:                 filepath.Join(dir, "buildkite-builds-that-dont-exist-yet"),
+			PreflightMinDiskSpace:     1,
+			PreflightRequiredBinaries: []string{"go"},
+		},
+		Job: &api.Job{Env: map[string]string{}},
+	}
+	assert.NoError(t, r.preflightChecks())
+
+	r.AgentConfiguration.PreflightMinDiskSpace = 1 << 40
+	r.AgentConfiguration.PreflightRequiredBinaries = []string{"go", "llama-that-isnt-installed"}
+
+	err := r.preflightChecks()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "the agent needs at least 1099511627776 MB")
+		assert.Contains(t, err.Error(), "llama-that-isnt-installed isn't installed")
+	}
+
+	// The machine isn't checked for jobs that are run in Kubernetes
+	r.AgentConfiguration.JobExecutor = JobExecutorKubernetes
+	assert.NoError(t, r.preflightChecks())
+}
+
+func TestJobUsesDocker(t *testing.T) {
+	t.Parallel()
+
+	assert.False(t, jobUsesDocker(map[string]string{}))
+	assert.False(t, jobUsesDocker(map[string]string{"BUILDKITE_PLUGINS": `[{"github.com/buildkite-plugins/llamas-buildkite-plugin#v1.0.0":{}}]`}))
+	assert.True(t, jobUsesDocker(map[string]string{"BUILDKITE_PLUGINS": `[{"github.com/buildkite-plugins/docker-compose-buildkite-plugin#v3.0.0":{"run":"app"}}]`}))
+	assert.True(t, jobUsesDocker(map[string]string{"BUILDKITE_DOCKER_COMPOSE_CONTAINER": "app"}))
+	assert.False(t, jobUsesDocker(map[string]string{"BUILDKITE_PLUGINS": `not json`}))
+}
+
+func TestFailureReasonOfFailedPreflightChecks(t *testing.T) {
+	t.Parallel()
+
+	r := &JobRunner{Job: &api.Job{ID: "llamas"}, preflightFailed: true}
+	assert.Equal(t, failureReasonInfrastructure, r.failureReason())
+}
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"fmt"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Removes the variables whose names match any of the glob patterns from the
+// environment, returning the names that were removed. Names aren't case
+// sensitive on Windows, so neither are the patterns.
+func removeProtectedEnv(env map[string]string, patterns []string) []string {
+	var removed []string
+	for name := range env {
+		if isProtectedEnv(name, patterns) {
+			removed = append(removed, name)
+			delete(env, name)
+		}
+	}
+
+	sort.Strings(removed)
+	return removed
+}
+
+func isProtectedEnv(name string, patterns []string) bool {
+	if runtime.GOOS == "windows" {
+		name = strings.ToUpper(name)
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if runtime.GOOS == "windows" {
+			pattern = strings.ToUpper(pattern)
+		}
+
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Says which protected variables the job tried to set, which fails the job if
+// the agent is configured to
+func (r *JobRunner) checkProtectedEnv() error {
+	if len(r.protectedEnvRemoved) == 0 {
+		return nil
+	}
+
+	names := strings.Join(r.protectedEnvRemoved, ", ")
+	r.log("start").Warn("Job %s tried to set protected environment variables: %s", r.Job.ID, names)
+
+	if r.AgentConfiguration.ProtectedEnvFatal {
+		return fmt.Errorf("The job can't set these environment variables, which are protected on this agent: %s", names)
+	}
+
+	r.logStreamer.Process(fmt.Sprintf("\033[33m⚠️ Warning: These environment variables are protected on this agent, so they've been removed from the job: %s\033[0m\n", names))
+	return nil
+}
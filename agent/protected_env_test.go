@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveProtectedEnv(t *testing.T) {
+	t.Parallel()
+
+	env := map[string]string{
+		"AWS_ACCESS_KEY_ID":     "llamas",
+		"AWS_SECRET_ACCESS_KEY": "alpacas",
+		"LD_PRELOAD":            "/tmp/evil.so",
+		"BUILDKITE_BRANCH":      "main",
+		"MY_AWS_REGION":         "us-east-1",
+	}
+
+	removed := removeProtectedEnv(env, []string{"AWS_*", " LD_PRELOAD "})
+
+	assert.Equal(t, []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "LD_PRELOAD"}, removed)
+	assert.Equal(t, map[string]string{"BUILDKITE_BRANCH": "main", "MY_AWS_REGION": "us-east-1"}, env)
+}
+
+func TestRemoveProtectedEnvWithoutPatterns(t *testing.T) {
+	t.Parallel()
+
+	env := map[string]string{"LD_PRELOAD": "/tmp/evil.so"}
+
+	assert.Empty(t, removeProtectedEnv(env, nil))
+	assert.Equal(t, map[string]string{"LD_PRELOAD": "/tmp/evil.so"}, env)
+}
+
+func TestCreateEnvironmentRemovesProtectedEnv(t *testing.T) {
+	t.Parallel()
+
+	runner := &JobRunner{
+		Agent:              &api.Agent{},
+		AgentConfiguration: &AgentConfiguration{ProtectedEnv: []string{"AWS_*", "BUILDKITE_AGENT_*"}},
+		Job:                &api.Job{Env: map[string]string{"AWS_PROFILE": "prod", "BUILDKITE_AGENT_ACCESS_TOKEN": "fake"}},
+	}
+
+	env := runner.createEnvironment()
+
+	assert.Equal(t, []string{"AWS_PROFILE", "BUILDKITE_AGENT_ACCESS_TOKEN"}, runner.protectedEnvRemoved)
+	assert.NotContains(t, env, "AWS_PROFILE=prod")
+	assert.NotContains(t, env, "BUILDKITE_AGENT_ACCESS_TOKEN=fake")
+
+	// The agent's own variables are still set
+	assert.Contains(t, env, "BUILDKITE_AGENT_ACCESS_TOKEN=")
+}
@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+)
+
+// What the values of secrets are replaced with in the job's log
+const RedactedValue = "[REDACTED]"
+
+// Values shorter than this are too likely to appear in the log by accident,
+// i.e. "true" or "1234", to be worth redacting
+const minRedactedValueLength = 6
+
+// Redactor replaces the values of secrets in a job's output before it's
+// uploaded. Output is redacted as it's streamed, so anything at the end of the
+// output that could be the start of a secret is held back until the rest of
+// it has been written.
+type Redactor struct {
+	// The values being redacted, longest first so that a secret containing
+	// another is redacted as a whole
+	secrets []string
+
+	// Output that's been held back from the last call to Redact
+	held string
+}
+
+// Creates a redactor for the values of the environment variables whose names
+// match any of the glob patterns, i.e. "*_TOKEN". The environment is a slice
+// of KEY=value strings.
+func NewRedactor(patterns []string, environ []string) *Redactor {
+	seen := map[string]bool{}
+	secrets := []string{}
+
+	for _, pair := range environ {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || len(parts[1]) < minRedactedValueLength || seen[parts[1]] {
+			continue
+		}
+
+		if isRedactedVar(patterns, parts[0]) {
+			secrets = append(secrets, parts[1])
+			seen[parts[1]] = true
+		}
+	}
+
+	r := &Redactor{secrets: secrets}
+	r.sort()
+
+	return r
+}
+
+// Returns whether the environment variable's name matches one of the patterns
+// of the ones that are redacted
+func isRedactedVar(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.TrimSpace(pattern), name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Add redacts more values, i.e. secrets fetched for the job once it's started.
+// Values that are too short to be worth redacting are skipped, and returned so
+// they can be warned about.
+func (r *Redactor) Add(values ...string) []string {
+	var skipped []string
+
+	for _, value := range values {
+		if len(value) < minRedactedValueLength {
+			if value != "" {
+				skipped = append(skipped, value)
+			}
+			continue
+		}
+		if r.secretAt(value) == value {
+			continue
+		}
+		r.secrets = append(r.secrets, value)
+	}
+
+	r.sort()
+
+	return skipped
+}
+
+// Keeps the values longest first
+func (r *Redactor) sort() {
+	sort.SliceStable(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+}
+
+// Redact returns the output with any secrets replaced, minus anything at the
+// end that could be the start of a secret
+func (r *Redactor) Redact(output string) string {
+	return r.redact(output, false)
+}
+
+// Flush returns what was held back from the last call to Redact, once there's
+// no more output to come
+func (r *Redactor) Flush() string {
+	return r.redact("", true)
+}
+
+func (r *Redactor) redact(output string, final bool) string {
+	text := r.held + output
+	r.held = ""
+
+	if len(r.secrets) == 0 {
+		return text
+	}
+
+	var redacted bytes.Buffer
+
+	for i := 0; i < len(text); {
+		if secret := r.secretAt(text[i:]); secret != "" {
+			redacted.WriteString(RedactedValue)
+			i += len(secret)
+			continue
+		}
+
+		// Wait for more output if a secret might start here
+		if !final && r.isPartialSecret(text[i:]) {
+			r.held = text[i:]
+			break
+		}
+
+		redacted.WriteByte(text[i])
+		i++
+	}
+
+	return redacted.String()
+}
+
+// Returns the longest secret that the text starts with
+func (r *Redactor) secretAt(text string) string {
+	for _, secret := range r.secrets {
+		if strings.HasPrefix(text, secret) {
+			return secret
+		}
+	}
+	return ""
+}
+
+// Whether the text is the start of a secret, but not the whole thing
+func (r *Redactor) isPartialSecret(text string) bool {
+	for _, secret := range r.secrets {
+		if len(text) < len(secret) && strings.HasPrefix(secret, text) {
+			return true
+		}
+	}
+	return false
+}
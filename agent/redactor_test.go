@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactorMatchesVariableNames(t *testing.T) {
+	t.Parallel()
+
+	r := NewRedactor([]string{"*_TOKEN", "*_SECRET"}, []string{
+		"GITHUB_TOKEN=abc123def",
+		"MY_SECRET=llamas-are-great",
+		"MY_TOKEN=short",
+		"BUILDKITE_BRANCH=master-branch",
+	})
+
+	assert.Equal(t,
+		"token [REDACTED] secret [REDACTED] short master-branch",
+		r.Redact("token abc123def secret llamas-are-great short master-branch")+r.Flush())
+}
+
+func TestRedactorHandlesSecretsSplitAcrossOutput(t *testing.T) {
+	t.Parallel()
+
+	r := NewRedactor([]string{"*_TOKEN"}, []string{"GITHUB_TOKEN=abc123def"})
+
+	// Every way of splitting the output should redact the secret
+	output := "before abc123def after abc123"
+	for i := 0; i <= len(output); i++ {
+		redacted := r.Redact(output[:i]) + r.Redact(output[i:]) + r.Flush()
+		assert.Equal(t, "before [REDACTED] after abc123", redacted, "split at %d", i)
+	}
+}
+
+func TestRedactorPrefersLongerSecrets(t *testing.T) {
+	t.Parallel()
+
+	r := NewRedactor([]string{"*_SECRET"}, []string{"A_SECRET=secret-value", "B_SECRET=secret-value-longer"})
+
+	assert.Equal(t, "[REDACTED] and [REDACTED]", r.Redact("secret-value-longer and secret-value")+r.Flush())
+}
+
+func TestRedactorAddsValues(t *testing.T) {
+	t.Parallel()
+
+	r := NewRedactor([]string{"*_SECRET"}, []string{"A_SECRET=secret-value"})
+
+	assert.Equal(t, []string{"1234"}, r.Add("secret-value-longer", "1234", "", "secret-value"))
+	assert.Equal(t, "[REDACTED] and [REDACTED] and 1234", r.Redact("secret-value-longer and secret-value and 1234")+r.Flush())
+}
+
+func TestLogStreamerRedactsChunks(t *testing.T) {
+	t.Parallel()
+
+	var uploaded []*LogStreamerChunk
+
+	ls := LogStreamer{
+		MaxChunkSizeBytes: 1024,
+		Redactor:          NewRedactor([]string{"*_TOKEN"}, []string{"GITHUB_TOKEN=abc123def"}),
+		Callback: func(chunk *LogStreamerChunk) error {
+			uploaded = append(uploaded, chunk)
+			return nil
+		},
+	}.New()
+	ls.Concurrency = 1
+
+	if err := ls.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	ls.Process("token abc")
+	ls.Process("token abc123def done")
+	ls.Stop()
+
+	var log []string
+	offset := 0
+	for _, chunk := range uploaded {
+		assert.Equal(t, offset, chunk.Offset)
+		offset += len(chunk.Data)
+		log = append(log, chunk.Data)
+	}
+
+	assert.Equal(t, "token [REDACTED] done", strings.Join(log, ""))
+}
@@ -0,0 +1,19 @@
+// +build !windows
+
+package agent
+
+import (
+	"os"
+	"syscall"
+)
+
+// Restart replaces the agent's process with its binary, which may have been
+// updated since it started, run with the same arguments and environment
+func Restart() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	return syscall.Exec(executable, os.Args, os.Environ())
+}
@@ -0,0 +1,27 @@
+package agent
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Restart starts the agent's binary, which may have been updated since it
+// started, with the same arguments and environment, then exits. Windows
+// can't replace a running process with another.
+func Restart() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	os.Exit(0)
+	return nil
+}
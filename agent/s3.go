@@ -3,7 +3,9 @@ package agent
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -46,11 +48,135 @@ func (e *credentialsProvider) IsExpired() bool {
 	return !e.retrieved
 }
 
-func awsS3RegionFromEnv() (region string, err error) {
+// How artifacts are stored in S3. The options can be set in the query string
+// of the destination, i.e. s3://my-bucket/path?sse=aws:kms&acl=private, which
+// wins over the environment variables for them.
+type s3Options struct {
+	// The canned ACL objects are uploaded with, or none for buckets that
+	// have ACLs disabled because the bucket owner owns all the objects
+	ACL string
+
+	// The server-side encryption, either AES256 or aws:kms, and the KMS key
+	// to encrypt with if it isn't the bucket's default
+	SSE      string
+	KMSKeyID string
+
+	// An S3-compatible service to use instead of AWS, i.e. MinIO or Ceph
+	// RGW, and whether buckets are in the path of the URL instead of the
+	// hostname
+	Endpoint  string
+	PathStyle bool
+}
+
+// The canned ACLs S3 supports
+var s3ACLs = map[string]bool{
+	"private":                   true,
+	"public-read":               true,
+	"public-read-write":         true,
+	"authenticated-read":        true,
+	"bucket-owner-read":         true,
+	"bucket-owner-full-control": true,
+}
+
+// Splits the query string off an S3 destination, and returns the options
+// from it and the environment
+func parseS3Destination(destination string) (string, s3Options, error) {
+	var query url.Values
+	if i := strings.Index(destination, "?"); i >= 0 {
+		var err error
+		if query, err = url.ParseQuery(destination[i+1:]); err != nil {
+			return "", s3Options{}, fmt.Errorf("Invalid S3 destination options %q (%v)", destination[i+1:], err)
+		}
+		destination = destination[:i]
+	}
+
+	option := func(key string, envs ...string) string {
+		if v := query.Get(key); v != "" {
+			return v
+		}
+		for _, env := range envs {
+			if v := os.Getenv(env); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	options := s3Options{
+		ACL:      option("acl", "BUILDKITE_S3_ACL", "AWS_S3_ACL"),
+		SSE:      option("sse", "BUILDKITE_S3_SSE"),
+		KMSKeyID: option("kms_key_id", "BUILDKITE_S3_SSE_KMS_KEY_ID"),
+		Endpoint: option("endpoint", "BUILDKITE_S3_ENDPOINT"),
+	}
+
+	if options.ACL == "" {
+		options.ACL = "public-read"
+	}
+	if options.ACL != "none" && !s3ACLs[options.ACL] {
+		return "", s3Options{}, fmt.Errorf("Invalid S3 ACL `%s`", options.ACL)
+	}
+
+	switch strings.ToLower(options.SSE) {
+	case "":
+		if options.KMSKeyID != "" {
+			options.SSE = s3.ServerSideEncryptionAwsKms
+		}
+	case "aes256":
+		options.SSE = s3.ServerSideEncryptionAes256
+	case "aws:kms", "kms":
+		options.SSE = s3.ServerSideEncryptionAwsKms
+	default:
+		return "", s3Options{}, fmt.Errorf("Invalid S3 server-side encryption `%s`, expected AES256 or aws:kms", options.SSE)
+	}
+	if options.KMSKeyID != "" && options.SSE != s3.ServerSideEncryptionAwsKms {
+		return "", s3Options{}, errors.New("A KMS key can only be used with aws:kms server-side encryption")
+	}
+
+	if options.Endpoint != "" {
+		if !strings.Contains(options.Endpoint, "://") {
+			options.Endpoint = "https://" + options.Endpoint
+		}
+		if u, err := url.Parse(options.Endpoint); err != nil || u.Host == "" {
+			return "", s3Options{}, fmt.Errorf("Invalid S3 endpoint %q", options.Endpoint)
+		}
+		options.Endpoint = strings.TrimSuffix(options.Endpoint, "/")
+	}
+
+	switch strings.ToLower(option("path_style", "BUILDKITE_S3_FORCE_PATH_STYLE")) {
+	case "true", "1", "on":
+		options.PathStyle = true
+	}
+
+	return destination, options, nil
+}
+
+// The base URL of the bucket
+func (o s3Options) bucketURL(bucket string) string {
+	if o.Endpoint == "" {
+		return "https://" + bucket + ".s3.amazonaws.com"
+	}
+	if o.PathStyle {
+		return o.Endpoint + "/" + bucket
+	}
+
+	u, _ := url.Parse(o.Endpoint)
+	u.Host = bucket + "." + u.Host
+	return strings.TrimSuffix(u.String(), "/")
+}
+
+// The ACL to upload objects with, which is left out if it's none
+func (o s3Options) acl() *string {
+	if o.ACL == "none" {
+		return nil
+	}
+	return aws.String(o.ACL)
+}
+
+func awsS3RegionFromEnv(options s3Options) (region string, err error) {
 	regionName := "us-east-1"
 	if os.Getenv("BUILDKITE_S3_DEFAULT_REGION") != "" {
 		regionName = os.Getenv("BUILDKITE_S3_DEFAULT_REGION")
-	} else {
+	} else if options.Endpoint == "" {
 		var err error
 		regionName, err = awsRegion()
 		if err != nil {
@@ -58,6 +184,12 @@ func awsS3RegionFromEnv() (region string, err error) {
 		}
 	}
 
+	// S3-compatible services can have regions AWS doesn't, and don't
+	// usually care which one is used
+	if options.Endpoint != "" {
+		return regionName, nil
+	}
+
 	// Check to make sure the region exists.
 	resolver := endpoints.DefaultResolver()
 	partitions := resolver.(endpoints.EnumPartitions).Partitions()
@@ -73,7 +205,7 @@ func awsS3RegionFromEnv() (region string, err error) {
 	return "", fmt.Errorf("Unknown AWS S3 Region %q", regionName)
 }
 
-func awsS3Session(region string) (*session.Session, error) {
+func awsS3Session(region string, options s3Options) (*session.Session, error) {
 	// Chicken and egg... but this is kinda how they do it in the sdk
 	sess, err := session.NewSession()
 	if err != nil {
@@ -82,6 +214,11 @@ func awsS3Session(region string) (*session.Session, error) {
 
 	sess.Config.Region = aws.String(region)
 
+	if options.Endpoint != "" {
+		sess.Config.Endpoint = aws.String(options.Endpoint)
+	}
+	sess.Config.S3ForcePathStyle = aws.Bool(options.PathStyle)
+
 	sess.Config.Credentials = credentials.NewChainCredentials(
 		[]credentials.Provider{
 			&credentialsProvider{},
@@ -93,18 +230,22 @@ func awsS3Session(region string) (*session.Session, error) {
 	return sess, nil
 }
 
-func newS3Client(bucket string) (*s3.S3, error) {
-	region, err := awsS3RegionFromEnv()
+func newS3Client(bucket string, options s3Options) (*s3.S3, error) {
+	region, err := awsS3RegionFromEnv(options)
 	if err != nil {
 		return nil, err
 	}
 
-	sess, err := awsS3Session(region)
+	sess, err := awsS3Session(region, options)
 	if err != nil {
 		return nil, err
 	}
 
-	logger.Debug("Authorizing S3 credentials and finding bucket `%s` in region `%s`...", bucket, region)
+	if options.Endpoint != "" {
+		logger.Debug("Authorizing S3 credentials and finding bucket `%s` at %s...", bucket, options.Endpoint)
+	} else {
+		logger.Debug("Authorizing S3 credentials and finding bucket `%s` in region `%s`...", bucket, region)
+	}
 
 	s3client := s3.New(sess)
 
@@ -26,25 +26,27 @@ type S3Downloader struct {
 
 	// If failed responses should be dumped to the log
 	DebugHTTP bool
+
+	// The checksums recorded when the file was uploaded
+	Sha1Sum   string
+	Sha256Sum string
+
+	// Whether a missing SHA256 checksum should fail the download, as well
+	// as a mismatched one, which always does
+	Verify bool
+
+	// How the file was compressed when it was uploaded, and whether it's a
+	// tar of a directory
+	Compression string
+	Archived    bool
 }
 
 func (d S3Downloader) Start() error {
-	// Initialize the s3 client, and authenticate it
-	s3Client, err := newS3Client(d.BucketName())
+	signedURL, err := d.SignedURL()
 	if err != nil {
 		return err
 	}
 
-	req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
-		Bucket: aws.String(d.BucketName()),
-		Key:    aws.String(d.BucketFileLocation()),
-	})
-
-	signedURL, err := req.Presign(time.Hour)
-	if err != nil {
-		return fmt.Errorf("error pre-signing request: %v", err)
-	}
-
 	// We can now cheat and pass the URL onto our regular downloader
 	return Download{
 		Client:      *http.DefaultClient,
@@ -53,9 +55,43 @@ func (d S3Downloader) Start() error {
 		Destination: d.Destination,
 		Retries:     d.Retries,
 		DebugHTTP:   d.DebugHTTP,
+		Sha1Sum:     d.Sha1Sum,
+		Sha256Sum:   d.Sha256Sum,
+		Verify:      d.Verify,
+		Compression: d.Compression,
+		Archived:    d.Archived,
 	}.Start()
 }
 
+// SignedURL returns a URL the artifact can be downloaded with for the next
+// hour, without any credentials
+func (d S3Downloader) SignedURL() (string, error) {
+	// The destination it was uploaded to can have options for the endpoint
+	bucket, options, err := parseS3Destination(d.Bucket)
+	if err != nil {
+		return "", err
+	}
+	d.Bucket = bucket
+
+	// Initialize the s3 client, and authenticate it
+	s3Client, err := newS3Client(d.BucketName(), options)
+	if err != nil {
+		return "", err
+	}
+
+	req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(d.BucketName()),
+		Key:    aws.String(d.BucketFileLocation()),
+	})
+
+	signedURL, err := req.Presign(time.Hour)
+	if err != nil {
+		return "", fmt.Errorf("error pre-signing request: %v", err)
+	}
+
+	return signedURL, nil
+}
+
 func (d S3Downloader) BucketFileLocation() string {
 	if d.BucketPath() != "" {
 		return strings.TrimSuffix(d.BucketPath(), "/") + "/" + strings.TrimPrefix(d.Path, "/")
@@ -2,12 +2,14 @@ package agent
 
 import (
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/buildkite/agent/api"
@@ -23,16 +25,24 @@ type S3Uploader struct {
 	// Whether or not HTTP calls should be debugged
 	DebugHTTP bool
 
+	// How the artifacts are stored, from the destination's query string and
+	// the environment
+	options s3Options
+
 	// The aws s3 client
 	s3Client *s3.S3
 }
 
 func (u *S3Uploader) Setup(destination string, debugHTTP bool) error {
-	u.Destination = destination
+	var err error
 	u.DebugHTTP = debugHTTP
+	u.Destination, u.options, err = parseS3Destination(destination)
+	if err != nil {
+		return err
+	}
 
 	// Initialize the s3 client, and authenticate it
-	s3Client, err := newS3Client(u.BucketName())
+	s3Client, err := newS3Client(u.BucketName(), u.options)
 	if err != nil {
 		return err
 	}
@@ -42,7 +52,7 @@ func (u *S3Uploader) Setup(destination string, debugHTTP bool) error {
 }
 
 func (u *S3Uploader) URL(artifact *api.Artifact) string {
-	baseUrl := "https://" + u.BucketName() + ".s3.amazonaws.com"
+	baseUrl := u.options.bucketURL(u.BucketName())
 
 	if os.Getenv("BUILDKITE_S3_ACCESS_URL") != "" {
 		baseUrl = os.Getenv("BUILDKITE_S3_ACCESS_URL")
@@ -50,31 +60,14 @@ func (u *S3Uploader) URL(artifact *api.Artifact) string {
 
 	url, _ := url.Parse(baseUrl)
 
-	url.Path += u.artifactPath(artifact)
+	url.Path = strings.TrimSuffix(url.Path, "/") + "/" + u.artifactPath(artifact)
 
 	return url.String()
 }
 
 func (u *S3Uploader) Upload(artifact *api.Artifact) error {
-	permission := "public-read"
-	if os.Getenv("BUILDKITE_S3_ACL") != "" {
-		permission = os.Getenv("BUILDKITE_S3_ACL")
-	} else if os.Getenv("AWS_S3_ACL") != "" {
-		permission = os.Getenv("AWS_S3_ACL")
-	}
-
-	// The dirtiest validation method ever...
-	if permission != "private" &&
-		permission != "public-read" &&
-		permission != "public-read-write" &&
-		permission != "authenticated-read" &&
-		permission != "bucket-owner-read" &&
-		permission != "bucket-owner-full-control" {
-		return fmt.Errorf("Invalid S3 ACL `%s`", permission)
-	}
-
 	// Initialize the s3 client, and authenticate it
-	s3Client, err := newS3Client(u.BucketName())
+	s3Client, err := newS3Client(u.BucketName(), u.options)
 	if err != nil {
 		return err
 	}
@@ -88,6 +81,7 @@ func (u *S3Uploader) Upload(artifact *api.Artifact) error {
 	if err != nil {
 		return fmt.Errorf("failed to open file %q (%v)", artifact.AbsolutePath, err)
 	}
+	defer f.Close()
 
   var contentEncoding *string
   
@@ -97,19 +91,108 @@ func (u *S3Uploader) Upload(artifact *api.Artifact) error {
 	}
   
 	// Upload the file to S3.
-	logger.Debug("Uploading \"%s\" to bucket with permission `%s`", u.artifactPath(artifact), permission)
+	logger.Debug("Uploading \"%s\" to bucket with permission `%s`", u.artifactPath(artifact), u.options.ACL)
 	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket:               aws.String(u.BucketName()),
+		Key:                  aws.String(u.artifactPath(artifact)),
+		ContentType:          aws.String(u.mimeType(artifact)),
+    ContentEncoding:      contentEncoding,
+		ACL:                  u.options.acl(),
+		ServerSideEncryption: u.serverSideEncryption(),
+		SSEKMSKeyId:          u.kmsKeyID(),
+		Body:                 f,
+	})
+
+	return err
+}
+
+func (u *S3Uploader) MultipartKey(artifact *api.Artifact) string {
+	return "s3://" + u.BucketName() + "/" + u.artifactPath(artifact)
+}
+
+func (u *S3Uploader) CreateMultipartUpload(artifact *api.Artifact) (string, error) {
+	var contentEncoding *string
+	if ce := u.contentEncoding(artifact); ce != "" {
+		contentEncoding = aws.String(ce)
+	}
+
+	logger.Debug("Starting multipart upload of \"%s\" to bucket with permission `%s`", u.artifactPath(artifact), u.options.ACL)
+	output, err := u.s3Client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(u.BucketName()),
+		Key:                  aws.String(u.artifactPath(artifact)),
+		ContentType:          aws.String(u.mimeType(artifact)),
+		ContentEncoding:      contentEncoding,
+		ACL:                  u.options.acl(),
+		ServerSideEncryption: u.serverSideEncryption(),
+		SSEKMSKeyId:          u.kmsKeyID(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return *output.UploadId, nil
+}
+
+func (u *S3Uploader) UploadPart(artifact *api.Artifact, uploadID string, partNumber int, body io.ReadSeeker) (string, error) {
+	output, err := u.s3Client.UploadPart(&s3.UploadPartInput{
+		Bucket:     aws.String(u.BucketName()),
+		Key:        aws.String(u.artifactPath(artifact)),
+		UploadId:   aws.String(uploadID),
+		PartNumber: aws.Int64(int64(partNumber)),
+		Body:       body,
+	})
+	if err != nil {
+		return "", u.multipartError(err)
+	}
+
+	return *output.ETag, nil
+}
+
+func (u *S3Uploader) CompleteMultipartUpload(artifact *api.Artifact, uploadID string, parts []MultipartPart) error {
+	completed := []*s3.CompletedPart{}
+	for _, part := range parts {
+		completed = append(completed, &s3.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int64(int64(part.Number)),
+		})
+	}
+
+	_, err := u.s3Client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
 		Bucket:          aws.String(u.BucketName()),
 		Key:             aws.String(u.artifactPath(artifact)),
-		ContentType:     aws.String(u.mimeType(artifact)),
-    ContentEncoding: contentEncoding,
-		ACL:             aws.String(permission),
-		Body:            f,
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
 	})
 
+	return u.multipartError(err)
+}
+
+// S3 forgets about multipart uploads that are aborted or cleaned up by a
+// bucket lifecycle rule, in which case the upload needs to start again
+func (u *S3Uploader) multipartError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+		return ErrMultipartUploadExpired
+	}
+
 	return err
 }
 
+// The server-side encryption objects are uploaded with, if there is any
+func (u *S3Uploader) serverSideEncryption() *string {
+	if u.options.SSE == "" {
+		return nil
+	}
+	return aws.String(u.options.SSE)
+}
+
+// The KMS key objects are encrypted with, if it isn't the bucket's default
+func (u *S3Uploader) kmsKeyID() *string {
+	if u.options.KMSKeyID == "" {
+		return nil
+	}
+	return aws.String(u.options.KMSKeyID)
+}
+
 func (u *S3Uploader) artifactPath(artifact *api.Artifact) string {
 	parts := []string{u.BucketPath(), artifact.Path}
 
@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"os"
 	"testing"
 
 	"github.com/buildkite/agent/api"
@@ -31,3 +32,65 @@ func TestS3UploaderContentEncoding(t *testing.T) {
 	gzipArtifact := api.Artifact{Path: "foo/bar/thing.csv.gz"}
 	assert.Equal(t, s3Uploader.contentEncoding(&gzipArtifact), "gzip")
 }
+
+func TestParseS3DestinationOptions(t *testing.T) {
+	destination, options, err := parseS3Destination("s3://my-bucket/foo?acl=bucket-owner-full-control&sse=aws:kms&kms_key_id=alias/artifacts")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3://my-bucket/foo", destination)
+	assert.Equal(t, s3Options{ACL: "bucket-owner-full-control", SSE: "aws:kms", KMSKeyID: "alias/artifacts"}, options)
+
+	_, options, err = parseS3Destination("s3://my-bucket/foo?kms_key_id=alias/artifacts")
+	assert.NoError(t, err)
+	assert.Equal(t, "aws:kms", options.SSE)
+
+	_, options, err = parseS3Destination("s3://my-bucket/foo?sse=aes256&acl=none")
+	assert.NoError(t, err)
+	assert.Equal(t, "AES256", options.SSE)
+	assert.Nil(t, options.acl())
+
+	destination, options, err = parseS3Destination("s3://my-bucket")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3://my-bucket", destination)
+	assert.Equal(t, s3Options{ACL: "public-read"}, options)
+	assert.Equal(t, "public-read", *options.acl())
+
+	for _, invalid := range []string{
+		"s3://my-bucket?acl=everyone",
+		"s3://my-bucket?sse=rot13",
+		"s3://my-bucket?sse=AES256&kms_key_id=alias/artifacts",
+		"s3://my-bucket?endpoint=http://",
+		"s3://my-bucket?%zz",
+	} {
+		_, _, err := parseS3Destination(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseS3DestinationOptionsFromEnvironment(t *testing.T) {
+	os.Setenv("BUILDKITE_S3_SSE", "aws:kms")
+	os.Setenv("BUILDKITE_S3_ENDPOINT", "minio.example.com:9000")
+	os.Setenv("BUILDKITE_S3_FORCE_PATH_STYLE", "true")
+	defer os.Unsetenv("BUILDKITE_S3_SSE")
+	defer os.Unsetenv("BUILDKITE_S3_ENDPOINT")
+	defer os.Unsetenv("BUILDKITE_S3_FORCE_PATH_STYLE")
+
+	_, options, err := parseS3Destination("s3://my-bucket/foo?sse=AES256")
+	assert.NoError(t, err)
+	assert.Equal(t, s3Options{ACL: "public-read", SSE: "AES256", Endpoint: "https://minio.example.com:9000", PathStyle: true}, options)
+}
+
+func TestS3UploaderURL(t *testing.T) {
+	artifact := &api.Artifact{Path: "llamas.txt"}
+
+	for destination, expected := range map[string]string{
+		"s3://my-bucket/foo": "https://my-bucket.s3.amazonaws.com/foo/llamas.txt",
+		"s3://my-bucket/foo?endpoint=http://minio.local:9000/&path_style=true": "http://minio.local:9000/my-bucket/foo/llamas.txt",
+		"s3://my-bucket/foo?endpoint=https://rgw.example.com":                  "https://my-bucket.rgw.example.com/foo/llamas.txt",
+	} {
+		u := S3Uploader{}
+		var err error
+		u.Destination, u.options, err = parseS3Destination(destination)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, u.URL(artifact), destination)
+	}
+}
@@ -0,0 +1,608 @@
+package agent
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Where the agent finds its releases, like install.sh does
+const DefaultReleasesURL = "https://buildkite.com/agent/releases"
+
+// The releases the agent can be updated to when it isn't pinned to a version
+const (
+	SelfUpdateChannelStable = "stable"
+	SelfUpdateChannelBeta   = "beta"
+)
+
+// ErrRestart is returned from the pool's Start once its workers have stopped
+// for the agent to be restarted, so the new binary is run
+var ErrRestart = errors.New("The agent is restarting")
+
+// SelfUpdater replaces the agent's binary with a release, once it's checked
+// that the release's SHA256SUMS are signed with the verification key and
+// that the download matches them. The key is either a minisign public key or
+// a cosign public key, and nothing is replaced without it.
+//
+// Fleets can roll out a release to some of their agents first by updating
+// CanaryPercentage of them to CanaryVersion, and the rest to Version. Which
+// agents are in the canary is decided by the hash of their name, so the same
+// agents are always in it, and more join as the percentage is raised.
+//
+// The releases URL can only say where a release is, not which one the agent
+// is updated to. The release has to be the version the agent asked for, and
+// the signed checksums have to be of that version's download. When the agent
+// isn't pinned to a version it's never updated to an older one than it's
+// running.
+type SelfUpdater struct {
+	ReleasesURL      string
+	Version          string
+	Channel          string
+	CanaryVersion    string
+	CanaryPercentage int
+	Name             string
+	VerificationKey  string
+
+	// The binary that's replaced, which defaults to the running one
+	Executable string
+
+	client *http.Client
+}
+
+// A release for this machine's platform and architecture
+type selfUpdateRelease struct {
+	Version   string
+	Filename  string
+	URL       string
+	Checksums string
+}
+
+// Update downloads, verifies and installs the release, and returns its
+// version and whether it was installed, which it isn't if the agent is
+// already running it
+func (u *SelfUpdater) Update() (string, bool, error) {
+	version, err := u.install()
+	if err == errUpToDate {
+		return version, false, nil
+	}
+	return version, err == nil, err
+}
+
+var errUpToDate = errors.New("The agent is up to date")
+
+// Returns the version the agent is updated to, which is the canary's if it's
+// one of the agents in the canary
+func (u *SelfUpdater) version() string {
+	if u.CanaryVersion != "" && inCanary(u.Name, u.CanaryPercentage) {
+		logger.Info("%s is one of the %d%% of agents in the canary, so it's updated to %s", u.Name, u.CanaryPercentage, u.CanaryVersion)
+		return u.CanaryVersion
+	}
+	return u.Version
+}
+
+// Returns whether the agent is one of the percentage of agents in the
+// canary, which is the same for an agent name every time
+func inCanary(name string, percentage int) bool {
+	hash := sha256.Sum256([]byte(name))
+	return int(binary.BigEndian.Uint32(hash[:4])%100) < percentage
+}
+
+// Installs the release, or returns errUpToDate when there's nothing to install
+func (u *SelfUpdater) install() (string, error) {
+	key, err := ioutil.ReadFile(u.VerificationKey)
+	if err != nil {
+		return "", fmt.Errorf("The verification key couldn't be read (%v)", err)
+	}
+
+	verifier, err := newReleaseVerifier(key)
+	if err != nil {
+		return "", fmt.Errorf("The verification key in %s couldn't be read (%v)", u.VerificationKey, err)
+	}
+
+	version := u.version()
+	release, err := u.findRelease(version)
+	if err != nil {
+		return "", err
+	}
+
+	if release.Version == Version() {
+		return release.Version, errUpToDate
+	}
+
+	if version != "" && release.Version != version {
+		return "", fmt.Errorf("The releases URL said %s is %s", version, release.Version)
+	}
+	if version == "" && versionLess(release.Version, Version()) {
+		return "", fmt.Errorf("The latest release is %s, which is older than %s", release.Version, Version())
+	}
+
+	// The filename is what's looked up in the signed checksums, so it has
+	// to be exactly this version's for this platform for them to say the
+	// archive is the binary to install
+	if expected := releaseFilename(release.Version); release.Filename != expected {
+		return "", fmt.Errorf("%s isn't the filename of %s, which is %s", release.Filename, release.Version, expected)
+	}
+
+	sums, err := u.get(release.Checksums)
+	if err != nil {
+		return "", fmt.Errorf("The checksums of %s couldn't be downloaded (%v)", release.Version, err)
+	}
+
+	signature, err := u.get(release.Checksums + verifier.extension())
+	if err != nil {
+		return "", fmt.Errorf("The signature of the checksums of %s couldn't be downloaded (%v)", release.Version, err)
+	}
+
+	if err := verifier.verify(sums, signature); err != nil {
+		return "", fmt.Errorf("The checksums of %s aren't signed with the verification key (%v)", release.Version, err)
+	}
+
+	expected, err := checksumOf(sums, release.Filename)
+	if err != nil {
+		return "", err
+	}
+
+	archive, err := u.download(release.URL, expected)
+	if err != nil {
+		return "", fmt.Errorf("%s couldn't be downloaded (%v)", release.Filename, err)
+	}
+	defer os.Remove(archive)
+
+	executable := u.Executable
+	if executable == "" {
+		if executable, err = os.Executable(); err != nil {
+			return "", err
+		}
+		if executable, err = filepath.EvalSymlinks(executable); err != nil {
+			return "", err
+		}
+	}
+
+	if err := installFromArchive(archive, release.Filename, executable); err != nil {
+		return "", fmt.Errorf("%s couldn't be installed (%v)", release.Version, err)
+	}
+
+	return release.Version, nil
+}
+
+// Asks where the release is, which is answered with key=value lines
+func (u *SelfUpdater) findRelease(version string) (*selfUpdateRelease, error) {
+	if version == "" {
+		version = "latest"
+	}
+
+	query := url.Values{}
+	query.Set("platform", runtime.GOOS)
+	query.Set("arch", releaseArch())
+	if u.Channel == SelfUpdateChannelBeta {
+		query.Set("prerelease", "true")
+	}
+
+	data, err := u.get(strings.TrimSuffix(u.ReleasesURL, "/") + "/" + url.PathEscape(version) + "?" + query.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("The %s release couldn't be found (%v)", version, err)
+	}
+
+	info := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if parts := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2); len(parts) == 2 {
+			info[parts[0]] = parts[1]
+		}
+	}
+
+	release := &selfUpdateRelease{
+		Version:   info["version"],
+		Filename:  info["filename"],
+		URL:       info["url"],
+		Checksums: info["checksums"],
+	}
+	if release.Version == "" || release.Filename == "" || release.URL == "" {
+		return nil, fmt.Errorf("The %s release couldn't be found", version)
+	}
+
+	// The checksums are published next to the releases
+	if release.Checksums == "" {
+		parsed, err := url.Parse(release.URL)
+		if err != nil {
+			return nil, err
+		}
+		parsed.Path = path.Join(path.Dir(parsed.Path), "SHA256SUMS")
+		parsed.RawQuery = ""
+		release.Checksums = parsed.String()
+	}
+
+	return release, nil
+}
+
+// Returns whether version a is older than b. Versions are compared by each
+// of their dot separated numbers, then a prerelease like 3.0-beta.35 is older
+// than its release and compared by the numbers in it.
+func versionLess(a string, b string) bool {
+	aRelease, aPrerelease := splitVersion(a)
+	bRelease, bPrerelease := splitVersion(b)
+
+	if c := compareVersionParts(aRelease, bRelease); c != 0 {
+		return c < 0
+	}
+
+	switch {
+	case aPrerelease == "" || bPrerelease == "":
+		return aPrerelease != "" && bPrerelease == ""
+	default:
+		return compareVersionParts(aPrerelease, bPrerelease) < 0
+	}
+}
+
+func splitVersion(version string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), "-", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// Compares dot separated parts, numerically when they're both numbers
+func compareVersionParts(a string, b string) int {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		aPart, bPart := "0", "0"
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+		if aPart == bPart {
+			continue
+		}
+
+		aNumber, aErr := strconv.Atoi(aPart)
+		bNumber, bErr := strconv.Atoi(bPart)
+		if aErr != nil || bErr != nil {
+			return strings.Compare(aPart, bPart)
+		}
+		if aNumber < bNumber {
+			return -1
+		}
+		return 1
+	}
+
+	return 0
+}
+
+// Returns the filename of the version's release for this platform, like
+// buildkite-agent-linux-amd64-3.1.tar.gz
+func releaseFilename(version string) string {
+	extension := ".tar.gz"
+	if runtime.GOOS == "windows" {
+		extension = ".zip"
+	}
+	return fmt.Sprintf("buildkite-agent-%s-%s-%s%s", runtime.GOOS, releaseArch(), version, extension)
+}
+
+// The architectures are named like install.sh names them
+func releaseArch() string {
+	switch runtime.GOARCH {
+	case "arm":
+		return "armhf"
+	default:
+		return runtime.GOARCH
+	}
+}
+
+func (u *SelfUpdater) httpClient() *http.Client {
+	if u.client == nil {
+		u.client = &http.Client{Timeout: 5 * time.Minute}
+	}
+	return u.client
+}
+
+func (u *SelfUpdater) get(address string) ([]byte, error) {
+	resp, err := u.httpClient().Get(address)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Downloads to a temporary file, which is removed again unless its checksum
+// is the expected one
+func (u *SelfUpdater) download(address string, checksum string) (string, error) {
+	resp, err := u.httpClient().Get(address)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("%s", resp.Status)
+	}
+
+	file, err := ioutil.TempFile("", "buildkite-agent-release")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), resp.Body); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != checksum {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("Its SHA256 is %s, and the checksums say it's %s", actual, checksum)
+	}
+
+	return file.Name(), nil
+}
+
+// Returns the checksum of the file in the output of sha256sum
+func checksumOf(sums []byte, filename string) (string, error) {
+	for _, line := range strings.Split(string(sums), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == filename {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+
+	return "", fmt.Errorf("The checksums don't include %s", filename)
+}
+
+// Extracts the binary from the archive next to the executable, then renames
+// it over the executable so nothing ever runs a half written binary
+func installFromArchive(archive string, filename string, executable string) error {
+	name := "buildkite-agent"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+
+	replacement, err := ioutil.TempFile(filepath.Dir(executable), ".buildkite-agent-update")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(replacement.Name())
+
+	if strings.HasSuffix(filename, ".zip") {
+		err = extractFromZip(archive, name, replacement)
+	} else {
+		err = extractFromTarGz(archive, name, replacement)
+	}
+	if closeErr := replacement.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(replacement.Name(), 0755); err != nil {
+		return err
+	}
+
+	// Windows can't replace a binary that's running, but it can rename
+	// it out of the way
+	if runtime.GOOS == "windows" {
+		old := executable + ".old"
+		os.Remove(old)
+		if err := os.Rename(executable, old); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(replacement.Name(), executable)
+}
+
+func extractFromTarGz(archive string, name string, w io.Writer) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("There's no %s in the release", name)
+		} else if err != nil {
+			return err
+		}
+
+		if path.Base(header.Name) == name && header.Typeflag == tar.TypeReg {
+			_, err := io.Copy(w, tr)
+			return err
+		}
+	}
+}
+
+func extractFromZip(archive string, name string, w io.Writer) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if path.Base(f.Name) != name {
+			continue
+		}
+
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		_, err = io.Copy(w, r)
+		return err
+	}
+
+	return fmt.Errorf("There's no %s in the release", name)
+}
+
+// Checks the signature of the checksums, either made by minisign or cosign
+type releaseVerifier interface {
+	extension() string
+	verify(message []byte, signature []byte) error
+}
+
+// Reads a minisign public key, or a cosign one, which is a PEM file
+func newReleaseVerifier(key []byte) (releaseVerifier, error) {
+	if block, _ := pem.Decode(key); block != nil {
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		public, ok := parsed.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, errors.New("cosign keys need to be ECDSA keys")
+		}
+		return &cosignVerifier{key: public}, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(lastLine(key))
+	if err != nil || len(data) != 42 || string(data[:2]) != "Ed" {
+		return nil, errors.New("it's neither a minisign public key nor a PEM file")
+	}
+
+	return &minisignVerifier{keyID: data[2:10], key: ed25519.PublicKey(data[10:])}, nil
+}
+
+// Returns the last line that isn't empty or a comment, which is the key in
+// minisign's files
+func lastLine(data []byte) string {
+	var last string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "untrusted comment:") {
+			last = line
+		}
+	}
+	return last
+}
+
+type minisignVerifier struct {
+	keyID []byte
+	key   ed25519.PublicKey
+}
+
+func (v *minisignVerifier) extension() string {
+	return ".minisig"
+}
+
+// Checks the signature of the message, then the signature of the trusted
+// comment, which is over the first signature and the comment. The signature
+// is either of the message itself, which `minisign -S -l` makes, or of it's
+// BLAKE2b hash, which minisign makes by default.
+func (v *minisignVerifier) verify(message []byte, signature []byte) error {
+	lines := strings.Split(strings.TrimSpace(string(signature)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return errors.New("it isn't a minisign signature")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sig) != 74 {
+		return errors.New("it isn't a minisign signature")
+	}
+
+	switch string(sig[:2]) {
+	case "Ed":
+	case "ED":
+		hash := blake2b.Sum512(message)
+		message = hash[:]
+	default:
+		return fmt.Errorf("its algorithm %q is unknown", sig[:2])
+	}
+
+	if !bytes.Equal(sig[2:10], v.keyID) {
+		return errors.New("it was signed with another key")
+	}
+
+	if !ed25519.Verify(v.key, message, sig[10:]) {
+		return errors.New("the signature doesn't match")
+	}
+
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return errors.New("the signature of the trusted comment is invalid")
+	}
+
+	comment := strings.TrimPrefix(strings.TrimRight(lines[2], "\r"), "trusted comment: ")
+	if !ed25519.Verify(v.key, append(append([]byte{}, sig[10:]...), comment...), global) {
+		return errors.New("the signature of the trusted comment doesn't match")
+	}
+
+	return nil
+}
+
+type cosignVerifier struct {
+	key *ecdsa.PublicKey
+}
+
+func (v *cosignVerifier) extension() string {
+	return ".sig"
+}
+
+// Checks the signature `cosign sign-blob` prints, which is the base64 of the
+// ASN.1 ECDSA signature of the SHA256 of the message
+func (v *cosignVerifier) verify(message []byte, signature []byte) error {
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return errors.New("it isn't a cosign signature")
+	}
+
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return errors.New("it isn't a cosign signature")
+	}
+
+	hash := sha256.Sum256(message)
+	if !ecdsa.Verify(v.key, hash[:], sig.R, sig.S) {
+		return errors.New("the signature doesn't match")
+	}
+
+	return nil
+}
@@ -0,0 +1,316 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Serves a release like the releases API and download site would
+type fakeReleases struct {
+	files map[string][]byte
+}
+
+func (f *fakeReleases) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if data, ok := f.files[r.URL.Path]; ok {
+		w.Write(data)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func newFakeRelease(t *testing.T, binary string) ([]byte, string) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "buildkite-agent", Mode: 0755, Size: int64(len(binary)), Typeflag: tar.TypeReg}))
+	tw.Write([]byte(binary))
+	tw.Close()
+	gz.Close()
+
+	hash := sha256.Sum256(buf.Bytes())
+	return buf.Bytes(), hex.EncodeToString(hash[:])
+}
+
+// Signs like `minisign -S -l` does
+func minisign(public ed25519.PublicKey, private ed25519.PrivateKey, message []byte) ([]byte, []byte) {
+	keyID := []byte("llamas!!")
+
+	publicKey := fmt.Sprintf("untrusted comment: minisign public key\n%s\n",
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID...), public...)))
+
+	sig := ed25519.Sign(private, message)
+	comment := "timestamp:1234567890\tfile:SHA256SUMS"
+	global := ed25519.Sign(private, append(append([]byte{}, sig...), comment...))
+
+	signature := fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID...), sig...)),
+		comment,
+		base64.StdEncoding.EncodeToString(global))
+
+	return []byte(publicKey), []byte(signature)
+}
+
+// Updates to the latest release, which the releases URL says is the version
+// with the filename
+func testSelfUpdate(t *testing.T, key []byte, files map[string][]byte, version string, filename string) (string, error) {
+	dir, err := ioutil.TempDir("", "self-update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := filepath.Join(dir, "release.pub")
+	executable := filepath.Join(dir, "buildkite-agent")
+	assert.NoError(t, ioutil.WriteFile(keyPath, key, 0600))
+	assert.NoError(t, ioutil.WriteFile(executable, []byte("old"), 0755))
+
+	server := httptest.NewServer(&fakeReleases{files: files})
+	defer server.Close()
+
+	files["/releases/latest"] = []byte(fmt.Sprintf("version=%s\nfilename=%s\nurl=%s/downloads/%[2]s\n", version, filename, server.URL))
+
+	updater := &SelfUpdater{ReleasesURL: server.URL + "/releases", VerificationKey: keyPath, Executable: executable}
+	if _, updated, err := updater.Update(); err != nil {
+		return "", err
+	} else if !updated {
+		return "", fmt.Errorf("Expected the agent to be updated")
+	}
+
+	data, err := ioutil.ReadFile(executable)
+	assert.NoError(t, err)
+	return string(data), nil
+}
+
+func TestSelfUpdateWithMinisign(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Releases for Windows are zip files")
+	}
+
+	t.Parallel()
+
+	archive, checksum := newFakeRelease(t, "new")
+	filename := fmt.Sprintf("buildkite-agent-%s-%s-3.1.tar.gz", runtime.GOOS, releaseArch())
+	sums := []byte(fmt.Sprintf("%s  %s\n", checksum, filename))
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	key, signature := minisign(public, private, sums)
+
+	binary, err := testSelfUpdate(t, key, map[string][]byte{
+		"/downloads/" + filename:        archive,
+		"/downloads/SHA256SUMS":         sums,
+		"/downloads/SHA256SUMS.minisig": signature,
+	}, "3.1", filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "new", binary)
+
+	// Checksums signed by another key aren't trusted
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := minisign(other, private, sums)
+
+	_, err = testSelfUpdate(t, otherKey, map[string][]byte{
+		"/downloads/" + filename:        archive,
+		"/downloads/SHA256SUMS":         sums,
+		"/downloads/SHA256SUMS.minisig": signature,
+	}, "3.1", filename)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "aren't signed with the verification key")
+	}
+
+	// Nor are downloads that don't match them
+	tampered, _ := newFakeRelease(t, "tampered")
+	_, err = testSelfUpdate(t, key, map[string][]byte{
+		"/downloads/" + filename:        tampered,
+		"/downloads/SHA256SUMS":         sums,
+		"/downloads/SHA256SUMS.minisig": signature,
+	}, "3.1", filename)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "the checksums say it's "+checksum)
+	}
+}
+
+func TestSelfUpdateWithCosign(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Releases for Windows are zip files")
+	}
+
+	t.Parallel()
+
+	archive, checksum := newFakeRelease(t, "new")
+	filename := fmt.Sprintf("buildkite-agent-%s-%s-3.1.tar.gz", runtime.GOOS, releaseArch())
+	sums := []byte(fmt.Sprintf("%s  %s\n", checksum, filename))
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	assert.NoError(t, err)
+	key := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	hash := sha256.Sum256(sums)
+	r, s, err := ecdsa.Sign(rand.Reader, private, hash[:])
+	assert.NoError(t, err)
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	assert.NoError(t, err)
+
+	binary, err := testSelfUpdate(t, key, map[string][]byte{
+		"/downloads/" + filename:    archive,
+		"/downloads/SHA256SUMS":     sums,
+		"/downloads/SHA256SUMS.sig": []byte(base64.StdEncoding.EncodeToString(sig)),
+	}, "3.1", filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "new", binary)
+}
+
+func TestMinisignSignaturesOfMessagesAndTheirHashes(t *testing.T) {
+	t.Parallel()
+
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	key, signature := minisign(public, private, []byte("llamas"))
+
+	verifier, err := newReleaseVerifier(key)
+	assert.NoError(t, err)
+	assert.NoError(t, verifier.verify([]byte("llamas"), signature))
+	assert.Error(t, verifier.verify([]byte("alpacas"), signature))
+
+	// Signed like `minisign -S` does by default, which is of the hash
+	hash := blake2b.Sum512([]byte("llamas"))
+	_, prehashed := minisign(public, private, hash[:])
+	prehashed = bytes.Replace(prehashed, []byte("\nRWR"), []byte("\nRUR"), 1)
+	assert.NoError(t, verifier.verify([]byte("llamas"), prehashed))
+	assert.Error(t, verifier.verify([]byte("alpacas"), prehashed))
+
+	// The hash's signature isn't taken to be one of the message
+	assert.Error(t, verifier.verify(hash[:], prehashed))
+}
+
+func TestSelfUpdateOnlyInstallsTheReleaseItAskedFor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Releases for Windows are zip files")
+	}
+
+	t.Parallel()
+
+	archive, checksum := newFakeRelease(t, "old")
+	filename := fmt.Sprintf("buildkite-agent-%s-%s-2.6.tar.gz", runtime.GOOS, releaseArch())
+	sums := []byte(fmt.Sprintf("%s  %s\n", checksum, filename))
+
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	key, signature := minisign(public, private, sums)
+
+	files := map[string][]byte{
+		"/downloads/" + filename:        archive,
+		"/downloads/SHA256SUMS":         sums,
+		"/downloads/SHA256SUMS.minisig": signature,
+	}
+
+	// An old release's signed checksums don't make it the latest
+	_, err := testSelfUpdate(t, key, files, "3.1", filename)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "isn't the filename of 3.1")
+	}
+
+	// Nor is the agent downgraded to it
+	_, err = testSelfUpdate(t, key, files, "2.6", filename)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "older than")
+	}
+}
+
+func TestSelfUpdateOnlyInstallsThisPlatformsRelease(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Releases for Windows are zip files")
+	}
+
+	t.Parallel()
+
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	archive, checksum := newFakeRelease(t, "other")
+
+	for _, filename := range []string{
+		"buildkite-agent-plan9-mips-3.1.tar.gz",
+		fmt.Sprintf("buildkite-agent-%s-%s-3.1.2.tar.gz", runtime.GOOS, releaseArch()),
+		fmt.Sprintf("buildkite-agent-%s-%s-3.1.zip", runtime.GOOS, releaseArch()),
+	} {
+		sums := []byte(fmt.Sprintf("%s  %s\n", checksum, filename))
+		key, signature := minisign(public, private, sums)
+
+		// Another platform's or version's archive is signed too, but
+		// isn't this one's
+		_, err := testSelfUpdate(t, key, map[string][]byte{
+			"/downloads/" + filename:        archive,
+			"/downloads/SHA256SUMS":         sums,
+			"/downloads/SHA256SUMS.minisig": signature,
+		}, "3.1", filename)
+		if assert.Error(t, err, filename) {
+			assert.Contains(t, err.Error(), "isn't the filename of 3.1", filename)
+		}
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	t.Parallel()
+
+	for _, versions := range [][2]string{
+		{"2.6", "3.0"},
+		{"3.0-beta.35", "3.0"},
+		{"3.0-beta.9", "3.0-beta.35"},
+		{"3.0-alpha.1", "3.0-beta.1"},
+		{"3.1", "3.1.1"},
+		{"3.9.0", "3.10.0"},
+	} {
+		assert.True(t, versionLess(versions[0], versions[1]), strings.Join(versions[:], " < "))
+		assert.False(t, versionLess(versions[1], versions[0]), strings.Join(versions[:], " > "))
+	}
+
+	assert.False(t, versionLess("3.1", "3.1.0"))
+}
+
+func TestAgentsAreInTheCanaryByTheirName(t *testing.T) {
+	t.Parallel()
+
+	in := 0
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("agent-%d", i)
+		if inCanary(name, 10) {
+			in++
+
+			// Agents stay in the canary as it grows
+			assert.True(t, inCanary(name, 50))
+		}
+		assert.Equal(t, inCanary(name, 10), inCanary(name, 10))
+		assert.False(t, inCanary(name, 0))
+		assert.True(t, inCanary(name, 100))
+	}
+
+	// Roughly the percentage of agents are in it
+	assert.InDelta(t, 100, in, 40)
+
+	assert.Equal(t, "3.1", (&SelfUpdater{Version: "3.0", CanaryVersion: "3.1", CanaryPercentage: 100}).version())
+	assert.Equal(t, "3.0", (&SelfUpdater{Version: "3.0", CanaryVersion: "3.1", CanaryPercentage: 0}).version())
+	assert.Equal(t, "3.0", (&SelfUpdater{Version: "3.0", CanaryPercentage: 100}).version())
+}
@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/process"
+	"github.com/buildkite/agent/secrets"
+	"golang.org/x/crypto/ssh"
+)
+
+// How long ssh-agent has to create it's socket before the job fails
+var sshAgentStartTimeout = 10 * time.Second
+
+// Starts an ssh-agent of the job's own with the agent's SSH keys loaded, so
+// jobs on the same machine can't use each other's keys, and the job can use
+// keys it can't read. The keys are files, or secrets like
+// vault://secret/data/deploy#private_key. Only the job is given the agent's
+// socket, and it's killed when the job finishes.
+func (r *JobRunner) startSSHAgent() error {
+	if len(r.AgentConfiguration.SSHKeys) == 0 || r.AgentConfiguration.JobExecutor == JobExecutorKubernetes {
+		return nil
+	}
+
+	// ssh-agent only answers the user it runs as, so it's run as the job's
+	dir, err := ioutil.TempDir("", "buildkite-ssh-agent-")
+	if err != nil {
+		return fmt.Errorf("Failed to create a directory for the job's ssh-agent (%v)", err)
+	}
+	r.sshAgentDir = dir
+	if err := r.chownForJobUser(dir); err != nil {
+		return err
+	}
+
+	socket := filepath.Join(dir, "agent.sock")
+
+	cmd := exec.Command("ssh-agent", "-D", "-a", socket)
+	if r.process.Credential != nil {
+		if err := process.SetCredential(cmd, r.process.Credential); err != nil {
+			return err
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Failed to start an ssh-agent for the job (%v)", err)
+	}
+	r.sshAgent = cmd
+
+	for started := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		if time.Since(started) > sshAgentStartTimeout {
+			return fmt.Errorf("The job's ssh-agent didn't start within %s", sshAgentStartTimeout)
+		}
+	}
+
+	for _, source := range r.AgentConfiguration.SSHKeys {
+		if err := r.addSSHKey(socket, dir, source); err != nil {
+			return fmt.Errorf("Failed to add the SSH key %s to the job's ssh-agent: %v", source, err)
+		}
+	}
+
+	r.process.Env = append(r.process.Env, "SSH_AUTH_SOCK="+socket)
+
+	r.log("start").Info("Started an ssh-agent for job %s with %d keys", r.Job.ID, len(r.AgentConfiguration.SSHKeys))
+
+	return nil
+}
+
+// Kills the job's ssh-agent, and removes it's socket
+func (r *JobRunner) stopSSHAgent() {
+	if r.sshAgent != nil {
+		if err := r.sshAgent.Process.Kill(); err != nil {
+			r.log("finish").Warn("Failed to stop the ssh-agent of job %s (%s)", r.Job.ID, err)
+		}
+		_ = r.sshAgent.Wait()
+		r.sshAgent = nil
+	}
+
+	if r.sshAgentDir != "" {
+		if err := os.RemoveAll(r.sshAgentDir); err != nil {
+			r.log("finish").Warn("Failed to remove the ssh-agent socket of job %s (%s)", r.Job.ID, err)
+		}
+		r.sshAgentDir = ""
+	}
+}
+
+// Adds a key to the ssh-agent. Keys from secrets are written to a file only
+// the agent's user can read for just long enough for ssh-add to read them.
+func (r *JobRunner) addSSHKey(socket string, dir string, source string) error {
+	key, err := r.sshKey(source)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ssh.ParseRawPrivateKey(key); err != nil {
+		return fmt.Errorf("it isn't a private key without a passphrase (%v)", err)
+	}
+
+	f, err := ioutil.TempFile(dir, "key-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(key)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("ssh-add", "-q", f.Name())
+	cmd.Env = append(os.Environ(), "SSH_AUTH_SOCK="+socket)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if message := strings.TrimSpace(string(output)); message != "" {
+			return fmt.Errorf("%s", message)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Returns the private key from a file, or a secret if it's in the form
+// provider://path#field
+func (r *JobRunner) sshKey(source string) ([]byte, error) {
+	if !strings.Contains(source, "://") {
+		return ioutil.ReadFile(source)
+	}
+
+	requested, err := secrets.Parse("SSH_KEY=" + source)
+	if err != nil {
+		return nil, err
+	}
+
+	providers, err := r.secretsProviders()
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := providers.Fetch(requested)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys need to end in a new line, which secrets are often stored without
+	key := strings.TrimPrefix(env[0], "SSH_KEY=")
+	return []byte(strings.TrimSpace(key) + "\n"), nil
+}
@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/process"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSHAgentIsStartedWithTheKeysAndStopped(t *testing.T) {
+	if _, err := exec.LookPath("ssh-agent"); err != nil {
+		t.Skip("ssh-agent isn't installed")
+	}
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ssh-agent")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key := filepath.Join(dir, "deploy_key")
+	assert.NoError(t, exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "deploy@llamas", "-f", key).Run())
+
+	r := &JobRunner{
+		AgentConfiguration: &AgentConfiguration{SSHKeys: []string{key}},
+		Job:                &api.Job{ID: "llamas"},
+		process:            &process.Process{},
+	}
+
+	assert.NoError(t, r.startSSHAgent())
+
+	var socket string
+	for _, pair := range r.process.Env {
+		if strings.HasPrefix(pair, "SSH_AUTH_SOCK=") {
+			socket = strings.TrimPrefix(pair, "SSH_AUTH_SOCK=")
+		}
+	}
+	assert.NotEmpty(t, socket)
+
+	list := exec.Command("ssh-add", "-l")
+	list.Env = []string{"SSH_AUTH_SOCK=" + socket}
+	output, err := list.CombinedOutput()
+	assert.NoError(t, err)
+	assert.Contains(t, string(output), "deploy@llamas")
+
+	// Only the key is left in the directory, and not a copy of it
+	files, err := ioutil.ReadDir(filepath.Dir(socket))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	r.stopSSHAgent()
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSSHAgentFailsWithKeysThatCantBeRead(t *testing.T) {
+	if _, err := exec.LookPath("ssh-agent"); err != nil {
+		t.Skip("ssh-agent isn't installed")
+	}
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ssh-agent")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key := filepath.Join(dir, "not_a_key")
+	assert.NoError(t, ioutil.WriteFile(key, []byte("llamas"), 0600))
+
+	r := &JobRunner{
+		AgentConfiguration: &AgentConfiguration{SSHKeys: []string{key}},
+		Job:                &api.Job{ID: "llamas"},
+		process:            &process.Process{},
+	}
+	defer r.stopSSHAgent()
+
+	err = r.startSSHAgent()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "it isn't a private key without a passphrase")
+}
+
+func TestJobsWithKeysThatCantBeReadArentInfrastructureFailures(t *testing.T) {
+	if _, err := exec.LookPath("ssh-agent"); err != nil {
+		t.Skip("ssh-agent isn't installed")
+	}
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ssh-agent")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key := filepath.Join(dir, "not_a_key")
+	assert.NoError(t, ioutil.WriteFile(key, []byte("llamas"), 0600))
+
+	r := &JobRunner{
+		AgentConfiguration: &AgentConfiguration{SSHKeys: []string{key}},
+		Job:                &api.Job{ID: "llamas", Env: map[string]string{}},
+		process:            &process.Process{},
+	}
+	defer r.stopSSHAgent()
+
+	err = r.prepareJob()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "it isn't a private key without a passphrase")
+	}
+	assert.False(t, r.preflightFailed)
+	assert.Equal(t, "", r.failureReason())
+}
@@ -0,0 +1,398 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/buildkite/agent/logger"
+	zglob "github.com/mattn/go-zglob"
+)
+
+// The most failures kept in a test summary, and the most of each one's
+// message and output, so the summary stays small enough to upload
+const (
+	maxTestSummaryFailures     = 50
+	maxTestFailureDetailsBytes = 1024
+)
+
+// TestSummary is the outcome of the tests in a set of JUnit XML or TAP files
+type TestSummary struct {
+	Files    int           `json:"files"`
+	Tests    int           `json:"tests"`
+	Passed   int           `json:"passed"`
+	Failed   int           `json:"failed"`
+	Skipped  int           `json:"skipped"`
+	Duration float64       `json:"duration"`
+	Failures []TestFailure `json:"failures"`
+}
+
+// TestFailure is a test that failed, or errored
+type TestFailure struct {
+	Name      string  `json:"name"`
+	Classname string  `json:"classname,omitempty"`
+	File      string  `json:"file"`
+	Message   string  `json:"message,omitempty"`
+	Details   string  `json:"details,omitempty"`
+	Duration  float64 `json:"duration"`
+}
+
+// SummarizeTestResults finds the files matching the paths, separated like
+// artifact upload paths, and summarizes the tests in them. Files that can't be
+// parsed are skipped with a warning.
+func SummarizeTestResults(paths string) (*TestSummary, error) {
+	files := map[string]bool{}
+
+	for _, path := range strings.Split(paths, ArtifactPathDelimiter) {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		matches, err := zglob.Glob(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		for _, match := range matches {
+			if !isDir(match) {
+				files[match] = true
+			}
+		}
+	}
+
+	// Files are read in order, so the summary is the same each time
+	var sorted []string
+	for file := range files {
+		sorted = append(sorted, file)
+	}
+	sort.Strings(sorted)
+
+	summary := &TestSummary{Failures: []TestFailure{}}
+
+	for _, file := range sorted {
+		logger.Debug("Reading test results from %s", file)
+
+		if err := summary.addFile(file); err != nil {
+			logger.Warn("Skipping %s, its test results couldn't be read (%s)", file, err)
+			continue
+		}
+
+		summary.Files++
+	}
+
+	return summary, nil
+}
+
+func (s *TestSummary) addFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	// The file's extension says what it is, and otherwise it's JUnit if it
+	// looks like XML
+	var results []TestFailure
+	var counts testCounts
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".xml":
+		counts, results, err = parseJUnit(r)
+	case ".tap":
+		counts, results, err = parseTAP(r)
+	default:
+		if looksLikeXML(r) {
+			counts, results, err = parseJUnit(r)
+		} else {
+			counts, results, err = parseTAP(r)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	s.Tests += counts.tests
+	s.Passed += counts.tests - counts.failed - counts.skipped
+	s.Failed += counts.failed
+	s.Skipped += counts.skipped
+	s.Duration += counts.duration
+
+	for _, failure := range results {
+		if len(s.Failures) >= maxTestSummaryFailures {
+			break
+		}
+
+		failure.File = path
+		failure.Message = truncateTestDetails(failure.Message)
+		failure.Details = truncateTestDetails(failure.Details)
+		s.Failures = append(s.Failures, failure)
+	}
+
+	return nil
+}
+
+type testCounts struct {
+	tests    int
+	failed   int
+	skipped  int
+	duration float64
+}
+
+func looksLikeXML(r *bufio.Reader) bool {
+	start, _ := r.Peek(512)
+	return bytes.HasPrefix(bytes.TrimSpace(bytes.TrimPrefix(start, []byte("\xef\xbb\xbf"))), []byte("<"))
+}
+
+type junitTestCase struct {
+	Name      string         `xml:"name,attr"`
+	Classname string         `xml:"classname,attr"`
+	Time      string         `xml:"time,attr"`
+	Failures  []junitProblem `xml:"failure"`
+	Errors    []junitProblem `xml:"error"`
+	Skipped   *junitProblem  `xml:"skipped"`
+	SystemOut string         `xml:"system-out"`
+	SystemErr string         `xml:"system-err"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// Parses the test cases from JUnit XML. Different tools nest test suites in
+// different ways, so test cases are found wherever they are.
+func parseJUnit(r io.Reader) (testCounts, []TestFailure, error) {
+	var counts testCounts
+	var failures []TestFailure
+
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return counts, nil, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "testcase" {
+			continue
+		}
+
+		var testCase junitTestCase
+		if err := decoder.DecodeElement(&testCase, &start); err != nil {
+			return counts, nil, err
+		}
+
+		// Some tools write times like 1,234.5
+		duration, _ := strconv.ParseFloat(strings.Replace(testCase.Time, ",", "", -1), 64)
+
+		counts.tests++
+		counts.duration += duration
+
+		problems := append(testCase.Failures, testCase.Errors...)
+		if len(problems) == 0 {
+			if testCase.Skipped != nil {
+				counts.skipped++
+			}
+			continue
+		}
+
+		counts.failed++
+
+		failure := TestFailure{
+			Name:      testCase.Name,
+			Classname: testCase.Classname,
+			Message:   problems[0].Message,
+			Duration:  duration,
+		}
+
+		var details []string
+		for _, problem := range problems {
+			if text := strings.TrimSpace(problem.Text); text != "" {
+				details = append(details, text)
+			}
+		}
+		if len(details) == 0 {
+			for _, output := range []string{testCase.SystemErr, testCase.SystemOut} {
+				if text := strings.TrimSpace(output); text != "" {
+					details = append(details, text)
+				}
+			}
+		}
+		failure.Details = strings.Join(details, "\n\n")
+
+		failures = append(failures, failure)
+	}
+
+	return counts, failures, nil
+}
+
+var (
+	tapTestRegex      = regexp.MustCompile(`^(not ok|ok)\b\s*(\d+)?\s*(?:-\s*)?([^#]*?)\s*(?:#\s*(\w+)\b\s*(.*))?$`)
+	tapYAMLStartRegex = regexp.MustCompile(`^\s+---\s*$`)
+	tapYAMLEndRegex   = regexp.MustCompile(`^\s+\.\.\.\s*$`)
+	tapMessageRegex   = regexp.MustCompile(`^\s+message:\s*['"]?(.*?)['"]?\s*$`)
+)
+
+// Parses the test points from TAP. Skipped tests, and failing tests that are
+// still to do, count as skipped. The YAML block after a failing test, if
+// there is one, is kept as it's details. Subtests are indented, and only the
+// tests they're part of are counted.
+func parseTAP(r io.Reader) (testCounts, []TestFailure, error) {
+	var counts testCounts
+	var failures []TestFailure
+
+	// The failure whose YAML block is being read, if there is one
+	var yamlFor *TestFailure
+	var yaml []string
+	lastFailed := false
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		if yamlFor != nil {
+			if tapYAMLEndRegex.MatchString(line) {
+				yamlFor.Details = strings.Join(yaml, "\n")
+				yamlFor, yaml = nil, nil
+				continue
+			}
+
+			if m := tapMessageRegex.FindStringSubmatch(line); m != nil && yamlFor.Message == "" {
+				yamlFor.Message = m[1]
+			}
+			yaml = append(yaml, strings.TrimPrefix(line, "  "))
+			continue
+		}
+
+		// Only a YAML block straight after a failing test is it's details
+		if lastFailed && tapYAMLStartRegex.MatchString(line) {
+			yamlFor = &failures[len(failures)-1]
+			lastFailed = false
+			continue
+		}
+		lastFailed = false
+
+		if strings.HasPrefix(line, "Bail out!") {
+			counts.tests++
+			counts.failed++
+			failures = append(failures, TestFailure{Name: "Bail out!", Message: strings.TrimSpace(strings.TrimPrefix(line, "Bail out!"))})
+			continue
+		}
+
+		m := tapTestRegex.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		counts.tests++
+
+		directive := strings.ToUpper(m[4])
+		if strings.HasPrefix(directive, "SKIP") || strings.HasPrefix(directive, "TODO") {
+			counts.skipped++
+			continue
+		}
+
+		if m[1] == "ok" {
+			continue
+		}
+
+		name := m[3]
+		if name == "" {
+			name = "test " + m[2]
+		}
+
+		counts.failed++
+		failures = append(failures, TestFailure{Name: name})
+		lastFailed = true
+	}
+
+	if yamlFor != nil {
+		yamlFor.Details = strings.Join(yaml, "\n")
+	}
+
+	return counts, failures, scanner.Err()
+}
+
+// Cuts the text down to the most that's kept of a failure's details, never in
+// the middle of a character
+func truncateTestDetails(text string) string {
+	if len(text) <= maxTestFailureDetailsBytes {
+		return text
+	}
+
+	end := maxTestFailureDetailsBytes
+	for end > 0 && !utf8.RuneStart(text[end]) {
+		end--
+	}
+
+	return text[:end] + "…"
+}
+
+// Annotation returns a Markdown annotation listing the first of the tests
+// that failed, at most the given number of them
+func (s *TestSummary) Annotation(heading string, max int) string {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "**%s:** %d of %d tests failed", heading, s.Failed, s.Tests)
+	if s.Skipped > 0 {
+		fmt.Fprintf(&b, ", %d skipped", s.Skipped)
+	}
+	b.WriteString("\n\n")
+
+	shown := s.Failures
+	if len(shown) > max {
+		shown = shown[:max]
+	}
+
+	for _, failure := range shown {
+		name := failure.Name
+		if failure.Classname != "" {
+			name = failure.Classname + " " + name
+		}
+
+		b.WriteString("<details>\n")
+		fmt.Fprintf(&b, "<summary><code>%s</code>", html.EscapeString(name))
+		if failure.Message != "" {
+			fmt.Fprintf(&b, " %s", html.EscapeString(firstLine(failure.Message)))
+		}
+		b.WriteString("</summary>\n\n")
+
+		fmt.Fprintf(&b, "<p>In <code>%s</code></p>\n", html.EscapeString(failure.File))
+		if failure.Details != "" {
+			fmt.Fprintf(&b, "<pre><code>%s</code></pre>\n", html.EscapeString(failure.Details))
+		}
+
+		b.WriteString("</details>\n")
+	}
+
+	if more := s.Failed - len(shown); more > 0 {
+		fmt.Fprintf(&b, "\nand %d more\n", more)
+	}
+
+	return b.String()
+}
+
+func firstLine(text string) string {
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		return text[:i]
+	}
+	return text
+}
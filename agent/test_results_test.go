@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const junitResults = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="llamas" tests="4">
+    <testcase classname="Llamas" name="eat grass" time="0.5"/>
+    <testcase classname="Llamas" name="spit" time="1,000.25">
+      <failure message="expected a spit" type="AssertionError">llamas_test.rb:12: expected a spit &lt;got none&gt;</failure>
+    </testcase>
+    <testcase classname="Llamas" name="hum" time="0.1">
+      <skipped/>
+    </testcase>
+    <testsuite name="alpacas">
+      <testcase classname="Alpacas" name="are fluffy" time="0.2">
+        <error message="undefined method fluffy?"/>
+        <system-err>NoMethodError: undefined method fluffy?</system-err>
+      </testcase>
+    </testsuite>
+  </testsuite>
+</testsuites>`
+
+const tapResults = `TAP version 13
+1..6
+ok 1 - llamas eat grass
+not ok 2 - llamas spit
+  ---
+  message: 'expected a spit'
+  at: llamas.js:12
+  ...
+ok 3 - llamas hum # SKIP not today
+not ok 4 - alpacas are fluffy # TODO shear them first
+    # Subtest: camels
+    not ok 1 - have humps
+not ok 5
+ok 6 camels have humps
+`
+
+func TestParseJUnit(t *testing.T) {
+	t.Parallel()
+
+	counts, failures, err := parseJUnit(strings.NewReader(junitResults))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 4, counts.tests)
+	assert.Equal(t, 2, counts.failed)
+	assert.Equal(t, 1, counts.skipped)
+	assert.InDelta(t, 1001.05, counts.duration, 0.001)
+
+	assert.Equal(t, []TestFailure{
+		{Name: "spit", Classname: "Llamas", Message: "expected a spit", Details: "llamas_test.rb:12: expected a spit <got none>", Duration: 1000.25},
+		{Name: "are fluffy", Classname: "Alpacas", Message: "undefined method fluffy?", Details: "NoMethodError: undefined method fluffy?", Duration: 0.2},
+	}, failures)
+
+	_, _, err = parseJUnit(strings.NewReader(`<testsuite><testcase name="llamas">`))
+	assert.Error(t, err)
+}
+
+func TestParseTAP(t *testing.T) {
+	t.Parallel()
+
+	counts, failures, err := parseTAP(strings.NewReader(tapResults))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 6, counts.tests)
+	assert.Equal(t, 2, counts.failed)
+	assert.Equal(t, 2, counts.skipped)
+
+	assert.Equal(t, []TestFailure{
+		{Name: "llamas spit", Message: "expected a spit", Details: "message: 'expected a spit'\nat: llamas.js:12"},
+		{Name: "test 5"},
+	}, failures)
+}
+
+func TestSummarizeTestResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-results")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"junit/llamas.xml": junitResults,
+		"junit/broken.xml": "<testsuite><testcase",
+		"results.tap":      tapResults,
+		"results.log":      junitResults,
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0666))
+	}
+
+	summary, err := SummarizeTestResults(filepath.Join(dir, "junit", "*.xml") + ";" + filepath.Join(dir, "results.*") + ";" + filepath.Join(dir, "missing", "*.xml"))
+	assert.NoError(t, err)
+
+	// The broken file is skipped, and the log is found to be JUnit
+	assert.Equal(t, 3, summary.Files)
+	assert.Equal(t, 14, summary.Tests)
+	assert.Equal(t, 6, summary.Failed)
+	assert.Equal(t, 4, summary.Skipped)
+	assert.Equal(t, 4, summary.Passed)
+	assert.Equal(t, 6, len(summary.Failures))
+	assert.Equal(t, filepath.Join(dir, "junit", "llamas.xml"), summary.Failures[0].File)
+}
+
+func TestTestSummaryAnnotation(t *testing.T) {
+	t.Parallel()
+
+	summary := &TestSummary{
+		Tests:   10,
+		Failed:  3,
+		Skipped: 1,
+		Failures: []TestFailure{
+			{Name: "spit", Classname: "Llamas", File: "llamas.xml", Message: "expected <spit>\nbut got none", Details: "llamas_test.rb:12"},
+			{Name: "hum", File: "llamas.tap"},
+			{Name: "fluff", File: "alpacas.tap"},
+		},
+	}
+
+	annotation := summary.Annotation("Tests", 2)
+
+	assert.True(t, strings.HasPrefix(annotation, "**Tests:** 3 of 10 tests failed, 1 skipped\n\n"))
+	assert.Contains(t, annotation, "<summary><code>Llamas spit</code> expected &lt;spit&gt;</summary>")
+	assert.Contains(t, annotation, "<pre><code>llamas_test.rb:12</code></pre>")
+	assert.Contains(t, annotation, "<summary><code>hum</code></summary>")
+	assert.NotContains(t, annotation, "fluff")
+	assert.True(t, strings.HasSuffix(annotation, "\nand 1 more\n"))
+}
+
+func TestTruncateTestDetails(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "llamas", truncateTestDetails("llamas"))
+
+	truncated := truncateTestDetails(strings.Repeat("🦙", maxTestFailureDetailsBytes))
+	assert.True(t, len(truncated) <= maxTestFailureDetailsBytes+len("…"))
+	assert.True(t, strings.HasSuffix(truncated, "🦙…"))
+}
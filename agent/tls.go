@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Returns the TLS config for talking to an API that requires client
+// certificates, or nil if none of the files are set. The CA is trusted as well
+// as the system's ones, so other HTTPS requests still work.
+func loadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("A TLS client certificate needs both --tls-client-cert and --tls-client-key")
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load the TLS client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the TLS CA certificate: %v", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Failed to parse the TLS CA certificate in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadTLSConfigNeedsTheCertAndKey(t *testing.T) {
+	config, err := loadTLSConfig("", "", "")
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+
+	_, err = loadTLSConfig("client.crt", "", "")
+	assert.Error(t, err)
+}
+
+func TestAPIClientWithMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, clientCert := writeClientCertificate(t, dir)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"action":"idle"}`))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	defaultTLSConfig := http.DefaultTransport.(*http.Transport).TLSClientConfig
+	defer func() {
+		tlsConfig = nil
+		http.DefaultTransport.(*http.Transport).TLSClientConfig = defaultTLSConfig
+	}()
+
+	if err := APIClientConfigureTLS(certFile, keyFile, caFile); err != nil {
+		t.Fatal(err)
+	}
+
+	client := APIClient{Endpoint: server.URL + "/", Token: "llamas"}.Create()
+	ping, _, err := client.Pings.Get()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "idle", ping.Action)
+	}
+}
+
+// Writes a self-signed client certificate and it's key to the directory
+func writeClientCertificate(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "buildkite-agent"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	return certFile, keyFile, cert
+}
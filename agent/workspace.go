@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// How each job's ephemeral workspace is provisioned
+const (
+	// A fresh directory in the workspace path, which is usually a
+	// filesystem of its own
+	WorkspaceDirectory = "directory"
+
+	// A tmpfs mounted for the job, so nothing it writes touches the disk
+	WorkspaceTmpfs = "tmpfs"
+)
+
+var errTmpfsUnsupported = errors.New("tmpfs workspaces are only supported on Linux")
+
+// Returns the build path of the job's ephemeral workspace, or an empty string
+// if jobs share the agent's build path
+func (r *JobRunner) workspacePath() string {
+	if r.AgentConfiguration.EphemeralWorkspace == "" || r.AgentConfiguration.JobExecutor == JobExecutorKubernetes {
+		return ""
+	}
+
+	root := r.AgentConfiguration.EphemeralWorkspacePath
+	if root == "" {
+		root = os.TempDir()
+	}
+
+	return filepath.Join(root, "buildkite-job-"+r.Job.ID)
+}
+
+// Provisions the job's workspace, so it starts without anything another job
+// left behind
+func (r *JobRunner) createWorkspace() error {
+	if r.workspace == "" {
+		return nil
+	}
+
+	// The job ID is in the path, so anything already there was left by a
+	// run of the same job that the agent didn't get to clean up after
+	if err := os.RemoveAll(r.workspace); err != nil {
+		return fmt.Errorf("The workspace %s couldn't be cleared (%v)", r.workspace, err)
+	}
+
+	if err := os.MkdirAll(r.workspace, 0755); err != nil {
+		return fmt.Errorf("The workspace %s couldn't be created (%v)", r.workspace, err)
+	}
+
+	if r.AgentConfiguration.EphemeralWorkspace == WorkspaceTmpfs {
+		if err := mountTmpfs(r.workspace, r.AgentConfiguration.EphemeralWorkspaceSize); err != nil {
+			os.Remove(r.workspace)
+			return fmt.Errorf("A tmpfs couldn't be mounted on %s (%v)", r.workspace, err)
+		}
+		r.workspaceMounted = true
+	}
+
+	if err := r.chownForJobUser(r.workspace); err != nil {
+		return err
+	}
+
+	r.log("start").Debug("Created workspace %s for job %s", r.workspace, r.Job.ID)
+
+	return nil
+}
+
+// Destroys the job's workspace along with everything the job left in it
+func (r *JobRunner) removeWorkspace() {
+	if r.workspace == "" {
+		return
+	}
+
+	if r.workspaceMounted {
+		if err := unmountTmpfs(r.workspace); err != nil {
+			r.log("finish").Warn("Failed to unmount the workspace of job %s (%s)", r.Job.ID, err)
+			return
+		}
+		r.workspaceMounted = false
+	}
+
+	if err := os.RemoveAll(r.workspace); err != nil {
+		r.log("finish").Warn("Failed to remove the workspace of job %s (%s)", r.Job.ID, err)
+	}
+}
@@ -0,0 +1,27 @@
+package agent
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Mounts a tmpfs of sizeMB on the path, or half of the machine's memory if
+// it's 0. It needs the agent to be run as root.
+func mountTmpfs(path string, sizeMB int) error {
+	options := "mode=0755"
+	if sizeMB > 0 {
+		options += fmt.Sprintf(",size=%dm", sizeMB)
+	}
+
+	return syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, options)
+}
+
+// Unmounts the tmpfs, detaching it if processes the job left behind are
+// still using it
+func unmountTmpfs(path string) error {
+	if err := syscall.Unmount(path, 0); err != syscall.EBUSY {
+		return err
+	}
+
+	return syscall.Unmount(path, syscall.MNT_DETACH)
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package agent
+
+func mountTmpfs(path string, sizeMB int) error {
+	return errTmpfsUnsupported
+}
+
+func unmountTmpfs(path string) error {
+	return errTmpfsUnsupported
+}
@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEphemeralWorkspaceIsCreatedAndRemoved(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "workspaces")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r := &JobRunner{
+		AgentConfiguration: &AgentConfiguration{
+			BuildPath:              "/var/lib/buildkite-agent/builds",
+			EphemeralWorkspace:     WorkspaceDirectory,
+			EphemeralWorkspacePath: dir,
+		},
+		Job: &api.Job{ID: "llamas"},
+	}
+
+	r.workspace = r.workspacePath()
+	assert.Equal(t, filepath.Join(dir, "buildkite-job-llamas"), r.workspace)
+
+	// Anything left by an earlier run of the job is cleared
+	assert.NoError(t, os.MkdirAll(filepath.Join(r.workspace, "left-behind"), 0777))
+
+	assert.NoError(t, r.createWorkspace())
+	files, err := ioutil.ReadDir(r.workspace)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(r.workspace, "llamas.txt"), []byte("llamas"), 0666))
+
+	r.removeWorkspace()
+	_, err = os.Stat(r.workspace)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestJobsShareTheBuildPathWithoutEphemeralWorkspaces(t *testing.T) {
+	t.Parallel()
+
+	r := &JobRunner{
+		AgentConfiguration: &AgentConfiguration{BuildPath: "/var/lib/buildkite-agent/builds"},
+		Job:                &api.Job{ID: "llamas"},
+	}
+	assert.Equal(t, "", r.workspacePath())
+
+	// Kubernetes pods have workspaces of their own
+	r.AgentConfiguration.EphemeralWorkspace = WorkspaceTmpfs
+	r.AgentConfiguration.JobExecutor = JobExecutorKubernetes
+	assert.Equal(t, "", r.workspacePath())
+
+	assert.NoError(t, r.createWorkspace())
+	r.removeWorkspace()
+}
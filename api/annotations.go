@@ -14,6 +14,11 @@ type Annotation struct {
 	Context string `json:"context,omitempty"`
 	Style   string `json:"style,omitempty"`
 	Append  bool   `json:"append,omitempty"`
+
+	// The name of the section of the annotation that the body is for, so
+	// jobs can each have their own part of an annotation without replacing
+	// each other's
+	Section string `json:"section,omitempty"`
 }
 
 // Annotates a build in the Buildkite UI
@@ -31,6 +31,9 @@ type Artifact struct {
 	// A Sha1Sum calculation of the file
 	Sha1Sum string `json:"sha1sum"`
 
+	// A Sha256Sum calculation of the file
+	Sha256Sum string `json:"sha256sum,omitempty"`
+
 	// The HTTP url to this artifact once it's been uploaded
 	URL string `json:"url,omitempty"`
 
@@ -38,6 +41,13 @@ type Artifact struct {
 	// uploaded
 	UploadDestination string `json:"upload_destination,omitempty"`
 
+	// How the file was compressed before it was uploaded, either gzip or
+	// zstd, so it can be decompressed when it's downloaded
+	Compression string `json:"compression,omitempty"`
+
+	// Whether the file is a tar of a directory
+	Archived bool `json:"archived,omitempty"`
+
 	// Information on how to upload this artifact.
 	UploadInstructions *ArtifactUploadInstructions `json:"-"`
 }
@@ -69,6 +79,8 @@ type ArtifactBatchCreateResponse struct {
 type ArtifactSearchOptions struct {
 	Query string `url:"query,omitempty"`
 	Scope string `url:"scope,omitempty"`
+
+	ListOptions
 }
 
 type ArtifactBatchUpdateArtifact struct {
@@ -141,3 +153,24 @@ func (as *ArtifactsService) Search(buildId string, opt *ArtifactSearchOptions) (
 
 	return a, resp, err
 }
+
+// Searches Buildkite for a set of artifacts, fetching every page of them
+func (as *ArtifactsService) SearchAll(buildId string, opt *ArtifactSearchOptions) ([]*Artifact, error) {
+	paged := ArtifactSearchOptions{}
+	if opt != nil {
+		paged = *opt
+	}
+
+	var all []*Artifact
+	err := Paginate(func(page ListOptions) (*Response, error) {
+		paged.Page = page.Page
+		artifacts, resp, err := as.Search(buildId, &paged)
+		all = append(all, artifacts...)
+		return resp, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return all, nil
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,10 +13,12 @@ import (
 	"net/textproto"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/tracing"
 	"github.com/google/go-querystring/query"
 	"gopkg.in/vmihailenco/msgpack.v2"
 )
@@ -40,6 +43,16 @@ type Client struct {
 	// If true, requests and responses will be dumped and set to the logger
 	DebugHTTP bool
 
+	// If set, each request is traced as a child of this span
+	Span *tracing.Span
+
+	// If set, the results of requests are recorded to it, to keep track of
+	// whether the API is failing
+	Breaker *CircuitBreaker
+
+	// The context requests are made with, set with WithContext
+	ctx context.Context
+
 	// Services used for talking to different parts of the Buildkite Agent API.
 	Agents      *AgentsService
 	Pings       *PingsService
@@ -51,6 +64,8 @@ type Client struct {
 	Pipelines   *PipelinesService
 	Heartbeats  *HeartbeatsService
 	Annotations *AnnotationsService
+	Steps       *StepsService
+	OIDC        *OIDCService
 }
 
 // NewClient returns a new Buildkite Agent API Client.
@@ -62,7 +77,40 @@ func NewClient(httpClient *http.Client) *Client {
 		BaseURL:   baseURL,
 		UserAgent: defaultUserAgent,
 	}
+	c.createServices()
+
+	return c
+}
+
+// NewTokenClient returns a Client for the endpoint that authenticates with the
+// token, either an agent registration token or an agent's access token. The
+// endpoint defaults to the public Buildkite Agent API.
+func NewTokenClient(endpoint string, token string) (*Client, error) {
+	transport := &AuthenticatedTransport{Token: token}
+
+	c := NewClient(transport.Client())
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid endpoint %q (%v)", endpoint, err)
+		}
+		c.BaseURL = u
+	}
 
+	return c, nil
+}
+
+// WithContext returns a copy of the client that makes its requests with the
+// context, so they're cancelled when it's done. The original client is left
+// as it is.
+func (c *Client) WithContext(ctx context.Context) *Client {
+	copied := *c
+	copied.ctx = ctx
+	copied.createServices()
+	return &copied
+}
+
+func (c *Client) createServices() {
 	c.Agents = &AgentsService{c}
 	c.Pings = &PingsService{c}
 	c.Jobs = &JobsService{c}
@@ -73,8 +121,8 @@ func NewClient(httpClient *http.Client) *Client {
 	c.Pipelines = &PipelinesService{c}
 	c.Heartbeats = &HeartbeatsService{c}
 	c.Annotations = &AnnotationsService{c}
-
-	return c
+	c.Steps = &StepsService{c}
+	c.OIDC = &OIDCService{c}
 }
 
 // NewRequest creates an API request. A relative URL can be provided in urlStr,
@@ -93,7 +141,7 @@ func (c *Client) NewRequest(method, urlStr string, body interface{}) (*http.Requ
 		}
 	}
 
-	req, err := http.NewRequest(method, u, buf)
+	req, err := c.newHTTPRequest(method, u, buf)
 	if err != nil {
 		return nil, err
 	}
@@ -120,7 +168,7 @@ func (c *Client) NewRequestWithMessagePack(method, urlStr string, body interface
 		}
 	}
 
-	req, err := http.NewRequest(method, u, buf)
+	req, err := c.newHTTPRequest(method, u, buf)
 	if err != nil {
 		return nil, err
 	}
@@ -141,7 +189,7 @@ func (c *Client) NewRequestWithMessagePack(method, urlStr string, body interface
 func (c *Client) NewFormRequest(method, urlStr string, body *bytes.Buffer) (*http.Request, error) {
 	u := joinURL(c.BaseURL.String(), urlStr)
 
-	req, err := http.NewRequest(method, u, body)
+	req, err := c.newHTTPRequest(method, u, body)
 	if err != nil {
 		return nil, err
 	}
@@ -153,15 +201,35 @@ func (c *Client) NewFormRequest(method, urlStr string, body *bytes.Buffer) (*htt
 	return req, nil
 }
 
+// Creates a request with the client's context, if it has one
+func (c *Client) newHTTPRequest(method, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.ctx != nil {
+		req = req.WithContext(c.ctx)
+	}
+
+	return req, nil
+}
+
 // Response is a Buildkite Agent API response. This wraps the standard
 // http.Response.
 type Response struct {
 	*http.Response
+
+	// The pages before and after this one of a paginated response, from
+	// it's Link header. They're 0 when there isn't one.
+	NextPage int
+	PrevPage int
 }
 
 // newResponse creates a new Response for the provided http.Response.
 func newResponse(r *http.Response) *Response {
 	response := &Response{Response: r}
+	response.populatePageValues()
 	return response
 }
 
@@ -171,6 +239,36 @@ func newResponse(r *http.Response) *Response {
 // interface, the raw response body will be written to v, without attempting to
 // first decode it.
 func (c *Client) Do(req *http.Request, v interface{}) (*Response, error) {
+	span := c.Span.StartChild("HTTP " + req.Method)
+	span.SetKind(tracing.KindClient)
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", req.URL.String())
+	if span != nil {
+		req.Header.Set("traceparent", span.Traceparent())
+	}
+
+	ts := time.Now()
+
+	response, err := c.do(req, v)
+	if response != nil {
+		span.SetAttribute("http.status_code", response.StatusCode)
+	}
+	span.End(err)
+
+	code := "error"
+	if response != nil {
+		code = strconv.Itoa(response.StatusCode)
+	}
+	requestsTotal.Inc(req.Method, code)
+	requestDuration.Observe(time.Since(ts).Seconds(), req.Method)
+	if err != nil {
+		requestErrorsTotal.Inc(req.Method)
+	}
+
+	return response, err
+}
+
+func (c *Client) do(req *http.Request, v interface{}) (*Response, error) {
 	var err error
 
 	if c.DebugHTTP {
@@ -193,6 +291,7 @@ func (c *Client) Do(req *http.Request, v interface{}) (*Response, error) {
 	logger.Debug("%s %s", req.Method, req.URL)
 
 	resp, err := c.client.Do(req)
+	c.Breaker.record(resp, err)
 	if err != nil {
 		return nil, err
 	}
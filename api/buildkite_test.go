@@ -0,0 +1,123 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTokenClient(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v3/ping", r.URL.Path)
+		assert.Equal(t, "Token llamas", r.Header.Get("Authorization"))
+		fmt.Fprint(w, `{"action":"idle"}`)
+	}))
+	defer server.Close()
+
+	client, err := NewTokenClient(server.URL+"/v3", "llamas")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ping, _, err := client.Pings.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, "idle", ping.Action)
+}
+
+func TestClientWithContext(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	client, _ := NewTokenClient(server.URL, "llamas")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, _, err := client.WithContext(ctx).Pings.Get()
+	assert.Error(t, err)
+
+	// The original client doesn't have the context
+	assert.Nil(t, client.ctx)
+	assert.Equal(t, client, client.Pings.client)
+}
+
+func TestErrorStatus(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/jobs/missing/data/get":
+			w.WriteHeader(http.StatusNotFound)
+		case "/jobs/limited/data/get":
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		fmt.Fprint(w, `{"message":"No"}`)
+	}))
+	defer server.Close()
+
+	client, _ := NewTokenClient(server.URL, "llamas")
+
+	_, _, err := client.MetaData.Get("missing", "llamas")
+	assert.Equal(t, http.StatusNotFound, ErrorStatus(err))
+	assert.True(t, IsNotFound(err))
+	assert.True(t, IsPermanentError(err))
+
+	_, _, err = client.MetaData.Get("limited", "llamas")
+	assert.False(t, IsPermanentError(err))
+
+	_, _, err = client.MetaData.Get("other", "llamas")
+	assert.True(t, IsUnauthorized(err))
+
+	assert.Equal(t, 0, ErrorStatus(fmt.Errorf("connection refused")))
+}
+
+func TestSearchAllFollowsPages(t *testing.T) {
+	t.Parallel()
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "llamas/*", r.URL.Query().Get("query"))
+
+		switch r.URL.Query().Get("page") {
+		case "1":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/builds/1/artifacts/search?page=2>; rel="next", <%s/builds/1/artifacts/search?page=2>; rel="last"`, server.URL, server.URL))
+			fmt.Fprint(w, `[{"path":"llamas/1.txt"}]`)
+		case "2":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/builds/1/artifacts/search?page=1>; rel="prev"`, server.URL))
+			fmt.Fprint(w, `[{"path":"llamas/2.txt"}]`)
+		default:
+			t.Errorf("Unexpected page %q", r.URL.Query().Get("page"))
+		}
+	}))
+	defer server.Close()
+
+	client, _ := NewTokenClient(server.URL, "llamas")
+
+	_, resp, err := client.Artifacts.Search("1", &ArtifactSearchOptions{Query: "llamas/*", ListOptions: ListOptions{Page: 1}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, resp.NextPage)
+	assert.Equal(t, 0, resp.PrevPage)
+
+	artifacts, err := client.Artifacts.SearchAll("1", &ArtifactSearchOptions{Query: "llamas/*"})
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(artifacts)) {
+		assert.Equal(t, "llamas/1.txt", artifacts[0].Path)
+		assert.Equal(t, "llamas/2.txt", artifacts[1].Path)
+	}
+}
@@ -3,7 +3,15 @@ package api
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/logger"
 )
 
 // ChunksService handles communication with the chunk related methods of the
@@ -44,3 +52,174 @@ func (cs *ChunksService) Upload(jobId string, chunk *Chunk) (*Response, error) {
 
 	return cs.client.Do(req, nil)
 }
+
+// How long to wait for the API to accept a chunk stream before giving up on
+// it, as servers that don't support streaming won't respond until the request
+// body has finished
+const chunkStreamOpenTimeout = 10 * time.Second
+
+// ChunkStream is a persistent HTTP/2 request that chunks are written to one
+// after another, rather than uploading each chunk in a request of it's own.
+// The request body is a gzipped stream of JSON chunks, one per line, and the
+// response is a stream of JSON acknowledgements, one per chunk the API has
+// saved.
+type ChunkStream struct {
+	pipe    *io.PipeWriter
+	gzipper *gzip.Writer
+	encoder *json.Encoder
+	body    io.ReadCloser
+	cancel  context.CancelFunc
+	acks    chan int
+	err     error
+
+	// Chunks are written one at a time
+	writeMutex sync.Mutex
+}
+
+type streamedChunk struct {
+	Data     string `json:"data"`
+	Sequence int    `json:"sequence"`
+	Offset   int    `json:"offset"`
+	Size     int    `json:"size"`
+}
+
+type streamedChunkAck struct {
+	Sequence int `json:"sequence"`
+}
+
+// Opens a stream to upload a job's chunks with. An error is returned if the
+// API doesn't support streaming chunks, or can't be reached over HTTP/2, in
+// which case chunks should be uploaded individually instead.
+func (cs *ChunksService) Stream(jobId string) (*ChunkStream, error) {
+	reader, writer := io.Pipe()
+
+	req, err := cs.client.newHTTPRequest("POST", joinURL(cs.client.BaseURL.String(), fmt.Sprintf("jobs/%s/chunks/stream", jobId)), reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if cs.client.UserAgent != "" {
+		req.Header.Add("User-Agent", cs.client.UserAgent)
+	}
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	req.Header.Add("Content-Encoding", "gzip")
+
+	ctx, cancel := context.WithCancel(req.Context())
+	req = req.WithContext(ctx)
+
+	// The client used for other requests has a timeout that would end the
+	// stream part way through a job
+	httpClient := &http.Client{Transport: cs.client.client.Transport}
+
+	// The transport can be stuck waiting to write the body, so that needs
+	// ending too
+	timer := time.AfterFunc(chunkStreamOpenTimeout, func() {
+		cancel()
+		writer.CloseWithError(context.DeadlineExceeded)
+	})
+	resp, err := httpClient.Do(req)
+	timer.Stop()
+	if err != nil {
+		cancel()
+		writer.Close()
+		return nil, err
+	}
+
+	logger.Debug("↳ %s %s (%s %s)", req.Method, req.URL, resp.Status, resp.Proto)
+
+	if err = checkResponse(resp); err != nil {
+		resp.Body.Close()
+		cancel()
+		writer.Close()
+		return nil, err
+	}
+
+	if resp.ProtoMajor < 2 {
+		resp.Body.Close()
+		cancel()
+		writer.Close()
+		return nil, fmt.Errorf("Streaming chunks requires HTTP/2, but the connection is %s", resp.Proto)
+	}
+
+	stream := &ChunkStream{
+		pipe:   writer,
+		body:   resp.Body,
+		cancel: cancel,
+		acks:   make(chan int, 1024),
+	}
+	stream.gzipper = gzip.NewWriter(writer)
+	stream.encoder = json.NewEncoder(stream.gzipper)
+
+	go stream.readAcks()
+
+	return stream, nil
+}
+
+// Write sends a chunk down the stream. It blocks while the connection's flow
+// control window is full.
+func (s *ChunkStream) Write(chunk *Chunk) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	err := s.encoder.Encode(streamedChunk{
+		Data:     chunk.Data,
+		Sequence: chunk.Sequence,
+		Offset:   chunk.Offset,
+		Size:     chunk.Size,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Make sure the chunk is sent now, rather than when the gzip buffer
+	// fills up
+	return s.gzipper.Flush()
+}
+
+// Acks returns the sequence numbers of the chunks the API has saved. It's
+// closed once the stream has ended.
+func (s *ChunkStream) Acks() <-chan int {
+	return s.acks
+}
+
+// Err returns why the stream ended, once Acks has been closed
+func (s *ChunkStream) Err() error {
+	return s.err
+}
+
+// Close finishes the request body. The API acknowledges the last of the
+// chunks and then ends the stream.
+func (s *ChunkStream) Close() error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if err := s.gzipper.Close(); err != nil {
+		return err
+	}
+
+	return s.pipe.Close()
+}
+
+// Cancel aborts the stream straight away
+func (s *ChunkStream) Cancel() {
+	s.cancel()
+	s.pipe.CloseWithError(context.Canceled)
+}
+
+func (s *ChunkStream) readAcks() {
+	defer close(s.acks)
+	defer s.cancel()
+	defer s.body.Close()
+
+	decoder := json.NewDecoder(s.body)
+	for {
+		var ack streamedChunkAck
+		if err := decoder.Decode(&ack); err != nil {
+			if err != io.EOF {
+				s.err = err
+			}
+			return
+		}
+		s.acks <- ack.Sequence
+	}
+}
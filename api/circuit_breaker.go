@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CircuitBreaker keeps track of whether the API is persistently failing. It
+// opens once enough requests have failed in a row, and stays open until the
+// cooldown has passed since the last failure, so callers can stop making
+// requests that aren't essential while it's open. A nil CircuitBreaker is
+// never open.
+type CircuitBreaker struct {
+	// How many requests need to fail in a row to open the circuit
+	Threshold int
+
+	// How long to wait after a failure before trying again
+	Cooldown time.Duration
+
+	failures    int
+	lastFailure time.Time
+
+	// Used instead of time.Now, for tests
+	now func() time.Time
+
+	mutex sync.Mutex
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+// IsOpen returns whether the API is failing. It closes once the cooldown is
+// up, so the next request can check if it's recovered, and opens again
+// straight away if that request fails too.
+func (cb *CircuitBreaker) IsOpen() bool {
+	if cb == nil || cb.Threshold <= 0 {
+		return false
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	return cb.failures >= cb.Threshold && cb.time().Sub(cb.lastFailure) < cb.Cooldown
+}
+
+// Records the result of a request. Connection errors, server errors and rate
+// limiting mean the API is in trouble, anything else means it's working.
+func (cb *CircuitBreaker) record(resp *http.Response, err error) {
+	if cb == nil {
+		return
+	}
+
+	failed := err != nil
+	if resp != nil {
+		failed = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if failed {
+		cb.failures++
+		cb.lastFailure = cb.time()
+	} else {
+		cb.failures = 0
+	}
+}
+
+func (cb *CircuitBreaker) time() time.Time {
+	if cb.now != nil {
+		return cb.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerOpensAfterFailuresInARow(t *testing.T) {
+	now := time.Now()
+	cb := NewCircuitBreaker(3, 30*time.Second)
+	cb.now = func() time.Time { return now }
+
+	cb.record(nil, errors.New("connection refused"))
+	cb.record(&http.Response{StatusCode: 502}, errors.New("Bad Gateway"))
+	assert.False(t, cb.IsOpen())
+
+	// Anything that isn't the API failing resets the count
+	cb.record(&http.Response{StatusCode: 422}, errors.New("Unprocessable"))
+	cb.record(nil, errors.New("connection refused"))
+	cb.record(&http.Response{StatusCode: 429}, errors.New("Too Many Requests"))
+	assert.False(t, cb.IsOpen())
+
+	cb.record(&http.Response{StatusCode: 503}, errors.New("Service Unavailable"))
+	assert.True(t, cb.IsOpen())
+
+	// It closes after the cooldown, and opens again if it still fails
+	now = now.Add(30 * time.Second)
+	assert.False(t, cb.IsOpen())
+	cb.record(nil, errors.New("connection refused"))
+	assert.True(t, cb.IsOpen())
+
+	now = now.Add(30 * time.Second)
+	cb.record(&http.Response{StatusCode: 200}, nil)
+	assert.False(t, cb.IsOpen())
+}
+
+func TestNilCircuitBreakerIsNeverOpen(t *testing.T) {
+	var cb *CircuitBreaker
+	cb.record(nil, errors.New("connection refused"))
+	assert.False(t, cb.IsOpen())
+}
@@ -0,0 +1,26 @@
+/*
+Package api is a client for the Buildkite Agent API, which is what agents
+register, accept jobs, upload logs and artifacts, and set meta-data with. It
+only depends on the agent's logger and tracing packages, so tools can use it
+without anything else from the agent.
+
+	client, err := api.NewTokenClient("https://agent.buildkite.com/v3", os.Getenv("BUILDKITE_AGENT_ACCESS_TOKEN"))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	value, _, err := client.WithContext(ctx).MetaData.Get(jobID, "release-version")
+	if api.IsNotFound(err) {
+		// It hasn't been set
+	}
+
+Each part of the API is a service of the Client, and each has an interface,
+like MetaDataAPI, that it can be replaced with in tests. Errors from the API
+are an *ErrorResponse, and ErrorStatus, IsNotFound, IsUnauthorized and
+IsPermanentError tell them apart. Paginated results can be fetched a page at
+a time with ListOptions, or all together with Paginate.
+*/
+package api
@@ -0,0 +1,31 @@
+package api
+
+import "net/http"
+
+// ErrorStatus returns the HTTP status code of an error returned by the API, or
+// 0 if the error didn't come from an API response
+func ErrorStatus(err error) int {
+	if e, ok := err.(*ErrorResponse); ok && e.Response != nil {
+		return e.Response.StatusCode
+	}
+	return 0
+}
+
+// IsNotFound returns whether the API responded that what was asked for
+// doesn't exist
+func IsNotFound(err error) bool {
+	return ErrorStatus(err) == http.StatusNotFound
+}
+
+// IsUnauthorized returns whether the API refused the client's token
+func IsUnauthorized(err error) bool {
+	return ErrorStatus(err) == http.StatusUnauthorized
+}
+
+// IsPermanentError returns whether the API rejected the request in a way that
+// making it again won't change, like a bad request or a missing job. Rate
+// limits, server errors and connection failures aren't permanent.
+func IsPermanentError(err error) bool {
+	status := ErrorStatus(err)
+	return status >= 400 && status < 500 && status != http.StatusTooManyRequests
+}
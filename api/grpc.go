@@ -0,0 +1,361 @@
+package api
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/buildkite/agent/logger"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/grpclog"
+)
+
+func init() {
+	// gRPC logs every time it reconnects, which is only worth seeing when
+	// debugging
+	grpclog.SetLogger(grpcLogger{})
+}
+
+// GRPCConnectMethod is the bidirectional streaming method the agent opens to
+// talk to the API over gRPC. Requests go up it, and responses and pushes
+// come back down it.
+const GRPCConnectMethod = "/buildkite.agent.v1.Agent/Connect"
+
+// errGRPCStreamingBody is returned for requests with bodies that are still
+// being written, like the log chunk stream, which can't be sent as a message
+var errGRPCStreamingBody = errors.New("Requests with streaming bodies can't be sent over gRPC")
+
+// GRPCMessage is a message on the stream. Requests and their responses share
+// an ID, and messages with no ID are pushed by the server, like a job being
+// assigned to the agent.
+type GRPCMessage struct {
+	ID     uint64      `json:"id,omitempty"`
+	Method string      `json:"method,omitempty"`
+	Path   string      `json:"path,omitempty"`
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+	JobID  string      `json:"job_id,omitempty"`
+}
+
+// GRPCCodec encodes messages on the stream as JSON, so there's no generated
+// code to keep in step with the server
+type GRPCCodec struct{}
+
+func (GRPCCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (GRPCCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (GRPCCodec) String() string {
+	return "json"
+}
+
+// Sends what gRPC logs to the agent's logger
+type grpcLogger struct{}
+
+func (grpcLogger) Fatal(args ...interface{}) { logger.Fatal("%s", fmt.Sprint(args...)) }
+
+func (grpcLogger) Fatalf(format string, args ...interface{}) { logger.Fatal(format, args...) }
+
+func (grpcLogger) Fatalln(args ...interface{}) { logger.Fatal("%s", fmt.Sprint(args...)) }
+
+func (grpcLogger) Print(args ...interface{}) { logger.Debug("%s", fmt.Sprint(args...)) }
+
+func (grpcLogger) Printf(format string, args ...interface{}) { logger.Debug(format, args...) }
+
+func (grpcLogger) Println(args ...interface{}) { logger.Debug("%s", fmt.Sprint(args...)) }
+
+var grpcConnectStream = &grpc.StreamDesc{
+	StreamName:    "Connect",
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// IsGRPCEndpoint returns whether the endpoint is talked to over gRPC, which
+// it is if it's a grpc:// or grpcs:// URL
+func IsGRPCEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, "grpc://") || strings.HasPrefix(endpoint, "grpcs://")
+}
+
+// GRPCTransport sends API requests as messages on a single gRPC stream rather
+// than as HTTP requests of their own. The stream is opened with the first
+// request, and opened again by the next one if it breaks.
+type GRPCTransport struct {
+	// The host and port of the server
+	Target string
+
+	// Used to connect to the server if it's set, otherwise the connection
+	// isn't encrypted
+	TLSConfig *tls.Config
+
+	mu      sync.Mutex
+	sendMu  sync.Mutex
+	conn    *grpc.ClientConn
+	stream  grpc.ClientStream
+	cancel  context.CancelFunc
+	nextID  uint64
+	pending map[uint64]chan *GRPCMessage
+
+	// The IDs of jobs the server has pushed to the agent
+	assigned chan string
+}
+
+// NewGRPCTransport returns a transport for a grpc:// or grpcs:// endpoint.
+// grpcs:// endpoints are connected to with the TLS config, or the system's
+// CAs if it's nil.
+func NewGRPCTransport(endpoint string, tlsConfig *tls.Config) (*GRPCTransport, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &GRPCTransport{
+		Target:   u.Host,
+		pending:  map[uint64]chan *GRPCMessage{},
+		assigned: make(chan string, 1),
+	}
+
+	switch u.Scheme {
+	case "grpc":
+		if !strings.Contains(u.Host, ":") {
+			t.Target += ":80"
+		}
+	case "grpcs":
+		if !strings.Contains(u.Host, ":") {
+			t.Target += ":443"
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		t.TLSConfig = tlsConfig
+	default:
+		return nil, fmt.Errorf("%q isn't a gRPC endpoint", endpoint)
+	}
+
+	return t, nil
+}
+
+// JobsAssigned returns the IDs of jobs the server pushes to the agent, so it
+// can ping for them straight away. Jobs are dropped if one's already waiting
+// to be read, since the ping will find it anyway.
+func (t *GRPCTransport) JobsAssigned() <-chan string {
+	return t.assigned
+}
+
+// RoundTrip sends the request on the stream and waits for its response
+func (t *GRPCTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		defer req.Body.Close()
+
+		if req.ContentLength <= 0 {
+			return nil, errGRPCStreamingBody
+		}
+
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	id, responses, err := t.send(&GRPCMessage{
+		Method: req.Method,
+		Path:   req.URL.RequestURI(),
+		Header: req.Header,
+		Body:   body,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg, ok := <-responses:
+		if !ok {
+			return nil, fmt.Errorf("The gRPC stream to %s closed before %s %s was answered", t.Target, req.Method, req.URL.Path)
+		}
+
+		header := msg.Header
+		if header == nil {
+			header = http.Header{}
+		}
+
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", msg.Status, http.StatusText(msg.Status)),
+			StatusCode:    msg.Status,
+			Proto:         "gRPC",
+			Header:        header,
+			Body:          ioutil.NopCloser(bytes.NewReader(msg.Body)),
+			ContentLength: int64(len(msg.Body)),
+			Request:       req,
+		}, nil
+	case <-req.Context().Done():
+		t.forget(id)
+		return nil, req.Context().Err()
+	case <-req.Cancel:
+		t.forget(id)
+		return nil, errors.New("The request was canceled")
+	}
+}
+
+// CancelRequest does nothing, requests are ended with their context
+func (t *GRPCTransport) CancelRequest(req *http.Request) {}
+
+// Close ends the stream and the connection
+func (t *GRPCTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn == nil {
+		return nil
+	}
+
+	t.cancel()
+	err := t.conn.Close()
+	t.conn, t.stream = nil, nil
+	return err
+}
+
+// Sends the message with the next ID, returning the ID and where its
+// response will be sent
+func (t *GRPCTransport) send(msg *GRPCMessage) (uint64, chan *GRPCMessage, error) {
+	stream, err := t.connect()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	responses := make(chan *GRPCMessage, 1)
+
+	t.mu.Lock()
+	t.nextID++
+	msg.ID = t.nextID
+	t.pending[msg.ID] = responses
+	t.mu.Unlock()
+
+	t.sendMu.Lock()
+	err = stream.SendMsg(msg)
+	t.sendMu.Unlock()
+
+	if err != nil {
+		t.forget(msg.ID)
+		t.broken(stream, err)
+		return 0, nil, err
+	}
+
+	return msg.ID, responses, nil
+}
+
+// Returns the stream, opening it if it isn't already
+func (t *GRPCTransport) connect() (grpc.ClientStream, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stream != nil {
+		return t.stream, nil
+	}
+
+	if t.conn == nil {
+		opts := []grpc.DialOption{grpc.WithCodec(GRPCCodec{})}
+		if t.TLSConfig != nil {
+			opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(t.TLSConfig)))
+		} else {
+			opts = append(opts, grpc.WithInsecure())
+		}
+
+		conn, err := grpc.Dial(t.Target, opts...)
+		if err != nil {
+			return nil, err
+		}
+		t.conn = conn
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stream, err := grpc.NewClientStream(ctx, grpcConnectStream, t.conn, GRPCConnectMethod)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	logger.Debug("Opened a gRPC stream to %s", t.Target)
+
+	t.stream = stream
+	t.cancel = cancel
+	go t.receive(stream)
+
+	return stream, nil
+}
+
+// Reads messages from the stream until it breaks, handing responses to the
+// requests waiting for them
+func (t *GRPCTransport) receive(stream grpc.ClientStream) {
+	for {
+		var msg GRPCMessage
+		if err := stream.RecvMsg(&msg); err != nil {
+			t.broken(stream, err)
+			return
+		}
+
+		if msg.ID == 0 {
+			if msg.JobID != "" {
+				logger.Debug("Job %s was pushed over the gRPC stream", msg.JobID)
+
+				select {
+				case t.assigned <- msg.JobID:
+				default:
+				}
+			}
+			continue
+		}
+
+		t.mu.Lock()
+		responses, ok := t.pending[msg.ID]
+		delete(t.pending, msg.ID)
+		t.mu.Unlock()
+
+		if ok {
+			responses <- &msg
+		}
+	}
+}
+
+// Stops waiting for the response to a request
+func (t *GRPCTransport) forget(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.pending, id)
+}
+
+// Fails the requests waiting on the stream, so the next request opens
+// another one. The connection is kept, since it reconnects by itself.
+func (t *GRPCTransport) broken(stream grpc.ClientStream, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stream != stream {
+		return
+	}
+
+	logger.Debug("The gRPC stream to %s broke (%s)", t.Target, err)
+
+	t.cancel()
+	t.stream = nil
+
+	for id, responses := range t.pending {
+		close(responses)
+		delete(t.pending, id)
+	}
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// Serves the Connect stream, answering each request with the handler
+func serveGRPC(t *testing.T, handle func(msg *GRPCMessage, send func(*GRPCMessage) error)) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer(grpc.CustomCodec(GRPCCodec{}))
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "buildkite.agent.v1.Agent",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "Connect",
+			ServerStreams: true,
+			ClientStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				for {
+					var msg GRPCMessage
+					if err := stream.RecvMsg(&msg); err != nil {
+						return nil
+					}
+					handle(&msg, func(reply *GRPCMessage) error {
+						return stream.SendMsg(reply)
+					})
+				}
+			},
+		}},
+	}, struct{}{})
+
+	go server.Serve(listener)
+
+	return "grpc://" + listener.Addr().String(), server.Stop
+}
+
+func TestGRPCTransport(t *testing.T) {
+	t.Parallel()
+
+	endpoint, stop := serveGRPC(t, func(msg *GRPCMessage, send func(*GRPCMessage) error) {
+		u, _ := url.Parse(msg.Path)
+
+		switch u.Path {
+		case "/v3/ping":
+			assert.Equal(t, "Token llamas", msg.Header.Get("Authorization"))
+
+			// A push arrives before the response
+			send(&GRPCMessage{JobID: "my-job"})
+			send(&GRPCMessage{ID: msg.ID, Status: 200, Body: []byte(`{"action":"idle"}`)})
+		case "/v3/jobs/my-job/chunks":
+			assert.Equal(t, "POST", msg.Method)
+			assert.NotEmpty(t, msg.Body)
+			send(&GRPCMessage{ID: msg.ID, Status: 201, Body: []byte(`{}`)})
+		default:
+			send(&GRPCMessage{ID: msg.ID, Status: 404, Body: []byte(`{"message":"No route"}`)})
+		}
+	})
+	defer stop()
+
+	transport, err := NewGRPCTransport(endpoint, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer transport.Close()
+
+	client := NewClient((&AuthenticatedTransport{Token: "llamas", Transport: transport}).Client())
+	client.BaseURL, _ = client.BaseURL.Parse(endpoint + "/v3/")
+
+	ping, _, err := client.Pings.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, "idle", ping.Action)
+
+	select {
+	case id := <-transport.JobsAssigned():
+		assert.Equal(t, "my-job", id)
+	case <-time.After(5 * time.Second):
+		t.Error("The pushed job wasn't received")
+	}
+
+	_, err = client.Chunks.Upload("my-job", &Chunk{Data: "llamas", Sequence: 1})
+	assert.NoError(t, err)
+
+	_, _, err = client.MetaData.Get("my-job", "llamas")
+	assert.True(t, IsNotFound(err))
+
+	// The log chunk stream has to fall back to uploading chunks one by one
+	_, err = client.Chunks.Stream("my-job")
+	assert.Equal(t, errGRPCStreamingBody, err.(*url.Error).Err)
+}
+
+func TestGRPCTransportFailsRequestsWhenTheStreamBreaks(t *testing.T) {
+	t.Parallel()
+
+	// Requests are never answered, the server stops instead
+	endpoint, stop := serveGRPC(t, func(msg *GRPCMessage, send func(*GRPCMessage) error) {})
+	time.AfterFunc(100*time.Millisecond, stop)
+
+	transport, err := NewGRPCTransport(endpoint, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer transport.Close()
+
+	req, _ := http.NewRequest("GET", endpoint+"/v3/ping", nil)
+	_, err = transport.RoundTrip(req)
+	assert.Error(t, err)
+}
+
+func TestNewGRPCTransport(t *testing.T) {
+	t.Parallel()
+
+	for endpoint, target := range map[string]string{
+		"grpc://agent.example.com":       "agent.example.com:80",
+		"grpcs://agent.example.com/v3":   "agent.example.com:443",
+		"grpc://agent.example.com:8080/": "agent.example.com:8080",
+	} {
+		transport, err := NewGRPCTransport(endpoint, nil)
+		if assert.NoError(t, err, endpoint) {
+			assert.Equal(t, target, transport.Target, endpoint)
+			assert.Equal(t, endpoint[:5] == "grpcs", transport.TLSConfig != nil, endpoint)
+		}
+	}
+
+	_, err := NewGRPCTransport("https://agent.example.com", nil)
+	assert.Error(t, err)
+	assert.False(t, IsGRPCEndpoint("https://agent.example.com"))
+	assert.True(t, IsGRPCEndpoint("grpcs://agent.example.com"))
+}
@@ -0,0 +1,86 @@
+package api
+
+import "time"
+
+// The services of the Client, as interfaces so code using them can be tested
+// with fakes instead of a real API. The Client's services implement them.
+
+type AgentsAPI interface {
+	Register(agent *Agent) (*Agent, *Response, error)
+	Connect() (*Response, error)
+	Disconnect() (*Response, error)
+}
+
+type AnnotationsAPI interface {
+	Create(jobId string, annotation *Annotation) (*Response, error)
+}
+
+type ArtifactsAPI interface {
+	Create(jobId string, batch *ArtifactBatch) (*ArtifactBatchCreateResponse, *Response, error)
+	Update(jobId string, artifactStates map[string]string) (*Response, error)
+	Search(buildId string, opt *ArtifactSearchOptions) ([]*Artifact, *Response, error)
+	SearchAll(buildId string, opt *ArtifactSearchOptions) ([]*Artifact, error)
+}
+
+type ChunksAPI interface {
+	Upload(jobId string, chunk *Chunk) (*Response, error)
+	Stream(jobId string) (*ChunkStream, error)
+}
+
+type HeaderTimesAPI interface {
+	Save(jobId string, headerTimes *HeaderTimes) (*Response, error)
+}
+
+type HeartbeatsAPI interface {
+	Beat() (*Heartbeat, *Response, error)
+}
+
+type JobsAPI interface {
+	GetState(id string) (*JobState, *Response, error)
+	Accept(job *Job) (*Job, *Response, error)
+	Acquire(id string) (*Job, *Response, error)
+	Start(job *Job) (*Response, error)
+	Finish(job *Job) (*Response, error)
+	CreateToken(jobId string, request *JobTokenRequest) (*JobToken, *Response, error)
+	RevokeToken(jobId string) (*Response, error)
+}
+
+type MetaDataAPI interface {
+	Set(jobId string, metaData *MetaData) (*Response, error)
+	Get(jobId string, key string) (*MetaData, *Response, error)
+	Exists(jobId string, key string) (*MetaDataExists, *Response, error)
+	Keys(jobId string) ([]string, *Response, error)
+}
+
+type OIDCAPI interface {
+	Token(jobId string, request *OIDCTokenRequest) (*OIDCToken, *Response, error)
+}
+
+type PingsAPI interface {
+	Get() (*Ping, *Response, error)
+	Poll(wait time.Duration) (*Ping, *Response, error)
+}
+
+type PipelinesAPI interface {
+	Upload(jobId string, pipeline *Pipeline) (*Response, error)
+}
+
+type StepsAPI interface {
+	Update(stepIdOrKey string, update *StepUpdate) (*Response, error)
+	Export(stepIdOrKey string, export *StepExport) (*StepExportResponse, *Response, error)
+}
+
+var (
+	_ AgentsAPI      = &AgentsService{}
+	_ AnnotationsAPI = &AnnotationsService{}
+	_ ArtifactsAPI   = &ArtifactsService{}
+	_ ChunksAPI      = &ChunksService{}
+	_ HeaderTimesAPI = &HeaderTimesService{}
+	_ HeartbeatsAPI  = &HeartbeatsService{}
+	_ JobsAPI        = &JobsService{}
+	_ MetaDataAPI    = &MetaDataService{}
+	_ OIDCAPI        = &OIDCService{}
+	_ PingsAPI       = &PingsService{}
+	_ PipelinesAPI   = &PipelinesService{}
+	_ StepsAPI       = &StepsService{}
+)
@@ -18,9 +18,28 @@ type Job struct {
 	Env                map[string]string `json:"env,omitempty"`
 	ChunksMaxSizeBytes int               `json:"chunks_max_size_bytes,omitempty"`
 	ExitStatus         string            `json:"exit_status,omitempty"`
+	RunnableAt         string            `json:"runnable_at,omitempty"`
 	StartedAt          string            `json:"started_at,omitempty"`
 	FinishedAt         string            `json:"finished_at,omitempty"`
 	ChunksFailedCount  int               `json:"chunks_failed_count,omitempty"`
+	Signal             string            `json:"signal,omitempty"`
+	SignalReason       string            `json:"signal_reason,omitempty"`
+	FailureReason      string            `json:"failure_reason,omitempty"`
+	Experiments        []string          `json:"experiments,omitempty"`
+}
+
+// JobTokenRequest represents a request for a token of the job's own
+type JobTokenRequest struct {
+	// What the token can be used for, i.e. the job's log, artifacts and
+	// meta-data
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// JobToken is an access token that only works for one job, until it's
+// revoked or the job finishes
+type JobToken struct {
+	Token     string `json:"token"`
+	ExpiresAt string `json:"expires_at,omitempty"`
 }
 
 type JobState struct {
@@ -28,13 +47,17 @@ type JobState struct {
 }
 
 type jobStartRequest struct {
-	StartedAt string `json:"started_at,omitempty"`
+	StartedAt   string   `json:"started_at,omitempty"`
+	Experiments []string `json:"experiments,omitempty"`
 }
 
 type jobFinishRequest struct {
 	ExitStatus        string `json:"exit_status,omitempty"`
 	FinishedAt        string `json:"finished_at,omitempty"`
 	ChunksFailedCount int    `json:"chunks_failed_count"`
+	Signal            string `json:"signal,omitempty"`
+	SignalReason      string `json:"signal_reason,omitempty"`
+	FailureReason     string `json:"failure_reason,omitempty"`
 }
 
 // Fetches a job
@@ -75,12 +98,32 @@ func (js *JobsService) Accept(job *Job) (*Job, *Response, error) {
 	return j, resp, err
 }
 
+// Acquires a specific job by it's ID, rather than waiting for it to be
+// assigned to the agent from a ping. Returns the job like Accept does.
+func (js *JobsService) Acquire(id string) (*Job, *Response, error) {
+	u := fmt.Sprintf("jobs/%s/acquire", id)
+
+	req, err := js.client.NewRequest("PUT", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	j := new(Job)
+	resp, err := js.client.Do(req, j)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return j, resp, err
+}
+
 // Starts the passed in job
 func (js *JobsService) Start(job *Job) (*Response, error) {
 	u := fmt.Sprintf("jobs/%s/start", job.ID)
 
 	req, err := js.client.NewRequest("PUT", u, &jobStartRequest{
-		StartedAt: job.StartedAt,
+		StartedAt:   job.StartedAt,
+		Experiments: job.Experiments,
 	})
 	if err != nil {
 		return nil, err
@@ -97,6 +140,9 @@ func (js *JobsService) Finish(job *Job) (*Response, error) {
 		FinishedAt:        job.FinishedAt,
 		ExitStatus:        job.ExitStatus,
 		ChunksFailedCount: job.ChunksFailedCount,
+		Signal:            job.Signal,
+		SignalReason:      job.SignalReason,
+		FailureReason:     job.FailureReason,
 	})
 	if err != nil {
 		return nil, err
@@ -104,3 +150,35 @@ func (js *JobsService) Finish(job *Job) (*Response, error) {
 
 	return js.client.Do(req, nil)
 }
+
+// Creates a token for the job's processes, which can only be used for the
+// parts of the API the scopes allow, and only for the job
+func (js *JobsService) CreateToken(jobId string, request *JobTokenRequest) (*JobToken, *Response, error) {
+	u := fmt.Sprintf("jobs/%s/token", jobId)
+
+	req, err := js.client.NewRequest("POST", u, request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t := new(JobToken)
+	resp, err := js.client.Do(req, t)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return t, resp, err
+}
+
+// Revokes the job's token, so it stops working as soon as the job is done
+// with it
+func (js *JobsService) RevokeToken(jobId string) (*Response, error) {
+	u := fmt.Sprintf("jobs/%s/token", jobId)
+
+	req, err := js.client.NewRequest("DELETE", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return js.client.Do(req, nil)
+}
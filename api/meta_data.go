@@ -70,3 +70,21 @@ func (ps *MetaDataService) Exists(jobId string, key string) (*MetaDataExists, *R
 
 	return e, resp, err
 }
+
+// Returns the keys of all the meta data that's been set on the build
+func (ps *MetaDataService) Keys(jobId string) ([]string, *Response, error) {
+	u := fmt.Sprintf("jobs/%s/data/keys", jobId)
+
+	req, err := ps.client.NewRequest("POST", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := []string{}
+	resp, err := ps.client.Do(req, &keys)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return keys, resp, err
+}
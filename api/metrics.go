@@ -0,0 +1,23 @@
+package api
+
+import (
+	"github.com/buildkite/agent/metrics"
+)
+
+var (
+	requestsTotal = metrics.NewCounter(
+		"buildkite_agent_api_requests_total",
+		"The number of requests made to the Buildkite Agent API, by method and response status code",
+		"method", "code")
+
+	requestErrorsTotal = metrics.NewCounter(
+		"buildkite_agent_api_request_errors_total",
+		"The number of requests to the Buildkite Agent API that failed, including connection errors",
+		"method")
+
+	requestDuration = metrics.NewHistogram(
+		"buildkite_agent_api_request_duration_seconds",
+		"How long requests to the Buildkite Agent API took, in seconds",
+		nil,
+		"method")
+)
@@ -0,0 +1,43 @@
+package api
+
+import "fmt"
+
+// OIDCService handles communication with the OIDC related methods of the
+// Buildkite Agent API.
+type OIDCService struct {
+	client *Client
+}
+
+// OIDCTokenRequest represents a request for an OIDC token for a job
+type OIDCTokenRequest struct {
+	Audience string `json:"audience,omitempty"`
+
+	// How many seconds the token is valid for, or the API's default if
+	// it's 0
+	Lifetime int `json:"lifetime,omitempty"`
+}
+
+// OIDCToken is a signed JWT whose claims identify the job's organization,
+// pipeline, build, branch and step
+type OIDCToken struct {
+	Token string `json:"token"`
+}
+
+// Requests a token signed by Buildkite, which cloud providers can be
+// configured to trust in exchange for their own short-lived credentials
+func (s *OIDCService) Token(jobId string, request *OIDCTokenRequest) (*OIDCToken, *Response, error) {
+	u := fmt.Sprintf("jobs/%s/oidc/tokens", jobId)
+
+	req, err := s.client.NewRequest("POST", u, request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t := new(OIDCToken)
+	resp, err := s.client.Do(req, t)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return t, resp, err
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOIDCToken(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/v3/jobs/llamas/oidc/tokens", r.URL.Path)
+
+		var request OIDCTokenRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		assert.Equal(t, OIDCTokenRequest{Audience: "sts.amazonaws.com", Lifetime: 300}, request)
+
+		fmt.Fprint(w, `{"token":"eyJhbGciOiJSUzI1NiJ9.alpacas.signature"}`)
+	}))
+	defer server.Close()
+
+	client, err := NewTokenClient(server.URL+"/v3", "llamas")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	token, _, err := client.OIDC.Token("llamas", &OIDCTokenRequest{Audience: "sts.amazonaws.com", Lifetime: 300})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "eyJhbGciOiJSUzI1NiJ9.alpacas.signature", token.Token)
+	}
+}
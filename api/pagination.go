@@ -0,0 +1,73 @@
+package api
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ListOptions are the pagination parameters of the API calls that return a
+// page of results at a time
+type ListOptions struct {
+	// The page of results, starting from 1
+	Page int `url:"page,omitempty"`
+
+	// How many results are on each page
+	PerPage int `url:"per_page,omitempty"`
+}
+
+// Finds the next and previous pages from the response's Link header, which
+// looks like:
+//
+//	<https://agent.buildkite.com/v3/builds/1/artifacts/search?page=2>; rel="next"
+func (r *Response) populatePageValues() {
+	for _, link := range strings.Split(r.Header.Get("Link"), ",") {
+		segments := strings.Split(strings.TrimSpace(link), ";")
+		if len(segments) < 2 {
+			continue
+		}
+
+		target := strings.TrimSpace(segments[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+
+		u, err := url.Parse(target[1 : len(target)-1])
+		if err != nil {
+			continue
+		}
+
+		page, err := strconv.Atoi(u.Query().Get("page"))
+		if err != nil {
+			continue
+		}
+
+		for _, segment := range segments[1:] {
+			switch strings.TrimSpace(segment) {
+			case `rel="next"`:
+				r.NextPage = page
+			case `rel="prev"`:
+				r.PrevPage = page
+			}
+		}
+	}
+}
+
+// Paginate calls fetch for each page of results, starting with the first,
+// until there are no more pages or it returns an error
+func Paginate(fetch func(opt ListOptions) (*Response, error)) error {
+	opt := ListOptions{Page: 1}
+
+	for {
+		resp, err := fetch(opt)
+		if err != nil {
+			return err
+		}
+
+		if resp == nil || resp.NextPage == 0 || resp.NextPage == opt.Page {
+			return nil
+		}
+
+		opt.Page = resp.NextPage
+	}
+}
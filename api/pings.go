@@ -1,5 +1,13 @@
 package api
 
+import (
+	"fmt"
+	"time"
+)
+
+// How much longer than the wait a long poll is given to answer
+const pollTimeoutMargin = 30 * time.Second
+
 // PingsService handles communication with the ping related methods of the
 // Buildkite Agent API.
 type PingsService struct {
@@ -12,6 +20,14 @@ type Ping struct {
 	Message  string `json:"message,omitempty"`
 	Job      *Job   `json:"job,omitempty"`
 	Endpoint string `json:"endpoint,omitempty"`
+
+	// Whether there are jobs waiting for an agent like this one, which
+	// stops idle agents backing off their pings
+	JobsQueued bool `json:"jobs_queued,omitempty"`
+
+	// Whether the API held the ping open waiting for a job, which it says
+	// with the Buildkite-Long-Poll header
+	LongPolled bool `json:"-"`
 }
 
 // Pings the API and returns any work the client needs to perform
@@ -29,3 +45,30 @@ func (ps *PingsService) Get() (*Ping, *Response, error) {
 
 	return ping, resp, err
 }
+
+// Poll is a ping that asks the API to hold it open until a job is assigned,
+// or the wait is up, so the job is found as soon as it's assigned. APIs that
+// don't support long polling answer straight away, and the ping isn't
+// LongPolled.
+func (ps *PingsService) Poll(wait time.Duration) (*Ping, *Response, error) {
+	// The client usually gives up on requests before the wait is up
+	c := *ps.client
+	httpClient := *c.client
+	httpClient.Timeout = wait + pollTimeoutMargin
+	c.client = &httpClient
+
+	req, err := c.NewRequest("GET", fmt.Sprintf("ping?wait=%d", int(wait.Seconds())), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ping := new(Ping)
+	resp, err := c.Do(req, ping)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	ping.LongPolled = resp.Header.Get("Buildkite-Long-Poll") == "true"
+
+	return ping, resp, err
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// StepsService handles communication with the step related methods of the
+// Buildkite Agent API.
+type StepsService struct {
+	client *Client
+}
+
+// StepUpdate represents a change to an attribute of a step
+type StepUpdate struct {
+	UUID      string `json:"uuid"`
+	Build     string `json:"build_id,omitempty"`
+	Attribute string `json:"attribute"`
+	Value     string `json:"value"`
+	Append    bool   `json:"append,omitempty"`
+}
+
+// StepExport represents a request for an attribute of a step
+type StepExport struct {
+	Build     string `json:"build_id,omitempty"`
+	Attribute string `json:"attribute"`
+	Format    string `json:"format,omitempty"`
+}
+
+// StepExportResponse is the value of the attribute that was requested
+type StepExportResponse struct {
+	Output string `json:"output"`
+}
+
+// Updates an attribute of a step, which is found by either its ID or key
+func (ss *StepsService) Update(stepIdOrKey string, update *StepUpdate) (*Response, error) {
+	u := fmt.Sprintf("steps/%s", url.PathEscape(stepIdOrKey))
+
+	req, err := ss.client.NewRequest("PUT", u, update)
+	if err != nil {
+		return nil, err
+	}
+
+	return ss.client.Do(req, nil)
+}
+
+// Gets an attribute of a step, which is found by either its ID or key
+func (ss *StepsService) Export(stepIdOrKey string, export *StepExport) (*StepExportResponse, *Response, error) {
+	u := fmt.Sprintf("steps/%s/export", url.PathEscape(stepIdOrKey))
+
+	req, err := ss.client.NewRequest("POST", u, export)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := new(StepExportResponse)
+	resp, err := ss.client.Do(req, r)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return r, resp, err
+}
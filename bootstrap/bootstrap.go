@@ -1,19 +1,28 @@
 package bootstrap
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/buildkite/agent/agent"
 	"github.com/buildkite/agent/bootstrap/shell"
 	"github.com/buildkite/agent/env"
+	"github.com/buildkite/agent/events"
+	"github.com/buildkite/agent/metrics"
+	"github.com/buildkite/agent/retry"
+	"github.com/buildkite/agent/tracing"
 	"github.com/pkg/errors"
 )
 
@@ -25,6 +34,22 @@ type Bootstrap struct {
 	// Config provides the bootstrap configuration
 	Config
 
+	// Phases replace the bootstrap's own phases, when it's embedded in
+	// another program
+	Phases Phases
+
+	// The environment the job starts with, which is the process's if it's
+	// nil. The agent passes the job's when it runs the bootstrap itself,
+	// so neither of them sees the other's.
+	Environ []string
+
+	// Where the job's output is written, stdout if it's nil
+	Output io.Writer
+
+	// The signals that cancel the job, which are the ones the process gets
+	// if it's nil
+	Signals <-chan os.Signal
+
 	// Shell is the shell environment for the bootstrap
 	shell *shell.Shell
 
@@ -33,10 +58,39 @@ type Bootstrap struct {
 
 	// Tracks whether there is a checkout to upload in the teardown
 	hasCheckout bool
+
+	// Whether the checkout has been given to the job's user
+	checkoutIsJobUsers bool
+
+	// Traces the bootstrap, if an OpenTelemetry collector has been
+	// configured
+	tracer *tracing.Tracer
+
+	// The span for the phase that's running, which hooks are children of
+	span *tracing.Span
+
+	// Set to 1 once the agent has cancelled the job
+	cancelled int32
+
+	// Why the command failed, if it did
+	commandError error
 }
 
+// The error for the phases that don't get to run when the job is cancelled
+var errCancelled = errors.New("The job was cancelled")
+
 // Start runs the bootstrap and returns the exit code
 func (b *Bootstrap) Start() int {
+	// Commands are run with a context that's never done, so only hook
+	// timeouts kill them. Cancelling the job signals them to stop instead,
+	// which lets them finish gracefully.
+	return b.RunPhases(context.Background())
+}
+
+// RunPhases runs the job's phases, with any that have been replaced in Phases
+// run instead of the bootstrap's own, and returns the exit code the job
+// finished with. Whatever is running is killed if ctx is done.
+func (b *Bootstrap) RunPhases(ctx context.Context) int {
 	// Check if not nil to allow for tests to overwrite shell
 	if b.shell == nil {
 		var err error
@@ -48,38 +102,96 @@ func (b *Bootstrap) Start() int {
 
 		b.shell.PTY = b.Config.RunInPty
 		b.shell.Debug = b.Config.Debug
+		b.shell.Env = env.FromSlice(b.environ())
+
+		if b.Output != nil {
+			b.shell.Writer = b.Output
+			b.shell.Logger = &shell.WriterLogger{Writer: b.Output, Ansi: true}
+		}
 	}
 
+	// The agent terminates the bootstrap to cancel the job, which stops
+	// any more phases from running. The shell passes the signal on to
+	// whatever's running, and the pre-exit hooks are still run.
+	stopWatching := b.watchForCancellation()
+	defer stopWatching()
+
+	// Trace the phases of the bootstrap as part of the job's trace, which
+	// is exported once everything else is finished
+	b.startTracing()
+	defer b.finishTracing()
+
 	// Tear down the environment (and fire pre-exit hook) before we exit
 	defer func() {
-		if err := b.tearDown(); err != nil {
+		tearDownCtx, cancel := b.tearDownContext(ctx)
+		defer cancel()
+
+		if err := b.tearDown(tearDownCtx); err != nil {
 			b.shell.Errorf("Error tearing down bootstrap: %v", err)
 		}
 	}()
 
+	// Refuse to run a job that wasn't signed with the agent's key, before
+	// any of it's hooks or plugins have a chance to run
+	if err := b.verifyStepSignature(); err != nil {
+		b.shell.Errorf("%v", err)
+		b.reportFailureReason(err)
+		return 1
+	}
+
 	// Initialize the environment, a failure here will still call the tearDown
-	if err := b.setUp(); err != nil {
+	if err := b.setUp(ctx); err != nil {
 		b.shell.Errorf("Error setting up bootstrap: %v", err)
 		return 1
 	}
 
 	// These are the "Phases of bootstrap execution". They are designed to be
 	// run independently at some later stage (think buildkite-agent bootstrap checkout)
-	var phases = []func() error{
-		b.PluginPhase,
-		b.CheckoutPhase,
-		b.CommandPhase,
+	var phases = []struct {
+		name string
+		run  func(context.Context) error
+	}{
+		{"plugins", b.phase(b.Phases.Plugins, b.PluginPhase)},
+		{"checkout", b.phase(b.Phases.Checkout, b.CheckoutPhase)},
+		{"dev-environment", b.DevEnvironmentPhase},
+		{"toolchain", b.ToolchainPhase},
+		{"command", b.phase(b.Phases.Command, b.CommandPhase)},
 	}
 
 	var phaseError error
 
 	for _, phase := range phases {
-		if phaseError = phase(); phaseError != nil {
+		if b.isCancelled() {
+			phaseError = errCancelled
+			break
+		}
+		if phaseError = b.runPhase(ctx, phase.name, phase.run); phaseError != nil {
 			break
 		}
+		if phase.name == "checkout" && b.Phases.Checkout != nil {
+			b.hasCheckout = true
+		}
+	}
+
+	// Let the agent know why the job failed, if it was one of the phases
+	// or the command
+	if phaseError != nil {
+		b.reportFailureReason(phaseError)
+	} else if b.commandError != nil {
+		b.reportFailureReason(b.commandError)
+	}
+
+	// Summaries of the test results and coverage are nice to have, so them
+	// failing doesn't fail the job
+	if err := b.runPhase(ctx, "test-summary", b.summarizeTestResults); err != nil {
+		b.shell.Warningf("Failed to summarize the test results: %v", err)
 	}
 
-	if err := b.uploadArtifacts(); err != nil {
+	if err := b.runPhase(ctx, "coverage", b.reportCoverage); err != nil {
+		b.shell.Warningf("Failed to report coverage: %v", err)
+	}
+
+	if err := b.runPhase(ctx, "artifacts", b.phase(b.Phases.Artifacts, b.ArtifactPhase)); err != nil {
 		b.shell.Errorf("%v", err)
 		return shell.GetExitCode(err)
 	}
@@ -97,8 +209,123 @@ func (b *Bootstrap) Start() int {
 	return exitStatusInt
 }
 
+// Watches for the agent cancelling the job, returning a func that stops
+// watching
+func (b *Bootstrap) watchForCancellation() func() {
+	if b.Signals != nil {
+		return b.forwardSignals()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		for sig := range signals {
+			if atomic.CompareAndSwapInt32(&b.cancelled, 0, 1) {
+				b.shell.Warningf("Received %v, cancelling the job", sig)
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
+
+// Watches the signals the bootstrap was given for the job being cancelled,
+// and passes them on to whatever the shell is running, which is otherwise
+// done by the process getting them too
+func (b *Bootstrap) forwardSignals() func() {
+	forwarded := make(chan os.Signal, 1)
+	b.shell.Signals = forwarded
+
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case sig := <-b.Signals:
+				if atomic.CompareAndSwapInt32(&b.cancelled, 0, 1) {
+					b.shell.Warningf("Received %v, cancelling the job", sig)
+				}
+				select {
+				case forwarded <- sig:
+				default:
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// Whether the job has been cancelled
+func (b *Bootstrap) isCancelled() bool {
+	return atomic.LoadInt32(&b.cancelled) == 1
+}
+
+// Starts the span for the bootstrap, which continues the job's trace if the
+// agent passed it on
+func (b *Bootstrap) startTracing() {
+	tracer, err := tracing.NewTracerFromEnv("buildkite-agent")
+	if err != nil {
+		b.shell.Warningf("Not tracing the bootstrap: %v", err)
+	}
+
+	b.tracer = tracer
+	traceparent, _ := env.FromSlice(b.environ()).Get(tracing.TraceparentEnv)
+	b.span = tracer.StartSpan("bootstrap", traceparent)
+}
+
+// Ends the span for the bootstrap and exports the trace
+func (b *Bootstrap) finishTracing() {
+	b.span.End(nil)
+
+	if err := b.tracer.Flush(); err != nil {
+		b.shell.Warningf("Failed to export the bootstrap's trace: %v", err)
+	}
+}
+
+// Runs a phase in it's own span, and reports how long it took to the agent.
+// Commands run in the phase are passed the phase's span, so they can add to
+// the trace too.
+func (b *Bootstrap) runPhase(ctx context.Context, name string, phase func(context.Context) error) error {
+	parent := b.span
+	startedAt := time.Now()
+
+	b.span = parent.StartChild(name)
+	if b.span != nil {
+		b.shell.Env.Set(tracing.TraceparentEnv, b.span.Traceparent())
+	}
+
+	err := phase(ctx)
+	b.span.End(err)
+	b.reportMetric(agent.JobPhaseDurationMetric, time.Since(startedAt).Seconds(), name)
+	b.reportPhaseFinished(name, time.Since(startedAt), err)
+
+	b.span = parent
+	if parent != nil {
+		b.shell.Env.Set(tracing.TraceparentEnv, parent.Traceparent())
+	}
+
+	return err
+}
+
 // executeHook runs a hook script with the hookRunner
-func (b *Bootstrap) executeHook(name string, hookPath string, extraEnviron *env.Environment) error {
+func (b *Bootstrap) executeHook(ctx context.Context, name string, hookPath string, extraEnviron *env.Environment) error {
+	return b.runHook(ctx, name, hookPath, extraEnviron, false)
+}
+
+// executeJobHook runs a hook that comes from the job rather than the agent,
+// i.e. one in the checkout or a plugin, in the job's sandbox if it has one
+func (b *Bootstrap) executeJobHook(ctx context.Context, name string, hookPath string, extraEnviron *env.Environment) error {
+	return b.runHook(ctx, name, hookPath, extraEnviron, true)
+}
+
+func (b *Bootstrap) runHook(ctx context.Context, name string, hookPath string, extraEnviron *env.Environment, isJobHook bool) (err error) {
 	if !fileExists(hookPath) {
 		if b.Debug {
 			b.shell.Commentf("Skipping %s hook, no script at \"%s\"", name, hookPath)
@@ -106,29 +333,142 @@ func (b *Bootstrap) executeHook(name string, hookPath string, extraEnviron *env.
 		return nil
 	}
 
+	span := b.span.StartChild("hook " + name)
+	span.SetAttribute("buildkite.hook.path", hookPath)
+	defer func() { span.End(err) }()
+
 	b.shell.Headerf("Running %s hook", name)
 
-	// We need a script to wrap the hook script so that we can snaffle the changed
-	// environment variables
-	script, err := newHookScriptWrapper(hookPath)
-	if err != nil {
-		b.shell.Errorf("Error creating hook script: %v", err)
-		return err
+	// Hooks that don't get to run have an exit status of -1
+	startedAt := time.Now()
+	exitStatus, envChanges := -1, 0
+	defer func() { b.reportHook(span, name, time.Since(startedAt), exitStatus, envChanges) }()
+
+	timeout := b.hookTimeout(hookPath)
+	if timeout > 0 {
+		if b.Debug {
+			b.shell.Commentf("The %s hook will be killed if it runs for longer than %v", name, timeout)
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
-	defer script.Close()
 
-	if b.Debug {
-		b.shell.Commentf("A hook runner was written to \"%s\" with the following:", script.Path())
-		b.shell.Printf("%s", hookPath)
+	var run func() error
+	var getChanges func() (hookScriptChanges, error)
+
+	// What's run in the sandbox instead, and the files the hook needs to
+	// read besides itself and the ones it writes its changes to
+	var sandboxCommand, hookFiles, hookEnvFiles []string
+	var sandboxEnv *env.Environment
+
+	if isExecutableHook(hookPath) {
+		// Hooks that aren't shell scripts can't be sourced, so they're
+		// run directly and write their changes to a file instead
+		hook, err := newExecutableHook(hookPath)
+		if err != nil {
+			b.shell.Errorf("Error preparing hook: %v", err)
+			return err
+		}
+		defer hook.Close()
+
+		b.shell.Commentf("Executing \"%s\" directly as it isn't a shell script", hook.Path())
+
+		run = func() error {
+			return b.shell.RunExecutable(ctx, hook.Path(), hook.Env().Merge(extraEnviron))
+		}
+		getChanges = hook.Changes
+
+		sandboxCommand = []string{hook.Path()}
+		sandboxEnv = hook.Env().Merge(extraEnviron)
+		hookEnvFiles = hook.envFiles()
+	} else {
+		// We need a script to wrap the hook script so that we can snaffle the changed
+		// environment variables
+		script, err := newHookScriptWrapper(hookPath)
+		if err != nil {
+			b.shell.Errorf("Error creating hook script: %v", err)
+			return err
+		}
+		defer script.Close()
+
+		if b.Debug {
+			b.shell.Commentf("A hook runner was written to \"%s\" with the following:", script.Path())
+			b.shell.Printf("%s", hookPath)
+		}
+
+		b.shell.Commentf("Executing \"%s\"", script.Path())
+
+		run = func() error {
+			return b.shell.RunScript(ctx, script.Path(), extraEnviron)
+		}
+		getChanges = script.Changes
+
+		hookFiles = []string{script.Path()}
+		hookEnvFiles = script.envFiles()
+
+		if !shell.IsPowershellScript(hookPath) {
+			sandboxCommand = []string{"/bin/bash", "-c", script.Path()}
+			sandboxEnv = extraEnviron
+		}
 	}
 
-	b.shell.Commentf("Executing \"%s\"", script.Path())
+	if isJobHook {
+		sandbox, err := b.jobSandbox()
+		if err != nil {
+			b.shell.Errorf("Error preparing hook: %v", err)
+			return err
+		}
+
+		if sandbox == sandboxBubblewrap {
+			if sandboxCommand == nil {
+				err = fmt.Errorf("The %s hook can't be run in the bubblewrap job sandbox", name)
+				b.shell.Errorf("Error preparing hook: %v", err)
+				return err
+			}
+
+			b.shell.Commentf("Running the %s hook in a bubblewrap sandbox", name)
+			run = func() error {
+				return b.runHookInSandbox(ctx, hookPath, sandboxCommand, sandboxEnv, hookFiles, hookEnvFiles)
+			}
+		}
+
+		// The hook is run as the job's user like the command, who needs to
+		// be able to read the wrapper and write the changes it makes
+		cred, err := b.jobCredential()
+		if err != nil {
+			b.shell.Errorf("Error preparing hook: %v", err)
+			return err
+		}
+
+		if cred != nil {
+			for _, path := range append(hookFiles, hookEnvFiles...) {
+				if err := os.Chown(path, int(cred.UID), int(cred.GID)); err != nil {
+					b.shell.Errorf("Error preparing hook: %v", err)
+					return err
+				}
+			}
 
-	// Run the wrapper script
-	if err := b.shell.RunScript(script.Path(), extraEnviron); err != nil {
+			b.shell.Commentf("Running the %s hook as %s", name, cred.Username)
+			runHook := run
+			run = func() error {
+				return b.runAsJobUser(cred, runHook)
+			}
+		}
+	}
+
+	// Run the hook
+	err = run()
+	exitStatus = shell.GetExitCode(err)
+	if err != nil {
 		b.shell.Env.Set("BUILDKITE_LAST_HOOK_EXIT_STATUS", fmt.Sprintf("%d", shell.GetExitCode(err)))
+		if _, ok := err.(*shell.TimeoutError); ok {
+			b.shell.Errorf("The %s hook was killed as it didn't finish within %v", name, timeout)
+			return &HookError{Name: name, Err: fmt.Errorf("The %s hook timed out after %v", name, timeout)}
+		}
 		b.shell.Errorf("The %s hook exited with an error: %v", name, err)
-		return err
+		return &HookError{Name: name, Err: err}
 	}
 
 	// Store the last hook exit code for subsequent steps
@@ -140,27 +480,100 @@ func (b *Bootstrap) executeHook(name string, hookPath string, extraEnviron *env.
 	}
 
 	// Get changed environment
-	changes, err := script.Changes()
+	changes, err := getChanges()
 	if err != nil {
-		return errors.Wrapf(err, "Failed to get environment")
+		return &HookError{Name: name, Err: errors.Wrapf(err, "Failed to get environment")}
 	}
 
 	// Finally, apply changes to the current shell and config
-	b.applyEnvironmentChanges(changes.Env, changes.Dir)
+	envChanges = len(changes.Diff.Names())
+	b.applyEnvironmentChanges(changes.Diff, changes.Dir)
 	return nil
 }
 
-func (b *Bootstrap) applyEnvironmentChanges(environ *env.Environment, dir string) {
+// Says how long a hook took, what it exited with and how many environment
+// variables it changed, and adds them to the hook's span and the agent's
+// metrics, so it's clear where the time before the command went
+func (b *Bootstrap) reportHook(span *tracing.Span, name string, duration time.Duration, exitStatus int, envChanges int) {
+	b.shell.Commentf("The %s hook took %v, exited with status %d and changed %d environment variables",
+		name, duration.Round(time.Millisecond), exitStatus, envChanges)
+
+	span.SetAttribute("buildkite.hook.exit_status", exitStatus)
+	span.SetAttribute("buildkite.hook.env_changes", envChanges)
+
+	// Names are the hook's source followed by the hook, with the plugin's
+	// label in between for plugin hooks, which are left out of the
+	// metric's labels so there aren't too many of them
+	fields := strings.Fields(name)
+	b.reportMetric(agent.HookDurationMetric, duration.Seconds(), fields[len(fields)-1], fields[0], strconv.Itoa(exitStatus))
+}
+
+// Lets the agent's event targets know the phase has finished. Like metrics,
+// the event goes to the report file in the job's environment.
+func (b *Bootstrap) reportPhaseFinished(name string, duration time.Duration, err error) {
+	event := events.Event{Type: events.PhaseFinished, JobID: b.JobID, Phase: name, Duration: duration.Seconds()}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	path, _ := b.shell.Env.Get(events.ReportFileEnv)
+	events.ReportTo(path, event)
+}
+
+// Reports a value to one of the agent's metrics, to the report file in the
+// job's environment rather than the process's, as they're only the same when
+// the bootstrap isn't run within the agent
+func (b *Bootstrap) reportMetric(name string, value float64, labelValues ...string) {
+	path, _ := b.shell.Env.Get(metrics.ReportFileEnv)
+	metrics.ReportTo(path, name, value, labelValues...)
+}
+
+// Returns how long a hook can run for before it's killed. A hook can be given
+// a shorter timeout than the agent-wide one with an environment variable named
+// after it, i.e. BUILDKITE_HOOK_TIMEOUT_PRE_COMMAND=300, but not a longer one
+// as the job's environment is the pipeline's to set. The variable is named
+// after the hook rather than where it's from, so it's the same for the agent's
+// hooks, the checkout's and the plugins' with that name.
+func (b *Bootstrap) hookTimeout(hookPath string) time.Duration {
+	seconds := b.HookTimeout
+
+	name := filepath.Base(hookPath)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	key := "BUILDKITE_HOOK_TIMEOUT_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+
+	if value, ok := b.shell.Env.Get(key); ok && value != "" {
+		override, err := strconv.Atoi(value)
+		switch {
+		case err != nil || override <= 0:
+			b.shell.Warningf("Ignoring %s as \"%s\" isn't a positive number of seconds", key, value)
+		case seconds > 0 && override > seconds:
+			b.shell.Warningf("Ignoring %s as it's longer than the agent's hook timeout of %ds", key, seconds)
+		default:
+			seconds = override
+		}
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+func (b *Bootstrap) applyEnvironmentChanges(diff env.Diff, dir string) {
 	if dir != "" {
 		b.shell.Commentf("Applying working directory change: %s", dir)
 		_ = b.shell.Chdir(dir)
 	}
 
 	// Do we even have any environment variables to change?
-	if environ != nil && environ.Length() > 0 {
+	if !diff.Empty() {
 		// First, let see any of the environment variables are supposed
 		// to change the bootstrap configuration at run time.
-		bootstrapConfigEnvChanges := b.Config.ReadFromEnvironment(environ)
+		changed := env.New()
+		for k, v := range diff.Added {
+			changed.Set(k, v)
+		}
+		for k, v := range diff.Changed {
+			changed.Set(k, v.New)
+		}
+		bootstrapConfigEnvChanges := b.Config.ReadFromEnvironment(changed)
 
 		// Print out the env vars that changed. As we go through each
 		// one, we'll determine if it was a special "bootstrap"
@@ -172,9 +585,10 @@ func (b *Bootstrap) applyEnvironmentChanges(environ *env.Environment, dir string
 		// environment variable contains sensitive information (i.e.
 		// THIRD_PARTY_API_KEY) we'll just not show any values for
 		// anything not controlled by us.
-		for k, v := range environ.ToMap() {
-			_, ok := bootstrapConfigEnvChanges[k]
-			if ok {
+		for _, k := range diff.Names() {
+			if _, ok := diff.Removed[k]; ok {
+				b.shell.Commentf("%s unset", k)
+			} else if v, ok := bootstrapConfigEnvChanges[k]; ok {
 				b.shell.Commentf("%s is now %q", k, v)
 			} else {
 				b.shell.Commentf("%s changed", k)
@@ -183,29 +597,73 @@ func (b *Bootstrap) applyEnvironmentChanges(environ *env.Environment, dir string
 
 		// Now that we've finished telling the user what's changed,
 		// let's mutate the current shell environment to include all
-		// the new values.
-		b.shell.Env = b.shell.Env.Merge(environ)
+		// the new values, and drop the ones that were unset.
+		b.shell.Env = diff.Apply(b.shell.Env)
 	}
 }
 
-// Returns the absolute path to a global hook
+// Returns the absolute path to a global hook. If the pipeline's hooks
+// overlays have the hook too, the last of them is used instead, which is
+// what's wanted for the hooks that there can only be one of.
 func (b *Bootstrap) globalHookPath(name string) string {
-	return filepath.Join(b.HooksPath, normalizeScriptFileName(name))
+	paths := b.globalHookPaths(name)
+	for i := len(paths) - 1; i > 0; i-- {
+		if fileExists(paths[i]) {
+			return paths[i]
+		}
+	}
+	return paths[0]
+}
+
+// Returns the absolute paths to a global hook, the agent's first and then
+// those of the hooks overlays that match the pipeline, in the order they're
+// configured
+func (b *Bootstrap) globalHookPaths(name string) []string {
+	paths := []string{hookFilePath(b.HooksPath, name)}
+
+	for _, value := range b.HooksOverlays {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+
+		overlay, err := agent.ParseHooksOverlay(value)
+		if err != nil {
+			b.shell.Warningf("Ignoring hooks overlay: %v", err)
+			continue
+		}
+
+		if overlay.Matches(b.PipelineSlug, b.Repository) {
+			paths = append(paths, hookFilePath(overlay.Path, name))
+		}
+	}
+
+	return paths
 }
 
-// Executes a global hook
-func (b *Bootstrap) executeGlobalHook(name string) error {
-	return b.executeHook("global "+name, b.globalHookPath(name), nil)
+// Executes a global hook, followed by the hook in each of the pipeline's
+// hooks overlays
+func (b *Bootstrap) executeGlobalHook(ctx context.Context, name string) error {
+	for i, path := range b.globalHookPaths(name) {
+		label := "global " + name
+		if i > 0 {
+			label = "overlay " + name
+		}
+
+		if err := b.executeHook(ctx, label, path, nil); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Returns the absolute path to a local hook
 func (b *Bootstrap) localHookPath(name string) string {
-	return filepath.Join(b.shell.Getwd(), ".buildkite", "hooks", normalizeScriptFileName(name))
+	return hookFilePath(filepath.Join(b.shell.Getwd(), ".buildkite", "hooks"), name)
 }
 
 // Executes a local hook
-func (b *Bootstrap) executeLocalHook(name string) error {
-	return b.executeHook("local "+name, b.localHookPath(name), nil)
+func (b *Bootstrap) executeLocalHook(ctx context.Context, name string) error {
+	return b.executeJobHook(ctx, "local "+name, b.localHookPath(name), nil)
 }
 
 // Returns whether or not a file exists on the filesystem. We consider any
@@ -225,27 +683,82 @@ func normalizeScriptFileName(filename string) string {
 	return filename
 }
 
+// Returns the name of the directory a repository is mirrored in
+func dirForRepository(repository string) string {
+	badCharsPattern := regexp.MustCompile("[[:^alnum:]]+")
+	return strings.Trim(badCharsPattern.ReplaceAllString(repository, "-"), "-")
+}
+
 func dirForAgentName(agentName string) string {
 	badCharsPattern := regexp.MustCompile("[[:^alnum:]]")
 	return badCharsPattern.ReplaceAllString(agentName, "-")
 }
 
-// Given a repository, it will add the host to the set of SSH known_hosts on the machine
-func addRepositoryHostToSSHKnownHosts(sh *shell.Shell, repository string) {
+// Given a repository, it will add the host to the set of SSH known_hosts on
+// the machine. Only a host key that can't be trusted is an error, so the
+// checkout fails with why rather than ssh prompting for it.
+func (b *Bootstrap) addRepositoryHostToSSHKnownHosts(ctx context.Context, repository string) error {
 	if fileExists(repository) {
-		return
+		return nil
 	}
 
-	knownHosts, err := findKnownHosts(sh)
+	knownHosts, err := b.findKnownHosts()
 	if err != nil {
-		sh.Warningf("Failed to find SSH known_hosts file: %v", err)
-		return
+		b.shell.Warningf("Failed to find SSH known_hosts file: %v", err)
+		return nil
 	}
 
-	if err = knownHosts.AddFromRepository(repository); err != nil {
-		sh.Warningf("Error adding to known_hosts: %v", err)
-		return
+	if err = knownHosts.AddFromRepository(ctx, repository); err != nil {
+		if _, ok := err.(*hostKeyError); ok {
+			return err
+		}
+		b.shell.Warningf("Error adding to known_hosts: %v", err)
 	}
+
+	return nil
+}
+
+// Adds the agent's SSH known hosts to known_hosts before anything is checked
+// out, verifying the ones with pinned fingerprints
+func (b *Bootstrap) addConfiguredSSHKnownHosts(ctx context.Context) error {
+	hosts, _, err := parseSSHKnownHosts(b.SSHKnownHosts)
+	if err != nil || len(hosts) == 0 {
+		return err
+	}
+
+	knownHosts, err := b.findKnownHosts()
+	if err != nil {
+		b.shell.Warningf("Failed to find SSH known_hosts file: %v", err)
+		return nil
+	}
+
+	for _, host := range hosts {
+		if err := knownHosts.Add(ctx, host); err != nil {
+			if _, ok := err.(*hostKeyError); ok {
+				return err
+			}
+			b.shell.Warningf("Failed to add %s to known_hosts: %v", host, err)
+		}
+	}
+
+	return nil
+}
+
+// Returns the known_hosts file, with the fingerprints the agent pins
+func (b *Bootstrap) findKnownHosts() (*knownHosts, error) {
+	kh, err := findKnownHosts(b.shell)
+	if err != nil {
+		return nil, err
+	}
+
+	_, pinned, err := parseSSHKnownHosts(b.SSHKnownHosts)
+	if err != nil {
+		return nil, err
+	}
+	kh.Pinned = pinned
+	kh.Strict = b.SSHHostKeyVerification == hostKeyStrict
+
+	return kh, nil
 }
 
 // Makes sure a file is executable
@@ -267,9 +780,9 @@ func addExecutePermissionToFile(filename string) error {
 
 // setUp is run before all the phases run. It's responsible for initializing the
 // bootstrap environment
-func (b *Bootstrap) setUp() error {
+func (b *Bootstrap) setUp(ctx context.Context) error {
 	// Create an empty env for us to keep track of our env changes in
-	b.shell.Env = env.FromSlice(os.Environ())
+	b.shell.Env = env.FromSlice(b.environ())
 
 	// Add the $BUILDKITE_BIN_PATH to the $PATH if we've been given one
 	if b.BinPath != "" {
@@ -291,198 +804,567 @@ func (b *Bootstrap) setUp() error {
 	// Disable any interactive Git/SSH prompting
 	b.shell.Env.Set("GIT_TERMINAL_PROMPT", "0")
 
+	if b.SSHFingerprintVerification {
+		if err := b.addConfiguredSSHKnownHosts(ctx); err != nil {
+			return err
+		}
+	}
+
 	// It's important to do this before checking out plugins, in case you want
 	// to use the global environment hook to whitelist the plugins that are
 	// allowed to be used.
-	return b.executeGlobalHook("environment")
+	return b.executeGlobalHook(ctx, "environment")
 }
 
 // tearDown is called before the bootstrap exits, even on error
-func (b *Bootstrap) tearDown() error {
-	if err := b.executeGlobalHook("pre-exit"); err != nil {
+// Returns the environment the job starts with
+func (b *Bootstrap) environ() []string {
+	if b.Environ != nil {
+		return b.Environ
+	}
+	return os.Environ()
+}
+
+func (b *Bootstrap) tearDown(ctx context.Context) error {
+	err := b.executePreExitHooks(ctx)
+
+	// Support deprecated BUILDKITE_DOCKER* env vars. The containers are
+	// cleaned up even if a pre-exit hook failed, so they aren't left running.
+	if hasDeprecatedDockerIntegration(b.shell) {
+		dockerErr := tearDownDeprecatedDockerIntegration(ctx, b.shell, b.isCancelled())
+		if err == nil {
+			err = dockerErr
+		}
+	}
+
+	return err
+}
+
+// Returns the context to tear down with, which isn't done as soon as ctx is.
+// ctx is done when whatever the job was running is killed, and the pre-exit
+// hooks still need to run then, so they get the cancel grace period of their
+// own before they're killed too.
+func (b *Bootstrap) tearDownContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	tearDownCtx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-tearDownCtx.Done():
+			return
+		}
+
+		gracePeriod := time.Duration(b.CancelGracePeriod) * time.Second
+		if gracePeriod <= 0 {
+			gracePeriod = 10 * time.Second
+		}
+
+		select {
+		case <-time.After(gracePeriod):
+			cancel()
+		case <-tearDownCtx.Done():
+		}
+	}()
+
+	return tearDownCtx, cancel
+}
+
+func (b *Bootstrap) executePreExitHooks(ctx context.Context) error {
+	if err := b.executeGlobalHook(ctx, "pre-exit"); err != nil {
+		return err
+	}
+
+	if err := b.executeLocalHook(ctx, "pre-exit"); err != nil {
 		return err
 	}
 
-	if err := b.executeLocalHook("pre-exit"); err != nil {
+	return b.executePluginHook(ctx, "pre-exit")
+}
+
+// PluginPhase is where plugins that weren't filtered in the Environment phase are
+// checked out and made available to later phases
+func (b *Bootstrap) PluginPhase(ctx context.Context) error {
+	if b.Plugins == "" {
+		return nil
+	}
+
+	b.shell.Headerf("Setting up plugins")
+
+	// Make sure we have a plugin path before trying to do anything
+	if b.PluginsPath == "" {
+		return fmt.Errorf("Can't checkout plugins without a `plugins-path`")
+	}
+
+	if b.Debug {
+		b.shell.Commentf("Plugin JSON is %s", b.Plugins)
+	}
+
+	// Check if we can run plugins (disabled via --no-plugins)
+	if b.Plugins != "" && !b.Config.PluginsEnabled {
+		return fmt.Errorf("This agent isn't allowed to run plugins. To allow this, re-run this agent without the `--no-plugins` option.")
+	}
+
+	plugins, err := agent.CreatePluginsFromJSON(b.Plugins)
+	if err != nil {
+		return errors.Wrap(err, "Failed to parse plugin definition")
+	}
+
+	// Make sure the agent allows all the plugins before checking any of
+	// them out
+	for _, p := range plugins {
+		if err := b.checkPluginAllowed(p); err != nil {
+			return &PluginError{Plugin: p.Name(), Err: err}
+		}
+	}
+
+	b.plugins = make([]*pluginCheckout, len(plugins))
+
+	for idx, p := range plugins {
+		checkout, err := b.checkoutPlugin(ctx, p)
+		if err != nil {
+			return &PluginError{Plugin: p.Name(), Err: errors.Wrapf(err, "Failed to checkout plugin %s", p.Name())}
+		}
+
+		if err = b.verifyPlugin(ctx, checkout); err != nil {
+			return &PluginError{Plugin: p.Name(), Err: errors.Wrapf(err, "Failed to verify plugin %s", p.Name())}
+		}
+
+		b.plugins[idx] = checkout
+	}
+
+	// Make sure the plugins are allowed to replace any phases they do
+	if err := b.checkPluginPhaseOverrides(); err != nil {
+		return &PluginError{Err: err}
+	}
+
+	// Now we can run plugin environment hooks too
+	return b.executePluginHook(ctx, "environment")
+}
+
+// Executes a named hook on all plugins that have it
+func (b *Bootstrap) executePluginHook(ctx context.Context, name string) error {
+	for _, p := range b.plugins {
+		path, err := p.HookPath(name)
+		if err != nil {
+			return err
+		}
+
+		env, _ := p.ConfigurationToEnvironment()
+		if err := b.executeJobHook(ctx, "plugin "+p.Label()+" "+name, path, env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// If any plugin has a hook by this name
+func (b *Bootstrap) pluginHookExists(name string) bool {
+	for _, p := range b.plugins {
+		if p.HasHook(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the plugins that replace a phase of the job with their own hook. Only
+// one plugin can replace each phase, and the agent can deny plugins from
+// replacing them with `denied-plugin-phases`.
+func (b *Bootstrap) checkPluginPhaseOverrides() error {
+	for _, denied := range b.DeniedPluginPhases {
+		if !isPluginPhase(denied) {
+			return fmt.Errorf("Unknown phase \"%s\" in `denied-plugin-phases`, it can be one of %s", denied, strings.Join(pluginPhases, ", "))
+		}
+	}
+
+	for _, phase := range pluginPhases {
+		var labels []string
+		for _, p := range b.plugins {
+			if p.HasHook(phase) {
+				labels = append(labels, fmt.Sprintf("\"%s\"", p.Label()))
+			}
+		}
+
+		if len(labels) == 0 {
+			continue
+		}
+
+		if len(labels) > 1 {
+			return fmt.Errorf("Only one plugin can replace the %s phase, but plugins %s all have a %s hook", phase, strings.Join(labels, ", "), phase)
+		}
+
+		for _, denied := range b.DeniedPluginPhases {
+			if denied == phase {
+				return fmt.Errorf("Plugin %s isn't allowed to replace the %s phase on this agent, as it's in `denied-plugin-phases`", labels[0], phase)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Checkout a given plugin to the plugins directory and return that directory.
+// The plugins directory is shared between all the jobs on the host, so plugins
+// are cloned to a temporary directory and then moved into place once they're
+// complete, which means other jobs never see a partial checkout.
+func (b *Bootstrap) checkoutPlugin(ctx context.Context, p *agent.Plugin) (*pluginCheckout, error) {
+	// Get the identifer for the plugin
+	id, err := p.Identifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.IsOCI() {
+		return b.checkoutOCIPlugin(p, id)
+	}
+
+	repo, err := p.Repository()
+	if err != nil {
+		return nil, err
+	}
+
+	if b.SSHFingerprintVerification {
+		if err := b.addRepositoryHostToSSHKnownHosts(ctx, repo); err != nil {
+			return nil, err
+		}
+	}
+
+	key := b.pluginCacheKey(ctx, p, id, repo)
+
+	// Create a path to the plugin
+	directory := filepath.Join(b.PluginsPath, key)
+	pluginGitDirectory := filepath.Join(directory, ".git")
+	checkout := &pluginCheckout{Plugin: p, Path: directory}
+
+	// Make the directory
+	err = os.MkdirAll(b.PluginsPath, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock this particular plugin while we check it out, or record that an
+	// existing checkout is being used, so the plugin cache can't be cleaned
+	// of it in the meantime
+	pluginCheckoutHook, err := shell.LockFileWithTimeout(b.shell, filepath.Join(b.PluginsPath, key+".lock"), time.Minute*5)
+	if err != nil {
+		return nil, err
+	}
+	defer pluginCheckoutHook.Unlock()
+
+	// Has it already been checked out?
+	if fileExists(pluginGitDirectory) {
+		b.shell.Commentf("Plugin \"%s\" already checked out", p.Label())
+		touchPluginCheckout(directory)
+		return checkout, nil
+	}
+
+	// A directory without a .git folder is left over from an older agent
+	// that was interrupted part way through a checkout
+	if fileExists(directory) {
+		if err = os.RemoveAll(directory); err != nil {
+			return nil, err
+		}
+	}
+
+	tempDirectory, err := ioutil.TempDir(b.PluginsPath, key+pluginCheckoutTempSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDirectory)
+
+	b.shell.Commentf("Plugin \"%s\" will be checked out to \"%s\"", p.Location, directory)
+
+	if b.Debug {
+		b.shell.Commentf("Checking if \"%s\" is a local repository", repo)
+	}
+
+	if err = b.clonePlugin(ctx, p, repo, tempDirectory); err != nil {
+		return nil, err
+	}
+
+	if err = os.Rename(tempDirectory, directory); err != nil {
+		return nil, err
+	}
+
+	return checkout, nil
+}
+
+// Pulls a plugin distributed as an OCI image into the plugins directory. Like
+// plugins cloned from git, tags can be moved so the directory includes the
+// digest of the image unless the plugin is pinned to one.
+func (b *Bootstrap) checkoutOCIPlugin(p *agent.Plugin, id string) (*pluginCheckout, error) {
+	client, err := newOCIClient(p, b.shell.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, manifest, err := client.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve plugin \"%s\" (%v)", p.Label(), err)
+	}
+
+	key := id
+	if !p.IsPinnedToDigest() {
+		key = id + "-" + strings.TrimPrefix(digest, "sha256:")[:10]
+	}
+
+	directory := filepath.Join(b.PluginsPath, key)
+	checkout := &pluginCheckout{Plugin: p, Path: directory}
+
+	// Images are unpacked into a temporary directory first, so if the
+	// directory exists it's complete
+	if fileExists(directory) {
+		b.shell.Commentf("Plugin \"%s\" already pulled", p.Label())
+		touchPluginCheckout(directory)
+		return checkout, nil
+	}
+
+	err = os.MkdirAll(b.PluginsPath, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	pluginCheckoutHook, err := shell.LockFileWithTimeout(b.shell, filepath.Join(b.PluginsPath, key+".lock"), time.Minute*5)
+	if err != nil {
+		return nil, err
+	}
+	defer pluginCheckoutHook.Unlock()
+
+	if fileExists(directory) {
+		b.shell.Commentf("Plugin \"%s\" already pulled", p.Label())
+		touchPluginCheckout(directory)
+		return checkout, nil
+	}
+
+	tempDirectory, err := ioutil.TempDir(b.PluginsPath, key+pluginCheckoutTempSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDirectory)
+
+	b.shell.Commentf("Pulling plugin \"%s\" (%s) to \"%s\"", p.Label(), digest, directory)
+
+	if err = client.Unpack(manifest, tempDirectory); err != nil {
+		return nil, fmt.Errorf("Failed to unpack plugin \"%s\" (%v)", p.Label(), err)
+	}
+
+	if err = os.Rename(tempDirectory, directory); err != nil {
+		return nil, err
+	}
+
+	return checkout, nil
+}
+
+// Clones the plugin into a directory and switches to the right version
+func (b *Bootstrap) clonePlugin(ctx context.Context, p *agent.Plugin, repo string, directory string) error {
+	// Switch to the plugin directory
+	previousWd := b.shell.Getwd()
+	if err := b.shell.Chdir(directory); err != nil {
 		return err
 	}
 
-	if err := b.executePluginHook("pre-exit"); err != nil {
+	// Switch back to the previous working directory
+	defer b.shell.Chdir(previousWd)
+
+	b.shell.Commentf("Switching to the plugin directory")
+
+	// Plugin clones shouldn't use custom GitCloneFlags
+	if err := b.shell.Run(ctx, "git", "clone", "-v", "--", repo, "."); err != nil {
 		return err
 	}
 
-	// Support deprecated BUILDKITE_DOCKER* env vars
-	if hasDeprecatedDockerIntegration(b.shell) {
-		return tearDownDeprecatedDockerIntegration(b.shell)
+	// Switch to the version if we need to
+	if p.Version != "" {
+		b.shell.Commentf("Checking out `%s`", p.Version)
+		if err := b.shell.Run(ctx, "git", "checkout", "-f", p.Version); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// PluginPhase is where plugins that weren't filtered in the Environment phase are
-// checked out and made available to later phases
-func (b *Bootstrap) PluginPhase() error {
-	if b.Plugins == "" {
-		return nil
-	}
-
-	b.shell.Headerf("Setting up plugins")
-
-	// Make sure we have a plugin path before trying to do anything
-	if b.PluginsPath == "" {
-		return fmt.Errorf("Can't checkout plugins without a `plugins-path`")
-	}
+// A full commit SHA, either SHA-1 or the SHA-256 of repositories that use it,
+// which there's no need to ask the remote about
+var fullCommitPattern = regexp.MustCompile(`^([0-9a-fA-F]{40}|[0-9a-fA-F]{64})$`)
 
-	if b.Debug {
-		b.shell.Commentf("Plugin JSON is %s", b.Plugins)
+// Returns the name of the directory a plugin is checked out into. Branches
+// and tags can be moved, so unless a plugin is pinned to a commit the key
+// includes the commit the ref currently points at, which means a new checkout
+// happens whenever it changes.
+func (b *Bootstrap) pluginCacheKey(ctx context.Context, p *agent.Plugin, id string, repo string) string {
+	ref := p.Version
+	if p.IsPinnedToCommit() || fullCommitPattern.MatchString(ref) {
+		return id
 	}
 
-	// Check if we can run plugins (disabled via --no-plugins)
-	if b.Plugins != "" && !b.Config.PluginsEnabled {
-		return fmt.Errorf("This agent isn't allowed to run plugins. To allow this, re-run this agent without the `--no-plugins` option.")
+	if ref == "" {
+		ref = "HEAD"
 	}
 
-	plugins, err := agent.CreatePluginsFromJSON(b.Plugins)
+	output, err := b.shell.RunAndCapture(ctx, "git", "ls-remote", "--", repo, ref, ref+"^{}")
 	if err != nil {
-		return errors.Wrap(err, "Failed to parse plugin definition")
+		b.shell.Warningf("Failed to find the commit for `%s` of plugin \"%s\", using any existing checkout (%s)", ref, p.Label(), err)
+		return id
 	}
 
-	b.plugins = make([]*pluginCheckout, len(plugins))
+	commit := resolveLsRemoteCommit(output)
+	if commit == "" {
+		// Probably an abbreviated commit, which git ls-remote can't
+		// resolve but also can't change
+		return id
+	}
 
-	for idx, p := range plugins {
-		checkout, err := b.checkoutPlugin(p)
-		if err != nil {
-			return errors.Wrapf(err, "Failed to checkout plugin %s", p.Name())
+	return id + "-" + commit[:10]
+}
 
-		}
-		b.plugins[idx] = checkout
+// Checks the plugin against the agent's allowed and denied plugin patterns
+func (b *Bootstrap) checkPluginAllowed(p *agent.Plugin) error {
+	repo, err := p.Repository()
+	if err != nil {
+		return err
 	}
 
-	// Now we can run plugin environment hooks too
-	return b.executePluginHook("environment")
-}
+	denied, err := p.MatchesAny(b.DeniedPlugins)
+	if err != nil {
+		return err
+	}
+	if denied {
+		return fmt.Errorf("Plugin \"%s\" from %s isn't allowed to run on this agent, as it matches `denied-plugins`", p.Label(), repo)
+	}
 
-// Executes a named hook on all plugins that have it
-func (b *Bootstrap) executePluginHook(name string) error {
-	for _, p := range b.plugins {
-		path, err := p.HookPath(name)
+	if len(b.AllowedPlugins) > 0 {
+		allowed, err := p.MatchesAny(b.AllowedPlugins)
 		if err != nil {
 			return err
 		}
-
-		env, _ := p.ConfigurationToEnvironment()
-		if err := b.executeHook("plugin "+p.Label()+" "+name, path, env); err != nil {
-			return err
+		if !allowed {
+			return fmt.Errorf("Plugin \"%s\" from %s isn't allowed to run on this agent, as it doesn't match `allowed-plugins`", p.Label(), repo)
 		}
 	}
+
 	return nil
 }
 
-// If any plugin has a hook by this name
-func (b *Bootstrap) pluginHookExists(name string) bool {
-	for _, p := range b.plugins {
-		if p.HasHook(name) {
-			return true
+// Checks that a plugin checkout is the commit and contents it was pinned to
+func (b *Bootstrap) verifyPlugin(ctx context.Context, checkout *pluginCheckout) error {
+	if !checkout.IsPinnedToCommit() && !checkout.IsPinnedToDigest() && checkout.Sha256 == "" {
+		if b.StrictPluginVerification {
+			return fmt.Errorf("Plugin \"%s\" must be pinned to a commit, digest or have a sha256 as this agent has strict plugin verification enabled", checkout.Label())
 		}
+		return nil
 	}
-	return false
-}
 
-// Checkout a given plugin to the plugins directory and return that directory
-func (b *Bootstrap) checkoutPlugin(p *agent.Plugin) (*pluginCheckout, error) {
-	// Get the identifer for the plugin
-	id, err := p.Identifier()
-	if err != nil {
-		return nil, err
+	// The digest of an image was checked when it was pulled
+	if checkout.IsPinnedToDigest() {
+		b.shell.Commentf("Verified plugin is at digest %s", checkout.Version)
 	}
 
-	// Create a path to the plugin
-	directory := filepath.Join(b.PluginsPath, id)
-	pluginGitDirectory := filepath.Join(directory, ".git")
-	checkout := &pluginCheckout{Plugin: p, Path: directory}
+	if checkout.IsPinnedToCommit() {
+		commit, err := b.shell.RunAndCapture(ctx, "git", "-C", checkout.Path, "rev-parse", "HEAD")
+		if err != nil {
+			return err
+		}
 
-	// Has it already been checked out?
-	if fileExists(pluginGitDirectory) {
-		b.shell.Commentf("Plugin \"%s\" already checked out", p.Label())
-		return checkout, nil
-	}
+		if commit != checkout.Version {
+			return fmt.Errorf("Plugin is at commit %s, expected %s", commit, checkout.Version)
+		}
 
-	// Make the directory
-	err = os.MkdirAll(directory, 0777)
-	if err != nil {
-		return nil, err
+		b.shell.Commentf("Verified plugin is at commit %s", commit)
 	}
 
-	// Try and lock this particular plugin while we check it out (we create
-	// the file outside of the plugin directory so git clone doesn't have
-	// a cry about the directory not being empty)
-	pluginCheckoutHook, err := shell.LockFileWithTimeout(b.shell, filepath.Join(b.PluginsPath, id+".lock"), time.Minute*5)
-	if err != nil {
-		return nil, err
-	}
-	defer pluginCheckoutHook.Unlock()
+	if checkout.Sha256 != "" {
+		checksum, err := pluginChecksum(checkout.Path)
+		if err != nil {
+			return err
+		}
 
-	// Once we've got the lock, we need to make sure another process didn't already
-	// checkout the plugin
-	if fileExists(pluginGitDirectory) {
-		b.shell.Commentf("Plugin \"%s\" already checked out", p.Label())
-		return checkout, nil
-	}
+		if checksum != checkout.Sha256 {
+			return fmt.Errorf("Plugin has a sha256 of %s, expected %s", checksum, checkout.Sha256)
+		}
 
-	repo, err := p.Repository()
-	if err != nil {
-		return nil, err
+		b.shell.Commentf("Verified plugin has a sha256 of %s", checksum)
 	}
 
-	b.shell.Commentf("Plugin \"%s\" will be checked out to \"%s\"", p.Location, directory)
+	return nil
+}
 
-	if b.Debug {
-		b.shell.Commentf("Checking if \"%s\" is a local repository", repo)
-	}
+// Creates or updates the bare mirror of the repository that's shared by all
+// the jobs on the host, and returns it's path so clones can use it as a
+// reference rather than downloading everything from the remote again.
+func (b *Bootstrap) updateGitMirror(ctx context.Context) (string, error) {
+	mirrorDir := filepath.Join(b.GitMirrorsPath, dirForRepository(b.Repository))
 
-	// Switch to the plugin directory
-	previousWd := b.shell.Getwd()
-	if err = b.shell.Chdir(directory); err != nil {
-		return nil, err
+	if err := os.MkdirAll(b.GitMirrorsPath, 0777); err != nil {
+		return "", err
 	}
 
-	// Switch back to the previous working directory
-	defer b.shell.Chdir(previousWd)
+	// Only one job at a time can clone or update a mirror. Locks on network
+	// filesystems like NFS can be left behind by other machines, so rather
+	// than failing the job it's cloned without the mirror.
+	lockTimeout := time.Second * time.Duration(b.GitMirrorsLockTimeout)
+	mirrorLock, err := shell.LockFileWithTimeout(b.shell, mirrorDir+".lock", lockTimeout)
+	if err == context.DeadlineExceeded {
+		b.shell.Warningf("The mirror in \"%s\" has been locked for longer than %v, cloning without it", mirrorDir, lockTimeout)
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer mirrorLock.Unlock()
 
-	b.shell.Commentf("Switching to the plugin directory")
+	if !fileExists(mirrorDir) {
+		b.shell.Commentf("Creating a mirror of the repository in \"%s\"", mirrorDir)
+		return mirrorDir, b.cloneGitMirror(ctx, mirrorDir)
+	}
 
-	if b.SSHFingerprintVerification {
-		addRepositoryHostToSSHKnownHosts(b.shell, repo)
+	// Mirrors that haven't been updated in a while are checked before
+	// they're used, as they might have been left broken
+	if b.isGitMirrorStale(mirrorDir) {
+		b.shell.Commentf("The mirror in \"%s\" hasn't been updated for over %v, checking it", mirrorDir, b.gitMirrorsStaleAfter())
+		if err := b.repairGitMirror(ctx, mirrorDir); err != nil {
+			return "", err
+		}
 	}
 
-	// Plugin clones shouldn't use custom GitCloneFlags
-	if err = b.shell.Run("git", "clone", "-v", "--", repo, "."); err != nil {
-		return nil, err
+	// Another job might have already fetched the commit we need
+	if b.Commit != "HEAD" {
+		if _, err := b.shell.RunAndCapture(ctx, "git", "--git-dir", mirrorDir, "cat-file", "-e", b.Commit+"^{commit}"); err == nil {
+			b.shell.Commentf("Mirror in \"%s\" already has commit %s", mirrorDir, b.Commit)
+			return mirrorDir, nil
+		}
 	}
 
-	// Switch to the version if we need to
-	if p.Version != "" {
-		b.shell.Commentf("Checking out `%s`", p.Version)
-		if err = b.shell.Run("git", "checkout", "-f", p.Version); err != nil {
-			return nil, err
+	b.shell.Commentf("Updating the mirror of the repository in \"%s\"", mirrorDir)
+
+	if err := b.fetchGitMirror(ctx, mirrorDir); err != nil {
+		// The update might have failed because the mirror is broken,
+		// in which case it's cloned again
+		if !b.isGitMirrorHealthy(ctx, mirrorDir) {
+			b.shell.Warningf("The mirror in \"%s\" is corrupt, cloning it again", mirrorDir)
+			return mirrorDir, b.recloneGitMirror(ctx, mirrorDir)
 		}
+		return "", err
 	}
 
-	return checkout, nil
+	return mirrorDir, nil
 }
 
 // CheckoutPhase creates the build directory and makes sure we're running the
 // build at the right commit.
-func (b *Bootstrap) CheckoutPhase() error {
-	if err := b.executeGlobalHook("pre-checkout"); err != nil {
+func (b *Bootstrap) CheckoutPhase(ctx context.Context) error {
+	if err := b.configureGitCredentialsHelper(); err != nil {
 		return err
 	}
 
-	if err := b.executeLocalHook("pre-checkout"); err != nil {
+	if err := b.executeGlobalHook(ctx, "pre-checkout"); err != nil {
 		return err
 	}
 
-	if err := b.executePluginHook("pre-checkout"); err != nil {
+	if err := b.executeLocalHook(ctx, "pre-checkout"); err != nil {
+		return err
+	}
+
+	if err := b.executePluginHook(ctx, "pre-checkout"); err != nil {
 		return err
 	}
 
@@ -511,6 +1393,10 @@ func (b *Bootstrap) CheckoutPhase() error {
 
 	b.shell.Headerf("Preparing build directory")
 
+	if err := b.takeBackCheckout(checkoutPath); err != nil {
+		return err
+	}
+
 	// Create the build directory
 	if !fileExists(checkoutPath) {
 		if err := createCheckoutDir(); err != nil {
@@ -523,9 +1409,14 @@ func (b *Bootstrap) CheckoutPhase() error {
 		return err
 	}
 
-	// Check if the checkout is working, sometimes we get broken git checkouts if there was a previous failure
-	if _, err := gitRevParse(b.shell); err != nil {
-		b.shell.Commentf("Previous checkout seems to be an invalid git repository, deleting and re-creating")
+	sc, err := b.sourceControl()
+	if err != nil {
+		return err
+	}
+
+	// Check if the checkout is working, sometimes we get broken checkouts if there was a previous failure
+	if !sc.IsCheckout(ctx) {
+		b.shell.Commentf("Previous checkout seems to be an invalid repository, deleting and re-creating")
 		if err := removeCheckoutDir(); err != nil {
 			return err
 		}
@@ -534,24 +1425,25 @@ func (b *Bootstrap) CheckoutPhase() error {
 		}
 	}
 
-	// There can only be one checkout hook, either plugin or global, in that order
+	// There can only be one checkout hook, either plugin or global, in that
+	// order. Only one plugin can have one, which was checked with the plugins.
 	switch {
 	case b.pluginHookExists("checkout"):
-		if err := b.executePluginHook("checkout"); err != nil {
-			return err
+		if err := b.executePluginHook(ctx, "checkout"); err != nil {
+			return &CheckoutError{Err: err}
 		}
 	case fileExists(b.globalHookPath("checkout")):
-		if err := b.executeGlobalHook("checkout"); err != nil {
-			return err
+		if err := b.executeHook(ctx, "global checkout", b.globalHookPath("checkout"), nil); err != nil {
+			return &CheckoutError{Err: err}
 		}
 	default:
-		if err := b.defaultCheckoutPhase(); err != nil {
+		if err := b.defaultCheckoutPhase(ctx); err != nil {
 			// Just to be certain, if we aren't in debug mode, let's nuke the checkout directory
 			// so that a partial checkout doesn't poison future builds
 			if !b.Debug {
 				_ = removeCheckoutDir()
 			}
-			return err
+			return &CheckoutError{Err: err}
 		}
 	}
 
@@ -563,15 +1455,15 @@ func (b *Bootstrap) CheckoutPhase() error {
 	previousCheckoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
 
 	// Run post-checkout hooks
-	if err := b.executeGlobalHook("post-checkout"); err != nil {
+	if err := b.executeGlobalHook(ctx, "post-checkout"); err != nil {
 		return err
 	}
 
-	if err := b.executeLocalHook("post-checkout"); err != nil {
+	if err := b.executeLocalHook(ctx, "post-checkout"); err != nil {
 		return err
 	}
 
-	if err := b.executePluginHook("post-checkout"); err != nil {
+	if err := b.executePluginHook(ctx, "post-checkout"); err != nil {
 		return err
 	}
 
@@ -592,126 +1484,42 @@ func (b *Bootstrap) CheckoutPhase() error {
 
 // defaultCheckoutPhase is called by the CheckoutPhase if no global or plugin checkout
 // hook exists. It performs the default checkout on the Repository provided in the config
-func (b *Bootstrap) defaultCheckoutPhase() error {
-	if b.SSHFingerprintVerification {
-		addRepositoryHostToSSHKnownHosts(b.shell, b.Repository)
-	}
-
-	// Do we need to do a git clone?
-	existingGitDir := filepath.Join(b.shell.Getwd(), ".git")
-	if fileExists(existingGitDir) {
-		// Update the the origin of the repository so we can gracefully handle repository renames
-		if err := b.shell.Run("git", "remote", "set-url", "origin", b.Repository); err != nil {
-			return err
-		}
-	} else {
-		if err := gitClone(b.shell, b.GitCloneFlags, b.Repository, "."); err != nil {
-			return err
-		}
-	}
-
-	// Git clean prior to checkout
-	if err := gitClean(b.shell, b.GitCleanFlags, b.GitSubmodules); err != nil {
+func (b *Bootstrap) defaultCheckoutPhase(ctx context.Context) error {
+	sc, err := b.sourceControl()
+	if err != nil {
 		return err
 	}
 
-	// If a refspec is provided then use it instead.
-	// i.e. `refs/not/a/head`
-	if b.RefSpec != "" {
-		b.shell.Commentf("Fetch and checkout custom refspec")
-		if err := gitFetch(b.shell, "-v --prune", "origin", b.RefSpec); err != nil {
-			return err
-		}
-
-		if err := b.shell.Run("git", "checkout", "-f", b.Commit); err != nil {
-			return err
-		}
-
-		// GitHub has a special ref which lets us fetch a pull request head, whether
-		// or not there is a current head in this repository or another which
-		// references the commit. We presume a commit sha is provided. See:
-		// https://help.github.com/articles/checking-out-pull-requests-locally/#modifying-an-inactive-pull-request-locally
-	} else if b.PullRequest != "false" && strings.Contains(b.PipelineProvider, "github") {
-		b.shell.Commentf("Fetch and checkout pull request head")
-		refspec := fmt.Sprintf("refs/pull/%s/head", b.PullRequest)
-
-		if err := gitFetch(b.shell, "-v", "origin", refspec); err != nil {
-			return err
-		}
-
-		gitFetchHead, _ := b.shell.RunAndCapture("git", "rev-parse", "FETCH_HEAD")
-		b.shell.Commentf("FETCH_HEAD is now `%s`", gitFetchHead)
-
-		if err := b.shell.Run("git", "checkout", "-f", b.Commit); err != nil {
+	if b.SSHFingerprintVerification {
+		if err := b.addRepositoryHostToSSHKnownHosts(ctx, sc.Repository()); err != nil {
 			return err
 		}
+	}
 
-		// If the commit is "HEAD" then we can't do a commit-specific fetch and will
-		// need to fetch the remote head and checkout the fetched head explicitly.
-	} else if b.Commit == "HEAD" {
-		b.shell.Commentf("Fetch and checkout remote branch HEAD commit")
-		if err := gitFetch(b.shell, "-v --prune", "origin", b.Branch); err != nil {
+	// Cloning and fetching are retried if the network or the remote is
+	// having problems
+	err = b.retryTransientGitErrors(ctx, func() error {
+		if err := sc.Clone(ctx); err != nil {
 			return err
 		}
 
-		if err := b.shell.Run("git", "checkout", "-f", "FETCH_HEAD"); err != nil {
+		// Clean prior to checkout
+		if err := sc.Clean(ctx); err != nil {
 			return err
 		}
 
-		// Otherwise fetch and checkout the commit directly. Some repositories don't
-		// support fetching a specific commit so we fall back to fetching all heads
-		// and tags, hoping that the commit is included.
-	} else {
-		b.shell.Commentf("Fetch and checkout commit")
-		if err := gitFetch(b.shell, "-v", "origin", b.Commit); err != nil {
-			// By default `git fetch origin` will only fetch tags which are
-			// reachable from a fetches branch. git 1.9.0+ changed `--tags` to
-			// fetch all tags in addition to the default refspec, but pre 1.9.0 it
-			// excludes the default refspec.
-			gitFetchRefspec, _ := b.shell.RunAndCapture("git", "config", "remote.origin.fetch")
-			if err := gitFetch(b.shell, "-v --prune", "origin", gitFetchRefspec, "+refs/tags/*:refs/tags/*"); err != nil {
-				return err
-			}
-		}
-		if err := b.shell.Run("git", "checkout", "-f", b.Commit); err != nil {
-			return err
-		}
+		return sc.Fetch(ctx)
+	})
+	if err != nil {
+		return err
 	}
 
-	if b.GitSubmodules {
-		// submodules might need their fingerprints verified too
-		if b.SSHFingerprintVerification {
-			b.shell.Commentf("Checking to see if submodule urls need to be added to known_hosts")
-			submoduleRepos, err := gitEnumerateSubmoduleURLs(b.shell)
-			if err != nil {
-				b.shell.Warningf("Failed to enumerate git submodules: %v", err)
-			} else {
-				for _, repository := range submoduleRepos {
-					addRepositoryHostToSSHKnownHosts(b.shell, repository)
-				}
-			}
-		}
-
-		// `submodule sync` will ensure the .git/config
-		// matches the .gitmodules file.  The command
-		// is only available in git version 1.8.1, so
-		// if the call fails, continue the bootstrap
-		// script, and show an informative error.
-		if err := b.shell.Run("git", "submodule", "sync", "--recursive"); err != nil {
-			gitVersionOutput, _ := b.shell.RunAndCapture("git", "--version")
-			b.shell.Warningf("Failed to recursively sync git submodules. This is most likely because you have an older version of git installed (" + gitVersionOutput + ") and you need version 1.8.1 and above. If you're using submodules, it's highly recommended you upgrade if you can.")
-		}
-
-		if err := b.shell.Run("git", "submodule", "update", "--init", "--recursive", "--force"); err != nil {
-			return err
-		}
-		if err := b.shell.Run("git", "submodule", "foreach", "--recursive", "git", "reset", "--hard"); err != nil {
-			return err
-		}
+	if err := sc.Checkout(ctx); err != nil {
+		return err
 	}
 
-	// Git clean after checkout
-	if err := gitClean(b.shell, b.GitCleanFlags, b.GitSubmodules); err != nil {
+	// Clean after checkout
+	if err := sc.Clean(ctx); err != nil {
 		return err
 	}
 
@@ -725,23 +1533,18 @@ func (b *Bootstrap) defaultCheckoutPhase() error {
 	// we'll check to see if someone else has done
 	// it first.
 	b.shell.Commentf("Checking to see if Git data needs to be sent to Buildkite")
-	if _, err := b.shell.RunAndCapture("buildkite-agent", "meta-data", "exists", "buildkite:git:commit"); err != nil {
+	if _, err := b.shell.RunAndCapture(ctx, "buildkite-agent", "meta-data", "exists", "buildkite:git:commit"); err != nil {
 		b.shell.Commentf("Sending Git commit information back to Buildkite")
 
-		gitCommitOutput, err := b.shell.RunAndCapture("git", "--no-pager", "show", "HEAD", "-s", "--format=fuller", "--no-color")
-		if err != nil {
-			return err
-		}
-
-		gitBranchOutput, err := b.shell.RunAndCapture("git", "--no-pager", "branch", "--contains", "HEAD", "--no-color")
+		metadata, err := sc.Metadata(ctx)
 		if err != nil {
 			return err
 		}
 
-		if err = b.shell.Run("buildkite-agent", "meta-data", "set", "buildkite:git:commit", gitCommitOutput); err != nil {
+		if err = b.shell.Run(ctx, "buildkite-agent", "meta-data", "set", "buildkite:git:commit", metadata.Commit); err != nil {
 			return err
 		}
-		if err = b.shell.Run("buildkite-agent", "meta-data", "set", "buildkite:git:branch", gitBranchOutput); err != nil {
+		if err = b.shell.Run(ctx, "buildkite-agent", "meta-data", "set", "buildkite:git:branch", metadata.Branch); err != nil {
 			return err
 		}
 	}
@@ -749,37 +1552,84 @@ func (b *Bootstrap) defaultCheckoutPhase() error {
 	return nil
 }
 
+// How long to wait before the first retry of a transient git error, which
+// doubles for each retry after it
+var gitRetryInterval = 2 * time.Second
+
+// Runs fetch again if it fails with a transient git error, up to GitRetries
+// times, waiting longer before each attempt. If GitRetryReclone is set, the
+// checkout is removed before the last attempt so it's cloned from scratch, in
+// case the failures left it broken.
+func (b *Bootstrap) retryTransientGitErrors(ctx context.Context, fetch func() error) error {
+	attempts := b.GitRetries + 1
+
+	return retry.Do(func(s *retry.Stats) error {
+		if s.Attempt > 1 && s.Attempt == attempts && b.GitRetryReclone {
+			checkoutPath := b.shell.Getwd()
+			b.shell.Commentf("Removing %s to clone it again", checkoutPath)
+
+			if err := os.RemoveAll(checkoutPath); err != nil {
+				s.Break()
+				return fmt.Errorf("Failed to remove \"%s\" (%s)", checkoutPath, err)
+			}
+			if err := os.MkdirAll(checkoutPath, 0777); err != nil {
+				s.Break()
+				return err
+			}
+		}
+
+		err := fetch()
+		if err == nil {
+			return nil
+		}
+
+		// Only transient errors are worth trying again, and there's no
+		// point waiting after the last attempt
+		if !isTransientGitError(err) || s.Attempt >= attempts || ctx.Err() != nil {
+			s.Break()
+			return err
+		}
+
+		b.shell.Warningf("Git failed with what looks like a transient error (%s)", s)
+		return err
+	}, &retry.Config{Maximum: attempts, Interval: gitRetryInterval, Exponential: true, MaxInterval: 30 * time.Second})
+}
+
 // CommandPhase determines how to run the build, and then runs it
-func (b *Bootstrap) CommandPhase() error {
-	if err := b.executeGlobalHook("pre-command"); err != nil {
+func (b *Bootstrap) CommandPhase(ctx context.Context) error {
+	if err := b.executeGlobalHook(ctx, "pre-command"); err != nil {
 		return err
 	}
 
-	if err := b.executeLocalHook("pre-command"); err != nil {
+	if err := b.executeLocalHook(ctx, "pre-command"); err != nil {
 		return err
 	}
 
-	if err := b.executePluginHook("pre-command"); err != nil {
+	if err := b.executePluginHook(ctx, "pre-command"); err != nil {
 		return err
 	}
 
 	var commandExitError error
 
-	// There can only be one command hook, so we check them in order of plugin, local
+	// There can only be one command hook, so we check them in order of plugin,
+	// local then global. Only one plugin can have one, which was checked with
+	// the plugins.
 	switch {
 	case b.pluginHookExists("command"):
-		commandExitError = b.executePluginHook("command")
+		commandExitError = b.executePluginHook(ctx, "command")
 	case fileExists(b.localHookPath("command")):
-		commandExitError = b.executeLocalHook("command")
+		commandExitError = b.executeLocalHook(ctx, "command")
 	case fileExists(b.globalHookPath("command")):
-		commandExitError = b.executeGlobalHook("command")
+		// It runs in place of the job's command, so it's sandboxed like it
+		commandExitError = b.executeJobHook(ctx, "global command", b.globalHookPath("command"), nil)
 	default:
-		commandExitError = b.defaultCommandPhase()
+		commandExitError = b.defaultCommandPhase(ctx)
 	}
 
 	// Expand the command header if it fails
 	if commandExitError != nil {
 		b.shell.Printf("^^^ +++")
+		b.commandError = &CommandError{Err: commandExitError}
 	}
 
 	// Save the command exit status to the env so hooks + plugins can access it. If there is no error
@@ -787,15 +1637,15 @@ func (b *Bootstrap) CommandPhase() error {
 	b.shell.Env.Set("BUILDKITE_COMMAND_EXIT_STATUS", fmt.Sprintf("%d", shell.GetExitCode(commandExitError)))
 
 	// Run post-command hooks
-	if err := b.executeGlobalHook("post-command"); err != nil {
+	if err := b.executeGlobalHook(ctx, "post-command"); err != nil {
 		return err
 	}
 
-	if err := b.executeLocalHook("post-command"); err != nil {
+	if err := b.executeLocalHook(ctx, "post-command"); err != nil {
 		return err
 	}
 
-	if err := b.executePluginHook("post-command"); err != nil {
+	if err := b.executePluginHook(ctx, "post-command"); err != nil {
 		return err
 	}
 
@@ -803,12 +1653,19 @@ func (b *Bootstrap) CommandPhase() error {
 }
 
 // defaultCommandPhase is executed if there is no global or plugin command hook
-func (b *Bootstrap) defaultCommandPhase() error {
+func (b *Bootstrap) defaultCommandPhase(ctx context.Context) error {
 	// Make sure we actually have a command to run
 	if b.Command == "" {
 		return fmt.Errorf("No command has been defined. Please go to \"Pipeline Settings\" and configure your build step's \"Command\"")
 	}
 
+	// The command might be run in a sandbox, or with the deprecated
+	// BUILDKITE_DOCKER* env vars
+	executor, err := b.commandExecutor()
+	if err != nil {
+		return err
+	}
+
 	scriptFileName := strings.Replace(b.Command, "\n", "", -1)
 	pathToCommand, err := filepath.Abs(filepath.Join(b.shell.Getwd(), scriptFileName))
 	commandIsScript := err == nil && fileExists(pathToCommand)
@@ -850,31 +1707,17 @@ func (b *Bootstrap) defaultCommandPhase() error {
 	} else {
 		headerLabel = "Running command"
 
-		// Create a build script that will output each line of the command, and run it.
-		var buildScriptContents string
-		if runtime.GOOS == "windows" {
-			buildScriptContents = "@echo off\n"
-			for _, k := range strings.Split(b.Command, "\n") {
-				if k != "" {
-					buildScriptContents = buildScriptContents +
-						fmt.Sprintf("ECHO %s\n", shell.BatchEscape("\033[90m>\033[0m "+k)) +
-						k + "\n" +
-						"if %errorlevel% neq 0 exit /b %errorlevel%\n"
-				}
-			}
-		} else {
-			buildScriptContents = "#!/bin/bash\nset -e\n"
-			for _, k := range strings.Split(b.Command, "\n") {
-				if k != "" {
-					buildScriptContents = buildScriptContents +
-						fmt.Sprintf("echo '\033[90m$\033[0m %s'\n", strings.Replace(k, "'", "'\\''", -1)) +
-						k + "\n"
-				}
-			}
+		// The script is written for the shell that will run it
+		scriptType, err := b.commandScriptType()
+		if err != nil {
+			return err
 		}
 
+		// Create a build script that will output each line of the command, and run it.
+		buildScriptContents := commandScript(scriptType, b.Command)
+
 		// Create a temporary file where we'll run a program from
-		buildScriptPath = filepath.Join(b.shell.Getwd(), normalizeScriptFileName("buildkite-script-"+b.JobID))
+		buildScriptPath = filepath.Join(b.shell.Getwd(), "buildkite-script-"+b.JobID+scriptExtension(scriptType))
 
 		if b.Debug {
 			b.shell.Headerf("Preparing build script")
@@ -883,7 +1726,7 @@ func (b *Bootstrap) defaultCommandPhase() error {
 		}
 
 		// Write the build script to disk
-		err := ioutil.WriteFile(buildScriptPath, []byte(buildScriptContents), 0644)
+		err = ioutil.WriteFile(buildScriptPath, []byte(buildScriptContents), 0644)
 		if err != nil {
 			return errors.Wrapf(err, "Failed to write to \"%s\"", buildScriptPath)
 		}
@@ -900,18 +1743,39 @@ func (b *Bootstrap) defaultCommandPhase() error {
 		b.shell.Promptf("%s", promptDisplay)
 	}
 
-	// Support deprecated BUILDKITE_DOCKER* env vars
-	if hasDeprecatedDockerIntegration(b.shell) {
-		if b.Debug {
-			b.shell.Commentf("Detected deprecated docker environment variables")
-		}
-		return runDeprecatedDockerIntegration(b.shell, buildScriptPath)
+	return executor.Run(ctx, buildScriptPath)
+}
+
+// Runs the test-summary command on the test result paths, which annotates the
+// build with any tests that failed
+func (b *Bootstrap) summarizeTestResults(ctx context.Context) error {
+	if b.isCancelled() || !b.hasCheckout || b.TestResultPaths == "" {
+		return nil
+	}
+
+	b.shell.Headerf("Summarizing test results")
+	return b.shell.Run(ctx, "buildkite-agent", "test-summary", b.TestResultPaths)
+}
+
+// Runs the coverage command on the coverage paths, which uploads the reports
+// and annotates the build with how much is covered
+func (b *Bootstrap) reportCoverage(ctx context.Context) error {
+	if b.isCancelled() || !b.hasCheckout || b.CoveragePaths == "" {
+		return nil
 	}
 
-	return b.shell.RunScript(buildScriptPath, nil)
+	b.shell.Headerf("Reporting coverage")
+	return b.shell.Run(ctx, "buildkite-agent", "coverage", b.CoveragePaths)
 }
 
-func (b *Bootstrap) uploadArtifacts() error {
+// ArtifactPhase runs the artifact hooks and uploads the job's artifacts, if
+// there's a checkout to upload them from
+func (b *Bootstrap) ArtifactPhase(ctx context.Context) error {
+	if b.isCancelled() {
+		b.shell.Commentf("Skipping artifact upload, the job was cancelled")
+		return nil
+	}
+
 	if !b.hasCheckout {
 		b.shell.Commentf("Skipping artifact upload, no checkout")
 		return nil
@@ -923,15 +1787,15 @@ func (b *Bootstrap) uploadArtifacts() error {
 	}
 
 	// Run pre-artifact hooks
-	if err := b.executeGlobalHook("pre-artifact"); err != nil {
+	if err := b.executeGlobalHook(ctx, "pre-artifact"); err != nil {
 		return err
 	}
 
-	if err := b.executeLocalHook("pre-artifact"); err != nil {
+	if err := b.executeLocalHook(ctx, "pre-artifact"); err != nil {
 		return err
 	}
 
-	if err := b.executePluginHook("pre-artifact"); err != nil {
+	if err := b.executePluginHook(ctx, "pre-artifact"); err != nil {
 		return err
 	}
 
@@ -945,26 +1809,112 @@ func (b *Bootstrap) uploadArtifacts() error {
 		args = append(args, b.ArtifactUploadDestination)
 	}
 
-	if err := b.shell.Run("buildkite-agent", args...); err != nil {
+	if err := b.shell.Run(ctx, "buildkite-agent", args...); err != nil {
 		return err
 	}
 
 	// Run post-artifact hooks
-	if err := b.executeGlobalHook("post-artifact"); err != nil {
+	if err := b.executeGlobalHook(ctx, "post-artifact"); err != nil {
 		return err
 	}
 
-	if err := b.executeLocalHook("post-artifact"); err != nil {
+	if err := b.executeLocalHook(ctx, "post-artifact"); err != nil {
 		return err
 	}
 
-	if err := b.executePluginHook("post-artifact"); err != nil {
+	if err := b.executePluginHook(ctx, "post-artifact"); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// The languages that build scripts are written in
+const (
+	scriptTypeBash       = "bash"
+	scriptTypeBatch      = "batch"
+	scriptTypePowershell = "powershell"
+)
+
+// Returns the language to write the build script in, which is the one the
+// configured shell uses, or otherwise bash, or batch on Windows
+func (b *Bootstrap) commandScriptType() (string, error) {
+	commandShell, err := b.commandShell()
+	if err != nil {
+		return "", err
+	}
+
+	if commandShell == nil {
+		if runtime.GOOS == "windows" {
+			return scriptTypeBatch, nil
+		}
+		return scriptTypeBash, nil
+	}
+
+	name := strings.ToLower(filepath.Base(strings.Replace(commandShell[0], `\`, "/", -1)))
+	switch {
+	case shell.IsPowershell(commandShell[0]):
+		return scriptTypePowershell, nil
+	case name == "cmd" || name == "cmd.exe":
+		return scriptTypeBatch, nil
+	default:
+		return scriptTypeBash, nil
+	}
+}
+
+// Returns a build script that prints each line of the command before it's
+// run, and stops at the first one that fails
+func commandScript(scriptType string, command string) string {
+	var script string
+
+	switch scriptType {
+	case scriptTypeBatch:
+		script = "@echo off\n"
+		for _, k := range strings.Split(command, "\n") {
+			if k != "" {
+				script = script +
+					fmt.Sprintf("ECHO %s\n", shell.BatchEscape("\033[90m>\033[0m "+k)) +
+					k + "\n" +
+					"if %errorlevel% neq 0 exit /b %errorlevel%\n"
+			}
+		}
+	case scriptTypePowershell:
+		// $LASTEXITCODE is only set once a program has been run
+		script = "$ErrorActionPreference = 'Stop'\n"
+		for _, k := range strings.Split(command, "\n") {
+			if k != "" {
+				script = script +
+					fmt.Sprintf("Write-Host (\"$([char]27)[90m>$([char]27)[0m \" + %s)\n", shell.PowershellQuote(k)) +
+					k + "\n" +
+					"if ($LASTEXITCODE) { exit $LASTEXITCODE }\n"
+			}
+		}
+	default:
+		script = "#!/bin/bash\nset -e\n"
+		for _, k := range strings.Split(command, "\n") {
+			if k != "" {
+				script = script +
+					fmt.Sprintf("echo '\033[90m$\033[0m %s'\n", strings.Replace(k, "'", "'\\''", -1)) +
+					k + "\n"
+			}
+		}
+	}
+
+	return script
+}
+
+// Returns the file extension for a build script
+func scriptExtension(scriptType string) string {
+	switch scriptType {
+	case scriptTypeBatch:
+		return ".bat"
+	case scriptTypePowershell:
+		return ".ps1"
+	default:
+		return ""
+	}
+}
+
 type pluginCheckout struct {
 	*agent.Plugin
 	Path string
@@ -979,5 +1929,5 @@ func (p *pluginCheckout) HasHook(name string) bool {
 }
 
 func (p *pluginCheckout) HookPath(name string) (string, error) {
-	return filepath.Join(p.Path, "hooks", normalizeScriptFileName(name)), nil
+	return hookFilePath(filepath.Join(p.Path, "hooks"), name), nil
 }
@@ -1,7 +1,9 @@
 package bootstrap
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -22,3 +24,61 @@ func TestDirForAgentName(t *testing.T) {
 		assert.Equal(t, test.expected, dirForAgentName(test.agentName))
 	}
 }
+
+func TestDirForRepository(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "git-github-com-buildkite-agent-git", dirForRepository("git@github.com:buildkite/agent.git"))
+	assert.Equal(t, "https-github-com-buildkite-agent", dirForRepository("https://github.com/buildkite/agent"))
+}
+
+func TestHookTimeoutsCanOnlyBeLowered(t *testing.T) {
+	t.Parallel()
+
+	var testCases = []struct {
+		agentTimeout int
+		override     string
+		expected     time.Duration
+	}{
+		{600, "", 600 * time.Second},
+		{600, "300", 300 * time.Second},
+		{600, "900", 600 * time.Second},
+		{600, "0", 600 * time.Second},
+		{600, "-1", 600 * time.Second},
+		{600, "llamas", 600 * time.Second},
+		{0, "300", 300 * time.Second},
+		{0, "0", 0},
+	}
+
+	for _, tc := range testCases {
+		sh := newTestShell(t)
+		sh.Env.Set("BUILDKITE_HOOK_TIMEOUT_PRE_COMMAND", tc.override)
+
+		b := &Bootstrap{shell: sh, Config: Config{HookTimeout: tc.agentTimeout}}
+		assert.Equal(t, tc.expected, b.hookTimeout("/etc/buildkite-agent/hooks/pre-command"), "%d with %q", tc.agentTimeout, tc.override)
+	}
+}
+
+func TestTearingDownOutlivesTheJobsContext(t *testing.T) {
+	t.Parallel()
+
+	b := &Bootstrap{Config: Config{CancelGracePeriod: 1}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tearDownCtx, cancelTearDown := b.tearDownContext(ctx)
+	defer cancelTearDown()
+
+	select {
+	case <-tearDownCtx.Done():
+		t.Fatal("Expected tearing down to have a grace period once the job's context is done")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	select {
+	case <-tearDownCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected tearing down to be cancelled after the grace period")
+	}
+}
@@ -0,0 +1,62 @@
+package bootstrap
+
+import (
+	"os"
+	"syscall"
+)
+
+// AT_SYMLINK_NOFOLLOW, which the syscall package doesn't export
+const atSymlinkNoFollow = 0x100
+
+// Gives the user everything in the directory. Each directory is opened
+// relative to the one it's in without following symlinks, so nothing that's
+// swapped for a symlink while it's walked can lead it out of the directory.
+func chownTree(dir string, uid, gid int) error {
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	return chownDir(fd, dir, uid, gid)
+}
+
+// Gives the user the open directory and everything in it, and closes it
+func chownDir(fd int, path string, uid, gid int) error {
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+
+	if err := syscall.Fchown(fd, uid, gid); err != nil {
+		return &os.PathError{Op: "chown", Path: path, Err: err}
+	}
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		child, err := syscall.Openat(fd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		switch err {
+		case nil:
+			if err := chownDir(child, path+"/"+name, uid, gid); err != nil {
+				return err
+			}
+		case syscall.ENOTDIR, syscall.ELOOP:
+			// It's a file or a symlink, which is given to the user itself
+			if err := syscall.Fchownat(fd, name, uid, gid, atSymlinkNoFollow); err != nil {
+				return &os.PathError{Op: "chown", Path: path + "/" + name, Err: err}
+			}
+		case syscall.ENOENT:
+			// It's been removed since the directory was read
+		default:
+			return &os.PathError{Op: "open", Path: path + "/" + name, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// Returns whether the file belongs to the bootstrap's user
+func isOwnedByCurrentUser(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(stat.Uid) == os.Getuid()
+}
@@ -0,0 +1,102 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/buildkite/agent/process"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckoutsLeftByTheJobUserAreRemoved(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Giving the checkout to another user needs root")
+	}
+	nobody, err := process.LookupCredential("nobody")
+	if err != nil {
+		t.Skipf("There isn't a nobody user (%v)", err)
+	}
+
+	dir, err := ioutil.TempDir("", "job-user-checkout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// One the bootstrap checked out itself is kept
+	checkout := filepath.Join(dir, "checkout")
+	if err := os.MkdirAll(filepath.Join(checkout, ".git", "hooks"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	b := &Bootstrap{shell: newTestShell(t), Config: Config{JobUser: "nobody"}}
+	if err := b.takeBackCheckout(checkout); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, fileExists(checkout))
+
+	// One a previous job's user had is removed
+	if err := chownTree(checkout, int(nobody.UID), int(nobody.GID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.takeBackCheckout(checkout); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, fileExists(checkout))
+}
+
+func TestGivingTheCheckoutAwayDoesntFollowSymlinks(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Giving the checkout to another user needs root")
+	}
+	nobody, err := process.LookupCredential("nobody")
+	if err != nil {
+		t.Skipf("There isn't a nobody user (%v)", err)
+	}
+
+	dir, err := ioutil.TempDir("", "job-user-chown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outside := filepath.Join(dir, "outside")
+	checkout := filepath.Join(dir, "checkout")
+	for _, d := range []string{outside, filepath.Join(checkout, "src")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("llamas"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(checkout, "src", "main.go"), []byte("package main"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(checkout, "dir-link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(checkout, "file-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := chownTree(checkout, int(nobody.UID), int(nobody.GID)); err != nil {
+		t.Fatal(err)
+	}
+
+	owner := func(path string) uint32 {
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Sys().(*syscall.Stat_t).Uid
+	}
+	for _, path := range []string{checkout, filepath.Join(checkout, "src", "main.go"), filepath.Join(checkout, "dir-link"), filepath.Join(checkout, "file-link")} {
+		assert.Equal(t, nobody.UID, owner(path), path)
+	}
+	for _, path := range []string{outside, filepath.Join(outside, "secret")} {
+		assert.Equal(t, uint32(0), owner(path), path)
+	}
+}
@@ -0,0 +1,20 @@
+// +build !linux
+
+package bootstrap
+
+import (
+	"errors"
+	"os"
+)
+
+// The checkout can only be walked without following symlinks that are
+// swapped in while it's being walked on linux
+func chownTree(dir string, uid, gid int) error {
+	return errors.New("The checkout can only be given to the job's user on linux")
+}
+
+// Returns whether the file belongs to the bootstrap's user, which it's never
+// taken to outside of linux
+func isOwnedByCurrentUser(info os.FileInfo) bool {
+	return false
+}
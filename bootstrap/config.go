@@ -67,15 +67,117 @@ type Config struct {
 	// Flags to pass to "git clean" command
 	GitCleanFlags string `env:"BUILDKITE_GIT_CLEAN_FLAGS"`
 
+	// How many commits deep to clone, empty for the full history
+	GitCloneDepth string `env:"BUILDKITE_GIT_CLONE_DEPTH"`
+
+	// How many commits deep to fetch, defaults to the clone depth
+	GitFetchDepth string `env:"BUILDKITE_GIT_FETCH_DEPTH"`
+
+	// The scm used to check out the repository, either git or mercurial.
+	// When empty it's worked out from the repository
+	SCM string `env:"BUILDKITE_SCM"`
+
+	// Comma separated paths to check out, empty for the whole repository
+	GitSparseCheckoutPaths string `env:"BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS"`
+
+	// How many levels of nested submodules to check out, where empty or 0
+	// means all of them
+	GitSubmoduleRecursionDepth string `env:"BUILDKITE_GIT_SUBMODULE_RECURSION_DEPTH"`
+
+	// Rewrites of submodule urls, in the form prefix=replacement
+	GitSubmoduleURLRewrites []string
+
+	// Path to a git-credentials file with credentials for private submodules
+	GitCredentialsFile string
+
+	// Path where bare mirrors of repositories are kept to clone from, or
+	// empty to not use mirrors
+	GitMirrorsPath string
+
+	// Seconds to wait for another job to finish updating a mirror
+	GitMirrorsLockTimeout int
+
+	// Seconds a mirror can go without being updated before it's checked
+	// for corruption, or 0 to never check
+	GitMirrorsStaleAfter int
+
+	// How many times to retry cloning and fetching after a transient git
+	// error, like the connection being reset
+	GitRetries int
+
+	// Whether to remove the checkout and clone it again on the last retry
+	GitRetryReclone bool
+
 	// Whether or not to run the hooks/commands in a PTY
 	RunInPty bool
 
 	// Are aribtary commands allowed to be executed
 	CommandEval bool
 
+	// The shell that the command is run with followed by its arguments, i.e.
+	// "pwsh -Command". Defaults to bash, or batch on Windows.
+	Shell string
+
 	// Are plugins enabled?
 	PluginsEnabled bool
 
+	// Whether plugins have to be pinned to a commit or sha256 to be run
+	StrictPluginVerification bool
+
+	// The public key that the job's step has to be signed with, if any
+	PipelineVerificationKey string
+
+	// Glob patterns of plugin repositories that are allowed to be run. If
+	// empty, all plugins are allowed
+	AllowedPlugins []string
+
+	// Glob patterns of plugin repositories that are never allowed to be run
+	DeniedPlugins []string
+
+	// Phases that plugins aren't allowed to replace with their own hooks,
+	// either checkout or command
+	DeniedPluginPhases []string
+
+	// The number of seconds a hook can run for before it's killed, or 0
+	// for no limit. Can be lowered for each hook with
+	// BUILDKITE_HOOK_TIMEOUT_<NAME>
+	HookTimeout int
+
+	// The number of seconds the pre-exit hooks have to finish once the
+	// context the job was run with is done
+	CancelGracePeriod int
+
+	// The sandbox the command and the job's hooks are run in, either none or
+	// bubblewrap
+	JobSandbox string
+
+	// Paths outside of the checkout that the command can write to in the
+	// sandbox
+	JobSandboxWritablePaths []string
+
+	// Whether only pull requests are run in the sandbox
+	JobSandboxPullRequestsOnly bool
+
+	// The user the command and the job's hooks are run as, if they aren't
+	// run as the bootstrap's
+	JobUser string
+
+	// The environment declared in the checkout that the hooks and command
+	// run in, which is one of auto, nix-flake, nix-shell, devbox or none
+	DevEnvironment string `env:"BUILDKITE_DEV_ENVIRONMENT"`
+
+	// The tool manager that installs the tool versions pinned in the
+	// checkout, which is one of asdf, mise or none
+	Toolchain string `env:"BUILDKITE_TOOLCHAIN"`
+
+	// Where the tool manager installs tools, which defaults to a directory
+	// in the build path
+	ToolchainCachePath string
+
+	// The file to write why the job failed to, which the agent reports to
+	// Buildkite when the job finishes
+	FailureReasonFile string
+
 	// Path where the builds will be run
 	BuildPath string
 
@@ -85,6 +187,11 @@ type Config struct {
 	// Path to the global hooks
 	HooksPath string
 
+	// Directories of hooks that are run after the global hooks for the
+	// pipelines or repositories they match, i.e.
+	// pipeline:team-a-*=/etc/buildkite-agent/hooks/team-a
+	HooksOverlays []string
+
 	// Path to the plugins directory
 	PluginsPath string
 
@@ -94,8 +201,28 @@ type Config struct {
 	// A custom destination to upload artifacts to (i.e. s3://...)
 	ArtifactUploadDestination string `env:"BUILDKITE_ARTIFACT_UPLOAD_DESTINATION"`
 
+	// Paths to JUnit XML or TAP files that are summarized when the build
+	// finishes
+	TestResultPaths string `env:"BUILDKITE_TEST_RESULT_PATHS"`
+
+	// Paths to lcov or Cobertura coverage reports that the build is
+	// annotated with when it finishes
+	CoveragePaths string `env:"BUILDKITE_COVERAGE_PATHS"`
+
 	// Whether or not to automatically authorize SSH key hosts
 	SSHFingerprintVerification bool
+
+	// Hosts that are added to known_hosts before anything is checked out,
+	// either a host or host=fingerprint to pin one of it's keys
+	SSHKnownHosts []string
+
+	// How hosts that aren't in known_hosts are trusted, either accept-new
+	// or strict, which only adds hosts with pinned fingerprints
+	SSHHostKeyVerification string
+
+	// Where `buildkite-agent git-credentials-helper` gets the credentials
+	// for HTTPS checkouts, either github-app or gitlab-job-token
+	GitCredentialsProvider string
 }
 
 // ReadFromEnvironment reads configuration from the Environment, returns a map
@@ -0,0 +1,121 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/env"
+)
+
+// The environments the command can be run in, which are declared in the
+// repository and built by their tool so the job has the same toolchain
+// wherever it runs
+const (
+	devEnvironmentNone     = "none"
+	devEnvironmentAuto     = "auto"
+	devEnvironmentNixFlake = "nix-flake"
+	devEnvironmentNixShell = "nix-shell"
+	devEnvironmentDevbox   = "devbox"
+)
+
+// The files that declare each environment, in the order they're looked for
+// when it's found automatically
+var devEnvironmentFiles = []struct {
+	file        string
+	environment string
+}{
+	{"flake.nix", devEnvironmentNixFlake},
+	{"shell.nix", devEnvironmentNixShell},
+	{"default.nix", devEnvironmentNixShell},
+	{"devbox.json", devEnvironmentDevbox},
+}
+
+// Variables that describe the shell that printed the environment, rather
+// than the environment itself
+var devEnvironmentIgnoredVars = map[string]bool{
+	"PWD":    true,
+	"OLDPWD": true,
+	"SHLVL":  true,
+	"_":      true,
+}
+
+// DevEnvironmentPhase enters the environment the repository declares, so the
+// hooks and command that follow run with its toolchain. The tool prints the
+// environment from inside of it, and the variables it sets are added to the
+// job's like they are for hooks.
+func (b *Bootstrap) DevEnvironmentPhase(ctx context.Context) error {
+	environment, err := b.devEnvironment()
+	if err != nil || environment == devEnvironmentNone {
+		return err
+	}
+
+	b.shell.Headerf("Entering the %s environment", environment)
+
+	command := devEnvironmentCommand(environment)
+	output, err := b.shell.RunAndCapture(ctx, command[0], command[1:]...)
+	if err != nil {
+		return fmt.Errorf("Failed to enter the %s environment: %v", environment, err)
+	}
+
+	b.applyEnvironmentChanges(devEnvironmentDiff(output, b.shell.Env), "")
+	return nil
+}
+
+// Returns the environment the command is run in, finding it from the files
+// in the checkout if it's automatic
+func (b *Bootstrap) devEnvironment() (string, error) {
+	switch environment := strings.ToLower(b.DevEnvironment); environment {
+	case "", devEnvironmentNone, "false":
+		return devEnvironmentNone, nil
+	case devEnvironmentNixFlake, devEnvironmentNixShell, devEnvironmentDevbox:
+		return environment, nil
+	case devEnvironmentAuto:
+		for _, f := range devEnvironmentFiles {
+			if fileExists(filepath.Join(b.shell.Getwd(), f.file)) {
+				return f.environment, nil
+			}
+		}
+		if b.Debug {
+			b.shell.Commentf("Not entering a dev environment, as the checkout doesn't declare one")
+		}
+		return devEnvironmentNone, nil
+	default:
+		return "", fmt.Errorf("Unknown dev environment \"%s\", expected auto, nix-flake, nix-shell, devbox or none", b.DevEnvironment)
+	}
+}
+
+// Returns the command that prints the environment from inside of it, with
+// each variable ending in a NUL so values can have newlines
+func devEnvironmentCommand(environment string) []string {
+	switch environment {
+	case devEnvironmentNixFlake:
+		return []string{"nix", "--extra-experimental-features", "nix-command flakes", "develop", "--command", "env", "-0"}
+	case devEnvironmentNixShell:
+		return []string{"nix-shell", "--run", "env -0"}
+	default:
+		return []string{"devbox", "run", "--", "env", "-0"}
+	}
+}
+
+// Returns the variables the environment adds and changes. Ones it removes are
+// left, since they're usually the agent's own that the tool didn't pass on.
+func devEnvironmentDiff(output string, current *env.Environment) env.Diff {
+	var vars []string
+	for _, v := range strings.Split(output, "\x00") {
+		if v = strings.TrimSpace(v); v != "" {
+			vars = append(vars, v)
+		}
+	}
+
+	diff := env.FromSlice(vars).Diff(current)
+
+	for _, name := range diff.Names() {
+		if _, removed := diff.Removed[name]; removed || devEnvironmentIgnoredVars[name] {
+			diff.Remove(name)
+		}
+	}
+
+	return diff
+}
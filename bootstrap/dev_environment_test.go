@@ -0,0 +1,83 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/buildkite/agent/env"
+)
+
+func TestDevEnvironmentIsFoundFromTheCheckout(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		files    []string
+		expected string
+	}{
+		{nil, devEnvironmentNone},
+		{[]string{"devbox.json"}, devEnvironmentDevbox},
+		{[]string{"shell.nix", "devbox.json"}, devEnvironmentNixShell},
+		{[]string{"default.nix"}, devEnvironmentNixShell},
+		{[]string{"flake.nix", "shell.nix"}, devEnvironmentNixFlake},
+	} {
+		dir, err := ioutil.TempDir("", "dev-environment")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		for _, f := range tc.files {
+			if err := ioutil.WriteFile(filepath.Join(dir, f), []byte("{}"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		sh := newTestShell(t)
+		if err := sh.Chdir(dir); err != nil {
+			t.Fatal(err)
+		}
+
+		b := &Bootstrap{Config: Config{DevEnvironment: "auto"}, shell: sh}
+
+		environment, err := b.devEnvironment()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if environment != tc.expected {
+			t.Fatalf("Expected %s for %v, got %s", tc.expected, tc.files, environment)
+		}
+	}
+}
+
+func TestUnknownDevEnvironmentIsAnError(t *testing.T) {
+	t.Parallel()
+
+	b := &Bootstrap{Config: Config{DevEnvironment: "conda"}, shell: newTestShell(t)}
+
+	if _, err := b.devEnvironment(); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+func TestDevEnvironmentDiffKeepsWhatTheEnvironmentSets(t *testing.T) {
+	t.Parallel()
+
+	current := env.FromSlice([]string{"PATH=/usr/bin", "HOME=/home/llama", "BUILDKITE_JOB_ID=1234", "PWD=/tmp"})
+	output := "PATH=/nix/store/go/bin:/usr/bin\x00HOME=/home/llama\x00GOROOT=/nix/store/go\x00" +
+		"shellHook=echo hello\necho world\x00PWD=/build\x00SHLVL=2\x00_=/usr/bin/env\x00"
+
+	diff := devEnvironmentDiff(output, current)
+
+	if !reflect.DeepEqual(diff.Added, map[string]string{"GOROOT": "/nix/store/go", "shellHook": "echo hello\necho world"}) {
+		t.Fatalf("Unexpected added variables %#v", diff.Added)
+	}
+	if len(diff.Changed) != 1 || diff.Changed["PATH"].New != "/nix/store/go/bin:/usr/bin" {
+		t.Fatalf("Unexpected changed variables %#v", diff.Changed)
+	}
+	if len(diff.Removed) != 0 {
+		t.Fatalf("Unexpected removed variables %#v", diff.Removed)
+	}
+}
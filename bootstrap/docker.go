@@ -1,9 +1,11 @@
 package bootstrap
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/buildkite/agent/bootstrap/shell"
@@ -28,7 +30,7 @@ func hasDeprecatedDockerIntegration(sh *shell.Shell) bool {
 	return false
 }
 
-func runDeprecatedDockerIntegration(sh *shell.Shell, scriptPath string) error {
+func runDeprecatedDockerIntegration(ctx context.Context, sh *shell.Shell, scriptPath string) error {
 	var warnNotSet = func(k1, k2 string) {
 		sh.Warningf("%s is set, but without %s, which it requires. You should be able to safely remove this from your pipeline.", k1, k2)
 	}
@@ -45,11 +47,11 @@ func runDeprecatedDockerIntegration(sh *shell.Shell, scriptPath string) error {
 	switch {
 	case sh.Env.Exists(`BUILDKITE_DOCKER_COMPOSE_CONTAINER`):
 		sh.Warningf("BUILDKITE_DOCKER_COMPOSE_CONTAINER is set, which is deprecated in Agent v3 and will be removed in v4. Consider using the :docker: docker-compose plugin instead at https://github.com/buildkite-plugins/docker-compose-buildkite-plugin.")
-		return runDockerComposeCommand(sh, relativePathToDot)
+		return runDockerComposeCommand(ctx, sh, relativePathToDot)
 
 	case sh.Env.Exists(`BUILDKITE_DOCKER`):
 		sh.Warningf("BUILDKITE_DOCKER is set, which is deprecated in Agent v3 and will be removed in v4. Consider using the docker plugin instead at https://github.com/buildkite-plugins/docker-buildkite-plugin.")
-		return runDockerCommand(sh, relativePathToDot)
+		return runDockerCommand(ctx, sh, relativePathToDot)
 
 	case sh.Env.Exists(`BUILDKITE_DOCKER_COMPOSE_FILE`):
 		warnNotSet(`BUILDKITE_DOCKER_COMPOSE_FILE`, `BUILDKITE_DOCKER_COMPOSE_CONTAINER`)
@@ -67,26 +69,54 @@ func runDeprecatedDockerIntegration(sh *shell.Shell, scriptPath string) error {
 	return errors.New("Failed to find any docker env")
 }
 
-func tearDownDeprecatedDockerIntegration(sh *shell.Shell) error {
+// How long a cancelled job's container gets to stop before it's killed, in
+// seconds. This needs to be well within the agent's cancel grace period, or
+// the agent kills the bootstrap before the container is cleaned up.
+const dockerStopTimeout = 5
+
+// tearDownDeprecatedDockerIntegration removes the container or compose
+// project the job registered in DOCKER_CONTAINER or COMPOSE_PROJ_NAME. They're
+// registered before anything is started, so a job that's cancelled part way
+// through is still cleaned up.
+func tearDownDeprecatedDockerIntegration(ctx context.Context, sh *shell.Shell, cancelled bool) error {
+	defer removeDockerLoginConfig(sh)
+
 	if container, ok := sh.Env.Get(`DOCKER_CONTAINER`); ok {
 		sh.Printf("~~~ Cleaning up Docker containers")
 
-		if err := sh.Run("docker", "rm", "-f", "-v", container); err != nil {
+		runtime, err := containerRuntime(sh)
+		if err != nil {
+			return err
+		}
+
+		// The container might not have seen the signal, so give it the
+		// chance to stop cleanly before it's removed
+		if cancelled {
+			_ = sh.Run(ctx, runtime, "stop", "--time", strconv.Itoa(dockerStopTimeout), container)
+		}
+
+		if err := sh.Run(ctx, runtime, "rm", "-f", "-v", container); err != nil {
 			return err
 		}
 	} else if projectName, ok := sh.Env.Get(`COMPOSE_PROJ_NAME`); ok {
 		sh.Printf("~~~ Cleaning up Docker containers")
 
-		// Friendly kill
-		_ = runDockerCompose(sh, projectName, "kill")
+		// Friendly kill, which also stops the services of a cancelled job
+		_ = runDockerCompose(ctx, sh, projectName, "kill")
 
-		if sh.Env.GetBool(`BUILDKITE_DOCKER_COMPOSE_LEAVE_VOLUMES`, false) {
-			_ = runDockerCompose(sh, projectName, "rm", "--force", "--all")
-		} else {
-			_ = runDockerCompose(sh, projectName, "rm", "--force", "--all", "-v")
+		// Only the standalone docker-compose binary supports (and needs) --all
+		rmArgs := []string{"rm", "--force"}
+		if command, _, err := dockerComposeCommand(ctx, sh); err == nil && command == "docker-compose" {
+			rmArgs = append(rmArgs, "--all")
+		}
+
+		if !sh.Env.GetBool(`BUILDKITE_DOCKER_COMPOSE_LEAVE_VOLUMES`, false) {
+			rmArgs = append(rmArgs, "-v")
 		}
 
-		return runDockerCompose(sh, projectName, "down")
+		_ = runDockerCompose(ctx, sh, projectName, rmArgs...)
+
+		return runDockerCompose(ctx, sh, projectName, "down")
 	}
 
 	return nil
@@ -94,7 +124,7 @@ func tearDownDeprecatedDockerIntegration(sh *shell.Shell) error {
 
 // runDockerCommand executes a script inside a docker container that is built as needed
 // Ported from https://github.com/buildkite/agent/blob/2b8f1d569b659e07de346c0e3ae7090cb98e49ba/templates/bootstrap.sh#L439
-func runDockerCommand(sh *shell.Shell, scriptPath string) error {
+func runDockerCommand(ctx context.Context, sh *shell.Shell, scriptPath string) error {
 	jobId, _ := sh.Env.Get(`BUILDKITE_JOB_ID`)
 	dockerContainer := fmt.Sprintf("buildkite_%s_container", jobId)
 	dockerImage := fmt.Sprintf("buildkite_%s_image", jobId)
@@ -104,25 +134,76 @@ func runDockerCommand(sh *shell.Shell, scriptPath string) error {
 		dockerFile = "Dockerfile"
 	}
 
+	runtime, err := containerRuntime(sh)
+	if err != nil {
+		return err
+	}
+
 	sh.Env.Set(`DOCKER_CONTAINER`, dockerContainer)
 	sh.Env.Set(`DOCKER_IMAGE`, dockerImage)
 
+	// Fresh agents can't pull private base images until they've logged in
+	if err := loginToDockerfileRegistries(ctx, sh, dockerFile); err != nil {
+		return err
+	}
+
 	sh.Printf("~~~ :docker: Building Docker image %s", dockerImage)
-	if err := sh.Run("docker", "build", "-f", dockerFile, "-t", dockerImage, "."); err != nil {
+	if err := sh.Run(ctx, runtime, dockerBuildArgs(sh, runtime, dockerFile, dockerImage)...); err != nil {
 		return err
 	}
 
 	sh.Headerf(":docker: Running command (in Docker container)")
-	if err := sh.Run("docker", "run", "--name", dockerContainer, dockerImage, scriptPath); err != nil {
+	if err := sh.Run(ctx, runtime, "run", "--name", dockerContainer, dockerImage, scriptPath); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// dockerBuildArgs returns the arguments for building the job's image. When
+// BUILDKITE_DOCKER_BUILDKIT is enabled the build is done with BuildKit (via
+// buildx for docker) and BUILDKITE_DOCKER_CACHE_REGISTRY can be used to share
+// the layer cache between jobs of the same pipeline
+func dockerBuildArgs(sh *shell.Shell, runtime, dockerFile, dockerImage string) []string {
+	if !sh.Env.GetBool(`BUILDKITE_DOCKER_BUILDKIT`, false) {
+		return []string{"build", "-f", dockerFile, "-t", dockerImage, "."}
+	}
+
+	var args []string
+
+	// Without --load, buildx leaves the image in the build cache and it can't be run
+	if runtime == "docker" {
+		args = []string{"buildx", "build", "--load"}
+	} else {
+		args = []string{"build"}
+	}
+
+	args = append(args, "-f", dockerFile, "-t", dockerImage)
+
+	if registry, _ := sh.Env.Get(`BUILDKITE_DOCKER_CACHE_REGISTRY`); registry != "" {
+		pipelineSlug, _ := sh.Env.Get(`BUILDKITE_PIPELINE_SLUG`)
+		registry = strings.TrimSuffix(registry, "/")
+
+		if runtime == "docker" {
+			cacheRef := fmt.Sprintf("%s/%s:buildcache", registry, pipelineSlug)
+			args = append(args,
+				"--cache-from", "type=registry,ref="+cacheRef,
+				"--cache-to", "type=registry,ref="+cacheRef+",mode=max",
+			)
+		} else {
+			// Podman only takes a repository, which it pushes each
+			// layer to with a tag of its own
+			cacheRepo := fmt.Sprintf("%s/%s/buildcache", registry, pipelineSlug)
+			args = append(args, "--cache-from", cacheRepo, "--cache-to", cacheRepo)
+		}
+	}
+
+	return append(args, ".")
+}
+
 // runDockerComposeCommand executes a script with docker-compose
 // Ported from https://github.com/buildkite/agent/blob/2b8f1d569b659e07de346c0e3ae7090cb98e49ba/templates/bootstrap.sh#L462
-func runDockerComposeCommand(sh *shell.Shell, scriptPath string) error {
+func runDockerComposeCommand(ctx context.Context, sh *shell.Shell, scriptPath string) error {
 	composeContainer, _ := sh.Env.Get(`BUILDKITE_DOCKER_COMPOSE_CONTAINER`)
 	jobId, _ := sh.Env.Get(`BUILDKITE_JOB_ID`)
 
@@ -134,21 +215,24 @@ func runDockerComposeCommand(sh *shell.Shell, scriptPath string) error {
 	sh.Headerf(":docker: Building Docker images")
 
 	if sh.Env.GetBool(`BUILDKITE_DOCKER_COMPOSE_BUILD_ALL`, false) {
-		if err := runDockerCompose(sh, projectName, "build", "--pull"); err != nil {
+		if err := runDockerCompose(ctx, sh, projectName, "build", "--pull"); err != nil {
 			return err
 		}
 	} else {
-		if err := runDockerCompose(sh, projectName, "build", "--pull", composeContainer); err != nil {
+		if err := runDockerCompose(ctx, sh, projectName, "build", "--pull", composeContainer); err != nil {
 			return err
 		}
 	}
 
 	sh.Headerf(":docker: Running command (in Docker Compose container)")
-	return runDockerCompose(sh, projectName, "run", composeContainer, scriptPath)
+	return runDockerCompose(ctx, sh, projectName, "run", composeContainer, scriptPath)
 }
 
-func runDockerCompose(sh *shell.Shell, projectName string, commandArgs ...string) error {
-	args := []string{}
+func runDockerCompose(ctx context.Context, sh *shell.Shell, projectName string, commandArgs ...string) error {
+	command, args, err := dockerComposeCommand(ctx, sh)
+	if err != nil {
+		return err
+	}
 
 	composeFile, _ := sh.Env.Get(`BUILDKITE_DOCKER_COMPOSE_FILE`)
 	if composeFile == "" {
@@ -164,10 +248,64 @@ func runDockerCompose(sh *shell.Shell, projectName string, commandArgs ...string
 
 	args = append(args, "-p", projectName)
 
-	if sh.Env.GetBool(`BUILDKITE_AGENT_DEBUG`, false) {
+	// The --verbose flag is only understood by the standalone v1 binary
+	if sh.Env.GetBool(`BUILDKITE_AGENT_DEBUG`, false) && command == "docker-compose" {
 		args = append(args, "--verbose")
 	}
 
 	args = append(args, commandArgs...)
-	return sh.Run("docker-compose", args...)
+	return sh.Run(ctx, command, args...)
+}
+
+// containerRuntime returns the cli that should be used for building and running
+// containers, which defaults to docker but can be changed to any cli that is
+// compatible with it using BUILDKITE_CONTAINER_RUNTIME
+func containerRuntime(sh *shell.Shell) (string, error) {
+	runtime, _ := sh.Env.Get(`BUILDKITE_CONTAINER_RUNTIME`)
+
+	switch runtime {
+	case "":
+		return "docker", nil
+	case "docker", "podman", "nerdctl":
+		return runtime, nil
+	}
+
+	return "", fmt.Errorf("Unknown container runtime %q in BUILDKITE_CONTAINER_RUNTIME, expected one of docker, podman or nerdctl", runtime)
+}
+
+// dockerComposeCommand returns the command and any leading arguments needed to
+// invoke docker-compose. Compose v1 is a standalone `docker-compose` binary,
+// whereas v2 ships as a plugin to the docker cli and is run as `docker compose`.
+// Other container runtimes provide compose as a subcommand of their own cli.
+func dockerComposeCommand(ctx context.Context, sh *shell.Shell) (string, []string, error) {
+	runtime, err := containerRuntime(sh)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if runtime != "docker" || isDockerComposeV2(ctx, sh) {
+		return runtime, []string{"compose"}, nil
+	}
+
+	return "docker-compose", []string{}, nil
+}
+
+// isDockerComposeV2 returns whether the `docker compose` plugin should be used
+// instead of `docker-compose`. BUILDKITE_DOCKER_COMPOSE_V2 can be used to force
+// either behaviour, otherwise we prefer the standalone binary if it's installed
+// and fall back to the plugin if the docker cli has it.
+func isDockerComposeV2(ctx context.Context, sh *shell.Shell) bool {
+	if sh.Env.Exists(`BUILDKITE_DOCKER_COMPOSE_V2`) {
+		return sh.Env.GetBool(`BUILDKITE_DOCKER_COMPOSE_V2`, false)
+	}
+
+	if _, err := sh.AbsolutePath("docker-compose"); err == nil {
+		return false
+	}
+
+	if _, err := sh.RunAndCapture(ctx, "docker", "compose", "version"); err == nil {
+		return true
+	}
+
+	return false
 }
@@ -0,0 +1,198 @@
+package bootstrap
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/agent/bootstrap/shell"
+)
+
+// The registries that fresh agents can't pull from without logging in first,
+// and what they're logged in to with
+var (
+	ecrRegistryRegex = regexp.MustCompile(`\A[0-9]{12}\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?\z`)
+	garRegistryRegex = regexp.MustCompile(`\A[a-z0-9-]+-docker\.pkg\.dev\z`)
+)
+
+// The environment variable with the docker config created for the job's
+// registry logins, so it can be removed when the job's torn down
+const dockerLoginConfigEnv = `BUILDKITE_DOCKER_LOGIN_CONFIG`
+
+// loginToDockerfileRegistries logs in to the ECR and Artifact Registry
+// registries the Dockerfile's images come from, with the credentials of the
+// aws and gcloud clis. The logins are kept in a docker config of the job's
+// own, which starts as a copy of the current one, so nothing is left behind
+// once the job's torn down. Registries the config already has credentials
+// for, including from a credential helper, are left alone.
+func loginToDockerfileRegistries(ctx context.Context, sh *shell.Shell, dockerFile string) error {
+	if !filepath.IsAbs(dockerFile) {
+		dockerFile = filepath.Join(sh.Getwd(), dockerFile)
+	}
+
+	registries, err := dockerfileRegistries(dockerFile)
+	if err != nil {
+		// The build will fail with why the Dockerfile couldn't be read
+		return nil
+	}
+
+	config := currentDockerConfig(sh)
+	auths, _ := config["auths"].(map[string]interface{})
+	if auths == nil {
+		auths = map[string]interface{}{}
+	}
+
+	var loggedIn []string
+	for _, registry := range registries {
+		if username, _, err := dockerCredentials(sh.Env, registry); err == nil && username != "" {
+			continue
+		}
+
+		username, password, err := dockerRegistryCredentials(ctx, sh, registry)
+		if err != nil {
+			return fmt.Errorf("Failed to log in to %s, which the Dockerfile's images come from: %v", registry, err)
+		}
+
+		auths[registry] = map[string]string{
+			"auth": base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+		}
+		loggedIn = append(loggedIn, registry)
+	}
+
+	if len(loggedIn) == 0 {
+		return nil
+	}
+	config["auths"] = auths
+
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "buildkite-docker-login-")
+	if err != nil {
+		return err
+	}
+	sh.Env.Set(dockerLoginConfigEnv, dir)
+
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+
+	// podman reads the logins from a file of its own
+	sh.Env.Set(`DOCKER_CONFIG`, dir)
+	sh.Env.Set(`REGISTRY_AUTH_FILE`, path)
+
+	sh.Commentf("Logged in to %s", strings.Join(loggedIn, ", "))
+	return nil
+}
+
+// removeDockerLoginConfig removes the docker config with the job's registry
+// logins, if it has one
+func removeDockerLoginConfig(sh *shell.Shell) {
+	if dir, ok := sh.Env.Get(dockerLoginConfigEnv); ok && dir != "" {
+		if err := os.RemoveAll(dir); err != nil {
+			sh.Warningf("Failed to remove the docker config with the job's registry logins: %v", err)
+		}
+		sh.Env.Remove(dockerLoginConfigEnv)
+	}
+}
+
+// Returns the ECR and Artifact Registry registries of the images the
+// Dockerfile's stages are built from. Images from a build argument can't be
+// known until the build and are skipped, as are earlier stages.
+func dockerfileRegistries(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stages := map[string]bool{}
+	seen := map[string]bool{}
+	var registries []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+
+		// Skip flags like --platform
+		fields = fields[1:]
+		for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		image := fields[0]
+		if len(fields) >= 3 && strings.EqualFold(fields[1], "AS") {
+			stages[strings.ToLower(fields[2])] = true
+		}
+		if strings.Contains(image, "$") || stages[strings.ToLower(image)] || !strings.Contains(image, "/") {
+			continue
+		}
+
+		registry := image[:strings.Index(image, "/")]
+		if (ecrRegistryRegex.MatchString(registry) || garRegistryRegex.MatchString(registry)) && !seen[registry] {
+			seen[registry] = true
+			registries = append(registries, registry)
+		}
+	}
+
+	return registries, scanner.Err()
+}
+
+// Returns the username and password for the registry, from the aws cli for
+// ECR and the gcloud cli for Artifact Registry
+func dockerRegistryCredentials(ctx context.Context, sh *shell.Shell, registry string) (string, string, error) {
+	// The password would be written to the log in debug mode
+	debug := sh.Debug
+	sh.Debug = false
+	defer func() { sh.Debug = debug }()
+
+	if match := ecrRegistryRegex.FindStringSubmatch(registry); match != nil {
+		password, err := sh.RunAndCapture(ctx, "aws", "ecr", "get-login-password", "--region", match[1])
+		if err != nil {
+			return "", "", err
+		}
+		return "AWS", password, nil
+	}
+
+	token, err := sh.RunAndCapture(ctx, "gcloud", "auth", "print-access-token")
+	if err != nil {
+		return "", "", err
+	}
+	return "oauth2accesstoken", token, nil
+}
+
+// Returns the docker config that's in use, or an empty config if there isn't
+// one
+func currentDockerConfig(sh *shell.Shell) map[string]interface{} {
+	config := map[string]interface{}{}
+
+	dir, _ := sh.Env.Get(`DOCKER_CONFIG`)
+	if dir == "" {
+		home, _ := sh.Env.Get(`HOME`)
+		dir = filepath.Join(home, ".docker")
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "config.json")); err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return map[string]interface{}{}
+		}
+	}
+
+	return config
+}
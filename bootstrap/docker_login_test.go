@@ -0,0 +1,124 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestDockerfileRegistries(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "dockerfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dockerfile := strings.Join([]string{
+		"ARG BASE=ubuntu",
+		"FROM --platform=linux/amd64 012345678910.dkr.ecr.us-east-1.amazonaws.com/base:latest AS build",
+		"FROM build",
+		"from us-docker.pkg.dev/acme/images/node:8",
+		"FROM $BASE",
+		"FROM golang:1.9",
+		"FROM quay.io/acme/tools",
+		"FROM 012345678910.dkr.ecr.us-east-1.amazonaws.com/other",
+	}, "\n")
+	path := filepath.Join(dir, "Dockerfile")
+	if err := ioutil.WriteFile(path, []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	registries, err := dockerfileRegistries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"012345678910.dkr.ecr.us-east-1.amazonaws.com", "us-docker.pkg.dev"}
+	if !reflect.DeepEqual(registries, expected) {
+		t.Fatalf("Expected %v, got %v", expected, registries)
+	}
+}
+
+func TestLoginToDockerfileRegistries(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("Not tested on windows yet")
+	}
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "docker-login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The agent's config already logs in to the ECR registry
+	existing := filepath.Join(dir, "existing")
+	bin := filepath.Join(dir, "bin")
+	for _, d := range []string{existing, bin} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(existing, "config.json"), []byte(`{"auths":{"012345678910.dkr.ecr.us-east-1.amazonaws.com":{"auth":"QVdTOm9sZA=="}},"detachKeys":"ctrl-q"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dockerfile := "FROM 012345678910.dkr.ecr.us-east-1.amazonaws.com/base\nFROM us-docker.pkg.dev/acme/images/node:8\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bin, "gcloud"), []byte("#!/bin/bash\necho ya29.token\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := newTestShell(t)
+	sh.Env.Set("PATH", bin+":/usr/bin:/bin")
+	sh.Env.Set("DOCKER_CONFIG", existing)
+	if err := sh.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loginToDockerfileRegistries(context.Background(), sh, "Dockerfile"); err != nil {
+		t.Fatal(err)
+	}
+
+	config, _ := sh.Env.Get("DOCKER_CONFIG")
+	if config == existing {
+		t.Fatal("Expected the job to have a docker config of its own")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(config, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var written struct {
+		Auths      map[string]map[string]string `json:"auths"`
+		DetachKeys string                       `json:"detachKeys"`
+	}
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]map[string]string{
+		"012345678910.dkr.ecr.us-east-1.amazonaws.com": {"auth": "QVdTOm9sZA=="},
+		"us-docker.pkg.dev":                            {"auth": "b2F1dGgyYWNjZXNzdG9rZW46eWEyOS50b2tlbg=="},
+	}
+	if !reflect.DeepEqual(written.Auths, expected) || written.DetachKeys != "ctrl-q" {
+		t.Fatalf("Unexpected docker config %s", data)
+	}
+
+	removeDockerLoginConfig(sh)
+	if fileExists(config) {
+		t.Fatalf("Expected %s to be removed", config)
+	}
+}
@@ -0,0 +1,31 @@
+package bootstrap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDockerBuildArgsShareTheCacheForEachRuntime(t *testing.T) {
+	t.Parallel()
+
+	sh := newTestShell(t)
+	sh.Env.Set("BUILDKITE_DOCKER_BUILDKIT", "true")
+	sh.Env.Set("BUILDKITE_DOCKER_CACHE_REGISTRY", "registry.example.com/cache/")
+	sh.Env.Set("BUILDKITE_PIPELINE_SLUG", "llamas")
+
+	assert.Equal(t, []string{
+		"buildx", "build", "--load", "-f", "Dockerfile", "-t", "llamas_image",
+		"--cache-from", "type=registry,ref=registry.example.com/cache/llamas:buildcache",
+		"--cache-to", "type=registry,ref=registry.example.com/cache/llamas:buildcache,mode=max",
+		".",
+	}, dockerBuildArgs(sh, "docker", "Dockerfile", "llamas_image"))
+
+	// Podman doesn't take BuildKit's type=registry caches
+	assert.Equal(t, []string{
+		"build", "-f", "Dockerfile", "-t", "llamas_image",
+		"--cache-from", "registry.example.com/cache/llamas/buildcache",
+		"--cache-to", "registry.example.com/cache/llamas/buildcache",
+		".",
+	}, dockerBuildArgs(sh, "podman", "Dockerfile", "llamas_image"))
+}
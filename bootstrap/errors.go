@@ -0,0 +1,105 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+)
+
+// Why a job failed, which is reported to Buildkite when the job finishes so
+// failures of the agent's machine can be told apart from failures of the
+// job's command, i.e. to only retry the former automatically
+const (
+	failureReasonCheckout = "checkout_failed"
+	failureReasonHook     = "hook_failed"
+	failureReasonCommand  = "command_failed"
+	failureReasonPlugin   = "plugin_failed"
+	failureReasonSigning  = "signature_verification_failed"
+)
+
+// CheckoutError is returned when the repository couldn't be checked out
+type CheckoutError struct {
+	Err error
+}
+
+func (e *CheckoutError) Error() string { return e.Err.Error() }
+func (e *CheckoutError) Cause() error  { return e.Err }
+
+// HookError is returned when a hook fails or times out
+type HookError struct {
+	Name string
+	Err  error
+}
+
+func (e *HookError) Error() string { return e.Err.Error() }
+func (e *HookError) Cause() error  { return e.Err }
+
+// CommandError is returned when the job's command fails, whether it's run
+// by the bootstrap or a command hook
+type CommandError struct {
+	Err error
+}
+
+func (e *CommandError) Error() string { return e.Err.Error() }
+func (e *CommandError) Cause() error  { return e.Err }
+
+// PluginError is returned when a plugin can't be checked out, or isn't
+// allowed to run
+type PluginError struct {
+	Plugin string
+	Err    error
+}
+
+func (e *PluginError) Error() string { return e.Err.Error() }
+func (e *PluginError) Cause() error  { return e.Err }
+
+// SignatureError is returned when the job's step isn't signed with the
+// agent's verification key
+type SignatureError struct {
+	Err error
+}
+
+func (e *SignatureError) Error() string { return e.Err.Error() }
+func (e *SignatureError) Cause() error  { return e.Err }
+
+// Returns the failure reason of the outermost typed error in err's chain of
+// causes, or an empty string if there isn't one
+func failureReason(err error) string {
+	type causer interface {
+		Cause() error
+	}
+
+	for err != nil {
+		switch err.(type) {
+		case *CheckoutError:
+			return failureReasonCheckout
+		case *HookError:
+			return failureReasonHook
+		case *CommandError:
+			return failureReasonCommand
+		case *PluginError:
+			return failureReasonPlugin
+		case *SignatureError:
+			return failureReasonSigning
+		}
+
+		cause, ok := err.(causer)
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+
+	return ""
+}
+
+// Writes why the job failed to the file the agent reads it from, if there's
+// a reason for the failure and the agent gave a file
+func (b *Bootstrap) reportFailureReason(err error) {
+	reason := failureReason(err)
+	if reason == "" || b.FailureReasonFile == "" {
+		return
+	}
+
+	if err := ioutil.WriteFile(b.FailureReasonFile, []byte(reason), 0600); err != nil {
+		b.shell.Warningf("Failed to report why the job failed: %v", err)
+	}
+}
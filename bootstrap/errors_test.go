@@ -0,0 +1,49 @@
+package bootstrap
+
+import (
+	"errors"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailureReasons(t *testing.T) {
+	t.Parallel()
+
+	err := errors.New("llamas")
+
+	var testCases = []struct {
+		err    error
+		reason string
+	}{
+		{nil, ""},
+		{err, ""},
+		{errCancelled, ""},
+		{&CheckoutError{Err: err}, failureReasonCheckout},
+		{&HookError{Name: "pre-command", Err: err}, failureReasonHook},
+		{&CommandError{Err: err}, failureReasonCommand},
+		{&PluginError{Plugin: "docker", Err: err}, failureReasonPlugin},
+		{pkgerrors.Wrap(&PluginError{Err: err}, "wrapped"), failureReasonPlugin},
+
+		// A checkout hook failing is a failed checkout
+		{&CheckoutError{Err: &HookError{Name: "checkout", Err: err}}, failureReasonCheckout},
+
+		// So is a command hook failing a failed command
+		{&CommandError{Err: &HookError{Name: "command", Err: err}}, failureReasonCommand},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.reason, failureReason(tc.err), "%v", tc.err)
+	}
+}
+
+func TestTypedErrorsKeepTheirCauses(t *testing.T) {
+	t.Parallel()
+
+	err := errors.New("llamas")
+	wrapped := &CheckoutError{Err: &HookError{Name: "checkout", Err: err}}
+
+	assert.Equal(t, "llamas", wrapped.Error())
+	assert.Equal(t, err, pkgerrors.Cause(wrapped))
+}
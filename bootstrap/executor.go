@@ -0,0 +1,368 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/buildkite/agent/bootstrap/shell"
+	"github.com/buildkite/agent/env"
+	"github.com/buildkite/agent/process"
+	shellwords "github.com/mattn/go-shellwords"
+)
+
+// executor runs the command phase's build script, either directly in the
+// bootstrap's shell or somewhere more isolated
+type executor interface {
+	// Runs the build script, which is in the working directory
+	Run(ctx context.Context, scriptPath string) error
+}
+
+const (
+	sandboxNone       = "none"
+	sandboxBubblewrap = "bubblewrap"
+)
+
+// The system directories that are mounted read-only inside the sandbox.
+// Anything that doesn't exist on the host is skipped.
+var sandboxReadOnlyPaths = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/etc", "/opt"}
+
+// The agent's config directories, which are within the read-only system
+// directories but have its registration token and hooks. They're hidden inside
+// the sandbox.
+var sandboxHiddenPaths = []string{"/etc/buildkite-agent", "/usr/local/etc/buildkite-agent"}
+
+// The directories in the checkout with the repository's config and hooks, which
+// are read-only inside the sandbox
+var sandboxReadOnlyCheckoutDirs = []string{".git", ".hg"}
+
+// Returns the sandbox the job's command should be run in, if any
+func (b *Bootstrap) jobSandbox() (string, error) {
+	switch strings.ToLower(b.JobSandbox) {
+	case "", sandboxNone:
+		return sandboxNone, nil
+	case sandboxBubblewrap, "bwrap":
+		// Builds of branches in the pipeline's own repository can be
+		// trusted to run outside the sandbox, if the agent allows it
+		if b.JobSandboxPullRequestsOnly && (b.PullRequest == "" || b.PullRequest == "false") {
+			return sandboxNone, nil
+		}
+		return sandboxBubblewrap, nil
+	default:
+		return "", fmt.Errorf("Unknown job sandbox \"%s\", expected none or bubblewrap", b.JobSandbox)
+	}
+}
+
+// Returns the executor used to run the job's command, as the job's user if
+// there is one
+func (b *Bootstrap) commandExecutor() (executor, error) {
+	e, err := b.sandboxExecutor()
+	if err != nil {
+		return nil, err
+	}
+
+	cred, err := b.jobCredential()
+	if err != nil || cred == nil {
+		return e, err
+	}
+
+	return &userExecutor{b: b, executor: e, credential: cred}, nil
+}
+
+// Returns the user the command and the job's hooks are run as, or nil if
+// they're run as the bootstrap's
+func (b *Bootstrap) jobCredential() (*process.Credential, error) {
+	if b.JobUser == "" {
+		return nil, nil
+	}
+	return process.LookupCredential(b.JobUser)
+}
+
+// Returns the executor that runs the command in the job's sandbox, if any
+func (b *Bootstrap) sandboxExecutor() (executor, error) {
+	sandbox, err := b.jobSandbox()
+	if err != nil {
+		return nil, err
+	}
+
+	if hasDeprecatedDockerIntegration(b.shell) {
+		// Running containers needs the docker socket, which would let the
+		// command get straight back out of the sandbox
+		if sandbox != sandboxNone {
+			return nil, errors.New("The deprecated BUILDKITE_DOCKER* integration can't be used in a job sandbox")
+		}
+		return &dockerExecutor{b: b}, nil
+	}
+
+	switch sandbox {
+	case sandboxBubblewrap:
+		if runtime.GOOS != "linux" {
+			return nil, errors.New("The bubblewrap job sandbox is only supported on linux")
+		}
+		return &bubblewrapExecutor{b: b}, nil
+	default:
+		return &shellExecutor{b: b}, nil
+	}
+}
+
+// Runs the build script in the bootstrap's shell
+type shellExecutor struct {
+	b *Bootstrap
+}
+
+func (e *shellExecutor) Run(ctx context.Context, scriptPath string) error {
+	commandShell, err := e.b.commandShell()
+	if err != nil {
+		return err
+	}
+
+	if commandShell == nil {
+		return e.b.shell.RunScript(ctx, scriptPath, nil)
+	}
+
+	args := append(commandShell[1:], shellScriptArg(commandShell, scriptPath))
+	return e.b.shell.Run(ctx, commandShell[0], args...)
+}
+
+// Runs the build script with another executor, as the job's user rather than
+// the bootstrap's. The user is given the checkout first, so they can write to
+// it, and the commands are run with their HOME.
+type userExecutor struct {
+	b          *Bootstrap
+	executor   executor
+	credential *process.Credential
+}
+
+func (e *userExecutor) Run(ctx context.Context, scriptPath string) error {
+	e.b.shell.Commentf("Running the command as %s", e.credential.Username)
+
+	return e.b.runAsJobUser(e.credential, func() error {
+		return e.executor.Run(ctx, scriptPath)
+	})
+}
+
+// Runs something of the job's, i.e. the command or a hook from the checkout,
+// as the job's user
+func (b *Bootstrap) runAsJobUser(cred *process.Credential, run func() error) error {
+	if err := b.giveCheckoutToJobUser(cred); err != nil {
+		return err
+	}
+
+	b.shell.Credential = cred
+	defer func() { b.shell.Credential = nil }()
+
+	return run()
+}
+
+// Gives the job's user the checkout, if there's one yet, so they can write to
+// it
+func (b *Bootstrap) giveCheckoutToJobUser(cred *process.Credential) error {
+	checkoutPath, _ := b.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
+	if b.checkoutIsJobUsers || checkoutPath == "" || !fileExists(checkoutPath) {
+		return nil
+	}
+
+	if err := chownTree(checkoutPath, int(cred.UID), int(cred.GID)); err != nil {
+		return fmt.Errorf("Failed to give the checkout to %s (%v)", cred.Username, err)
+	}
+	b.checkoutIsJobUsers = true
+	return nil
+}
+
+// Takes the checkout back from the job's user before the bootstrap checks it
+// out again. The user could have changed anything in it, including the
+// repository's config and hooks that git runs, so rather than run them as the
+// bootstrap's user it's removed to be cloned again. Jobs leave it with their
+// user, so it's removed before each job's checkout too.
+func (b *Bootstrap) takeBackCheckout(checkoutPath string) error {
+	if b.JobUser == "" {
+		return nil
+	}
+
+	info, err := os.Lstat(checkoutPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if b.checkoutIsJobUsers || !isOwnedByCurrentUser(info) {
+		b.shell.Commentf("Removing the checkout %s has had, to clone it again", b.JobUser)
+		if err := os.RemoveAll(checkoutPath); err != nil {
+			return fmt.Errorf("Failed to remove \"%s\" (%s)", checkoutPath, err)
+		}
+	}
+	b.checkoutIsJobUsers = false
+	return nil
+}
+
+// Returns the shell the command is run with followed by its arguments, or nil
+// if one hasn't been configured with `--shell`
+func (b *Bootstrap) commandShell() ([]string, error) {
+	if b.Shell == "" {
+		return nil, nil
+	}
+
+	args, err := shellwords.Parse(b.Shell)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the shell \"%s\" (%v)", b.Shell, err)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("The shell \"%s\" doesn't have a command to run", b.Shell)
+	}
+
+	return args, nil
+}
+
+// Returns the argument the shell is given to run the build script. PowerShell's
+// -Command runs its argument as PowerShell rather than as a path, so the path
+// is quoted and called like a command.
+func shellScriptArg(commandShell []string, scriptPath string) string {
+	if shell.IsPowershell(commandShell[0]) {
+		switch strings.ToLower(commandShell[len(commandShell)-1]) {
+		case "-command", "-c":
+			return "& " + shell.PowershellQuote(scriptPath)
+		}
+	}
+	return scriptPath
+}
+
+// Runs the build script in a container with the deprecated BUILDKITE_DOCKER*
+// env vars
+type dockerExecutor struct {
+	b *Bootstrap
+}
+
+func (e *dockerExecutor) Run(ctx context.Context, scriptPath string) error {
+	if e.b.Debug {
+		e.b.shell.Commentf("Detected deprecated docker environment variables")
+	}
+	return runDeprecatedDockerIntegration(ctx, e.b.shell, scriptPath)
+}
+
+// Runs the build script with bubblewrap, in a sandbox where the system
+// directories are read-only and only the checkout can be written to. It has
+// it's own empty home and temp directories, so it can't get at the agent's
+// credentials.
+type bubblewrapExecutor struct {
+	b *Bootstrap
+}
+
+func (e *bubblewrapExecutor) Run(ctx context.Context, scriptPath string) error {
+	home, _ := e.b.shell.Env.Get("HOME")
+
+	e.b.shell.Commentf("Running the command in a bubblewrap sandbox")
+	return e.b.shell.Run(ctx, "bwrap", bubblewrapArgs(e.b.shell.Getwd(), home, e.b.BinPath, e.b.sandboxHiddenPaths(), nil, e.b.sandboxWritablePaths(), "/bin/bash", "-c", scriptPath)...)
+}
+
+// Runs a hook from the checkout or a plugin in the same sandbox as the
+// command. It can read the plugins and the directory it's in, and write to
+// the files it makes its changes to the environment in.
+func (b *Bootstrap) runHookInSandbox(ctx context.Context, hookPath string, command []string, extra *env.Environment, files, envFiles []string) error {
+	if runtime.GOOS != "linux" {
+		return errors.New("The bubblewrap job sandbox is only supported on linux")
+	}
+
+	wd := b.shell.Getwd()
+	home, _ := b.shell.Env.Get("HOME")
+
+	var readOnlyPaths []string
+	if b.PluginsPath != "" && fileExists(b.PluginsPath) {
+		readOnlyPaths = append(readOnlyPaths, b.PluginsPath)
+	}
+	if dir := filepath.Dir(hookPath); !withinDir(wd, dir) && !withinDir(b.PluginsPath, dir) {
+		readOnlyPaths = append(readOnlyPaths, dir)
+	}
+	readOnlyPaths = append(readOnlyPaths, files...)
+
+	writablePaths := append(b.sandboxWritablePaths(), envFiles...)
+
+	return b.shell.RunWithEnv(ctx, extra, "bwrap", bubblewrapArgs(wd, home, b.BinPath, b.sandboxHiddenPaths(), readOnlyPaths, writablePaths, command...)...)
+}
+
+// Returns the agent's directories that are hidden inside the sandbox, which are
+// its config and global hooks. Ones that don't exist are skipped, as there'd be
+// nowhere in the read-only system directories to mount over.
+func (b *Bootstrap) sandboxHiddenPaths() []string {
+	var paths []string
+	for _, path := range append(append([]string{}, sandboxHiddenPaths...), b.HooksPath) {
+		if path != "" && fileExists(path) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// Returns the paths the job can write to inside the sandbox, besides the
+// checkout. The socket of the job's ssh-agent is in the agent's temp
+// directory, which the sandbox has its own of, so it's mounted too.
+func (b *Bootstrap) sandboxWritablePaths() []string {
+	paths := append([]string{}, b.JobSandboxWritablePaths...)
+	if socket, ok := b.shell.Env.Get("SSH_AUTH_SOCK"); ok && socket != "" && fileExists(socket) {
+		paths = append(paths, socket)
+	}
+	return paths
+}
+
+func bubblewrapArgs(wd, home, binPath string, hiddenPaths, readOnlyPaths, writablePaths []string, command ...string) []string {
+	args := []string{
+		"--die-with-parent",
+		"--new-session",
+		"--unshare-all",
+		"--share-net",
+	}
+
+	for _, path := range sandboxReadOnlyPaths {
+		args = append(args, "--ro-bind-try", path, path)
+	}
+
+	args = append(args,
+		"--dev", "/dev",
+		"--proc", "/proc",
+		"--tmpfs", "/tmp",
+	)
+
+	// Hides the agent's home directory, and anything in it like ssh keys.
+	// This comes before the other mounts, which might be within it.
+	if home != "" && home != string(os.PathSeparator) {
+		args = append(args, "--tmpfs", home)
+	}
+
+	// Hides the agent's config and hooks, which the system directories
+	// above include
+	for _, path := range hiddenPaths {
+		args = append(args, "--tmpfs", path)
+	}
+
+	// The command can still use buildkite-agent, i.e. to upload artifacts
+	if binPath != "" {
+		args = append(args, "--ro-bind-try", binPath, binPath)
+	}
+
+	for _, path := range readOnlyPaths {
+		args = append(args, "--ro-bind", path, path)
+	}
+
+	for _, path := range append([]string{wd}, writablePaths...) {
+		args = append(args, "--bind", path, path)
+	}
+
+	// The checkout is shared with the jobs after it that aren't sandboxed,
+	// whose checkouts run the repository's config and hooks, so they can't
+	// be written to. One that isn't there yet can't be made either.
+	for _, name := range sandboxReadOnlyCheckoutDirs {
+		path := filepath.Join(wd, name)
+		if fileExists(path) {
+			args = append(args, "--ro-bind", path, path)
+		} else {
+			args = append(args, "--tmpfs", path, "--remount-ro", path)
+		}
+	}
+
+	args = append(args, "--chdir", wd, "--")
+	return append(args, command...)
+}
@@ -0,0 +1,398 @@
+package bootstrap
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobSandbox(t *testing.T) {
+	t.Parallel()
+
+	var testCases = []struct {
+		sandbox          string
+		pullRequestsOnly bool
+		pullRequest      string
+		expected         string
+	}{
+		{"", false, "false", sandboxNone},
+		{"none", false, "123", sandboxNone},
+		{"bubblewrap", false, "false", sandboxBubblewrap},
+		{"bwrap", false, "false", sandboxBubblewrap},
+		{"bubblewrap", true, "false", sandboxNone},
+		{"bubblewrap", true, "", sandboxNone},
+		{"bubblewrap", true, "123", sandboxBubblewrap},
+	}
+
+	for _, tc := range testCases {
+		b := &Bootstrap{Config: Config{
+			JobSandbox:                 tc.sandbox,
+			JobSandboxPullRequestsOnly: tc.pullRequestsOnly,
+			PullRequest:                tc.pullRequest,
+		}}
+
+		sandbox, err := b.jobSandbox()
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, sandbox, tc)
+	}
+
+	b := &Bootstrap{Config: Config{JobSandbox: "nsjail"}}
+	_, err := b.jobSandbox()
+	assert.Error(t, err)
+}
+
+func TestCommandExecutor(t *testing.T) {
+	t.Parallel()
+
+	b := &Bootstrap{shell: newTestShell(t)}
+
+	executor, err := b.commandExecutor()
+	assert.NoError(t, err)
+	assert.IsType(t, &shellExecutor{}, executor)
+
+	b.JobSandbox = sandboxBubblewrap
+	executor, err = b.commandExecutor()
+	if runtime.GOOS == "linux" {
+		assert.NoError(t, err)
+		assert.IsType(t, &bubblewrapExecutor{}, executor)
+	} else {
+		assert.Error(t, err)
+	}
+
+	// Containers can't be run from inside the sandbox
+	b.shell.Env.Set("BUILDKITE_DOCKER", "llamas")
+	_, err = b.commandExecutor()
+	assert.Error(t, err)
+
+	b.JobSandbox = sandboxNone
+	executor, err = b.commandExecutor()
+	assert.NoError(t, err)
+	assert.IsType(t, &dockerExecutor{}, executor)
+}
+
+func TestCommandExecutorRunsAsTheJobUser(t *testing.T) {
+	t.Parallel()
+
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("The current user couldn't be found (%v)", err)
+	}
+
+	b := &Bootstrap{shell: newTestShell(t), Config: Config{JobUser: current.Username}}
+
+	executor, err := b.commandExecutor()
+	assert.NoError(t, err)
+	if assert.IsType(t, &userExecutor{}, executor) {
+		assert.IsType(t, &shellExecutor{}, executor.(*userExecutor).executor)
+	}
+
+	b.JobUser = "llama-that-isnt-a-user"
+	_, err = b.commandExecutor()
+	assert.Error(t, err)
+}
+
+func TestBubblewrapArgs(t *testing.T) {
+	t.Parallel()
+
+	args := bubblewrapArgs("/builds/llamas", "/home/buildkite", "/usr/local/bin", []string{"/etc/buildkite-agent"}, []string{"/etc/buildkite-agent/plugins"}, []string{"/var/cache/npm"}, "/bin/bash", "-c", "./build.sh")
+
+	assert.Equal(t, []string{
+		"--die-with-parent",
+		"--new-session",
+		"--unshare-all",
+		"--share-net",
+		"--ro-bind-try", "/usr", "/usr",
+		"--ro-bind-try", "/bin", "/bin",
+		"--ro-bind-try", "/sbin", "/sbin",
+		"--ro-bind-try", "/lib", "/lib",
+		"--ro-bind-try", "/lib32", "/lib32",
+		"--ro-bind-try", "/lib64", "/lib64",
+		"--ro-bind-try", "/etc", "/etc",
+		"--ro-bind-try", "/opt", "/opt",
+		"--dev", "/dev",
+		"--proc", "/proc",
+		"--tmpfs", "/tmp",
+		"--tmpfs", "/home/buildkite",
+		"--tmpfs", "/etc/buildkite-agent",
+		"--ro-bind-try", "/usr/local/bin", "/usr/local/bin",
+		"--ro-bind", "/etc/buildkite-agent/plugins", "/etc/buildkite-agent/plugins",
+		"--bind", "/builds/llamas", "/builds/llamas",
+		"--bind", "/var/cache/npm", "/var/cache/npm",
+		"--tmpfs", "/builds/llamas/.git", "--remount-ro", "/builds/llamas/.git",
+		"--tmpfs", "/builds/llamas/.hg", "--remount-ro", "/builds/llamas/.hg",
+		"--chdir", "/builds/llamas",
+		"--",
+		"/bin/bash", "-c", "./build.sh",
+	}, args)
+}
+
+func TestBubblewrapArgsHideTheAgentsConfig(t *testing.T) {
+	t.Parallel()
+
+	hooksDir, err := ioutil.TempDir("", "bubblewrap-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hooksDir)
+
+	b := &Bootstrap{Config: Config{HooksPath: hooksDir}}
+	assert.Contains(t, b.sandboxHiddenPaths(), hooksDir)
+
+	b.HooksPath = filepath.Join(hooksDir, "missing")
+	assert.NotContains(t, b.sandboxHiddenPaths(), b.HooksPath)
+
+	// The config directory is hidden after /etc is mounted, and before the
+	// plugins within it are
+	args := strings.Join(bubblewrapArgs("/builds/llamas", "", "", []string{"/etc/buildkite-agent"}, []string{"/etc/buildkite-agent/plugins"}, nil, "true"), " ")
+	assert.Contains(t, args, "--ro-bind-try /etc /etc")
+	assert.Contains(t, args, "--tmpfs /etc/buildkite-agent --ro-bind /etc/buildkite-agent/plugins")
+	assert.True(t, strings.Index(args, "--ro-bind-try /etc /etc") < strings.Index(args, "--tmpfs /etc/buildkite-agent"))
+}
+
+func TestBubblewrapArgsKeepTheJobsSSHAgent(t *testing.T) {
+	if _, err := exec.LookPath("ssh-agent"); err != nil {
+		t.Skip("ssh-agent isn't installed")
+	}
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "bubblewrap-ssh-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "agent.sock")
+	sshAgent := exec.Command("ssh-agent", "-D", "-a", socket)
+	if err := sshAgent.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = sshAgent.Process.Kill()
+		_ = sshAgent.Wait()
+	}()
+
+	for started := time.Now(); !fileExists(socket); time.Sleep(50 * time.Millisecond) {
+		if time.Since(started) > 10*time.Second {
+			t.Fatal("ssh-agent didn't start")
+		}
+	}
+
+	b := &Bootstrap{shell: newTestShell(t), Config: Config{JobSandboxWritablePaths: []string{"/var/cache/npm"}}}
+	b.shell.Env.Set("SSH_AUTH_SOCK", socket)
+	assert.Equal(t, []string{"/var/cache/npm", socket}, b.sandboxWritablePaths())
+
+	if _, err := exec.LookPath("bwrap"); err != nil {
+		t.Skipf("bwrap isn't installed (%v)", err)
+	}
+
+	checkoutDir, err := ioutil.TempDir("", "bubblewrap-checkout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(checkoutDir)
+
+	// ssh-add only says the agent has no keys if it could connect to it
+	args := bubblewrapArgs(checkoutDir, "", "", nil, nil, []string{socket}, "ssh-add", "-l")
+	cmd := exec.Command("bwrap", args...)
+	cmd.Env = []string{"SSH_AUTH_SOCK=" + socket}
+	out, _ := cmd.CombinedOutput()
+	assert.Contains(t, string(out), "no identities")
+}
+
+func TestBubblewrapArgsProtectTheRepository(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "bubblewrap-repository")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gitDir := filepath.Join(dir, ".git")
+	if err := os.MkdirAll(filepath.Join(gitDir, "hooks"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	args := bubblewrapArgs(dir, "", "", nil, nil, nil, "/bin/sh", "-c", "echo llamas > .git/hooks/post-checkout")
+	assert.Contains(t, strings.Join(args, " "), "--bind "+dir+" "+dir+" --ro-bind "+gitDir+" "+gitDir)
+
+	if _, err := exec.LookPath("bwrap"); err != nil {
+		t.Skipf("bwrap isn't installed (%v)", err)
+	}
+
+	out, err := exec.Command("bwrap", args...).CombinedOutput()
+	assert.Error(t, err, string(out))
+	assert.False(t, fileExists(filepath.Join(gitDir, "hooks", "post-checkout")))
+}
+
+func TestCommandShell(t *testing.T) {
+	t.Parallel()
+
+	var testCases = []struct {
+		shell      string
+		scriptType string
+		scriptArg  string
+	}{
+		{`pwsh -Command`, scriptTypePowershell, `& 'C:\builds\buildkite-script-1.ps1'`},
+		{`'C:\Program Files\PowerShell\7\pwsh.exe' -NoProfile -File`, scriptTypePowershell, `C:\builds\buildkite-script-1.ps1`},
+		{`powershell.exe -c`, scriptTypePowershell, `& 'C:\builds\buildkite-script-1.ps1'`},
+		{`cmd.exe /c`, scriptTypeBatch, `C:\builds\buildkite-script-1.ps1`},
+		{`/bin/bash -e -c`, scriptTypeBash, `C:\builds\buildkite-script-1.ps1`},
+	}
+
+	for _, tc := range testCases {
+		b := &Bootstrap{Config: Config{Shell: tc.shell}}
+
+		commandShell, err := b.commandShell()
+		assert.NoError(t, err, tc.shell)
+
+		scriptType, err := b.commandScriptType()
+		assert.NoError(t, err, tc.shell)
+		assert.Equal(t, tc.scriptType, scriptType, tc.shell)
+
+		assert.Equal(t, tc.scriptArg, shellScriptArg(commandShell, `C:\builds\buildkite-script-1.ps1`), tc.shell)
+	}
+
+	b := &Bootstrap{Config: Config{Shell: `"pwsh -Command`}}
+	_, err := b.commandShell()
+	assert.Error(t, err)
+}
+
+func TestPowershellCommandScript(t *testing.T) {
+	t.Parallel()
+
+	script := commandScript(scriptTypePowershell, "npm install\nWrite-Host 'llamas'")
+
+	assert.Equal(t, "$ErrorActionPreference = 'Stop'\n"+
+		"Write-Host (\"$([char]27)[90m>$([char]27)[0m \" + 'npm install')\n"+
+		"npm install\n"+
+		"if ($LASTEXITCODE) { exit $LASTEXITCODE }\n"+
+		"Write-Host (\"$([char]27)[90m>$([char]27)[0m \" + 'Write-Host ''llamas''')\n"+
+		"Write-Host 'llamas'\n"+
+		"if ($LASTEXITCODE) { exit $LASTEXITCODE }\n", script)
+}
+
+func TestJobHooksRunInTheJobSandbox(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("The bubblewrap sandbox is only supported on linux")
+	}
+
+	dir, err := ioutil.TempDir("", "job-hook-sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A bwrap that says how it was run, and then runs the command without
+	// a sandbox
+	argsPath := filepath.Join(dir, "bwrap-args")
+	bwrap := "#!/bin/bash\n" +
+		"printf '%s\\n' \"$@\" > " + argsPath + "\n" +
+		"while [[ $1 != -- ]]; do shift; done\n" +
+		"shift\n" +
+		"exec \"$@\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "bwrap"), []byte(bwrap), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	checkout := filepath.Join(dir, "checkout")
+	if err := os.MkdirAll(filepath.Join(checkout, ".buildkite", "hooks"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(checkout, ".buildkite", "hooks", "command"), []byte("export LLAMAS=rock\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := newTestShell(t)
+	sh.Env.Set("PATH", dir+":/usr/bin:/bin")
+	if err := sh.Chdir(checkout); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Bootstrap{shell: sh, Config: Config{JobSandbox: sandboxBubblewrap}}
+	if err := b.executeLocalHook(context.Background(), "command"); err != nil {
+		t.Fatal(err)
+	}
+
+	args, err := ioutil.ReadFile(argsPath)
+	if err != nil {
+		t.Fatalf("Expected the local hook to be run with bwrap (%v)", err)
+	}
+	assert.Contains(t, string(args), "--bind\n"+checkout+"\n"+checkout+"\n")
+
+	// The hook's changes to the environment still make it out
+	llamas, _ := sh.Env.Get("LLAMAS")
+	assert.Equal(t, "rock", llamas)
+
+	// The agent's own hooks aren't the job's, so they're run as they are
+	os.Remove(argsPath)
+	globalHook := filepath.Join(dir, "pre-command")
+	if err := ioutil.WriteFile(globalHook, []byte("export ALPACAS=ok\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.executeHook(context.Background(), "global pre-command", globalHook, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, fileExists(argsPath))
+}
+
+func TestJobHooksRunAsTheJobUser(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Getuid() != 0 {
+		t.Skipf("Running as another user needs root")
+	}
+	if _, err := user.Lookup("nobody"); err != nil {
+		t.Skipf("There isn't a nobody user (%v)", err)
+	}
+
+	dir, err := ioutil.TempDir("", "job-hook-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	checkout := filepath.Join(dir, "checkout")
+	if err := os.MkdirAll(filepath.Join(checkout, ".buildkite", "hooks"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(checkout, ".buildkite", "hooks", "post-checkout"), []byte("export WHO=$(id -un)\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := newTestShell(t)
+	sh.Env.Set("PATH", "/usr/bin:/bin")
+	sh.Env.Set("BUILDKITE_BUILD_CHECKOUT_PATH", checkout)
+	if err := sh.Chdir(checkout); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Bootstrap{shell: sh, Config: Config{JobUser: "nobody"}}
+	if err := b.executeLocalHook(context.Background(), "post-checkout"); err != nil {
+		t.Fatal(err)
+	}
+
+	who, _ := sh.Env.Get("WHO")
+	assert.Equal(t, "nobody", who)
+	assert.Nil(t, sh.Credential)
+	assert.True(t, b.checkoutIsJobUsers)
+
+	// The user could have changed its git config and hooks, so the
+	// bootstrap's git doesn't use it again
+	if err := b.takeBackCheckout(checkout); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, b.checkoutIsJobUsers)
+	assert.False(t, fileExists(checkout))
+}
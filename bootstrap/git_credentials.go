@@ -0,0 +1,51 @@
+package bootstrap
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/buildkite/agent/env"
+)
+
+// The git config that has git ask `buildkite-agent git-credentials-helper`
+// for the checkout's credentials. The empty helper first resets any helpers
+// configured on the machine, so a token stored on it is never used instead,
+// and the path is sent so tokens can be scoped to the repository.
+var gitCredentialsConfig = [][2]string{
+	{"credential.helper", ""},
+	{"credential.helper", "!buildkite-agent git-credentials-helper"},
+	{"credential.useHttpPath", "true"},
+}
+
+// Has git get its HTTPS credentials from the agent's git credentials
+// provider, with the config passed in the environment so it doesn't touch
+// the machine's ~/.gitconfig
+func (b *Bootstrap) configureGitCredentialsHelper() error {
+	if b.GitCredentialsProvider == "" {
+		return nil
+	}
+
+	b.shell.Commentf("Using %s credentials for git", b.GitCredentialsProvider)
+
+	return addGitConfigToEnv(b.shell.Env, gitCredentialsConfig)
+}
+
+// Adds git config with GIT_CONFIG_COUNT, after any that's already there
+func addGitConfigToEnv(environ *env.Environment, config [][2]string) error {
+	count := 0
+	if value, ok := environ.Get("GIT_CONFIG_COUNT"); ok && value != "" {
+		var err error
+		if count, err = strconv.Atoi(value); err != nil {
+			return fmt.Errorf("GIT_CONFIG_COUNT isn't a number (%q)", value)
+		}
+	}
+
+	for _, entry := range config {
+		environ.Set(fmt.Sprintf("GIT_CONFIG_KEY_%d", count), entry[0])
+		environ.Set(fmt.Sprintf("GIT_CONFIG_VALUE_%d", count), entry[1])
+		count++
+	}
+
+	environ.Set("GIT_CONFIG_COUNT", strconv.Itoa(count))
+	return nil
+}
@@ -0,0 +1,34 @@
+package bootstrap
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddingGitConfigToEnv(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromSlice([]string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=core.autocrlf",
+		"GIT_CONFIG_VALUE_0=false",
+	})
+
+	assert.NoError(t, addGitConfigToEnv(environ, gitCredentialsConfig))
+
+	for name, expected := range map[string]string{
+		"GIT_CONFIG_COUNT":   "4",
+		"GIT_CONFIG_KEY_0":   "core.autocrlf",
+		"GIT_CONFIG_KEY_1":   "credential.helper",
+		"GIT_CONFIG_VALUE_1": "",
+		"GIT_CONFIG_VALUE_2": "!buildkite-agent git-credentials-helper",
+		"GIT_CONFIG_KEY_3":   "credential.useHttpPath",
+	} {
+		value, _ := environ.Get(name)
+		assert.Equal(t, expected, value, name)
+	}
+
+	assert.Error(t, addGitConfigToEnv(env.FromSlice([]string{"GIT_CONFIG_COUNT=llamas"}), gitCredentialsConfig))
+}
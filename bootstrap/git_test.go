@@ -1,8 +1,15 @@
 package bootstrap
 
 import (
+	"context"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 func TestParsingGittableRepository(t *testing.T) {
@@ -52,3 +59,211 @@ func TestStrippingGitHostAliases(t *testing.T) {
 		}
 	}
 }
+
+func TestParsingGitDepth(t *testing.T) {
+	t.Parallel()
+
+	var testCases = []struct {
+		Depth    string
+		Expected int
+		IsErr    bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"50", 50, false},
+		{"-1", 0, true},
+		{"llamas", 0, true},
+	}
+
+	for _, tc := range testCases {
+		actual, err := parseGitDepth(tc.Depth)
+		if (err != nil) != tc.IsErr {
+			t.Fatalf("Unexpected error for %q: %v", tc.Depth, err)
+		}
+		if actual != tc.Expected {
+			t.Fatalf("Expected %d, got %d", tc.Expected, actual)
+		}
+	}
+}
+
+func TestGitSparseCheckoutPatterns(t *testing.T) {
+	t.Parallel()
+
+	actual := strings.Join(gitSparseCheckoutPatterns(" services/api, /lib/,,README.md"), " ")
+	if expected := "/services/api /lib/ /README.md"; actual != expected {
+		t.Fatalf("Expected %q, got %q", expected, actual)
+	}
+
+	if patterns := gitSparseCheckoutPatterns(""); len(patterns) != 0 {
+		t.Fatalf("Expected no patterns, got %v", patterns)
+	}
+}
+
+func TestGitSubmoduleConfigArgs(t *testing.T) {
+	t.Parallel()
+
+	args, err := gitSubmoduleConfigArgs([]string{"git@github.com:=https://github.com/", " "}, "/etc/git-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"-c", "url.https://github.com/.insteadOf=git@github.com:",
+		"-c", "credential.helper=store --file='/etc/git-credentials'",
+	}
+	if strings.Join(args, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected %q, got %q", expected, args)
+	}
+
+	if _, err = gitSubmoduleConfigArgs([]string{"git@github.com:"}, ""); err == nil {
+		t.Fatalf("Expected an error for a rewrite without a replacement")
+	}
+}
+
+func TestGitSubmoduleUpdateArgs(t *testing.T) {
+	t.Parallel()
+
+	var testCases = []struct {
+		Depth    int
+		Expected []string
+	}{
+		{0, []string{"submodule update --init --recursive --force"}},
+		{1, []string{"submodule update --init --force"}},
+		{2, []string{
+			"submodule update --init --force",
+			"submodule foreach --quiet git submodule update --init --force",
+		}},
+	}
+
+	for _, tc := range testCases {
+		commands := gitSubmoduleUpdateArgs([]string{}, tc.Depth)
+		if len(commands) != len(tc.Expected) {
+			t.Fatalf("Expected %d commands for depth %d, got %q", len(tc.Expected), tc.Depth, commands)
+		}
+		for i, args := range commands {
+			if strings.Join(args, " ") != tc.Expected[i] {
+				t.Fatalf("Expected %q, got %q", tc.Expected[i], strings.Join(args, " "))
+			}
+		}
+	}
+}
+
+func TestTransientGitErrors(t *testing.T) {
+	t.Parallel()
+
+	exitErr := errors.New("exit status 128")
+
+	var testCases = []struct {
+		Err       error
+		Transient bool
+	}{
+		{nil, false},
+		{exitErr, false},
+		{&gitError{err: exitErr, stderr: "fatal: early EOF\nfatal: index-pack failed\n"}, true},
+		{&gitError{err: exitErr, stderr: "fatal: The remote end hung up unexpectedly\n"}, true},
+		{&gitError{err: exitErr, stderr: "error: RPC failed; curl 56 Recv failure: Connection reset by peer\n"}, true},
+		{&gitError{err: exitErr, stderr: "fatal: unable to access 'https://example.com/repo.git/': The requested URL returned error: 503\n"}, true},
+		{&gitError{err: exitErr, stderr: "fatal: repository 'https://example.com/repo.git/' not found\n"}, false},
+		{&gitError{err: exitErr, stderr: "fatal: couldn't find remote ref refs/heads/llamas\n"}, false},
+		{errors.Wrap(&gitError{err: exitErr, stderr: "fatal: early EOF"}, "Failed to fetch"), true},
+	}
+
+	for _, tc := range testCases {
+		if actual := isTransientGitError(tc.Err); actual != tc.Transient {
+			t.Fatalf("Expected transient to be %v for %v, got %v", tc.Transient, tc.Err, actual)
+		}
+	}
+}
+
+func TestRetryingTransientGitErrors(t *testing.T) {
+	defer func(interval time.Duration) { gitRetryInterval = interval }(gitRetryInterval)
+	gitRetryInterval = time.Millisecond
+
+	dir, err := ioutil.TempDir("", "git-retry-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sh := newTestShell(t)
+	if err := sh.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	transient := &gitError{err: errors.New("exit status 128"), stderr: "fatal: early EOF"}
+	permanent := &gitError{err: errors.New("exit status 128"), stderr: "fatal: repository not found"}
+
+	var testCases = []struct {
+		Name     string
+		Retries  int
+		Errors   []error
+		Attempts int
+		Failed   bool
+	}{
+		{"success", 2, []error{nil}, 1, false},
+		{"transient then success", 2, []error{transient, nil}, 2, false},
+		{"always transient", 2, []error{transient, transient, transient}, 3, true},
+		{"permanent", 2, []error{permanent}, 1, true},
+		{"no retries", 0, []error{transient}, 1, true},
+	}
+
+	for _, tc := range testCases {
+		b := &Bootstrap{shell: sh, Config: Config{GitRetries: tc.Retries}}
+
+		attempts := 0
+		err := b.retryTransientGitErrors(context.Background(), func() error {
+			err := tc.Errors[attempts]
+			attempts++
+			return err
+		})
+
+		if attempts != tc.Attempts {
+			t.Fatalf("%s: expected %d attempts, got %d", tc.Name, tc.Attempts, attempts)
+		}
+		if (err != nil) != tc.Failed {
+			t.Fatalf("%s: expected failed to be %v, got %v", tc.Name, tc.Failed, err)
+		}
+	}
+}
+
+func TestRetryingTransientGitErrorsReclones(t *testing.T) {
+	defer func(interval time.Duration) { gitRetryInterval = interval }(gitRetryInterval)
+	gitRetryInterval = time.Millisecond
+
+	dir, err := ioutil.TempDir("", "git-retry-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sh := newTestShell(t)
+	if err := sh.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	partial := filepath.Join(dir, "partial")
+	if err = ioutil.WriteFile(partial, []byte("llamas"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Bootstrap{shell: sh, Config: Config{GitRetries: 1, GitRetryReclone: true}}
+
+	attempts := 0
+	err = b.retryTransientGitErrors(context.Background(), func() error {
+		attempts++
+		if attempts == 1 {
+			return &gitError{err: errors.New("exit status 128"), stderr: "fatal: early EOF"}
+		}
+		if fileExists(partial) {
+			t.Fatalf("Expected the checkout to be removed before the last attempt")
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(dir) {
+		t.Fatalf("Expected the checkout directory to be created again")
+	}
+}
@@ -1,19 +1,24 @@
 package bootstrap
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"github.com/buildkite/agent/bootstrap/shell"
 	"github.com/buildkite/agent/env"
 )
 
 const (
-	hookExitStatusEnv = `BUILDKITE_HOOK_EXIT_STATUS`
-	hookWorkingDirEnv = `BUILDKITE_HOOK_WORKING_DIR`
+	hookExitStatusEnv  = `BUILDKITE_HOOK_EXIT_STATUS`
+	hookWorkingDirEnv  = `BUILDKITE_HOOK_WORKING_DIR`
+	hookEnvFileJSONEnv = `BUILDKITE_ENV_FILE_JSON`
 )
 
 // Hooks get "sourced" into the bootstrap in the sense that they get the
@@ -26,6 +31,20 @@ const (
 // Then we can use the diff of the two to figure out what changes to make to the
 // bootstrap. Horrible, but effective.
 
+// Hooks can also make changes by writing a JSON object of variables to the
+// file named in BUILDKITE_ENV_FILE_JSON, which is handy for hooks that can't
+// export variables the way a shell does, for example:
+//
+//	{"LLAMAS": "rock", "BUILDKITE_HOOK_WORKING_DIR": "/path/to/dir"}
+//
+// Setting BUILDKITE_HOOK_WORKING_DIR changes the working directory of the rest
+// of the job, the same as a shell hook running cd. Anything in the file takes
+// precedence over the changes found by diffing the environment.
+
+// PowerShell hooks (ones with a .ps1 extension) are dot-sourced by a
+// PowerShell wrapper in the same way, so they can change the environment with
+// $env:NAME = "value" and the working directory with Set-Location.
+
 // hookScriptWrapper wraps a hook script with env collection and then provides
 // a way to get the difference between the environment before the hook is run and
 // after it
@@ -34,12 +53,13 @@ type hookScriptWrapper struct {
 	scriptFile    *os.File
 	beforeEnvFile *os.File
 	afterEnvFile  *os.File
+	jsonEnvFile   *os.File
 	beforeWd      string
 }
 
 type hookScriptChanges struct {
-	Env *env.Environment
-	Dir string
+	Diff env.Diff
+	Dir  string
 }
 
 func newHookScriptWrapper(hookPath string) (*hookScriptWrapper, error) {
@@ -50,9 +70,12 @@ func newHookScriptWrapper(hookPath string) (*hookScriptWrapper, error) {
 	var err error
 
 	// Create a temporary file that we'll put the hook runner code in
-	h.scriptFile, err = shell.TempFileWithExtension(normalizeScriptFileName(
-		`buildkite-agent-bootstrap-hook-runner`,
-	))
+	scriptFileName := normalizeScriptFileName(`buildkite-agent-bootstrap-hook-runner`)
+	if shell.IsPowershellScript(hookPath) {
+		scriptFileName = `buildkite-agent-bootstrap-hook-runner.ps1`
+	}
+
+	h.scriptFile, err = shell.TempFileWithExtension(scriptFileName)
 	if err != nil {
 		return nil, err
 	}
@@ -75,6 +98,12 @@ func newHookScriptWrapper(hookPath string) (*hookScriptWrapper, error) {
 	}
 	h.afterEnvFile.Close()
 
+	// And the hook can write JSON changes to the ENV into this one
+	h.jsonEnvFile, err = newHookEnvFileJSON()
+	if err != nil {
+		return nil, err
+	}
+
 	absolutePathToHook, err := filepath.Abs(h.hookPath)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to find absolute path to \"%s\" (%s)", h.hookPath, err)
@@ -87,9 +116,19 @@ func newHookScriptWrapper(hookPath string) (*hookScriptWrapper, error) {
 
 	// Create the hook runner code
 	var script string
-	if runtime.GOOS == "windows" {
+	if shell.IsPowershellScript(hookPath) {
+		script = "$env:" + hookEnvFileJSONEnv + " = " + shell.PowershellQuote(h.jsonEnvFile.Name()) + "\n" +
+			powershellExportEnv(h.beforeEnvFile.Name()) + "\n" +
+			"$global:LASTEXITCODE = 0\n" +
+			". " + shell.PowershellQuote(absolutePathToHook) + "\n" +
+			"$env:" + hookExitStatusEnv + " = $LASTEXITCODE\n" +
+			"$env:" + hookWorkingDirEnv + " = (Get-Location).Path\n" +
+			powershellExportEnv(h.afterEnvFile.Name()) + "\n" +
+			"exit [int]$env:" + hookExitStatusEnv
+	} else if runtime.GOOS == "windows" {
 		script = "@echo off\n" +
 			"SETLOCAL ENABLEDELAYEDEXPANSION\n" +
+			"SET " + hookEnvFileJSONEnv + "=" + h.jsonEnvFile.Name() + "\n" +
 			"SET > \"" + h.beforeEnvFile.Name() + "\"\n" +
 			"CALL \"" + absolutePathToHook + "\"\n" +
 			"SET " + hookExitStatusEnv + "=!ERRORLEVEL!\n" +
@@ -98,6 +137,7 @@ func newHookScriptWrapper(hookPath string) (*hookScriptWrapper, error) {
 			"EXIT %" + hookExitStatusEnv + "%"
 	} else {
 		script = "#!/bin/bash\n" +
+			"export " + hookEnvFileJSONEnv + "=\"" + h.jsonEnvFile.Name() + "\"\n" +
 			"export -p > \"" + h.beforeEnvFile.Name() + "\"\n" +
 			". \"" + absolutePathToHook + "\"\n" +
 			"export " + hookExitStatusEnv + "=$?\n" +
@@ -118,16 +158,29 @@ func newHookScriptWrapper(hookPath string) (*hookScriptWrapper, error) {
 	return h, nil
 }
 
+// Returns PowerShell that writes the environment to a file in the same
+// NAME=value format as the SET command, without the byte order mark that
+// Windows PowerShell adds when writing UTF-8 with Set-Content
+func powershellExportEnv(path string) string {
+	return "[IO.File]::WriteAllLines(" + shell.PowershellQuote(path) + ", [string[]](Get-ChildItem Env: | ForEach-Object { \"$($_.Name)=$($_.Value)\" }))"
+}
+
 // Path returns the path to the wrapper script, this is the one that should be executed
 func (h *hookScriptWrapper) Path() string {
 	return h.scriptFile.Name()
 }
 
+// The files the wrapper script writes the environment to
+func (h *hookScriptWrapper) envFiles() []string {
+	return []string{h.beforeEnvFile.Name(), h.afterEnvFile.Name(), h.jsonEnvFile.Name()}
+}
+
 // Close cleans up the wrapper script and the environment files
 func (h *hookScriptWrapper) Close() {
 	os.Remove(h.scriptFile.Name())
 	os.Remove(h.beforeEnvFile.Name())
 	os.Remove(h.afterEnvFile.Name())
+	os.Remove(h.jsonEnvFile.Name())
 }
 
 // Changes returns the changes in the environment and working dir after the hook script runs
@@ -142,13 +195,213 @@ func (h *hookScriptWrapper) Changes() (hookScriptChanges, error) {
 		return hookScriptChanges{}, fmt.Errorf("Failed to read \"%s\" (%s)", h.afterEnvFile.Name(), err)
 	}
 
+	jsonEnv, err := readHookEnvFileJSON(h.jsonEnvFile.Name())
+	if err != nil {
+		return hookScriptChanges{}, err
+	}
+
+	// Anything written to the JSON file wins over what the hook exported
 	beforeEnv := env.FromExport(string(beforeEnvContents))
-	afterEnv := env.FromExport(string(afterEnvContents))
+	afterEnv := env.FromExport(string(afterEnvContents)).Merge(jsonEnv)
 	diff := afterEnv.Diff(beforeEnv)
-	wd, _ := diff.Get(hookWorkingDirEnv)
+
+	wd, _ := afterEnv.Get(hookWorkingDirEnv)
 
 	diff.Remove(hookExitStatusEnv)
 	diff.Remove(hookWorkingDirEnv)
+	diff.Remove(hookEnvFileJSONEnv)
+
+	return hookScriptChanges{Diff: diff, Dir: wd}, nil
+}
+
+// Creates the empty file a hook can write JSON environment changes to
+func newHookEnvFileJSON() (*os.File, error) {
+	f, err := shell.TempFileWithExtension(
+		`buildkite-agent-bootstrap-hook-env-json`,
+	)
+	if err != nil {
+		return nil, err
+	}
 
-	return hookScriptChanges{Env: diff, Dir: wd}, nil
+	return f, f.Close()
+}
+
+// Reads the JSON object of environment changes a hook wrote to the file in
+// BUILDKITE_ENV_FILE_JSON. An empty file means there aren't any changes.
+func readHookEnvFileJSON(path string) (*env.Environment, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read \"%s\" (%s)", path, err)
+	}
+
+	changes := env.FromSlice([]string{})
+	if len(bytes.TrimSpace(contents)) == 0 {
+		return changes, nil
+	}
+
+	var vars map[string]string
+	if err = json.Unmarshal(contents, &vars); err != nil {
+		return nil, fmt.Errorf("Failed to parse the environment written to %s (%s)", hookEnvFileJSONEnv, err)
+	}
+
+	for k, v := range vars {
+		changes.Set(k, v)
+	}
+
+	return changes, nil
+}
+
+// Hooks that aren't shell scripts (i.e. a Python script or a compiled binary)
+// can't be sourced, so they're run directly instead. As we can't see the
+// environment they finish with, the only way they can make changes to the
+// job's environment is with BUILDKITE_ENV_FILE_JSON.
+type executableHook struct {
+	hookPath string
+	envFile  *os.File
+}
+
+func newExecutableHook(hookPath string) (*executableHook, error) {
+	var h = &executableHook{
+		hookPath: hookPath,
+	}
+
+	var err error
+
+	if runtime.GOOS != "windows" {
+		s, err := os.Stat(hookPath)
+		if err != nil {
+			return nil, err
+		}
+		if s.Mode()&0111 == 0 {
+			return nil, fmt.Errorf("\"%s\" isn't a shell script, so it needs to be executable", hookPath)
+		}
+	}
+
+	// The hook writes any changes to the environment into this file
+	h.envFile, err = newHookEnvFileJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// Path returns the path to the hook, which is run directly
+func (h *executableHook) Path() string {
+	return h.hookPath
+}
+
+// Env returns the extra environment the hook is run with
+func (h *executableHook) Env() *env.Environment {
+	return env.FromSlice([]string{hookEnvFileJSONEnv + "=" + h.envFile.Name()})
+}
+
+// The file the hook writes its changes to the environment to
+func (h *executableHook) envFiles() []string {
+	return []string{h.envFile.Name()}
+}
+
+// Close cleans up the environment file
+func (h *executableHook) Close() {
+	os.Remove(h.envFile.Name())
+}
+
+// Changes returns the changes in the environment and working dir the hook
+// wrote to the environment file
+func (h *executableHook) Changes() (hookScriptChanges, error) {
+	changes, err := readHookEnvFileJSON(h.envFile.Name())
+	if err != nil {
+		return hookScriptChanges{}, err
+	}
+
+	wd, _ := changes.Get(hookWorkingDirEnv)
+	changes.Remove(hookWorkingDirEnv)
+
+	// The hook can only set variables, so they're all treated as added
+	return hookScriptChanges{Diff: changes.Diff(nil), Dir: wd}, nil
+}
+
+// Whether a hook needs to be run directly rather than sourced, which is the
+// case for compiled binaries and scripts with a shebang for something other
+// than a shell
+func isExecutableHook(hookPath string) bool {
+	// PowerShell hooks are sourced by a PowerShell wrapper
+	if shell.IsPowershellScript(hookPath) {
+		return false
+	}
+
+	f, err := os.Open(hookPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	header := make([]byte, 4)
+	n, _ := f.Read(header)
+	header = header[:n]
+
+	// ELF, Mach-O and PE (Windows) binaries
+	for _, magic := range [][]byte{
+		{0x7f, 'E', 'L', 'F'},
+		{0xfe, 0xed, 0xfa, 0xce},
+		{0xfe, 0xed, 0xfa, 0xcf},
+		{0xce, 0xfa, 0xed, 0xfe},
+		{0xcf, 0xfa, 0xed, 0xfe},
+		{0xca, 0xfe, 0xba, 0xbe},
+		{'M', 'Z'},
+	} {
+		if bytes.HasPrefix(header, magic) {
+			return true
+		}
+	}
+
+	if !bytes.HasPrefix(header, []byte("#!")) {
+		return false
+	}
+
+	// Windows doesn't use shebangs, so it's up to the wrapper to run these
+	if runtime.GOOS == "windows" {
+		return false
+	}
+
+	if _, err = f.Seek(0, 0); err != nil {
+		return false
+	}
+
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	return !isShellShebang(line)
+}
+
+// Whether a shebang line (i.e. #!/usr/bin/env bash) is for a shell that can
+// source the hook
+func isShellShebang(line string) bool {
+	fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(line), "#!"))
+	if len(fields) == 0 {
+		return true
+	}
+
+	interpreter := filepath.Base(fields[0])
+	if interpreter == "env" && len(fields) > 1 {
+		interpreter = filepath.Base(fields[1])
+	}
+
+	switch interpreter {
+	case "sh", "bash", "zsh", "dash", "ksh":
+		return true
+	}
+
+	return false
+}
+
+// Returns the path to a hook in a directory. Hooks are written for the
+// platform's shell, or in PowerShell with a .ps1 extension, which is only
+// used if there isn't one for the platform's shell.
+func hookFilePath(dir string, name string) string {
+	path := filepath.Join(dir, normalizeScriptFileName(name))
+	if !fileExists(path) {
+		if powershellPath := filepath.Join(dir, name+".ps1"); fileExists(powershellPath) {
+			return powershellPath
+		}
+	}
+	return path
 }
@@ -1,16 +1,21 @@
 package bootstrap
 
 import (
+	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/buildkite/agent/bootstrap/shell"
 	"github.com/buildkite/agent/env"
+	"github.com/buildkite/agent/metrics"
 )
 
 func TestRunningHookDetectsChangedEnvironment(t *testing.T) {
@@ -30,7 +35,7 @@ func TestRunningHookDetectsChangedEnvironment(t *testing.T) {
 
 	sh := newTestShell(t)
 
-	if err := sh.RunScript(wrapper.Path(), nil); err != nil {
+	if err := sh.RunScript(context.Background(), wrapper.Path(), nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -39,8 +44,79 @@ func TestRunningHookDetectsChangedEnvironment(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if !reflect.DeepEqual(changes.Env, env.FromSlice([]string{"LLAMAS=rock", "Alpacas=are ok"})) {
-		t.Fatalf("Unexpected env in %#v", changes.Env)
+	if !reflect.DeepEqual(changes.Diff.Added, map[string]string{"LLAMAS": "rock", "Alpacas": "are ok"}) {
+		t.Fatalf("Unexpected env in %#v", changes.Diff)
+	}
+}
+
+func TestRunningHookDetectsJSONEnvironment(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("Not tested on windows yet")
+	}
+
+	t.Parallel()
+
+	wrapper := newTestHookWrapper(t, []string{
+		"#!/bin/bash",
+		"export LLAMAS=rock",
+		`echo '{"LLAMAS":"are the best","Alpacas":"are ok"}' > "$BUILDKITE_ENV_FILE_JSON"`,
+	})
+	defer wrapper.Close()
+
+	sh := newTestShell(t)
+
+	if err := sh.RunScript(context.Background(), wrapper.Path(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := wrapper.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(changes.Diff.Added, map[string]string{"LLAMAS": "are the best", "Alpacas": "are ok"}) {
+		t.Fatalf("Unexpected env in %#v", changes.Diff)
+	}
+}
+
+func TestRunningHookDetectsUnsetEnvironment(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("Not tested on windows yet")
+	}
+
+	t.Parallel()
+
+	wrapper := newTestHookWrapper(t, []string{
+		"#!/bin/bash",
+		"unset LLAMAS",
+		"export ALPACAS=\"are not llamas\"",
+	})
+	defer wrapper.Close()
+
+	sh := newTestShell(t)
+	sh.Env.Set("LLAMAS", "rock")
+	sh.Env.Set("ALPACAS", "are llamas")
+
+	if err := sh.RunScript(context.Background(), wrapper.Path(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := wrapper.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(changes.Diff.Removed, map[string]struct{}{"LLAMAS": {}}) {
+		t.Fatalf("Unexpected removed env in %#v", changes.Diff)
+	}
+
+	if !reflect.DeepEqual(changes.Diff.Changed, map[string]env.DiffPair{"ALPACAS": {Old: "are llamas", New: "are not llamas"}}) {
+		t.Fatalf("Unexpected changed env in %#v", changes.Diff)
+	}
+
+	environ := changes.Diff.Apply(sh.Env)
+	if environ.Exists("LLAMAS") {
+		t.Fatalf("Expected LLAMAS to be removed from %v", environ.ToSlice())
 	}
 }
 
@@ -70,7 +146,7 @@ func TestRunningHookDetectsChangedWorkingDirectory(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := sh.RunScript(wrapper.Path(), nil); err != nil {
+	if err := sh.RunScript(context.Background(), wrapper.Path(), nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -123,3 +199,272 @@ func newTestHookWrapper(t *testing.T, script []string) *hookScriptWrapper {
 
 	return wrapper
 }
+
+func TestDetectingExecutableHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("Not tested on windows yet")
+	}
+
+	t.Parallel()
+
+	var testCases = []struct {
+		contents   string
+		executable bool
+	}{
+		{"#!/bin/bash\necho llamas\n", false},
+		{"#!/usr/bin/env bash\necho llamas\n", false},
+		{"#!/bin/sh -e\necho llamas\n", false},
+		{"echo llamas\n", false},
+		{"", false},
+		{"#!/usr/bin/env python3\nprint('llamas')\n", true},
+		{"#!/usr/bin/perl\nprint 'llamas';\n", true},
+		{"\x7fELF\x02\x01\x01", true},
+		{"MZ\x90\x00", true},
+	}
+
+	for _, tc := range testCases {
+		hookFile, err := ioutil.TempFile("", "hook")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.WriteString(hookFile, tc.contents); err != nil {
+			t.Fatal(err)
+		}
+		hookFile.Close()
+
+		if actual := isExecutableHook(hookFile.Name()); actual != tc.executable {
+			t.Errorf("Expected isExecutableHook(%q) to be %v, got %v", tc.contents, tc.executable, actual)
+		}
+
+		os.Remove(hookFile.Name())
+	}
+}
+
+func TestRunningExecutableHookDetectsChangedEnvironment(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("Not tested on windows yet")
+	}
+
+	if _, err := os.Stat("/usr/bin/perl"); err != nil {
+		t.Skipf("Perl isn't installed")
+	}
+
+	t.Parallel()
+
+	hookFile, err := ioutil.TempFile("", "hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(hookFile.Name())
+
+	script := []string{
+		"#!/usr/bin/perl",
+		`open(my $fh, '>', $ENV{'BUILDKITE_ENV_FILE_JSON'}) or die;`,
+		`print $fh '{"LLAMAS":"rock","BUILDKITE_HOOK_WORKING_DIR":"/tmp"}';`,
+		`close($fh);`,
+	}
+	for _, line := range script {
+		if _, err = io.WriteString(hookFile, line+"\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hookFile.Close()
+
+	if err = os.Chmod(hookFile.Name(), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if !isExecutableHook(hookFile.Name()) {
+		t.Fatalf("Expected %s to be run directly", hookFile.Name())
+	}
+
+	hook, err := newExecutableHook(hookFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hook.Close()
+
+	sh := newTestShell(t)
+
+	if err := sh.RunExecutable(context.Background(), hook.Path(), hook.Env()); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := hook.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(changes.Diff.Added, map[string]string{"LLAMAS": "rock"}) {
+		t.Fatalf("Unexpected env in %#v", changes.Diff)
+	}
+
+	if changes.Dir != "/tmp" {
+		t.Fatalf("Expected working dir of %q, got %q", "/tmp", changes.Dir)
+	}
+}
+
+func TestFindingPowershellHooks(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "environment.ps1"), []byte("$env:LLAMAS = 'rock'\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, normalizeScriptFileName("command")), []byte("echo llamas\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "command.ps1"), []byte("Write-Host llamas\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hook for the platform's shell is preferred to a PowerShell one
+	for name, expected := range map[string]string{
+		"environment": filepath.Join(dir, "environment.ps1"),
+		"command":     filepath.Join(dir, normalizeScriptFileName("command")),
+		"pre-exit":    filepath.Join(dir, normalizeScriptFileName("pre-exit")),
+	} {
+		if actual := hookFilePath(dir, name); actual != expected {
+			t.Errorf("Expected the %s hook to be %q, got %q", name, expected, actual)
+		}
+	}
+}
+
+func TestRunningPowershellHookDetectsChangedEnvironment(t *testing.T) {
+	if _, err := exec.LookPath("pwsh"); err != nil {
+		t.Skipf("PowerShell Core isn't installed")
+	}
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hookPath := filepath.Join(dir, "environment.ps1")
+	hook := "$env:LLAMAS = 'rock'\n$env:Alpacas = \"are ok\"\nSet-Location '" + dir + "'\n"
+	if err = ioutil.WriteFile(hookPath, []byte(hook), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	wrapper, err := newHookScriptWrapper(hookPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wrapper.Close()
+
+	sh := newTestShell(t)
+
+	if err := sh.RunScript(context.Background(), wrapper.Path(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := wrapper.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(changes.Diff.Added, map[string]string{"LLAMAS": "rock", "Alpacas": "are ok"}) {
+		t.Fatalf("Unexpected env in %#v", changes.Diff)
+	}
+
+	if changes.Dir != dir {
+		t.Fatalf("Expected working dir to be %q, got %q", dir, changes.Dir)
+	}
+}
+
+func TestGlobalHooksIncludeMatchingOverlays(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "hooks-overlays")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, hooks := range []string{"global", "team-a", "acme"} {
+		if err := os.MkdirAll(filepath.Join(dir, hooks), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "acme", normalizeScriptFileName("command")), []byte("make test\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Bootstrap{shell: newTestShell(t), Config: Config{
+		HooksPath:    filepath.Join(dir, "global"),
+		PipelineSlug: "team-a-llamas",
+		Repository:   "git@github.com:acme/llamas.git",
+		HooksOverlays: []string{
+			"pipeline:team-a-*=" + filepath.Join(dir, "team-a"),
+			"pipeline:team-b-*=" + filepath.Join(dir, "team-b"),
+			"repository:git@github.com:acme/**=" + filepath.Join(dir, "acme"),
+		},
+	}}
+
+	paths := b.globalHookPaths("pre-command")
+	expected := []string{
+		filepath.Join(dir, "global", normalizeScriptFileName("pre-command")),
+		filepath.Join(dir, "team-a", normalizeScriptFileName("pre-command")),
+		filepath.Join(dir, "acme", normalizeScriptFileName("pre-command")),
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("Expected %v, got %v", expected, paths)
+	}
+
+	// The last overlay with a command hook replaces the global one
+	if path := b.globalHookPath("command"); path != filepath.Join(dir, "acme", normalizeScriptFileName("command")) {
+		t.Fatalf("Expected the acme command hook, got %q", path)
+	}
+	if path := b.globalHookPath("checkout"); path != filepath.Join(dir, "global", normalizeScriptFileName("checkout")) {
+		t.Fatalf("Expected the global checkout hook, got %q", path)
+	}
+}
+
+func TestExecutingHookReportsHowLongItTook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("Not tested on windows yet")
+	}
+
+	dir, err := ioutil.TempDir("", "hook-timing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hookPath := filepath.Join(dir, "pre-command")
+	if err := ioutil.WriteFile(hookPath, []byte("#!/bin/bash\nexport LLAMAS=rock\nexport ALPACAS=ok\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	reportPath := filepath.Join(dir, "metrics")
+
+	var output bytes.Buffer
+	sh := newTestShell(t)
+	sh.Logger = &shell.WriterLogger{Writer: &output}
+	sh.Env.Set(metrics.ReportFileEnv, reportPath)
+
+	b := &Bootstrap{shell: sh}
+	if err := b.executeHook(context.Background(), "global pre-command", hookPath, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(output.String(), "exited with status 0 and changed 2 environment variables") {
+		t.Fatalf("Expected how long the hook took in the output, got %q", output.String())
+	}
+
+	report, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(report), `"name":"buildkite_agent_hook_duration_seconds"`) || !strings.Contains(string(report), `"labels":["pre-command","global","0"]`) {
+		t.Fatalf("Expected the hook's duration to be reported, got %q", report)
+	}
+}
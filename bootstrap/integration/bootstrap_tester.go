@@ -3,6 +3,7 @@ package integration
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
@@ -32,6 +33,10 @@ type BootstrapTester struct {
 
 	hookMock *bintest.Mock
 	mocks    []*bintest.Mock
+
+	// The bootstrap process while it's running
+	cmd     *exec.Cmd
+	cmdLock sync.Mutex
 }
 
 func NewBootstrapTester() (*BootstrapTester, error) {
@@ -242,11 +247,32 @@ func (b *BootstrapTester) Run(t *testing.T, env ...string) error {
 	cmd.Stderr = io.MultiWriter(buf, w)
 	cmd.Env = append(b.Env, env...)
 
-	err := cmd.Run()
+	b.cmdLock.Lock()
+	err := cmd.Start()
+	b.cmd = cmd
+	b.cmdLock.Unlock()
+
+	if err == nil {
+		err = cmd.Wait()
+	}
+
 	b.Output = buf.String()
 	return err
 }
 
+// Signal sends a signal to the running bootstrap, like the agent does when
+// it cancels a job
+func (b *BootstrapTester) Signal(sig os.Signal) error {
+	b.cmdLock.Lock()
+	defer b.cmdLock.Unlock()
+
+	if b.cmd == nil || b.cmd.Process == nil {
+		return errors.New("The bootstrap isn't running")
+	}
+
+	return b.cmd.Process.Signal(sig)
+}
+
 func (b *BootstrapTester) CheckMocks(t *testing.T) {
 	for _, mock := range b.mocks {
 		if mock.Check(t) {
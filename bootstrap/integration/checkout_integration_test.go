@@ -226,3 +226,206 @@ func TestCheckoutOnAnExistingRepositoryWithoutAGitFolder(t *testing.T) {
 
 	tester.RunAndCheck(t)
 }
+
+func TestCheckingOutShallowSparseCheckout(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	// Give the repository a few directories and some history
+	for _, path := range []string{"services/api/main.go", "services/web/main.go", "docs/README.md"} {
+		if err = os.MkdirAll(filepath.Join(tester.Repo.Path, filepath.Dir(path)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(tester.Repo.Path, path), []byte("llamas"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = tester.Repo.Add(path); err != nil {
+			t.Fatal(err)
+		}
+		if err = tester.Repo.Commit("Add %s", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+
+	// Local clones ignore --depth, so clone over the file protocol
+	tester.RunAndCheck(t,
+		"BUILDKITE_REPO=file://"+tester.Repo.Path,
+		"BUILDKITE_GIT_CLONE_DEPTH=1",
+		"BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS=services/api,test.txt",
+	)
+
+	for path, exists := range map[string]bool{
+		"services/api/main.go": true,
+		"test.txt":             true,
+		"services/web/main.go": false,
+		"docs/README.md":       false,
+		".git/shallow":         true,
+	} {
+		if _, err := os.Stat(filepath.Join(tester.CheckoutDir(), path)); (err == nil) != exists {
+			t.Errorf("Expected %s to exist: %v", path, exists)
+		}
+	}
+}
+
+func TestCheckingOutWithAGitMirror(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	mirrorsDir, err := ioutil.TempDir("", "git-mirrors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mirrorsDir)
+
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+
+	tester.RunAndCheck(t, "BUILDKITE_GIT_MIRRORS_PATH="+mirrorsDir)
+
+	// The checkout should borrow objects from the mirror
+	alternates, err := ioutil.ReadFile(filepath.Join(tester.CheckoutDir(), ".git", "objects", "info", "alternates"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(alternates), mirrorsDir) {
+		t.Fatalf("Expected alternates to point at the mirror in %s, got %q", mirrorsDir, alternates)
+	}
+
+	if !strings.Contains(tester.Output, "Creating a mirror of the repository") {
+		t.Fatalf("Expected a mirror to be created")
+	}
+}
+
+func TestCheckingOutMercurialProject(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	hg := tester.MustMock(t, "hg")
+
+	hg.ExpectAll([][]interface{}{
+		{"root"},
+		{"clone", "--noupdate", "--", "https://hg.example.com/repo", "."},
+		{"--config", "extensions.purge=", "purge", "--all"},
+		{"pull", "--", "https://hg.example.com/repo"},
+		{"update", "--clean", "--rev", "master"},
+		{"--config", "extensions.purge=", "purge", "--all"},
+	})
+
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+
+	tester.RunAndCheck(t, "BUILDKITE_REPO=hg+https://hg.example.com/repo")
+}
+
+// Adds a submodule to the tester's repository that has it's own submodule,
+// both with urls that only resolve once they've been rewritten
+func createNestedSubmodules(t *testing.T, tester *BootstrapTester) (string, func()) {
+	dir, err := ioutil.TempDir("", "submodules")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"nested", "submodule"} {
+		repo, err := createTestGitRespository()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if name == "submodule" {
+			if out, err := repo.Execute("-c", "protocol.file.allow=always", "submodule", "add", filepath.Join(dir, "nested"), "nested"); err != nil {
+				t.Fatalf("Adding submodule failed with %s", out)
+			}
+			if out, err := repo.Execute("config", "-f", ".gitmodules", "submodule.nested.url", "https://submodules.invalid/nested"); err != nil {
+				t.Fatalf("Rewriting submodule failed with %s", out)
+			}
+			if err = repo.ExecuteAll([][]string{{"add", "."}, {"commit", "-m", "Add nested submodule"}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err = os.Rename(repo.Path, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if out, err := tester.Repo.Execute("-c", "protocol.file.allow=always", "submodule", "add", filepath.Join(dir, "submodule"), "submodule"); err != nil {
+		t.Fatalf("Adding submodule failed with %s", out)
+	}
+	if out, err := tester.Repo.Execute("config", "-f", ".gitmodules", "submodule.submodule.url", "https://submodules.invalid/submodule"); err != nil {
+		t.Fatalf("Rewriting submodule failed with %s", out)
+	}
+	if err := tester.Repo.ExecuteAll([][]string{{"add", "."}, {"commit", "-m", "Add submodule"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestCheckingOutSubmodulesWithURLRewrites(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		depth  string
+		nested bool
+	}{
+		{"", true},
+		{"1", false},
+	} {
+		tester, err := NewBootstrapTester()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tester.Close()
+
+		dir, cleanup := createNestedSubmodules(t, tester)
+		defer cleanup()
+
+		agent := tester.MustMock(t, "buildkite-agent")
+		agent.
+			Expect("meta-data", "exists", "buildkite:git:commit").
+			AndExitWith(0)
+
+		tester.RunAndCheck(t,
+			"BUILDKITE_GIT_SUBMODULE_URL_REWRITES=https://submodules.invalid/="+dir+"/",
+			"BUILDKITE_GIT_SUBMODULE_RECURSION_DEPTH="+tc.depth,
+			// Newer versions of git don't clone submodules from local paths by default
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=protocol.file.allow",
+			"GIT_CONFIG_VALUE_0=always",
+		)
+
+		if _, err := os.Stat(filepath.Join(tester.CheckoutDir(), "submodule", "test.txt")); err != nil {
+			t.Errorf("Expected the submodule to be checked out with depth %q", tc.depth)
+		}
+
+		_, err = os.Stat(filepath.Join(tester.CheckoutDir(), "submodule", "nested", "test.txt"))
+		if (err == nil) != tc.nested {
+			t.Errorf("Expected the nested submodule to be checked out with depth %q: %v", tc.depth, tc.nested)
+		}
+	}
+}
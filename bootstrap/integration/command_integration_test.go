@@ -1,6 +1,9 @@
 package integration
 
 import (
+	"runtime"
+	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/lox/bintest/proxy"
@@ -38,3 +41,75 @@ func TestPreExitHooksRunsAfterCommandFails(t *testing.T) {
 
 	tester.CheckMocks(t)
 }
+
+func TestCancellingTheJobRunsPreExitHooksAndSkipsArtifacts(t *testing.T) {
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("Not implemented for windows yet")
+	}
+
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+	agent.
+		Expect("artifact", "upload", "llamas.txt").
+		NotCalled()
+
+	// Cancel the job like the agent does as the command finishes. The
+	// hook exits first, otherwise the bootstrap passing the signal on to
+	// it kills the mock before it can respond.
+	tester.ExpectGlobalHook("command").Once().AndCallFunc(func(c *proxy.Call) {
+		c.Exit(1)
+		if err := tester.Signal(syscall.SIGTERM); err != nil {
+			t.Error(err)
+		}
+	})
+
+	tester.ExpectGlobalHook("pre-exit").Once()
+
+	if err := tester.Run(t, "BUILDKITE_ARTIFACT_PATHS=llamas.txt"); err == nil {
+		t.Fatal("Expected the bootstrap to fail")
+	}
+
+	tester.CheckMocks(t)
+}
+
+func TestLocalCommandHookRunsInTheJobSandbox(t *testing.T) {
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("The bubblewrap sandbox is only supported on linux")
+	}
+
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+
+	// The hook is the job's as much as its command is, so it's only ever
+	// run inside the sandbox
+	tester.ExpectLocalHook("command").NotCalled()
+
+	tester.MustMock(t, "bwrap").Expect().WithAnyArguments().Once().AndCallFunc(func(c *proxy.Call) {
+		args := strings.Join(c.Args, " ")
+		if !strings.Contains(args, "--bind "+tester.CheckoutDir()+" "+tester.CheckoutDir()) {
+			t.Errorf("Expected the checkout to be writable, got %s", args)
+		}
+		if !strings.Contains(args, "-- /bin/bash -c ") {
+			t.Errorf("Expected the hook to be run in the sandbox, got %s", args)
+		}
+		c.Exit(0)
+	})
+
+	tester.RunAndCheck(t, "BUILDKITE_JOB_SANDBOX=bubblewrap")
+}
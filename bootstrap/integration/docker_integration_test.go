@@ -1,6 +1,8 @@
 package integration
 
 import (
+	"runtime"
+	"syscall"
 	"testing"
 
 	"github.com/lox/bintest/proxy"
@@ -73,6 +75,117 @@ func TestRunningCommandWithDockerAndCustomDockerfile(t *testing.T) {
 	tester.RunAndCheck(t, env...)
 }
 
+func TestRunningCommandWithDockerAndPodmanRuntime(t *testing.T) {
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+
+	env := []string{
+		"BUILDKITE_DOCKER=llamas",
+		"BUILDKITE_CONTAINER_RUNTIME=podman",
+	}
+
+	jobId := "1111-1111-1111-1111"
+	imageId := "buildkite_" + jobId + "_image"
+	containerId := "buildkite_" + jobId + "_container"
+
+	podman := tester.MustMock(t, "podman")
+	podman.ExpectAll([][]interface{}{
+		{"build", "-f", "Dockerfile", "-t", imageId, "."},
+		{"run", "--name", containerId, imageId, "./buildkite-script-" + jobId},
+		{"rm", "-f", "-v", containerId},
+	})
+
+	expectCommandHooks("0", t, tester)
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestRunningCommandWithDockerAndBuildKitCache(t *testing.T) {
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+
+	env := []string{
+		"BUILDKITE_DOCKER=llamas",
+		"BUILDKITE_DOCKER_BUILDKIT=true",
+		"BUILDKITE_DOCKER_CACHE_REGISTRY=registry.example.com/cache/",
+	}
+
+	jobId := "1111-1111-1111-1111"
+	imageId := "buildkite_" + jobId + "_image"
+	containerId := "buildkite_" + jobId + "_container"
+	cacheRef := "registry.example.com/cache/test-project:buildcache"
+
+	docker := tester.MustMock(t, "docker")
+	docker.ExpectAll([][]interface{}{
+		{"buildx", "build", "--load", "-f", "Dockerfile", "-t", imageId,
+			"--cache-from", "type=registry,ref=" + cacheRef,
+			"--cache-to", "type=registry,ref=" + cacheRef + ",mode=max", "."},
+		{"run", "--name", containerId, imageId, "./buildkite-script-" + jobId},
+		{"rm", "-f", "-v", containerId},
+	})
+
+	expectCommandHooks("0", t, tester)
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestRunningCommandWithPodmanAndBuildKitCache(t *testing.T) {
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+
+	env := []string{
+		"BUILDKITE_DOCKER=llamas",
+		"BUILDKITE_DOCKER_BUILDKIT=true",
+		"BUILDKITE_DOCKER_CACHE_REGISTRY=registry.example.com/cache/",
+		"BUILDKITE_CONTAINER_RUNTIME=podman",
+	}
+
+	jobId := "1111-1111-1111-1111"
+	imageId := "buildkite_" + jobId + "_image"
+	containerId := "buildkite_" + jobId + "_container"
+	cacheRepo := "registry.example.com/cache/test-project/buildcache"
+
+	podman := tester.MustMock(t, "podman")
+	podman.ExpectAll([][]interface{}{
+		{"build", "-f", "Dockerfile", "-t", imageId,
+			"--cache-from", cacheRepo,
+			"--cache-to", cacheRepo, "."},
+		{"run", "--name", containerId, imageId, "./buildkite-script-" + jobId},
+		{"rm", "-f", "-v", containerId},
+	})
+
+	expectCommandHooks("0", t, tester)
+
+	tester.RunAndCheck(t, env...)
+}
+
 func TestRunningFailingCommandWithDocker(t *testing.T) {
 	tester, err := NewBootstrapTester()
 	if err != nil {
@@ -112,6 +225,57 @@ func TestRunningFailingCommandWithDocker(t *testing.T) {
 	tester.CheckMocks(t)
 }
 
+func TestCancellingCommandWithDockerStopsTheContainer(t *testing.T) {
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("Not implemented for windows yet")
+	}
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+
+	env := []string{
+		"BUILDKITE_DOCKER=llamas",
+	}
+
+	jobId := "1111-1111-1111-1111"
+	imageId := "buildkite_" + jobId + "_image"
+	containerId := "buildkite_" + jobId + "_container"
+
+	docker := tester.MustMock(t, "docker")
+	docker.ExpectAll([][]interface{}{
+		{"build", "-f", "Dockerfile", "-t", imageId, "."},
+		{"stop", "--time", "5", containerId},
+		{"rm", "-f", "-v", containerId},
+	})
+
+	// Cancel the job like the agent does while the container is running
+	docker.Expect("run", "--name", containerId, imageId, "./buildkite-script-"+jobId).
+		Once().
+		AndCallFunc(func(c *proxy.Call) {
+			c.Exit(1)
+			if err := tester.Signal(syscall.SIGTERM); err != nil {
+				t.Error(err)
+			}
+		})
+
+	tester.ExpectGlobalHook("pre-exit").Once()
+
+	if err = tester.Run(t, env...); err == nil {
+		t.Fatal("Expected bootstrap to fail")
+	}
+
+	tester.CheckMocks(t)
+}
+
 func TestRunningCommandWithDockerCompose(t *testing.T) {
 	tester, err := NewBootstrapTester()
 	if err != nil {
@@ -247,6 +411,76 @@ func TestRunningCommandWithDockerComposeAndBuildAll(t *testing.T) {
 	tester.RunAndCheck(t, env...)
 }
 
+func TestRunningCommandWithDockerComposeV2(t *testing.T) {
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+
+	env := []string{
+		"BUILDKITE_DOCKER_COMPOSE_CONTAINER=llamas",
+		"BUILDKITE_DOCKER_COMPOSE_V2=true",
+	}
+
+	jobId := "1111-1111-1111-1111"
+	projectName := "buildkite1111111111111111"
+
+	docker := tester.MustMock(t, "docker")
+	docker.ExpectAll([][]interface{}{
+		{"compose", "-f", "docker-compose.yml", "-p", projectName, "build", "--pull", "llamas"},
+		{"compose", "-f", "docker-compose.yml", "-p", projectName, "run", "llamas", "./buildkite-script-" + jobId},
+		{"compose", "-f", "docker-compose.yml", "-p", projectName, "kill"},
+		{"compose", "-f", "docker-compose.yml", "-p", projectName, "rm", "--force", "-v"},
+		{"compose", "-f", "docker-compose.yml", "-p", projectName, "down"},
+	})
+
+	expectCommandHooks("0", t, tester)
+
+	tester.RunAndCheck(t, env...)
+}
+
+func TestRunningCommandWithDockerComposeAndNerdctlRuntime(t *testing.T) {
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		AndExitWith(0)
+
+	env := []string{
+		"BUILDKITE_DOCKER_COMPOSE_CONTAINER=llamas",
+		"BUILDKITE_CONTAINER_RUNTIME=nerdctl",
+	}
+
+	jobId := "1111-1111-1111-1111"
+	projectName := "buildkite1111111111111111"
+
+	nerdctl := tester.MustMock(t, "nerdctl")
+	nerdctl.ExpectAll([][]interface{}{
+		{"compose", "-f", "docker-compose.yml", "-p", projectName, "build", "--pull", "llamas"},
+		{"compose", "-f", "docker-compose.yml", "-p", projectName, "run", "llamas", "./buildkite-script-" + jobId},
+		{"compose", "-f", "docker-compose.yml", "-p", projectName, "kill"},
+		{"compose", "-f", "docker-compose.yml", "-p", projectName, "rm", "--force", "-v"},
+		{"compose", "-f", "docker-compose.yml", "-p", projectName, "down"},
+	})
+
+	expectCommandHooks("0", t, tester)
+
+	tester.RunAndCheck(t, env...)
+}
+
 func expectCommandHooks(exitStatus string, t *testing.T, tester *BootstrapTester) {
 	tester.ExpectGlobalHook("pre-command").Once()
 	tester.ExpectLocalHook("pre-command").Once()
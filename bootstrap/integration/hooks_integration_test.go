@@ -7,6 +7,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/lox/bintest"
 	"github.com/lox/bintest/proxy"
@@ -292,3 +293,77 @@ func TestPreExitHooksFireAfterHookFailures(t *testing.T) {
 		})
 	}
 }
+
+func TestHooksAreKilledAfterTheirTimeout(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("Not implemented for windows yet")
+	}
+
+	var script = []string{
+		"#!/bin/bash",
+		"while true; do :; done",
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tester.HooksDir, "pre-command"), []byte(strings.Join(script, "\n")), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	tester.ExpectGlobalHook("command").NotCalled()
+
+	start := time.Now()
+
+	if err = tester.Run(t, "BUILDKITE_HOOK_TIMEOUT=60", "BUILDKITE_HOOK_TIMEOUT_PRE_COMMAND=1"); err == nil {
+		t.Fatal("Expected the bootstrap to fail")
+	}
+
+	if elapsed := time.Since(start); elapsed > 20*time.Second {
+		t.Fatalf("Expected the pre-command hook to be killed after a second, took %v", elapsed)
+	}
+
+	if !strings.Contains(tester.Output, "The global pre-command hook timed out after 1s") {
+		t.Fatalf("Expected a timeout error in the output, got %s", tester.Output)
+	}
+
+	tester.CheckMocks(t)
+}
+
+func TestEnvironmentVariablesFromJSONPassBetweenHooks(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("Not implemented for windows yet")
+	}
+
+	var script = []string{
+		"#!/bin/bash",
+		`echo '{"LLAMAS_ROCK":"absolutely"}' > "$BUILDKITE_ENV_FILE_JSON"`,
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tester.HooksDir, "environment"), []byte(strings.Join(script, "\n")), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	tester.ExpectGlobalHook("command").Once().AndExitWith(0).AndCallFunc(func(c *proxy.Call) {
+		if err := bintest.ExpectEnv(t, c.Env, `LLAMAS_ROCK=absolutely`); err != nil {
+			fmt.Fprintf(c.Stderr, "%v\n", err)
+			c.Exit(1)
+		}
+		c.Exit(0)
+	})
+
+	tester.RunAndCheck(t)
+}
@@ -1,10 +1,17 @@
 package integration
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 
@@ -60,6 +67,267 @@ func TestRunningPlugins(t *testing.T) {
 	tester.RunAndCheck(t, env...)
 }
 
+func TestRunningPluginsWithStrictVerificationRequiresPinning(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	pluginMock := tester.MustMock(t, "my-plugin")
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": []string{
+			"#!/bin/bash",
+			pluginMock.Path + " testing",
+		},
+	})
+
+	env := []string{
+		`BUILDKITE_STRICT_PLUGIN_VERIFICATION=true`,
+		fmt.Sprintf(`BUILDKITE_PLUGINS=[{"%s":{}}]`, p.Path),
+	}
+
+	pluginMock.Expect("testing").NotCalled()
+
+	if err = tester.Run(t, env...); err == nil {
+		t.Fatal("Expected the bootstrap to fail")
+	} else {
+		t.Logf("Failed as expected with %v", err)
+	}
+
+	tester.CheckMocks(t)
+}
+
+func TestRunningPluginsWithSha256(t *testing.T) {
+	t.Parallel()
+
+	hook := []string{
+		"#!/bin/bash",
+		"export LLAMAS_ROCK=absolutely",
+	}
+
+	var testCases = []struct {
+		name      string
+		sha256    func(*testPlugin) string
+		expectRun bool
+	}{
+		{"matching", func(p *testPlugin) string { return p.Sha256(t) }, true},
+		{"mismatched", func(p *testPlugin) string { return strings.Repeat("0", 64) }, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tester, err := NewBootstrapTester()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tester.Close()
+
+			p := createTestPlugin(t, map[string][]string{"environment": hook})
+
+			env := []string{
+				`BUILDKITE_STRICT_PLUGIN_VERIFICATION=true`,
+				fmt.Sprintf(`BUILDKITE_PLUGINS=[{"%s":{},"sha256":"%s"}]`, p.Path, tc.sha256(p)),
+			}
+
+			if tc.expectRun {
+				tester.ExpectGlobalHook("command").Once().AndExitWith(0)
+				tester.RunAndCheck(t, env...)
+				return
+			}
+
+			tester.ExpectGlobalHook("command").NotCalled()
+
+			if err = tester.Run(t, env...); err == nil {
+				t.Fatal("Expected the bootstrap to fail")
+			} else {
+				t.Logf("Failed as expected with %v", err)
+			}
+
+			tester.CheckMocks(t)
+		})
+	}
+}
+
+func TestRunningPluginsThatArentAllowed(t *testing.T) {
+	t.Parallel()
+
+	var testCases = []struct {
+		name string
+		env  string
+	}{
+		{"denied", `BUILDKITE_DENIED_PLUGINS=/**`},
+		{"not allowed", `BUILDKITE_ALLOWED_PLUGINS=https://github.com/my-org/*`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tester, err := NewBootstrapTester()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tester.Close()
+
+			p := createTestPlugin(t, map[string][]string{
+				"environment": []string{"#!/bin/bash"},
+			})
+
+			json, err := p.ToJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tester.ExpectGlobalHook("command").NotCalled()
+
+			if err = tester.Run(t, tc.env, `BUILDKITE_PLUGINS=`+json); err == nil {
+				t.Fatal("Expected the bootstrap to fail")
+			} else {
+				t.Logf("Failed as expected with %v", err)
+			}
+
+			tester.CheckMocks(t)
+
+			if !strings.Contains(tester.Output, "isn't allowed to run on this agent") {
+				t.Fatalf("Expected the output to explain why the plugin wasn't run")
+			}
+		})
+	}
+}
+
+func TestRunningPluginsFromABranchChecksOutNewCommits(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	pluginMock := tester.MustMock(t, "my-plugin")
+
+	p := createTestPlugin(t, map[string][]string{
+		"environment": []string{
+			"#!/bin/bash",
+			pluginMock.Path + " first",
+		},
+	})
+
+	if _, err = p.Execute("branch", "llamas"); err != nil {
+		t.Fatal(err)
+	}
+
+	env := []string{
+		fmt.Sprintf(`BUILDKITE_PLUGINS=[{"%s#llamas":{}}]`, p.Path),
+	}
+
+	// Both runs check whether the git metadata has already been sent
+	agent := tester.MustMock(t, "buildkite-agent")
+	agent.
+		Expect("meta-data", "exists", "buildkite:git:commit").
+		Exactly(2).
+		AndExitWith(0)
+
+	pluginMock.Expect("first").Once()
+	pluginMock.Expect("second").Once()
+	tester.ExpectGlobalHook("command").Exactly(2).AndExitWith(0)
+
+	if err = tester.Run(t, env...); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the branch along to a new version of the plugin
+	hook := []byte("#!/bin/bash\n" + pluginMock.Path + " second")
+	if err = ioutil.WriteFile(filepath.Join(p.Path, "hooks", "environment"), hook, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.ExecuteAll([][]string{
+		{"commit", "-am", "Second version of the plugin"},
+		{"branch", "-f", "llamas", "HEAD"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tester.RunAndCheck(t, env...)
+
+	checkouts, err := filepath.Glob(filepath.Join(tester.PluginsDir, "*-llamas-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(checkouts) != 2 {
+		t.Fatalf("Expected a checkout for each commit of the plugin, got %v", checkouts)
+	}
+}
+
+func TestRunningOCIPlugins(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	pluginMock := tester.MustMock(t, "my-plugin")
+
+	// Package the plugin up as a single layer image
+	var layer bytes.Buffer
+	gz := gzip.NewWriter(&layer)
+	tw := tar.NewWriter(gz)
+	hook := []byte("#!/bin/bash\n" + pluginMock.Path + " testing\n")
+	if err = tw.WriteHeader(&tar.Header{Name: "hooks/environment", Mode: 0755, Size: int64(len(hook))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tw.Write(hook); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	gz.Close()
+
+	layerDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(layer.Bytes()))
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"%s","size":%d}]}`, layerDigest, layer.Len())
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/my-org/my-plugin/manifests/1.0.0":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			fmt.Fprint(w, manifest)
+		case "/v2/my-org/my-plugin/blobs/" + layerDigest:
+			w.Write(layer.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer registry.Close()
+
+	env := []string{
+		fmt.Sprintf(`BUILDKITE_PLUGINS=[{"oci://%s/my-org/my-plugin:1.0.0":{}}]`, strings.TrimPrefix(registry.URL, "http://")),
+	}
+
+	pluginMock.Expect("testing").Once().AndExitWith(0)
+	tester.ExpectGlobalHook("command").Once().AndExitWith(0)
+
+	tester.RunAndCheck(t, env...)
+
+	checkouts, err := filepath.Glob(filepath.Join(tester.PluginsDir, "oci-*-my-org-my-plugin-1-0-0-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(checkouts) != 1 {
+		t.Fatalf("Expected the plugin to be pulled into the plugins directory, got %v", checkouts)
+	}
+}
+
 type testPlugin struct {
 	*gitRepository
 }
@@ -99,3 +367,39 @@ func (tp *testPlugin) ToJSON() (string, error) {
 	}
 	return fmt.Sprintf(`[{"%s#%s":{"setting":"blah"}}]`, tp.Path, strings.TrimSpace(commitHash)), nil
 }
+
+// The checksum of the plugin's files, as calculated by
+// find . -type f -not -path './.git/*' | LC_ALL=C sort | xargs sha256sum | sha256sum
+func (tp *testPlugin) Sha256(t *testing.T) string {
+	var files []string
+
+	err := filepath.Walk(tp.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(tp.Path, path)
+			files = append(files, "./"+filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(files)
+
+	var summary bytes.Buffer
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(tp.Path, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&summary, "%x  %s\n", sha256.Sum256(data), file)
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(summary.Bytes()))
+}
@@ -2,6 +2,7 @@ package bootstrap
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -10,12 +11,85 @@ import (
 	"github.com/buildkite/agent/bootstrap/shell"
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
 )
 
+// How hosts that aren't in known_hosts are trusted
+const (
+	// Their keys are scanned and added, so they're trusted on first use
+	hostKeyAcceptNew = "accept-new"
+
+	// Only hosts with pinned fingerprints are added, and the checkout of
+	// any other fails
+	hostKeyStrict = "strict"
+)
+
 type knownHosts struct {
 	Shell *shell.Shell
 	Path  string
+
+	// The fingerprints of the keys trusted for each host, i.e.
+	// SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8. Keys of the host
+	// that don't match one aren't added, or used if they're already known.
+	Pinned map[string][]string
+
+	// Whether hosts are only added if they have pinned fingerprints
+	Strict bool
+}
+
+// hostKeyError is why a host's keys can't be trusted, which fails the job
+// rather than leaving ssh to prompt for them or accepting them blindly
+type hostKeyError struct {
+	Host   string
+	Reason string
+}
+
+func (e *hostKeyError) Error() string {
+	return fmt.Sprintf("The SSH host key of %s can't be trusted, %s", e.Host, e.Reason)
+}
+
+// parseSSHKnownHosts reads the hosts that are added to known_hosts before
+// the job runs, which are either a host or host=fingerprint to pin one of
+// it's keys. A host can be pinned to more than one key.
+func parseSSHKnownHosts(entries []string) ([]string, map[string][]string, error) {
+	var hosts []string
+	pinned := map[string][]string{}
+
+	for _, entry := range entries {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		host := strings.TrimSpace(parts[0])
+		if host == "" {
+			return nil, nil, fmt.Errorf("Invalid SSH known host %q, expected host or host=SHA256:fingerprint", entry)
+		}
+
+		if _, ok := pinned[host]; !ok && !containsString(hosts, host) {
+			hosts = append(hosts, host)
+		}
+
+		if len(parts) == 2 {
+			fingerprint := strings.TrimSpace(parts[1])
+			if !strings.HasPrefix(fingerprint, "SHA256:") {
+				return nil, nil, fmt.Errorf("Invalid SSH known host %q, fingerprints are SHA256:... like ssh-keygen -l prints", entry)
+			}
+			pinned[host] = append(pinned[host], fingerprint)
+		}
+	}
+
+	return hosts, pinned, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
 func findKnownHosts(sh *shell.Shell) (*knownHosts, error) {
@@ -48,9 +122,15 @@ func findKnownHosts(sh *shell.Shell) (*knownHosts, error) {
 }
 
 func (kh *knownHosts) Contains(host string) (bool, error) {
+	keys, err := kh.keys(host)
+	return len(keys) > 0, err
+}
+
+// Returns the keys of the host in known_hosts, in the form "type base64"
+func (kh *knownHosts) keys(host string) ([]string, error) {
 	file, err := os.Open(kh.Path)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	defer file.Close()
 
@@ -72,6 +152,7 @@ func (kh *knownHosts) Contains(host string) (bool, error) {
 	// @revoked * ssh-rsa AAAAB5W...
 	// # A CA key, accepted for any host in *.mydomain.com or *.mydomain.org
 	// @cert-authority *.mydomain.org,*.mydomain.com ssh-rsa AAAAB5W...
+	var keys []string
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		fields := strings.Split(scanner.Text(), " ")
@@ -80,15 +161,80 @@ func (kh *knownHosts) Contains(host string) (bool, error) {
 		}
 		for _, addr := range strings.Split(fields[0], ",") {
 			if addr == normalized || addr == knownhosts.HashHostname(normalized) {
-				return true, nil
+				keys = append(keys, fields[1]+" "+fields[2])
+				break
 			}
 		}
 	}
 
-	return false, nil
+	return keys, scanner.Err()
+}
+
+// Returns the SHA256 fingerprint of a key in the form "type base64", which
+// is how ssh-keygen -l prints them
+func sshFingerprint(key string) (string, error) {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return "", err
+	}
+	return ssh.FingerprintSHA256(parsed), nil
 }
 
-func (kh *knownHosts) Add(host string) error {
+// Returns an error unless all of the keys match one of the host's pinned
+// fingerprints
+func (kh *knownHosts) verifyKnownKeys(host string, keys []string) error {
+	pins := kh.Pinned[host]
+	if len(pins) == 0 {
+		return nil
+	}
+
+	for _, key := range keys {
+		fingerprint, err := sshFingerprint(key)
+		if err != nil {
+			return &hostKeyError{Host: host, Reason: fmt.Sprintf("%s has a key for it that can't be read (%v)", kh.Path, err)}
+		}
+		if !containsString(pins, fingerprint) {
+			return &hostKeyError{Host: host, Reason: fmt.Sprintf("%s has a key for it with the fingerprint %s, which isn't one of the agent's pinned fingerprints (%s)", kh.Path, fingerprint, strings.Join(pins, ", "))}
+		}
+	}
+
+	return nil
+}
+
+// Returns the lines of the keyscan output with keys that match the host's
+// pinned fingerprints, or all of them if it doesn't have any
+func (kh *knownHosts) trustedKeys(host string, keyscanOutput string) (string, error) {
+	pins := kh.Pinned[host]
+	if len(pins) == 0 {
+		return keyscanOutput, nil
+	}
+
+	var trusted, scanned []string
+	for _, line := range strings.Split(keyscanOutput, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		fingerprint, err := sshFingerprint(fields[1] + " " + fields[2])
+		if err != nil {
+			continue
+		}
+		scanned = append(scanned, fingerprint)
+
+		if containsString(pins, fingerprint) {
+			trusted = append(trusted, line)
+		}
+	}
+
+	if len(trusted) == 0 {
+		return "", &hostKeyError{Host: host, Reason: fmt.Sprintf("none of it's keys (%s) match the agent's pinned fingerprints (%s)", strings.Join(scanned, ", "), strings.Join(pins, ", "))}
+	}
+
+	return strings.Join(trusted, "\n"), nil
+}
+
+func (kh *knownHosts) Add(ctx context.Context, host string) error {
 	// Use a lockfile to prevent parallel processes stepping on each other
 	lock, err := shell.LockFile(kh.Shell, kh.Path+".lock")
 	if err != nil {
@@ -100,18 +246,32 @@ func (kh *knownHosts) Add(host string) error {
 		}
 	}()
 
-	// If the keygen output already contains the host, we can skip!
-	if contains, _ := kh.Contains(host); contains {
+	// If the keygen output already contains the host, we can skip! As long
+	// as the keys it has are the ones that are pinned.
+	if keys, _ := kh.keys(host); len(keys) > 0 {
+		if err := kh.verifyKnownKeys(host, keys); err != nil {
+			return err
+		}
 		kh.Shell.Commentf("Host \"%s\" already in list of known hosts at \"%s\"", host, kh.Path)
 		return nil
 	}
 
-	// Scan the key and then write it to the known_host file
-	keyscanOutput, err := sshKeyScan(kh.Shell, host)
+	if kh.Strict && len(kh.Pinned[host]) == 0 {
+		return &hostKeyError{Host: host, Reason: fmt.Sprintf("it isn't in %s and doesn't have a pinned fingerprint, which the agent requires", kh.Path)}
+	}
+
+	// Scan the key and then write it to the known_host file, with only the
+	// keys that match if it's pinned
+	keyscanOutput, err := sshKeyScan(ctx, kh.Shell, host)
 	if err != nil {
 		return errors.Wrap(err, "Could not perform `ssh-keyscan`")
 	}
 
+	keyscanOutput, err = kh.trustedKeys(host, keyscanOutput)
+	if err != nil {
+		return err
+	}
+
 	// Try and open the existing hostfile in (append_only) mode
 	f, err := os.OpenFile(kh.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0700)
 	if err != nil {
@@ -127,7 +287,7 @@ func (kh *knownHosts) Add(host string) error {
 }
 
 // AddFromRepository takes a git repo url, extracts the host and adds it
-func (kh *knownHosts) AddFromRepository(repository string) error {
+func (kh *knownHosts) AddFromRepository(ctx context.Context, repository string) error {
 	u, err := ParseGittableURL(repository)
 	if err != nil {
 		kh.Shell.Warningf("Could not parse \"%s\" as a URL - skipping adding host to SSH known_hosts", repository)
@@ -136,7 +296,10 @@ func (kh *knownHosts) AddFromRepository(repository string) error {
 
 	host := stripAliasesFromGitHost(u.Host)
 
-	if err = kh.Add(host); err != nil {
+	if err = kh.Add(ctx, host); err != nil {
+		if _, ok := err.(*hostKeyError); ok {
+			return err
+		}
 		return errors.Wrapf(err, "Failed to add `%s` to known_hosts file `%s`", host, u)
 	}
 
@@ -1,11 +1,19 @@
 package bootstrap
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/buildkite/agent/bootstrap/shell"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestAddingToKnownHosts(t *testing.T) {
@@ -53,7 +61,7 @@ func TestAddingToKnownHosts(t *testing.T) {
 
 			t.Logf("Adding %s", tc.Repository)
 
-			if err := kh.AddFromRepository(tc.Repository); err != nil {
+			if err := kh.AddFromRepository(context.Background(), tc.Repository); err != nil {
 				t.Fatal(err)
 			}
 
@@ -67,3 +75,125 @@ func TestAddingToKnownHosts(t *testing.T) {
 		})
 	}
 }
+
+func TestParseSSHKnownHosts(t *testing.T) {
+	t.Parallel()
+
+	hosts, pinned, err := parseSSHKnownHosts([]string{"github.com=SHA256:aaa", "gitlab.com", "github.com=SHA256:bbb", "ssh.github.com:443=SHA256:ccc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"github.com", "gitlab.com", "ssh.github.com:443"}; !reflect.DeepEqual(hosts, expected) {
+		t.Fatalf("Expected hosts %v, got %v", expected, hosts)
+	}
+
+	expected := map[string][]string{"github.com": {"SHA256:aaa", "SHA256:bbb"}, "ssh.github.com:443": {"SHA256:ccc"}}
+	if !reflect.DeepEqual(pinned, expected) {
+		t.Fatalf("Expected pinned %v, got %v", expected, pinned)
+	}
+
+	for _, invalid := range []string{"=SHA256:aaa", "github.com=MD5:aa:bb"} {
+		if _, _, err := parseSSHKnownHosts([]string{invalid}); err == nil {
+			t.Fatalf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+// Returns a host key in the form "type base64", and it's fingerprint
+func newTestHostKey(t *testing.T) (string, string) {
+	private, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public, err := ssh.NewPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(public))), ssh.FingerprintSHA256(public)
+}
+
+func TestAddingPinnedHostsToKnownHosts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("Not tested on windows yet")
+	}
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pinnedKey, pinnedFingerprint := newTestHostKey(t)
+	otherKey, otherFingerprint := newTestHostKey(t)
+
+	// Scans both keys for any host
+	keyscan := "#!/bin/bash\necho \"${@: -1} " + pinnedKey + "\"\necho \"${@: -1} " + otherKey + "\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "ssh-keyscan"), []byte(keyscan), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := newTestShell(t)
+	sh.Env.Set("PATH", dir+":/usr/bin:/bin")
+
+	path := filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(path, []byte("known.example.com "+otherKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	kh := &knownHosts{
+		Shell: sh,
+		Path:  path,
+		Pinned: map[string][]string{
+			"pinned.example.com":   {pinnedFingerprint},
+			"known.example.com":    {pinnedFingerprint},
+			"mismatch.example.com": {"SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8"},
+		},
+		Strict: true,
+	}
+
+	// Only the pinned key is added
+	if err := kh.Add(context.Background(), "pinned.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := kh.keys("pinned.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{pinnedKey}) {
+		t.Fatalf("Expected only the pinned key to be added, got %v", keys)
+	}
+
+	// The host's already known, but with another key
+	err = kh.Add(context.Background(), "known.example.com")
+	if _, ok := err.(*hostKeyError); !ok || !strings.Contains(err.Error(), otherFingerprint) {
+		t.Fatalf("Expected a host key error with the known key's fingerprint, got %v", err)
+	}
+
+	// None of the scanned keys are pinned
+	err = kh.Add(context.Background(), "mismatch.example.com")
+	if _, ok := err.(*hostKeyError); !ok {
+		t.Fatalf("Expected a host key error, got %v", err)
+	}
+	if contains, _ := kh.Contains("mismatch.example.com"); contains {
+		t.Fatal("Expected the host not to be added")
+	}
+
+	// Hosts without pinned fingerprints aren't trusted when it's strict
+	err = kh.Add(context.Background(), "unpinned.example.com")
+	if _, ok := err.(*hostKeyError); !ok {
+		t.Fatalf("Expected a host key error, got %v", err)
+	}
+
+	kh.Strict = false
+	if err := kh.Add(context.Background(), "unpinned.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := kh.keys("unpinned.example.com"); len(keys) != 2 {
+		t.Fatalf("Expected both keys to be added, got %v", keys)
+	}
+}
@@ -0,0 +1,98 @@
+package bootstrap
+
+import (
+	"context"
+	"path/filepath"
+)
+
+// The commit in the same layout as `git show --format=fuller`, which is how
+// Buildkite expects to be sent commit information
+const mercurialCommitTemplate = "commit {node}\n" +
+	"Author:     {author}\n" +
+	"AuthorDate: {date|rfc822date}\n" +
+	"Commit:     {author}\n" +
+	"CommitDate: {date|rfc822date}\n" +
+	"\n" +
+	"{indent(desc, '    ')}\n"
+
+// mercurialSCM checks out Mercurial repositories. Mercurial doesn't have
+// remotes that need updating like git, so everything is pulled directly from
+// the repository.
+type mercurialSCM struct {
+	b          *Bootstrap
+	repository string
+}
+
+func (s *mercurialSCM) Repository() string {
+	return s.repository
+}
+
+func (s *mercurialSCM) IsCheckout(ctx context.Context) bool {
+	_, err := s.b.shell.RunAndCapture(ctx, "hg", "root")
+	return err == nil
+}
+
+func (s *mercurialSCM) Clone(ctx context.Context) error {
+	if fileExists(filepath.Join(s.b.shell.Getwd(), ".hg")) {
+		return nil
+	}
+
+	// The working directory is updated once the commit has been pulled
+	return s.b.shell.Run(ctx, "hg", "clone", "--noupdate", "--", s.repository, ".")
+}
+
+func (s *mercurialSCM) Fetch(ctx context.Context) error {
+	sh := s.b.shell
+
+	if s.b.RefSpec != "" {
+		sh.Warningf("Ignoring the refspec \"%s\", they aren't supported by Mercurial", s.b.RefSpec)
+	}
+
+	if s.b.Commit == "HEAD" {
+		sh.Commentf("Pull and checkout branch %s", s.b.Branch)
+		return sh.Run(ctx, "hg", "pull", "--", s.repository)
+	}
+
+	// Fall back to pulling everything if the commit can't be pulled on
+	// it's own, i.e. it's a tag rather than a changeset id
+	sh.Commentf("Pull and checkout commit")
+	if err := sh.Run(ctx, "hg", "pull", "--rev", s.b.Commit, "--", s.repository); err != nil {
+		return sh.Run(ctx, "hg", "pull", "--", s.repository)
+	}
+
+	return nil
+}
+
+func (s *mercurialSCM) Checkout(ctx context.Context) error {
+	rev := s.b.Commit
+	if rev == "HEAD" {
+		rev = s.b.Branch
+	}
+
+	// Mercurial's equivalent of master
+	if rev == "" {
+		rev = "default"
+	}
+
+	return s.b.shell.Run(ctx, "hg", "update", "--clean", "--rev", rev)
+}
+
+func (s *mercurialSCM) Clean(ctx context.Context) error {
+	// Purge is an extension that ships with Mercurial, but isn't enabled by
+	// default
+	return s.b.shell.Run(ctx, "hg", "--config", "extensions.purge=", "purge", "--all")
+}
+
+func (s *mercurialSCM) Metadata(ctx context.Context) (*scmMetadata, error) {
+	commitOutput, err := s.b.shell.RunAndCapture(ctx, "hg", "log", "--rev", ".", "--template", mercurialCommitTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	branchOutput, err := s.b.shell.RunAndCapture(ctx, "hg", "branch")
+	if err != nil {
+		return nil, err
+	}
+
+	return &scmMetadata{Commit: commitOutput, Branch: branchOutput}, nil
+}
@@ -0,0 +1,98 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How long a mirror can go without being updated before it's checked for
+// corruption, which is a proxy for it being left broken by a job that was
+// killed part way through updating it
+func (b *Bootstrap) gitMirrorsStaleAfter() time.Duration {
+	return time.Second * time.Duration(b.GitMirrorsStaleAfter)
+}
+
+// Whether a mirror hasn't been updated within GitMirrorsStaleAfter
+func (b *Bootstrap) isGitMirrorStale(mirrorDir string) bool {
+	if b.GitMirrorsStaleAfter <= 0 {
+		return false
+	}
+
+	info, err := os.Stat(mirrorDir)
+	if err != nil {
+		return false
+	}
+
+	return time.Since(info.ModTime()) > b.gitMirrorsStaleAfter()
+}
+
+// Records that a mirror has been updated, the same way plugin checkouts
+// record being used
+func touchGitMirror(mirrorDir string) {
+	now := time.Now()
+	_ = os.Chtimes(mirrorDir, now, now)
+}
+
+// Whether all the objects in a mirror can be reached, which is quick enough
+// to run before using an old mirror as it doesn't check their contents
+func (b *Bootstrap) isGitMirrorHealthy(ctx context.Context, mirrorDir string) bool {
+	_, err := b.shell.RunAndCapture(ctx, "git", "--git-dir", mirrorDir, "fsck", "--connectivity-only")
+	return err == nil
+}
+
+// Checks a mirror, cloning it again if it's corrupt. Healthy mirrors are
+// touched so they aren't checked again until they're stale again.
+func (b *Bootstrap) repairGitMirror(ctx context.Context, mirrorDir string) error {
+	if b.isGitMirrorHealthy(ctx, mirrorDir) {
+		touchGitMirror(mirrorDir)
+		return nil
+	}
+
+	b.shell.Warningf("The mirror in \"%s\" is corrupt, cloning it again", mirrorDir)
+	return b.recloneGitMirror(ctx, mirrorDir)
+}
+
+// Creates the mirror of the repository
+func (b *Bootstrap) cloneGitMirror(ctx context.Context, mirrorDir string) error {
+	// Clone into a temporary directory so an interrupted clone doesn't
+	// leave a broken mirror behind
+	tempDir, err := ioutil.TempDir(b.GitMirrorsPath, filepath.Base(mirrorDir)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err = b.shell.Run(ctx, "git", "clone", "--mirror", "-v", "--", b.Repository, tempDir); err != nil {
+		return err
+	}
+
+	return os.Rename(tempDir, mirrorDir)
+}
+
+// Replaces a broken mirror with a new clone of the repository
+func (b *Bootstrap) recloneGitMirror(ctx context.Context, mirrorDir string) error {
+	b.shell.Commentf("Removing \"%s\"", mirrorDir)
+	if err := os.RemoveAll(mirrorDir); err != nil {
+		return fmt.Errorf("Failed to remove \"%s\" (%s)", mirrorDir, err)
+	}
+
+	return b.cloneGitMirror(ctx, mirrorDir)
+}
+
+// Updates the mirror from the repository
+func (b *Bootstrap) fetchGitMirror(ctx context.Context, mirrorDir string) error {
+	if err := b.shell.Run(ctx, "git", "--git-dir", mirrorDir, "remote", "set-url", "origin", b.Repository); err != nil {
+		return err
+	}
+
+	if err := b.shell.Run(ctx, "git", "--git-dir", mirrorDir, "remote", "update", "--prune"); err != nil {
+		return err
+	}
+
+	touchGitMirror(mirrorDir)
+	return nil
+}
@@ -0,0 +1,123 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/bootstrap/shell"
+)
+
+// Creates a repository with a commit in it, and a bootstrap that mirrors it
+func newTestMirrorBootstrap(t *testing.T) (*Bootstrap, func()) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+
+	dir, err := ioutil.TempDir("", "git-mirror-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := filepath.Join(dir, "repo")
+	for _, args := range [][]string{
+		{"init", "-q", repo},
+		{"-C", repo, "-c", "user.name=Llama", "-c", "user.email=llama@example.com", "commit", "-q", "--allow-empty", "-m", "Llamas"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("git %v failed: %v\n%s", args, err, out)
+		}
+	}
+
+	sh, err := shell.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh.Logger = shell.DiscardLogger
+	sh.Writer = ioutil.Discard
+
+	b := &Bootstrap{shell: sh, Config: Config{
+		Repository:            repo,
+		Commit:                "HEAD",
+		GitMirrorsPath:        filepath.Join(dir, "mirrors"),
+		GitMirrorsLockTimeout: 1,
+		GitMirrorsStaleAfter:  60,
+	}}
+
+	return b, func() { os.RemoveAll(dir) }
+}
+
+func TestUpdatingGitMirrorRepairsCorruptMirrors(t *testing.T) {
+	b, cleanup := newTestMirrorBootstrap(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	mirrorDir, err := b.updateGitMirror(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.isGitMirrorHealthy(ctx, mirrorDir) {
+		t.Fatalf("Expected the new mirror to be healthy")
+	}
+
+	// Remove the objects, and make the mirror look like it hasn't been
+	// updated in a while
+	if err = os.RemoveAll(filepath.Join(mirrorDir, "objects")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Join(mirrorDir, "objects"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(mirrorDir, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if !b.isGitMirrorStale(mirrorDir) {
+		t.Fatalf("Expected the mirror to be stale")
+	}
+	if b.isGitMirrorHealthy(ctx, mirrorDir) {
+		t.Fatalf("Expected the mirror to be corrupt")
+	}
+
+	if _, err = b.updateGitMirror(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !b.isGitMirrorHealthy(ctx, mirrorDir) {
+		t.Fatalf("Expected the mirror to be cloned again")
+	}
+	if b.isGitMirrorStale(mirrorDir) {
+		t.Fatalf("Expected the mirror not to be stale after it was cloned again")
+	}
+}
+
+func TestUpdatingLockedGitMirrorFallsBackToCloning(t *testing.T) {
+	b, cleanup := newTestMirrorBootstrap(t)
+	defer cleanup()
+
+	if err := os.MkdirAll(b.GitMirrorsPath, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lock the mirror like another process is updating it. Locks held by
+	// this process can be taken again, so it's the parent's pid.
+	lock := filepath.Join(b.GitMirrorsPath, dirForRepository(b.Repository)+".lock")
+	if err := ioutil.WriteFile(lock, []byte(fmt.Sprintf("%d\n", os.Getppid())), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mirrorDir, err := b.updateGitMirror(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mirrorDir != "" {
+		t.Fatalf("Expected no mirror to be used, got %q", mirrorDir)
+	}
+}
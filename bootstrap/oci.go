@@ -0,0 +1,547 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/env"
+	"github.com/buildkite/agent/untar"
+)
+
+const (
+	ociManifestMediaType        = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexMediaType           = "application/vnd.oci.image.index.v1+json"
+	dockerManifestMediaType     = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// The annotation tools like oras use for the name of a file pushed as
+	// a layer on it's own
+	ociTitleAnnotation = "org.opencontainers.image.title"
+
+	// Manifests are small, anything bigger than this is something else
+	ociMaxManifestSize = 4 * 1024 * 1024
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// ociClient pulls a plugin from an OCI registry using the distribution API
+type ociClient struct {
+	// The registry as it was written in the plugin, e.g. ghcr.io
+	Registry string
+
+	// The repository within the registry, e.g. my-org/my-plugin
+	Repository string
+
+	// The tag or digest to pull
+	Reference string
+
+	// The environment used to find registry credentials
+	Env *env.Environment
+
+	client *http.Client
+	token  string
+	basic  bool
+}
+
+func newOCIClient(p *agent.Plugin, environ *env.Environment) (*ociClient, error) {
+	parts := strings.SplitN(p.Location, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("Incomplete OCI plugin reference \"%s\"", p.Label())
+	}
+
+	c := &ociClient{
+		Registry:   parts[0],
+		Repository: parts[1],
+		Reference:  p.Version,
+		Env:        environ,
+		client:     &http.Client{},
+	}
+
+	if c.Reference == "" {
+		c.Reference = "latest"
+	}
+
+	// Official images on Docker Hub live under library/
+	if c.isDockerHub() && !strings.Contains(c.Repository, "/") {
+		c.Repository = "library/" + c.Repository
+	}
+
+	return c, nil
+}
+
+func (c *ociClient) isDockerHub() bool {
+	return c.Registry == "docker.io" || c.Registry == "index.docker.io"
+}
+
+// The base URL of the repository in the registry's API. Like docker, plain
+// HTTP is only used for registries running on the local machine.
+func (c *ociClient) repositoryURL() string {
+	host := c.Registry
+	if c.isDockerHub() {
+		host = "registry-1.docker.io"
+	}
+
+	scheme := "https"
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if hostname == "localhost" || hostname == "127.0.0.1" || hostname == "::1" {
+		scheme = "http"
+	}
+
+	return scheme + "://" + host + "/v2/" + c.Repository
+}
+
+// Resolve fetches the manifest for the reference, returning it along with
+// it's digest
+func (c *ociClient) Resolve() (string, *ociManifest, error) {
+	return c.resolve(c.Reference)
+}
+
+func (c *ociClient) resolve(reference string) (string, *ociManifest, error) {
+	req, err := http.NewRequest("GET", c.repositoryURL()+"/manifests/"+reference, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Accept", strings.Join([]string{
+		ociManifestMediaType, ociIndexMediaType, dockerManifestMediaType, dockerManifestListMediaType,
+	}, ", "))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("Failed to fetch the manifest for %s (%s)", reference, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, ociMaxManifestSize))
+	if err != nil {
+		return "", nil, err
+	}
+
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	if strings.HasPrefix(reference, "sha256:") && reference != digest {
+		return "", nil, fmt.Errorf("Manifest has a digest of %s, expected %s", digest, reference)
+	}
+
+	var manifest ociManifest
+	if err = json.Unmarshal(body, &manifest); err != nil {
+		return "", nil, fmt.Errorf("Failed to parse the manifest for %s (%v)", reference, err)
+	}
+
+	// Plugins aren't platform specific, so if we're given an index the
+	// first manifest in it is as good as any
+	if len(manifest.Manifests) > 0 {
+		return c.resolve(manifest.Manifests[0].Digest)
+	}
+
+	return digest, &manifest, nil
+}
+
+// Unpack downloads each layer of the manifest and extracts them into dir
+func (c *ociClient) Unpack(manifest *ociManifest, dir string) error {
+	if len(manifest.Layers) == 0 {
+		return errors.New("The image doesn't have any layers")
+	}
+
+	for _, layer := range manifest.Layers {
+		if err := c.unpackLayer(layer, dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *ociClient) unpackLayer(layer ociDescriptor, dir string) error {
+	if !strings.HasPrefix(layer.Digest, "sha256:") {
+		return fmt.Errorf("Unsupported layer digest \"%s\"", layer.Digest)
+	}
+
+	req, err := http.NewRequest("GET", c.repositoryURL()+"/blobs/"+layer.Digest, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to fetch layer %s (%s)", layer.Digest, resp.Status)
+	}
+
+	// Everything read from the layer goes through the hash, so it can be
+	// checked once the layer has been extracted
+	hash := sha256.New()
+	body := io.TeeReader(resp.Body, hash)
+
+	title := layer.Annotations[ociTitleAnnotation]
+
+	switch {
+	case strings.Contains(layer.MediaType, "tar") && strings.Contains(layer.MediaType, "gzip"):
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		if err = extractTar(gz, dir); err != nil {
+			return err
+		}
+	case strings.Contains(layer.MediaType, "tar"):
+		if err := extractTar(body, dir); err != nil {
+			return err
+		}
+	case title != "":
+		if err := writeUnpackedFile(dir, title, body, 0755); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unsupported layer type \"%s\"", layer.MediaType)
+	}
+
+	// Make sure we've read right to the end before checking the digest
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return err
+	}
+
+	if digest := fmt.Sprintf("sha256:%x", hash.Sum(nil)); digest != layer.Digest {
+		return fmt.Errorf("Layer has a digest of %s, expected %s", digest, layer.Digest)
+	}
+
+	return nil
+}
+
+// Performs a request, authenticating with the registry if it asks us to
+func (c *ociClient) do(req *http.Request) (*http.Response, error) {
+	c.authorize(req)
+
+	resp, err := c.client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	if err = c.authenticate(challenge); err != nil {
+		return nil, err
+	}
+
+	c.authorize(req)
+	return c.client.Do(req)
+}
+
+func (c *ociClient) authorize(req *http.Request) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.basic {
+		if username, password, err := c.credentials(); err == nil && username != "" {
+			req.SetBasicAuth(username, password)
+		}
+	}
+}
+
+// Handles a WWW-Authenticate challenge, either by switching to basic auth or
+// by fetching a bearer token from the registry's token service
+func (c *ociClient) authenticate(challenge string) error {
+	scheme, params := parseAuthChallenge(challenge)
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.basic {
+			return errors.New("The registry rejected the credentials")
+		}
+		c.basic = true
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("Unsupported registry authentication \"%s\"", challenge)
+	}
+
+	if c.token != "" {
+		return errors.New("The registry rejected the token")
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("Invalid registry authentication realm \"%s\"", params["realm"])
+	}
+
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	if params["scope"] != "" {
+		query.Set("scope", params["scope"])
+	} else {
+		query.Set("scope", "repository:"+c.Repository+":pull")
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	username, password, err := c.credentials()
+	if err != nil {
+		return err
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to authenticate with %s (%s)", c.Registry, resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+
+	c.token = token.Token
+	if c.token == "" {
+		c.token = token.AccessToken
+	}
+	if c.token == "" {
+		return fmt.Errorf("No token returned by %s", realm.Host)
+	}
+
+	return nil
+}
+
+func (c *ociClient) credentials() (string, string, error) {
+	server := c.Registry
+	if c.isDockerHub() {
+		server = "https://index.docker.io/v1/"
+	}
+
+	return dockerCredentials(c.Env, server)
+}
+
+// Finds the credentials for a registry in the docker config, the same way the
+// docker cli does, either from a credential helper or from the auths section
+func dockerCredentials(environ *env.Environment, server string) (string, string, error) {
+	configDir, _ := environ.Get("DOCKER_CONFIG")
+	if configDir == "" {
+		home, _ := environ.Get("HOME")
+		configDir = filepath.Join(home, ".docker")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(configDir, "config.json"))
+	if os.IsNotExist(err) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+
+	var config struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+		CredsStore  string            `json:"credsStore"`
+		CredHelpers map[string]string `json:"credHelpers"`
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return "", "", fmt.Errorf("Failed to parse docker config (%v)", err)
+	}
+
+	helper := config.CredHelpers[server]
+	if helper == "" {
+		helper = config.CredsStore
+	}
+
+	if helper != "" {
+		username, password, err := dockerCredentialHelper(environ, helper, server)
+		if err != nil {
+			return "", "", err
+		}
+		if username != "" {
+			return username, password, nil
+		}
+	}
+
+	for _, key := range []string{server, "https://" + server, "http://" + server} {
+		auth, ok := config.Auths[key]
+		if !ok {
+			continue
+		}
+
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return "", "", fmt.Errorf("Invalid auth for %s in docker config (%v)", key, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return "", "", fmt.Errorf("Invalid auth for %s in docker config", key)
+			}
+			return parts[0], parts[1], nil
+		}
+
+		return auth.Username, auth.Password, nil
+	}
+
+	return "", "", nil
+}
+
+func dockerCredentialHelper(environ *env.Environment, helper string, server string) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Env = environ.ToSlice()
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		// Helpers exit non-zero when they don't have credentials
+		if strings.Contains(stdout.String()+stderr.String(), "credentials not found") {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("docker-credential-%s failed (%v)", helper, err)
+	}
+
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return "", "", fmt.Errorf("Failed to parse output of docker-credential-%s (%v)", helper, err)
+	}
+
+	return creds.Username, creds.Secret, nil
+}
+
+// Parses a WWW-Authenticate header like:
+// Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:org/plugin:pull"
+func parseAuthChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end == -1 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma != -1 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+
+	return parts[0], params
+}
+
+// Extracts a tar stream into dir, refusing anything that would end up
+// outside of it
+func extractTar(r io.Reader, dir string) error {
+	return untar.Extract(r, dir, func(header *tar.Header) bool {
+		// Whiteouts only mean something when layering images
+		return strings.HasPrefix(filepath.Base(filepath.FromSlash(header.Name)), ".wh.")
+	})
+}
+
+func writeUnpackedFile(dir string, name string, r io.Reader, mode os.FileMode) error {
+	path, err := unpackedPath(dir, name)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return err
+	}
+
+	f, err := untar.Create(dir, rel, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func unpackedPath(dir string, name string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash("/" + name))
+	path := filepath.Join(dir, cleaned)
+
+	if !withinDir(dir, path) {
+		return "", fmt.Errorf("\"%s\" would be unpacked outside of the plugin", name)
+	}
+
+	return path, nil
+}
+
+func withinDir(dir string, path string) bool {
+	dir = filepath.Clean(dir)
+	path = filepath.Clean(path)
+
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
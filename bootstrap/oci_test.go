@@ -0,0 +1,284 @@
+package bootstrap
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/env"
+	"github.com/stretchr/testify/assert"
+)
+
+type testTarFile struct {
+	Name     string
+	Body     string
+	Linkname string
+}
+
+func createTestLayer(t *testing.T, files []testTarFile) []byte {
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, f := range files {
+		header := &tar.Header{Name: f.Name, Mode: 0755, Size: int64(len(f.Body)), Typeflag: tar.TypeReg}
+		if f.Linkname != "" {
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = f.Linkname
+			header.Size = 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.Body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// A registry that serves a single image and requires a token obtained with
+// basic auth, like most hosted registries
+func createTestRegistry(t *testing.T, layer []byte) (*httptest.Server, string) {
+	layerDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+
+	manifest, err := json.Marshal(ociManifest{
+		MediaType: ociManifestMediaType,
+		Layers: []ociDescriptor{
+			{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: layerDigest, Size: int64(len(layer))},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if username, password, ok := r.BasicAuth(); !ok || username != "llama" || password != "secret" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			assert.Equal(t, "repository:my-org/my-plugin:pull", r.URL.Query().Get("scope"))
+			fmt.Fprint(w, `{"token":"abc123"}`)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer abc123" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:my-org/my-plugin:pull"`, server.URL))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v2/my-org/my-plugin/manifests/1.0.0", "/v2/my-org/my-plugin/manifests/" + manifestDigest:
+			w.Header().Set("Content-Type", ociManifestMediaType)
+			w.Write(manifest)
+		case "/v2/my-org/my-plugin/blobs/" + layerDigest:
+			w.Write(layer)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	return server, manifestDigest
+}
+
+func createTestDockerConfig(t *testing.T, registry string) string {
+	dir, err := ioutil.TempDir("", "docker-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := fmt.Sprintf(`{"auths":{"%s":{"auth":"%s"}}}`, registry, base64.StdEncoding.EncodeToString([]byte("llama:secret")))
+	if err = ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestPullingOCIPluginWithDockerCredentials(t *testing.T) {
+	t.Parallel()
+
+	server, manifestDigest := createTestRegistry(t, createTestLayer(t, []testTarFile{
+		{Name: "hooks/command", Body: "echo llamas\n"},
+		{Name: "plugin.yml", Body: "name: My Plugin\n"},
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+
+	configDir := createTestDockerConfig(t, registry)
+	defer os.RemoveAll(configDir)
+
+	dir, err := ioutil.TempDir("", "oci-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := agent.CreatePlugin("oci://"+registry+"/my-org/my-plugin:1.0.0", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := newOCIClient(p, env.FromSlice([]string{"DOCKER_CONFIG=" + configDir}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, manifest, err := client.Resolve()
+	assert.NoError(t, err)
+	assert.Equal(t, manifestDigest, digest)
+
+	assert.NoError(t, client.Unpack(manifest, dir))
+
+	command, err := ioutil.ReadFile(filepath.Join(dir, "hooks", "command"))
+	assert.NoError(t, err)
+	assert.Equal(t, "echo llamas\n", string(command))
+	assert.True(t, fileExists(filepath.Join(dir, "plugin.yml")))
+}
+
+func TestPullingOCIPluginWithoutCredentialsFails(t *testing.T) {
+	t.Parallel()
+
+	server, _ := createTestRegistry(t, createTestLayer(t, []testTarFile{
+		{Name: "hooks/command", Body: "echo llamas\n"},
+	}))
+	defer server.Close()
+
+	p, err := agent.CreatePlugin("oci://"+strings.TrimPrefix(server.URL, "http://")+"/my-org/my-plugin:1.0.0", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := newOCIClient(p, env.FromSlice([]string{"DOCKER_CONFIG=/does/not/exist"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = client.Resolve()
+	assert.Error(t, err)
+}
+
+func TestPullingOCIPluginWithMismatchedDigestFails(t *testing.T) {
+	t.Parallel()
+
+	server, _ := createTestRegistry(t, createTestLayer(t, []testTarFile{
+		{Name: "hooks/command", Body: "echo llamas\n"},
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+
+	configDir := createTestDockerConfig(t, registry)
+	defer os.RemoveAll(configDir)
+
+	p, err := agent.CreatePlugin("oci://"+registry+"/my-org/my-plugin@sha256:"+strings.Repeat("0", 64), map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := newOCIClient(p, env.FromSlice([]string{"DOCKER_CONFIG=" + configDir}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = client.Resolve()
+	assert.Error(t, err)
+}
+
+func TestExtractingTarLayersStaysInsideThePlugin(t *testing.T) {
+	t.Parallel()
+
+	var testCases = []struct {
+		files    []testTarFile
+		succeeds bool
+	}{
+		{[]testTarFile{{Name: "hooks/command", Body: "echo llamas"}, {Name: "hooks/post-command", Linkname: "command"}}, true},
+		{[]testTarFile{{Name: ".wh.command"}}, true},
+		{[]testTarFile{{Name: "hooks/escape", Linkname: "../../../etc/passwd"}}, false},
+		{[]testTarFile{{Name: "hooks/escape", Linkname: "/etc/passwd"}}, false},
+		{[]testTarFile{{Name: "x", Linkname: "."}, {Name: "x/y", Linkname: ".."}, {Name: "y/escape", Body: "llamas"}}, false},
+	}
+
+	for _, tc := range testCases {
+		dir, err := ioutil.TempDir("", "oci-plugin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(createTestLayer(t, tc.files)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = extractTar(gz, dir)
+		if tc.succeeds {
+			assert.NoError(t, err, tc.files)
+		} else {
+			assert.Error(t, err, tc.files)
+		}
+
+		os.RemoveAll(dir)
+	}
+
+	// Paths that try and climb out of the plugin are kept inside it
+	path, err := unpackedPath("/plugins/my-plugin", "../../etc/passwd")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join("/plugins/my-plugin", "etc", "passwd"), path)
+
+	// Files aren't written through symlinks that are already there either
+	if runtime.GOOS != "windows" {
+		dir, err := ioutil.TempDir("", "oci-plugin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := os.Symlink(os.TempDir(), filepath.Join(dir, "hooks")); err != nil {
+			t.Fatal(err)
+		}
+		assert.Error(t, writeUnpackedFile(dir, "hooks/command", strings.NewReader("echo llamas"), 0755))
+	}
+}
+
+func TestParsingAuthChallenges(t *testing.T) {
+	t.Parallel()
+
+	scheme, params := parseAuthChallenge(`Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:my-org/my-plugin:pull"`)
+	assert.Equal(t, "Bearer", scheme)
+	assert.Equal(t, map[string]string{
+		"realm":   "https://ghcr.io/token",
+		"service": "ghcr.io",
+		"scope":   "repository:my-org/my-plugin:pull",
+	}, params)
+
+	scheme, params = parseAuthChallenge(`Basic realm=registry`)
+	assert.Equal(t, "Basic", scheme)
+	assert.Equal(t, map[string]string{"realm": "registry"}, params)
+}
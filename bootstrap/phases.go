@@ -0,0 +1,58 @@
+package bootstrap
+
+import (
+	"context"
+
+	"github.com/buildkite/agent/bootstrap/shell"
+)
+
+// Phase is a phase of the job that a program embedding the bootstrap can
+// replace with its own, i.e. to check out from somewhere the bootstrap
+// doesn't know about. It's run with the bootstrap, so it can use its shell and
+// config, and call the default phase to wrap it.
+type Phase interface {
+	Run(ctx context.Context, b *Bootstrap) error
+}
+
+// PhaseFunc is a func that's a Phase
+type PhaseFunc func(ctx context.Context, b *Bootstrap) error
+
+// Run calls the func
+func (f PhaseFunc) Run(ctx context.Context, b *Bootstrap) error {
+	return f(ctx, b)
+}
+
+// Phases are the phases of the job that can be replaced. Any that are nil are
+// the bootstrap's own.
+type Phases struct {
+	// Checks out the plugins and runs their environment hooks, which is
+	// PluginPhase by default
+	Plugins Phase
+
+	// Checks out the repository, which is CheckoutPhase by default. When
+	// it's replaced, a phase that succeeds counts as a checkout, so the
+	// artifacts are still uploaded.
+	Checkout Phase
+
+	// Runs the job's command, which is CommandPhase by default
+	Command Phase
+
+	// Uploads the job's artifacts, which is ArtifactPhase by default
+	Artifacts Phase
+}
+
+// Returns the phase's replacement as a func, or the default if there isn't one
+func (b *Bootstrap) phase(replacement Phase, def func(context.Context) error) func(context.Context) error {
+	if replacement == nil {
+		return def
+	}
+	return func(ctx context.Context) error {
+		return replacement.Run(ctx, b)
+	}
+}
+
+// JobShell returns the shell the bootstrap runs everything in, for phases to run
+// commands with. It's nil until the bootstrap has started.
+func (b *Bootstrap) JobShell() *shell.Shell {
+	return b.shell
+}
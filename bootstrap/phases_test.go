@@ -0,0 +1,125 @@
+package bootstrap
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunPhasesRunsReplacedPhases(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "phases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var ran []string
+	record := func(name string) Phase {
+		return PhaseFunc(func(ctx context.Context, b *Bootstrap) error {
+			ran = append(ran, name)
+			if name == "command" {
+				b.JobShell().Env.Set("BUILDKITE_COMMAND_EXIT_STATUS", "3")
+			}
+			return nil
+		})
+	}
+
+	b := &Bootstrap{
+		shell:  newTestShell(t),
+		Config: Config{BuildPath: dir, HooksPath: dir},
+		Phases: Phases{
+			Plugins:   record("plugins"),
+			Checkout:  record("checkout"),
+			Command:   record("command"),
+			Artifacts: record("artifacts"),
+		},
+	}
+
+	assert.Equal(t, 3, b.RunPhases(context.Background()))
+	assert.Equal(t, []string{"plugins", "checkout", "command", "artifacts"}, ran)
+	assert.True(t, b.hasCheckout)
+}
+
+func TestRunPhasesStopsAtAFailedPhase(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "phases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	commandRan := false
+
+	b := &Bootstrap{
+		shell:  newTestShell(t),
+		Config: Config{BuildPath: dir, HooksPath: dir},
+		Phases: Phases{
+			Plugins: PhaseFunc(func(ctx context.Context, b *Bootstrap) error { return nil }),
+			Checkout: PhaseFunc(func(ctx context.Context, b *Bootstrap) error {
+				return &HookError{Name: "checkout", Err: os.ErrNotExist}
+			}),
+			Command: PhaseFunc(func(ctx context.Context, b *Bootstrap) error {
+				commandRan = true
+				return nil
+			}),
+			Artifacts: PhaseFunc(func(ctx context.Context, b *Bootstrap) error { return nil }),
+		},
+	}
+
+	assert.NotEqual(t, 0, b.RunPhases(context.Background()))
+	assert.False(t, commandRan)
+	assert.False(t, b.hasCheckout)
+}
+
+func TestRunPhasesWithTheJobsEnvironmentOutputAndSignals(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "phases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var output bytes.Buffer
+	signals := make(chan os.Signal, 1)
+	checkedOut := false
+
+	b := &Bootstrap{
+		Config:  Config{BuildPath: dir, HooksPath: dir},
+		Environ: []string{"LLAMAS=rock"},
+		Output:  &output,
+		Signals: signals,
+		Phases: Phases{
+			Plugins: PhaseFunc(func(ctx context.Context, b *Bootstrap) error {
+				if value, _ := b.JobShell().Env.Get("LLAMAS"); value != "rock" {
+					t.Errorf("Expected the job's environment, got LLAMAS=%q", value)
+				}
+
+				signals <- syscall.SIGTERM
+				for i := 0; i < 100 && !b.isCancelled(); i++ {
+					time.Sleep(10 * time.Millisecond)
+				}
+				return nil
+			}),
+			Checkout: PhaseFunc(func(ctx context.Context, b *Bootstrap) error {
+				checkedOut = true
+				return nil
+			}),
+			Artifacts: PhaseFunc(func(ctx context.Context, b *Bootstrap) error { return nil }),
+		},
+	}
+
+	assert.NotEqual(t, 0, b.RunPhases(context.Background()))
+	assert.False(t, checkedOut)
+	assert.Contains(t, output.String(), "cancelling the job")
+	assert.Contains(t, output.String(), errCancelled.Error())
+}
@@ -0,0 +1,207 @@
+package bootstrap
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nightlyone/lockfile"
+)
+
+// Plugins are cloned into a temporary directory named after the plugin with
+// this suffix before being moved into place
+const pluginCheckoutTempSuffix = ".tmp"
+
+// The phases of a job that a plugin can replace by having a hook of the same
+// name, which runs instead of the built-in phase
+var pluginPhases = []string{"checkout", "command"}
+
+func isPluginPhase(name string) bool {
+	for _, phase := range pluginPhases {
+		if phase == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolves the output of `git ls-remote <repo> <ref> <ref>^{}` to the commit
+// the ref points at, preferring the peeled commit of annotated tags
+func resolveLsRemoteCommit(output string) string {
+	var commit string
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || len(fields[0]) != 40 {
+			continue
+		}
+
+		if strings.HasSuffix(fields[1], "^{}") {
+			return fields[0]
+		}
+
+		if commit == "" {
+			commit = fields[0]
+		}
+	}
+
+	return commit
+}
+
+// Records that a plugin checkout has been used, so the plugin cache can be
+// cleaned of checkouts that haven't been used in a while
+func touchPluginCheckout(directory string) {
+	now := time.Now()
+	_ = os.Chtimes(directory, now, now)
+}
+
+// CleanPluginCache removes plugin checkouts from the plugins directory that
+// haven't been used within olderThan (or all of them if it's 0), along with
+// any left over from interrupted checkouts. Each is locked while it's removed,
+// so plugins that are being checked out, or that a job is starting to use, are
+// skipped. Checkouts are only recorded as used when jobs start, so cleaning
+// all of them removes ones that running jobs are using. It returns the paths
+// removed, or that would've been removed if dryRun is set.
+func CleanPluginCache(pluginsPath string, olderThan time.Duration, dryRun bool) ([]string, error) {
+	entries, err := ioutil.ReadDir(pluginsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		if olderThan > 0 && time.Since(entry.ModTime()) < olderThan {
+			continue
+		}
+
+		path := filepath.Join(pluginsPath, entry.Name())
+
+		// Interrupted checkouts are locked by their plugin's key
+		key := entry.Name()
+		if i := strings.Index(key, pluginCheckoutTempSuffix); i > 0 {
+			key = key[:i]
+		}
+
+		lockPath, err := filepath.Abs(filepath.Join(pluginsPath, key+".lock"))
+		if err != nil {
+			return removed, err
+		}
+
+		lock, err := lockfile.New(lockPath)
+		if err != nil {
+			return removed, err
+		}
+
+		if err := lock.TryLock(); err != nil {
+			continue
+		}
+
+		// A job could have started using it before it was locked
+		if olderThan > 0 {
+			if info, err := os.Stat(path); err != nil || time.Since(info.ModTime()) < olderThan {
+				lock.Unlock()
+				continue
+			}
+		}
+
+		if !dryRun {
+			err = os.RemoveAll(path)
+		}
+		lock.Unlock()
+
+		if err != nil {
+			return removed, err
+		}
+
+		removed = append(removed, path)
+	}
+
+	return removed, nil
+}
+
+// Calculates a checksum of all the files in a plugin checkout (ignoring the
+// .git directory). It's the same as what you'd get by running the following
+// in a clean checkout of the plugin:
+//
+//	find . -type f -not -path './.git/*' | LC_ALL=C sort | xargs sha256sum | sha256sum
+//
+// Except that symlinks, which find skips, are summarized as "link  ./path ->
+// target" in their place, so a hook can't be pointed at another file without
+// changing the checksum.
+func pluginChecksum(dir string) (string, error) {
+	var files []string
+	links := map[string]string{}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && info.Name() == ".git" && path != dir {
+			return filepath.SkipDir
+		}
+
+		if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		file := "./" + filepath.ToSlash(rel)
+		files = append(files, file)
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			links[file] = target
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sort.Strings(files)
+
+	summary := sha256.New()
+	for _, file := range files {
+		if target, ok := links[file]; ok {
+			fmt.Fprintf(summary, "link  %s -> %s\n", file, target)
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(file)))
+		if err != nil {
+			return "", err
+		}
+
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(summary, "%x  %s\n", h.Sum(nil), file)
+	}
+
+	return fmt.Sprintf("%x", summary.Sum(nil)), nil
+}
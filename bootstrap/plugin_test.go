@@ -0,0 +1,226 @@
+package bootstrap
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolvingLsRemoteCommits(t *testing.T) {
+	t.Parallel()
+
+	var testCases = []struct {
+		output string
+		commit string
+	}{
+		{"", ""},
+		{"2de6e3b5a2e8da6a2a9aa8e2d1a5e9f3e1a3c7b1\trefs/heads/master", "2de6e3b5a2e8da6a2a9aa8e2d1a5e9f3e1a3c7b1"},
+		{
+			"1111111111111111111111111111111111111111\trefs/tags/v1.0.0\n" +
+				"2222222222222222222222222222222222222222\trefs/tags/v1.0.0^{}",
+			"2222222222222222222222222222222222222222",
+		},
+		{"warning: redirecting to https://example.com/\n", ""},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.commit, resolveLsRemoteCommit(tc.output))
+	}
+}
+
+func TestCleaningPluginCache(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "plugin-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := time.Now().Add(-48 * time.Hour)
+
+	for _, name := range []string{"recent-plugin", "old-plugin", "interrupted-plugin" + pluginCheckoutTempSuffix + "12345"} {
+		if err := os.MkdirAll(filepath.Join(dir, name, "hooks"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if name != "recent-plugin" {
+			if err := os.Chtimes(filepath.Join(dir, name), old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	removed, err := CleanPluginCache(dir, 24*time.Hour, true)
+	assert.NoError(t, err)
+	assert.Len(t, removed, 2)
+	assert.True(t, fileExists(filepath.Join(dir, "old-plugin")))
+
+	removed, err = CleanPluginCache(dir, 24*time.Hour, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "interrupted-plugin"+pluginCheckoutTempSuffix+"12345"),
+		filepath.Join(dir, "old-plugin"),
+	}, removed)
+	assert.True(t, fileExists(filepath.Join(dir, "recent-plugin")))
+	assert.False(t, fileExists(filepath.Join(dir, "old-plugin")))
+
+	removed, err = CleanPluginCache(dir, 0, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "recent-plugin")}, removed)
+}
+
+func TestPluginsPinnedToCommitsArentLookedUp(t *testing.T) {
+	t.Parallel()
+
+	// There's no shell, so looking the commit up would panic
+	b := &Bootstrap{}
+
+	for _, version := range []string{
+		strings.Repeat("a", 40),
+		strings.Repeat("A", 40),
+		strings.Repeat("b", 64),
+	} {
+		p := &agent.Plugin{Location: "github.com/buildkite-plugins/llamas-buildkite-plugin", Version: version}
+		assert.Equal(t, "llamas", b.pluginCacheKey(context.Background(), p, "llamas", "https://github.com/buildkite-plugins/llamas-buildkite-plugin"))
+	}
+}
+
+func TestPluginChecksumIgnoresGitDirectory(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "plugin-checksum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "hooks"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "hooks", "command"), []byte("llamas\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// echo llamas > hooks/command && find . -type f | LC_ALL=C sort | xargs sha256sum | sha256sum
+	before, err := pluginChecksum(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, "1b294ed3b8ffbd436888acea0d706e026cd2dd669aef251fd93852b8b87c0315", before)
+
+	if err := os.MkdirAll(filepath.Join(dir, ".git"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".git", "HEAD"), []byte("ref: refs/heads/master\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := pluginChecksum(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestPluginChecksumIncludesSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Symlinks need extra privileges on Windows")
+	}
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "plugin-checksum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "hooks"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"llamas.sh", "alpacas.sh"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("echo "+name+"\n"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../llamas.sh", filepath.Join(dir, "hooks", "command")); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := pluginChecksum(dir)
+	assert.NoError(t, err)
+
+	// Only where the hook points changes
+	if err := os.Remove(filepath.Join(dir, "hooks", "command")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../alpacas.sh", filepath.Join(dir, "hooks", "command")); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := pluginChecksum(dir)
+	assert.NoError(t, err)
+	assert.NotEqual(t, before, after)
+}
+
+func TestCheckingPluginPhaseOverrides(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "plugin-phase-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	createPlugin := func(name string, hooks ...string) *pluginCheckout {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Join(path, "hooks"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		for _, hook := range hooks {
+			if err := ioutil.WriteFile(filepath.Join(path, "hooks", hook), []byte("#!/bin/bash\n"), 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		p, err := agent.CreatePlugin("github.com/buildkite-plugins/"+name+"#v1.0.0", map[string]interface{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &pluginCheckout{Plugin: p, Path: path}
+	}
+
+	docker := createPlugin("docker-buildkite-plugin", "command")
+	compose := createPlugin("docker-compose-buildkite-plugin", "command")
+	gitCheckout := createPlugin("git-checkout-buildkite-plugin", "checkout")
+	envHook := createPlugin("env-buildkite-plugin", "environment", "pre-command")
+
+	var testCases = []struct {
+		name    string
+		plugins []*pluginCheckout
+		denied  []string
+		valid   bool
+	}{
+		{"one plugin for each phase", []*pluginCheckout{docker, gitCheckout, envHook}, nil, true},
+		{"two plugins for a phase", []*pluginCheckout{docker, compose}, nil, false},
+		{"a denied phase", []*pluginCheckout{gitCheckout}, []string{"checkout"}, false},
+		{"another phase denied", []*pluginCheckout{docker}, []string{"checkout"}, true},
+		{"no phases replaced", []*pluginCheckout{envHook}, []string{"checkout", "command"}, true},
+		{"an unknown phase", []*pluginCheckout{envHook}, []string{"llamas"}, false},
+	}
+
+	for _, tc := range testCases {
+		b := &Bootstrap{Config: Config{DeniedPluginPhases: tc.denied}, plugins: tc.plugins}
+
+		err := b.checkPluginPhaseOverrides()
+		if tc.valid {
+			assert.NoError(t, err, tc.name)
+		} else {
+			assert.Error(t, err, tc.name)
+		}
+	}
+}
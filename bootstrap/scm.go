@@ -0,0 +1,87 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// scm is a source control system that the default checkout can use to check
+// out the pipeline's repository into the working directory. The checkout
+// calls Clone, Clean, Fetch, Checkout and Clean again in that order, and then
+// Metadata if the commit information hasn't been sent to Buildkite yet.
+type scm interface {
+	// The repository being checked out, without any scm prefix
+	Repository() string
+
+	// Whether the working directory contains a usable checkout
+	IsCheckout(ctx context.Context) bool
+
+	// Clones the repository into the working directory, or updates an
+	// existing checkout to point at it
+	Clone(ctx context.Context) error
+
+	// Fetches the commit that's going to be built
+	Fetch(ctx context.Context) error
+
+	// Checks out the fetched commit
+	Checkout(ctx context.Context) error
+
+	// Removes untracked files from the checkout
+	Clean(ctx context.Context) error
+
+	// Returns a description of the checked out commit and it's branches
+	Metadata(ctx context.Context) (*scmMetadata, error)
+}
+
+type scmMetadata struct {
+	Commit string
+	Branch string
+}
+
+const (
+	scmGit       = "git"
+	scmMercurial = "mercurial"
+)
+
+// Mercurial repositories can be distinguished from git ones with a prefix on
+// their scheme, i.e. hg+https://hg.example.com/repo
+const mercurialSchemePrefix = "hg+"
+
+// Works out which scm a repository uses from the name it's been given, or if
+// none was given from it's url, and returns the repository without any prefix
+func scmForRepository(name string, repository string) (string, string, error) {
+	hasMercurialPrefix := strings.HasPrefix(repository, mercurialSchemePrefix)
+	if hasMercurialPrefix {
+		repository = strings.TrimPrefix(repository, mercurialSchemePrefix)
+	}
+
+	switch strings.ToLower(name) {
+	case "":
+		if hasMercurialPrefix {
+			return scmMercurial, repository, nil
+		}
+		return scmGit, repository, nil
+	case "git":
+		return scmGit, repository, nil
+	case "hg", "mercurial":
+		return scmMercurial, repository, nil
+	default:
+		return "", "", fmt.Errorf("Unknown scm \"%s\", expected git or mercurial", name)
+	}
+}
+
+// Returns the scm used to check out the pipeline's repository
+func (b *Bootstrap) sourceControl() (scm, error) {
+	name, repository, err := scmForRepository(b.SCM, b.Repository)
+	if err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case scmMercurial:
+		return &mercurialSCM{b: b, repository: repository}, nil
+	default:
+		return &gitSCM{b: b, repository: repository}, nil
+	}
+}
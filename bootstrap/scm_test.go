@@ -0,0 +1,35 @@
+package bootstrap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSCMForRepository(t *testing.T) {
+	t.Parallel()
+
+	var testCases = []struct {
+		name       string
+		repository string
+		scm        string
+		expected   string
+	}{
+		{"", "git@github.com:buildkite/agent.git", scmGit, "git@github.com:buildkite/agent.git"},
+		{"", "hg+https://hg.example.com/repo", scmMercurial, "https://hg.example.com/repo"},
+		{"", "hg+ssh://hg@hg.example.com/repo", scmMercurial, "ssh://hg@hg.example.com/repo"},
+		{"hg", "https://hg.example.com/repo", scmMercurial, "https://hg.example.com/repo"},
+		{"Mercurial", "https://hg.example.com/repo", scmMercurial, "https://hg.example.com/repo"},
+		{"git", "https://github.com/buildkite/agent.git", scmGit, "https://github.com/buildkite/agent.git"},
+	}
+
+	for _, tc := range testCases {
+		scm, repository, err := scmForRepository(tc.name, tc.repository)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.scm, scm, tc.repository)
+		assert.Equal(t, tc.expected, repository)
+	}
+
+	_, _, err := scmForRepository("svn", "svn://svn.example.com/repo")
+	assert.Error(t, err)
+}
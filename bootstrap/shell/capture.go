@@ -0,0 +1,98 @@
+package shell
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/buildkite/agent/process"
+)
+
+// MaxCapturedOutput is how much of each output stream RunAndTee keeps. Only
+// the end of the output is kept, as that's where tools write their errors.
+const MaxCapturedOutput = 64 * 1024
+
+// CapturedOutput is the end of the stdout and stderr of a command run with
+// RunAndTee
+type CapturedOutput struct {
+	Stdout string
+	Stderr string
+
+	// Whether the start of either stream was dropped to keep within
+	// MaxCapturedOutput
+	Truncated bool
+}
+
+// RunAndTee runs a command like Run, writing it's stdout and stderr to the
+// shell's output, and also captures the end of each stream separately so it
+// can be inspected afterwards. The captured output is returned even if the
+// command fails, so the reason it failed can be found. A PTY is never used,
+// as it would merge the two streams.
+func (s *Shell) RunAndTee(ctx context.Context, command string, arg ...string) (*CapturedOutput, error) {
+	s.Promptf("%s", process.FormatCommand(command, arg))
+
+	cmd, err := s.buildCommand(command, arg...)
+	if err != nil {
+		s.Errorf("Error building command: %v", err)
+		return nil, err
+	}
+
+	stdout := &tailBuffer{max: MaxCapturedOutput}
+	stderr := &tailBuffer{max: MaxCapturedOutput}
+
+	// Both streams are written to the shell's output at the same time
+	w := &lockedWriter{w: s.Writer}
+
+	err = s.executeCommand(ctx, cmd, io.MultiWriter(w, stdout), executeFlags{
+		Silent: false,
+		PTY:    false,
+		Stderr: io.MultiWriter(w, stderr),
+	})
+
+	return &CapturedOutput{
+		Stdout:    stdout.String(),
+		Stderr:    stderr.String(),
+		Truncated: stdout.truncated || stderr.truncated,
+	}, err
+}
+
+// A writer that keeps the last max bytes written to it
+type tailBuffer struct {
+	mu        sync.Mutex
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - b.max; over > 0 {
+		b.buf = append(b.buf[:0], b.buf[over:]...)
+		b.truncated = true
+	}
+
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return string(b.buf)
+}
+
+// Serializes writes to a writer that's shared by more than one stream
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.w.Write(p)
+}
@@ -47,12 +47,10 @@ func LockFileWithContext(ctx context.Context, sh *Shell, path string) (*lockfile
 		}
 
 		// Check if we've timed out
-		for {
-			select {
-			case <-ctx.Done():
-				return nil, ctx.Err()
-			default:
-			}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
 		}
 	}
 
@@ -0,0 +1,40 @@
+package shell
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// PowershellQuote quotes a string for PowerShell as a single-quoted string,
+// which doesn't expand variables or escape sequences
+func PowershellQuote(str string) string {
+	return "'" + strings.Replace(str, "'", "''", -1) + "'"
+}
+
+// IsPowershell returns whether a command is PowerShell, either Windows
+// PowerShell or PowerShell Core (pwsh)
+func IsPowershell(command string) bool {
+	name := strings.ToLower(filepath.Base(strings.Replace(command, `\`, "/", -1)))
+	name = strings.TrimSuffix(name, ".exe")
+	return name == "powershell" || name == "pwsh"
+}
+
+// IsPowershellScript returns whether a file is a PowerShell script
+func IsPowershellScript(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".ps1")
+}
+
+// Returns the PowerShell that scripts are run with, preferring PowerShell
+// Core if it's installed
+func (s *Shell) powershell() string {
+	if _, err := s.AbsolutePath("pwsh"); err == nil {
+		return "pwsh"
+	}
+	return "powershell"
+}
+
+// The arguments to run a PowerShell script with, without the user's profile
+// or the execution policy getting in the way
+func powershellScriptArgs(path string) []string {
+	return []string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File", path}
+}
@@ -12,6 +12,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/buildkite/agent/env"
@@ -38,6 +39,13 @@ type Shell struct {
 	// Whether to run the shell in debug mode
 	Debug bool
 
+	// The user commands are run as, if they aren't run as the shell's
+	Credential *process.Credential
+
+	// The signals passed on to the running command, which are the ones
+	// the process gets if it's nil
+	Signals <-chan os.Signal
+
 	// Current working directory that shell commands get executed in
 	wd string
 
@@ -105,8 +113,10 @@ func (s *Shell) AbsolutePath(executable string) (string, error) {
 	return filepath.Abs(absolutePath)
 }
 
-// Run runs a command, write to the logger and return an error if it fails
-func (s *Shell) Run(command string, arg ...string) error {
+// Run runs a command, write to the logger and return an error if it fails. The
+// command and anything it started are killed if the context is done before it
+// finishes.
+func (s *Shell) Run(ctx context.Context, command string, arg ...string) error {
 	s.Promptf("%s", process.FormatCommand(command, arg))
 
 	cmd, err := s.buildCommand(command, arg...)
@@ -115,7 +125,7 @@ func (s *Shell) Run(command string, arg ...string) error {
 		return err
 	}
 
-	return s.executeCommand(cmd, s.Writer, executeFlags{
+	return s.executeCommand(ctx, cmd, s.Writer, executeFlags{
 		Silent: false,
 		PTY:    s.PTY,
 	})
@@ -123,7 +133,7 @@ func (s *Shell) Run(command string, arg ...string) error {
 
 // RunAndCapture runs a command and captures the stdout, nothing else is logged. A PTY is not used
 // even if one is enabled for the shell. Will write the command and the output to logger if Debug is enabled
-func (s *Shell) RunAndCapture(command string, arg ...string) (string, error) {
+func (s *Shell) RunAndCapture(ctx context.Context, command string, arg ...string) (string, error) {
 	if s.Debug {
 		s.Promptf("%s", process.FormatCommand(command, arg))
 	}
@@ -135,7 +145,7 @@ func (s *Shell) RunAndCapture(command string, arg ...string) (string, error) {
 
 	var b bytes.Buffer
 
-	err = s.executeCommand(cmd, &b, executeFlags{
+	err = s.executeCommand(ctx, cmd, &b, executeFlags{
 		Silent: !s.Debug,
 		PTY:    false,
 	})
@@ -149,7 +159,7 @@ func (s *Shell) RunAndCapture(command string, arg ...string) (string, error) {
 // RunScript is like Run, but the target is an interpreted script which has
 // some extra checks to ensure it gets to the correct interpreter. It also supports
 // passing in extra environment just for that script
-func (s *Shell) RunScript(path string, extra *env.Environment) error {
+func (s *Shell) RunScript(ctx context.Context, path string, extra *env.Environment) error {
 	// If you run a script on Linux that doesn't have the
 	// #!/bin/bash shebang at the top, it will fail to run with a
 	// "exec format error" error.
@@ -165,7 +175,11 @@ func (s *Shell) RunScript(path string, extra *env.Environment) error {
 	var command string
 	var args []string
 
-	if runtime.GOOS == "windows" {
+	// PowerShell scripts can't be run directly, even on Windows
+	if IsPowershellScript(path) {
+		command = s.powershell()
+		args = powershellScriptArgs(path)
+	} else if runtime.GOOS == "windows" {
 		command = path
 		args = []string{}
 	} else {
@@ -186,7 +200,32 @@ func (s *Shell) RunScript(path string, extra *env.Environment) error {
 	customEnv := currentEnv.Merge(extra)
 	cmd.Env = customEnv.ToSlice()
 
-	return s.executeCommand(cmd, s.Writer, executeFlags{
+	return s.executeCommand(ctx, cmd, s.Writer, executeFlags{
+		Silent: false,
+		PTY:    s.PTY,
+	})
+}
+
+// RunExecutable runs an executable file directly rather than through a shell,
+// with extra environment just for it like RunScript
+func (s *Shell) RunExecutable(ctx context.Context, path string, extra *env.Environment) error {
+	return s.RunWithEnv(ctx, extra, path)
+}
+
+// RunWithEnv is like Run, with extra environment just for the command like
+// RunScript
+func (s *Shell) RunWithEnv(ctx context.Context, extra *env.Environment, command string, arg ...string) error {
+	s.Promptf("%s", process.FormatCommand(command, arg))
+
+	cmd, err := s.buildCommand(command, arg...)
+	if err != nil {
+		s.Errorf("Error building command: %v", err)
+		return err
+	}
+
+	cmd.Env = env.FromSlice(cmd.Env).Merge(extra).ToSlice()
+
+	return s.executeCommand(ctx, cmd, s.Writer, executeFlags{
 		Silent: false,
 		PTY:    s.PTY,
 	})
@@ -204,6 +243,13 @@ func (s *Shell) buildCommand(name string, arg ...string) (*exec.Cmd, error) {
 	cmd.Env = s.Env.ToSlice()
 	cmd.Dir = s.wd
 
+	if s.Credential != nil {
+		if err := process.SetCredential(cmd, s.Credential); err != nil {
+			return nil, err
+		}
+		cmd.Env = append(cmd.Env, s.Credential.Env()...)
+	}
+
 	return cmd, nil
 }
 
@@ -213,36 +259,109 @@ type executeFlags struct {
 
 	// Run the command in a PTY
 	PTY bool
+
+	// Where stderr is written when not using a PTY, otherwise it's discarded
+	Stderr io.Writer
+}
+
+// TimeoutError is returned when a command is killed because the deadline of
+// it's context passed before it finished
+type TimeoutError struct {
+	Command string
 }
 
-func (s *Shell) executeCommand(cmd *exec.Cmd, w io.Writer, flags executeFlags) error {
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt,
-		syscall.SIGHUP,
-		syscall.SIGTERM,
-		syscall.SIGINT,
-		syscall.SIGQUIT)
-	defer signal.Stop(signals)
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("`%s` didn't finish before it's deadline", e.Command)
+}
+
+func (s *Shell) executeCommand(ctx context.Context, cmd *exec.Cmd, w io.Writer, flags executeFlags) error {
+	signals := s.Signals
+	if signals == nil {
+		notified := make(chan os.Signal, 1)
+		signal.Notify(notified, os.Interrupt,
+			syscall.SIGHUP,
+			syscall.SIGTERM,
+			syscall.SIGINT,
+			syscall.SIGQUIT)
+		defer signal.Stop(notified)
+		signals = notified
+	}
+
+	finished := make(chan struct{})
+	defer close(finished)
 
 	go func() {
-		// forward signals to the process
-		for sig := range signals {
-			if err := signalProcess(cmd, sig); err != nil {
-				if !flags.Silent {
-					s.Errorf("Error passing signal to child process: %v", err)
+		// forward signals to the process, until it's finished so the
+		// next command gets the ones after
+		for {
+			select {
+			case sig := <-signals:
+				if err := signalProcess(cmd, sig); err != nil {
+					if !flags.Silent {
+						s.Errorf("Error passing signal to child process: %v", err)
+					}
 				}
+			case <-finished:
+				return
 			}
 		}
 	}()
 
 	cmdStr := process.FormatCommand(cmd.Path, cmd.Args[1:])
 
+	// Contexts that can't be done (like context.Background) don't need the
+	// command to be in it's own process group (or job object on Windows)
+	cancellable := ctx.Done() != nil
+
+	// On Windows, the job object the command is in
+	var job *process.JobObject
+
+	// Once the command has started, kill it's process group (or job object)
+	// if the context is done before it finishes
+	var killed int32
+
+	watchContext := func() {
+		if !cancellable {
+			return
+		}
+
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-finished:
+				return
+			}
+
+			atomic.StoreInt32(&killed, 1)
+
+			kill := killProcessGroup
+			if job != nil {
+				kill = func(*exec.Cmd) error { return job.Terminate() }
+			}
+
+			if err := kill(cmd); err != nil && !flags.Silent {
+				s.Errorf("Error killing process: %v", err)
+			}
+		}()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return errors.Wrapf(err, "Error starting `%s`", cmdStr)
+	}
+
 	if flags.PTY {
 		pty, err := process.StartPTY(cmd)
 		if err != nil {
 			return fmt.Errorf("Error starting PTY: %v", err)
 		}
 
+		if runtime.GOOS == "windows" && cancellable {
+			job = s.assignJobObject(cmd, flags.Silent)
+			defer job.Close()
+		}
+
+		watchContext()
+
 		// Copy the pty to our buffer. This will block until it EOF's
 		// or something breaks.
 		_, err = io.Copy(w, pty)
@@ -253,7 +372,7 @@ func (s *Shell) executeCommand(cmd *exec.Cmd, w io.Writer, flags executeFlags) e
 		}
 	} else {
 		cmd.Stdout = w
-		cmd.Stderr = nil
+		cmd.Stderr = flags.Stderr
 		cmd.Stdin = nil
 
 		if s.Debug {
@@ -266,11 +385,27 @@ func (s *Shell) executeCommand(cmd *exec.Cmd, w io.Writer, flags executeFlags) e
 			// write the stdout to the writer and stream both stdout and stderr to the logger
 			cmd.Stdout = io.MultiWriter(stdOutStreamer, w)
 			cmd.Stderr = stdErrStreamer
+			if flags.Stderr != nil {
+				cmd.Stderr = io.MultiWriter(stdErrStreamer, flags.Stderr)
+			}
+		}
+
+		if cancellable {
+			setProcessGroup(cmd)
 		}
 
 		if err := cmd.Start(); err != nil {
 			return errors.Wrapf(err, "Error starting `%s`", cmdStr)
 		}
+
+		// Windows doesn't have process groups, so the command is put in a
+		// job object that everything it starts will be in too
+		if runtime.GOOS == "windows" && cancellable {
+			job = s.assignJobObject(cmd, flags.Silent)
+			defer job.Close()
+		}
+
+		watchContext()
 	}
 
 	if err := cmd.Wait(); err != nil {
@@ -278,12 +413,38 @@ func (s *Shell) executeCommand(cmd *exec.Cmd, w io.Writer, flags executeFlags) e
 			s.Printf("Exited with error: %v", err)
 		}
 
+		if atomic.LoadInt32(&killed) == 1 {
+			if ctx.Err() == context.DeadlineExceeded {
+				return &TimeoutError{Command: cmdStr}
+			}
+			return errors.Wrapf(ctx.Err(), "Error running `%s`", cmdStr)
+		}
+
 		return errors.Wrapf(err, "Error running `%s`", cmdStr)
 	}
 
 	return nil
 }
 
+// Adds a started command to a new job object. If that fails it's only the
+// command that's killed when it's context is done, not what it started.
+func (s *Shell) assignJobObject(cmd *exec.Cmd, silent bool) *process.JobObject {
+	job, err := process.NewJobObject()
+	if err == nil {
+		if err = job.Assign(cmd.Process); err != nil {
+			job.Close()
+		}
+	}
+	if err != nil {
+		if !silent {
+			s.Warningf("Failed to add `%s` to a job object, processes it starts won't be killed with it (%v)", process.FormatCommand(cmd.Path, cmd.Args[1:]), err)
+		}
+		return nil
+	}
+
+	return job
+}
+
 // GetExitCode extracts an exit code from an error where the platform supports it,
 // otherwise returns 0 for no error and 1 for an error
 func GetExitCode(err error) int {
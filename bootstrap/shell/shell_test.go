@@ -2,14 +2,19 @@ package shell_test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/buildkite/agent/bootstrap/shell"
 	"github.com/lox/bintest/proxy"
+	"github.com/pkg/errors"
 )
 
 func TestRunAndCaptureWithTTY(t *testing.T) {
@@ -32,7 +37,7 @@ func TestRunAndCaptureWithTTY(t *testing.T) {
 		call.Exit(0)
 	}()
 
-	actual, err := sh.RunAndCapture(sshKeygen.Path, "-f", "my_hosts", "-F", "llamas.com")
+	actual, err := sh.RunAndCapture(context.Background(), sshKeygen.Path, "-f", "my_hosts", "-F", "llamas.com")
 	if err != nil {
 		t.Error(err)
 	}
@@ -66,7 +71,7 @@ func TestRun(t *testing.T) {
 		call.Exit(0)
 	}()
 
-	if err = sh.Run(sshKeygen.Path, "-f", "my_hosts", "-F", "llamas.com"); err != nil {
+	if err = sh.Run(context.Background(), sshKeygen.Path, "-f", "my_hosts", "-F", "llamas.com"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -124,7 +129,7 @@ func TestWorkingDir(t *testing.T) {
 			t.Fatalf("Expected working dir %q, got %q", dir, actual)
 		}
 
-		out, err := sh.RunAndCapture("pwd")
+		out, err := sh.RunAndCapture(context.Background(), "pwd")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -139,3 +144,149 @@ func TestWorkingDir(t *testing.T) {
 		t.Fatalf("Expected working dir to be the same as before shell commands ran")
 	}
 }
+
+func TestRunScriptWithDeadlineKillsProcessGroup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Process groups aren't supported on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "shell-timeout-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Starts a child that would hold on to stdout if it wasn't killed too
+	script := filepath.Join(dir, "hook.sh")
+	if err = ioutil.WriteFile(script, []byte("#!/bin/bash\nsleep 30 &\nsleep 30\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pty := range []bool{false, true} {
+		sh, err := shell.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := &bytes.Buffer{}
+		sh.PTY = pty
+		sh.Writer = out
+		sh.Logger = &shell.WriterLogger{Writer: out, Ansi: false}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		start := time.Now()
+		err = sh.RunScript(ctx, script, nil)
+		cancel()
+
+		if _, ok := err.(*shell.TimeoutError); !ok {
+			t.Fatalf("Expected a timeout error with pty=%v, got %v", pty, err)
+		}
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Fatalf("Expected the script to be killed with pty=%v, took %v", pty, elapsed)
+		}
+	}
+}
+
+func TestRunWithCancelledContext(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Process groups aren't supported on Windows")
+	}
+
+	sh, err := shell.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sh.Logger = shell.DiscardLogger
+	sh.Writer = ioutil.Discard
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err = sh.Run(ctx, "/bin/sh", "-c", "sleep 30")
+
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("Expected the command to be cancelled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("Expected the command to be killed, took %v", elapsed)
+	}
+
+	// Commands aren't started once the context is done
+	if err = sh.Run(ctx, "/bin/sh", "-c", "true"); errors.Cause(err) != context.Canceled {
+		t.Fatalf("Expected the command not to start, got %v", err)
+	}
+}
+
+func TestRunAndTee(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Uses /bin/sh")
+	}
+
+	sh, err := shell.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	sh.Writer = out
+	sh.Logger = &shell.WriterLogger{Writer: out, Ansi: false}
+
+	output, err := sh.RunAndTee(context.Background(), "/bin/sh", "-c", "echo llamas; echo alpacas >&2; exit 3")
+	if shell.GetExitCode(err) != 3 {
+		t.Fatalf("Expected exit code 3, got %v", err)
+	}
+
+	if output.Stdout != "llamas\n" {
+		t.Fatalf("Expected stdout %q, got %q", "llamas\n", output.Stdout)
+	}
+	if output.Stderr != "alpacas\n" {
+		t.Fatalf("Expected stderr %q, got %q", "alpacas\n", output.Stderr)
+	}
+	if output.Truncated {
+		t.Fatalf("Expected the output not to be truncated")
+	}
+
+	// Both streams are still written to the shell's output
+	for _, expected := range []string{"llamas\n", "alpacas\n"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("Expected output to contain %q, got %q", expected, out.String())
+		}
+	}
+}
+
+func TestRunAndTeeKeepsTheEndOfLongOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Uses /bin/sh")
+	}
+
+	sh, err := shell.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sh.Writer = ioutil.Discard
+	sh.Logger = shell.DiscardLogger
+
+	// Writes twice as much as is kept, ending with a marker
+	script := fmt.Sprintf("head -c %d /dev/zero | tr '\\0' x; echo end", 2*shell.MaxCapturedOutput)
+
+	output, err := sh.RunAndTee(context.Background(), "/bin/sh", "-c", script)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(output.Stdout) != shell.MaxCapturedOutput {
+		t.Fatalf("Expected %d bytes of stdout, got %d", shell.MaxCapturedOutput, len(output.Stdout))
+	}
+	if !strings.HasSuffix(output.Stdout, "xxxend\n") {
+		t.Fatalf("Expected the end of stdout to be kept, got %q", output.Stdout[len(output.Stdout)-10:])
+	}
+	if !output.Truncated {
+		t.Fatalf("Expected the output to be truncated")
+	}
+}
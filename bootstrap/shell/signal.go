@@ -14,10 +14,30 @@ func signalProcess(cmd *exec.Cmd, sig os.Signal) error {
 		return errors.New("Process doesn't exist yet")
 	}
 
-	// If possible, send to the process group (linux/darwin/bsd)
+	// If possible, send to the process group (linux/darwin/bsd). Commands
+	// that share the bootstrap's process group are signalled on their own.
 	if ssig, ok := sig.(syscall.Signal); ok {
-		return syscall.Kill(-cmd.Process.Pid, ssig)
+		if err := syscall.Kill(-cmd.Process.Pid, ssig); err != syscall.ESRCH {
+			return err
+		}
 	}
 
 	return cmd.Process.Signal(sig)
 }
+
+// Starts the command in it's own process group, so it can be killed along
+// with anything it starts
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return errors.New("Process doesn't exist yet")
+	}
+
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
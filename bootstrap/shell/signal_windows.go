@@ -12,3 +12,14 @@ func signalProcess(cmd *exec.Cmd, sig os.Signal) error {
 	}
 	return cmd.Process.Signal(sig)
 }
+
+// Windows doesn't have process groups we can kill, so there's nothing to set
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return errors.New("Process doesn't exist yet")
+	}
+
+	return cmd.Process.Kill()
+}
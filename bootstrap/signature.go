@@ -0,0 +1,41 @@
+package bootstrap
+
+import (
+	"strings"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/pkg/errors"
+)
+
+// Checks the job's step was signed with the agent's verification key, if it
+// has one. What's checked is the job's environment from the agent, before any
+// hooks have changed it.
+func (b *Bootstrap) verifyStepSignature() error {
+	if b.PipelineVerificationKey == "" {
+		return nil
+	}
+
+	key, err := agent.LoadVerificationKey(b.PipelineVerificationKey)
+	if err != nil {
+		return &SignatureError{Err: errors.Wrap(err, "Failed to load the pipeline verification key")}
+	}
+
+	// Without the names of the job's variables there's no telling which of
+	// them weren't signed
+	names, ok := b.shell.Env.Get(agent.JobEnvNamesEnv)
+	if !ok {
+		return &SignatureError{Err: errors.Errorf("The job's step can't be verified without %s from the agent", agent.JobEnvNamesEnv)}
+	}
+
+	var jobEnvNames []string
+	if names != "" {
+		jobEnvNames = strings.Split(names, ",")
+	}
+
+	if err := agent.VerifyStepSignature(key, b.Repository, b.Command, b.Plugins, jobEnvNames, b.shell.Env.Get); err != nil {
+		return &SignatureError{Err: err}
+	}
+
+	b.shell.Commentf("The job's step signature was verified")
+	return nil
+}
@@ -1,6 +1,7 @@
 package bootstrap
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -10,18 +11,18 @@ import (
 	"github.com/buildkite/agent/bootstrap/shell"
 )
 
-func sshKeyScan(sh *shell.Shell, host string) (string, error) {
-	toolsDir, err := findPathToSSHTools(sh)
+func sshKeyScan(ctx context.Context, sh *shell.Shell, host string) (string, error) {
+	toolsDir, err := findPathToSSHTools(ctx, sh)
 	if err != nil {
 		return "", err
 	}
 
 	parts := strings.Split(host, ":")
 	if len(parts) == 2 {
-		return sh.RunAndCapture(filepath.Join(toolsDir, "ssh-keyscan"), "-p", parts[1], parts[0])
+		return sh.RunAndCapture(ctx, filepath.Join(toolsDir, "ssh-keyscan"), "-p", parts[1], parts[0])
 	}
 
-	out, err := sh.RunAndCapture(filepath.Join(toolsDir, "ssh-keyscan"), host)
+	out, err := sh.RunAndCapture(ctx, filepath.Join(toolsDir, "ssh-keyscan"), host)
 	if err != nil {
 		return out, err
 	}
@@ -38,9 +39,9 @@ func sshKeyScan(sh *shell.Shell, host string) (string, error) {
 // git for windows which is generally MinGW. Often this isn't in the path, so we go looking for it specifically.
 //
 // Some more details on the relative paths at https://stackoverflow.com/a/11771907
-func findPathToSSHTools(sh *shell.Shell) (string, error) {
+func findPathToSSHTools(ctx context.Context, sh *shell.Shell) (string, error) {
 	if runtime.GOOS == "windows" {
-		execPath, _ := sh.RunAndCapture("git", "--exec-path")
+		execPath, _ := sh.RunAndCapture(ctx, "git", "--exec-path")
 		if len(execPath) > 0 {
 			for _, path := range []string{
 				filepath.Join(execPath, "..", "..", "..", "usr", "bin", "ssh-keygen.exe"),
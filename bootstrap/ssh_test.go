@@ -1,6 +1,7 @@
 package bootstrap
 
 import (
+	"context"
 	"testing"
 
 	"github.com/buildkite/agent/bootstrap/shell"
@@ -17,7 +18,7 @@ func TestFindingSSHTools(t *testing.T) {
 	sh.Debug = true
 	sh.Logger = shell.TestingLogger{t}
 
-	d, err := findPathToSSHTools(sh)
+	d, err := findPathToSSHTools(context.Background(), sh)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,204 @@
+package bootstrap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/bootstrap/shell"
+)
+
+// The tool managers that can install the tools pinned in the checkout
+const (
+	toolManagerNone = "none"
+	toolManagerAsdf = "asdf"
+	toolManagerMise = "mise"
+)
+
+// How long a job waits for another to finish installing tools into the cache
+var toolchainLockTimeout = 15 * time.Minute
+
+// The files each tool manager reads the pinned versions from. mise reads
+// asdf's too, so the checkout doesn't have to choose.
+var toolManagerFiles = map[string][]string{
+	toolManagerAsdf: {".tool-versions"},
+	toolManagerMise: {"mise.toml", ".mise.toml", ".tool-versions"},
+}
+
+// ToolchainPhase installs the versions of tools pinned in the checkout with
+// the agent's tool manager, then puts them on the PATH for the hooks and
+// command that follow. Tools are installed into a cache that's shared by
+// all of the agent's jobs, so each version is only installed once.
+func (b *Bootstrap) ToolchainPhase(ctx context.Context) error {
+	manager, err := b.toolManager()
+	if err != nil || manager == toolManagerNone {
+		return err
+	}
+
+	dir := b.shell.Getwd()
+
+	var pinned []string
+	for _, f := range toolManagerFiles[manager] {
+		if fileExists(filepath.Join(dir, f)) {
+			pinned = append(pinned, f)
+		}
+	}
+	if len(pinned) == 0 {
+		if b.Debug {
+			b.shell.Commentf("Not installing any tools, as the checkout doesn't pin any versions")
+		}
+		return nil
+	}
+
+	b.shell.Headerf("Installing the tools pinned in %s with %s", strings.Join(pinned, " and "), manager)
+
+	cachePath := b.toolchainCachePath()
+	if err := os.MkdirAll(cachePath, 0777); err != nil {
+		return err
+	}
+
+	// Jobs on the same machine share the cache, so only one installs into
+	// it at a time
+	lock, err := shell.LockFileWithTimeout(b.shell, filepath.Join(cachePath, manager+".lock"), toolchainLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	switch manager {
+	case toolManagerAsdf:
+		return b.installWithAsdf(ctx, filepath.Join(cachePath, toolManagerAsdf), dir)
+	default:
+		return b.installWithMise(ctx, filepath.Join(cachePath, toolManagerMise), dir)
+	}
+}
+
+// Returns the tool manager the tools are installed with
+func (b *Bootstrap) toolManager() (string, error) {
+	switch manager := strings.ToLower(b.Toolchain); manager {
+	case "", toolManagerNone, "false":
+		return toolManagerNone, nil
+	case toolManagerAsdf, toolManagerMise:
+		return manager, nil
+	default:
+		return "", fmt.Errorf("Unknown tool manager \"%s\", expected asdf, mise or none", b.Toolchain)
+	}
+}
+
+// Returns where tools are installed, which is in the build path unless the
+// agent keeps them somewhere else
+func (b *Bootstrap) toolchainCachePath() string {
+	if b.ToolchainCachePath != "" {
+		return b.ToolchainCachePath
+	}
+	return filepath.Join(b.BuildPath, ".toolchains")
+}
+
+// Adds the plugin for each of the tools and installs them, then puts asdf's
+// shims on the PATH, which run the version pinned in the directory they're
+// run in
+func (b *Bootstrap) installWithAsdf(ctx context.Context, dataDir string, dir string) error {
+	b.setToolchainEnv(map[string]string{"ASDF_DATA_DIR": dataDir})
+
+	tools, err := readToolVersions(filepath.Join(dir, ".tool-versions"))
+	if err != nil {
+		return err
+	}
+
+	installed, _ := b.shell.RunAndCapture(ctx, "asdf", "plugin", "list")
+	for _, tool := range tools {
+		if !containsLine(installed, tool) {
+			if err := b.shell.Run(ctx, "asdf", "plugin", "add", tool); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := b.shell.Run(ctx, "asdf", "install"); err != nil {
+		return err
+	}
+
+	path, _ := b.shell.Env.Get("PATH")
+	b.setToolchainEnv(map[string]string{
+		"PATH": filepath.Join(dataDir, "shims") + string(os.PathListSeparator) + path,
+	})
+	return nil
+}
+
+// Installs the tools, then adds the environment mise would activate in the
+// directory, which has the installed versions on the PATH
+func (b *Bootstrap) installWithMise(ctx context.Context, dataDir string, dir string) error {
+	b.setToolchainEnv(map[string]string{
+		"MISE_DATA_DIR":  dataDir,
+		"MISE_CACHE_DIR": filepath.Join(dataDir, "cache"),
+		"MISE_YES":       "1",
+
+		// mise won't read the checkout's config until it's trusted, which
+		// it is by running the job
+		"MISE_TRUSTED_CONFIG_PATHS": dir,
+	})
+
+	if err := b.shell.Run(ctx, "mise", "install"); err != nil {
+		return err
+	}
+
+	output, err := b.shell.RunAndCapture(ctx, "mise", "env", "--json")
+	if err != nil {
+		return fmt.Errorf("Failed to read the environment from mise: %v", err)
+	}
+
+	vars := map[string]string{}
+	if err := json.Unmarshal([]byte(output), &vars); err != nil {
+		return fmt.Errorf("Failed to read the environment from mise: %v", err)
+	}
+
+	b.setToolchainEnv(vars)
+	return nil
+}
+
+// Sets the variables in the job's environment like a hook would
+func (b *Bootstrap) setToolchainEnv(vars map[string]string) {
+	updated := b.shell.Env.Copy()
+	for k, v := range vars {
+		updated.Set(k, v)
+	}
+	b.applyEnvironmentChanges(updated.Diff(b.shell.Env), "")
+}
+
+// Returns the names of the tools pinned in a .tool-versions file
+func readToolVersions(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tools []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if fields := strings.Fields(line); len(fields) > 1 {
+			tools = append(tools, fields[0])
+		}
+	}
+
+	return tools, scanner.Err()
+}
+
+// Returns whether one of the lines of the output is the value
+func containsLine(output string, value string) bool {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package bootstrap
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestReadingToolVersions(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "tool-versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ".tool-versions")
+	contents := "# The versions CI uses\ngolang 1.9.4\nnodejs 8.9.4 system # falls back\n\npython\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tools, err := readToolVersions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tools, []string{"golang", "nodejs"}) {
+		t.Fatalf("Unexpected tools %v", tools)
+	}
+}
+
+func TestUnknownToolManagerIsAnError(t *testing.T) {
+	t.Parallel()
+
+	b := &Bootstrap{Config: Config{Toolchain: "rbenv"}, shell: newTestShell(t)}
+
+	if _, err := b.toolManager(); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
+
+func TestToolchainPhaseAddsTheEnvironmentFromMise(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("Not tested on windows yet")
+	}
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "toolchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	checkout := filepath.Join(dir, "checkout")
+	bin := filepath.Join(dir, "bin")
+	for _, d := range []string{checkout, bin} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(checkout, "mise.toml"), []byte("[tools]\ngo = \"1.9\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Records what it's asked to do, and prints an environment like mise
+	mise := strings.Join([]string{
+		"#!/bin/bash",
+		"echo \"$@ $MISE_DATA_DIR\" >> " + filepath.Join(dir, "mise.log"),
+		"if [[ $1 == env ]]; then echo '{\"PATH\":\"/tools/go/bin:/usr/bin\",\"GOROOT\":\"/tools/go\"}'; fi",
+	}, "\n")
+	if err := ioutil.WriteFile(filepath.Join(bin, "mise"), []byte(mise), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := newTestShell(t)
+	sh.Env.Set("PATH", bin+":/usr/bin:/bin")
+	if err := sh.Chdir(checkout); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Bootstrap{Config: Config{Toolchain: "mise", BuildPath: dir}, shell: sh}
+
+	if err := b.ToolchainPhase(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := ioutil.ReadFile(filepath.Join(dir, "mise.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := filepath.Join(dir, ".toolchains", "mise")
+	if expected := "install " + data + "\nenv --json " + data + "\n"; string(log) != expected {
+		t.Fatalf("Expected mise to be run with %q, got %q", expected, log)
+	}
+
+	if path, _ := sh.Env.Get("PATH"); path != "/tools/go/bin:/usr/bin" {
+		t.Fatalf("Unexpected PATH %q", path)
+	}
+	if goroot, _ := sh.Env.Get("GOROOT"); goroot != "/tools/go" {
+		t.Fatalf("Unexpected GOROOT %q", goroot)
+	}
+}
+
+func TestToolchainPhaseDoesNothingWithoutPinnedVersions(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "toolchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sh := newTestShell(t)
+	if err := sh.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// mise.toml isn't read by asdf
+	if err := ioutil.WriteFile(filepath.Join(dir, "mise.toml"), []byte(""), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Bootstrap{Config: Config{Toolchain: "asdf", BuildPath: dir}, shell: sh}
+
+	if err := b.ToolchainPhase(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(filepath.Join(dir, ".toolchains")) {
+		t.Fatal("Expected the cache not to be created")
+	}
+}
@@ -0,0 +1,160 @@
+// Package cgroup limits the CPU and memory that a job's processes can use, by
+// running them in a cgroup (v2) of their own.
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The cgroup the job's cgroups are created in, if one isn't configured. The
+// agent needs to be able to write to it, and it's parent needs to have the
+// cpu and memory controllers enabled.
+const DefaultParent = "/sys/fs/cgroup/buildkite-agent"
+
+// The period the CPU limit is enforced over, in microseconds
+const cpuPeriod = 100000
+
+// ErrUnsupported is returned when cgroups aren't supported on this platform
+var ErrUnsupported = errors.New("Resource limits are only supported on linux")
+
+// Cgroup is the cgroup a job's processes are run in
+type Cgroup struct {
+	// The cgroup's directory in the cgroup filesystem
+	Path string
+
+	// The limits for the job
+	Limits Limits
+}
+
+// Limits are the resources a job can use. A zero limit means that resource
+// isn't limited.
+type Limits struct {
+	// How many CPUs the job can use, which can be fractional
+	CPUs float64
+
+	// How much memory the job can use, in bytes
+	Memory int64
+}
+
+// ParseLimits parses the limits from the number of CPUs, like "1.5", and an
+// amount of memory, like "512m" or "2g". Either can be blank.
+func ParseLimits(cpus, memory string) (Limits, error) {
+	var limits Limits
+
+	if cpus != "" {
+		v, err := strconv.ParseFloat(cpus, 64)
+		if err != nil || v <= 0 {
+			return limits, fmt.Errorf("Invalid CPU limit %q, expected a number of CPUs like 1.5", cpus)
+		}
+		limits.CPUs = v
+	}
+
+	if memory != "" {
+		v, err := parseMemory(memory)
+		if err != nil {
+			return limits, err
+		}
+		limits.Memory = v
+	}
+
+	return limits, nil
+}
+
+// IsZero returns whether there aren't any limits
+func (l Limits) IsZero() bool {
+	return l.CPUs == 0 && l.Memory == 0
+}
+
+// Within returns the limits with each one capped at the maximum's, so the
+// limits can be lowered but not raised
+func (l Limits) Within(max Limits) Limits {
+	if max.CPUs > 0 && (l.CPUs == 0 || l.CPUs > max.CPUs) {
+		l.CPUs = max.CPUs
+	}
+	if max.Memory > 0 && (l.Memory == 0 || l.Memory > max.Memory) {
+		l.Memory = max.Memory
+	}
+	return l
+}
+
+func (l Limits) String() string {
+	var parts []string
+	if l.CPUs > 0 {
+		parts = append(parts, fmt.Sprintf("%s CPUs", strconv.FormatFloat(l.CPUs, 'f', -1, 64)))
+	}
+	if l.Memory > 0 {
+		parts = append(parts, fmt.Sprintf("%s of memory", FormatMemory(l.Memory)))
+	}
+	if len(parts) == 0 {
+		return "no limits"
+	}
+	return strings.Join(parts, " and ")
+}
+
+// The cgroup's cpu.max, which is the quota of CPU time the job gets in each
+// period
+func (l Limits) cpuMax() string {
+	if l.CPUs == 0 {
+		return "max"
+	}
+	return fmt.Sprintf("%d %d", int64(l.CPUs*cpuPeriod), cpuPeriod)
+}
+
+// The cgroup's memory.max, which is the most memory the job can use before
+// it's processes are OOM killed
+func (l Limits) memoryMax() string {
+	if l.Memory == 0 {
+		return "max"
+	}
+	return strconv.FormatInt(l.Memory, 10)
+}
+
+var memoryUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"k", 1 << 10},
+	{"m", 1 << 20},
+	{"g", 1 << 30},
+	{"t", 1 << 40},
+}
+
+// Parses an amount of memory in bytes, or with a k, m, g or t suffix like
+// docker's --memory
+func parseMemory(memory string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(memory))
+	s = strings.TrimSuffix(s, "b")
+
+	multiplier := int64(1)
+	for _, unit := range memoryUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSuffix(s, unit.suffix)
+			multiplier = unit.bytes
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("Invalid memory limit %q, expected an amount like 512m or 2g", memory)
+	}
+
+	return int64(v * float64(multiplier)), nil
+}
+
+// FormatMemory formats an amount of memory in the largest unit it fits in,
+// like 1.5GiB
+func FormatMemory(bytes int64) string {
+	for i := len(memoryUnits) - 1; i >= 0; i-- {
+		unit := memoryUnits[i]
+		if bytes >= unit.bytes {
+			v := math.Floor(float64(bytes)/float64(unit.bytes)*10+0.5) / 10
+			return strconv.FormatFloat(v, 'f', -1, 64) + strings.ToUpper(unit.suffix) + "iB"
+		}
+	}
+	return fmt.Sprintf("%d bytes", bytes)
+}
@@ -0,0 +1,167 @@
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// New creates a cgroup called name in the parent with the limits. The parent
+// is created if it doesn't exist, and has the controllers for the limits
+// enabled for it's children.
+func New(parent, name string, limits Limits) (*Cgroup, error) {
+	if parent == "" {
+		parent = DefaultParent
+	}
+
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create cgroup %s: %v", parent, err)
+	}
+
+	var controllers []string
+	if limits.CPUs > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if limits.Memory > 0 {
+		controllers = append(controllers, "memory")
+	}
+
+	if err := enableControllers(parent, controllers); err != nil {
+		return nil, err
+	}
+
+	c := &Cgroup{Path: filepath.Join(parent, name), Limits: limits}
+
+	if err := os.Mkdir(c.Path, 0755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("Failed to create cgroup %s: %v", c.Path, err)
+	}
+
+	if limits.CPUs > 0 {
+		if err := c.write("cpu.max", limits.cpuMax()); err != nil {
+			return nil, err
+		}
+	}
+
+	if limits.Memory > 0 {
+		if err := c.write("memory.max", limits.memoryMax()); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Enables the controllers in the parent's children, unless they already are
+func enableControllers(parent string, controllers []string) error {
+	path := filepath.Join(parent, "cgroup.subtree_control")
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s, is %s a cgroup v2 cgroup? (%v)", path, parent, err)
+	}
+
+	enabled := map[string]bool{}
+	for _, controller := range strings.Fields(string(data)) {
+		enabled[controller] = true
+	}
+
+	for _, controller := range controllers {
+		if enabled[controller] {
+			continue
+		}
+
+		if err := ioutil.WriteFile(path, []byte("+"+controller), 0644); err != nil {
+			return fmt.Errorf("Failed to enable the %s controller in %s, it needs to be enabled in the parent cgroup's cgroup.subtree_control (%v)", controller, parent, err)
+		}
+	}
+
+	return nil
+}
+
+// Add moves the process into the cgroup. Processes it starts from then on are
+// in the cgroup too.
+func (c *Cgroup) Add(pid int) error {
+	return c.write("cgroup.procs", strconv.Itoa(pid))
+}
+
+// OOMKills returns how many of the cgroup's processes have been killed for
+// using more than the memory limit
+func (c *Cgroup) OOMKills() (int, error) {
+	file, err := os.Open(filepath.Join(c.Path, "memory.events"))
+	if os.IsNotExist(err) {
+		// The memory controller isn't enabled
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.Atoi(fields[1])
+		}
+	}
+
+	return 0, scanner.Err()
+}
+
+// Remove kills anything left running in the cgroup, and removes it
+func (c *Cgroup) Remove() error {
+	// cgroup.kill is only in linux 5.14 and later, otherwise each of the
+	// processes is killed
+	if err := c.write("cgroup.kill", "1"); err != nil {
+		if pids, err := c.pids(); err == nil {
+			for _, pid := range pids {
+				_ = syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+	}
+
+	// The cgroup can't be removed until the killed processes have exited
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = syscall.Rmdir(c.Path); err != syscall.EBUSY {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to remove cgroup %s: %v", c.Path, err)
+	}
+
+	return nil
+}
+
+// The processes in the cgroup
+func (c *Cgroup) pids() ([]int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.Path, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, field := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids, nil
+}
+
+func (c *Cgroup) write(file, value string) error {
+	path := filepath.Join(c.Path, file)
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("Failed to write %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readCgroupFile(t *testing.T, path ...string) string {
+	data, err := ioutil.ReadFile(filepath.Join(path...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCreatingCgroups(t *testing.T) {
+	parent, err := ioutil.TempDir("", "cgroup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+
+	// The cpu controller is already enabled, so only memory is
+	if err := ioutil.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("cpu io\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := New(parent, "job-llamas", Limits{CPUs: 0.5, Memory: 1 << 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, filepath.Join(parent, "job-llamas"), c.Path)
+	assert.Equal(t, "+memory", readCgroupFile(t, parent, "cgroup.subtree_control"))
+	assert.Equal(t, "50000 100000", readCgroupFile(t, c.Path, "cpu.max"))
+	assert.Equal(t, "1073741824", readCgroupFile(t, c.Path, "memory.max"))
+
+	assert.NoError(t, c.Add(1234))
+	assert.Equal(t, "1234", readCgroupFile(t, c.Path, "cgroup.procs"))
+
+	kills, err := c.OOMKills()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, kills)
+
+	events := "low 0\nhigh 0\nmax 12\noom 2\noom_kill 1\n"
+	if err := ioutil.WriteFile(filepath.Join(c.Path, "memory.events"), []byte(events), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	kills, err = c.OOMKills()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, kills)
+}
+
+func TestCreatingCgroupsOutsideOfCgroupV2(t *testing.T) {
+	parent, err := ioutil.TempDir("", "cgroup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+
+	_, err = New(parent, "job-llamas", Limits{CPUs: 1})
+	assert.Error(t, err)
+}
@@ -0,0 +1,20 @@
+// +build !linux
+
+package cgroup
+
+// New isn't supported on this platform, and always returns ErrUnsupported
+func New(parent, name string, limits Limits) (*Cgroup, error) {
+	return nil, ErrUnsupported
+}
+
+func (c *Cgroup) Add(pid int) error {
+	return ErrUnsupported
+}
+
+func (c *Cgroup) OOMKills() (int, error) {
+	return 0, ErrUnsupported
+}
+
+func (c *Cgroup) Remove() error {
+	return ErrUnsupported
+}
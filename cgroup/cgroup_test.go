@@ -0,0 +1,48 @@
+package cgroup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsingLimits(t *testing.T) {
+	limits, err := ParseLimits("1.5", "512m")
+	assert.NoError(t, err)
+	assert.Equal(t, Limits{CPUs: 1.5, Memory: 512 << 20}, limits)
+	assert.Equal(t, "150000 100000", limits.cpuMax())
+	assert.Equal(t, "536870912", limits.memoryMax())
+	assert.Equal(t, "1.5 CPUs and 512MiB of memory", limits.String())
+
+	for memory, expected := range map[string]int64{
+		"1024": 1024,
+		"2g":   2 << 30,
+		"2GB":  2 << 30,
+		"1.5G": 3 << 29,
+		"64k":  64 << 10,
+	} {
+		limits, err := ParseLimits("", memory)
+		assert.NoError(t, err, memory)
+		assert.Equal(t, expected, limits.Memory, memory)
+	}
+
+	limits, err = ParseLimits("", "")
+	assert.NoError(t, err)
+	assert.True(t, limits.IsZero())
+	assert.Equal(t, "max", limits.cpuMax())
+	assert.Equal(t, "max", limits.memoryMax())
+
+	for _, invalid := range [][]string{{"llamas", ""}, {"0", ""}, {"", "lots"}, {"", "-1g"}} {
+		_, err := ParseLimits(invalid[0], invalid[1])
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestLimitsCanOnlyBeLoweredWithinTheMaximum(t *testing.T) {
+	max := Limits{CPUs: 2, Memory: 4 << 30}
+
+	assert.Equal(t, max, Limits{}.Within(max))
+	assert.Equal(t, max, Limits{CPUs: 8, Memory: 8 << 30}.Within(max))
+	assert.Equal(t, Limits{CPUs: 1, Memory: 4 << 30}, Limits{CPUs: 1}.Within(max))
+	assert.Equal(t, Limits{CPUs: 8}, Limits{CPUs: 8}.Within(Limits{}))
+}
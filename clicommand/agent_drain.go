@@ -0,0 +1,60 @@
+package clicommand
+
+import (
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/urfave/cli"
+)
+
+var AgentDrainHelpDescription = `Usage:
+
+   buildkite-agent drain [arguments...]
+
+Description:
+
+   Stops the agent running on this machine from accepting any more jobs. Jobs
+   it's already running are finished, and it stays connected until it's
+   stopped, so it can be stopped once it's idle without cancelling anything.
+
+Example:
+
+   $ buildkite-agent drain
+   $ buildkite-agent status
+   $ buildkite-agent stop`
+
+type AgentDrainConfig struct {
+	ControlSocket string `cli:"control-socket" normalize:"filepath"`
+	NoColor       bool   `cli:"no-color"`
+	Debug         bool   `cli:"debug"`
+}
+
+var AgentDrainCommand = cli.Command{
+	Name:        "drain",
+	Usage:       "Stop the running agent accepting new jobs",
+	Description: AgentDrainHelpDescription,
+	Flags: []cli.Flag{
+		ControlSocketFlag,
+		NoColorFlag,
+		DebugFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := AgentDrainConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		status, err := agent.ControlClient{Path: cfg.ControlSocket}.Send(agent.ControlRequest{Command: agent.ControlDrain})
+		if err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		printAgentStatus(status)
+	},
+}
@@ -1,14 +1,22 @@
 package clicommand
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/cgroup"
 	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/kubernetes"
 	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/process"
+	"github.com/buildkite/agent/proxy"
+	"github.com/buildkite/agent/secrets"
 	"github.com/urfave/cli"
 )
 
@@ -25,6 +33,10 @@ Description:
 
    The agent will run any jobs within a PTY (pseudo terminal) if available.
 
+   Sending the agent a SIGHUP reloads its tags, spawn, worker pools, hooks and
+   plugins paths, and debug setting from its config file, without stopping
+   any jobs that are running.
+
 Example:
 
    $ buildkite-agent start --token xxx`
@@ -36,9 +48,15 @@ type AgentStartConfig struct {
 	Priority                     string   `cli:"priority"`
 	DisconnectAfterJob           bool     `cli:"disconnect-after-job"`
 	DisconnectAfterJobTimeout    int      `cli:"disconnect-after-job-timeout"`
+	DisconnectAfterIdleTimeout   int      `cli:"disconnect-after-idle-timeout"`
+	LongPoll                     bool     `cli:"long-poll"`
+	AdaptiveIntervals            bool     `cli:"adaptive-intervals"`
+	AcquireJob                   string   `cli:"acquire-job"`
+	Spawn                        int      `cli:"spawn"`
 	BootstrapScript              string   `cli:"bootstrap-script" normalize:"filepath" validate:"required"`
 	BuildPath                    string   `cli:"build-path" normalize:"filepath" validate:"required"`
 	HooksPath                    string   `cli:"hooks-path" normalize:"filepath"`
+	HooksOverlays                []string `cli:"hooks-overlays"`
 	PluginsPath                  string   `cli:"plugins-path" normalize:"filepath"`
 	Tags                         []string `cli:"tags"`
 	TagsFromEC2                  bool     `cli:"tags-from-ec2"`
@@ -47,16 +65,119 @@ type AgentStartConfig struct {
 	WaitForEC2TagsTimeout        string   `cli:"wait-for-ec2-tags-timeout"`
 	GitCloneFlags                string   `cli:"git-clone-flags"`
 	GitCleanFlags                string   `cli:"git-clean-flags"`
+	GitCloneDepth                int      `cli:"git-clone-depth"`
+	GitFetchDepth                int      `cli:"git-fetch-depth"`
+	GitSparseCheckoutPaths       []string `cli:"git-sparse-checkout-paths"`
+	GitSubmoduleRecursionDepth   int      `cli:"git-submodule-recursion-depth"`
+	GitSubmoduleURLRewrites      []string `cli:"git-submodule-url-rewrites"`
+	GitCredentialsFile           string   `cli:"git-credentials-file" normalize:"filepath"`
+	GitMirrorsPath               string   `cli:"git-mirrors-path" normalize:"filepath"`
+	GitMirrorsLockTimeout        int      `cli:"git-mirrors-lock-timeout"`
+	GitMirrorsStaleAfter         int      `cli:"git-mirrors-stale-after"`
+	GitRetries                   int      `cli:"git-retries"`
+	GitRetryReclone              bool     `cli:"git-retry-reclone"`
 	NoColor                      bool     `cli:"no-color"`
 	NoSSHFingerprintVerification bool     `cli:"no-automatic-ssh-fingerprint-verification"`
+	SSHKnownHosts                []string `cli:"ssh-known-hosts"`
+	SSHHostKeyVerification       string   `cli:"ssh-host-key-verification"`
+	GitCredentialsProvider       string   `cli:"git-credentials-provider"`
+	GitHubAppID                  string   `cli:"github-app-id"`
+	GitHubAppPrivateKeyPath      string   `cli:"github-app-private-key-path" normalize:"filepath"`
+	GitHubAppInstallationID      int      `cli:"github-app-installation-id"`
+	GitHubAppHost                string   `cli:"github-app-host"`
+	JobAPIToken                  bool     `cli:"job-api-token"`
+	JobAPITokenScopes            []string `cli:"job-api-token-scopes"`
 	NoCommandEval                bool     `cli:"no-command-eval"`
+	Shell                        string   `cli:"shell"`
 	NoPlugins                    bool     `cli:"no-plugins"`
+	StrictPluginVerification     bool     `cli:"strict-plugin-verification"`
+	PipelineVerificationKey      string   `cli:"pipeline-verification-key" normalize:"filepath"`
+	AllowedPlugins               []string `cli:"allowed-plugins"`
+	DeniedPlugins                []string `cli:"denied-plugins"`
+	DeniedPluginPhases           []string `cli:"denied-plugin-phases"`
+	HookTimeout                  int      `cli:"hook-timeout"`
+	CancelGracePeriod            int      `cli:"cancel-grace-period"`
+	CgroupParent                 string   `cli:"cgroup-parent" normalize:"filepath"`
+	JobCPULimit                  string   `cli:"job-cpu-limit"`
+	JobMemoryLimit               string   `cli:"job-memory-limit"`
+	JobSandbox                   string   `cli:"job-sandbox"`
+	JobSandboxWritablePaths      []string `cli:"job-sandbox-writable-paths"`
+	JobSandboxPullRequestsOnly   bool     `cli:"job-sandbox-pull-requests-only"`
+	JobExecutor                  string   `cli:"job-executor"`
+	KubernetesImage              string   `cli:"kubernetes-image"`
+	KubernetesNamespace          string   `cli:"kubernetes-namespace"`
+	KubernetesCPU                string   `cli:"kubernetes-cpu"`
+	KubernetesMemory             string   `cli:"kubernetes-memory"`
+	KubernetesNodeSelector       []string `cli:"kubernetes-node-selector"`
+	Proxy                        string   `cli:"proxy"`
+	ProxyAuth                    string   `cli:"proxy-auth"`
+	ProxyUsername                string   `cli:"proxy-username"`
+	ProxyPassword                string   `cli:"proxy-password"`
+	ProxyAuthForJobs             bool     `cli:"proxy-auth-for-jobs"`
+	NoProxy                      []string `cli:"no-proxy"`
+	TLSClientCert                string   `cli:"tls-client-cert" normalize:"filepath"`
+	TLSClientKey                 string   `cli:"tls-client-key" normalize:"filepath"`
+	TLSCA                        string   `cli:"tls-ca" normalize:"filepath"`
+	S3ACL                        string   `cli:"s3-acl"`
+	S3SSE                        string   `cli:"s3-sse"`
+	S3SSEKMSKeyID                string   `cli:"s3-sse-kms-key-id"`
+	S3Endpoint                   string   `cli:"s3-endpoint"`
+	S3ForcePathStyle             bool     `cli:"s3-force-path-style"`
+	VaultAddr                    string   `cli:"vault-addr"`
+	VaultNamespace               string   `cli:"vault-namespace"`
+	VaultAuthMethod              string   `cli:"vault-auth-method"`
+	VaultAuthMount               string   `cli:"vault-auth-mount"`
+	VaultRoleID                  string   `cli:"vault-role-id"`
+	VaultSecretID                string   `cli:"vault-secret-id"`
+	VaultKubernetesRole          string   `cli:"vault-kubernetes-role"`
+	VaultKubernetesTokenPath     string   `cli:"vault-kubernetes-token-path" normalize:"filepath"`
+	SecretsFromAWS               bool     `cli:"secrets-from-aws"`
+	RedactedVars                 []string `cli:"redacted-vars"`
+	ProtectedEnv                 []string `cli:"protected-env"`
+	ProtectedEnvFatal            bool     `cli:"protected-env-fatal"`
+	PreflightMinDiskSpace        int      `cli:"preflight-min-disk-space"`
+	PreflightRequiredBinaries    []string `cli:"preflight-required-binaries"`
+	PreflightDocker              bool     `cli:"preflight-docker"`
+	JanitorKeepBuilds            string   `cli:"janitor-keep-builds"`
+	JanitorMinFreeSpace          int      `cli:"janitor-min-free-space"`
+	JanitorInterval              string   `cli:"janitor-interval"`
+	DockerGCTTL                  string   `cli:"docker-gc-ttl"`
+	DockerGCMinFreeSpace         int      `cli:"docker-gc-min-free-space"`
+	DockerGCInterval             string   `cli:"docker-gc-interval"`
+	EphemeralWorkspace           string   `cli:"ephemeral-workspace"`
+	EphemeralWorkspacePath       string   `cli:"ephemeral-workspace-path" normalize:"filepath"`
+	EphemeralWorkspaceSize       int      `cli:"ephemeral-workspace-size"`
+	JobUser                      string   `cli:"job-user"`
+	JobUserCommandOnly           bool     `cli:"job-user-command-only"`
+	DevEnvironment               string   `cli:"dev-environment"`
+	Toolchain                    string   `cli:"toolchain"`
+	ToolchainCachePath           string   `cli:"toolchain-cache-path" normalize:"filepath"`
+	DockerLogins                 []string `cli:"docker-login"`
+	SSHKeys                      []string `cli:"ssh-keys"`
+	AgentStartupHookFatal        bool     `cli:"agent-startup-hook-fatal"`
 	NoPTY                        bool     `cli:"no-pty"`
 	TimestampLines               bool     `cli:"timestamp-lines"`
+	TimestampLinesFormat         string   `cli:"timestamp-lines-format"`
+	ANSIOutput                   string   `cli:"ansi-output"`
+	LogChunkSize                 int      `cli:"log-chunk-size"`
+	LogFlushInterval             int      `cli:"log-flush-interval"`
+	MaxLogSize                   int      `cli:"max-log-size"`
+	MetricsAddr                  string   `cli:"metrics-addr"`
+	MetricsDatadogHost           string   `cli:"metrics-datadog-host"`
+	MetricsCloudWatchNamespace   string   `cli:"metrics-cloudwatch-namespace"`
+	EventTargets                 []string `cli:"event-targets"`
+	HealthCheckAddr              string   `cli:"health-check-addr"`
+	ControlSocket                string   `cli:"control-socket" normalize:"filepath"`
+	APIRetryBudget               int      `cli:"api-retry-budget"`
+	APICircuitBreakerThreshold   int      `cli:"api-circuit-breaker-threshold"`
+	APICircuitBreakerCooldown    int      `cli:"api-circuit-breaker-cooldown"`
 	Endpoint                     string   `cli:"endpoint" validate:"required"`
 	Debug                        bool     `cli:"debug"`
 	DebugHTTP                    bool     `cli:"debug-http"`
 	Experiments                  []string `cli:"experiment"`
+	AllowedJobExperiments        []string `cli:"allowed-job-experiments"`
+	LogFormat                    string   `cli:"log-format"`
+	LogSinks                     []string `cli:"log-sink"`
 	/* Deprecated */
 	MetaData        []string `cli:"meta-data" deprecated-and-renamed-to:"Tags"`
 	MetaDataEC2     bool     `cli:"meta-data-ec2" deprecated-and-renamed-to:"TagsFromEC2"`
@@ -129,6 +250,34 @@ var AgentStartCommand = cli.Command{
 			Usage:  "When --disconnect-after-job is specified, the number of seconds to wait for a job before shutting down",
 			EnvVar: "BUILDKITE_AGENT_DISCONNECT_AFTER_JOB_TIMEOUT",
 		},
+		cli.IntFlag{
+			Name:   "disconnect-after-idle-timeout",
+			Value:  0,
+			Usage:  "The number of seconds to wait for a job before shutting down, counting from when the agent started or last finished a job. 0 means the agent never disconnects for being idle",
+			EnvVar: "BUILDKITE_AGENT_DISCONNECT_AFTER_IDLE_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "long-poll",
+			Usage:  "Hold pings open until a job is assigned, so jobs start as soon as they're assigned rather than at the next ping. The agent goes back to pinging every ping interval if a long poll fails, or the API doesn't support them",
+			EnvVar: "BUILDKITE_AGENT_LONG_POLL",
+		},
+		cli.BoolFlag{
+			Name:   "adaptive-intervals",
+			Usage:  "Back off pinging and heartbeating while the agent is idle, up to 4 times as long between them, going back as soon as it's given a job or there are jobs queued for it",
+			EnvVar: "BUILDKITE_AGENT_ADAPTIVE_INTERVALS",
+		},
+		cli.IntFlag{
+			Name:   "spawn",
+			Value:  1,
+			Usage:  "The number of agents to run in this process, each of which runs one job at a time. Config file [pool.<name>] sections can run agents with different tags instead",
+			EnvVar: "BUILDKITE_AGENT_SPAWN",
+		},
+		cli.StringFlag{
+			Name:   "acquire-job",
+			Value:  "",
+			Usage:  "Run the job with this ID and then disconnect, exiting with the job's exit status. Used by schedulers that start an agent for each job",
+			EnvVar: "BUILDKITE_AGENT_ACQUIRE_JOB",
+		},
 		cli.StringSliceFlag{
 			Name:   "tags",
 			Value:  &cli.StringSlice{},
@@ -137,7 +286,7 @@ var AgentStartCommand = cli.Command{
 		},
 		cli.BoolFlag{
 			Name:   "tags-from-ec2",
-			Usage:  "Include the host's EC2 meta-data as tags (instance-id, instance-type, and ami-id)",
+			Usage:  "Include the host's EC2 meta-data as tags (instance-id, instance-type, ami-id, availability-zone and autoscaling-group-name)",
 			EnvVar: "BUILDKITE_AGENT_TAGS_FROM_EC2",
 		},
 		cli.BoolFlag{
@@ -168,6 +317,71 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Flags to pass to \"git clean\" command",
 			EnvVar: "BUILDKITE_GIT_CLEAN_FLAGS",
 		},
+		cli.IntFlag{
+			Name:   "git-clone-depth",
+			Value:  0,
+			Usage:  "Create shallow clones with this many commits of history, unless the pipeline sets BUILDKITE_GIT_CLONE_DEPTH. 0 means a full clone",
+			EnvVar: "BUILDKITE_GIT_CLONE_DEPTH",
+		},
+		cli.IntFlag{
+			Name:   "git-fetch-depth",
+			Value:  0,
+			Usage:  "Fetch this many commits of history, unless the pipeline sets BUILDKITE_GIT_FETCH_DEPTH. Defaults to the clone depth",
+			EnvVar: "BUILDKITE_GIT_FETCH_DEPTH",
+		},
+		cli.StringSliceFlag{
+			Name:   "git-sparse-checkout-paths",
+			Value:  &cli.StringSlice{},
+			Usage:  "Paths to check out instead of the whole repository, unless the pipeline sets BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS",
+			EnvVar: "BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS",
+		},
+		cli.IntFlag{
+			Name:   "git-submodule-recursion-depth",
+			Value:  0,
+			Usage:  "How many levels of nested git submodules to check out, unless the pipeline sets BUILDKITE_GIT_SUBMODULE_RECURSION_DEPTH. Defaults to all of them",
+			EnvVar: "BUILDKITE_GIT_SUBMODULE_RECURSION_DEPTH",
+		},
+		cli.StringSliceFlag{
+			Name:   "git-submodule-url-rewrites",
+			Value:  &cli.StringSlice{},
+			Usage:  "Rewrites of git submodule urls in the form prefix=replacement, i.e. \"git@github.com:=https://github.com/\"",
+			EnvVar: "BUILDKITE_GIT_SUBMODULE_URL_REWRITES",
+		},
+		cli.StringFlag{
+			Name:   "git-credentials-file",
+			Value:  "",
+			Usage:  "Path to a git-credentials file with per-host credentials for private git submodules",
+			EnvVar: "BUILDKITE_GIT_CREDENTIALS_FILE",
+		},
+		cli.StringFlag{
+			Name:   "git-mirrors-path",
+			Value:  "",
+			Usage:  "Path where mirrors of git repositories are kept, which are shared by jobs on this machine to speed up checkouts",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_PATH",
+		},
+		cli.IntFlag{
+			Name:   "git-mirrors-lock-timeout",
+			Value:  300,
+			Usage:  "Seconds to wait for another job to finish updating a git mirror before cloning without it",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "git-mirrors-stale-after",
+			Value:  86400,
+			Usage:  "Seconds a git mirror can go without being updated before it's checked for corruption, 0 means never",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_STALE_AFTER",
+		},
+		cli.IntFlag{
+			Name:   "git-retries",
+			Value:  2,
+			Usage:  "How many times to retry cloning and fetching after a transient git error, like the connection being reset",
+			EnvVar: "BUILDKITE_GIT_RETRIES",
+		},
+		cli.BoolFlag{
+			Name:   "git-retry-reclone",
+			Usage:  "Remove the checkout and clone it again on the last retry of a transient git error",
+			EnvVar: "BUILDKITE_GIT_RETRY_RECLONE",
+		},
 		cli.StringFlag{
 			Name:   "bootstrap-script",
 			Value:  "buildkite-agent bootstrap",
@@ -186,6 +400,12 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Directory where the hook scripts are found",
 			EnvVar: "BUILDKITE_HOOKS_PATH",
 		},
+		cli.StringSliceFlag{
+			Name:   "hooks-overlays",
+			Value:  &cli.StringSlice{},
+			Usage:  "Directories of hooks that are run after the global hooks for the pipelines or repositories they match, in order, i.e. \"pipeline:team-a-*=/etc/buildkite-agent/hooks/team-a\" or \"repository:git@github.com:acme/**=/etc/buildkite-agent/hooks/acme\"",
+			EnvVar: "BUILDKITE_HOOKS_OVERLAYS",
+		},
 		cli.StringFlag{
 			Name:   "plugins-path",
 			Value:  "",
@@ -197,6 +417,36 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Prepend timestamps on each line of output.",
 			EnvVar: "BUILDKITE_TIMESTAMP_LINES",
 		},
+		cli.StringFlag{
+			Name:   "timestamp-lines-format",
+			Value:  "rfc3339",
+			Usage:  "How lines are timestamped with --timestamp-lines, either rfc3339 or relative to when the job started",
+			EnvVar: "BUILDKITE_TIMESTAMP_LINES_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "ansi-output",
+			Value:  "keep",
+			Usage:  "What to do with ANSI escape sequences in job output: keep them, keep only colors and drop things like cursor movement, or strip them all. Jobs can choose with BUILDKITE_ANSI_OUTPUT",
+			EnvVar: "BUILDKITE_ANSI_OUTPUT",
+		},
+		cli.IntFlag{
+			Name:   "log-chunk-size",
+			Value:  0,
+			Usage:  "The size in KiB of the chunks job logs are uploaded in, which can't be more than Buildkite allows. 0 uses the size Buildkite gives",
+			EnvVar: "BUILDKITE_LOG_CHUNK_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "log-flush-interval",
+			Value:  1,
+			Usage:  "The number of seconds between uploading new output from jobs",
+			EnvVar: "BUILDKITE_LOG_FLUSH_INTERVAL",
+		},
+		cli.IntFlag{
+			Name:   "max-log-size",
+			Value:  0,
+			Usage:  "The most output in MiB a job can have, after which the rest of its log is dropped. 0 means no limit",
+			EnvVar: "BUILDKITE_MAX_LOG_SIZE",
+		},
 		cli.BoolFlag{
 			Name:   "no-pty",
 			Usage:  "Do not run jobs within a pseudo terminal",
@@ -207,17 +457,514 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Don't automatically verify SSH fingerprints",
 			EnvVar: "BUILDKITE_NO_AUTOMATIC_SSH_FINGERPRINT_VERIFICATION",
 		},
+		cli.StringSliceFlag{
+			Name:   "ssh-known-hosts",
+			Value:  &cli.StringSlice{},
+			Usage:  "Hosts to add to known_hosts before each job checks out, i.e. \"github.com\", or \"github.com=SHA256:+DiY3wvvV6TuJJhbpZisF/zLDA0zPMSvHdkr4UvCOqU\" to only trust the key with that fingerprint. A host can be pinned to more than one",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS",
+		},
+		cli.StringFlag{
+			Name:   "ssh-host-key-verification",
+			Value:  "accept-new",
+			Usage:  "How hosts that aren't in known_hosts are trusted, either accept-new to add their keys when they're first checked out from, or strict to fail the checkout unless the host's fingerprints are pinned in ssh-known-hosts",
+			EnvVar: "BUILDKITE_SSH_HOST_KEY_VERIFICATION",
+		},
+		cli.StringFlag{
+			Name:   "git-credentials-provider",
+			Value:  "",
+			Usage:  "Check out over HTTPS with short-lived credentials from `buildkite-agent git-credentials-helper`, either github-app for installation tokens minted by the agent, or gitlab-job-token for the job's CI_JOB_TOKEN",
+			EnvVar: "BUILDKITE_GIT_CREDENTIALS_PROVIDER",
+		},
+		cli.StringFlag{
+			Name:   "github-app-id",
+			Value:  "",
+			Usage:  "The ID of the GitHub App that mints the tokens of the github-app git credentials provider",
+			EnvVar: "BUILDKITE_GITHUB_APP_ID",
+		},
+		cli.StringFlag{
+			Name:   "github-app-private-key-path",
+			Value:  "",
+			Usage:  "The PEM file with the GitHub App's private key",
+			EnvVar: "BUILDKITE_GITHUB_APP_PRIVATE_KEY_PATH",
+		},
+		cli.IntFlag{
+			Name:   "github-app-installation-id",
+			Value:  0,
+			Usage:  "The installation of the GitHub App that tokens are minted from. Defaults to the one in each repository's account",
+			EnvVar: "BUILDKITE_GITHUB_APP_INSTALLATION_ID",
+		},
+		cli.StringFlag{
+			Name:   "github-app-host",
+			Value:  "github.com",
+			Usage:  "The host the GitHub App is on, which is the only one its tokens are given to",
+			EnvVar: "BUILDKITE_GITHUB_APP_HOST",
+		},
+		cli.BoolFlag{
+			Name:   "job-api-token",
+			Usage:  "Give each job a token of its own instead of the agent's access token, which only works for that job and is revoked when it finishes",
+			EnvVar: "BUILDKITE_JOB_API_TOKEN",
+		},
+		cli.StringSliceFlag{
+			Name:   "job-api-token-scopes",
+			Value:  &cli.StringSlice{},
+			Usage:  "What the job's token can be used for, which is log, artifacts and meta-data when none are given. Jobs that run buildkite-agent pipeline upload or annotate also need pipelines or annotations",
+			EnvVar: "BUILDKITE_JOB_API_TOKEN_SCOPES",
+		},
 		cli.BoolFlag{
 			Name:   "no-command-eval",
 			Usage:  "Don't allow this agent to run arbitrary console commands",
 			EnvVar: "BUILDKITE_NO_COMMAND_EVAL",
 		},
+		cli.StringFlag{
+			Name:   "shell",
+			Value:  "",
+			Usage:  "The shell to run the command with followed by its arguments, e.g. \"pwsh -Command\". Defaults to bash, or batch on Windows",
+			EnvVar: "BUILDKITE_SHELL",
+		},
 		cli.BoolFlag{
 			Name:   "no-plugins",
 			Usage:  "Don't allow this agent to load plugins",
 			EnvVar: "BUILDKITE_NO_PLUGINS",
 		},
+		cli.BoolFlag{
+			Name:   "strict-plugin-verification",
+			Usage:  "Fail jobs with plugins that aren't pinned to a commit or sha256, or don't match it",
+			EnvVar: "BUILDKITE_STRICT_PLUGIN_VERIFICATION",
+		},
+		cli.StringFlag{
+			Name:   "pipeline-verification-key",
+			Value:  "",
+			Usage:  "Path to an ed25519 public key (PEM). Jobs whose steps weren't signed by `pipeline upload --signing-key` with its private key are refused",
+			EnvVar: "BUILDKITE_PIPELINE_VERIFICATION_KEY",
+		},
+		cli.StringSliceFlag{
+			Name:   "allowed-plugins",
+			Value:  &cli.StringSlice{},
+			Usage:  "Only allow plugins from repositories matching these glob patterns, e.g. \"https://github.com/my-org/*\"",
+			EnvVar: "BUILDKITE_ALLOWED_PLUGINS",
+		},
+		cli.StringSliceFlag{
+			Name:   "denied-plugins",
+			Value:  &cli.StringSlice{},
+			Usage:  "Don't allow plugins from repositories matching these glob patterns",
+			EnvVar: "BUILDKITE_DENIED_PLUGINS",
+		},
+		cli.StringSliceFlag{
+			Name:   "denied-plugin-phases",
+			Value:  &cli.StringSlice{},
+			Usage:  "Don't allow plugins to replace these phases of the job with their own hooks, either checkout or command",
+			EnvVar: "BUILDKITE_DENIED_PLUGIN_PHASES",
+		},
+		cli.IntFlag{
+			Name:   "hook-timeout",
+			Value:  0,
+			Usage:  "The number of seconds a hook can run for before it's killed. Pipelines can lower it, but not raise it, for the hooks with a name with BUILDKITE_HOOK_TIMEOUT_<NAME>. 0 means no timeout",
+			EnvVar: "BUILDKITE_HOOK_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "cancel-grace-period",
+			Value:  10,
+			Usage:  "The number of seconds a cancelled job has to run it's hooks and exit before it's process group is killed",
+			EnvVar: "BUILDKITE_CANCEL_GRACE_PERIOD",
+		},
+		cli.StringFlag{
+			Name:   "job-cpu-limit",
+			Value:  "",
+			Usage:  "The most CPUs each job can use, like 1.5. Pipelines can lower it with BUILDKITE_JOB_CPU_LIMIT (linux only)",
+			EnvVar: "BUILDKITE_JOB_CPU_LIMIT",
+		},
+		cli.StringFlag{
+			Name:   "job-memory-limit",
+			Value:  "",
+			Usage:  "The most memory each job can use, like 512m or 2g. Pipelines can lower it with BUILDKITE_JOB_MEMORY_LIMIT (linux only)",
+			EnvVar: "BUILDKITE_JOB_MEMORY_LIMIT",
+		},
+		cli.StringFlag{
+			Name:   "cgroup-parent",
+			Value:  "",
+			Usage:  "The cgroup (v2) that jobs with resource limits are run in a cgroup of their own within (default: \"" + cgroup.DefaultParent + "\")",
+			EnvVar: "BUILDKITE_CGROUP_PARENT",
+		},
+		cli.StringFlag{
+			Name:   "job-sandbox",
+			Value:  "",
+			Usage:  "Run job commands, and the hooks from the checkout and plugins, in a sandbox where only the checkout can be written to, either none or bubblewrap (linux only)",
+			EnvVar: "BUILDKITE_JOB_SANDBOX",
+		},
+		cli.StringSliceFlag{
+			Name:   "job-sandbox-writable-paths",
+			Value:  &cli.StringSlice{},
+			Usage:  "Paths outside of the checkout that job commands can write to in the sandbox, e.g. \"/var/cache/npm\"",
+			EnvVar: "BUILDKITE_JOB_SANDBOX_WRITABLE_PATHS",
+		},
+		cli.BoolFlag{
+			Name:   "job-sandbox-pull-requests-only",
+			Usage:  "Only run the commands of pull request builds in the sandbox, i.e. for open source pipelines",
+			EnvVar: "BUILDKITE_JOB_SANDBOX_PULL_REQUESTS_ONLY",
+		},
+		cli.StringFlag{
+			Name:   "job-executor",
+			Value:  "local",
+			Usage:  "Where jobs are run, either local or kubernetes to run each one in a pod of it's own",
+			EnvVar: "BUILDKITE_JOB_EXECUTOR",
+		},
+		cli.StringFlag{
+			Name:   "kubernetes-image",
+			Value:  "",
+			Usage:  "The image job pods run, unless the pipeline sets BUILDKITE_KUBERNETES_IMAGE. It needs to have buildkite-agent installed",
+			EnvVar: "BUILDKITE_KUBERNETES_IMAGE",
+		},
+		cli.StringFlag{
+			Name:   "kubernetes-namespace",
+			Value:  "",
+			Usage:  "The namespace job pods are created in, defaults to the agent's own",
+			EnvVar: "BUILDKITE_KUBERNETES_NAMESPACE",
+		},
+		cli.StringFlag{
+			Name:   "kubernetes-cpu",
+			Value:  "",
+			Usage:  "The CPU each job pod needs, i.e. 500m or 2, unless the pipeline sets BUILDKITE_KUBERNETES_CPU",
+			EnvVar: "BUILDKITE_KUBERNETES_CPU",
+		},
+		cli.StringFlag{
+			Name:   "kubernetes-memory",
+			Value:  "",
+			Usage:  "The memory each job pod needs, i.e. 512Mi or 4Gi, unless the pipeline sets BUILDKITE_KUBERNETES_MEMORY",
+			EnvVar: "BUILDKITE_KUBERNETES_MEMORY",
+		},
+		cli.StringSliceFlag{
+			Name:   "kubernetes-node-selector",
+			Value:  &cli.StringSlice{},
+			Usage:  "Labels of the nodes job pods can run on in the form key=value, unless the pipeline sets BUILDKITE_KUBERNETES_NODE_SELECTOR",
+			EnvVar: "BUILDKITE_KUBERNETES_NODE_SELECTOR",
+		},
+		cli.StringFlag{
+			Name:   "proxy",
+			Value:  "",
+			Usage:  "The proxy to make HTTP requests through, i.e. http://proxy.example.com:3128, instead of the one in HTTP_PROXY and HTTPS_PROXY",
+			EnvVar: "BUILDKITE_PROXY",
+		},
+		cli.StringFlag{
+			Name:   "proxy-auth",
+			Value:  "",
+			Usage:  "How to authenticate with the proxy, either basic or ntlm",
+			EnvVar: "BUILDKITE_PROXY_AUTH",
+		},
+		cli.StringFlag{
+			Name:   "proxy-username",
+			Value:  "",
+			Usage:  "The username to authenticate with the proxy with, which can include the domain for ntlm, i.e. CORP\\buildkite",
+			EnvVar: "BUILDKITE_PROXY_USERNAME",
+		},
+		cli.StringFlag{
+			Name:   "proxy-password",
+			Value:  "",
+			Usage:  "The password to authenticate with the proxy with",
+			EnvVar: "BUILDKITE_PROXY_PASSWORD",
+		},
+		cli.BoolFlag{
+			Name:   "proxy-auth-for-jobs",
+			Usage:  "Pass the proxy's credentials on to jobs, so the buildkite-agent commands they run can authenticate with it. Anything a job runs can read them from its environment, and they're only redacted from the log",
+			EnvVar: "BUILDKITE_PROXY_AUTH_FOR_JOBS",
+		},
+		cli.StringSliceFlag{
+			Name:   "no-proxy",
+			Value:  &cli.StringSlice{},
+			Usage:  "Hosts, domains and IP ranges to connect to directly instead of through the proxy, optionally with a port, i.e. .internal.example.com or 10.0.0.0/8",
+			EnvVar: "BUILDKITE_NO_PROXY",
+		},
+		cli.StringFlag{
+			Name:   "tls-client-cert",
+			Value:  "",
+			Usage:  "The path to a PEM client certificate the agent authenticates with, for APIs that require mutual TLS",
+			EnvVar: "BUILDKITE_TLS_CLIENT_CERT",
+		},
+		cli.StringFlag{
+			Name:   "tls-client-key",
+			Value:  "",
+			Usage:  "The path to the PEM private key of the client certificate",
+			EnvVar: "BUILDKITE_TLS_CLIENT_KEY",
+		},
+		cli.StringFlag{
+			Name:   "tls-ca",
+			Value:  "",
+			Usage:  "The path to a PEM CA certificate to trust as well as the system's ones, i.e. for a self-hosted API",
+			EnvVar: "BUILDKITE_TLS_CA",
+		},
+		cli.StringFlag{
+			Name:   "s3-acl",
+			Value:  "",
+			Usage:  "The canned ACL artifacts are uploaded to S3 with, i.e. bucket-owner-full-control, or none for buckets with ACLs disabled (default: public-read)",
+			EnvVar: "BUILDKITE_S3_ACL",
+		},
+		cli.StringFlag{
+			Name:   "s3-sse",
+			Value:  "",
+			Usage:  "The server-side encryption artifacts are uploaded to S3 with, either AES256 or aws:kms",
+			EnvVar: "BUILDKITE_S3_SSE",
+		},
+		cli.StringFlag{
+			Name:   "s3-sse-kms-key-id",
+			Value:  "",
+			Usage:  "The KMS key artifacts are encrypted with in S3, if it isn't the bucket's default",
+			EnvVar: "BUILDKITE_S3_SSE_KMS_KEY_ID",
+		},
+		cli.StringFlag{
+			Name:   "s3-endpoint",
+			Value:  "",
+			Usage:  "An S3-compatible service to upload artifacts to instead of AWS, i.e. https://minio.example.com:9000",
+			EnvVar: "BUILDKITE_S3_ENDPOINT",
+		},
+		cli.BoolFlag{
+			Name:   "s3-force-path-style",
+			Usage:  "Address S3 buckets in the path of the URL instead of the hostname, which most S3-compatible services need",
+			EnvVar: "BUILDKITE_S3_FORCE_PATH_STYLE",
+		},
+		cli.StringFlag{
+			Name:   "vault-addr",
+			Value:  "",
+			Usage:  "The address of the HashiCorp Vault server that jobs can fetch secrets from with BUILDKITE_SECRETS, i.e. https://vault.example.com:8200",
+			EnvVar: "BUILDKITE_VAULT_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "vault-namespace",
+			Value:  "",
+			Usage:  "The Vault Enterprise namespace the secrets are in",
+			EnvVar: "BUILDKITE_VAULT_NAMESPACE",
+		},
+		cli.StringFlag{
+			Name:   "vault-auth-method",
+			Value:  "approle",
+			Usage:  "How the agent logs into Vault, either approle or kubernetes",
+			EnvVar: "BUILDKITE_VAULT_AUTH_METHOD",
+		},
+		cli.StringFlag{
+			Name:   "vault-auth-mount",
+			Value:  "",
+			Usage:  "The path the Vault auth method is mounted at, if it isn't the default",
+			EnvVar: "BUILDKITE_VAULT_AUTH_MOUNT",
+		},
+		cli.StringFlag{
+			Name:   "vault-role-id",
+			Value:  "",
+			Usage:  "The role ID to log into Vault with approle",
+			EnvVar: "BUILDKITE_VAULT_ROLE_ID",
+		},
+		cli.StringFlag{
+			Name:   "vault-secret-id",
+			Value:  "",
+			Usage:  "The secret ID to log into Vault with approle",
+			EnvVar: "BUILDKITE_VAULT_SECRET_ID",
+		},
+		cli.StringFlag{
+			Name:   "vault-kubernetes-role",
+			Value:  "",
+			Usage:  "The role to log into Vault with kubernetes",
+			EnvVar: "BUILDKITE_VAULT_KUBERNETES_ROLE",
+		},
+		cli.StringFlag{
+			Name:   "vault-kubernetes-token-path",
+			Value:  "",
+			Usage:  "The service account token to log into Vault with kubernetes, which defaults to the pod's",
+			EnvVar: "BUILDKITE_VAULT_KUBERNETES_TOKEN_PATH",
+		},
+		cli.BoolFlag{
+			Name:   "secrets-from-aws",
+			Usage:  "Fetch environment variables set to ssm:/path or aws-secrets:name from AWS SSM Parameter Store or Secrets Manager with the agent's instance role",
+			EnvVar: "BUILDKITE_SECRETS_FROM_AWS",
+		},
+		cli.StringSliceFlag{
+			Name:   "redacted-vars",
+			Value:  &cli.StringSlice{"*_PASSWORD", "*_SECRET", "*_TOKEN", "*_ACCESS_KEY", "*_SECRET_KEY"},
+			Usage:  "Glob patterns of environment variable names whose values are replaced with [REDACTED] in job logs",
+			EnvVar: "BUILDKITE_REDACTED_VARS",
+		},
+		cli.StringSliceFlag{
+			Name:   "protected-env",
+			Value:  &cli.StringSlice{},
+			Usage:  "Glob patterns of environment variable names that jobs can't set, such as \"AWS_*\" or \"LD_PRELOAD\". They're removed from the job's environment before it starts",
+			EnvVar: "BUILDKITE_PROTECTED_ENV",
+		},
+		cli.BoolFlag{
+			Name:   "protected-env-fatal",
+			Usage:  "Fail jobs that set a --protected-env variable, instead of removing it and running them",
+			EnvVar: "BUILDKITE_PROTECTED_ENV_FATAL",
+		},
+		cli.IntFlag{
+			Name:   "preflight-min-disk-space",
+			Value:  0,
+			Usage:  "Fail jobs before they start if there's less than this many MB free on the build path. 0 doesn't check",
+			EnvVar: "BUILDKITE_PREFLIGHT_MIN_DISK_SPACE",
+		},
+		cli.StringSliceFlag{
+			Name:   "preflight-required-binaries",
+			Value:  &cli.StringSlice{},
+			Usage:  "Fail jobs before they start if any of these binaries, such as \"git\", aren't installed",
+			EnvVar: "BUILDKITE_PREFLIGHT_REQUIRED_BINARIES",
+		},
+		cli.BoolFlag{
+			Name:   "preflight-docker",
+			Usage:  "Fail jobs that use Docker before they start if the Docker daemon isn't running",
+			EnvVar: "BUILDKITE_PREFLIGHT_DOCKER",
+		},
+		cli.StringFlag{
+			Name:   "janitor-keep-builds",
+			Value:  "",
+			Usage:  "Remove checkouts from the build path that haven't been used for this long, i.e. \"168h\". Pipelines can keep theirs for longer with BUILDKITE_JANITOR_KEEP_BUILDS",
+			EnvVar: "BUILDKITE_JANITOR_KEEP_BUILDS",
+		},
+		cli.IntFlag{
+			Name:   "janitor-min-free-space",
+			Value:  0,
+			Usage:  "Remove the least recently used checkouts from the build path while there's less than this many MB free. Pipelines can ask for more before their jobs with BUILDKITE_JANITOR_MIN_FREE_SPACE",
+			EnvVar: "BUILDKITE_JANITOR_MIN_FREE_SPACE",
+		},
+		cli.StringFlag{
+			Name:   "janitor-interval",
+			Value:  "",
+			Usage:  "Clean up the build path this often, i.e. \"1h\", as well as after each job",
+			EnvVar: "BUILDKITE_JANITOR_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "docker-gc-ttl",
+			Value:  "",
+			Usage:  "Remove dangling Docker images, stopped buildkite containers and unused volumes once they're this old, i.e. \"24h\"",
+			EnvVar: "BUILDKITE_DOCKER_GC_TTL",
+		},
+		cli.IntFlag{
+			Name:   "docker-gc-min-free-space",
+			Value:  0,
+			Usage:  "Remove everything Docker isn't using, whatever its age, while there's less than this many MB free on Docker's disk",
+			EnvVar: "BUILDKITE_DOCKER_GC_MIN_FREE_SPACE",
+		},
+		cli.StringFlag{
+			Name:   "docker-gc-interval",
+			Value:  "",
+			Usage:  "Clean up after Docker this often while the agent is idle, i.e. \"15m\", as well as after each job",
+			EnvVar: "BUILDKITE_DOCKER_GC_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "ephemeral-workspace",
+			Value:  "",
+			Usage:  "Give each job a fresh build path that's destroyed once it's finished, either a directory in the ephemeral-workspace-path or a tmpfs mounted for the job (directory, tmpfs)",
+			EnvVar: "BUILDKITE_EPHEMERAL_WORKSPACE",
+		},
+		cli.StringFlag{
+			Name:   "ephemeral-workspace-path",
+			Value:  "",
+			Usage:  "Where jobs' ephemeral workspaces are created, which can be a filesystem of its own. Defaults to the temp directory",
+			EnvVar: "BUILDKITE_EPHEMERAL_WORKSPACE_PATH",
+		},
+		cli.IntFlag{
+			Name:   "ephemeral-workspace-size",
+			Value:  0,
+			Usage:  "The size of each job's tmpfs workspace in MB. Defaults to half of the machine's memory",
+			EnvVar: "BUILDKITE_EPHEMERAL_WORKSPACE_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "job-user",
+			Value:  "",
+			Usage:  "Run jobs as this user, by name or UID, with their groups and HOME, so the agent can run as root but jobs don't (unix only). Only the agent's user can connect to its control socket, so jobs run as the user can't use buildkite-agent lock or the github-app git credentials",
+			EnvVar: "BUILDKITE_JOB_USER",
+		},
+		cli.BoolFlag{
+			Name:   "job-user-command-only",
+			Usage:  "Only run the command, and the hooks from the checkout and plugins, as the job-user rather than the whole bootstrap, so the agent's own hooks still run as the agent's user (linux only). The user could change the checkout's git config and hooks, so it's cloned again for each job rather than checked out by the agent as it was left; git-mirrors-path keeps that quick",
+			EnvVar: "BUILDKITE_JOB_USER_COMMAND_ONLY",
+		},
+		cli.StringFlag{
+			Name:   "dev-environment",
+			Value:  "",
+			Usage:  "Enter the nix or devbox environment the checkout declares before the command is run, one of auto, nix-flake, nix-shell, devbox or none. Pipelines can choose their own with BUILDKITE_DEV_ENVIRONMENT",
+			EnvVar: "BUILDKITE_DEV_ENVIRONMENT",
+		},
+		cli.StringFlag{
+			Name:   "toolchain",
+			Value:  "",
+			Usage:  "Install the tool versions pinned in the checkout's .tool-versions or mise.toml before the command is run, with asdf or mise. Pipelines can choose their own with BUILDKITE_TOOLCHAIN",
+			EnvVar: "BUILDKITE_TOOLCHAIN",
+		},
+		cli.StringFlag{
+			Name:   "toolchain-cache-path",
+			Value:  "",
+			Usage:  "Where tools are installed, so each version is only installed once. Defaults to .toolchains in the build path",
+			EnvVar: "BUILDKITE_TOOLCHAIN_CACHE_PATH",
+		},
+		cli.StringSliceFlag{
+			Name:   "docker-login",
+			Value:  &cli.StringSlice{},
+			Usage:  "Registries to log each job in to with fresh credentials, which are removed when it finishes, i.e. \"012345678910.dkr.ecr.us-east-1.amazonaws.com=ecr\", \"us-docker.pkg.dev=gcp\" or \"registry.example.com=vault://secret/data/registry#login\" for a username:password secret",
+			EnvVar: "BUILDKITE_DOCKER_LOGIN",
+		},
+		cli.StringSliceFlag{
+			Name:   "ssh-keys",
+			Value:  &cli.StringSlice{},
+			Usage:  "SSH private keys to load into an ssh-agent started for each job, so jobs can't use each other's keys. Either files or secrets, i.e. \"vault://secret/data/deploy#private_key\" (unix only)",
+			EnvVar: "BUILDKITE_SSH_KEYS",
+		},
+		cli.BoolFlag{
+			Name:   "agent-startup-hook-fatal",
+			Usage:  "Stop the agent from accepting jobs if the agent-startup hook fails",
+			EnvVar: "BUILDKITE_AGENT_STARTUP_HOOK_FATAL",
+		},
+		cli.StringFlag{
+			Name:   "metrics-addr",
+			Value:  "",
+			Usage:  "Serve Prometheus metrics at /metrics on this address, e.g. \"127.0.0.1:9100\"",
+			EnvVar: "BUILDKITE_METRICS_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "metrics-datadog-host",
+			Value:  "",
+			Usage:  "Send metrics to the DogStatsD server at this address as they change, e.g. \"127.0.0.1:8125\"",
+			EnvVar: "BUILDKITE_METRICS_DATADOG_HOST",
+		},
+		cli.StringFlag{
+			Name:   "metrics-cloudwatch-namespace",
+			Value:  "",
+			Usage:  "Publish the jobs running, idle percentage and job wait time to CloudWatch in this namespace every minute, e.g. \"Buildkite\"",
+			EnvVar: "BUILDKITE_METRICS_CLOUDWATCH_NAMESPACE",
+		},
+		cli.StringSliceFlag{
+			Name:   "event-targets",
+			Value:  &cli.StringSlice{},
+			Usage:  "Send job events as JSON to these webhook URLs or unix sockets, e.g. \"https://example.com/events,unix:///var/run/events.sock\"",
+			EnvVar: "BUILDKITE_EVENT_TARGETS",
+		},
+		cli.StringFlag{
+			Name:   "health-check-addr",
+			Value:  "",
+			Usage:  "Serve liveness and readiness checks at /healthz and /readyz on this address, e.g. \"0.0.0.0:8080\"",
+			EnvVar: "BUILDKITE_HEALTH_CHECK_ADDR",
+		},
+		ControlSocketFlag,
+		cli.IntFlag{
+			Name:   "api-retry-budget",
+			Value:  0,
+			Usage:  "The number of times each Buildkite API endpoint can be retried a minute, before failing calls to it stop being retried (default: unlimited)",
+			EnvVar: "BUILDKITE_API_RETRY_BUDGET",
+		},
+		cli.IntFlag{
+			Name:   "api-circuit-breaker-threshold",
+			Value:  10,
+			Usage:  "The number of Buildkite API calls that need to fail in a row to pause job acceptance, or 0 to never pause",
+			EnvVar: "BUILDKITE_API_CIRCUIT_BREAKER_THRESHOLD",
+		},
+		cli.IntFlag{
+			Name:   "api-circuit-breaker-cooldown",
+			Value:  30,
+			Usage:  "The number of seconds job acceptance is paused for after the Buildkite API fails",
+			EnvVar: "BUILDKITE_API_CIRCUIT_BREAKER_COOLDOWN",
+		},
 		ExperimentsFlag,
+		cli.StringSliceFlag{
+			Name:   "allowed-job-experiments",
+			Value:  &cli.StringSlice{},
+			Usage:  "Experiments that pipelines can enable for their jobs with BUILDKITE_AGENT_EXPERIMENTS, as glob patterns, i.e. \"log-chunk-streaming\" or \"*\"",
+			EnvVar: "BUILDKITE_ALLOWED_JOB_EXPERIMENTS",
+		},
+		LogFormatFlag,
+		LogSinksFlag,
 		EndpointFlag,
 		NoColorFlag,
 		DebugFlag,
@@ -265,9 +1012,13 @@ var AgentStartCommand = cli.Command{
 		// Setup the any global configuration options
 		HandleGlobalFlags(cfg)
 
-		// Force some settings if on Windows (these aren't supported
-		// yet)
-		if runtime.GOOS == "windows" {
+		// Jobs with the in-process-bootstrap experiment run the bootstrap
+		// within the agent, which only this package can import
+		agent.InProcessBootstrap = runBootstrapInProcess
+
+		// Windows only has PTYs from Windows 10 1809, which added ConPTY
+		if runtime.GOOS == "windows" && !cfg.NoPTY && !process.PTYSupported() {
+			logger.Info("Jobs won't be run in a PTY, as this version of Windows doesn't support ConPTY")
 			cfg.NoPTY = true
 		}
 
@@ -276,6 +1027,157 @@ var AgentStartCommand = cli.Command{
 			logger.Fatal("The timeout for `disconnect-after-job` must be at least 120 seconds")
 		}
 
+		switch cfg.JobExecutor {
+		case "", agent.JobExecutorLocal, agent.JobExecutorKubernetes:
+		default:
+			logger.Fatal("Unknown job executor %q, expected local or kubernetes", cfg.JobExecutor)
+		}
+
+		for _, overlay := range cfg.HooksOverlays {
+			if _, err := agent.ParseHooksOverlay(overlay); err != nil {
+				logger.Fatal("%s", err)
+			}
+		}
+
+		switch cfg.SSHHostKeyVerification {
+		case "", "accept-new", "strict":
+		default:
+			logger.Fatal("Unknown SSH host key verification %q, expected accept-new or strict", cfg.SSHHostKeyVerification)
+		}
+
+		for _, host := range cfg.SSHKnownHosts {
+			if parts := strings.SplitN(host, "=", 2); len(parts) == 2 && !strings.HasPrefix(strings.TrimSpace(parts[1]), "SHA256:") {
+				logger.Fatal("Invalid SSH known host %q, fingerprints are SHA256:... like ssh-keygen -l prints", host)
+			}
+		}
+
+		switch cfg.GitCredentialsProvider {
+		case "", agent.GitCredentialsGitLabJobToken:
+		case agent.GitCredentialsGitHubApp:
+			if cfg.GitHubAppID == "" || cfg.GitHubAppPrivateKeyPath == "" {
+				logger.Fatal("The github-app git credentials provider needs a github-app-id and github-app-private-key-path")
+			}
+			if cfg.ControlSocket == "" {
+				logger.Fatal("The github-app git credentials provider needs the control socket, which jobs get their tokens over")
+			}
+		default:
+			logger.Fatal("Unknown git credentials provider %q, expected github-app or gitlab-job-token", cfg.GitCredentialsProvider)
+		}
+
+		if len(cfg.SSHKeys) > 0 && runtime.GOOS == "windows" {
+			logger.Fatal("Jobs can't have an ssh-agent of their own on Windows")
+		}
+
+		for _, login := range cfg.DockerLogins {
+			if _, err := agent.ParseDockerLogin(login); err != nil {
+				logger.Fatal("%s", err)
+			}
+		}
+
+		if cfg.JobUser != "" {
+			if runtime.GOOS == "windows" {
+				logger.Fatal("Jobs can't be run as another user on Windows")
+			}
+			if _, err := process.LookupCredential(cfg.JobUser); err != nil {
+				logger.Fatal("%s", err)
+			}
+			if cfg.JobUserCommandOnly && runtime.GOOS != "linux" {
+				logger.Fatal("Only the command can be run as the job-user on linux")
+			}
+			if !cfg.JobUserCommandOnly && cfg.GitCredentialsProvider == agent.GitCredentialsGitHubApp {
+				logger.Fatal("The github-app git credentials provider needs job-user-command-only, as the job-user can't connect to the control socket")
+			}
+		}
+
+		switch cfg.DevEnvironment {
+		case "", "none", "auto", "nix-flake", "nix-shell", "devbox":
+		default:
+			logger.Fatal("Unknown dev environment %q, expected auto, nix-flake, nix-shell, devbox or none", cfg.DevEnvironment)
+		}
+
+		switch cfg.Toolchain {
+		case "", "none", "asdf", "mise":
+		default:
+			logger.Fatal("Unknown tool manager %q, expected asdf, mise or none", cfg.Toolchain)
+		}
+
+		switch cfg.EphemeralWorkspace {
+		case "", agent.WorkspaceDirectory:
+		case agent.WorkspaceTmpfs:
+			if runtime.GOOS != "linux" {
+				logger.Fatal("tmpfs workspaces are only supported on Linux")
+			}
+		default:
+			logger.Fatal("Unknown ephemeral workspace %q, expected directory or tmpfs", cfg.EphemeralWorkspace)
+		}
+
+		if _, err := kubernetes.ParseNodeSelector(cfg.KubernetesNodeSelector); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		switch cfg.JobSandbox {
+		case "", "none", "bubblewrap":
+		default:
+			logger.Fatal("Unknown job sandbox %q, expected none or bubblewrap", cfg.JobSandbox)
+		}
+
+		if _, err := cgroup.ParseLimits(cfg.JobCPULimit, cfg.JobMemoryLimit); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		if cfg.DisconnectAfterIdleTimeout < 0 {
+			logger.Fatal("The timeout for `disconnect-after-idle-timeout` can't be negative")
+		}
+
+		if cfg.APIRetryBudget < 0 || cfg.APICircuitBreakerThreshold < 0 || cfg.APICircuitBreakerCooldown < 0 {
+			logger.Fatal("The `api-retry-budget`, `api-circuit-breaker-threshold` and `api-circuit-breaker-cooldown` can't be negative")
+		}
+
+		if err := process.ValidateTimestampFormat(cfg.TimestampLinesFormat); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		if err := process.ValidateANSIOutput(cfg.ANSIOutput); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		if cfg.LogChunkSize < 0 || cfg.MaxLogSize < 0 {
+			logger.Fatal("The `log-chunk-size` and `max-log-size` can't be negative")
+		}
+
+		if cfg.LogFlushInterval < 1 {
+			logger.Fatal("The `log-flush-interval` must be at least 1 second")
+		}
+
+		proxyConfig := proxy.Config{
+			URL:      cfg.Proxy,
+			Auth:     cfg.ProxyAuth,
+			Username: cfg.ProxyUsername,
+			Password: cfg.ProxyPassword,
+			NoProxy:  cfg.NoProxy,
+		}
+		if err := agent.APIClientConfigureProxy(proxyConfig); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		if err := agent.APIClientConfigureTLS(cfg.TLSClientCert, cfg.TLSClientKey, cfg.TLSCA); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		if cfg.VaultAddr != "" {
+			_, err := secrets.NewVault(secrets.VaultConfig{
+				Address:        cfg.VaultAddr,
+				AuthMethod:     cfg.VaultAuthMethod,
+				RoleID:         cfg.VaultRoleID,
+				KubernetesRole: cfg.VaultKubernetesRole,
+			})
+			if err != nil {
+				logger.Fatal("%s", err)
+			}
+		}
+
+		agent.APIClientConfigureRetries(cfg.APIRetryBudget, cfg.APICircuitBreakerThreshold, time.Duration(cfg.APICircuitBreakerCooldown)*time.Second)
+
 		var ec2TagTimeout time.Duration
 		if t := cfg.WaitForEC2TagsTimeout; t != "" {
 			var err error
@@ -285,6 +1187,47 @@ var AgentStartCommand = cli.Command{
 			}
 		}
 
+		var janitorKeepBuilds, janitorInterval time.Duration
+		if t := cfg.JanitorKeepBuilds; t != "" {
+			var err error
+			janitorKeepBuilds, err = time.ParseDuration(t)
+			if err != nil {
+				logger.Fatal("Failed to parse janitor-keep-builds: %v", err)
+			}
+		}
+		if t := cfg.JanitorInterval; t != "" {
+			var err error
+			janitorInterval, err = time.ParseDuration(t)
+			if err != nil {
+				logger.Fatal("Failed to parse janitor-interval: %v", err)
+			}
+		}
+
+		var dockerGCTTL, dockerGCInterval time.Duration
+		if t := cfg.DockerGCTTL; t != "" {
+			var err error
+			dockerGCTTL, err = time.ParseDuration(t)
+			if err != nil {
+				logger.Fatal("Failed to parse docker-gc-ttl: %v", err)
+			}
+		}
+		if t := cfg.DockerGCInterval; t != "" {
+			var err error
+			dockerGCInterval, err = time.ParseDuration(t)
+			if err != nil {
+				logger.Fatal("Failed to parse docker-gc-interval: %v", err)
+			}
+		}
+
+		if cfg.Spawn < 1 {
+			logger.Fatal("The agent needs to `spawn` at least 1 worker")
+		}
+
+		workerPools, err := workerPoolsFromConfigFile(loader.File)
+		if err != nil {
+			logger.Fatal("%s", err)
+		}
+
 		// Setup the agent
 		pool := agent.AgentPool{
 			Token:                 cfg.Token,
@@ -296,32 +1239,233 @@ var AgentStartCommand = cli.Command{
 			TagsFromGCP:           cfg.TagsFromGCP,
 			WaitForEC2TagsTimeout: ec2TagTimeout,
 			Endpoint:              cfg.Endpoint,
+			MetricsAddr:           cfg.MetricsAddr,
+			MetricsDatadogHost:    cfg.MetricsDatadogHost,
+			CloudWatchNamespace:   cfg.MetricsCloudWatchNamespace,
+			EventTargets:          cfg.EventTargets,
+			HealthCheckAddr:       cfg.HealthCheckAddr,
+			ControlSocket:         cfg.ControlSocket,
+			Spawn:                 cfg.Spawn,
+			WorkerPools:           workerPools,
 			AgentConfiguration: &agent.AgentConfiguration{
 				BootstrapScript:            cfg.BootstrapScript,
 				BuildPath:                  cfg.BuildPath,
 				HooksPath:                  cfg.HooksPath,
+				HooksOverlays:              cfg.HooksOverlays,
+				AllowedJobExperiments:      cfg.AllowedJobExperiments,
 				PluginsPath:                cfg.PluginsPath,
 				GitCloneFlags:              cfg.GitCloneFlags,
 				GitCleanFlags:              cfg.GitCleanFlags,
+				GitCloneDepth:              cfg.GitCloneDepth,
+				GitFetchDepth:              cfg.GitFetchDepth,
+				GitSparseCheckoutPaths:     cfg.GitSparseCheckoutPaths,
+				GitSubmoduleRecursionDepth: cfg.GitSubmoduleRecursionDepth,
+				GitSubmoduleURLRewrites:    cfg.GitSubmoduleURLRewrites,
+				GitCredentialsFile:         cfg.GitCredentialsFile,
+				GitMirrorsPath:             cfg.GitMirrorsPath,
+				GitMirrorsLockTimeout:      cfg.GitMirrorsLockTimeout,
+				GitMirrorsStaleAfter:       cfg.GitMirrorsStaleAfter,
+				GitRetries:                 cfg.GitRetries,
+				GitRetryReclone:            cfg.GitRetryReclone,
 				SSHFingerprintVerification: !cfg.NoSSHFingerprintVerification,
+				SSHKnownHosts:              cfg.SSHKnownHosts,
+				SSHHostKeyVerification:     cfg.SSHHostKeyVerification,
 				CommandEval:                !cfg.NoCommandEval,
+				Shell:                      cfg.Shell,
 				PluginsEnabled:             !cfg.NoPlugins,
+				StrictPluginVerification:   cfg.StrictPluginVerification,
+				PipelineVerificationKey:    cfg.PipelineVerificationKey,
+				AllowedPlugins:             cfg.AllowedPlugins,
+				DeniedPlugins:              cfg.DeniedPlugins,
+				DeniedPluginPhases:         cfg.DeniedPluginPhases,
+				HookTimeout:                cfg.HookTimeout,
+				CancelGracePeriod:          cfg.CancelGracePeriod,
+				CgroupParent:               cfg.CgroupParent,
+				JobCPULimit:                cfg.JobCPULimit,
+				JobMemoryLimit:             cfg.JobMemoryLimit,
+				JobSandbox:                 cfg.JobSandbox,
+				JobSandboxWritablePaths:    cfg.JobSandboxWritablePaths,
+				JobSandboxPullRequestsOnly: cfg.JobSandboxPullRequestsOnly,
+				JobExecutor:                cfg.JobExecutor,
+				KubernetesImage:            cfg.KubernetesImage,
+				KubernetesNamespace:        cfg.KubernetesNamespace,
+				KubernetesCPU:              cfg.KubernetesCPU,
+				KubernetesMemory:           cfg.KubernetesMemory,
+				KubernetesNodeSelector:     cfg.KubernetesNodeSelector,
+				Proxy:                      cfg.Proxy,
+				ProxyAuth:                  cfg.ProxyAuth,
+				ProxyUsername:              cfg.ProxyUsername,
+				ProxyPassword:              cfg.ProxyPassword,
+				ProxyAuthForJobs:           cfg.ProxyAuthForJobs,
+				NoProxy:                    cfg.NoProxy,
+				TLSClientCert:              cfg.TLSClientCert,
+				TLSClientKey:               cfg.TLSClientKey,
+				TLSCA:                      cfg.TLSCA,
+				S3ACL:                      cfg.S3ACL,
+				S3SSE:                      cfg.S3SSE,
+				S3SSEKMSKeyID:              cfg.S3SSEKMSKeyID,
+				S3Endpoint:                 cfg.S3Endpoint,
+				S3ForcePathStyle:           cfg.S3ForcePathStyle,
+				VaultAddr:                  cfg.VaultAddr,
+				VaultNamespace:             cfg.VaultNamespace,
+				VaultAuthMethod:            cfg.VaultAuthMethod,
+				VaultAuthMount:             cfg.VaultAuthMount,
+				VaultRoleID:                cfg.VaultRoleID,
+				VaultSecretID:              cfg.VaultSecretID,
+				VaultKubernetesRole:        cfg.VaultKubernetesRole,
+				VaultKubernetesTokenPath:   cfg.VaultKubernetesTokenPath,
+				SecretsFromAWS:             cfg.SecretsFromAWS,
+				RedactedVars:               cfg.RedactedVars,
+				ProtectedEnv:               cfg.ProtectedEnv,
+				ProtectedEnvFatal:          cfg.ProtectedEnvFatal,
+				PreflightMinDiskSpace:      cfg.PreflightMinDiskSpace,
+				PreflightRequiredBinaries:  cfg.PreflightRequiredBinaries,
+				PreflightDocker:            cfg.PreflightDocker,
+				JanitorKeepBuilds:          janitorKeepBuilds,
+				JanitorMinFreeSpace:        cfg.JanitorMinFreeSpace,
+				JanitorInterval:            janitorInterval,
+				DockerGCTTL:                dockerGCTTL,
+				DockerGCMinFreeSpace:       cfg.DockerGCMinFreeSpace,
+				DockerGCInterval:           dockerGCInterval,
+				EphemeralWorkspace:         cfg.EphemeralWorkspace,
+				EphemeralWorkspacePath:     cfg.EphemeralWorkspacePath,
+				EphemeralWorkspaceSize:     cfg.EphemeralWorkspaceSize,
+				JobUser:                    cfg.JobUser,
+				JobUserCommandOnly:         cfg.JobUserCommandOnly,
+				DevEnvironment:             cfg.DevEnvironment,
+				Toolchain:                  cfg.Toolchain,
+				ToolchainCachePath:         cfg.ToolchainCachePath,
+				DockerLogins:               cfg.DockerLogins,
+				SSHKeys:                    cfg.SSHKeys,
+				GitCredentialsProvider:     cfg.GitCredentialsProvider,
+				GitHubAppID:                cfg.GitHubAppID,
+				GitHubAppPrivateKeyPath:    cfg.GitHubAppPrivateKeyPath,
+				GitHubAppInstallationID:    cfg.GitHubAppInstallationID,
+				GitHubAppHost:              cfg.GitHubAppHost,
+				JobAPIToken:                cfg.JobAPIToken,
+				JobAPITokenScopes:          cfg.JobAPITokenScopes,
+				AgentStartupHookFatal:      cfg.AgentStartupHookFatal,
 				RunInPty:                   !cfg.NoPTY,
 				TimestampLines:             cfg.TimestampLines,
+				TimestampLinesFormat:       cfg.TimestampLinesFormat,
+				ANSIOutput:                 cfg.ANSIOutput,
+				ControlSocket:              cfg.ControlSocket,
+				LogChunkSize:               cfg.LogChunkSize * 1024,
+				LogFlushInterval:           cfg.LogFlushInterval,
+				MaxLogSize:                 cfg.MaxLogSize * 1024 * 1024,
 				DisconnectAfterJob:         cfg.DisconnectAfterJob,
 				DisconnectAfterJobTimeout:  cfg.DisconnectAfterJobTimeout,
+				DisconnectAfterIdleTimeout: cfg.DisconnectAfterIdleTimeout,
+				LongPoll:                   cfg.LongPoll,
+				AdaptiveIntervals:          cfg.AdaptiveIntervals,
+				AcquireJob:                 cfg.AcquireJob,
 			},
 		}
 
+		// Load the config file and environment again when the agent
+		// is sent a SIGHUP, for the parts of it that can be reloaded
+		pool.Reload = func() (*agent.ReloadableConfiguration, error) {
+			reloaded := AgentStartConfig{}
+			reloader := cliconfig.Loader{
+				CLI:                    c,
+				Config:                 &reloaded,
+				DefaultConfigFilePaths: DefaultConfigFilePaths(),
+			}
+			if err := reloader.Load(); err != nil {
+				return nil, err
+			}
+
+			if reloaded.Spawn < 1 {
+				return nil, fmt.Errorf("The agent needs to `spawn` at least 1 worker")
+			}
+
+			workerPools, err := workerPoolsFromConfigFile(reloader.File)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, overlay := range reloaded.HooksOverlays {
+				if _, err := agent.ParseHooksOverlay(overlay); err != nil {
+					return nil, err
+				}
+			}
+
+			return &agent.ReloadableConfiguration{
+				Tags:          reloaded.Tags,
+				Spawn:         reloaded.Spawn,
+				WorkerPools:   workerPools,
+				HooksPath:     reloaded.HooksPath,
+				HooksOverlays: reloaded.HooksOverlays,
+				PluginsPath:   reloaded.PluginsPath,
+				Debug:         reloaded.Debug,
+			}, nil
+		}
+
 		// Store the loaded config file path on the pool so we can
 		// show it when the agent starts
 		if loader.File != nil {
 			pool.ConfigFilePath = loader.File.Path
 		}
 
-		// Start the agent pool
+		// Start the agent pool. When it ran a specific job, the agent
+		// exits with the job's exit status, and when it's been updated
+		// it's started again.
 		if err := pool.Start(); err != nil {
+			if err == agent.ErrRestart {
+				logger.Info("Restarting the agent")
+				if err := agent.Restart(); err != nil {
+					logger.Fatal("Failed to restart the agent: %s", err)
+				}
+			}
+			if exitErr, ok := err.(*agent.JobExitError); ok {
+				logger.Info("%s", exitErr)
+				os.Exit(exitErr.ExitStatus)
+			}
 			logger.Fatal("%s", err)
 		}
 	},
 }
+
+// Returns the worker pools in the [pool.<name>] sections of the config file,
+// in the order they're in the file
+func workerPoolsFromConfigFile(file *cliconfig.File) ([]agent.WorkerPool, error) {
+	if file == nil {
+		return nil, nil
+	}
+
+	var pools []agent.WorkerPool
+	for _, section := range file.SectionNames {
+		if !strings.HasPrefix(section, "pool.") || section == "pool." {
+			return nil, fmt.Errorf("Unknown section [%s] in %s, expected [pool.<name>]", section, file.Path)
+		}
+
+		pool := agent.WorkerPool{Name: strings.TrimPrefix(section, "pool."), Spawn: 1}
+		for key, value := range file.Sections[section] {
+			switch key {
+			case "spawn":
+				spawn, err := strconv.Atoi(value)
+				if err != nil || spawn < 1 {
+					return nil, fmt.Errorf("The spawn for [%s] needs to be a number that's at least 1, got %q", section, value)
+				}
+				pool.Spawn = spawn
+			case "name":
+				pool.AgentName = value
+			case "priority":
+				pool.Priority = value
+			case "tags":
+				pool.Tags = []string{}
+				for _, tag := range strings.Split(value, ",") {
+					if tag = strings.TrimSpace(tag); tag != "" {
+						pool.Tags = append(pool.Tags, tag)
+					}
+				}
+			default:
+				return nil, fmt.Errorf("Unknown setting %q for [%s], expected spawn, name, priority or tags", key, section)
+			}
+		}
+
+		pools = append(pools, pool)
+	}
+
+	return pools, nil
+}
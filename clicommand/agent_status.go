@@ -0,0 +1,102 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/urfave/cli"
+)
+
+var AgentStatusHelpDescription = `Usage:
+
+   buildkite-agent status [arguments...]
+
+Description:
+
+   Shows what the agent running on this machine is doing, including the jobs
+   it's running, how long it's been running for, and whether it can reach
+   Buildkite. It talks to the agent over its control socket.
+
+Example:
+
+   $ buildkite-agent status
+   $ buildkite-agent status --json`
+
+type AgentStatusConfig struct {
+	ControlSocket string `cli:"control-socket" normalize:"filepath"`
+	JSON          bool   `cli:"json"`
+	NoColor       bool   `cli:"no-color"`
+	Debug         bool   `cli:"debug"`
+}
+
+var AgentStatusCommand = cli.Command{
+	Name:        "status",
+	Usage:       "Show what the running agent is doing",
+	Description: AgentStatusHelpDescription,
+	Flags: []cli.Flag{
+		ControlSocketFlag,
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Show the status as JSON",
+		},
+		NoColorFlag,
+		DebugFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := AgentStatusConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		status, err := agent.ControlClient{Path: cfg.ControlSocket}.Send(agent.ControlRequest{Command: agent.ControlStatus})
+		if err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		if cfg.JSON {
+			if err := json.NewEncoder(os.Stdout).Encode(status); err != nil {
+				logger.Fatal("%s", err)
+			}
+			return
+		}
+
+		printAgentStatus(status)
+	},
+}
+
+// Prints the status of the agent for people to read
+func printAgentStatus(status *agent.AgentStatus) {
+	uptime := time.Duration(status.Uptime) * time.Second
+
+	fmt.Printf("Agent v%s (PID %d) is %s, and has been up for %s\n", status.Version, status.PID, status.State, uptime)
+	if !status.APIHealthy {
+		fmt.Printf("The Buildkite API is failing, so jobs aren't being accepted\n")
+	}
+
+	for _, worker := range status.Workers {
+		if worker.JobID != "" {
+			fmt.Printf("  %s: %s job %s\n", worker.Name, worker.State, worker.JobID)
+		} else {
+			fmt.Printf("  %s: %s\n", worker.Name, worker.State)
+		}
+	}
+
+	for _, lock := range status.Locks {
+		if lock.JobID != "" {
+			fmt.Printf("Lock %q is held by job %s\n", lock.Key, lock.JobID)
+		} else {
+			fmt.Printf("Lock %q is held\n", lock.Key)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package clicommand
+
+import (
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/urfave/cli"
+)
+
+var AgentStopHelpDescription = `Usage:
+
+   buildkite-agent stop [arguments...]
+
+Description:
+
+   Stops the agent running on this machine. Any jobs it's running are
+   cancelled, unless it's stopped with --graceful, in which case they're
+   finished before the agent disconnects.
+
+Example:
+
+   $ buildkite-agent stop --graceful`
+
+type AgentStopConfig struct {
+	ControlSocket string `cli:"control-socket" normalize:"filepath"`
+	Graceful      bool   `cli:"graceful"`
+	NoColor       bool   `cli:"no-color"`
+	Debug         bool   `cli:"debug"`
+}
+
+var AgentStopCommand = cli.Command{
+	Name:        "stop",
+	Usage:       "Stop the running agent",
+	Description: AgentStopHelpDescription,
+	Flags: []cli.Flag{
+		ControlSocketFlag,
+		cli.BoolFlag{
+			Name:  "graceful",
+			Usage: "Wait for any jobs the agent is running to finish, instead of cancelling them",
+		},
+		NoColorFlag,
+		DebugFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := AgentStopConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		status, err := agent.ControlClient{Path: cfg.ControlSocket}.Send(agent.ControlRequest{Command: agent.ControlStop, Graceful: cfg.Graceful})
+		if err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		printAgentStatus(status)
+	},
+}
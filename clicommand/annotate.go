@@ -5,6 +5,7 @@ import (
 	"os"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/buildkite/agent/agent"
 	"github.com/buildkite/agent/api"
@@ -38,18 +39,26 @@ Description:
    You can also just update the style of an existing annotation by omitting the
    body and just providing a new style value.
 
+   Jobs running in parallel can share an annotation by each writing to their
+   own section of it, which replaces just that section, or adds to it with
+   --append. Large bodies are sent in parts, so they can be read from a file
+   with --from-file (or - for STDIN).
+
 Example:
 
    $ buildkite-agent annotate "All tests passed! :rocket:"
    $ cat annotation.md | buildkite-agent annotate --style "warning"
    $ buildkite-agent annotate --style "success" --context "junit"
-   $ ./script/dynamic_annotation_generator | buildkite-agent annotate --style "success"`
+   $ ./script/dynamic_annotation_generator | buildkite-agent annotate --style "success"
+   $ buildkite-agent annotate --from-file report.md --context "tests" --section "$BUILDKITE_PARALLEL_JOB"`
 
 type AnnotateConfig struct {
 	Body             string `cli:"arg:0" label:"annotation body"`
 	Style            string `cli:"style"`
 	Context          string `cli:"context"`
 	Append           bool   `cli:"append"`
+	Section          string `cli:"section"`
+	FromFile         string `cli:"from-file"`
 	Job              string `cli:"job" validate:"required"`
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
@@ -78,6 +87,16 @@ var AnnotateCommand = cli.Command{
 			Usage:  "Append to the body of an existing annotation",
 			EnvVar: "BUILDKITE_ANNOTATION_APPEND",
 		},
+		cli.StringFlag{
+			Name:   "section",
+			Usage:  "The section of the annotation to write to, so that parallel jobs don't replace each other's",
+			EnvVar: "BUILDKITE_ANNOTATION_SECTION",
+		},
+		cli.StringFlag{
+			Name:  "from-file",
+			Value: "",
+			Usage: "Read the body of the annotation from a file, or - to read it from STDIN",
+		},
 		cli.StringFlag{
 			Name:   "job",
 			Value:  "",
@@ -106,9 +125,22 @@ var AnnotateCommand = cli.Command{
 		var body string
 		var err error
 
+		if cfg.Body != "" && cfg.FromFile != "" {
+			logger.Fatal("%s", loader.Errorf("An annotation body can't be used with --from-file."))
+		}
+
 		if cfg.Body != "" {
 			body = cfg.Body
-		} else if stdin.IsPipe() {
+		} else if cfg.FromFile != "" && cfg.FromFile != "-" {
+			logger.Info("Reading annotation body from %s", cfg.FromFile)
+
+			data, err := ioutil.ReadFile(cfg.FromFile)
+			if err != nil {
+				logger.Fatal("Failed to read %s: %s", cfg.FromFile, err)
+			}
+
+			body = string(data)
+		} else if cfg.FromFile == "-" || stdin.IsPipe() {
 			logger.Info("Reading annotation body from STDIN")
 
 			// Actually read the file from STDIN
@@ -129,38 +161,88 @@ var AnnotateCommand = cli.Command{
 			Token:    cfg.AgentAccessToken,
 		}.Create()
 
-		// Create the annotation we'll send to the Buildkite API
-		annotation := &api.Annotation{
-			Body:    body,
-			Style:   cfg.Style,
-			Context: cfg.Context,
-			Append:  cfg.Append,
+		// Large bodies are sent in parts, with the ones after the first
+		// appended to it
+		chunks := splitAnnotationBody(body, annotationChunkSize)
+		if len(chunks) > 1 {
+			logger.Info("Sending the annotation body in %d parts", len(chunks))
 		}
 
-		// Retry the annotation a few times before giving up
-		err = retry.Do(func(s *retry.Stats) error {
-			// Attempt ot create the annotation
-			resp, err := client.Annotations.Create(cfg.Job, annotation)
-
-			// Don't bother retrying if the response was one of these statuses
-			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
-				s.Break()
-				return err
+		for i, chunk := range chunks {
+			// Create the annotation we'll send to the Buildkite API
+			annotation := &api.Annotation{
+				Body:    chunk,
+				Style:   cfg.Style,
+				Context: cfg.Context,
+				Append:  cfg.Append || i > 0,
+				Section: cfg.Section,
 			}
 
-			// Show the unexpected error
+			// Retry the annotation a few times before giving up
+			err = createAnnotation(client, cfg.Job, annotation)
+
+			// Show a fatal error if we gave up trying to create the annotation
 			if err != nil {
-				logger.Warn("%s (%s)", err, s)
+				logger.Fatal("Failed to annotate build: %s", err)
 			}
+		}
+
+		logger.Info("Successfully annotated build")
+	},
+}
+
+// Creates the annotation, retrying a few times before giving up
+func createAnnotation(client *api.Client, jobID string, annotation *api.Annotation) error {
+	return retry.Do(func(s *retry.Stats) error {
+		// Attempt ot create the annotation
+		resp, err := client.Annotations.Create(jobID, annotation)
 
+		// Don't bother retrying if the response was one of these statuses
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+			s.Break()
 			return err
-		}, &retry.Config{Maximum: 5, Interval: 1 * time.Second, Jitter: true})
+		}
 
-		// Show a fatal error if we gave up trying to create the annotation
+		// Show the unexpected error
 		if err != nil {
-			logger.Fatal("Failed to annotate build: %s", err)
+			logger.Warn("%s (%s)", err, s)
 		}
 
-		logger.Info("Successfully annotated build")
-	},
+		return err
+	}, &retry.Config{Maximum: 5, Interval: 1 * time.Second, Jitter: true})
+}
+
+// The most of an annotation's body that's sent in one request
+var annotationChunkSize = 256 * 1024
+
+// Splits the body into parts no bigger than the size, breaking them after a
+// line where possible, and never in the middle of a character. An empty body
+// is still one part, which just updates the style.
+func splitAnnotationBody(body string, size int) []string {
+	if len(body) <= size {
+		return []string{body}
+	}
+
+	var chunks []string
+	for len(body) > size {
+		end := strings.LastIndex(body[:size], "\n") + 1
+		if end == 0 {
+			end = size
+			for end > 0 && !utf8.RuneStart(body[end]) {
+				end--
+			}
+			if end == 0 {
+				end = size
+			}
+		}
+
+		chunks = append(chunks, body[:end])
+		body = body[end:]
+	}
+
+	if body != "" {
+		chunks = append(chunks, body)
+	}
+
+	return chunks
 }
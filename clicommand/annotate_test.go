@@ -0,0 +1,31 @@
+package clicommand
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitAnnotationBody(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []string{""}, splitAnnotationBody("", 10))
+	assert.Equal(t, []string{"llamas"}, splitAnnotationBody("llamas", 10))
+
+	// Lines are kept together where possible
+	assert.Equal(t, []string{"llamas\n", "alpacas\n", "camels"}, splitAnnotationBody("llamas\nalpacas\ncamels", 10))
+
+	// Otherwise it's split at the size, but never in the middle of a
+	// character
+	assert.Equal(t, []string{"llamas", "llamas"}, splitAnnotationBody("llamasllamas", 6))
+	assert.Equal(t, []string{"ll", "🦙", "🦙"}, splitAnnotationBody("ll🦙🦙", 5))
+
+	body := strings.Repeat("| llama | alpaca |\n", 1000)
+	chunks := splitAnnotationBody(body, 1024)
+	assert.Equal(t, body, strings.Join(chunks, ""))
+	for _, chunk := range chunks {
+		assert.True(t, len(chunk) <= 1024)
+		assert.True(t, strings.HasSuffix(chunk, "\n"))
+	}
+}
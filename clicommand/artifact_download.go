@@ -31,13 +31,35 @@ Example:
 
    $ buildkite-agent artifact download "pkg/*.tar.gz" . --step "tests" --build xxx
 
-   You can also use the step's jobs id (provided by the environment variable $BUILDKITE_JOB_ID)`
+   You can also use the step's jobs id (provided by the environment variable $BUILDKITE_JOB_ID)
+
+   Artifacts are downloaded in parallel, by default one at a time per CPU. If
+   you're downloading lots of small files you can turn that up:
+
+   $ buildkite-agent artifact download "dist/**/*" . --concurrency 32
+
+   Downloaded files are checked against the checksums recorded when they were
+   uploaded, and any file that doesn't match fails the download and is
+   removed. Artifacts uploaded without a SHA256 checksum only fail the download
+   if you pass --verify:
+
+   $ buildkite-agent artifact download "pkg/*.tar.gz" . --verify
+
+   Instead of downloading them, you can print a URL for each artifact. URLs for
+   artifacts in S3 and Google Cloud Storage are signed, so they can be fetched
+   without any credentials for the next hour:
+
+   $ buildkite-agent artifact download "pkg/*.tar.gz" --url-only`
 
 type ArtifactDownloadConfig struct {
 	Query            string `cli:"arg:0" label:"artifact search query" validate:"required"`
-	Destination      string `cli:"arg:1" label:"artifact download path" validate:"required"`
+	Destination      string `cli:"arg:1" label:"artifact download path"`
 	Step             string `cli:"step"`
 	Build            string `cli:"build" validate:"required"`
+	Concurrency      int    `cli:"concurrency"`
+	Retries          int    `cli:"retries"`
+	Verify           bool   `cli:"verify"`
+	URLOnly          bool   `cli:"url-only"`
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoColor          bool   `cli:"no-color"`
@@ -61,6 +83,27 @@ var ArtifactDownloadCommand = cli.Command{
 			EnvVar: "BUILDKITE_BUILD_ID",
 			Usage:  "The build that the artifacts were uploaded to",
 		},
+		cli.IntFlag{
+			Name:   "concurrency",
+			Value:  0,
+			Usage:  "How many artifacts to download at once (defaults to the number of CPUs)",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_CONCURRENCY",
+		},
+		cli.IntFlag{
+			Name:   "retries",
+			Value:  5,
+			Usage:  "How many times to retry downloading each artifact before giving up, 0 only tries once",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_RETRIES",
+		},
+		cli.BoolFlag{
+			Name:   "verify",
+			Usage:  "Fail if an artifact doesn't have a SHA256 checksum recorded when it was uploaded to check it against",
+			EnvVar: "BUILDKITE_ARTIFACT_DOWNLOAD_VERIFY",
+		},
+		cli.BoolFlag{
+			Name:  "url-only",
+			Usage: "Print a URL for each artifact instead of downloading them, which is signed for artifacts in S3 and Google Cloud Storage",
+		},
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoColorFlag,
@@ -72,10 +115,16 @@ var ArtifactDownloadCommand = cli.Command{
 		cfg := ArtifactDownloadConfig{}
 
 		// Load the configuration
-		if err := cliconfig.Load(c, &cfg); err != nil {
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		if err := loader.Load(); err != nil {
 			logger.Fatal("%s", err)
 		}
 
+		// Printing URLs doesn't need anywhere to download to
+		if cfg.Destination == "" && !cfg.URLOnly {
+			logger.Fatal("%s", loader.Errorf("Missing artifact download path."))
+		}
+
 		// Setup the any global configuration options
 		HandleGlobalFlags(cfg)
 
@@ -89,6 +138,10 @@ var ArtifactDownloadCommand = cli.Command{
 			Destination: cfg.Destination,
 			BuildID:     cfg.Build,
 			Step:        cfg.Step,
+			Concurrency: cfg.Concurrency,
+			Retries:     cfg.Retries,
+			Verify:      cfg.Verify,
+			URLOnly:     cfg.URLOnly,
 		}
 
 		// Download the artifacts
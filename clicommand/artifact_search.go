@@ -0,0 +1,130 @@
+package clicommand
+
+import (
+	"os"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/urfave/cli"
+)
+
+var SearchHelpDescription = `Usage:
+
+   buildkite-agent artifact search <query> [arguments...]
+
+Description:
+
+   Searches for artifacts in the build and prints to STDOUT their paths,
+   sizes, checksums and URLs, without downloading them. By default it
+   searches the build the command is run from, and prints a table.
+
+   Note: You need to ensure that your search query is surrounded by quotes if
+   using a wild card as the built-in shell path globbing will provide files,
+   which will break the search.
+
+Example:
+
+   $ buildkite-agent artifact search "pkg/*.tar.gz"
+
+   This will search across all the artifacts for the build with files that match
+   that path. The first argument is the search query.
+
+   If you would like to target artifacts from a specific build step, you can do
+   so by using the --step argument.
+
+   $ buildkite-agent artifact search "pkg/*.tar.gz" --step "tests" --build xxx
+
+   You can also use the step's job id (provided by the environment variable $BUILDKITE_JOB_ID)
+
+   To use the results in a script, print them as JSON instead:
+
+   $ buildkite-agent artifact search "pkg/*.tar.gz" --format json`
+
+type ArtifactSearchConfig struct {
+	Query            string `cli:"arg:0" label:"artifact search query" validate:"required"`
+	Step             string `cli:"step"`
+	Build            string `cli:"build" validate:"required"`
+	Format           string `cli:"format"`
+	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
+	Endpoint         string `cli:"endpoint" validate:"required"`
+	NoColor          bool   `cli:"no-color"`
+	Debug            bool   `cli:"debug"`
+	DebugHTTP        bool   `cli:"debug-http"`
+}
+
+var ArtifactSearchCommand = cli.Command{
+	Name:        "search",
+	Usage:       "Searches artifacts in Buildkite",
+	Description: SearchHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "step",
+			Value: "",
+			Usage: "Scope the search to a paticular step by using either it's name or job ID",
+		},
+		cli.StringFlag{
+			Name:   "build",
+			Value:  "",
+			EnvVar: "BUILDKITE_BUILD_ID",
+			Usage:  "The build that the artifacts were uploaded to",
+		},
+		cli.StringFlag{
+			Name:   "format",
+			Value:  "table",
+			EnvVar: "BUILDKITE_ARTIFACT_SEARCH_FORMAT",
+			Usage:  "How to print the artifacts that are found, either table or json",
+		},
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoColorFlag,
+		DebugFlag,
+		DebugHTTPFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := ArtifactSearchConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		if cfg.Format != "table" && cfg.Format != "json" {
+			logger.Fatal("Invalid format %q, it needs to be either table or json", cfg.Format)
+		}
+
+		// Find the artifacts that match the query
+		searcher := agent.ArtifactSearcher{
+			APIClient: agent.APIClient{
+				Endpoint: cfg.Endpoint,
+				Token:    cfg.AgentAccessToken,
+			}.Create(),
+			BuildID: cfg.Build,
+		}
+
+		artifacts, err := searcher.Search(cfg.Query, cfg.Step)
+		if err != nil {
+			logger.Fatal("Failed to find artifacts: %s", err)
+		}
+
+		if len(artifacts) == 0 {
+			logger.Info("No artifacts found")
+		} else {
+			logger.Debug("Found %d artifacts", len(artifacts))
+		}
+
+		if cfg.Format == "json" {
+			err = agent.WriteArtifactsJSON(os.Stdout, artifacts)
+		} else if len(artifacts) > 0 {
+			err = agent.WriteArtifactsTable(os.Stdout, artifacts)
+		}
+
+		if err != nil {
+			logger.Fatal("Failed to print the artifacts: %s", err)
+		}
+	},
+}
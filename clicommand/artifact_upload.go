@@ -23,6 +23,16 @@ Example:
 
    $ buildkite-agent artifact upload "log/**/*.log"
 
+   Several paths can be uploaded at once by separating them with a semicolon.
+   Paths that start with ! are left out of the upload, and a path can be sent
+   to a destination of its own by following it with -> and the destination:
+
+   $ buildkite-agent artifact upload "log/**/*.log;!log/debug/**;coverage/** -> s3://name-of-your-s3-bucket/coverage"
+
+   Files matching the patterns in a .buildkite-artifact-ignore file in the
+   working directory, one on each line, are never uploaded, including when
+   they're in a directory that's archived with --compress.
+
    You can also upload directly to Amazon S3 if you'd like to host your own artifacts:
 
    $ export BUILDKITE_S3_ACCESS_KEY_ID=xxx
@@ -34,12 +44,35 @@ Example:
    Or upload directly to Google Cloud Storage:
 
    $ export BUILDKITE_GS_ACL=private
-   $ buildkite-agent artifact upload "log/**/*.log" gs://name-of-your-gs-bucket/$BUILDKITE_JOB_ID`
+   $ buildkite-agent artifact upload "log/**/*.log" gs://name-of-your-gs-bucket/$BUILDKITE_JOB_ID
+
+   Or upload directly to Azure Blob Storage, authenticating with either a SAS
+   token or the managed identity of the machine (the default):
+
+   $ export BUILDKITE_AZURE_STORAGE_ACCOUNT=name-of-your-storage-account
+   $ export BUILDKITE_AZURE_BLOB_SAS_TOKEN="sv=...&sig=..." # optional
+   $ buildkite-agent artifact upload "log/**/*.log" azblob://name-of-your-container/$BUILDKITE_JOB_ID
+
+   Large files uploaded to S3 or Azure are sent in parts, and the progress of each
+   upload is saved so that running the same upload again after an
+   interruption carries on from the last part that was sent:
+
+   $ buildkite-agent artifact upload --multipart-part-size 64 "pkg/*.tar.gz" s3://name-of-your-s3-bucket/$BUILDKITE_JOB_ID
+
+   Files can be compressed with gzip or zstd before they're uploaded, with
+   directories that match being uploaded as a single tar. They're
+   decompressed again when they're downloaded with buildkite-agent artifact
+   download:
+
+   $ buildkite-agent artifact upload --compress zstd "dist" s3://name-of-your-s3-bucket/$BUILDKITE_JOB_ID`
 
 type ArtifactUploadConfig struct {
 	UploadPaths      string `cli:"arg:0" label:"upload paths" validate:"required"`
 	Destination      string `cli:"arg:1" label:"destination" env:"BUILDKITE_ARTIFACT_UPLOAD_DESTINATION"`
 	Job              string `cli:"job" validate:"required"`
+	PartSize         int    `cli:"multipart-part-size"`
+	StateDir         string `cli:"multipart-state-dir" normalize:"filepath"`
+	Compress         string `cli:"compress"`
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoColor          bool   `cli:"no-color"`
@@ -58,6 +91,24 @@ var ArtifactUploadCommand = cli.Command{
 			Usage:  "Which job should the artifacts be uploaded to",
 			EnvVar: "BUILDKITE_JOB_ID",
 		},
+		cli.IntFlag{
+			Name:   "multipart-part-size",
+			Value:  agent.DefaultMultipartPartSize / 1024 / 1024,
+			Usage:  "The size in MiB of each part when uploading large files in parts (S3 requires at least 5)",
+			EnvVar: "BUILDKITE_ARTIFACT_MULTIPART_PART_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "multipart-state-dir",
+			Value:  "",
+			Usage:  "Where to keep the progress of multipart uploads so they can be resumed (defaults to the system temp directory)",
+			EnvVar: "BUILDKITE_ARTIFACT_MULTIPART_STATE_DIR",
+		},
+		cli.StringFlag{
+			Name:   "compress",
+			Value:  "",
+			Usage:  "Compress the files before they're uploaded, either gzip or zstd, and upload directories as a single tar",
+			EnvVar: "BUILDKITE_ARTIFACT_COMPRESS",
+		},
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoColorFlag,
@@ -76,6 +127,10 @@ var ArtifactUploadCommand = cli.Command{
 		// Setup the any global configuration options
 		HandleGlobalFlags(cfg)
 
+		if err := agent.ValidateArtifactCompression(cfg.Compress); err != nil {
+			logger.Fatal("%s", err)
+		}
+
 		// Setup the uploader
 		uploader := agent.ArtifactUploader{
 			APIClient: agent.APIClient{
@@ -85,6 +140,9 @@ var ArtifactUploadCommand = cli.Command{
 			JobID:       cfg.Job,
 			Paths:       cfg.UploadPaths,
 			Destination: cfg.Destination,
+			PartSize:    int64(cfg.PartSize) * 1024 * 1024,
+			StateDir:    cfg.StateDir,
+			Compression: cfg.Compress,
 		}
 
 		// Upload the artifacts
@@ -7,6 +7,7 @@ import (
 	"github.com/buildkite/agent/bootstrap"
 	"github.com/buildkite/agent/cliconfig"
 	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/process"
 	"github.com/urfave/cli"
 )
 
@@ -26,34 +27,68 @@ Example:
    $ buildkite-agent bootstrap --build-path builds`
 
 type BootstrapConfig struct {
-	Command                      string `cli:"command"`
-	JobID                        string `cli:"job" validate:"required"`
-	Repository                   string `cli:"repository" validate:"required"`
-	Commit                       string `cli:"commit" validate:"required"`
-	Branch                       string `cli:"branch" validate:"required"`
-	Tag                          string `cli:"tag"`
-	RefSpec                      string `cli:"refspec"`
-	Plugins                      string `cli:"plugins"`
-	PullRequest                  string `cli:"pullrequest"`
-	GitSubmodules                bool   `cli:"git-submodules"`
-	SSHFingerprintVerification   bool   `cli:"ssh-fingerprint-verification"`
-	AgentName                    string `cli:"agent" validate:"required"`
-	OrganizationSlug             string `cli:"organization" validate:"required"`
-	PipelineSlug                 string `cli:"pipeline" validate:"required"`
-	PipelineProvider             string `cli:"pipeline-provider" validate:"required"`
-	AutomaticArtifactUploadPaths string `cli:"artifact-upload-paths"`
-	ArtifactUploadDestination    string `cli:"artifact-upload-destination"`
-	CleanCheckout                bool   `cli:"clean-checkout"`
-	GitCloneFlags                string `cli:"git-clone-flags"`
-	GitCleanFlags                string `cli:"git-clean-flags"`
-	BinPath                      string `cli:"bin-path" normalize:"filepath"`
-	BuildPath                    string `cli:"build-path" normalize:"filepath" validate:"required"`
-	HooksPath                    string `cli:"hooks-path" normalize:"filepath"`
-	PluginsPath                  string `cli:"plugins-path" normalize:"filepath"`
-	CommandEval                  bool   `cli:"command-eval"`
-	PluginsEnabled               bool   `cli:"plugins-enabled"`
-	PTY                          bool   `cli:"pty"`
-	Debug                        bool   `cli:"debug"`
+	Command                      string   `cli:"command"`
+	JobID                        string   `cli:"job" validate:"required"`
+	Repository                   string   `cli:"repository" validate:"required"`
+	Commit                       string   `cli:"commit" validate:"required"`
+	Branch                       string   `cli:"branch" validate:"required"`
+	Tag                          string   `cli:"tag"`
+	RefSpec                      string   `cli:"refspec"`
+	Plugins                      string   `cli:"plugins"`
+	PullRequest                  string   `cli:"pullrequest"`
+	GitSubmodules                bool     `cli:"git-submodules"`
+	SSHFingerprintVerification   bool     `cli:"ssh-fingerprint-verification"`
+	SSHKnownHosts                []string `cli:"ssh-known-hosts"`
+	SSHHostKeyVerification       string   `cli:"ssh-host-key-verification"`
+	GitCredentialsProvider       string   `cli:"git-credentials-provider"`
+	AgentName                    string   `cli:"agent" validate:"required"`
+	OrganizationSlug             string   `cli:"organization" validate:"required"`
+	PipelineSlug                 string   `cli:"pipeline" validate:"required"`
+	PipelineProvider             string   `cli:"pipeline-provider" validate:"required"`
+	AutomaticArtifactUploadPaths string   `cli:"artifact-upload-paths"`
+	ArtifactUploadDestination    string   `cli:"artifact-upload-destination"`
+	TestResultPaths              string   `cli:"test-result-paths"`
+	CoveragePaths                string   `cli:"coverage-paths"`
+	CleanCheckout                bool     `cli:"clean-checkout"`
+	GitCloneFlags                string   `cli:"git-clone-flags"`
+	SCM                          string   `cli:"scm"`
+	GitCleanFlags                string   `cli:"git-clean-flags"`
+	GitCloneDepth                string   `cli:"git-clone-depth"`
+	GitFetchDepth                string   `cli:"git-fetch-depth"`
+	GitSparseCheckoutPaths       string   `cli:"git-sparse-checkout-paths"`
+	GitSubmoduleRecursionDepth   string   `cli:"git-submodule-recursion-depth"`
+	GitSubmoduleURLRewrites      []string `cli:"git-submodule-url-rewrites"`
+	GitCredentialsFile           string   `cli:"git-credentials-file" normalize:"filepath"`
+	GitMirrorsPath               string   `cli:"git-mirrors-path" normalize:"filepath"`
+	GitMirrorsLockTimeout        int      `cli:"git-mirrors-lock-timeout"`
+	GitMirrorsStaleAfter         int      `cli:"git-mirrors-stale-after"`
+	GitRetries                   int      `cli:"git-retries"`
+	GitRetryReclone              bool     `cli:"git-retry-reclone"`
+	BinPath                      string   `cli:"bin-path" normalize:"filepath"`
+	BuildPath                    string   `cli:"build-path" normalize:"filepath" validate:"required"`
+	HooksPath                    string   `cli:"hooks-path" normalize:"filepath"`
+	HooksOverlays                []string `cli:"hooks-overlays"`
+	PluginsPath                  string   `cli:"plugins-path" normalize:"filepath"`
+	CommandEval                  bool     `cli:"command-eval"`
+	Shell                        string   `cli:"shell"`
+	PluginsEnabled               bool     `cli:"plugins-enabled"`
+	StrictPluginVerification     bool     `cli:"strict-plugin-verification"`
+	PipelineVerificationKey      string   `cli:"pipeline-verification-key" normalize:"filepath"`
+	AllowedPlugins               []string `cli:"allowed-plugins"`
+	DeniedPlugins                []string `cli:"denied-plugins"`
+	DeniedPluginPhases           []string `cli:"denied-plugin-phases"`
+	HookTimeout                  int      `cli:"hook-timeout"`
+	CancelGracePeriod            int      `cli:"cancel-grace-period"`
+	JobSandbox                   string   `cli:"job-sandbox"`
+	JobSandboxWritablePaths      []string `cli:"job-sandbox-writable-paths"`
+	JobSandboxPullRequestsOnly   bool     `cli:"job-sandbox-pull-requests-only"`
+	JobUser                      string   `cli:"job-user"`
+	DevEnvironment               string   `cli:"dev-environment"`
+	Toolchain                    string   `cli:"toolchain"`
+	ToolchainCachePath           string   `cli:"toolchain-cache-path" normalize:"filepath"`
+	FailureReasonFile            string   `cli:"failure-reason-file" normalize:"filepath"`
+	PTY                          bool     `cli:"pty"`
+	Debug                        bool     `cli:"debug"`
 }
 
 var BootstrapCommand = cli.Command{
@@ -151,6 +186,18 @@ var BootstrapCommand = cli.Command{
 			Usage:  "A custom location to upload artifact paths to (i.e. s3://my-custom-bucket)",
 			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_DESTINATION",
 		},
+		cli.StringFlag{
+			Name:   "test-result-paths",
+			Value:  "",
+			Usage:  "Paths to JUnit XML or TAP files to summarize at the end of a job",
+			EnvVar: "BUILDKITE_TEST_RESULT_PATHS",
+		},
+		cli.StringFlag{
+			Name:   "coverage-paths",
+			Value:  "",
+			Usage:  "Paths to lcov or Cobertura coverage reports to annotate the build with at the end of a job",
+			EnvVar: "BUILDKITE_COVERAGE_PATHS",
+		},
 		cli.BoolFlag{
 			Name:   "clean-checkout",
 			Usage:  "Whether or not the bootstrap should remove the existing repository before running the command",
@@ -162,12 +209,83 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Flags to pass to \"git clone\" command",
 			EnvVar: "BUILDKITE_GIT_CLONE_FLAGS",
 		},
+		cli.StringFlag{
+			Name:   "scm",
+			Value:  "",
+			Usage:  "The source control system to check out the repository with, either \"git\" or \"mercurial\". Defaults to git unless the repository starts with \"hg+\"",
+			EnvVar: "BUILDKITE_SCM",
+		},
 		cli.StringFlag{
 			Name:   "git-clean-flags",
 			Value:  "-fxdq",
 			Usage:  "Flags to pass to \"git clean\" command",
 			EnvVar: "BUILDKITE_GIT_CLEAN_FLAGS",
 		},
+		cli.StringFlag{
+			Name:   "git-clone-depth",
+			Value:  "",
+			Usage:  "Create a shallow clone with this many commits of history",
+			EnvVar: "BUILDKITE_GIT_CLONE_DEPTH",
+		},
+		cli.StringFlag{
+			Name:   "git-fetch-depth",
+			Value:  "",
+			Usage:  "Fetch this many commits of history, defaults to the clone depth",
+			EnvVar: "BUILDKITE_GIT_FETCH_DEPTH",
+		},
+		cli.StringFlag{
+			Name:   "git-sparse-checkout-paths",
+			Value:  "",
+			Usage:  "Comma separated paths to check out instead of the whole repository",
+			EnvVar: "BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS",
+		},
+		cli.StringFlag{
+			Name:   "git-submodule-recursion-depth",
+			Value:  "",
+			Usage:  "How many levels of nested git submodules to check out, all of them if empty or 0",
+			EnvVar: "BUILDKITE_GIT_SUBMODULE_RECURSION_DEPTH",
+		},
+		cli.StringSliceFlag{
+			Name:   "git-submodule-url-rewrites",
+			Value:  &cli.StringSlice{},
+			Usage:  "Rewrites of git submodule urls in the form prefix=replacement",
+			EnvVar: "BUILDKITE_GIT_SUBMODULE_URL_REWRITES",
+		},
+		cli.StringFlag{
+			Name:   "git-credentials-file",
+			Value:  "",
+			Usage:  "Path to a git-credentials file used when checking out git submodules",
+			EnvVar: "BUILDKITE_GIT_CREDENTIALS_FILE",
+		},
+		cli.StringFlag{
+			Name:   "git-mirrors-path",
+			Value:  "",
+			Usage:  "Path where mirrors of git repositories are kept and cloned from",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_PATH",
+		},
+		cli.IntFlag{
+			Name:   "git-mirrors-lock-timeout",
+			Value:  300,
+			Usage:  "Seconds to wait for another job to finish updating a git mirror, after which the repository is cloned without it",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "git-mirrors-stale-after",
+			Value:  86400,
+			Usage:  "Seconds a git mirror can go without being updated before it's checked for corruption, 0 means never",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_STALE_AFTER",
+		},
+		cli.IntFlag{
+			Name:   "git-retries",
+			Value:  2,
+			Usage:  "How many times to retry cloning and fetching after a transient git error, like the connection being reset",
+			EnvVar: "BUILDKITE_GIT_RETRIES",
+		},
+		cli.BoolFlag{
+			Name:   "git-retry-reclone",
+			Usage:  "Remove the checkout and clone it again on the last retry",
+			EnvVar: "BUILDKITE_GIT_RETRY_RECLONE",
+		},
 		cli.StringFlag{
 			Name:   "bin-path",
 			Value:  "",
@@ -186,6 +304,12 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Directory where the hook scripts are found",
 			EnvVar: "BUILDKITE_HOOKS_PATH",
 		},
+		cli.StringSliceFlag{
+			Name:   "hooks-overlays",
+			Value:  &cli.StringSlice{},
+			Usage:  "Directories of hooks that are run after the global hooks for the pipelines or repositories they match, i.e. \"pipeline:team-a-*=/etc/buildkite-agent/hooks/team-a\"",
+			EnvVar: "BUILDKITE_HOOKS_OVERLAYS",
+		},
 		cli.StringFlag{
 			Name:   "plugins-path",
 			Value:  "",
@@ -197,16 +321,128 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Allow running of arbitary commands",
 			EnvVar: "BUILDKITE_COMMAND_EVAL",
 		},
+		cli.StringFlag{
+			Name:   "shell",
+			Value:  "",
+			Usage:  "The shell to run the command with followed by its arguments, e.g. \"pwsh -Command\". Defaults to bash, or batch on Windows",
+			EnvVar: "BUILDKITE_SHELL",
+		},
 		cli.BoolTFlag{
 			Name:   "plugins-enabled",
 			Usage:  "Allow plugins to be run",
 			EnvVar: "BUILDKITE_PLUGINS_ENABLED",
 		},
+		cli.BoolFlag{
+			Name:   "strict-plugin-verification",
+			Usage:  "Only run plugins that are pinned to a commit or sha256, and verified after checkout",
+			EnvVar: "BUILDKITE_STRICT_PLUGIN_VERIFICATION",
+		},
+		cli.StringFlag{
+			Name:   "pipeline-verification-key",
+			Value:  "",
+			Usage:  "Path to the ed25519 public key (PEM) that the job's step has to be signed with",
+			EnvVar: "BUILDKITE_PIPELINE_VERIFICATION_KEY",
+		},
+		cli.StringSliceFlag{
+			Name:   "allowed-plugins",
+			Value:  &cli.StringSlice{},
+			Usage:  "Glob patterns of plugin repositories that are allowed to run",
+			EnvVar: "BUILDKITE_ALLOWED_PLUGINS",
+		},
+		cli.StringSliceFlag{
+			Name:   "denied-plugins",
+			Value:  &cli.StringSlice{},
+			Usage:  "Glob patterns of plugin repositories that aren't allowed to run",
+			EnvVar: "BUILDKITE_DENIED_PLUGINS",
+		},
+		cli.StringSliceFlag{
+			Name:   "denied-plugin-phases",
+			Value:  &cli.StringSlice{},
+			Usage:  "Phases of the job that plugins aren't allowed to replace with their own hooks",
+			EnvVar: "BUILDKITE_DENIED_PLUGIN_PHASES",
+		},
+		cli.IntFlag{
+			Name:   "hook-timeout",
+			Value:  0,
+			Usage:  "The number of seconds a hook can run for before it's killed, 0 means no timeout",
+			EnvVar: "BUILDKITE_HOOK_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "cancel-grace-period",
+			Value:  10,
+			Usage:  "The number of seconds the pre-exit hooks have to finish once the job is cancelled and what it was running is killed",
+			EnvVar: "BUILDKITE_CANCEL_GRACE_PERIOD",
+		},
+		cli.StringFlag{
+			Name:   "job-sandbox",
+			Value:  "",
+			Usage:  "The sandbox to run the command and the hooks from the checkout and plugins in, either none or bubblewrap",
+			EnvVar: "BUILDKITE_JOB_SANDBOX",
+		},
+		cli.StringSliceFlag{
+			Name:   "job-sandbox-writable-paths",
+			Value:  &cli.StringSlice{},
+			Usage:  "Paths outside of the checkout that the command can write to in the sandbox",
+			EnvVar: "BUILDKITE_JOB_SANDBOX_WRITABLE_PATHS",
+		},
+		cli.BoolFlag{
+			Name:   "job-sandbox-pull-requests-only",
+			Usage:  "Only run the commands of pull request builds in the sandbox",
+			EnvVar: "BUILDKITE_JOB_SANDBOX_PULL_REQUESTS_ONLY",
+		},
+		cli.StringFlag{
+			Name:   "job-user",
+			Value:  "",
+			Usage:  "The user to run the command and the hooks from the checkout and plugins as, by name or UID, who's given the checkout first. A checkout the user's had is removed to be cloned again rather than checked out by the bootstrap's user (linux only)",
+			EnvVar: "BUILDKITE_JOB_USER",
+		},
+		cli.StringFlag{
+			Name:   "dev-environment",
+			Value:  "",
+			Usage:  "Enter the environment the checkout declares before the command is run, one of auto, nix-flake, nix-shell, devbox or none",
+			EnvVar: "BUILDKITE_DEV_ENVIRONMENT",
+		},
+		cli.StringFlag{
+			Name:   "toolchain",
+			Value:  "",
+			Usage:  "Install the tool versions pinned in the checkout before the command is run, with asdf or mise",
+			EnvVar: "BUILDKITE_TOOLCHAIN",
+		},
+		cli.StringFlag{
+			Name:   "toolchain-cache-path",
+			Value:  "",
+			Usage:  "Where tools are installed, which defaults to a directory in the build path",
+			EnvVar: "BUILDKITE_TOOLCHAIN_CACHE_PATH",
+		},
+		cli.StringFlag{
+			Name:   "failure-reason-file",
+			Value:  "",
+			Usage:  "The file to write why the job failed to, which the agent reports to Buildkite",
+			EnvVar: "BUILDKITE_FAILURE_REASON_FILE",
+		},
 		cli.BoolTFlag{
 			Name:   "ssh-fingerprint-verification",
 			Usage:  "Automatically verify SSH fingerprints",
 			EnvVar: "BUILDKITE_AUTO_SSH_FINGERPRINT_VERIFICATION",
 		},
+		cli.StringSliceFlag{
+			Name:   "ssh-known-hosts",
+			Value:  &cli.StringSlice{},
+			Usage:  "Hosts to add to known_hosts before anything is checked out, either a host or host=SHA256:fingerprint to pin one of it's keys",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS",
+		},
+		cli.StringFlag{
+			Name:   "ssh-host-key-verification",
+			Value:  "",
+			Usage:  "How hosts that aren't in known_hosts are trusted, either accept-new or strict, which only adds hosts with pinned fingerprints",
+			EnvVar: "BUILDKITE_SSH_HOST_KEY_VERIFICATION",
+		},
+		cli.StringFlag{
+			Name:   "git-credentials-provider",
+			Value:  "",
+			Usage:  "Have git get the credentials for HTTPS checkouts from buildkite-agent git-credentials-helper, either github-app or gitlab-job-token",
+			EnvVar: "BUILDKITE_GIT_CREDENTIALS_PROVIDER",
+		},
 		cli.BoolTFlag{
 			Name:   "git-submodules",
 			Usage:  "Enable git submodules",
@@ -228,47 +464,85 @@ var BootstrapCommand = cli.Command{
 			logger.Fatal("%s", err)
 		}
 
-		// Turn of PTY support if we're on Windows
-		runInPty := cfg.PTY
-		if runtime.GOOS == "windows" {
-			runInPty = false
-		}
-
-		// Configure the bootstraper
-		bootstrap := &bootstrap.Bootstrap{
-			Config: bootstrap.Config{
-				Command:                      cfg.Command,
-				JobID:                        cfg.JobID,
-				Repository:                   cfg.Repository,
-				Commit:                       cfg.Commit,
-				Branch:                       cfg.Branch,
-				Tag:                          cfg.Tag,
-				RefSpec:                      cfg.RefSpec,
-				Plugins:                      cfg.Plugins,
-				GitSubmodules:                cfg.GitSubmodules,
-				PullRequest:                  cfg.PullRequest,
-				GitCloneFlags:                cfg.GitCloneFlags,
-				GitCleanFlags:                cfg.GitCleanFlags,
-				AgentName:                    cfg.AgentName,
-				PipelineProvider:             cfg.PipelineProvider,
-				PipelineSlug:                 cfg.PipelineSlug,
-				OrganizationSlug:             cfg.OrganizationSlug,
-				AutomaticArtifactUploadPaths: cfg.AutomaticArtifactUploadPaths,
-				ArtifactUploadDestination:    cfg.ArtifactUploadDestination,
-				CleanCheckout:                cfg.CleanCheckout,
-				BuildPath:                    cfg.BuildPath,
-				BinPath:                      cfg.BinPath,
-				HooksPath:                    cfg.HooksPath,
-				PluginsPath:                  cfg.PluginsPath,
-				Debug:                        cfg.Debug,
-				RunInPty:                     runInPty,
-				CommandEval:                  cfg.CommandEval,
-				PluginsEnabled:               cfg.PluginsEnabled,
-				SSHFingerprintVerification:   cfg.SSHFingerprintVerification,
-			},
-		}
-
 		// Run the bootstrap and exit with whatever it returns
-		os.Exit(bootstrap.Start())
+		os.Exit(newBootstrap(cfg).Start())
 	},
 }
+
+// Returns the bootstrap configured for the job
+func newBootstrap(cfg BootstrapConfig) *bootstrap.Bootstrap {
+	// Turn of PTY support if we're on a version of Windows without
+	// ConPTY
+	runInPty := cfg.PTY
+	if runtime.GOOS == "windows" && !process.PTYSupported() {
+		runInPty = false
+	}
+
+	// Configure the bootstraper
+	return &bootstrap.Bootstrap{
+		Config: bootstrap.Config{
+			Command:                      cfg.Command,
+			JobID:                        cfg.JobID,
+			Repository:                   cfg.Repository,
+			Commit:                       cfg.Commit,
+			Branch:                       cfg.Branch,
+			Tag:                          cfg.Tag,
+			RefSpec:                      cfg.RefSpec,
+			Plugins:                      cfg.Plugins,
+			GitSubmodules:                cfg.GitSubmodules,
+			PullRequest:                  cfg.PullRequest,
+			GitCloneFlags:                cfg.GitCloneFlags,
+			SCM:                          cfg.SCM,
+			GitCleanFlags:                cfg.GitCleanFlags,
+			GitCloneDepth:                cfg.GitCloneDepth,
+			GitFetchDepth:                cfg.GitFetchDepth,
+			GitSparseCheckoutPaths:       cfg.GitSparseCheckoutPaths,
+			GitSubmoduleRecursionDepth:   cfg.GitSubmoduleRecursionDepth,
+			GitSubmoduleURLRewrites:      cfg.GitSubmoduleURLRewrites,
+			GitCredentialsFile:           cfg.GitCredentialsFile,
+			GitMirrorsPath:               cfg.GitMirrorsPath,
+			GitMirrorsLockTimeout:        cfg.GitMirrorsLockTimeout,
+			GitMirrorsStaleAfter:         cfg.GitMirrorsStaleAfter,
+			GitRetries:                   cfg.GitRetries,
+			GitRetryReclone:              cfg.GitRetryReclone,
+			AgentName:                    cfg.AgentName,
+			PipelineProvider:             cfg.PipelineProvider,
+			PipelineSlug:                 cfg.PipelineSlug,
+			OrganizationSlug:             cfg.OrganizationSlug,
+			AutomaticArtifactUploadPaths: cfg.AutomaticArtifactUploadPaths,
+			ArtifactUploadDestination:    cfg.ArtifactUploadDestination,
+			TestResultPaths:              cfg.TestResultPaths,
+			CoveragePaths:                cfg.CoveragePaths,
+			CleanCheckout:                cfg.CleanCheckout,
+			BuildPath:                    cfg.BuildPath,
+			BinPath:                      cfg.BinPath,
+			HooksPath:                    cfg.HooksPath,
+			HooksOverlays:                cfg.HooksOverlays,
+			PluginsPath:                  cfg.PluginsPath,
+			Debug:                        cfg.Debug,
+			RunInPty:                     runInPty,
+			CommandEval:                  cfg.CommandEval,
+			Shell:                        cfg.Shell,
+			PluginsEnabled:               cfg.PluginsEnabled,
+			StrictPluginVerification:     cfg.StrictPluginVerification,
+			PipelineVerificationKey:      cfg.PipelineVerificationKey,
+			AllowedPlugins:               cfg.AllowedPlugins,
+			DeniedPlugins:                cfg.DeniedPlugins,
+			DeniedPluginPhases:           cfg.DeniedPluginPhases,
+			HookTimeout:                  cfg.HookTimeout,
+			CancelGracePeriod:            cfg.CancelGracePeriod,
+			JobSandbox:                   cfg.JobSandbox,
+			JobSandboxWritablePaths:      cfg.JobSandboxWritablePaths,
+			JobSandboxPullRequestsOnly:   cfg.JobSandboxPullRequestsOnly,
+			JobUser:                      cfg.JobUser,
+			DevEnvironment:               cfg.DevEnvironment,
+			Toolchain:                    cfg.Toolchain,
+			ToolchainCachePath:           cfg.ToolchainCachePath,
+			FailureReasonFile:            cfg.FailureReasonFile,
+			SSHFingerprintVerification:   cfg.SSHFingerprintVerification,
+			SSHKnownHosts:                cfg.SSHKnownHosts,
+			SSHHostKeyVerification:       cfg.SSHHostKeyVerification,
+			GitCredentialsProvider:       cfg.GitCredentialsProvider,
+		},
+	}
+}
@@ -0,0 +1,131 @@
+package clicommand
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/env"
+	"github.com/urfave/cli"
+)
+
+// Runs the bootstrap for a job within the agent, configured from the job's
+// environment just as `buildkite-agent bootstrap` would be, but without
+// reading or changing the agent's own
+func runBootstrapInProcess(ctx context.Context, environ []string, output io.Writer, signals <-chan os.Signal) int {
+	cfg, err := loadBootstrapConfig(environ)
+	if err != nil {
+		fmt.Fprintf(output, "Error loading the bootstrap's configuration: %v\n", err)
+		return 1
+	}
+
+	b := newBootstrap(cfg)
+	b.Environ = environ
+	b.Output = output
+	b.Signals = signals
+
+	return b.RunPhases(ctx)
+}
+
+// Loads the bootstrap's configuration from an environment rather than the
+// process's, with the bootstrap command's flags so they're read the same way
+func loadBootstrapConfig(environ []string) (BootstrapConfig, error) {
+	cfg := BootstrapConfig{}
+	vars := env.FromSlice(environ)
+
+	set := flag.NewFlagSet(BootstrapCommand.Name, flag.ContinueOnError)
+	set.SetOutput(ioutil.Discard)
+
+	for _, f := range BootstrapCommand.Flags {
+		if err := applyFlagFromEnv(f, set, vars); err != nil {
+			return cfg, err
+		}
+	}
+
+	c := cli.NewContext(&cli.App{Name: "buildkite-agent"}, set, nil)
+	c.Command = BootstrapCommand
+
+	err := cliconfig.Load(c, &cfg)
+	return cfg, err
+}
+
+// Adds the flag to the set with it's value from the environment instead of
+// the process's
+func applyFlagFromEnv(f cli.Flag, set *flag.FlagSet, vars *env.Environment) error {
+	var envVar string
+	var isBool bool
+
+	// The flags are copies, so their environment variables can be
+	// cleared without changing the command's
+	switch typed := f.(type) {
+	case cli.StringFlag:
+		envVar, typed.EnvVar = typed.EnvVar, ""
+		f = typed
+	case cli.IntFlag:
+		envVar, typed.EnvVar = typed.EnvVar, ""
+		f = typed
+	case cli.BoolFlag:
+		envVar, typed.EnvVar = typed.EnvVar, ""
+		f, isBool = typed, true
+	case cli.BoolTFlag:
+		envVar, typed.EnvVar = typed.EnvVar, ""
+		f, isBool = typed, true
+	case cli.StringSliceFlag:
+		envVar, typed.EnvVar = typed.EnvVar, ""
+
+		// Slices are set with the values from the environment, so
+		// they aren't added to the default
+		value, ok := lookupFlagEnv(vars, envVar)
+		typed.Value = &cli.StringSlice{}
+		if ok {
+			for _, s := range strings.Split(value, ",") {
+				typed.Value.Set(strings.TrimSpace(s))
+			}
+		}
+		typed.Apply(set)
+		return nil
+	default:
+		return fmt.Errorf("The %s flag can't be read from the job's environment", f.GetName())
+	}
+
+	f.Apply(set)
+
+	value, ok := lookupFlagEnv(vars, envVar)
+	if !ok {
+		return nil
+	}
+
+	// Empty booleans are false, as they are when read from the process's
+	// environment
+	if isBool && value == "" {
+		value = "false"
+	}
+
+	name := strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+	if err := set.Set(name, value); err != nil {
+		return fmt.Errorf("%q isn't a valid value for %s (%v)", value, envVar, err)
+	}
+
+	return nil
+}
+
+// Returns the value of the first of the flag's comma separated environment
+// variables that's set
+func lookupFlagEnv(vars *env.Environment, envVar string) (string, bool) {
+	if envVar == "" {
+		return "", false
+	}
+
+	for _, name := range strings.Split(envVar, ",") {
+		if value, ok := vars.Get(strings.TrimSpace(name)); ok {
+			return value, true
+		}
+	}
+
+	return "", false
+}
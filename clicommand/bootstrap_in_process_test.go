@@ -0,0 +1,58 @@
+package clicommand
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The variables every job has, which the bootstrap needs
+var testJobEnv = []string{
+	"BUILDKITE_JOB_ID=1111-1111",
+	"BUILDKITE_REPO=https://github.com/buildkite/agent.git",
+	"BUILDKITE_COMMIT=HEAD",
+	"BUILDKITE_BRANCH=main",
+	"BUILDKITE_AGENT_NAME=llamas",
+	"BUILDKITE_ORGANIZATION_SLUG=buildkite",
+	"BUILDKITE_PIPELINE_SLUG=agent",
+	"BUILDKITE_PIPELINE_PROVIDER=github",
+	"BUILDKITE_BUILD_PATH=/tmp/builds",
+}
+
+func TestBootstrapConfigIsLoadedFromTheJobsEnvironment(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := loadBootstrapConfig(append(testJobEnv,
+		"BUILDKITE_COMMAND=make test",
+		"BUILDKITE_GIT_RETRIES=5",
+		"BUILDKITE_PLUGINS_ENABLED=false",
+		"BUILDKITE_ALLOWED_PLUGINS=docker, llamas/*",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "1111-1111", cfg.JobID)
+	assert.Equal(t, "make test", cfg.Command)
+	assert.Equal(t, 5, cfg.GitRetries)
+	assert.False(t, cfg.PluginsEnabled)
+	assert.Equal(t, []string{"docker", "llamas/*"}, cfg.AllowedPlugins)
+
+	// Flags that aren't in the environment have their defaults
+	assert.Equal(t, "-v", cfg.GitCloneFlags)
+	assert.True(t, cfg.CommandEval)
+
+	// And loading it again doesn't add to the slices
+	cfg, err = loadBootstrapConfig(append(testJobEnv, "BUILDKITE_ALLOWED_PLUGINS=docker"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"docker"}, cfg.AllowedPlugins)
+}
+
+func TestBootstrapConfigWithInvalidValuesIsntLoaded(t *testing.T) {
+	t.Parallel()
+
+	_, err := loadBootstrapConfig(append(testJobEnv, "BUILDKITE_GIT_RETRIES=llamas"))
+	assert.Error(t, err)
+}
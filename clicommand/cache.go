@@ -0,0 +1,48 @@
+package clicommand
+
+import (
+	"os"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/urfave/cli"
+)
+
+var CacheKeyFlag = cli.StringSliceFlag{
+	Name:  "key",
+	Value: &cli.StringSlice{},
+	Usage: "A key of the cache, which can be a template like 'node-{{ checksum \"yarn.lock\" }}' (can be used more than once)",
+}
+
+var CacheDestinationFlag = cli.StringFlag{
+	Name:   "destination",
+	Value:  "",
+	Usage:  "Where caches are kept, an s3://, gs:// or azblob:// location (defaults to the artifact upload destination)",
+	EnvVar: "BUILDKITE_CACHE_DESTINATION,BUILDKITE_ARTIFACT_UPLOAD_DESTINATION",
+}
+
+var CachePipelineFlag = cli.StringFlag{
+	Name:   "pipeline",
+	Value:  "",
+	Usage:  "The pipeline the cache belongs to, which keeps it apart from the caches of other pipelines",
+	EnvVar: "BUILDKITE_PIPELINE_SLUG",
+}
+
+var CacheCompressFlag = cli.StringFlag{
+	Name:   "compress",
+	Value:  "gzip",
+	Usage:  "How caches are compressed, either gzip or zstd",
+	EnvVar: "BUILDKITE_CACHE_COMPRESS",
+}
+
+// Expands the templates of cache keys with the environment of the job
+func expandCacheKeys(templates []string) ([]string, error) {
+	var keys []string
+	for _, template := range templates {
+		key, err := agent.ExpandCacheKey(template, os.Getenv)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,92 @@
+package clicommand
+
+import (
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/urfave/cli"
+)
+
+var CacheRestoreHelpDescription = `Usage:
+
+   buildkite-agent cache restore [arguments...]
+
+Description:
+
+   Restores a cache saved by buildkite-agent cache save into the working
+   directory. Each of the keys is tried in turn, and the first one that has
+   a cache is restored, so the keys after the first are fallbacks for when
+   there isn't an exact match. The keys are templates, the same as for
+   buildkite-agent cache save.
+
+   It isn't an error for there to be no cache, the build just carries on
+   without one.
+
+Example:
+
+   $ buildkite-agent cache restore \
+       --key 'node-{{ checksum "yarn.lock" }}' \
+       --key 'node-{{ .Branch }}' \
+       --key 'node-{{ .DefaultBranch }}'`
+
+type CacheRestoreConfig struct {
+	Keys        []string `cli:"key" label:"cache key" validate:"required"`
+	Destination string   `cli:"destination"`
+	Pipeline    string   `cli:"pipeline"`
+	Compress    string   `cli:"compress"`
+	NoColor     bool     `cli:"no-color"`
+	Debug       bool     `cli:"debug"`
+	DebugHTTP   bool     `cli:"debug-http"`
+}
+
+var CacheRestoreCommand = cli.Command{
+	Name:        "restore",
+	Usage:       "Restores files from a cache saved by an earlier build",
+	Description: CacheRestoreHelpDescription,
+	Flags: []cli.Flag{
+		CacheKeyFlag,
+		CacheDestinationFlag,
+		CachePipelineFlag,
+		CacheCompressFlag,
+		NoColorFlag,
+		DebugFlag,
+		DebugHTTPFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := CacheRestoreConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		if err := agent.ValidateArtifactCompression(cfg.Compress); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		keys, err := expandCacheKeys(cfg.Keys)
+		if err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		cache := agent.Cache{
+			Destination: cfg.Destination,
+			Pipeline:    cfg.Pipeline,
+			Compression: cfg.Compress,
+			DebugHTTP:   cfg.DebugHTTP,
+		}
+
+		key, err := cache.Restore(keys)
+		if err != nil {
+			logger.Fatal("Failed to restore the cache: %s", err)
+		}
+
+		if key == "" {
+			logger.Info("No cache was found, carrying on without one")
+		}
+	},
+}
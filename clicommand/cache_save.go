@@ -0,0 +1,99 @@
+package clicommand
+
+import (
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/urfave/cli"
+)
+
+var CacheSaveHelpDescription = `Usage:
+
+   buildkite-agent cache save <paths> [arguments...]
+
+Description:
+
+   Archives the files and directories that match the paths, and saves them
+   as a cache that later builds of the pipeline can restore with
+   buildkite-agent cache restore. Caches are kept alongside artifacts in S3,
+   Google Cloud Storage or Azure Blob Storage, in the artifact upload
+   destination unless --destination is used.
+
+   The keys of the cache are templates, which can use the branch of the build
+   and the checksum of files, so that the cache changes when they do:
+
+     {{ .Branch }}                   The branch of the build
+     {{ .DefaultBranch }}            The default branch of the pipeline
+     {{ .OS }} and {{ .Arch }}       The operating system and architecture
+     {{ env "NAME" }}                An environment variable
+     {{ checksum "yarn.lock" }}      A checksum of the files that match
+
+   The cache is saved under each of the keys, so it can also be found by a
+   broader one when restoring, like one for the branch.
+
+   Note: You need to ensure that your paths are surrounded by quotes if
+   using a wild card as the built-in shell path globbing will provide files,
+   which will break the upload.
+
+Example:
+
+   $ buildkite-agent cache save "node_modules" \
+       --key 'node-{{ checksum "yarn.lock" }}' --key 'node-{{ .Branch }}'`
+
+type CacheSaveConfig struct {
+	Paths       string   `cli:"arg:0" label:"cache paths" validate:"required"`
+	Keys        []string `cli:"key" label:"cache key" validate:"required"`
+	Destination string   `cli:"destination"`
+	Pipeline    string   `cli:"pipeline"`
+	Compress    string   `cli:"compress"`
+	NoColor     bool     `cli:"no-color"`
+	Debug       bool     `cli:"debug"`
+	DebugHTTP   bool     `cli:"debug-http"`
+}
+
+var CacheSaveCommand = cli.Command{
+	Name:        "save",
+	Usage:       "Saves files as a cache for later builds",
+	Description: CacheSaveHelpDescription,
+	Flags: []cli.Flag{
+		CacheKeyFlag,
+		CacheDestinationFlag,
+		CachePipelineFlag,
+		CacheCompressFlag,
+		NoColorFlag,
+		DebugFlag,
+		DebugHTTPFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := CacheSaveConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		if err := agent.ValidateArtifactCompression(cfg.Compress); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		keys, err := expandCacheKeys(cfg.Keys)
+		if err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		cache := agent.Cache{
+			Destination: cfg.Destination,
+			Pipeline:    cfg.Pipeline,
+			Compression: cfg.Compress,
+			DebugHTTP:   cfg.DebugHTTP,
+		}
+
+		if err := cache.Save(keys, cfg.Paths); err != nil {
+			logger.Fatal("Failed to save the cache: %s", err)
+		}
+	},
+}
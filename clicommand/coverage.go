@@ -0,0 +1,249 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/retry"
+	"github.com/urfave/cli"
+)
+
+var CoverageHelpDescription = `Usage:
+
+   buildkite-agent coverage <pattern> [arguments...]
+
+Description:
+
+   Reads lcov or Cobertura XML coverage reports, merges them into a summary of
+   how many lines are covered, and annotates the build with it. The reports
+   are uploaded as artifacts, and the summary is saved to the build's
+   meta-data as JSON under coverage:<job id> unless you give a --meta-data-key.
+
+   Reports are Cobertura if they're XML, and lcov otherwise. Multiple patterns
+   can be separated with ;
+
+   When there's somewhere to keep caches, builds of the base branch save their
+   coverage, and builds of other branches show how theirs compares with it.
+   The base branch is the one a pull request is being merged into, or the
+   pipeline's default branch. See buildkite-agent cache save --help.
+
+   Coverage is reported automatically at the end of a job when
+   BUILDKITE_COVERAGE_PATHS is set.
+
+Example:
+
+   $ buildkite-agent coverage "coverage/lcov.info"
+   $ buildkite-agent coverage "reports/**/cobertura.xml" --destination s3://my-bucket/caches`
+
+type CoverageConfig struct {
+	Paths                     string `cli:"arg:0" label:"coverage paths" validate:"required"`
+	Name                      string `cli:"name"`
+	Context                   string `cli:"context"`
+	MetaDataKey               string `cli:"meta-data-key"`
+	ArtifactUploadDestination string `cli:"artifact-upload-destination"`
+	Destination               string `cli:"destination"`
+	Pipeline                  string `cli:"pipeline"`
+	Branch                    string `cli:"branch"`
+	BaseBranch                string `cli:"base-branch"`
+	Job                       string `cli:"job" validate:"required"`
+	AgentAccessToken          string `cli:"agent-access-token" validate:"required"`
+	Endpoint                  string `cli:"endpoint" validate:"required"`
+	NoColor                   bool   `cli:"no-color"`
+	Debug                     bool   `cli:"debug"`
+	DebugHTTP                 bool   `cli:"debug-http"`
+}
+
+var CoverageCommand = cli.Command{
+	Name:        "coverage",
+	Usage:       "Summarizes lcov or Cobertura coverage reports, and annotates the build with how it's changed",
+	Description: CoverageHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "name",
+			Value:  "Coverage",
+			Usage:  "What the coverage is shown as in the annotation, and saved as for the base branch, which defaults to the step's label",
+			EnvVar: "BUILDKITE_LABEL",
+		},
+		cli.StringFlag{
+			Name:   "context",
+			Value:  "coverage",
+			Usage:  "The context of the coverage annotation",
+			EnvVar: "BUILDKITE_COVERAGE_CONTEXT",
+		},
+		cli.StringFlag{
+			Name:   "meta-data-key",
+			Value:  "",
+			Usage:  "The meta-data key the summary is saved to, which defaults to coverage:<job id>",
+			EnvVar: "BUILDKITE_COVERAGE_META_DATA_KEY",
+		},
+		cli.StringFlag{
+			Name:   "artifact-upload-destination",
+			Value:  "",
+			Usage:  "A custom location to upload the reports to (i.e. s3://my-custom-bucket)",
+			EnvVar: "BUILDKITE_ARTIFACT_UPLOAD_DESTINATION",
+		},
+		CacheDestinationFlag,
+		CachePipelineFlag,
+		cli.StringFlag{
+			Name:   "branch",
+			Value:  "",
+			Usage:  "The branch of the build",
+			EnvVar: "BUILDKITE_BRANCH",
+		},
+		cli.StringFlag{
+			Name:   "base-branch",
+			Value:  "",
+			Usage:  "The branch coverage is compared with, which defaults to the pull request's base branch or the pipeline's default branch",
+			EnvVar: "BUILDKITE_COVERAGE_BASE_BRANCH",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job the coverage is from",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoColorFlag,
+		DebugFlag,
+		DebugHTTPFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := CoverageConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		summary, err := agent.SummarizeCoverage(cfg.Paths)
+		if err != nil {
+			logger.Fatal("Failed to find coverage reports: %s", err)
+		}
+
+		if summary.Reports == 0 {
+			logger.Warn("No coverage reports found matching %s", cfg.Paths)
+			return
+		}
+
+		logger.Info("%d of %d lines are covered (%.2f%%) in %d files, from %d reports",
+			summary.Covered, summary.Lines, summary.Percent, summary.Files, summary.Reports)
+
+		// Create the API client
+		client := agent.APIClient{
+			Endpoint: cfg.Endpoint,
+			Token:    cfg.AgentAccessToken,
+		}.Create()
+
+		uploader := agent.ArtifactUploader{
+			APIClient:   client,
+			JobID:       cfg.Job,
+			Paths:       cfg.Paths,
+			Destination: cfg.ArtifactUploadDestination,
+		}
+
+		if err := uploader.Upload(); err != nil {
+			logger.Fatal("Failed to upload the coverage reports: %s", err)
+		}
+
+		data, err := json.Marshal(summary)
+		if err != nil {
+			logger.Fatal("Failed to encode the coverage summary: %s", err)
+		}
+
+		key := cfg.MetaDataKey
+		if key == "" {
+			key = "coverage:" + cfg.Job
+		}
+
+		metaData := &api.MetaData{Key: key, Value: string(data)}
+
+		err = retry.Do(func(s *retry.Stats) error {
+			resp, err := client.MetaData.Set(cfg.Job, metaData)
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+				s.Break()
+			}
+			if err != nil {
+				logger.Warn("%s (%s)", err, s)
+			}
+
+			return err
+		}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+		if err != nil {
+			logger.Fatal("Failed to save the coverage summary to meta-data %q: %s", key, err)
+		}
+
+		logger.Info("Saved the coverage summary to meta-data %q", key)
+
+		// Builds of the base branch save the baseline that others are
+		// compared with
+		baseBranch := coverageBaseBranch(cfg.BaseBranch)
+		var baseline *agent.CoverageSummary
+
+		if baseBranch != "" && cfg.Destination == "" {
+			logger.Info("Not comparing coverage with %s, there's nowhere to keep caches", baseBranch)
+		} else if baseBranch != "" {
+			cache := agent.Cache{
+				Destination: cfg.Destination,
+				Pipeline:    cfg.Pipeline,
+				DebugHTTP:   cfg.DebugHTTP,
+			}
+			baselineKey := agent.CoverageBaselineKey(cfg.Name, baseBranch)
+
+			if baseBranch == cfg.Branch {
+				if err := agent.SaveCoverageBaseline(cache, baselineKey, summary); err != nil {
+					logger.Warn("Failed to save the coverage of %s: %s", baseBranch, err)
+				}
+			} else if baseline, err = agent.LoadCoverageBaseline(cache, baselineKey); err != nil {
+				logger.Warn("Failed to find the coverage of %s: %s", baseBranch, err)
+			} else if baseline == nil {
+				logger.Info("There's no coverage from %s to compare with", baseBranch)
+			}
+		}
+
+		style := "info"
+		if baseline != nil && summary.Percent < baseline.Percent {
+			style = "warning"
+		}
+
+		// Each job has its own section of the annotation, so the coverage
+		// of different steps is shown together
+		annotation := &api.Annotation{
+			Body:    summary.Annotation(cfg.Name, baseline, baseBranch),
+			Style:   style,
+			Context: cfg.Context,
+			Section: cfg.Job,
+		}
+
+		if err := createAnnotation(client, cfg.Job, annotation); err != nil {
+			logger.Fatal("Failed to annotate build: %s", err)
+		}
+
+		logger.Info("Annotated the build with the coverage")
+	},
+}
+
+// Returns the branch coverage is compared with, either what's been configured,
+// where a pull request is being merged to, or the default branch
+func coverageBaseBranch(configured string) string {
+	if configured != "" {
+		return configured
+	}
+
+	if pr := os.Getenv("BUILDKITE_PULL_REQUEST"); pr != "" && pr != "false" {
+		if base := os.Getenv("BUILDKITE_PULL_REQUEST_BASE_BRANCH"); base != "" {
+			return base
+		}
+	}
+
+	return os.Getenv("BUILDKITE_PIPELINE_DEFAULT_BRANCH")
+}
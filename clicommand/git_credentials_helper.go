@@ -0,0 +1,140 @@
+package clicommand
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/urfave/cli"
+)
+
+var GitCredentialsHelperHelpDescription = `Usage:
+
+   buildkite-agent git-credentials-helper <action> [arguments...]
+
+Description:
+
+   A git credential helper that answers with short-lived credentials instead
+   of a token stored on the agent. With the github-app provider, they're
+   installation tokens for the repository being checked out, minted by the
+   running agent with its GitHub App. With gitlab-job-token, they're the job's
+   CI_JOB_TOKEN.
+
+   The bootstrap configures git to use it when the agent has a git
+   credentials provider, so there's usually no need to run it yourself. Only
+   the get action answers, as the credentials aren't stored anywhere.
+
+Example:
+
+   $ git config --global credential.helper "!buildkite-agent git-credentials-helper"
+   $ git config --global credential.useHttpPath true`
+
+type GitCredentialsHelperConfig struct {
+	Action                 string `cli:"arg:0" label:"action" validate:"required"`
+	GitCredentialsProvider string `cli:"git-credentials-provider"`
+	ControlSocket          string `cli:"control-socket" normalize:"filepath"`
+	NoColor                bool   `cli:"no-color"`
+	Debug                  bool   `cli:"debug"`
+}
+
+var GitCredentialsHelperCommand = cli.Command{
+	Name:        "git-credentials-helper",
+	Usage:       "Answers git with short-lived credentials for the checkout",
+	Description: GitCredentialsHelperHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "git-credentials-provider",
+			Value:  "",
+			Usage:  "Where the credentials come from, either github-app or gitlab-job-token",
+			EnvVar: "BUILDKITE_GIT_CREDENTIALS_PROVIDER",
+		},
+		ControlSocketFlag,
+		NoColorFlag,
+		DebugFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := GitCredentialsHelperConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		// Git also asks helpers to store and erase credentials, which
+		// there's nothing to do for
+		if cfg.Action != "get" {
+			return
+		}
+
+		if err := answerGitCredentials(cfg, os.Stdin, os.Stdout); err != nil {
+			logger.Fatal("Failed to get the git credentials: %s", err)
+		}
+	},
+}
+
+// Reads what git wants credentials for, and writes back the username and
+// password. Nothing is written if there are none for the repository, so git
+// carries on to its other helpers.
+func answerGitCredentials(cfg GitCredentialsHelperConfig, in io.Reader, out io.Writer) error {
+	request := map[string]string{}
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		if parts := strings.SplitN(line, "=", 2); len(parts) == 2 {
+			request[parts[0]] = parts[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// Tokens are only ever sent over HTTPS
+	if request["protocol"] != "https" {
+		return nil
+	}
+
+	var username, password string
+
+	switch cfg.GitCredentialsProvider {
+	case agent.GitCredentialsGitHubApp:
+		response, err := agent.ControlClient{Path: cfg.ControlSocket}.Do(agent.ControlRequest{
+			Command:   agent.ControlGitCredentials,
+			GitHost:   request["host"],
+			GitPath:   request["path"],
+			GitSecret: os.Getenv(agent.GitCredentialsSecretEnv),
+		})
+		if err != nil {
+			return err
+		}
+		username, password = response.GitUsername, response.GitPassword
+	case agent.GitCredentialsGitLabJobToken:
+		username, password = "gitlab-ci-token", os.Getenv("CI_JOB_TOKEN")
+		if password == "" {
+			return fmt.Errorf("The job doesn't have a CI_JOB_TOKEN")
+		}
+	case "":
+		return nil
+	default:
+		return fmt.Errorf("Unknown git credentials provider %q", cfg.GitCredentialsProvider)
+	}
+
+	if username == "" {
+		return nil
+	}
+
+	_, err := fmt.Fprintf(out, "username=%s\npassword=%s\n", username, password)
+	return err
+}
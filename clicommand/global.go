@@ -1,9 +1,13 @@
 package clicommand
 
 import (
+	"os"
+	"strings"
+
 	"github.com/buildkite/agent/agent"
 	"github.com/buildkite/agent/experiments"
 	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/proxy"
 	"github.com/oleiade/reflections"
 	"github.com/urfave/cli"
 )
@@ -22,10 +26,17 @@ var AgentAccessTokenFlag = cli.StringFlag{
 var EndpointFlag = cli.StringFlag{
 	Name:   "endpoint",
 	Value:  DefaultEndpoint,
-	Usage:  "The Agent API endpoint",
+	Usage:  "The Agent API endpoint, which is talked to over an experimental gRPC stream if it's a grpc:// or grpcs:// URL",
 	EnvVar: "BUILDKITE_AGENT_ENDPOINT",
 }
 
+var ControlSocketFlag = cli.StringFlag{
+	Name:   "control-socket",
+	Value:  agent.DefaultControlSocketPath(),
+	Usage:  "The unix socket (or named pipe on Windows) that the running agent is controlled with",
+	EnvVar: "BUILDKITE_AGENT_CONTROL_SOCKET",
+}
+
 var DebugFlag = cli.BoolFlag{
 	Name:   "debug",
 	Usage:  "Enable debug mode",
@@ -51,6 +62,20 @@ var ExperimentsFlag = cli.StringSliceFlag{
 	EnvVar: "BUILDKITE_AGENT_EXPERIMENT",
 }
 
+var LogFormatFlag = cli.StringFlag{
+	Name:   "log-format",
+	Value:  "text",
+	Usage:  "The format of the agent's logs, either \"text\" or \"json\"",
+	EnvVar: "BUILDKITE_LOG_FORMAT",
+}
+
+var LogSinksFlag = cli.StringSliceFlag{
+	Name:   "log-sink",
+	Value:  &cli.StringSlice{},
+	Usage:  "Where to write the agent's logs, any of \"stderr\", \"file:///path/to/log?max-size=100&max-backups=5\", \"syslog\" or \"syslog://host:514\". Defaults to stderr",
+	EnvVar: "BUILDKITE_LOG_SINKS",
+}
+
 func HandleGlobalFlags(cfg interface{}) {
 	// Enable debugging if a Debug option is present
 	debug, err := reflections.GetField(cfg, "Debug")
@@ -64,12 +89,44 @@ func HandleGlobalFlags(cfg interface{}) {
 		agent.APIClientEnableHTTPDebug()
 	}
 
+	// Use the proxy the agent passed on to the job, if any
+	if err := agent.APIClientConfigureProxy(proxy.FromEnvironment()); err != nil {
+		logger.Fatal("%s", err)
+	}
+
+	// And the client certificate
+	if err := agent.APIClientConfigureTLS(os.Getenv("BUILDKITE_TLS_CLIENT_CERT"), os.Getenv("BUILDKITE_TLS_CLIENT_KEY"), os.Getenv("BUILDKITE_TLS_CA")); err != nil {
+		logger.Fatal("%s", err)
+	}
+
 	// Turn off color if a NoColor option is present
 	noColor, err := reflections.GetField(cfg, "NoColor")
 	if noColor == true && err == nil {
 		logger.SetColors(false)
 	}
 
+	// Change the format of the logs
+	logFormat, err := reflections.GetField(cfg, "LogFormat")
+	if logFormatString, ok := logFormat.(string); ok && logFormatString != "" && err == nil {
+		if err := logger.SetFormat(logFormatString); err != nil {
+			logger.Fatal("%s", err)
+		}
+	}
+
+	// Change where the logs are written
+	logSinks, err := reflections.GetField(cfg, "LogSinks")
+	if logSinksSlice, ok := logSinks.([]string); ok && len(logSinksSlice) > 0 && err == nil {
+		sinks := []logger.Sink{}
+		for _, s := range logSinksSlice {
+			sink, err := logger.ParseSink(strings.TrimSpace(s))
+			if err != nil {
+				logger.Fatal("Failed to set up the log sink \"%s\": %s", s, err)
+			}
+			sinks = append(sinks, sink)
+		}
+		logger.SetSinks(sinks)
+	}
+
 	// Enable experiments
 	experimentNames, err := reflections.GetField(cfg, "Experiments")
 	if err == nil {
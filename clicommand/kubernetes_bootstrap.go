@@ -0,0 +1,203 @@
+package clicommand
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/kubernetes"
+	"github.com/buildkite/agent/logger"
+	"github.com/mattn/go-shellwords"
+	"github.com/urfave/cli"
+)
+
+var KubernetesBootstrapHelpDescription = `Usage:
+
+   buildkite-agent kubernetes-bootstrap [arguments...]
+
+Description:
+
+   The kubernetes-bootstrap command runs the job in a Kubernetes pod of it's
+   own, instead of on the agent's machine. The pod runs the bootstrap in the
+   image, which needs to have buildkite-agent installed. The pod's output is
+   streamed back as the job's log, and the pod is deleted once it finishes.
+
+   It's used in place of the bootstrap when the agent is started with
+   --job-executor kubernetes, and it needs permission to create, get and
+   delete pods, to get their logs, and to create and delete secrets. The
+   job's secret environment, like it's token, is kept in a secret of the
+   job's that's deleted with the pod, rather than in the pod itself.
+
+Example:
+
+   $ buildkite-agent kubernetes-bootstrap --job 1234 --image buildkite/agent:3`
+
+type KubernetesBootstrapConfig struct {
+	JobID             string   `cli:"job" validate:"required"`
+	Image             string   `cli:"image" validate:"required"`
+	Namespace         string   `cli:"namespace"`
+	CPU               string   `cli:"cpu"`
+	Memory            string   `cli:"memory"`
+	NodeSelector      []string `cli:"node-selector"`
+	Command           string   `cli:"command"`
+	JobEnv            []string `cli:"job-env"`
+	SecretEnv         []string `cli:"secret-env"`
+	APIEndpoint       string   `cli:"api-endpoint"`
+	CancelGracePeriod int      `cli:"cancel-grace-period"`
+	Debug             bool     `cli:"debug"`
+}
+
+var KubernetesBootstrapCommand = cli.Command{
+	Name:        "kubernetes-bootstrap",
+	Usage:       "Run a job in a Kubernetes pod",
+	Description: KubernetesBootstrapHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "The ID of the job being run",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+		cli.StringFlag{
+			Name:   "image",
+			Value:  "",
+			Usage:  "The image to run the job in, which needs to have buildkite-agent installed",
+			EnvVar: "BUILDKITE_KUBERNETES_IMAGE",
+		},
+		cli.StringFlag{
+			Name:   "namespace",
+			Value:  "",
+			Usage:  "The namespace to create the pod in, defaults to the agent's namespace",
+			EnvVar: "BUILDKITE_KUBERNETES_NAMESPACE",
+		},
+		cli.StringFlag{
+			Name:   "cpu",
+			Value:  "",
+			Usage:  "The CPU the job needs, i.e. 500m or 2",
+			EnvVar: "BUILDKITE_KUBERNETES_CPU",
+		},
+		cli.StringFlag{
+			Name:   "memory",
+			Value:  "",
+			Usage:  "The memory the job needs, i.e. 512Mi or 4Gi",
+			EnvVar: "BUILDKITE_KUBERNETES_MEMORY",
+		},
+		cli.StringSliceFlag{
+			Name:   "node-selector",
+			Value:  &cli.StringSlice{},
+			Usage:  "Labels of the nodes the job can run on, in the form key=value",
+			EnvVar: "BUILDKITE_KUBERNETES_NODE_SELECTOR",
+		},
+		cli.StringFlag{
+			Name:   "command",
+			Value:  "buildkite-agent bootstrap",
+			Usage:  "The command that runs the bootstrap in the image",
+			EnvVar: "BUILDKITE_KUBERNETES_COMMAND",
+		},
+		cli.StringSliceFlag{
+			Name:   "job-env",
+			Value:  &cli.StringSlice{},
+			Usage:  "The names of the environment variables that are passed on to the pod",
+			EnvVar: "BUILDKITE_KUBERNETES_JOB_ENV",
+		},
+		cli.StringSliceFlag{
+			Name:   "secret-env",
+			Value:  &cli.StringSlice{},
+			Usage:  "The names of the environment variables passed on to the pod that are secret, which it gets from a secret of the job's",
+			EnvVar: "BUILDKITE_KUBERNETES_SECRET_ENV",
+		},
+		cli.StringFlag{
+			Name:   "api-endpoint",
+			Value:  "",
+			Usage:  "The Kubernetes API to use instead of the cluster's, i.e. http://localhost:8001 for kubectl proxy",
+			EnvVar: "BUILDKITE_KUBERNETES_API",
+		},
+		cli.IntFlag{
+			Name:   "cancel-grace-period",
+			Value:  10,
+			Usage:  "The number of seconds a cancelled job's pod has to exit before it's killed",
+			EnvVar: "BUILDKITE_CANCEL_GRACE_PERIOD",
+		},
+		DebugFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := KubernetesBootstrapConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		command, err := shellwords.Parse(cfg.Command)
+		if err != nil || len(command) == 0 {
+			logger.Fatal("Invalid command %q", cfg.Command)
+		}
+
+		nodeSelector, err := kubernetes.ParseNodeSelector(cfg.NodeSelector)
+		if err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		var client *kubernetes.Client
+		if cfg.APIEndpoint != "" {
+			client = &kubernetes.Client{Endpoint: cfg.APIEndpoint}
+		} else if client, err = kubernetes.NewInClusterClient(); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		namespace := cfg.Namespace
+		if namespace == "" {
+			namespace = kubernetes.InClusterNamespace()
+		}
+
+		secret := map[string]bool{}
+		for _, name := range cfg.SecretEnv {
+			secret[name] = true
+		}
+
+		env, secretEnv := map[string]string{}, map[string]string{}
+		for _, name := range cfg.JobEnv {
+			if value, ok := os.LookupEnv(name); ok && secret[name] {
+				secretEnv[name] = value
+			} else if ok {
+				env[name] = value
+			}
+		}
+
+		opts := kubernetes.PodOptions{
+			JobID:        cfg.JobID,
+			Namespace:    namespace,
+			Image:        cfg.Image,
+			Command:      command,
+			Env:          env,
+			SecretEnv:    secretEnv,
+			CPU:          cfg.CPU,
+			Memory:       cfg.Memory,
+			NodeSelector: nodeSelector,
+		}
+
+		// The agent terminates the bootstrap to cancel the job, which is
+		// passed on to the pod
+		cancel := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			close(cancel)
+		}()
+
+		exitCode, err := kubernetes.RunJob(client, kubernetes.NewJobPod(opts), kubernetes.NewJobSecret(opts), os.Stdout, cancel, time.Duration(cfg.CancelGracePeriod)*time.Second)
+		if err != nil {
+			logger.Error("%s", err)
+			os.Exit(1)
+		}
+
+		os.Exit(exitCode)
+	},
+}
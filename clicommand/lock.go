@@ -0,0 +1,45 @@
+package clicommand
+
+import (
+	"github.com/buildkite/agent/agent"
+	"github.com/urfave/cli"
+)
+
+var LockTimeoutFlag = cli.IntFlag{
+	Name:   "timeout",
+	Value:  0,
+	Usage:  "How many seconds to wait for the lock before giving up, or 0 to wait for as long as it takes",
+	EnvVar: "BUILDKITE_LOCK_TIMEOUT",
+}
+
+var LockJobFlag = cli.StringFlag{
+	Name:   "job",
+	Value:  "",
+	Usage:  "The job holding the lock, which releases it when it finishes if it hasn't been already",
+	EnvVar: "BUILDKITE_JOB_ID",
+}
+
+// Waits for the running agent to give us the lock, and returns the token that
+// releases it
+func acquireLock(socket string, key string, jobID string, timeout int) (string, error) {
+	response, err := agent.ControlClient{Path: socket}.Do(agent.ControlRequest{
+		Command:     agent.ControlLockAcquire,
+		LockKey:     key,
+		LockJobID:   jobID,
+		LockTimeout: float64(timeout),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return response.LockToken, nil
+}
+
+func releaseLock(socket string, key string, token string) error {
+	_, err := agent.ControlClient{Path: socket}.Do(agent.ControlRequest{
+		Command:   agent.ControlLockRelease,
+		LockKey:   key,
+		LockToken: token,
+	})
+	return err
+}
@@ -0,0 +1,69 @@
+package clicommand
+
+import (
+	"fmt"
+
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/urfave/cli"
+)
+
+var LockAcquireHelpDescription = `Usage:
+
+   buildkite-agent lock acquire <key> [arguments...]
+
+Description:
+
+   Waits until no other job on this machine holds the lock, takes it, and
+   prints the token that releases it with buildkite-agent lock release. The
+   locks are kept by the agent running on this machine, so they're shared by
+   all of its jobs, and are released when the job that holds one finishes.
+
+Example:
+
+   $ token=$(buildkite-agent lock acquire ios-simulator)
+   $ ./run-ui-tests
+   $ buildkite-agent lock release ios-simulator "$token"`
+
+type LockAcquireConfig struct {
+	Key           string `cli:"arg:0" label:"lock key" validate:"required"`
+	Timeout       int    `cli:"timeout"`
+	Job           string `cli:"job"`
+	ControlSocket string `cli:"control-socket" normalize:"filepath"`
+	NoColor       bool   `cli:"no-color"`
+	Debug         bool   `cli:"debug"`
+}
+
+var LockAcquireCommand = cli.Command{
+	Name:        "acquire",
+	Usage:       "Waits for a lock that's shared by the jobs on this machine",
+	Description: LockAcquireHelpDescription,
+	Flags: []cli.Flag{
+		LockTimeoutFlag,
+		LockJobFlag,
+		ControlSocketFlag,
+		NoColorFlag,
+		DebugFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := LockAcquireConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		logger.Debug("Waiting for the lock %q", cfg.Key)
+
+		token, err := acquireLock(cfg.ControlSocket, cfg.Key, cfg.Job, cfg.Timeout)
+		if err != nil {
+			logger.Fatal("Failed to acquire the lock %q: %s", cfg.Key, err)
+		}
+
+		fmt.Println(token)
+	},
+}
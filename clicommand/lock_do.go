@@ -0,0 +1,106 @@
+package clicommand
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/buildkite/agent/bootstrap/shell"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/urfave/cli"
+)
+
+var LockDoHelpDescription = `Usage:
+
+   buildkite-agent lock do <key> <command> [arguments...]
+
+Description:
+
+   Runs the command while holding the lock, waiting for it first if another
+   job on this machine has it, and releases it once the command has finished.
+   It exits with the command's exit status. Arguments for lock do itself come
+   before the key, and everything after it is the command.
+
+Example:
+
+   $ buildkite-agent lock do ios-simulator ./run-ui-tests
+   $ buildkite-agent lock do --timeout 600 license-server -- make release`
+
+type LockDoConfig struct {
+	Key           string `cli:"arg:0" label:"lock key" validate:"required"`
+	Timeout       int    `cli:"timeout"`
+	Job           string `cli:"job"`
+	ControlSocket string `cli:"control-socket" normalize:"filepath"`
+	NoColor       bool   `cli:"no-color"`
+	Debug         bool   `cli:"debug"`
+}
+
+var LockDoCommand = cli.Command{
+	Name:        "do",
+	Usage:       "Runs a command while holding a lock that's shared by the jobs on this machine",
+	Description: LockDoHelpDescription,
+
+	// Anything after the key is the command, including its flags
+	SkipArgReorder: true,
+
+	Flags: []cli.Flag{
+		LockTimeoutFlag,
+		LockJobFlag,
+		ControlSocketFlag,
+		NoColorFlag,
+		DebugFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := LockDoConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		args := c.Args().Tail()
+		if len(args) > 0 && args[0] == "--" {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			logger.Fatal("Missing the command to run while holding the lock")
+		}
+
+		logger.Info("Waiting for the lock %q", cfg.Key)
+
+		token, err := acquireLock(cfg.ControlSocket, cfg.Key, cfg.Job, cfg.Timeout)
+		if err != nil {
+			logger.Fatal("Failed to acquire the lock %q: %s", cfg.Key, err)
+		}
+
+		// Signals are for the command, which is in the same process
+		// group, and the lock is released once it's finished with them
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		runErr := cmd.Run()
+
+		if err := releaseLock(cfg.ControlSocket, cfg.Key, token); err != nil {
+			logger.Error("Failed to release the lock %q: %s", cfg.Key, err)
+		}
+
+		if runErr != nil {
+			if _, ok := runErr.(*exec.ExitError); !ok {
+				logger.Error("%s", runErr)
+			}
+			os.Exit(shell.GetExitCode(runErr))
+		}
+	},
+}
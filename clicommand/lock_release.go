@@ -0,0 +1,56 @@
+package clicommand
+
+import (
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/urfave/cli"
+)
+
+var LockReleaseHelpDescription = `Usage:
+
+   buildkite-agent lock release <key> <token> [arguments...]
+
+Description:
+
+   Releases a lock acquired with buildkite-agent lock acquire, so the next job
+   waiting for it can take it. The token is the one printed when the lock was
+   acquired.
+
+Example:
+
+   $ buildkite-agent lock release ios-simulator "$token"`
+
+type LockReleaseConfig struct {
+	Key           string `cli:"arg:0" label:"lock key" validate:"required"`
+	Token         string `cli:"arg:1" label:"lock token" validate:"required"`
+	ControlSocket string `cli:"control-socket" normalize:"filepath"`
+	NoColor       bool   `cli:"no-color"`
+	Debug         bool   `cli:"debug"`
+}
+
+var LockReleaseCommand = cli.Command{
+	Name:        "release",
+	Usage:       "Releases a lock that's shared by the jobs on this machine",
+	Description: LockReleaseHelpDescription,
+	Flags: []cli.Flag{
+		ControlSocketFlag,
+		NoColorFlag,
+		DebugFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := LockReleaseConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		if err := releaseLock(cfg.ControlSocket, cfg.Key, cfg.Token); err != nil {
+			logger.Fatal("Failed to release the lock %q: %s", cfg.Key, err)
+		}
+	},
+}
@@ -22,7 +22,12 @@ Description:
 
 Example:
 
-   $ buildkite-agent meta-data get "foo"`
+   $ buildkite-agent meta-data get "foo"
+
+   If the key hasn't been set, it fails unless there's a default to print
+   instead, so there's no need to check it exists first:
+
+   $ buildkite-agent meta-data get "release-version" --default "unreleased"`
 
 type MetaDataGetConfig struct {
 	Key              string `cli:"arg:0" label:"meta-data key" validate:"required"`
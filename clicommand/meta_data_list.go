@@ -0,0 +1,140 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/retry"
+	"github.com/urfave/cli"
+)
+
+var MetaDataListHelpDescription = `Usage:
+
+   buildkite-agent meta-data list [arguments...]
+
+Description:
+
+   Prints the keys of all the meta-data that's been set on the build, one on
+   each line. With --json, it prints a JSON object of the keys and their
+   values instead.
+
+Example:
+
+   $ buildkite-agent meta-data list
+   $ buildkite-agent meta-data list --json > meta-data.json`
+
+type MetaDataListConfig struct {
+	JSON             bool   `cli:"json"`
+	Job              string `cli:"job" validate:"required"`
+	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
+	Endpoint         string `cli:"endpoint" validate:"required"`
+	NoColor          bool   `cli:"no-color"`
+	Debug            bool   `cli:"debug"`
+	DebugHTTP        bool   `cli:"debug-http"`
+}
+
+var MetaDataListCommand = cli.Command{
+	Name:        "list",
+	Usage:       "List the meta-data of a build",
+	Description: MetaDataListHelpDescription,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print a JSON object of the keys and their values",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job's build should the meta-data be listed for",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoColorFlag,
+		DebugFlag,
+		DebugHTTPFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := MetaDataListConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		// Create the API client
+		client := agent.APIClient{
+			Endpoint: cfg.Endpoint,
+			Token:    cfg.AgentAccessToken,
+		}.Create()
+
+		// Find the keys that have been set
+		var keys []string
+		err := retry.Do(func(s *retry.Stats) error {
+			var resp *api.Response
+			var err error
+			keys, resp, err = client.MetaData.Keys(cfg.Job)
+			// Don't bother retrying if the response was one of these statuses
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+				s.Break()
+				return err
+			}
+			if err != nil {
+				logger.Warn("%s (%s)", err, s)
+			}
+
+			return err
+		}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+		if err != nil {
+			logger.Fatal("Failed to list meta-data: %s", err)
+		}
+
+		sort.Strings(keys)
+
+		if !cfg.JSON {
+			for _, key := range keys {
+				fmt.Println(key)
+			}
+			return
+		}
+
+		// Get the value of each of them
+		values := map[string]string{}
+		for _, key := range keys {
+			err := retry.Do(func(s *retry.Stats) error {
+				metaData, resp, err := client.MetaData.Get(cfg.Job, key)
+				if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+					s.Break()
+					return err
+				}
+				if err != nil {
+					logger.Warn("%s (%s)", err, s)
+					return err
+				}
+
+				values[key] = metaData.Value
+				return nil
+			}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+			if err != nil {
+				logger.Fatal("Failed to get meta-data %q: %s", key, err)
+			}
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(values); err != nil {
+			logger.Fatal("Failed to print meta-data: %s", err)
+		}
+	},
+}
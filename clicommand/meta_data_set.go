@@ -1,8 +1,12 @@
 package clicommand
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/buildkite/agent/agent"
@@ -16,6 +20,7 @@ import (
 var MetaDataSetHelpDescription = `Usage:
 
    buildkite-agent meta-data set <key> [<value>] [arguments...]
+   buildkite-agent meta-data set --from-file <path> [arguments...]
 
 Description:
 
@@ -28,11 +33,19 @@ Example:
 
    $ buildkite-agent meta-data set "foo" "bar"
    $ buildkite-agent meta-data set "foo" < ./tmp/meta-data-value
-   $ ./script/meta-data-generator | buildkite-agent meta-data set "foo"`
+   $ ./script/meta-data-generator | buildkite-agent meta-data set "foo"
+
+   You can also set many keys at once from a JSON object of keys and values,
+   either in a file or piped in with --from-file -. Values that aren't strings
+   are set to their JSON:
+
+   $ buildkite-agent meta-data set --from-file meta-data.json
+   $ echo '{"foo": "bar", "count": 3}' | buildkite-agent meta-data set --from-file -`
 
 type MetaDataSetConfig struct {
-	Key              string `cli:"arg:0" label:"meta-data key" validate:"required"`
+	Key              string `cli:"arg:0" label:"meta-data key"`
 	Value            string `cli:"arg:1" label:"meta-data value"`
+	FromFile         string `cli:"from-file"`
 	Job              string `cli:"job" validate:"required"`
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
@@ -46,6 +59,11 @@ var MetaDataSetCommand = cli.Command{
 	Usage:       "Set data on a build",
 	Description: MetaDataSetHelpDescription,
 	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "from-file",
+			Value: "",
+			Usage: "Set the keys and values of a JSON object in the file, or - to read it from STDIN",
+		},
 		cli.StringFlag{
 			Name:   "job",
 			Value:  "",
@@ -63,22 +81,42 @@ var MetaDataSetCommand = cli.Command{
 		cfg := MetaDataSetConfig{}
 
 		// Load the configuration
-		if err := cliconfig.Load(c, &cfg); err != nil {
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		if err := loader.Load(); err != nil {
 			logger.Fatal("%s", err)
 		}
 
 		// Setup the any global configuration options
 		HandleGlobalFlags(cfg)
 
-		// Read the value from STDIN if argument omitted entirely
-		if len(c.Args()) < 2 {
-			logger.Info("Reading meta-data value from STDIN")
+		// A key is needed unless they're all coming from a file
+		if cfg.FromFile != "" && cfg.Key != "" {
+			logger.Fatal("%s", loader.Errorf("A meta-data key can't be used with --from-file."))
+		} else if cfg.FromFile == "" && cfg.Key == "" {
+			logger.Fatal("%s", loader.Errorf("Missing meta-data key."))
+		}
+
+		var metaData []*api.MetaData
 
-			input, err := ioutil.ReadAll(os.Stdin)
+		if cfg.FromFile != "" {
+			var err error
+			metaData, err = readMetaDataFile(cfg.FromFile)
 			if err != nil {
-				logger.Fatal("Failed to read from STDIN: %s", err)
+				logger.Fatal("Failed to read meta-data from %s: %s", cfg.FromFile, err)
+			}
+		} else {
+			// Read the value from STDIN if argument omitted entirely
+			if len(c.Args()) < 2 {
+				logger.Info("Reading meta-data value from STDIN")
+
+				input, err := ioutil.ReadAll(os.Stdin)
+				if err != nil {
+					logger.Fatal("Failed to read from STDIN: %s", err)
+				}
+				cfg.Value = string(input)
 			}
-			cfg.Value = string(input)
+
+			metaData = []*api.MetaData{{Key: cfg.Key, Value: cfg.Value}}
 		}
 
 		// Create the API client
@@ -87,26 +125,66 @@ var MetaDataSetCommand = cli.Command{
 			Token:    cfg.AgentAccessToken,
 		}.Create()
 
-		// Create the meta data to set
-		metaData := &api.MetaData{
-			Key:   cfg.Key,
-			Value: cfg.Value,
-		}
-
 		// Set the meta data
-		err := retry.Do(func(s *retry.Stats) error {
-			resp, err := client.MetaData.Set(cfg.Job, metaData)
-			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
-				s.Break()
-			}
+		for _, m := range metaData {
+			err := retry.Do(func(s *retry.Stats) error {
+				resp, err := client.MetaData.Set(cfg.Job, m)
+				if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+					s.Break()
+				}
+				if err != nil {
+					logger.Warn("%s (%s)", err, s)
+				}
+
+				return err
+			}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
 			if err != nil {
-				logger.Warn("%s (%s)", err, s)
+				logger.Fatal("Failed to set meta-data %q: %s", m.Key, err)
 			}
-
-			return err
-		}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
-		if err != nil {
-			logger.Fatal("Failed to set meta-data: %s", err)
 		}
 	},
 }
+
+// Reads meta-data from a JSON object of keys and values, with - reading it
+// from STDIN. The keys are sorted so they're always set in the same order.
+func readMetaDataFile(path string) ([]*api.MetaData, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		logger.Info("Reading meta-data from STDIN")
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("It needs to be a JSON object of keys and values (%v)", err)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	metaData := []*api.MetaData{}
+	for _, key := range keys {
+		if key == "" {
+			return nil, errors.New("Meta-data keys can't be empty")
+		}
+
+		// Strings are set as they are, and anything else as its JSON
+		var value string
+		if err := json.Unmarshal(values[key], &value); err != nil {
+			value = string(values[key])
+		}
+
+		metaData = append(metaData, &api.MetaData{Key: key, Value: value})
+	}
+
+	return metaData, nil
+}
@@ -0,0 +1,129 @@
+package clicommand
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/retry"
+	"github.com/urfave/cli"
+)
+
+var OIDCRequestTokenHelpDescription = `Usage:
+
+   buildkite-agent oidc request-token [arguments...]
+
+Description:
+
+   Requests an OIDC token signed by Buildkite for the current job, and prints
+   it. Its claims are the job's organization, pipeline, build, branch and
+   step, so AWS, GCP and Azure can be configured to trust tokens of
+   particular pipelines and branches in exchange for short-lived credentials
+   of their own, without any static cloud credentials on the agent.
+
+   The audience is who the token is for, which the cloud provider checks is
+   what it expects.
+
+Example:
+
+   $ buildkite-agent oidc request-token --audience sts.amazonaws.com > "$AWS_WEB_IDENTITY_TOKEN_FILE"
+   $ buildkite-agent oidc request-token --audience "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/buildkite/providers/buildkite" --lifetime 300`
+
+type OIDCRequestTokenConfig struct {
+	Audience         string `cli:"audience" validate:"required"`
+	Lifetime         int    `cli:"lifetime"`
+	Job              string `cli:"job" validate:"required"`
+	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
+	Endpoint         string `cli:"endpoint" validate:"required"`
+	NoColor          bool   `cli:"no-color"`
+	Debug            bool   `cli:"debug"`
+	DebugHTTP        bool   `cli:"debug-http"`
+}
+
+var OIDCRequestTokenCommand = cli.Command{
+	Name:        "request-token",
+	Usage:       "Requests and prints an OIDC token for the job",
+	Description: OIDCRequestTokenHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "audience",
+			Value: "",
+			Usage: "Who the token is for, which is its aud claim",
+		},
+		cli.IntFlag{
+			Name:  "lifetime",
+			Value: 0,
+			Usage: "How many seconds the token is valid for, which defaults to the API's default",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job the token is for",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoColorFlag,
+		DebugFlag,
+		DebugHTTPFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := OIDCRequestTokenConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		if cfg.Lifetime < 0 {
+			logger.Fatal("The lifetime of the token can't be negative")
+		}
+
+		// Create the API client
+		client := agent.APIClient{
+			Endpoint: cfg.Endpoint,
+			Token:    cfg.AgentAccessToken,
+		}.Create()
+
+		token, err := requestOIDCToken(client.OIDC, cfg.Job, &api.OIDCTokenRequest{
+			Audience: cfg.Audience,
+			Lifetime: cfg.Lifetime,
+		})
+		if err != nil {
+			logger.Fatal("Failed to get an OIDC token: %s", err)
+		}
+
+		// Output the token to STDOUT
+		fmt.Println(token.Token)
+	},
+}
+
+// Requests the token, retrying a few times before giving up
+func requestOIDCToken(oidc api.OIDCAPI, jobID string, request *api.OIDCTokenRequest) (*api.OIDCToken, error) {
+	var token *api.OIDCToken
+	err := retry.Do(func(s *retry.Stats) error {
+		var resp *api.Response
+		var err error
+		token, resp, err = oidc.Token(jobID, request)
+
+		// Don't bother retrying if the response was one of these statuses
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 403 || resp.StatusCode == 404 || resp.StatusCode == 400 || resp.StatusCode == 422) {
+			s.Break()
+			return err
+		}
+		if err != nil {
+			logger.Warn("%s (%s)", err, s)
+		}
+
+		return err
+	}, &retry.Config{Maximum: 5, Interval: 1 * time.Second, Jitter: true})
+
+	return token, err
+}
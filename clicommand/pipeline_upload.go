@@ -1,6 +1,8 @@
 package clicommand
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
@@ -41,13 +43,43 @@ Example:
 
    $ buildkite-agent pipeline upload
    $ buildkite-agent pipeline upload my-custom-pipeline.yml
-   $ ./script/dynamic_step_generator | buildkite-agent pipeline upload`
+   $ ./script/dynamic_step_generator | buildkite-agent pipeline upload
+
+   To check a pipeline without uploading it, i.e. before it's merged, use
+   --dry-run. It parses, interpolates and validates the pipeline, and prints
+   the JSON that would've been uploaded:
+
+   $ buildkite-agent pipeline upload --dry-run .buildkite/pipeline.yml
+
+   Steps with if_changed globs are only uploaded if any of the files that
+   have changed match them, which are found by diffing HEAD with where it
+   diverged from the pull request's base branch, the pipeline's default
+   branch, or otherwise the previous commit:
+
+   steps:
+     - command: make web
+       if_changed:
+         - "web/**"
+         - package.json
+
+   With --signing-key, each step's command, plugins and env are signed with
+   an ed25519 private key, along with the pipeline's env, so agents with
+   --pipeline-verification-key only run the steps as they were uploaded. Jobs
+   with any other env vars, apart from the BUILDKITE_* ones that Buildkite
+   sets itself, aren't run. Keys can be made with openssl:
+
+   $ openssl genpkey -algorithm ed25519 -out signing-key.pem
+   $ openssl pkey -in signing-key.pem -pubout -out verification-key.pem`
 
 type PipelineUploadConfig struct {
 	FilePath         string `cli:"arg:0" label:"upload paths"`
 	Replace          bool   `cli:"replace"`
-	Job              string `cli:"job" validate:"required"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
+	DryRun           bool   `cli:"dry-run"`
+	IfChangedBase    string `cli:"if-changed-base"`
+	NoInterpolation  bool   `cli:"no-interpolation"`
+	SigningKey       string `cli:"signing-key" normalize:"filepath"`
+	Job              string `cli:"job"`
+	AgentAccessToken string `cli:"agent-access-token"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoColor          bool   `cli:"no-color"`
 	Debug            bool   `cli:"debug"`
@@ -64,6 +96,28 @@ var PipelineUploadCommand = cli.Command{
 			Usage:  "Replace the rest of the existing pipeline with the steps uploaded. Jobs that are already running are not removed.",
 			EnvVar: "BUILDKITE_PIPELINE_REPLACE",
 		},
+		cli.BoolFlag{
+			Name:   "dry-run",
+			Usage:  "Parse, interpolate and validate the pipeline, and print it as JSON instead of uploading it",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_DRY_RUN",
+		},
+		cli.StringFlag{
+			Name:   "if-changed-base",
+			Value:  "",
+			Usage:  "The git ref to compare HEAD with to find the changed files for if_changed, instead of the pull request's base branch or the default branch",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_IF_CHANGED_BASE",
+		},
+		cli.BoolFlag{
+			Name:   "no-interpolation",
+			Usage:  "Upload the pipeline without interpolating environment variables into it, i.e. when it's already been interpolated",
+			EnvVar: "BUILDKITE_PIPELINE_NO_INTERPOLATION",
+		},
+		cli.StringFlag{
+			Name:   "signing-key",
+			Value:  "",
+			Usage:  "Path to an ed25519 private key (PEM) to sign the pipeline's steps with",
+			EnvVar: "BUILDKITE_PIPELINE_SIGNING_KEY",
+		},
 		cli.StringFlag{
 			Name:   "job",
 			Value:  "",
@@ -89,6 +143,16 @@ var PipelineUploadCommand = cli.Command{
 		// Setup the any global configuration options
 		HandleGlobalFlags(cfg)
 
+		// A dry run doesn't need to talk to Buildkite
+		if !cfg.DryRun {
+			if cfg.Job == "" {
+				logger.Fatal("%s", loader.Errorf("Missing job."))
+			}
+			if cfg.AgentAccessToken == "" {
+				logger.Fatal("%s", loader.Errorf("Missing agent-access-token."))
+			}
+		}
+
 		// Find the pipeline file either from STDIN or the first
 		// argument
 		var input []byte
@@ -159,11 +223,73 @@ var PipelineUploadCommand = cli.Command{
 		var parsed interface{}
 
 		// Parse the pipeline
-		parsed, err = agent.PipelineParser{Filename: filename, Pipeline: input}.Parse()
+		parsed, err = agent.PipelineParser{Filename: filename, Pipeline: input, NoInterpolation: cfg.NoInterpolation}.Parse()
 		if err != nil {
 			logger.Fatal("Pipeline parsing of \"%s\" failed (%s)", filename, err)
 		}
 
+		// Drop the steps that don't need to run for the files that were
+		// changed
+		if agent.PipelineUsesIfChanged(parsed) {
+			base := ifChangedBase(cfg.IfChangedBase)
+
+			changed, err := agent.ChangedFiles(".", base)
+			if err != nil {
+				logger.Warn("%s, so the steps with if_changed will all be uploaded", err)
+			} else {
+				logger.Info("Found %d files changed since %s", len(changed), base)
+			}
+
+			var removed []string
+			parsed, removed, err = agent.FilterPipelineIfChanged(parsed, changed)
+			if err != nil {
+				logger.Fatal("%s", err)
+			}
+
+			for _, label := range removed {
+				logger.Info("Skipping \"%s\" because none of it's if_changed files changed", label)
+			}
+		}
+
+		// Buildkite has the final say on whether the pipeline is valid, so
+		// problems found here only stop dry runs
+		if err := agent.ValidatePipeline(parsed); err != nil {
+			if cfg.DryRun {
+				logger.Fatal("%s", err)
+			}
+			logger.Warn("%s", err)
+		}
+
+		// Sign the steps last, so it's what's uploaded that's signed
+		if cfg.SigningKey != "" {
+			key, err := agent.LoadSigningKey(cfg.SigningKey)
+			if err != nil {
+				logger.Fatal("Failed to load the signing key (%s)", err)
+			}
+
+			repository := os.Getenv("BUILDKITE_REPO")
+			if repository == "" {
+				logger.Fatal("Signing the pipeline needs the repository it's for in BUILDKITE_REPO")
+			}
+
+			var signed int
+			parsed, signed, err = agent.SignPipeline(parsed, key, repository)
+			if err != nil {
+				logger.Fatal("%s", err)
+			}
+
+			logger.Info("Signed %d steps", signed)
+		}
+
+		if cfg.DryRun {
+			output, err := json.MarshalIndent(parsed, "", "  ")
+			if err != nil {
+				logger.Fatal("Failed to marshal the pipeline to JSON (%s)", err)
+			}
+			fmt.Println(string(output))
+			return
+		}
+
 		// Create the API client
 		client := agent.APIClient{
 			Endpoint: cfg.Endpoint,
@@ -191,3 +317,24 @@ var PipelineUploadCommand = cli.Command{
 		logger.Info("Successfully uploaded and parsed pipeline config")
 	},
 }
+
+// Returns the git ref to find changed files since, either what's been
+// configured, where a pull request is being merged to, or the default branch.
+// Builds of the default branch are compared with their previous commit.
+func ifChangedBase(configured string) string {
+	if configured != "" {
+		return configured
+	}
+
+	if pr := os.Getenv("BUILDKITE_PULL_REQUEST"); pr != "" && pr != "false" {
+		if base := os.Getenv("BUILDKITE_PULL_REQUEST_BASE_BRANCH"); base != "" {
+			return "origin/" + base
+		}
+	}
+
+	if defaultBranch := os.Getenv("BUILDKITE_PIPELINE_DEFAULT_BRANCH"); defaultBranch != "" && defaultBranch != os.Getenv("BUILDKITE_BRANCH") {
+		return "origin/" + defaultBranch
+	}
+
+	return "HEAD~1"
+}
@@ -0,0 +1,110 @@
+package clicommand
+
+import (
+	"time"
+
+	"github.com/buildkite/agent/bootstrap"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/urfave/cli"
+)
+
+var PluginCacheCleanHelpDescription = `Usage:
+
+   buildkite-agent plugin cache clean [arguments...]
+
+Description:
+
+   Removes plugin checkouts from the plugins directory that's shared by the
+   jobs on this machine. Plugins that are in the middle of being checked out
+   are left alone.
+
+   Checkouts are marked each time a job starts using them, so passing
+   --older-than will only remove plugins that haven't been used recently, and
+   is the safe way to clean up while jobs are running. Without it, plugins
+   that running jobs are using are removed too.
+
+Example:
+
+   $ buildkite-agent plugin cache clean --older-than 168h`
+
+type PluginCacheCleanConfig struct {
+	Config      string `cli:"config"`
+	PluginsPath string `cli:"plugins-path" normalize:"filepath" validate:"required"`
+	OlderThan   string `cli:"older-than"`
+	DryRun      bool   `cli:"dry-run"`
+	NoColor     bool   `cli:"no-color"`
+	Debug       bool   `cli:"debug"`
+}
+
+var PluginCacheCleanCommand = cli.Command{
+	Name:        "clean",
+	Usage:       "Removes cached plugin checkouts",
+	Description: PluginCacheCleanHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "Path to a configuration file",
+			EnvVar: "BUILDKITE_AGENT_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "plugins-path",
+			Value:  "",
+			Usage:  "Directory where the plugins are saved to",
+			EnvVar: "BUILDKITE_PLUGINS_PATH",
+		},
+		cli.StringFlag{
+			Name:  "older-than",
+			Value: "",
+			Usage: "Only remove plugins that haven't been used for this long, e.g. 24h",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Show the plugins that would be removed without removing them",
+		},
+		NoColorFlag,
+		DebugFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := PluginCacheCleanConfig{}
+
+		// Load the configuration, including the agent's config file
+		// which is where the plugins-path is usually set
+		loader := cliconfig.Loader{
+			CLI:                    c,
+			Config:                 &cfg,
+			DefaultConfigFilePaths: DefaultConfigFilePaths(),
+		}
+		if err := loader.Load(); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		var olderThan time.Duration
+		if cfg.OlderThan != "" {
+			var err error
+			olderThan, err = time.ParseDuration(cfg.OlderThan)
+			if err != nil {
+				logger.Fatal("Failed to parse older-than duration: %v", err)
+			}
+		}
+
+		removed, err := bootstrap.CleanPluginCache(cfg.PluginsPath, olderThan, cfg.DryRun)
+		for _, path := range removed {
+			if cfg.DryRun {
+				logger.Info("Would remove %s", path)
+			} else {
+				logger.Info("Removed %s", path)
+			}
+		}
+		if err != nil {
+			logger.Fatal("Failed to clean the plugin cache: %s", err)
+		}
+
+		logger.Info("Cleaned %d plugins from %s", len(removed), cfg.PluginsPath)
+	},
+}
@@ -0,0 +1,183 @@
+package clicommand
+
+import (
+	"os"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/urfave/cli"
+)
+
+var SelfUpdateHelpDescription = `Usage:
+
+   buildkite-agent self-update [arguments...]
+
+Description:
+
+   Downloads a release of the agent and replaces this binary with it, then
+   restarts the agent running on this machine once its jobs have finished.
+
+   Nothing is replaced unless the release's SHA256SUMS are signed by the
+   verification key, and the download matches them. The key is either a
+   minisign public key, with the signature in SHA256SUMS.minisig, or a cosign
+   public key, with the signature in SHA256SUMS.sig. The download has to be
+   of the version the agent asked for, and unless it's pinned to a version,
+   the agent is never updated to an older release than it's running.
+
+   New releases can be rolled out to some of a fleet first, with a canary
+   version that a percentage of the agents are updated to. Which agents are
+   in the canary is decided by the hash of their name, so the same agents are
+   in it each time self-update is run, and more join as the percentage is
+   raised. The rest are updated to the version, or the latest release of the
+   channel.
+
+Example:
+
+   $ buildkite-agent self-update --verification-key /etc/buildkite-agent/release.pub
+   $ buildkite-agent self-update --version 3.0-beta.36 --verification-key cosign.pub
+   $ buildkite-agent self-update --version 3.0 --canary-version 3.1 --canary-percentage 10 --verification-key release.pub`
+
+type SelfUpdateConfig struct {
+	Version          string `cli:"version"`
+	Channel          string `cli:"channel"`
+	Prerelease       bool   `cli:"prerelease"`
+	CanaryVersion    string `cli:"canary-version"`
+	CanaryPercentage int    `cli:"canary-percentage"`
+	Name             string `cli:"name"`
+	VerificationKey  string `cli:"verification-key" normalize:"filepath" validate:"required"`
+	ReleasesURL      string `cli:"releases-url"`
+	NoRestart        bool   `cli:"no-restart"`
+	ControlSocket    string `cli:"control-socket" normalize:"filepath"`
+	NoColor          bool   `cli:"no-color"`
+	Debug            bool   `cli:"debug"`
+}
+
+var SelfUpdateCommand = cli.Command{
+	Name:        "self-update",
+	Usage:       "Update the agent to a signed release",
+	Description: SelfUpdateHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "version",
+			Value:  "",
+			Usage:  "The version to update to, which defaults to the latest release of the channel",
+			EnvVar: "BUILDKITE_SELF_UPDATE_VERSION",
+		},
+		cli.StringFlag{
+			Name:   "channel",
+			Value:  agent.SelfUpdateChannelStable,
+			Usage:  "Which releases the latest is, either stable or beta, which includes prereleases",
+			EnvVar: "BUILDKITE_SELF_UPDATE_CHANNEL",
+		},
+		cli.BoolFlag{
+			Name:  "prerelease",
+			Usage: "Update to the latest release even if it's a prerelease, which is the same as --channel beta",
+		},
+		cli.StringFlag{
+			Name:   "canary-version",
+			Value:  "",
+			Usage:  "The version the agents in the canary are updated to",
+			EnvVar: "BUILDKITE_SELF_UPDATE_CANARY_VERSION",
+		},
+		cli.IntFlag{
+			Name:   "canary-percentage",
+			Value:  0,
+			Usage:  "The percentage of agents in the canary, from 0 to 100",
+			EnvVar: "BUILDKITE_SELF_UPDATE_CANARY_PERCENTAGE",
+		},
+		cli.StringFlag{
+			Name:   "name",
+			Value:  "",
+			Usage:  "The name that decides whether the agent is in the canary, which defaults to the hostname",
+			EnvVar: "BUILDKITE_AGENT_NAME",
+		},
+		cli.StringFlag{
+			Name:   "verification-key",
+			Value:  "",
+			Usage:  "The minisign or cosign public key the release's checksums are signed with",
+			EnvVar: "BUILDKITE_SELF_UPDATE_VERIFICATION_KEY",
+		},
+		cli.StringFlag{
+			Name:   "releases-url",
+			Value:  agent.DefaultReleasesURL,
+			Usage:  "Where to find the releases",
+			EnvVar: "BUILDKITE_SELF_UPDATE_RELEASES_URL",
+		},
+		cli.BoolFlag{
+			Name:  "no-restart",
+			Usage: "Don't restart the running agent, which runs the new version when it's next started",
+		},
+		ControlSocketFlag,
+		NoColorFlag,
+		DebugFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := SelfUpdateConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		if cfg.Prerelease {
+			cfg.Channel = agent.SelfUpdateChannelBeta
+		}
+
+		switch cfg.Channel {
+		case agent.SelfUpdateChannelStable, agent.SelfUpdateChannelBeta:
+		default:
+			logger.Fatal("Unknown channel %q, expected stable or beta", cfg.Channel)
+		}
+
+		if cfg.CanaryPercentage < 0 || cfg.CanaryPercentage > 100 {
+			logger.Fatal("The canary percentage needs to be from 0 to 100, got %d", cfg.CanaryPercentage)
+		}
+
+		if cfg.Name == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				logger.Fatal("Failed to find the hostname: %s", err)
+			}
+			cfg.Name = hostname
+		}
+
+		updater := &agent.SelfUpdater{
+			ReleasesURL:      cfg.ReleasesURL,
+			Version:          cfg.Version,
+			Channel:          cfg.Channel,
+			CanaryVersion:    cfg.CanaryVersion,
+			CanaryPercentage: cfg.CanaryPercentage,
+			Name:             cfg.Name,
+			VerificationKey:  cfg.VerificationKey,
+		}
+
+		version, updated, err := updater.Update()
+		if err != nil {
+			logger.Fatal("Failed to update the agent: %s", err)
+		}
+
+		if !updated {
+			logger.Info("The agent is already running %s", version)
+			return
+		}
+
+		logger.Info("Updated the agent to %s", version)
+
+		if cfg.NoRestart {
+			return
+		}
+
+		status, err := agent.ControlClient{Path: cfg.ControlSocket}.Send(agent.ControlRequest{Command: agent.ControlRestart})
+		if err != nil {
+			logger.Warn("The running agent couldn't be restarted, so it'll run %s when it's next started: %s", version, err)
+			return
+		}
+
+		printAgentStatus(status)
+	},
+}
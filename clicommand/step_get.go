@@ -0,0 +1,122 @@
+package clicommand
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/retry"
+	"github.com/urfave/cli"
+)
+
+var StepGetHelpDescription = `Usage:
+
+   buildkite-agent step get <attribute> [arguments...]
+
+Description:
+
+   Prints an attribute of a step in the build, such as its label, retry rules
+   or soft_fail setting. The step is found by its ID or key, and defaults to
+   the step of the current job.
+
+   Attributes that aren't strings, like retry, can be printed as JSON with
+   --format json.
+
+Example:
+
+   $ buildkite-agent step get "label" --step "key"
+   $ buildkite-agent step get "retry" --step "key" --format json
+   $ buildkite-agent step get "soft_fail"`
+
+type StepGetConfig struct {
+	Attribute        string `cli:"arg:0" label:"step attribute" validate:"required"`
+	Step             string `cli:"step" validate:"required"`
+	Build            string `cli:"build"`
+	Format           string `cli:"format"`
+	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
+	Endpoint         string `cli:"endpoint" validate:"required"`
+	NoColor          bool   `cli:"no-color"`
+	Debug            bool   `cli:"debug"`
+	DebugHTTP        bool   `cli:"debug-http"`
+}
+
+var StepGetCommand = cli.Command{
+	Name:        "get",
+	Usage:       "Get the value of an attribute of a step",
+	Description: StepGetHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "step",
+			Value:  "",
+			Usage:  "The ID or key of the step to get the attribute of",
+			EnvVar: "BUILDKITE_STEP_ID",
+		},
+		cli.StringFlag{
+			Name:   "build",
+			Value:  "",
+			Usage:  "The build to look for the step in, which is needed when the step is found by its key",
+			EnvVar: "BUILDKITE_BUILD_ID",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: "",
+			Usage: "The format to print the attribute in, e.g. json",
+		},
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoColorFlag,
+		DebugFlag,
+		DebugHTTPFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := StepGetConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		// Create the API client
+		client := agent.APIClient{
+			Endpoint: cfg.Endpoint,
+			Token:    cfg.AgentAccessToken,
+		}.Create()
+
+		export := &api.StepExport{
+			Build:     cfg.Build,
+			Attribute: cfg.Attribute,
+			Format:    cfg.Format,
+		}
+
+		// Find the value of the attribute
+		var result *api.StepExportResponse
+		err := retry.Do(func(s *retry.Stats) error {
+			var resp *api.Response
+			var err error
+			result, resp, err = client.Steps.Export(cfg.Step, export)
+			// Don't bother retrying if the response was one of these statuses
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+				s.Break()
+				return err
+			}
+			if err != nil {
+				logger.Warn("%s (%s)", err, s)
+			}
+
+			return err
+		}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+		if err != nil {
+			logger.Fatal("Failed to get step attribute %q: %s", cfg.Attribute, err)
+		}
+
+		// Output the value to STDOUT
+		fmt.Print(result.Output)
+	},
+}
@@ -0,0 +1,137 @@
+package clicommand
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/retry"
+	"github.com/urfave/cli"
+)
+
+var StepUpdateHelpDescription = `Usage:
+
+   buildkite-agent step update <attribute> [<value>] [arguments...]
+
+Description:
+
+   Changes an attribute of a step in the build that hasn't finished yet, such
+   as its label, retry rules or soft_fail setting. The step is found by its ID
+   or key, and defaults to the step of the current job.
+
+   You can supply the value as an argument to the command, or pipe in a file or
+   script output. Attributes that aren't strings, like retry, are set from
+   their JSON.
+
+Example:
+
+   $ buildkite-agent step update "label" "New label" --step "key"
+   $ buildkite-agent step update "label" " (attempt 2)" --append
+   $ buildkite-agent step update "soft_fail" "true" --step "key"
+   $ echo '{"automatic": [{"exit_status": -1, "limit": 2}]}' | buildkite-agent step update "retry" --step "key"`
+
+type StepUpdateConfig struct {
+	Attribute        string `cli:"arg:0" label:"step attribute" validate:"required"`
+	Value            string `cli:"arg:1" label:"step value"`
+	Append           bool   `cli:"append"`
+	Step             string `cli:"step" validate:"required"`
+	Build            string `cli:"build"`
+	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
+	Endpoint         string `cli:"endpoint" validate:"required"`
+	NoColor          bool   `cli:"no-color"`
+	Debug            bool   `cli:"debug"`
+	DebugHTTP        bool   `cli:"debug-http"`
+}
+
+var StepUpdateCommand = cli.Command{
+	Name:        "update",
+	Usage:       "Change the value of an attribute of a step",
+	Description: StepUpdateHelpDescription,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "append",
+			Usage: "Append to the current value of the attribute instead of replacing it",
+		},
+		cli.StringFlag{
+			Name:   "step",
+			Value:  "",
+			Usage:  "The ID or key of the step to update",
+			EnvVar: "BUILDKITE_STEP_ID",
+		},
+		cli.StringFlag{
+			Name:   "build",
+			Value:  "",
+			Usage:  "The build to look for the step in, which is needed when the step is found by its key",
+			EnvVar: "BUILDKITE_BUILD_ID",
+		},
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoColorFlag,
+		DebugFlag,
+		DebugHTTPFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := StepUpdateConfig{}
+
+		// Load the configuration
+		if err := cliconfig.Load(c, &cfg); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		// Read the value from STDIN if argument omitted entirely
+		if len(c.Args()) < 2 {
+			logger.Info("Reading step value from STDIN")
+
+			input, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				logger.Fatal("Failed to read from STDIN: %s", err)
+			}
+			cfg.Value = string(input)
+		}
+
+		// Create the API client
+		client := agent.APIClient{
+			Endpoint: cfg.Endpoint,
+			Token:    cfg.AgentAccessToken,
+		}.Create()
+
+		// Generate a UUID that will identify this change. We do this
+		// outside of the retry loop because we want this UUID to be
+		// the same for each attempt at updating the step.
+		update := &api.StepUpdate{
+			UUID:      api.NewUUID(),
+			Build:     cfg.Build,
+			Attribute: cfg.Attribute,
+			Value:     cfg.Value,
+			Append:    cfg.Append,
+		}
+
+		// Post the change
+		err := retry.Do(func(s *retry.Stats) error {
+			resp, err := client.Steps.Update(cfg.Step, update)
+			// Don't bother retrying if the response was one of these statuses
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+				s.Break()
+				return err
+			}
+			if err != nil {
+				logger.Warn("%s (%s)", err, s)
+			}
+
+			return err
+		}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+		if err != nil {
+			logger.Fatal("Failed to update step attribute %q: %s", cfg.Attribute, err)
+		}
+
+		logger.Info("Successfully updated the step's %s", cfg.Attribute)
+	},
+}
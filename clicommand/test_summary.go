@@ -0,0 +1,182 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/buildkite/agent/agent"
+	"github.com/buildkite/agent/api"
+	"github.com/buildkite/agent/cliconfig"
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/retry"
+	"github.com/urfave/cli"
+)
+
+var TestSummaryHelpDescription = `Usage:
+
+   buildkite-agent test-summary <pattern> [arguments...]
+
+Description:
+
+   Reads the test results from JUnit XML or TAP files, and saves a summary of
+   them to the build's meta-data as JSON, under test-summary:<job id> unless
+   you give a --meta-data-key. If any tests failed, the first of them are
+   added to an error annotation, with each job writing its own section of it.
+
+   Files are JUnit XML if they end in .xml and TAP if they end in .tap, and
+   otherwise it's worked out from what's in them. Multiple patterns can be
+   separated with ;
+
+   The summary is made automatically at the end of a job when
+   BUILDKITE_TEST_RESULT_PATHS is set.
+
+Example:
+
+   $ buildkite-agent test-summary "tmp/junit-*.xml"
+   $ buildkite-agent test-summary "spec/reports/**/*.xml;test/*.tap" --max-failures 20`
+
+type TestSummaryConfig struct {
+	Paths            string `cli:"arg:0" label:"test result paths" validate:"required"`
+	Context          string `cli:"context"`
+	Heading          string `cli:"heading"`
+	MetaDataKey      string `cli:"meta-data-key"`
+	MaxFailures      int    `cli:"max-failures"`
+	Job              string `cli:"job" validate:"required"`
+	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
+	Endpoint         string `cli:"endpoint" validate:"required"`
+	NoColor          bool   `cli:"no-color"`
+	Debug            bool   `cli:"debug"`
+	DebugHTTP        bool   `cli:"debug-http"`
+}
+
+var TestSummaryCommand = cli.Command{
+	Name:        "test-summary",
+	Usage:       "Summarizes JUnit XML or TAP test results, and annotates the build with the tests that failed",
+	Description: TestSummaryHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "context",
+			Value:  "test-summary",
+			Usage:  "The context of the annotation of failed tests",
+			EnvVar: "BUILDKITE_TEST_SUMMARY_CONTEXT",
+		},
+		cli.StringFlag{
+			Name:   "heading",
+			Value:  "",
+			Usage:  "What the job's failures are listed under in the annotation, which defaults to the step's label",
+			EnvVar: "BUILDKITE_LABEL",
+		},
+		cli.StringFlag{
+			Name:   "meta-data-key",
+			Value:  "",
+			Usage:  "The meta-data key the summary is saved to, which defaults to test-summary:<job id>",
+			EnvVar: "BUILDKITE_TEST_SUMMARY_META_DATA_KEY",
+		},
+		cli.IntFlag{
+			Name:   "max-failures",
+			Value:  10,
+			Usage:  "The most failed tests that are listed in the annotation",
+			EnvVar: "BUILDKITE_TEST_SUMMARY_MAX_FAILURES",
+		},
+		cli.StringFlag{
+			Name:   "job",
+			Value:  "",
+			Usage:  "Which job the test results are from",
+			EnvVar: "BUILDKITE_JOB_ID",
+		},
+		AgentAccessTokenFlag,
+		EndpointFlag,
+		NoColorFlag,
+		DebugFlag,
+		DebugHTTPFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := TestSummaryConfig{}
+
+		// Load the configuration
+		loader := cliconfig.Loader{CLI: c, Config: &cfg}
+		if err := loader.Load(); err != nil {
+			logger.Fatal("%s", err)
+		}
+
+		// Setup the any global configuration options
+		HandleGlobalFlags(cfg)
+
+		if cfg.MaxFailures < 0 {
+			logger.Fatal("%s", loader.Errorf("The most failures listed can't be less than 0."))
+		}
+
+		summary, err := agent.SummarizeTestResults(cfg.Paths)
+		if err != nil {
+			logger.Fatal("Failed to find test results: %s", err)
+		}
+
+		if summary.Files == 0 {
+			logger.Warn("No test results found matching %s", cfg.Paths)
+			return
+		}
+
+		logger.Info("Found %d tests in %d files: %d passed, %d failed and %d skipped",
+			summary.Tests, summary.Files, summary.Passed, summary.Failed, summary.Skipped)
+
+		// Create the API client
+		client := agent.APIClient{
+			Endpoint: cfg.Endpoint,
+			Token:    cfg.AgentAccessToken,
+		}.Create()
+
+		data, err := json.Marshal(summary)
+		if err != nil {
+			logger.Fatal("Failed to encode the test summary: %s", err)
+		}
+
+		key := cfg.MetaDataKey
+		if key == "" {
+			key = "test-summary:" + cfg.Job
+		}
+
+		metaData := &api.MetaData{Key: key, Value: string(data)}
+
+		err = retry.Do(func(s *retry.Stats) error {
+			resp, err := client.MetaData.Set(cfg.Job, metaData)
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404) {
+				s.Break()
+			}
+			if err != nil {
+				logger.Warn("%s (%s)", err, s)
+			}
+
+			return err
+		}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+		if err != nil {
+			logger.Fatal("Failed to save the test summary to meta-data %q: %s", key, err)
+		}
+
+		logger.Info("Saved the test summary to meta-data %q", key)
+
+		if summary.Failed == 0 {
+			return
+		}
+
+		heading := cfg.Heading
+		if heading == "" {
+			heading = cfg.Job
+		}
+
+		// Each job has its own section of the annotation, so the failures
+		// of parallel jobs are listed together
+		annotation := &api.Annotation{
+			Body:    summary.Annotation(heading, cfg.MaxFailures),
+			Style:   "error",
+			Context: cfg.Context,
+			Section: cfg.Job,
+		}
+
+		if err := createAnnotation(client, cfg.Job, annotation); err != nil {
+			logger.Fatal("Failed to annotate build: %s", err)
+		}
+
+		logger.Info("Annotated the build with %d failed tests", summary.Failed)
+	},
+}
@@ -3,6 +3,7 @@ package cliconfig
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"os"
 	"strings"
 
@@ -15,11 +16,19 @@ type File struct {
 
 	// A map of key/values that was loaded from the file
 	Config map[string]string
+
+	// The key/values in each [section] of the file, which come after the
+	// rest of the config, and the names of the sections in the order
+	// they're in the file
+	Sections     map[string]map[string]string
+	SectionNames []string
 }
 
 func (f *File) Load() error {
 	// Set the default config
 	f.Config = map[string]string{}
+	f.Sections = map[string]map[string]string{}
+	f.SectionNames = nil
 
 	// Open the file
 	file, err := os.Open(f.AbsolutePath())
@@ -37,16 +46,29 @@ func (f *File) Load() error {
 		lines = append(lines, scanner.Text())
 	}
 
-	// Parse each line
+	// Parse each line, keeping the values for the section they're in
+	config := f.Config
 	for _, fullLine := range lines {
-		if !isIgnoredLine(fullLine) {
-			key, value, err := parseLine(fullLine)
-			if err != nil {
-				return err
+		if isIgnoredLine(fullLine) {
+			continue
+		}
+
+		if name, ok := parseSectionLine(fullLine); ok {
+			if _, exists := f.Sections[name]; exists {
+				return fmt.Errorf("The section [%s] is in the config file more than once", name)
 			}
+			config = map[string]string{}
+			f.Sections[name] = config
+			f.SectionNames = append(f.SectionNames, name)
+			continue
+		}
 
-			f.Config[key] = value
+		key, value, err := parseLine(fullLine)
+		if err != nil {
+			return err
 		}
+
+		config[key] = value
 	}
 
 	return nil
@@ -137,6 +159,16 @@ func parseLine(line string) (key string, value string, err error) {
 	return
 }
 
+// Returns the name of the section if the line starts one, i.e. "[name]"
+func parseSectionLine(line string) (string, bool) {
+	trimmedLine := strings.Trim(line, " \t")
+	if !strings.HasPrefix(trimmedLine, "[") || !strings.HasSuffix(trimmedLine, "]") {
+		return "", false
+	}
+
+	return strings.Trim(trimmedLine[1:len(trimmedLine)-1], " "), true
+}
+
 func isIgnoredLine(line string) bool {
 	trimmedLine := strings.Trim(line, " \n\t")
 	return len(trimmedLine) == 0 || strings.HasPrefix(trimmedLine, "#")
@@ -0,0 +1,64 @@
+package env
+
+import "sort"
+
+// Diff is the set of changes between two environments
+type Diff struct {
+	Added   map[string]string
+	Changed map[string]DiffPair
+	Removed map[string]struct{}
+}
+
+// DiffPair is the old and new value of a variable that changed
+type DiffPair struct {
+	Old string
+	New string
+}
+
+// Empty returns whether there aren't any changes
+func (d Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Changed) == 0 && len(d.Removed) == 0
+}
+
+// Names returns the names of all the variables that were added, changed or
+// removed, sorted so they're in a consistent order
+func (d Diff) Names() []string {
+	names := make([]string, 0, len(d.Added)+len(d.Changed)+len(d.Removed))
+	for k := range d.Added {
+		names = append(names, k)
+	}
+	for k := range d.Changed {
+		names = append(names, k)
+	}
+	for k := range d.Removed {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Remove drops a variable from the diff, so it won't be changed when the diff
+// is applied
+func (d Diff) Remove(key string) {
+	delete(d.Added, key)
+	delete(d.Changed, key)
+	delete(d.Removed, key)
+}
+
+// Apply returns a copy of the environment with the changes in the diff made
+// to it
+func (d Diff) Apply(e *Environment) *Environment {
+	c := e.Copy()
+
+	for _, k := range d.Names() {
+		if v, ok := d.Added[k]; ok {
+			c.Set(k, v)
+		} else if v, ok := d.Changed[k]; ok {
+			c.Set(k, v.New)
+		} else {
+			c.Remove(k)
+		}
+	}
+
+	return c
+}
@@ -2,23 +2,37 @@ package env
 
 import (
 	"runtime"
-	"sort"
 	"strings"
 )
 
-// Environment is a map of environment variables, with the keys normalized
-// for case-insensitive operating systems
+// Environment is an ordered map of environment variables. Keys are compared
+// case-insensitively on operating systems that treat them that way, but keep
+// the casing they were first set with.
 type Environment struct {
-	env map[string]string
+	keys            []string
+	vars            map[string]variable
+	caseInsensitive bool
+}
+
+type variable struct {
+	name  string
+	value string
 }
 
 func New() *Environment {
-	return &Environment{env: map[string]string{}}
+	return newEnvironment(runtime.GOOS == "windows")
+}
+
+func newEnvironment(caseInsensitive bool) *Environment {
+	return &Environment{
+		vars:            map[string]variable{},
+		caseInsensitive: caseInsensitive,
+	}
 }
 
 // FromSlice creates a new environment from a string slice of KEY=VALUE
 func FromSlice(s []string) *Environment {
-	env := &Environment{env: make(map[string]string, len(s))}
+	env := New()
 
 	for _, l := range s {
 		parts := strings.SplitN(l, "=", 2)
@@ -32,8 +46,8 @@ func FromSlice(s []string) *Environment {
 
 // Get returns a key from the environment
 func (e *Environment) Get(key string) (string, bool) {
-	v, ok := e.env[normalizeKeyName(key)]
-	return v, ok
+	v, ok := e.vars[e.normalizeKeyName(key)]
+	return v.value, ok
 }
 
 // Get a boolean value from environment, with a default for empty. Supports true|false, on|off, 1|0
@@ -52,38 +66,85 @@ func (e *Environment) GetBool(key string, defaultValue bool) bool {
 
 // Exists returns true/false depending on whether or not the key exists in the env
 func (e *Environment) Exists(key string) bool {
-	_, ok := e.env[normalizeKeyName(key)]
+	_, ok := e.vars[e.normalizeKeyName(key)]
 	return ok
 }
 
-// Set sets a key in the environment
+// Set sets a key in the environment. A new key is added to the end, and an
+// existing one keeps its place and the casing it was first set with.
 func (e *Environment) Set(key string, value string) string {
-	e.env[normalizeKeyName(key)] = value
+	normalized := e.normalizeKeyName(key)
+
+	if v, ok := e.vars[normalized]; ok {
+		v.value = value
+		e.vars[normalized] = v
+	} else {
+		e.keys = append(e.keys, normalized)
+		e.vars[normalized] = variable{name: key, value: value}
+	}
 
 	return value
 }
 
 // Remove a key from the Environment and return it's value
 func (e *Environment) Remove(key string) string {
-	value, ok := e.Get(key)
-	if ok {
-		delete(e.env, normalizeKeyName(key))
+	normalized := e.normalizeKeyName(key)
+
+	v, ok := e.vars[normalized]
+	if !ok {
+		return ""
 	}
-	return value
+
+	delete(e.vars, normalized)
+	for i, k := range e.keys {
+		if k == normalized {
+			e.keys = append(e.keys[:i:i], e.keys[i+1:]...)
+			break
+		}
+	}
+
+	return v.value
 }
 
 // Length returns the length of the environment
 func (e *Environment) Length() int {
-	return len(e.env)
+	return len(e.keys)
 }
 
-// Diff returns a new environment with all the variables that have changed
-func (e *Environment) Diff(other *Environment) *Environment {
-	diff := &Environment{env: make(map[string]string)}
+// Keys returns the names of the variables in the order they were added
+func (e *Environment) Keys() []string {
+	names := make([]string, 0, len(e.keys))
+	for _, k := range e.keys {
+		names = append(names, e.vars[k].name)
+	}
+	return names
+}
+
+// Diff returns the changes that turn the other environment into this one
+func (e *Environment) Diff(other *Environment) Diff {
+	diff := Diff{
+		Added:   map[string]string{},
+		Changed: map[string]DiffPair{},
+		Removed: map[string]struct{}{},
+	}
+
+	if other == nil {
+		other = newEnvironment(e.caseInsensitive)
+	}
+
+	for _, k := range e.keys {
+		v := e.vars[k]
+		if old, ok := other.Get(v.name); !ok {
+			diff.Added[v.name] = v.value
+		} else if old != v.value {
+			diff.Changed[v.name] = DiffPair{Old: old, New: v.value}
+		}
+	}
 
-	for k, v := range e.env {
-		if other, _ := other.Get(k); other != v {
-			diff.Set(k, v)
+	for _, k := range other.keys {
+		v := other.vars[k]
+		if !e.Exists(v.name) {
+			diff.Removed[v.name] = struct{}{}
 		}
 	}
 
@@ -98,8 +159,9 @@ func (e *Environment) Merge(other *Environment) *Environment {
 		return c
 	}
 
-	for k, v := range other.ToMap() {
-		c.Set(k, v)
+	for _, k := range other.keys {
+		v := other.vars[k]
+		c.Set(v.name, v.value)
 	}
 
 	return c
@@ -107,31 +169,37 @@ func (e *Environment) Merge(other *Environment) *Environment {
 
 // Copy returns a copy of the env
 func (e *Environment) Copy() *Environment {
-	c := make(map[string]string)
+	c := newEnvironment(e.caseInsensitive)
 
-	for k, v := range e.env {
-		c[k] = v
+	c.keys = make([]string, len(e.keys))
+	copy(c.keys, e.keys)
+
+	for k, v := range e.vars {
+		c.vars[k] = v
 	}
 
-	return &Environment{env: c}
+	return c
 }
 
-// ToSlice returns a sorted slice representation of the environment
+// ToSlice returns a slice representation of the environment, in the order
+// the variables were added
 func (e *Environment) ToSlice() []string {
-	s := []string{}
-	for k, v := range e.env {
-		s = append(s, k+"="+v)
+	s := make([]string, 0, len(e.keys))
+	for _, k := range e.keys {
+		v := e.vars[k]
+		s = append(s, v.name+"="+v.value)
 	}
 
-	// Ensure they are in a consistent order (helpful for tests)
-	sort.Strings(s)
-
 	return s
 }
 
 // ToMap returns a map representation of the environment
 func (e *Environment) ToMap() map[string]string {
-	return e.env
+	m := make(map[string]string, len(e.keys))
+	for _, v := range e.vars {
+		m[v.name] = v.value
+	}
+	return m
 }
 
 // Environment variables on Windows are case-insensitive. When you run `SET`
@@ -155,14 +223,14 @@ func (e *Environment) ToMap() map[string]string {
 //
 // Users of env.Environment shouldn't need to care about this.
 // env.Get("PATH") should "just work" on Windows. This means on Windows
-// machines, we'll normalise all the keys that go in/out of this API.
+// machines, we'll compare all the keys that go in/out of this API by their
+// normalised name, while still handing back the original casing.
 //
 // Unix systems _are_ case sensitive when it comes to ENV, so we'll just leave
 // that alone.
-func normalizeKeyName(key string) string {
-	if runtime.GOOS == "windows" {
+func (e *Environment) normalizeKeyName(key string) string {
+	if e.caseInsensitive {
 		return strings.ToUpper(key)
-	} else {
-		return key
 	}
+	return key
 }
@@ -70,7 +70,7 @@ func TestEnvironmentMerge(t *testing.T) {
 
 	env3 := env1.Merge(env2)
 
-	assert.Equal(t, env3.ToSlice(), []string{"BAR=foo", "FOO=bar"})
+	assert.Equal(t, env3.ToSlice(), []string{"FOO=bar", "BAR=foo"})
 }
 
 func TestEnvironmentCopy(t *testing.T) {
@@ -93,3 +93,90 @@ func TestEnvironmentToSlice(t *testing.T) {
 
 	assert.Equal(t, []string{"THIS_IS_GREAT=totes", "ZOMG=greatness"}, env.ToSlice())
 }
+
+func TestEnvironmentKeepsOrder(t *testing.T) {
+	t.Parallel()
+
+	env := FromSlice([]string{"ZOMG=greatness", "THIS_IS_GREAT=totes", "APPLE=pie"})
+	env.Set("ZOMG", "still great")
+	env.Remove("THIS_IS_GREAT")
+	env.Set("BANANA", "bread")
+
+	assert.Equal(t, []string{"ZOMG", "APPLE", "BANANA"}, env.Keys())
+	assert.Equal(t, []string{"ZOMG=still great", "APPLE=pie", "BANANA=bread"}, env.ToSlice())
+}
+
+func TestEnvironmentCaseInsensitiveKeys(t *testing.T) {
+	t.Parallel()
+
+	env := newEnvironment(true)
+	env.Set("Path", "C:\\Windows")
+	env.Set("PATH", "C:\\Windows;C:\\Go")
+
+	v, ok := env.Get("path")
+	assert.True(t, ok)
+	assert.Equal(t, "C:\\Windows;C:\\Go", v)
+	assert.Equal(t, []string{"Path=C:\\Windows;C:\\Go"}, env.ToSlice())
+	assert.Equal(t, map[string]string{"Path": "C:\\Windows;C:\\Go"}, env.ToMap())
+
+	assert.Equal(t, "C:\\Windows;C:\\Go", env.Remove("pAtH"))
+	assert.Equal(t, 0, env.Length())
+}
+
+func TestEnvironmentCaseSensitiveKeys(t *testing.T) {
+	t.Parallel()
+
+	env := newEnvironment(false)
+	env.Set("Path", "/bin")
+	env.Set("PATH", "/usr/bin")
+
+	assert.Equal(t, []string{"Path=/bin", "PATH=/usr/bin"}, env.ToSlice())
+	assert.False(t, env.Exists("path"))
+}
+
+func TestEnvironmentDiff(t *testing.T) {
+	t.Parallel()
+
+	before := FromSlice([]string{"FOO=bar", "CHANGED=before", "REMOVED=soon"})
+	after := FromSlice([]string{"FOO=bar", "CHANGED=after", "ADDED=new"})
+
+	diff := after.Diff(before)
+
+	assert.Equal(t, map[string]string{"ADDED": "new"}, diff.Added)
+	assert.Equal(t, map[string]DiffPair{"CHANGED": {Old: "before", New: "after"}}, diff.Changed)
+	assert.Equal(t, map[string]struct{}{"REMOVED": {}}, diff.Removed)
+	assert.Equal(t, []string{"ADDED", "CHANGED", "REMOVED"}, diff.Names())
+	assert.False(t, diff.Empty())
+
+	assert.Equal(t, []string{"FOO=bar", "CHANGED=after", "ADDED=new"}, diff.Apply(before).ToSlice())
+	assert.Equal(t, []string{"FOO=bar", "CHANGED=before", "REMOVED=soon"}, before.ToSlice())
+
+	assert.True(t, after.Diff(after.Copy()).Empty())
+}
+
+func TestEnvironmentDiffIgnoresCaseChanges(t *testing.T) {
+	t.Parallel()
+
+	before := newEnvironment(true)
+	before.Set("Path", "C:\\Windows")
+
+	after := newEnvironment(true)
+	after.Set("PATH", "C:\\Windows")
+	after.Set("Temp", "C:\\Temp")
+
+	diff := after.Diff(before)
+
+	assert.Equal(t, map[string]string{"Temp": "C:\\Temp"}, diff.Added)
+	assert.Empty(t, diff.Changed)
+	assert.Empty(t, diff.Removed)
+}
+
+func TestEnvironmentDiffRemove(t *testing.T) {
+	t.Parallel()
+
+	diff := FromSlice([]string{"FOO=bar", "BAR=baz"}).Diff(FromSlice([]string{"BAZ=qux"}))
+	diff.Remove("FOO")
+	diff.Remove("BAZ")
+
+	assert.Equal(t, []string{"BAR"}, diff.Names())
+}
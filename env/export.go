@@ -37,7 +37,7 @@ var endsWithUnescapedQuoteRegex = regexp.MustCompile("([^\\\\]\"\\z|\\A\"\\z)")
 //
 func FromExport(body string) *Environment {
 	// Create the environment that we'll load values into
-	env := &Environment{env: make(map[string]string)}
+	env := New()
 
 	// Remove any white space at the start and the end of the export string
 	body = strings.TrimSpace(body)
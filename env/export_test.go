@@ -24,11 +24,11 @@ declare -x VAR6="ends with a quote \"
 and a new line \""
 declare -x _="/usr/local/bin/watch"`)
 	assert.Equal(t, []string{
-		"SOMETHING=0",
 		"USER=keithpitt",
 		"VAR1=boom\\nboom\\nshake\\nthe\\nroom",
 		"VAR2=hello\nfriends",
 		"VAR3=hello\nfriends\nOMG=foo\ntest",
+		"SOMETHING=0",
 		"VAR4=ends with a space ",
 		"VAR5=ends with\nanother space ",
 		"VAR6=ends with a quote \"\nand a new line \"",
@@ -0,0 +1,209 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// How many events can be waiting to be sent before more are dropped, and how
+// long each target has to take one
+const (
+	queueSize   = 1000
+	sendTimeout = 10 * time.Second
+)
+
+// The agent's emitter, if it's sending events
+var emitter *Emitter
+
+// Emitter sends events to webhooks, which they're POSTed to, and unix
+// sockets, which they're written to as a line of JSON per connection. They're
+// sent one at a time in the order they happened, but best effort, so an event
+// that a target fails to take isn't sent to it again.
+type Emitter struct {
+	targets []target
+	queue   chan Event
+	done    chan struct{}
+	client  *http.Client
+
+	// Set once it's stopped, after which events are dropped
+	mu      sync.Mutex
+	stopped bool
+}
+
+type target struct {
+	url    string
+	socket string
+}
+
+// NewEmitter returns an emitter for the targets, which are http:// or
+// https:// URLs, or unix:///path/to/socket
+func NewEmitter(targets []string) (*Emitter, error) {
+	e := &Emitter{
+		queue:  make(chan Event, queueSize),
+		done:   make(chan struct{}),
+		client: &http.Client{Timeout: sendTimeout},
+	}
+
+	for _, value := range targets {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+
+		u, err := url.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a URL (%v)", value, err)
+		}
+
+		switch u.Scheme {
+		case "http", "https":
+			e.targets = append(e.targets, target{url: value})
+		case "unix":
+			if u.Path == "" {
+				return nil, fmt.Errorf("%q doesn't have the path of a socket", value)
+			}
+			e.targets = append(e.targets, target{socket: u.Path})
+		default:
+			return nil, fmt.Errorf("%q isn't an http, https or unix URL", value)
+		}
+	}
+
+	go e.run()
+
+	return e, nil
+}
+
+// Emit queues the event to be sent, dropping it if too many are waiting
+func (e *Emitter) Emit(event Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.stopped {
+		return
+	}
+
+	select {
+	case e.queue <- event:
+	default:
+		logger.Warn("Dropped the %s event, as too many are waiting to be sent", event.Type)
+	}
+}
+
+// Stop sends the events that are waiting, waiting for them for up to the
+// timeout
+func (e *Emitter) Stop(timeout time.Duration) {
+	e.mu.Lock()
+	if !e.stopped {
+		e.stopped = true
+		close(e.queue)
+	}
+	e.mu.Unlock()
+
+	select {
+	case <-e.done:
+	case <-time.After(timeout):
+		logger.Warn("Stopped before all the events were sent")
+	}
+}
+
+func (e *Emitter) run() {
+	defer close(e.done)
+
+	for event := range e.queue {
+		data, err := json.Marshal(event)
+		if err != nil {
+			logger.Error("Failed to encode the %s event (%s)", event.Type, err)
+			continue
+		}
+
+		for _, t := range e.targets {
+			if err := e.send(t, data); err != nil {
+				logger.Warn("Failed to send the %s event to %s (%s)", event.Type, t, err)
+			}
+		}
+	}
+}
+
+func (e *Emitter) send(t target, data []byte) error {
+	if t.socket != "" {
+		conn, err := net.DialTimeout("unix", t.socket, sendTimeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		conn.SetWriteDeadline(time.Now().Add(sendTimeout))
+		_, err = conn.Write(append(data, '\n'))
+		return err
+	}
+
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "buildkite-agent")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+func (t target) String() string {
+	if t.socket != "" {
+		return "unix://" + t.socket
+	}
+	return t.url
+}
+
+// Start has the agent send its events to the targets
+func Start(targets []string) error {
+	e, err := NewEmitter(targets)
+	if err != nil {
+		return err
+	}
+
+	emitter = e
+	logger.Info("Sending job events to %s", strings.Join(targets, ", "))
+
+	return nil
+}
+
+// IsEmitting returns whether the agent is sending events, which is when other
+// processes need to report theirs too
+func IsEmitting() bool {
+	return emitter != nil
+}
+
+// Emit sends the event, if the agent is sending events
+func Emit(event Event) {
+	if emitter != nil {
+		emitter.Emit(event)
+	}
+}
+
+// Stop sends the events that are waiting to be, for up to the timeout
+func Stop(timeout time.Duration) {
+	if emitter != nil {
+		emitter.Stop(timeout)
+	}
+}
@@ -0,0 +1,89 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventsAreSentToWebhooksAndSockets(t *testing.T) {
+	t.Parallel()
+
+	posted := make(chan Event, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "POST", req.Method)
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+
+		var event Event
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&event))
+		posted <- event
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "events.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	written := make(chan Event, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadBytes('\n')
+			conn.Close()
+
+			var event Event
+			assert.NoError(t, json.Unmarshal(line, &event))
+			written <- event
+		}
+	}()
+
+	e, err := NewEmitter([]string{server.URL, "unix://" + socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.Emit(Event{Type: JobStarted, JobID: "llamas"})
+	e.Emit(Event{Type: JobFinished, JobID: "llamas", ExitStatus: "0"})
+	e.Stop(5 * time.Second)
+
+	for _, received := range []chan Event{posted, written} {
+		started, finished := <-received, <-received
+		assert.Equal(t, JobStarted, started.Type)
+		assert.False(t, started.Timestamp.IsZero())
+		assert.Equal(t, JobFinished, finished.Type)
+		assert.Equal(t, "0", finished.ExitStatus)
+	}
+
+	// Events after it's stopped are dropped
+	e.Emit(Event{Type: JobStarted})
+}
+
+func TestUnknownTargetsAreRejected(t *testing.T) {
+	t.Parallel()
+
+	for _, target := range []string{"ftp://example.com", "unix://", "llamas"} {
+		_, err := NewEmitter([]string{target})
+		assert.Error(t, err, target)
+	}
+}
@@ -0,0 +1,52 @@
+// Package events sends the agent's events about the jobs it runs, i.e. a job
+// starting or a phase of it finishing, to webhooks and local unix sockets as
+// they happen, so fleet tooling can react to them without polling the API.
+package events
+
+import (
+	"time"
+)
+
+// The types of events
+const (
+	// The agent has started running a job
+	JobStarted = "job.started"
+
+	// A phase of the job's bootstrap has finished, i.e. the checkout
+	PhaseFinished = "job.phase.finished"
+
+	// An artifact of the job has been uploaded
+	ArtifactUploaded = "job.artifact.uploaded"
+
+	// The job has finished, with it's exit status
+	JobFinished = "job.finished"
+)
+
+// Event is sent as JSON. Only the fields for the type of event are set.
+type Event struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	AgentName string    `json:"agent_name,omitempty"`
+	JobID     string    `json:"job_id,omitempty"`
+
+	// The phase that finished, how many seconds it took, and why it
+	// failed if it did
+	Phase    string  `json:"phase,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+
+	// What the job exited with, and the signal that killed it if one did
+	ExitStatus string `json:"exit_status,omitempty"`
+	Signal     string `json:"signal,omitempty"`
+
+	// The artifact that was uploaded
+	Artifact *Artifact `json:"artifact,omitempty"`
+}
+
+// Artifact is an artifact that was uploaded
+type Artifact struct {
+	ID       string `json:"id"`
+	Path     string `json:"path"`
+	FileSize int64  `json:"file_size"`
+	URL      string `json:"url,omitempty"`
+}
@@ -0,0 +1,94 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// The environment variable with the file that processes run for a job, like
+// the bootstrap and artifact uploads, report their events to. The agent
+// follows it while the job runs, and sends what's reported to it.
+const ReportFileEnv = "BUILDKITE_AGENT_EVENTS_FILE"
+
+// Protects writes to the report file from within this process
+var reportMutex sync.Mutex
+
+// Report reports an event to the agent, when running as part of a job. It
+// does nothing if the agent isn't sending events.
+func Report(event Event) {
+	ReportTo(os.Getenv(ReportFileEnv), event)
+}
+
+// ReportTo is Report with the report file given, for when it isn't in the
+// process's environment, i.e. a job's bootstrap run within the agent
+func ReportTo(path string, event Event) {
+	if path == "" {
+		return
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		logger.Debug("Failed to encode the %s event (%s)", event.Type, err)
+		return
+	}
+
+	reportMutex.Lock()
+	defer reportMutex.Unlock()
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		logger.Debug("Failed to report the %s event (%s)", event.Type, err)
+		return
+	}
+	defer file.Close()
+
+	file.Write(append(line, '\n'))
+}
+
+// ReadReports returns the events that have been reported to a file since the
+// offset, along with the offset to read the next ones from. A line that's
+// still being written is left for the next read.
+func ReadReports(path string, offset int64) ([]Event, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, offset, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, offset, err
+	}
+
+	var reported []Event
+
+	for {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			break
+		}
+
+		line := data[:end]
+		data = data[end+1:]
+		offset += int64(end + 1)
+
+		var event Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			return reported, offset, fmt.Errorf("Invalid event report %q (%s)", line, err)
+		}
+		reported = append(reported, event)
+	}
+
+	return reported, offset, nil
+}
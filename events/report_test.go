@@ -0,0 +1,66 @@
+package events
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportedEventsAreReadAsTheyreWritten(t *testing.T) {
+	t.Parallel()
+
+	file, err := ioutil.TempFile("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	ReportTo(file.Name(), Event{Type: PhaseFinished, Phase: "checkout", Duration: 1.5})
+
+	reported, offset, err := ReadReports(file.Name(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, reported, 1)
+	assert.Equal(t, "checkout", reported[0].Phase)
+	assert.Equal(t, 1.5, reported[0].Duration)
+
+	// Lines that are still being written are left for the next read
+	f, err := os.OpenFile(file.Name(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"type":"job.phase.finished","phase":"com`)
+	f.Close()
+
+	reported, next, err := ReadReports(file.Name(), offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, reported)
+	assert.Equal(t, offset, next)
+
+	f, err = os.OpenFile(file.Name(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("mand\"}\n")
+	f.Close()
+
+	reported, _, err = ReadReports(file.Name(), next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, reported, 1)
+	assert.Equal(t, "command", reported[0].Phase)
+}
+
+func TestEventsArentReportedWithoutAFile(t *testing.T) {
+	t.Parallel()
+
+	// It's a no-op, rather than writing anywhere
+	ReportTo("", Event{Type: JobStarted})
+}
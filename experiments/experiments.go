@@ -1,6 +1,10 @@
 package experiments
 
 import (
+	"path"
+	"sort"
+	"strings"
+
 	"github.com/buildkite/agent/logger"
 )
 
@@ -20,3 +24,56 @@ func IsEnabled(experiment string) bool {
 		return false
 	}
 }
+
+// Enabled returns the experiments that have been enabled, sorted by name
+func Enabled() []string {
+	var enabled []string
+	for name, on := range experiments {
+		if on {
+			enabled = append(enabled, name)
+		}
+	}
+
+	sort.Strings(enabled)
+	return enabled
+}
+
+// ForJob returns the experiments that are enabled for a job, which are the
+// agent's along with the comma separated experiments the job asks for that
+// match the allowed patterns. The ones the job asked for that aren't allowed
+// are returned too, so it can be told why they weren't enabled.
+func ForJob(requested string, allowed []string) (enabled []string, denied []string) {
+	set := map[string]bool{}
+	for _, name := range Enabled() {
+		set[name] = true
+	}
+
+	for _, name := range strings.Split(requested, ",") {
+		if name = strings.TrimSpace(name); name == "" || set[name] {
+			continue
+		}
+
+		if isAllowed(name, allowed) {
+			set[name] = true
+		} else {
+			denied = append(denied, name)
+		}
+	}
+
+	for name := range set {
+		enabled = append(enabled, name)
+	}
+
+	sort.Strings(enabled)
+	sort.Strings(denied)
+	return enabled, denied
+}
+
+func isAllowed(name string, allowed []string) bool {
+	for _, pattern := range allowed {
+		if matched, _ := path.Match(strings.TrimSpace(pattern), name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package experiments
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForJob(t *testing.T) {
+	Enable("llamas")
+	defer delete(experiments, "llamas")
+
+	enabled, denied := ForJob("", nil)
+	assert.Equal(t, []string{"llamas"}, enabled)
+	assert.Empty(t, denied)
+
+	enabled, denied = ForJob("alpacas, camels,llamas", []string{"alpacas"})
+	assert.Equal(t, []string{"alpacas", "llamas"}, enabled)
+	assert.Equal(t, []string{"camels"}, denied)
+
+	enabled, denied = ForJob("alpacas,camels", []string{"*"})
+	assert.Equal(t, []string{"alpacas", "camels", "llamas"}, enabled)
+	assert.Empty(t, denied)
+}
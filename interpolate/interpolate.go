@@ -1,3 +1,6 @@
+// Package interpolate expands shell style variables like ${VAR:-default} in
+// pipelines. It started as github.com/buildkite/interpolate at 90db4cd, and
+// adds ${VAR:?message} and the positions of parse errors.
 package interpolate
 
 import (
@@ -115,20 +118,24 @@ func (e SubstringExpansion) Expand(env Env) (string, error) {
 	return val[from:to], nil
 }
 
-// RequiredExpansion returns an env value, or an error if it is unset
+// RequiredExpansion returns an env value, or an error if it is unset (or
+// empty too, for ${VAR:?})
 type RequiredExpansion struct {
 	Identifier string
 	Message    Expression
+	NotEmpty   bool
 }
 
 func (e RequiredExpansion) Expand(env Env) (string, error) {
 	val, ok := env.Get(e.Identifier)
-	if !ok {
+	if !ok || (e.NotEmpty && val == "") {
 		msg, err := e.Message.Expand(env)
 		if err != nil {
 			return "", err
 		}
-		if msg == "" {
+		if msg == "" && ok {
+			msg = "empty"
+		} else if msg == "" {
 			msg = "not set"
 		}
 		return "", fmt.Errorf("$%s: %s", e.Identifier, msg)
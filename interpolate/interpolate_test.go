@@ -0,0 +1,67 @@
+package interpolate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterpolate(t *testing.T) {
+	t.Parallel()
+
+	env := NewMapEnv(map[string]string{"LLAMAS": "ROCK", "EMPTY": ""})
+
+	var testCases = []struct {
+		str      string
+		expected string
+	}{
+		{"$LLAMAS", "ROCK"},
+		{"${LLAMAS}!", "ROCK!"},
+		{"${MISSING:-${LLAMAS}}", "ROCK"},
+		{"${EMPTY:-alpacas}", "alpacas"},
+		{"${EMPTY-alpacas}", ""},
+		{"${LLAMAS:1:2}", "OC"},
+		{"${LLAMAS:?}", "ROCK"},
+		{"${EMPTY?}", ""},
+		{"$$LLAMAS", "$LLAMAS"},
+	}
+
+	for _, tc := range testCases {
+		actual, err := Interpolate(env, tc.str)
+		if assert.NoError(t, err, tc.str) {
+			assert.Equal(t, tc.expected, actual, tc.str)
+		}
+	}
+}
+
+func TestInterpolateRequiredValues(t *testing.T) {
+	t.Parallel()
+
+	env := NewMapEnv(map[string]string{"EMPTY": ""})
+
+	var testCases = []struct {
+		str      string
+		expected string
+	}{
+		{"${MISSING?}", "$MISSING: not set"},
+		{"${MISSING:?needs a target}", "$MISSING: needs a target"},
+		{"${EMPTY:?}", "$EMPTY: empty"},
+	}
+
+	for _, tc := range testCases {
+		_, err := Interpolate(env, tc.str)
+		assert.EqualError(t, err, tc.expected, tc.str)
+	}
+}
+
+func TestParseErrorsHaveTheirPosition(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewParser("deploy ${TARGET:a}").Parse()
+	if assert.IsType(t, &ParseError{}, err) {
+		assert.Equal(t, 17, err.(*ParseError).Position)
+	}
+
+	_, err = NewParser("deploy ${TARGET").Parse()
+	assert.EqualError(t, err, "Expected an operator or } after ${TARGET, got the end of the string at position 16")
+}
@@ -1,7 +1,6 @@
 package interpolate
 
 import (
-	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -34,7 +33,7 @@ Expression       = { Text | Expansion }
 EmptyValue       = ":-" { Expression }
 UnsetValue       = "-" { Expression }
 Substring        = ":" number [ ":" number ]
-Required         = "?" { Expression }
+Required         = [ ":" ] "?" { Expression }
 Operation        = EmptyValue | UnsetValue | Substring | Required
 */
 
@@ -42,6 +41,19 @@ const (
 	eof = -1
 )
 
+// ParseError is returned when a string can't be parsed, along with where in
+// the string the problem is
+type ParseError struct {
+	Message string
+
+	// The position of the problem in the string, counting from 1
+	Position int
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Message, e.Position)
+}
+
 // Parser takes a string and parses out a tree of structs that represent text and Expansions
 type Parser struct {
 	input string // the string we are scanning
@@ -105,7 +117,7 @@ func (p *Parser) parseExpression(stop ...rune) (Expression, error) {
 
 func (p *Parser) parseExpansion() (Expansion, error) {
 	if c := p.nextRune(); c != '$' {
-		return nil, fmt.Errorf("Expected expansion to start with $, got %c", c)
+		return nil, p.errorAt(p.pos-1, "Expected expansion to start with $, got %s", describeRune(c))
 	}
 
 	// if we have an open brace, this is a brace expansion
@@ -123,7 +135,7 @@ func (p *Parser) parseExpansion() (Expansion, error) {
 
 func (p *Parser) parseBraceExpansion() (Expansion, error) {
 	if c := p.nextRune(); c != '{' {
-		return nil, fmt.Errorf("Expected brace expansion to start with {, got %c", c)
+		return nil, p.errorAt(p.pos-1, "Expected brace expansion to start with {, got %s", describeRune(c))
 	}
 
 	identifier, err := p.scanIdentifier()
@@ -139,18 +151,19 @@ func (p *Parser) parseBraceExpansion() (Expansion, error) {
 	var operator string
 	var exp Expansion
 
-	// Parse an operator, some trickery is needed to handle : vs :-
+	// Parse an operator, some trickery is needed to handle : vs :- and :?
+	opPos := p.pos
 	if op1 := p.nextRune(); op1 == ':' {
-		if op2 := p.peekRune(); op2 == '-' {
+		if op2 := p.peekRune(); op2 == '-' || op2 == '?' {
 			_ = p.nextRune()
-			operator = ":-"
+			operator = ":" + string(op2)
 		} else {
 			operator = ":"
 		}
 	} else if op1 == '?' || op1 == '-' {
 		operator = string(op1)
 	} else {
-		return nil, fmt.Errorf("Expected an operator, got %c", op1)
+		return nil, p.errorAt(opPos, "Expected an operator or } after ${%s, got %s", identifier, describeRune(op1))
 	}
 
 	switch operator {
@@ -169,15 +182,15 @@ func (p *Parser) parseBraceExpansion() (Expansion, error) {
 		if err != nil {
 			return nil, err
 		}
-	case `?`:
-		exp, err = p.parseRequiredExpansion(identifier)
+	case `?`, `:?`:
+		exp, err = p.parseRequiredExpansion(identifier, operator == `:?`)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	if c := p.nextRune(); c != '}' {
-		return nil, fmt.Errorf("Expected brace expansion to end with }, got %c", c)
+		return nil, p.errorAt(p.pos-1, "Expected ${%s to end with }, got %s", identifier, describeRune(c))
 	}
 
 	return exp, nil
@@ -194,7 +207,7 @@ func (p *Parser) parseEmptyValueOrSubstringExpansion(identifier string) (Expansi
 
 		substr, ok := expr.(SubstringExpansion)
 		if !ok {
-			return nil, errors.New("Unable to convert to SubstringExpansion")
+			return nil, p.errorAt(p.pos, "Unable to convert to SubstringExpansion")
 		}
 
 		// we swallowed the negative sign, so correct for that
@@ -221,13 +234,14 @@ func (p *Parser) parseUnsetValueExpansion(identifier string) (Expansion, error)
 }
 
 func (p *Parser) parseSubstringExpansion(identifier string) (Expansion, error) {
+	offsetPos := p.pos
 	offset := p.scanUntil(func(r rune) bool {
 		return r == ':' || r == '}'
 	})
 
 	offsetInt, err := strconv.Atoi(strings.TrimSpace(offset))
 	if err != nil {
-		return nil, fmt.Errorf("Unable to parse offset: %v", err)
+		return nil, p.errorAt(offsetPos, "Unable to parse offset %q of ${%s", offset, identifier)
 	}
 
 	if c := p.peekRune(); c == '}' {
@@ -235,25 +249,39 @@ func (p *Parser) parseSubstringExpansion(identifier string) (Expansion, error) {
 	}
 
 	_ = p.nextRune()
+	lengthPos := p.pos
 	length := p.scanUntil(func(r rune) bool {
 		return r == '}'
 	})
 
 	lengthInt, err := strconv.Atoi(strings.TrimSpace(length))
 	if err != nil {
-		return nil, fmt.Errorf("Unable to parse length: %v", err)
+		return nil, p.errorAt(lengthPos, "Unable to parse length %q of ${%s", length, identifier)
 	}
 
 	return SubstringExpansion{Identifier: identifier, Offset: offsetInt, Length: lengthInt, HasLength: true}, nil
 }
 
-func (p *Parser) parseRequiredExpansion(identifier string) (Expansion, error) {
+func (p *Parser) parseRequiredExpansion(identifier string, notEmpty bool) (Expansion, error) {
 	expr, err := p.parseExpression('}')
 	if err != nil {
 		return nil, err
 	}
 
-	return RequiredExpansion{Identifier: identifier, Message: expr}, nil
+	return RequiredExpansion{Identifier: identifier, Message: expr, NotEmpty: notEmpty}, nil
+}
+
+// Returns an error at the given position in the input, which counts from 0
+func (p *Parser) errorAt(pos int, format string, v ...interface{}) error {
+	return &ParseError{Message: fmt.Sprintf(format, v...), Position: pos + 1}
+}
+
+// Describes a rune for an error message
+func describeRune(c rune) string {
+	if c == eof {
+		return "the end of the string"
+	}
+	return fmt.Sprintf("%q", c)
 }
 
 func (p *Parser) scanUntil(f func(rune) bool) string {
@@ -270,7 +298,7 @@ func (p *Parser) scanUntil(f func(rune) bool) string {
 
 func (p *Parser) scanIdentifier() (string, error) {
 	if c := p.peekRune(); !unicode.IsLetter(c) {
-		return "", errors.New("Expected identifier to start with a letter")
+		return "", p.errorAt(p.pos, "Expected a variable name starting with a letter, got %s", describeRune(c))
 	}
 	var notIdentifierChar = func(r rune) bool {
 		return (!unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_')
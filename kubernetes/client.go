@@ -0,0 +1,248 @@
+// Package kubernetes runs jobs as pods in a Kubernetes cluster, using the
+// cluster's REST API.
+package kubernetes
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Where the service account's credentials are mounted in pods
+const serviceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Client talks to the Kubernetes API
+type Client struct {
+	// The API server, i.e. https://10.0.0.1:443
+	Endpoint string
+
+	// The bearer token to authenticate with, if any
+	Token string
+
+	HTTPClient *http.Client
+}
+
+// NewInClusterClient creates a client using the service account of the pod
+// it's running in
+func NewInClusterClient() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Not running in a Kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT aren't set")
+	}
+
+	token, err := ioutil.ReadFile(serviceAccountPath + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the service account token: %v", err)
+	}
+
+	ca, err := ioutil.ReadFile(serviceAccountPath + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the service account CA certificate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("Failed to parse the service account CA certificate")
+	}
+
+	return &Client{
+		Endpoint: "https://" + net.JoinHostPort(host, port),
+		Token:    strings.TrimSpace(string(token)),
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+// InClusterNamespace returns the namespace of the pod it's running in, or
+// default if it isn't running in one
+func InClusterNamespace() string {
+	namespace, err := ioutil.ReadFile(serviceAccountPath + "/namespace")
+	if err != nil || strings.TrimSpace(string(namespace)) == "" {
+		return "default"
+	}
+	return strings.TrimSpace(string(namespace))
+}
+
+// CreatePod creates the pod in it's namespace
+func (c *Client) CreatePod(pod *Pod) error {
+	pod.APIVersion = "v1"
+	pod.Kind = "Pod"
+
+	body, err := json.Marshal(pod)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do("POST", apiPath(pod.Metadata.Namespace, "pods", ""), nil, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Failed to create pod %s: %v", pod.Metadata.Name, err)
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+// GetPod returns the pod, including it's status
+func (c *Client) GetPod(namespace, name string) (*Pod, error) {
+	resp, err := c.do("GET", apiPath(namespace, "pods", name), nil, nil)
+	if IsNotFound(err) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to get pod %s: %v", name, err)
+	}
+	defer resp.Body.Close()
+
+	var pod Pod
+	if err := json.NewDecoder(resp.Body).Decode(&pod); err != nil {
+		return nil, fmt.Errorf("Failed to decode pod %s: %v", name, err)
+	}
+
+	return &pod, nil
+}
+
+// DeletePod deletes the pod, giving it's containers the grace period to exit
+// after they're terminated
+func (c *Client) DeletePod(namespace, name string, gracePeriod time.Duration) error {
+	query := url.Values{"gracePeriodSeconds": {fmt.Sprintf("%d", int(gracePeriod/time.Second))}}
+
+	resp, err := c.do("DELETE", apiPath(namespace, "pods", name), query, nil)
+	if IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to delete pod %s: %v", name, err)
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+// StreamLogs follows the output of the pod's container until it exits
+func (c *Client) StreamLogs(namespace, name, container string) (io.ReadCloser, error) {
+	query := url.Values{"container": {container}, "follow": {"true"}}
+
+	resp, err := c.do("GET", apiPath(namespace, "pods", name)+"/log", query, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to stream the logs of pod %s: %v", name, err)
+	}
+
+	return resp.Body, nil
+}
+
+// CreateSecret creates the secret in it's namespace
+func (c *Client) CreateSecret(secret *Secret) error {
+	secret.APIVersion = "v1"
+	secret.Kind = "Secret"
+
+	body, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do("POST", apiPath(secret.Metadata.Namespace, "secrets", ""), nil, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Failed to create secret %s: %v", secret.Metadata.Name, err)
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+// DeleteSecret deletes the secret, if it's still there
+func (c *Client) DeleteSecret(namespace, name string) error {
+	resp, err := c.do("DELETE", apiPath(namespace, "secrets", name), nil, nil)
+	if IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to delete secret %s: %v", name, err)
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+func apiPath(namespace, resource, name string) string {
+	path := "/api/v1/namespaces/" + url.PathEscape(namespace) + "/" + resource
+	if name != "" {
+		path += "/" + url.PathEscape(name)
+	}
+	return path
+}
+
+// Makes a request to the API, returning an error with the API's message if
+// it doesn't succeed
+func (c *Client) do(method, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	u := strings.TrimSuffix(c.Endpoint, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+
+		// Failures are described by a Status object
+		apiErr := &APIError{StatusCode: resp.StatusCode, Message: resp.Status}
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&status) == nil && status.Message != "" {
+			apiErr.Message = fmt.Sprintf("%s (%s)", status.Message, resp.Status)
+		}
+		return nil, apiErr
+	}
+
+	return resp, nil
+}
+
+// APIError is returned when the API responds with an error
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// IsNotFound returns whether the error is because something doesn't exist
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
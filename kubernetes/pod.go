@@ -0,0 +1,242 @@
+package kubernetes
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The name of the container in a job's pod that runs the bootstrap
+const jobContainer = "job"
+
+// The pod waiting reasons that mean the container is never going to start
+var fatalWaitingReasons = map[string]bool{
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// Pod is the parts of a Kubernetes pod that jobs use
+type Pod struct {
+	APIVersion string     `json:"apiVersion,omitempty"`
+	Kind       string     `json:"kind,omitempty"`
+	Metadata   ObjectMeta `json:"metadata"`
+	Spec       PodSpec    `json:"spec"`
+	Status     PodStatus  `json:"status"`
+}
+
+type ObjectMeta struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+type PodSpec struct {
+	RestartPolicy string            `json:"restartPolicy,omitempty"`
+	NodeSelector  map[string]string `json:"nodeSelector,omitempty"`
+	Containers    []Container       `json:"containers"`
+}
+
+type Container struct {
+	Name      string               `json:"name"`
+	Image     string               `json:"image"`
+	Command   []string             `json:"command,omitempty"`
+	Env       []EnvVar             `json:"env,omitempty"`
+	Resources ResourceRequirements `json:"resources,omitempty"`
+}
+
+type EnvVar struct {
+	Name      string        `json:"name"`
+	Value     string        `json:"value,omitempty"`
+	ValueFrom *EnvVarSource `json:"valueFrom,omitempty"`
+}
+
+type EnvVarSource struct {
+	SecretKeyRef *SecretKeySelector `json:"secretKeyRef,omitempty"`
+}
+
+type SecretKeySelector struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// Secret is the parts of a Kubernetes secret that jobs use
+type Secret struct {
+	APIVersion string            `json:"apiVersion,omitempty"`
+	Kind       string            `json:"kind,omitempty"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
+	StringData map[string]string `json:"stringData,omitempty"`
+}
+
+type ResourceRequirements struct {
+	Requests map[string]string `json:"requests,omitempty"`
+	Limits   map[string]string `json:"limits,omitempty"`
+}
+
+type PodStatus struct {
+	Phase             string            `json:"phase,omitempty"`
+	Reason            string            `json:"reason,omitempty"`
+	Message           string            `json:"message,omitempty"`
+	ContainerStatuses []ContainerStatus `json:"containerStatuses,omitempty"`
+}
+
+type ContainerStatus struct {
+	Name  string         `json:"name"`
+	State ContainerState `json:"state"`
+}
+
+type ContainerState struct {
+	Waiting    *ContainerStateWaiting    `json:"waiting,omitempty"`
+	Running    *struct{}                 `json:"running,omitempty"`
+	Terminated *ContainerStateTerminated `json:"terminated,omitempty"`
+}
+
+type ContainerStateWaiting struct {
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type ContainerStateTerminated struct {
+	ExitCode int    `json:"exitCode"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// PodOptions configure the pod a job is run in
+type PodOptions struct {
+	// The ID of the job, which the pod is named after
+	JobID string
+
+	Namespace string
+	Image     string
+
+	// The command that runs the bootstrap in the image
+	Command []string
+
+	// The job's environment
+	Env map[string]string
+
+	// The job's environment that's secret, like it's token. It's kept in a
+	// secret of the job's rather than in the pod, where anyone who can get
+	// the pod could read it.
+	SecretEnv map[string]string
+
+	// The CPU and memory the job needs, in Kubernetes' quantities like
+	// 500m or 2Gi. They're used as both the requests and limits.
+	CPU    string
+	Memory string
+
+	NodeSelector map[string]string
+}
+
+// NewJobPod returns the pod that runs a job
+func NewJobPod(opts PodOptions) *Pod {
+	resources := map[string]string{}
+	if opts.CPU != "" {
+		resources["cpu"] = opts.CPU
+	}
+	if opts.Memory != "" {
+		resources["memory"] = opts.Memory
+	}
+
+	var requirements ResourceRequirements
+	if len(resources) > 0 {
+		requirements = ResourceRequirements{Requests: resources, Limits: resources}
+	}
+
+	// Sorted, so the pod is the same each time
+	var env []EnvVar
+	for name, value := range opts.Env {
+		env = append(env, EnvVar{Name: name, Value: value})
+	}
+	for name := range opts.SecretEnv {
+		env = append(env, EnvVar{Name: name, ValueFrom: &EnvVarSource{
+			SecretKeyRef: &SecretKeySelector{Name: jobObjectName(opts.JobID), Key: name},
+		}})
+	}
+	sort.Slice(env, func(i, j int) bool { return env[i].Name < env[j].Name })
+
+	return &Pod{
+		Metadata: jobObjectMeta(opts),
+		Spec: PodSpec{
+			RestartPolicy: "Never",
+			NodeSelector:  opts.NodeSelector,
+			Containers: []Container{{
+				Name:      jobContainer,
+				Image:     opts.Image,
+				Command:   opts.Command,
+				Env:       env,
+				Resources: requirements,
+			}},
+		},
+	}
+}
+
+// NewJobSecret returns the secret with the job's secret environment, or nil if
+// it doesn't have any
+func NewJobSecret(opts PodOptions) *Secret {
+	if len(opts.SecretEnv) == 0 {
+		return nil
+	}
+
+	return &Secret{
+		Metadata:   jobObjectMeta(opts),
+		Type:       "Opaque",
+		StringData: opts.SecretEnv,
+	}
+}
+
+// The job's pod and secret are both named after it
+func jobObjectName(jobID string) string {
+	return "buildkite-" + strings.ToLower(jobID)
+}
+
+func jobObjectMeta(opts PodOptions) ObjectMeta {
+	return ObjectMeta{
+		Name:      jobObjectName(opts.JobID),
+		Namespace: opts.Namespace,
+		Labels:    map[string]string{"buildkite.com/job-id": opts.JobID},
+	}
+}
+
+// ParseNodeSelector parses node labels in the form key=value
+func ParseNodeSelector(labels []string) (map[string]string, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+
+	selector := map[string]string{}
+	for _, label := range labels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid node selector %q, expected key=value", label)
+		}
+		selector[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return selector, nil
+}
+
+// Returns the status of the job's container, if it's been created
+func (p *Pod) jobContainerState() ContainerState {
+	for _, status := range p.Status.ContainerStatuses {
+		if status.Name == jobContainer {
+			return status.State
+		}
+	}
+	return ContainerState{}
+}
+
+// Returns an error if the job is never going to run
+func (p *Pod) startError() error {
+	if waiting := p.jobContainerState().Waiting; waiting != nil && fatalWaitingReasons[waiting.Reason] {
+		return fmt.Errorf("The job's container couldn't start: %s %s", waiting.Reason, waiting.Message)
+	}
+
+	if p.Status.Phase == "Failed" && p.jobContainerState().Terminated == nil {
+		return fmt.Errorf("The job's pod failed: %s %s", p.Status.Reason, p.Status.Message)
+	}
+
+	return nil
+}
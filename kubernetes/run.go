@@ -0,0 +1,146 @@
+package kubernetes
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+	"github.com/buildkite/agent/retry"
+)
+
+// How often the pod is checked on while it's starting and stopping
+var pollInterval = time.Second
+
+// RunJob runs the job's pod, copying it's output to w until it finishes, and
+// returns the exit code of the job's container. The job's secret, if it has
+// one, is created first for the pod to get it's secret environment from.
+// Closing cancel deletes the pod, giving the job the grace period to run it's
+// pre-exit hooks. The pod and secret are always deleted before it returns.
+func RunJob(client *Client, pod *Pod, secret *Secret, w io.Writer, cancel <-chan struct{}, gracePeriod time.Duration) (int, error) {
+	namespace, name := pod.Metadata.Namespace, pod.Metadata.Name
+
+	if secret != nil {
+		if err := client.CreateSecret(secret); err != nil {
+			return -1, err
+		}
+
+		defer func() {
+			if err := client.DeleteSecret(secret.Metadata.Namespace, secret.Metadata.Name); err != nil {
+				logger.Warn("%s", err)
+			}
+		}()
+	}
+
+	if err := client.CreatePod(pod); err != nil {
+		return -1, err
+	}
+
+	defer func() {
+		if err := client.DeletePod(namespace, name, 0); err != nil {
+			logger.Warn("%s", err)
+		}
+	}()
+
+	// Cancelling deletes the pod, which terminates the job's container
+	// and waits for the grace period before killing it
+	stopCancelling := make(chan struct{})
+	defer close(stopCancelling)
+
+	go func() {
+		select {
+		case <-cancel:
+			logger.Info("Cancelling the job by deleting pod %s", name)
+			if err := client.DeletePod(namespace, name, gracePeriod); err != nil {
+				logger.Error("%s", err)
+			}
+		case <-stopCancelling:
+		}
+	}()
+
+	logger.Info("Waiting for pod %s/%s to start", namespace, name)
+
+	if _, err := waitForPod(client, namespace, name, cancel, func(p *Pod) bool {
+		state := p.jobContainerState()
+		return state.Running != nil || state.Terminated != nil
+	}); err != nil {
+		return -1, err
+	}
+
+	logs, err := client.StreamLogs(namespace, name, jobContainer)
+	if err != nil {
+		return -1, err
+	}
+	_, err = io.Copy(w, logs)
+	logs.Close()
+	if err != nil {
+		logger.Warn("The logs of pod %s stopped streaming: %v", name, err)
+	}
+
+	// The logs can finish just before the container is marked as finished
+	finished, err := waitForPod(client, namespace, name, nil, func(p *Pod) bool {
+		return p.jobContainerState().Terminated != nil
+	})
+	if IsNotFound(err) {
+		select {
+		case <-cancel:
+			return -1, fmt.Errorf("The job was cancelled")
+		default:
+			return -1, fmt.Errorf("Pod %s was deleted before the job finished", name)
+		}
+	} else if err != nil {
+		return -1, err
+	}
+
+	terminated := finished.jobContainerState().Terminated
+	if terminated.Reason == "OOMKilled" {
+		fmt.Fprintf(w, "\033[31m🚨 Error: The job ran out of memory and was killed\033[0m\n")
+	}
+
+	return terminated.ExitCode, nil
+}
+
+// Polls the pod until done returns true, returning an error if the pod fails
+// to start or it's been cancelled
+func waitForPod(client *Client, namespace, name string, cancel <-chan struct{}, done func(*Pod) bool) (*Pod, error) {
+	for {
+		pod, err := getPod(client, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if done(pod) {
+			return pod, nil
+		}
+
+		if err := pod.startError(); err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-cancel:
+			return nil, fmt.Errorf("The job was cancelled before pod %s started", name)
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Gets the pod, retrying errors from the API server other than the pod not
+// being found, so a blip while the job's running doesn't fail it and delete
+// the pod from under it
+func getPod(client *Client, namespace, name string) (*Pod, error) {
+	var pod *Pod
+
+	err := retry.Do(func(s *retry.Stats) error {
+		var err error
+		pod, err = client.GetPod(namespace, name)
+		if IsNotFound(err) {
+			s.Break()
+		} else if err != nil {
+			logger.Warn("Failed to check on pod %s: %v (%s)", name, err, s)
+		}
+		return err
+	}, &retry.Config{Maximum: 10, Interval: pollInterval, Exponential: true, MaxInterval: 30 * time.Second})
+
+	return pod, err
+}
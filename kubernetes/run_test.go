@@ -0,0 +1,186 @@
+package kubernetes
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A fake API server with a single pod, which starts on the second time it's
+// checked on and finishes once it's logs have been read
+type fakeAPI struct {
+	pod            *Pod
+	secret         *Secret
+	gets           int
+	deletes        []string
+	secretsDeleted int
+	mutex          sync.Mutex
+
+	// Which check on the pod the API server fails, if any
+	failingGet int
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	const podPath = "/api/v1/namespaces/builds/pods/buildkite-abc"
+
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/api/v1/namespaces/builds/pods":
+		f.pod = &Pod{}
+		json.NewDecoder(r.Body).Decode(f.pod)
+		json.NewEncoder(w).Encode(f.pod)
+
+	case r.Method == "GET" && r.URL.Path == podPath:
+		f.gets++
+		if f.gets == f.failingGet {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"kind":"Status","message":"the server is currently unable to handle the request"}`))
+			return
+		}
+		if f.gets > 1 && f.pod.Status.ContainerStatuses == nil {
+			f.pod.Status.ContainerStatuses = []ContainerStatus{{Name: "job", State: ContainerState{Running: &struct{}{}}}}
+		}
+		json.NewEncoder(w).Encode(f.pod)
+
+	case r.Method == "GET" && r.URL.Path == podPath+"/log":
+		w.Write([]byte("~~~ Running the job\nllamas\n"))
+		f.pod.Status.ContainerStatuses = []ContainerStatus{{Name: "job", State: ContainerState{
+			Terminated: &ContainerStateTerminated{ExitCode: 3, Reason: "Error"},
+		}}}
+
+	case r.Method == "DELETE" && r.URL.Path == podPath:
+		f.deletes = append(f.deletes, r.URL.Query().Get("gracePeriodSeconds"))
+		w.Write([]byte("{}"))
+
+	case r.Method == "POST" && r.URL.Path == "/api/v1/namespaces/builds/secrets":
+		f.secret = &Secret{}
+		json.NewDecoder(r.Body).Decode(f.secret)
+		json.NewEncoder(w).Encode(f.secret)
+
+	case r.Method == "DELETE" && r.URL.Path == "/api/v1/namespaces/builds/secrets/buildkite-abc":
+		f.secretsDeleted++
+		w.Write([]byte("{}"))
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"kind":"Status","message":"pods \"llamas\" not found"}`))
+	}
+}
+
+func TestRunningJobPods(t *testing.T) {
+	defer func(interval time.Duration) { pollInterval = interval }(pollInterval)
+	pollInterval = time.Millisecond
+
+	api := &fakeAPI{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	opts := PodOptions{
+		JobID:        "ABC",
+		Namespace:    "builds",
+		Image:        "buildkite/agent:3",
+		Command:      []string{"buildkite-agent", "bootstrap"},
+		Env:          map[string]string{"BUILDKITE_JOB_ID": "ABC", "BUILDKITE_COMMAND": "make"},
+		SecretEnv:    map[string]string{"BUILDKITE_AGENT_ACCESS_TOKEN": "llamas"},
+		CPU:          "500m",
+		NodeSelector: map[string]string{"pool": "builds"},
+	}
+
+	var output bytes.Buffer
+	exitCode, err := RunJob(&Client{Endpoint: server.URL}, NewJobPod(opts), NewJobSecret(opts), &output, nil, 10*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, exitCode)
+	assert.Equal(t, "~~~ Running the job\nllamas\n", output.String())
+
+	created := api.pod
+	assert.Equal(t, "buildkite-abc", created.Metadata.Name)
+	assert.Equal(t, "ABC", created.Metadata.Labels["buildkite.com/job-id"])
+	assert.Equal(t, "Never", created.Spec.RestartPolicy)
+	assert.Equal(t, map[string]string{"pool": "builds"}, created.Spec.NodeSelector)
+
+	container := created.Spec.Containers[0]
+	assert.Equal(t, "buildkite/agent:3", container.Image)
+	assert.Equal(t, []string{"buildkite-agent", "bootstrap"}, container.Command)
+	assert.Equal(t, []EnvVar{
+		{Name: "BUILDKITE_AGENT_ACCESS_TOKEN", ValueFrom: &EnvVarSource{SecretKeyRef: &SecretKeySelector{Name: "buildkite-abc", Key: "BUILDKITE_AGENT_ACCESS_TOKEN"}}},
+		{Name: "BUILDKITE_COMMAND", Value: "make"},
+		{Name: "BUILDKITE_JOB_ID", Value: "ABC"},
+	}, container.Env)
+	assert.Equal(t, map[string]string{"cpu": "500m"}, container.Resources.Limits)
+
+	// The secret environment is only in the job's secret
+	assert.Equal(t, "buildkite-abc", api.secret.Metadata.Name)
+	assert.Equal(t, map[string]string{"BUILDKITE_AGENT_ACCESS_TOKEN": "llamas"}, api.secret.StringData)
+
+	// The pod and secret are cleaned up once it's finished
+	assert.Equal(t, []string{"0"}, api.deletes)
+	assert.Equal(t, 1, api.secretsDeleted)
+}
+
+func TestRunningJobPodsRetriesFailedChecks(t *testing.T) {
+	defer func(interval time.Duration) { pollInterval = interval }(pollInterval)
+	pollInterval = time.Millisecond
+
+	// The API server fails once while the pod's running
+	api := &fakeAPI{failingGet: 3}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	opts := PodOptions{JobID: "ABC", Namespace: "builds", Image: "buildkite/agent:3"}
+
+	var output bytes.Buffer
+	exitCode, err := RunJob(&Client{Endpoint: server.URL}, NewJobPod(opts), nil, &output, nil, 10*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, exitCode)
+	assert.Equal(t, 4, api.gets)
+	assert.Equal(t, []string{"0"}, api.deletes)
+}
+
+func TestJobsWithoutSecretEnvDontHaveSecrets(t *testing.T) {
+	assert.Nil(t, NewJobSecret(PodOptions{JobID: "abc", Env: map[string]string{"BUILDKITE_COMMAND": "make"}}))
+}
+
+func TestRunningJobPodsThatCantStart(t *testing.T) {
+	defer func(interval time.Duration) { pollInterval = interval }(pollInterval)
+	pollInterval = time.Millisecond
+
+	var deleted bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			json.NewEncoder(w).Encode(&Pod{Status: PodStatus{
+				Phase: "Pending",
+				ContainerStatuses: []ContainerStatus{{Name: "job", State: ContainerState{
+					Waiting: &ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "Back-off pulling image"},
+				}}},
+			}})
+		case "DELETE":
+			deleted = true
+		}
+	}))
+	defer server.Close()
+
+	pod := NewJobPod(PodOptions{JobID: "abc", Namespace: "builds", Image: "llamas"})
+
+	_, err := RunJob(&Client{Endpoint: server.URL}, pod, nil, &bytes.Buffer{}, nil, time.Second)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "ImagePullBackOff")
+	assert.True(t, deleted)
+}
+
+func TestParsingNodeSelectors(t *testing.T) {
+	selector, err := ParseNodeSelector([]string{"pool=builds", "kubernetes.io/arch = arm64"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"pool": "builds", "kubernetes.io/arch": "arm64"}, selector)
+
+	_, err = ParseNodeSelector([]string{"llamas"})
+	assert.Error(t, err)
+}
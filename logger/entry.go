@@ -0,0 +1,67 @@
+package logger
+
+import (
+	"os"
+	"time"
+)
+
+// Fields are extra information attached to a log entry, i.e. the job it's
+// about. They're only written in the json format.
+type Fields map[string]interface{}
+
+// Entry is a single message written to the log
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Fields  Fields
+}
+
+// FieldLogger writes log entries that all have the same fields
+type FieldLogger struct {
+	fields Fields
+}
+
+// WithFields returns a logger that adds the fields to every entry
+func WithFields(fields Fields) *FieldLogger {
+	return &FieldLogger{fields: fields}
+}
+
+// WithFields returns a logger with the fields added to the existing ones
+func (f *FieldLogger) WithFields(fields Fields) *FieldLogger {
+	merged := Fields{}
+	for k, v := range f.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &FieldLogger{fields: merged}
+}
+
+func (f *FieldLogger) Debug(format string, v ...interface{}) {
+	if level == DEBUG {
+		log(DEBUG, f.fields, format, v...)
+	}
+}
+
+func (f *FieldLogger) Error(format string, v ...interface{}) {
+	log(ERROR, f.fields, format, v...)
+}
+
+func (f *FieldLogger) Fatal(format string, v ...interface{}) {
+	log(FATAL, f.fields, format, v...)
+	os.Exit(1)
+}
+
+func (f *FieldLogger) Notice(format string, v ...interface{}) {
+	log(NOTICE, f.fields, format, v...)
+}
+
+func (f *FieldLogger) Info(format string, v ...interface{}) {
+	log(INFO, f.fields, format, v...)
+}
+
+func (f *FieldLogger) Warn(format string, v ...interface{}) {
+	log(WARN, f.fields, format, v...)
+}
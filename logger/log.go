@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -24,8 +25,18 @@ const (
 
 var level = INFO
 var colors = true
+var format = TextFormat
+var sinks = []Sink{StderrSink}
 var mutex = sync.Mutex{}
 
+const (
+	// Lines of text for people to read
+	TextFormat = "text"
+
+	// A JSON object per line for log aggregators
+	JSONFormat = "json"
+)
+
 func GetLevel() Level {
 	return level
 }
@@ -42,6 +53,33 @@ func SetColors(b bool) {
 	colors = b
 }
 
+func GetFormat() string {
+	return format
+}
+
+// SetFormat changes how log lines are written, either text or json
+func SetFormat(f string) error {
+	switch f {
+	case TextFormat, JSONFormat:
+		format = f
+		return nil
+	default:
+		return fmt.Errorf("Unknown log format \"%s\", expected text or json", f)
+	}
+}
+
+// SetSinks changes where log lines are written to, closing the old ones
+func SetSinks(s []Sink) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, sink := range sinks {
+		sink.Close()
+	}
+
+	sinks = s
+}
+
 func ColorsEnabled() bool {
 	if runtime.GOOS == "windows" {
 		// Boo, no colors on Windows.
@@ -63,62 +101,101 @@ func OutputPipe() io.Writer {
 
 func Debug(format string, v ...interface{}) {
 	if level == DEBUG {
-		log(DEBUG, format, v...)
+		log(DEBUG, nil, format, v...)
 	}
 }
 
 func Error(format string, v ...interface{}) {
-	log(ERROR, format, v...)
+	log(ERROR, nil, format, v...)
 }
 
 func Fatal(format string, v ...interface{}) {
-	log(FATAL, format, v...)
+	log(FATAL, nil, format, v...)
 	os.Exit(1)
 }
 
 func Notice(format string, v ...interface{}) {
-	log(NOTICE, format, v...)
+	log(NOTICE, nil, format, v...)
 }
 
 func Info(format string, v ...interface{}) {
-	log(INFO, format, v...)
+	log(INFO, nil, format, v...)
 }
 
 func Warn(format string, v ...interface{}) {
-	log(WARN, format, v...)
-}
-
-func log(l Level, format string, v ...interface{}) {
-	level := strings.ToUpper(l.String())
-	message := fmt.Sprintf(format, v...)
-	now := time.Now().Format("2006-01-02 15:04:05")
-	line := ""
-
-	if ColorsEnabled() {
-		prefixColor := green
-		messageColor := nocolor
-
-		if l == DEBUG {
-			prefixColor = gray
-			messageColor = gray
-		} else if l == NOTICE {
-			prefixColor = cyan
-		} else if l == WARN {
-			prefixColor = yellow
-		} else if l == ERROR {
-			prefixColor = red
-		} else if l == FATAL {
-			prefixColor = red
-			messageColor = red
-		}
+	log(WARN, nil, format, v...)
+}
 
-		line = fmt.Sprintf("\x1b[%sm%s %-6s\x1b[0m \x1b[%sm%s\x1b[0m\n", prefixColor, now, level, messageColor, message)
-	} else {
-		line = fmt.Sprintf("%s %-6s %s\n", now, level, message)
+func log(l Level, fields Fields, format string, v ...interface{}) {
+	entry := &Entry{
+		Time:    time.Now(),
+		Level:   l,
+		Message: fmt.Sprintf(format, v...),
+		Fields:  fields,
 	}
 
 	// Make sure we're only outputing a line one at a time
 	mutex.Lock()
-	fmt.Fprint(OutputPipe(), line)
-	mutex.Unlock()
+	defer mutex.Unlock()
+
+	for _, sink := range sinks {
+		if err := sink.Write(entry); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write to log sink: %v\n", err)
+		}
+	}
+}
+
+// Formats an entry as a line of text, or a JSON object in the json format
+func formatEntry(e *Entry, colors bool) []byte {
+	if format == JSONFormat {
+		return formatJSONEntry(e)
+	}
+
+	level := strings.ToUpper(e.Level.String())
+	now := e.Time.Format("2006-01-02 15:04:05")
+
+	if !colors {
+		return []byte(fmt.Sprintf("%s %-6s %s\n", now, level, e.Message))
+	}
+
+	prefixColor := green
+	messageColor := nocolor
+
+	if e.Level == DEBUG {
+		prefixColor = gray
+		messageColor = gray
+	} else if e.Level == NOTICE {
+		prefixColor = cyan
+	} else if e.Level == WARN {
+		prefixColor = yellow
+	} else if e.Level == ERROR {
+		prefixColor = red
+	} else if e.Level == FATAL {
+		prefixColor = red
+		messageColor = red
+	}
+
+	return []byte(fmt.Sprintf("\x1b[%sm%s %-6s\x1b[0m \x1b[%sm%s\x1b[0m\n", prefixColor, now, level, messageColor, e.Message))
+}
+
+func formatJSONEntry(e *Entry) []byte {
+	object := map[string]interface{}{}
+	for k, v := range e.Fields {
+		object[k] = v
+	}
+
+	object["time"] = e.Time.Format(time.RFC3339Nano)
+	object["level"] = strings.ToLower(e.Level.String())
+	object["msg"] = e.Message
+
+	line, err := json.Marshal(object)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{
+			"time":  e.Time.Format(time.RFC3339Nano),
+			"level": strings.ToLower(e.Level.String()),
+			"msg":   e.Message,
+		})
+	}
+
+	return append(line, '\n')
 }
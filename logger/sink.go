@@ -0,0 +1,205 @@
+package logger
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Sink is somewhere that log entries are written to
+type Sink interface {
+	Write(e *Entry) error
+	Close() error
+}
+
+// StderrSink writes entries to stderr, which is where they go by default
+var StderrSink Sink = &stderrSink{}
+
+type stderrSink struct{}
+
+func (s *stderrSink) Write(e *Entry) error {
+	_, err := OutputPipe().Write(formatEntry(e, ColorsEnabled()))
+	return err
+}
+
+func (s *stderrSink) Close() error {
+	return nil
+}
+
+// The defaults for file sinks, in megabytes and files
+const (
+	defaultFileMaxSize    = 100
+	defaultFileMaxBackups = 5
+)
+
+var windowsDrivePattern = regexp.MustCompile(`^/[a-zA-Z]:/`)
+
+// ParseSink creates a sink from a url, which is one of:
+//
+//	stderr
+//	file:///var/log/buildkite-agent.log?max-size=100&max-backups=5
+//	syslog                      (the local syslog daemon)
+//	syslog://logs.example.com   (over udp, or syslog+tcp:// for tcp)
+//
+// Files are rotated once they're max-size megabytes, keeping max-backups of
+// the old files. A max-size of 0 turns off rotation.
+func ParseSink(sink string) (Sink, error) {
+	if sink == "stderr" {
+		return StderrSink, nil
+	}
+
+	if sink == "syslog" {
+		return NewSyslogSink("", "")
+	}
+
+	u, err := url.Parse(sink)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		path := u.Path
+		if u.Opaque != "" {
+			path = u.Opaque
+		}
+		if runtime.GOOS == "windows" && windowsDrivePattern.MatchString(path) {
+			path = path[1:]
+		}
+		if path == "" {
+			return nil, fmt.Errorf("Missing a path in the log sink \"%s\"", sink)
+		}
+
+		maxSize, err := sinkOption(u, "max-size", defaultFileMaxSize)
+		if err != nil {
+			return nil, err
+		}
+
+		maxBackups, err := sinkOption(u, "max-backups", defaultFileMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewFileSink(filepath.FromSlash(path), int64(maxSize)*1024*1024, maxBackups)
+	case "syslog":
+		return NewSyslogSink("udp", u.Host)
+	case "syslog+tcp", "syslog+udp":
+		return NewSyslogSink(strings.TrimPrefix(u.Scheme, "syslog+"), u.Host)
+	default:
+		return nil, fmt.Errorf("Unknown log sink \"%s\", expected stderr, file:// or syslog://", sink)
+	}
+}
+
+func sinkOption(u *url.URL, name string, defaultValue int) (int, error) {
+	value := u.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid %s \"%s\" in the log sink \"%s\"", name, value, u.String())
+	}
+
+	return n, nil
+}
+
+// FileSink appends entries to a file, moving it aside once it's too big
+type FileSink struct {
+	// Where the log is written to
+	Path string
+
+	// How big in bytes the file can get before it's rotated, or 0 to
+	// never rotate it
+	MaxSize int64
+
+	// How many rotated files to keep, named Path.1, Path.2 and so on
+	MaxBackups int
+
+	file *os.File
+	size int64
+}
+
+// NewFileSink opens the file, creating it if it doesn't exist
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) Write(e *Entry) error {
+	line := formatEntry(e, false)
+
+	if s.MaxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.MaxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+
+	return err
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+func (s *FileSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	if s.MaxBackups == 0 {
+		if err := os.Remove(s.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return s.open()
+	}
+
+	// Shuffle the old files along, dropping the oldest
+	for i := s.MaxBackups - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", s.Path, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", s.Path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := os.Rename(s.Path, s.Path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return s.open()
+}
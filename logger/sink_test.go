@@ -0,0 +1,90 @@
+package logger
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSinkRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "agent.log")
+
+	sink, err := ParseSink("file://" + filepath.ToSlash(path) + "?max-size=0&max-backups=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+
+	// Rotate after every two lines
+	fileSink, err := NewFileSink(path, 70, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileSink.Close()
+
+	for i := 0; i < 8; i++ {
+		if err := fileSink.Write(&Entry{Time: time.Now(), Level: INFO, Message: "llamas"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"agent.log", "agent.log.1", "agent.log.2"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(data), "\n"); lines != 2 {
+			t.Fatalf("Expected 2 lines in %s, got %d", name, lines)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "agent.log.3")); !os.IsNotExist(err) {
+		t.Fatalf("Expected only 2 backups to be kept")
+	}
+}
+
+func TestFormattingJSONEntries(t *testing.T) {
+	line := formatJSONEntry(&Entry{
+		Time:    time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+		Level:   WARN,
+		Message: "Something happened",
+		Fields:  Fields{"job_id": "abc", "phase": "run"},
+	})
+
+	var object map[string]string
+	if err := json.Unmarshal(line, &object); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"time":   "2018-01-02T03:04:05Z",
+		"level":  "warn",
+		"msg":    "Something happened",
+		"job_id": "abc",
+		"phase":  "run",
+	}
+
+	for k, v := range expected {
+		if object[k] != v {
+			t.Fatalf("Expected %s to be %q, got %q", k, v, object[k])
+		}
+	}
+}
+
+func TestParsingUnknownSinks(t *testing.T) {
+	for _, sink := range []string{"stdout", "http://example.com", "file://"} {
+		if _, err := ParseSink(sink); err == nil {
+			t.Fatalf("Expected an error for %q", sink)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// +build !windows
+
+package logger
+
+import (
+	"log/syslog"
+)
+
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink creates a sink that sends entries to a syslog server, or the
+// local syslog daemon if network and address are empty
+func NewSyslogSink(network string, address string) (Sink, error) {
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, "buildkite-agent")
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) Write(e *Entry) error {
+	// Syslog has it's own timestamps and levels, so text entries are sent
+	// as just the message
+	message := e.Message
+	if format == JSONFormat {
+		message = string(formatJSONEntry(e))
+	}
+
+	switch e.Level {
+	case DEBUG:
+		return s.writer.Debug(message)
+	case NOTICE:
+		return s.writer.Notice(message)
+	case WARN:
+		return s.writer.Warning(message)
+	case ERROR:
+		return s.writer.Err(message)
+	case FATAL:
+		return s.writer.Crit(message)
+	default:
+		return s.writer.Info(message)
+	}
+}
+
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,10 @@
+package logger
+
+import (
+	"errors"
+)
+
+// NewSyslogSink isn't supported on Windows, which doesn't have syslog
+func NewSyslogSink(network string, address string) (Sink, error) {
+	return nil, errors.New("Logging to syslog isn't supported on Windows")
+}
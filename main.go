@@ -58,6 +58,9 @@ func main() {
 	app.Version = agent.Version()
 	app.Commands = []cli.Command{
 		clicommand.AgentStartCommand,
+		clicommand.AgentStatusCommand,
+		clicommand.AgentDrainCommand,
+		clicommand.AgentStopCommand,
 		clicommand.AnnotateCommand,
 		{
 			Name:  "artifact",
@@ -66,6 +69,24 @@ func main() {
 				clicommand.ArtifactUploadCommand,
 				clicommand.ArtifactDownloadCommand,
 				clicommand.ArtifactShasumCommand,
+				clicommand.ArtifactSearchCommand,
+			},
+		},
+		{
+			Name:  "cache",
+			Usage: "Save and restore caches of files between builds",
+			Subcommands: []cli.Command{
+				clicommand.CacheSaveCommand,
+				clicommand.CacheRestoreCommand,
+			},
+		},
+		{
+			Name:  "lock",
+			Usage: "Share locks between the jobs running on this machine",
+			Subcommands: []cli.Command{
+				clicommand.LockAcquireCommand,
+				clicommand.LockReleaseCommand,
+				clicommand.LockDoCommand,
 			},
 		},
 		{
@@ -75,6 +96,14 @@ func main() {
 				clicommand.MetaDataSetCommand,
 				clicommand.MetaDataGetCommand,
 				clicommand.MetaDataExistsCommand,
+				clicommand.MetaDataListCommand,
+			},
+		},
+		{
+			Name:  "oidc",
+			Usage: "Get OIDC tokens that identify the job to cloud providers",
+			Subcommands: []cli.Command{
+				clicommand.OIDCRequestTokenCommand,
 			},
 		},
 		{
@@ -84,7 +113,33 @@ func main() {
 				clicommand.PipelineUploadCommand,
 			},
 		},
+		{
+			Name:  "plugin",
+			Usage: "Manage the plugins used by jobs on this machine",
+			Subcommands: []cli.Command{
+				{
+					Name:  "cache",
+					Usage: "Manage the shared plugin cache",
+					Subcommands: []cli.Command{
+						clicommand.PluginCacheCleanCommand,
+					},
+				},
+			},
+		},
+		{
+			Name:  "step",
+			Usage: "Get or update an attribute of a build step",
+			Subcommands: []cli.Command{
+				clicommand.StepGetCommand,
+				clicommand.StepUpdateCommand,
+			},
+		},
+		clicommand.SelfUpdateCommand,
+		clicommand.TestSummaryCommand,
+		clicommand.CoverageCommand,
 		clicommand.BootstrapCommand,
+		clicommand.GitCredentialsHelperCommand,
+		clicommand.KubernetesBootstrapCommand,
 	}
 
 	// When no sub command is used
@@ -0,0 +1,378 @@
+// Package metrics keeps counters, gauges and histograms for the agent and
+// serves them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The buckets histograms use if they aren't given any, in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// The metrics that are served by Handler
+var registry struct {
+	metrics []metric
+	mutex   sync.Mutex
+}
+
+type metric interface {
+	family() *family
+	write(w io.Writer)
+
+	// Records a value reported by another process
+	apply(v float64, labelValues []string)
+}
+
+// Finds a metric that's been created by it's name
+func lookup(name string) metric {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	for _, m := range registry.metrics {
+		if m.family().name == name {
+			return m
+		}
+	}
+
+	return nil
+}
+
+func register(m metric) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.metrics = append(registry.metrics, m)
+}
+
+// Handler serves all the metrics that have been created
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
+
+// Write writes all the metrics that have been created in the Prometheus text
+// format
+func Write(w io.Writer) {
+	registry.mutex.Lock()
+	metrics := append([]metric{}, registry.metrics...)
+	registry.mutex.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// The parts common to each type of metric. Every combination of label values
+// is kept as a separate series.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	series map[string]interface{}
+	mutex  sync.Mutex
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+	return &family{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: map[string]interface{}{},
+	}
+}
+
+// Returns the series for the label values, creating it if it doesn't exist.
+// Must be called with the mutex held.
+func (f *family) get(labelValues []string, create func() interface{}) interface{} {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = create()
+		f.series[key] = s
+	}
+
+	return s
+}
+
+// Returns the value of a counter or gauge series, which is zero if it hasn't
+// been changed yet. Must be called with the mutex held.
+func (f *family) value(labelValues []string) float64 {
+	if v, ok := f.series[strings.Join(labelValues, "\xff")].(*float64); ok {
+		return *v
+	}
+	return 0
+}
+
+// Calls fn with the label values and series, sorted by label values so the
+// output is stable. Must be called with the mutex held.
+func (f *family) each(fn func(labelValues []string, s interface{})) {
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var labelValues []string
+		if len(f.labels) > 0 {
+			labelValues = strings.Split(k, "\xff")
+		}
+		fn(labelValues, f.series[k])
+	}
+}
+
+func (f *family) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+// Formats a series' labels, with any extra label for histogram buckets
+func (f *family) formatLabels(labelValues []string, extra ...string) string {
+	names := append([]string{}, f.labels...)
+	values := append([]string{}, labelValues...)
+
+	// Extra labels are given as name, value pairs
+	for i := 0; i+1 < len(extra); i += 2 {
+		names = append(names, extra[i])
+		values = append(values, extra[i+1])
+	}
+
+	if len(names) == 0 {
+		return ""
+	}
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, names[i], escaper.Replace(values[i]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// Counter is a value that only goes up, like the number of jobs run
+type Counter struct {
+	f *family
+}
+
+// NewCounter creates a counter, which needs a value for each of the labels
+// every time it's changed
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{f: newFamily(name, help, "counter", labels)}
+	register(c)
+	return c
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds a positive amount to the counter
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: %s can't be decreased", c.f.name))
+	}
+
+	c.f.mutex.Lock()
+	value := c.f.get(labelValues, func() interface{} { return new(float64) }).(*float64)
+	*value += v
+	c.f.mutex.Unlock()
+
+	eachSink(func(s Sink) { s.Count(c.f.name, v, c.f.tags(labelValues)) })
+}
+
+// Value returns the counter's current value
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.f.mutex.Lock()
+	defer c.f.mutex.Unlock()
+
+	return c.f.value(labelValues)
+}
+
+func (c *Counter) family() *family {
+	return c.f
+}
+
+func (c *Counter) apply(v float64, labelValues []string) {
+	c.Add(v, labelValues...)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.f.mutex.Lock()
+	defer c.f.mutex.Unlock()
+
+	c.f.writeHeader(w)
+	c.f.each(func(labelValues []string, s interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", c.f.name, c.f.formatLabels(labelValues), formatValue(*s.(*float64)))
+	})
+}
+
+// Gauge is a value that can go up and down, like the number of jobs running
+type Gauge struct {
+	f *family
+}
+
+// NewGauge creates a gauge, which needs a value for each of the labels every
+// time it's changed
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{f: newFamily(name, help, "gauge", labels)}
+	register(g)
+	return g
+}
+
+// Set sets the gauge to a value
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.mutex.Lock()
+	*g.f.get(labelValues, func() interface{} { return new(float64) }).(*float64) = v
+	g.f.mutex.Unlock()
+
+	eachSink(func(s Sink) { s.Gauge(g.f.name, v, g.f.tags(labelValues)) })
+}
+
+// Add adds an amount, which can be negative, to the gauge
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.f.mutex.Lock()
+	value := g.f.get(labelValues, func() interface{} { return new(float64) }).(*float64)
+	*value += v
+	current := *value
+	g.f.mutex.Unlock()
+
+	// Sinks are sent the new value, as not all of them can take changes
+	eachSink(func(s Sink) { s.Gauge(g.f.name, current, g.f.tags(labelValues)) })
+}
+
+// Inc adds one to the gauge
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec subtracts one from the gauge
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Value returns the gauge's current value
+func (g *Gauge) Value(labelValues ...string) float64 {
+	g.f.mutex.Lock()
+	defer g.f.mutex.Unlock()
+
+	return g.f.value(labelValues)
+}
+
+func (g *Gauge) family() *family {
+	return g.f
+}
+
+func (g *Gauge) apply(v float64, labelValues []string) {
+	g.Add(v, labelValues...)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.f.mutex.Lock()
+	defer g.f.mutex.Unlock()
+
+	g.f.writeHeader(w)
+	g.f.each(func(labelValues []string, s interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", g.f.name, g.f.formatLabels(labelValues), formatValue(*s.(*float64)))
+	})
+}
+
+// Histogram counts observations, like how long things take, in buckets
+type Histogram struct {
+	f       *family
+	buckets []float64
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates a histogram with the upper bounds of it's buckets,
+// which are DefaultBuckets if there aren't any
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	h := &Histogram{
+		f:       newFamily(name, help, "histogram", labels),
+		buckets: append([]float64{}, buckets...),
+	}
+	sort.Float64s(h.buckets)
+
+	register(h)
+	return h
+}
+
+// Observe records a value in the histogram
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.f.mutex.Lock()
+	s := h.f.get(labelValues, func() interface{} {
+		return &histogramSeries{counts: make([]uint64, len(h.buckets))}
+	}).(*histogramSeries)
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+	h.f.mutex.Unlock()
+
+	eachSink(func(sink Sink) { sink.Histogram(h.f.name, v, h.f.tags(labelValues)) })
+}
+
+func (h *Histogram) family() *family {
+	return h.f
+}
+
+func (h *Histogram) apply(v float64, labelValues []string) {
+	h.Observe(v, labelValues...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.f.mutex.Lock()
+	defer h.f.mutex.Unlock()
+
+	h.f.writeHeader(w)
+	h.f.each(func(labelValues []string, series interface{}) {
+		s := series.(*histogramSeries)
+
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.f.name, h.f.formatLabels(labelValues, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.f.name, h.f.formatLabels(labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.f.name, h.f.formatLabels(labelValues), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.f.name, h.f.formatLabels(labelValues), s.count)
+	})
+}
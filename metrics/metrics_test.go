@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritingMetrics(t *testing.T) {
+	counter := NewCounter("test_jobs_total", "Jobs by \"status\"", "status")
+	counter.Inc("passed")
+	counter.Add(2, "failed")
+	counter.Inc("passed")
+
+	gauge := NewGauge("test_jobs_running", "Running jobs")
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+
+	histogram := NewHistogram("test_duration_seconds", "Durations", []float64{1, 5}, "phase")
+	histogram.Observe(0.5, "checkout")
+	histogram.Observe(3, "checkout")
+	histogram.Observe(10, "checkout")
+
+	var buf bytes.Buffer
+	Write(&buf)
+
+	for _, expected := range []string{
+		"# HELP test_jobs_total Jobs by \"status\"\n" +
+			"# TYPE test_jobs_total counter\n" +
+			"test_jobs_total{status=\"failed\"} 2\n" +
+			"test_jobs_total{status=\"passed\"} 2\n",
+		"# TYPE test_jobs_running gauge\n" +
+			"test_jobs_running 1\n",
+		"# TYPE test_duration_seconds histogram\n" +
+			"test_duration_seconds_bucket{phase=\"checkout\",le=\"1\"} 1\n" +
+			"test_duration_seconds_bucket{phase=\"checkout\",le=\"5\"} 2\n" +
+			"test_duration_seconds_bucket{phase=\"checkout\",le=\"+Inf\"} 3\n" +
+			"test_duration_seconds_sum{phase=\"checkout\"} 13.5\n" +
+			"test_duration_seconds_count{phase=\"checkout\"} 3\n",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Fatalf("Expected metrics to contain:\n%s\nGot:\n%s", expected, buf.String())
+		}
+	}
+}
+
+func TestEscapingLabelValues(t *testing.T) {
+	counter := NewCounter("test_escaped_total", "Escaped", "path")
+	counter.Inc("C:\\build\n\"llamas\"")
+
+	var buf bytes.Buffer
+	Write(&buf)
+
+	assert.Contains(t, buf.String(), `test_escaped_total{path="C:\\build\n\"llamas\""} 1`)
+}
+
+func TestApplyingReports(t *testing.T) {
+	file, err := ioutil.TempFile("", "metrics-report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	defer os.Setenv(ReportFileEnv, os.Getenv(ReportFileEnv))
+	os.Setenv(ReportFileEnv, file.Name())
+
+	bytesTotal := NewCounter("test_reported_bytes_total", "Bytes", "direction")
+	NewHistogram("test_reported_duration_seconds", "Durations", nil, "phase")
+
+	Report("test_reported_bytes_total", 100, "upload")
+	Report("test_reported_bytes_total", 50, "upload")
+	Report("test_reported_duration_seconds", 2, "command")
+	Report("test_unknown_metric", 1)
+
+	assert.NoError(t, ApplyReports(file.Name()))
+	assert.Equal(t, float64(150), bytesTotal.Value("upload"))
+
+	var buf bytes.Buffer
+	Write(&buf)
+	assert.Contains(t, buf.String(), "test_reported_duration_seconds_count{phase=\"command\"} 1\n")
+
+	// Reports with the wrong labels are errors
+	os.Remove(file.Name())
+	Report("test_reported_bytes_total", 1)
+	assert.Error(t, ApplyReports(file.Name()))
+}
+
+func TestReportingWithoutAReportFile(t *testing.T) {
+	defer os.Setenv(ReportFileEnv, os.Getenv(ReportFileEnv))
+	os.Unsetenv(ReportFileEnv)
+
+	// Does nothing, rather than failing
+	Report("test_reported_bytes_total", 1, "upload")
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// The environment variable with the file that processes run for a job, like
+// the bootstrap and artifact uploads, report their metrics to. The agent
+// adds what's reported to it's own metrics once the job has finished.
+const ReportFileEnv = "BUILDKITE_AGENT_METRICS_REPORT_FILE"
+
+// A value reported to the agent, written as a line of JSON
+type report struct {
+	Name   string   `json:"name"`
+	Value  float64  `json:"value"`
+	Labels []string `json:"labels,omitempty"`
+}
+
+// Protects writes to the report file from within this process
+var reportMutex sync.Mutex
+
+// Report adds a value to one of the agent's metrics, i.e. observes a duration
+// for a histogram, when running as part of a job. It does nothing if the agent
+// isn't collecting metrics.
+func Report(name string, value float64, labelValues ...string) {
+	ReportTo(os.Getenv(ReportFileEnv), name, value, labelValues...)
+}
+
+// ReportTo is Report with the report file given, for when it isn't in the
+// process's environment, i.e. a job's bootstrap run within the agent
+func ReportTo(path string, name string, value float64, labelValues ...string) {
+	if path == "" {
+		return
+	}
+
+	line, err := json.Marshal(report{Name: name, Value: value, Labels: labelValues})
+	if err != nil {
+		logger.Debug("Failed to encode the %s metric (%s)", name, err)
+		return
+	}
+
+	reportMutex.Lock()
+	defer reportMutex.Unlock()
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		logger.Debug("Failed to report the %s metric (%s)", name, err)
+		return
+	}
+	defer file.Close()
+
+	file.Write(append(line, '\n'))
+}
+
+// ApplyReports adds the values that were reported to a file to the metrics
+// they're for. Reports for metrics that don't exist are ignored.
+func ApplyReports(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r report
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return fmt.Errorf("Invalid metrics report %q (%s)", scanner.Text(), err)
+		}
+
+		m := lookup(r.Name)
+		if m == nil {
+			continue
+		}
+
+		if len(r.Labels) != len(m.family().labels) {
+			return fmt.Errorf("The %s metric needs %d labels, but the report had %d", r.Name, len(m.family().labels), len(r.Labels))
+		}
+
+		// Counters can't go down
+		if _, ok := m.(*Counter); ok && r.Value < 0 {
+			continue
+		}
+
+		m.apply(r.Value, r.Labels)
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// Whether the metrics are being served
+var serving bool
+
+// Serve listens on the address and serves the metrics at /metrics in the
+// background. It returns an error if the address can't be listened on.
+func Serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	serving = true
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			logger.Error("Metrics server stopped: %s", err)
+		}
+	}()
+
+	logger.Info("Serving metrics at http://%s/metrics", listener.Addr())
+
+	return nil
+}
+
+// IsServing returns whether the metrics are being served
+func IsServing() bool {
+	return serving
+}
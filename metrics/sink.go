@@ -0,0 +1,71 @@
+package metrics
+
+import "sync"
+
+// Sink is sent every change to the metrics, so they can be sent somewhere
+// that doesn't scrape /metrics, like StatsD. Labels are passed as tags.
+type Sink interface {
+	// Count is sent the amount a counter went up by
+	Count(name string, value float64, tags []Tag)
+
+	// Gauge is sent the new value of a gauge
+	Gauge(name string, value float64, tags []Tag)
+
+	// Histogram is sent each value observed by a histogram
+	Histogram(name string, value float64, tags []Tag)
+}
+
+// Tag is the value of one of a metric's labels
+type Tag struct {
+	Name  string
+	Value string
+}
+
+// The sinks that changes are sent to, along with the metrics server
+var sinks struct {
+	list  []Sink
+	mutex sync.Mutex
+}
+
+// AddSink has every change to the metrics from now on sent to the sink
+func AddSink(s Sink) {
+	sinks.mutex.Lock()
+	defer sinks.mutex.Unlock()
+
+	sinks.list = append(sinks.list, s)
+}
+
+// IsCollecting returns whether the metrics are going anywhere, either being
+// served or sent to a sink, which is when other processes need to report
+// their metrics too
+func IsCollecting() bool {
+	sinks.mutex.Lock()
+	defer sinks.mutex.Unlock()
+
+	return serving || len(sinks.list) > 0
+}
+
+// Calls fn with each of the sinks. It's called once the family's mutex has
+// been released, so a slow sink doesn't hold up the metric.
+func eachSink(fn func(s Sink)) {
+	sinks.mutex.Lock()
+	list := sinks.list
+	sinks.mutex.Unlock()
+
+	for _, s := range list {
+		fn(s)
+	}
+}
+
+// Returns the labels of a series as tags
+func (f *family) tags(labelValues []string) []Tag {
+	if len(f.labels) == 0 {
+		return nil
+	}
+
+	tags := make([]Tag, len(f.labels))
+	for i, name := range f.labels {
+		tags[i] = Tag{Name: name, Value: labelValues[i]}
+	}
+	return tags
+}
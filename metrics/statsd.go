@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"bytes"
+	"net"
+	"strings"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// StatsD sends the metrics to a StatsD server over UDP as they change. With
+// DogStatsD, which is Datadog's, labels are sent as tags, otherwise they're
+// left out as plain StatsD has nowhere to put them.
+type StatsD struct {
+	DogStatsD bool
+
+	conn net.Conn
+}
+
+// NewStatsD creates a sink for the StatsD server at the address, i.e.
+// "127.0.0.1:8125". Nothing needs to be listening yet, as metrics are sent
+// without waiting to hear back.
+func NewStatsD(addr string, dogStatsD bool) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsD{DogStatsD: dogStatsD, conn: conn}, nil
+}
+
+// Count sends the amount a counter went up by
+func (s *StatsD) Count(name string, value float64, tags []Tag) {
+	s.send(name, value, "c", tags)
+}
+
+// Gauge sends the new value of a gauge
+func (s *StatsD) Gauge(name string, value float64, tags []Tag) {
+	// Plain StatsD takes signed gauges as changes to the value, so a
+	// negative one is set from zero
+	if !s.DogStatsD && value < 0 {
+		s.send(name, 0, "g", tags)
+	}
+	s.send(name, value, "g", tags)
+}
+
+// Histogram sends a value observed by a histogram
+func (s *StatsD) Histogram(name string, value float64, tags []Tag) {
+	s.send(name, value, "h", tags)
+}
+
+// Close stops sending metrics
+func (s *StatsD) Close() error {
+	return s.conn.Close()
+}
+
+func (s *StatsD) send(name string, value float64, kind string, tags []Tag) {
+	if _, err := s.conn.Write(s.format(name, value, kind, tags)); err != nil {
+		logger.Debug("Failed to send the %s metric to StatsD (%s)", name, err)
+	}
+}
+
+// Formats the metric as a StatsD line, i.e. name:1|c|#tag:value
+func (s *StatsD) format(name string, value float64, kind string, tags []Tag) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString(name)
+	buf.WriteByte(':')
+	buf.WriteString(formatValue(value))
+	buf.WriteByte('|')
+	buf.WriteString(kind)
+
+	if s.DogStatsD && len(tags) > 0 {
+		// Commas and pipes separate tags and fields, so can't be in them
+		escaper := strings.NewReplacer(",", "_", "|", "_", "\n", "_")
+
+		buf.WriteString("|#")
+		for i, tag := range tags {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(escaper.Replace(tag.Name))
+			buf.WriteByte(':')
+			buf.WriteString(escaper.Replace(tag.Value))
+		}
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendingMetricsToDogStatsD(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	statsd, err := NewStatsD(conn.LocalAddr().String(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer statsd.Close()
+
+	AddSink(statsd)
+	assert.True(t, IsCollecting())
+
+	counter := NewCounter("test_statsd_jobs_total", "Jobs", "pipeline", "exit_status")
+	gauge := NewGauge("test_statsd_jobs_running", "Running jobs")
+	histogram := NewHistogram("test_statsd_duration_seconds", "Durations", nil, "phase")
+
+	counter.Add(2, "llamas,alpacas", "0")
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+	histogram.Observe(1.5, "checkout")
+
+	var received []string
+	buf := make([]byte, 1024)
+	for len(received) < 5 {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Expected 5 metrics, got %v (%v)", received, err)
+		}
+		received = append(received, string(buf[:n]))
+	}
+
+	assert.Equal(t, []string{
+		"test_statsd_jobs_total:2|c|#pipeline:llamas_alpacas,exit_status:0",
+		"test_statsd_jobs_running:1|g",
+		"test_statsd_jobs_running:2|g",
+		"test_statsd_jobs_running:1|g",
+		"test_statsd_duration_seconds:1.5|h|#phase:checkout",
+	}, received)
+}
+
+func TestFormattingPlainStatsDMetrics(t *testing.T) {
+	s := &StatsD{}
+	tags := []Tag{{Name: "phase", Value: "checkout"}}
+
+	// There's nowhere for tags in plain StatsD
+	assert.Equal(t, "test_duration_seconds:0.25|h", string(s.format("test_duration_seconds", 0.25, "h", tags)))
+	assert.Equal(t, "test_jobs_total:1|c", string(s.format("test_jobs_total", 1, "c", nil)))
+}
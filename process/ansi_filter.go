@@ -0,0 +1,162 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// What's done with ANSI escape sequences in the output
+const (
+	// Output is left as it is
+	ANSIOutputKeep = "keep"
+
+	// Colors are kept, along with the sequences Buildkite uses for links
+	// and images, and everything else, like cursor movement, is dropped
+	ANSIOutputColors = "colors"
+
+	// Every escape sequence is dropped, leaving plain text
+	ANSIOutputStrip = "strip"
+)
+
+// ValidateANSIOutput returns an error if the output can't be filtered that way
+func ValidateANSIOutput(mode string) error {
+	switch mode {
+	case "", ANSIOutputKeep, ANSIOutputColors, ANSIOutputStrip:
+		return nil
+	default:
+		return fmt.Errorf("Unknown ANSI output %q, it can be %q, %q or %q", mode, ANSIOutputKeep, ANSIOutputColors, ANSIOutputStrip)
+	}
+}
+
+// The operating system commands Buildkite renders, for inline images and
+// links, which are kept along with colors
+var buildkiteOSCPrefixes = [][]byte{
+	[]byte("1337;"),
+	[]byte("1338;"),
+	[]byte("1339;"),
+}
+
+const (
+	ansiText = iota
+	ansiEscape
+	ansiCSI
+	ansiOSC
+	ansiOSCEscape
+)
+
+// The longest escape sequence that's held onto, so something that never
+// finishes one can't use up memory. Longer ones are dropped.
+const maxANSISequenceLength = 64 * 1024
+
+// Filters escape sequences out of output as it's written. Sequences can be
+// split across writes, so the start of one is held back until it's finished.
+type ansiFilter struct {
+	w    io.Writer
+	mode string
+
+	mu    sync.Mutex
+	state int
+	seq   []byte
+}
+
+func newANSIFilter(w io.Writer, mode string) *ansiFilter {
+	return &ansiFilter{w: w, mode: mode}
+}
+
+func (f *ansiFilter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var out bytes.Buffer
+	out.Grow(len(p))
+
+	for _, b := range p {
+		switch f.state {
+		case ansiText:
+			if b == 0x1b {
+				f.state = ansiEscape
+				f.seq = append(f.seq[:0], b)
+			} else {
+				out.WriteByte(b)
+			}
+
+		case ansiEscape:
+			f.seq = append(f.seq, b)
+			switch b {
+			case '[':
+				f.state = ansiCSI
+			case ']':
+				f.state = ansiOSC
+			default:
+				// A two byte sequence, like saving the cursor
+				f.finish(&out)
+			}
+
+		case ansiCSI:
+			f.seq = append(f.seq, b)
+			if b >= 0x40 && b <= 0x7e {
+				f.finish(&out)
+			}
+
+		case ansiOSC:
+			f.seq = append(f.seq, b)
+			if b == 0x07 {
+				f.finish(&out)
+			} else if b == 0x1b {
+				f.state = ansiOSCEscape
+			}
+
+		case ansiOSCEscape:
+			// Ended with ESC \
+			f.seq = append(f.seq, b)
+			f.finish(&out)
+		}
+
+		if f.state != ansiText && len(f.seq) > maxANSISequenceLength {
+			f.state = ansiText
+			f.seq = f.seq[:0]
+		}
+	}
+
+	if _, err := f.w.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Writes the finished sequence if it's being kept
+func (f *ansiFilter) finish(out *bytes.Buffer) {
+	if f.keep(f.seq) {
+		out.Write(f.seq)
+	}
+
+	f.state = ansiText
+	f.seq = f.seq[:0]
+}
+
+func (f *ansiFilter) keep(seq []byte) bool {
+	switch f.mode {
+	case ANSIOutputStrip:
+		return false
+	case ANSIOutputColors:
+		// Select Graphic Rendition, which is how colors are set
+		if seq[1] == '[' && seq[len(seq)-1] == 'm' {
+			return true
+		}
+
+		if seq[1] == ']' {
+			for _, prefix := range buildkiteOSCPrefixes {
+				if bytes.HasPrefix(seq[2:], prefix) {
+					return true
+				}
+			}
+		}
+
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,45 @@
+package process
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const ansiTestOutput = "\x1b[31mred\x1b[0m\x1b[2K\x1b[1Aup\x1b7\x1b]0;title\x07\x1b]1339;url=https://buildkite.com\x07\x1b]2;title\x1b\\done\n"
+
+func filterANSI(mode string, output string) string {
+	var buf bytes.Buffer
+	f := newANSIFilter(&buf, mode)
+
+	// Sequences are split across writes
+	for i := 0; i < len(output); i++ {
+		f.Write([]byte{output[i]})
+	}
+
+	return buf.String()
+}
+
+func TestANSIFilterKeepsColors(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "\x1b[31mred\x1b[0mup\x1b]1339;url=https://buildkite.com\x07done\n", filterANSI(ANSIOutputColors, ansiTestOutput))
+}
+
+func TestANSIFilterStripsEverything(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "redupdone\n", filterANSI(ANSIOutputStrip, ansiTestOutput))
+}
+
+func TestANSIFilterWithTextOnly(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	n, err := newANSIFilter(&buf, ANSIOutputStrip).Write([]byte("llamas\r\nalpacas"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 15, n)
+	assert.Equal(t, "llamas\r\nalpacas", buf.String())
+}
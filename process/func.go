@@ -0,0 +1,108 @@
+package process
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+)
+
+// Runs the process's Func within this process, with it's output going through
+// the same buffer and line callbacks as a script's would
+func (p *Process) startFunc() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p.cancel = cancel
+	p.signals = make(chan os.Signal, 1)
+	p.done = make(chan struct{})
+	p.buffer.limit = p.MaxOutputBytes
+
+	output, lineReaderPipe, lineWriterPipe, timestamps := p.newOutput()
+
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(1)
+
+	go func() {
+		p.scanLines(lineReaderPipe)
+		waitGroup.Done()
+	}()
+
+	p.setRunning(true)
+	logger.Info("[Process] Process is running within the agent")
+
+	go p.StartCallback()
+
+	// The process gets the agent's environment with it's own merged in
+	// over the top, just as a script would
+	exitStatus := p.runFunc(ctx, append(os.Environ(), p.Env...), output)
+
+	lineWriterPipe.Close()
+
+	p.setRunning(false)
+	close(p.done)
+
+	p.ExitStatus = strconv.Itoa(exitStatus)
+
+	logger.Info("Process within the agent finished with Exit Status: %s", p.ExitStatus)
+
+	if err := timeoutWait(&waitGroup); err != nil {
+		logger.Debug("[Process] Timed out waiting for wait group: (%T: %v)", err, err)
+	}
+
+	if timestamps != nil {
+		timestamps.Flush()
+	}
+
+	return nil
+}
+
+// Runs the Func, turning a panic into a failure of the job rather than one
+// that takes down the agent and every other job it's running
+func (p *Process) runFunc(ctx context.Context, env []string, output io.Writer) (exitStatus int) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("[Process] Process within the agent panicked: %v\n%s", r, debug.Stack())
+			fmt.Fprintf(output, "The process within the agent panicked: %v\n", r)
+			exitStatus = 1
+		}
+	}()
+
+	return p.Func(ctx, env, output, p.signals)
+}
+
+// Sends the Func SIGTERM, giving it the grace period to finish before it's
+// context is done, which kills whatever it's running
+func (p *Process) killFunc() error {
+	// The process hasn't been started, so there's nothing to wait for
+	if p.done == nil {
+		return nil
+	}
+
+	select {
+	case p.signals <- syscall.SIGTERM:
+	default:
+	}
+
+	gracePeriod := p.GracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = DefaultGracePeriod
+	}
+
+	select {
+	case <-p.done:
+		logger.Debug("[Process] Process within the agent has exited.")
+	case <-time.After(gracePeriod):
+		logger.Debug("[Process] Process within the agent didn't exit within %v, cancelling it", gracePeriod)
+		p.cancel()
+	}
+
+	return nil
+}
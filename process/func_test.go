@@ -0,0 +1,87 @@
+package process
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFuncProcess(f func(ctx context.Context, env []string, output io.Writer, signals <-chan os.Signal) int) (*Process, *[]string) {
+	var lines []string
+	var mu sync.Mutex
+
+	return &Process{
+		Env:                []string{"LLAMAS=rock"},
+		Func:               f,
+		GracePeriod:        50 * time.Millisecond,
+		StartCallback:      func() {},
+		LinePreProcessor:   func(line string) string { return line },
+		LineCallbackFilter: func(line string) bool { return strings.HasPrefix(line, "~~~") },
+		LineCallback: func(line string) {
+			mu.Lock()
+			defer mu.Unlock()
+			lines = append(lines, line)
+		},
+	}, &lines
+}
+
+func TestFuncsRunWithTheProcessesEnvironmentAndOutput(t *testing.T) {
+	t.Parallel()
+
+	p, lines := newFuncProcess(func(ctx context.Context, env []string, output io.Writer, signals <-chan os.Signal) int {
+		fmt.Fprintf(output, "~~~ Running\n%s\n", env[len(env)-1])
+		return 3
+	})
+
+	assert.NoError(t, p.Start())
+	assert.Equal(t, "3", p.ExitStatus)
+	assert.False(t, p.IsRunning())
+	assert.Equal(t, "~~~ Running\nLLAMAS=rock\n", p.Output())
+	assert.Equal(t, []string{"~~~ Running"}, *lines)
+}
+
+func TestKillingAFuncSignalsThenCancelsIt(t *testing.T) {
+	t.Parallel()
+
+	signalled := make(chan os.Signal, 1)
+
+	p, _ := newFuncProcess(func(ctx context.Context, env []string, output io.Writer, signals <-chan os.Signal) int {
+		signalled <- <-signals
+		<-ctx.Done()
+		return 1
+	})
+
+	started := make(chan struct{})
+	p.StartCallback = func() { close(started) }
+
+	finished := make(chan error)
+	go func() { finished <- p.Start() }()
+
+	<-started
+	assert.NoError(t, p.Kill())
+
+	assert.Equal(t, syscall.SIGTERM, <-signalled)
+	assert.NoError(t, <-finished)
+	assert.Equal(t, "1", p.ExitStatus)
+}
+
+func TestFuncsThatPanicFail(t *testing.T) {
+	t.Parallel()
+
+	p, _ := newFuncProcess(func(ctx context.Context, env []string, output io.Writer, signals <-chan os.Signal) int {
+		panic("llamas")
+	})
+
+	assert.NoError(t, p.Start())
+	assert.Equal(t, "1", p.ExitStatus)
+	assert.False(t, p.IsRunning())
+	assert.Contains(t, p.Output(), "panicked: llamas")
+}
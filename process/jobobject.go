@@ -0,0 +1,32 @@
+// +build !windows
+
+package process
+
+import (
+	"errors"
+	"os"
+)
+
+// JobObject is a Windows Job Object. Everywhere else processes are killed
+// along with everything they start through their process group instead.
+type JobObject struct{}
+
+// NewJobObject returns an error, as job objects are only supported on Windows
+func NewJobObject() (*JobObject, error) {
+	return nil, errors.New("Job objects are only supported on Windows")
+}
+
+// Assign does nothing outside of Windows
+func (j *JobObject) Assign(p *os.Process) error {
+	return nil
+}
+
+// Terminate does nothing outside of Windows
+func (j *JobObject) Terminate() error {
+	return nil
+}
+
+// Close does nothing outside of Windows
+func (j *JobObject) Close() error {
+	return nil
+}
@@ -0,0 +1,97 @@
+package process
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+var (
+	modkernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+	procCreateJobObjectW         = modkernel32.NewProc("CreateJobObjectW")
+	procAssignProcessToJobObject = modkernel32.NewProc("AssignProcessToJobObject")
+	procTerminateJobObject       = modkernel32.NewProc("TerminateJobObject")
+)
+
+// The access a process handle needs to be assigned to a job object
+const (
+	processTerminate = 0x0001
+	processSetQuota  = 0x0100
+)
+
+// JobObject is a Windows Job Object. Windows doesn't have process groups like
+// unix, and TASKKILL /T can't find the children of processes that have
+// already exited, but everything a process in a job starts is in the job
+// too, so terminating the job kills the whole tree.
+//
+// Processes aren't killed when the job is closed, so anything left running
+// in the background carries on the same as it does on unix.
+type JobObject struct {
+	mu     sync.Mutex
+	handle syscall.Handle
+}
+
+// NewJobObject creates an unnamed job object
+func NewJobObject() (*JobObject, error) {
+	handle, _, err := procCreateJobObjectW.Call(0, 0)
+	if handle == 0 {
+		return nil, os.NewSyscallError("CreateJobObject", err)
+	}
+
+	return &JobObject{handle: syscall.Handle(handle)}, nil
+}
+
+// Assign adds a process to the job. Anything it has already started isn't
+// added, so it needs to be assigned as soon as it's started.
+func (j *JobObject) Assign(p *os.Process) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	process, err := syscall.OpenProcess(processTerminate|processSetQuota, false, uint32(p.Pid))
+	if err != nil {
+		return os.NewSyscallError("OpenProcess", err)
+	}
+	defer syscall.CloseHandle(process)
+
+	if ok, _, err := procAssignProcessToJobObject.Call(uintptr(j.handle), uintptr(process)); ok == 0 {
+		return os.NewSyscallError("AssignProcessToJobObject", err)
+	}
+
+	return nil
+}
+
+// Terminate kills every process in the job. It does nothing once the job has
+// been closed.
+func (j *JobObject) Terminate() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.handle == 0 {
+		return nil
+	}
+
+	if ok, _, err := procTerminateJobObject.Call(uintptr(j.handle), 1); ok == 0 {
+		return os.NewSyscallError("TerminateJobObject", err)
+	}
+
+	return nil
+}
+
+// Close closes the handle to the job, leaving any processes in it running
+func (j *JobObject) Close() error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.handle == 0 {
+		return nil
+	}
+
+	err := syscall.CloseHandle(j.handle)
+	j.handle = 0
+	return err
+}
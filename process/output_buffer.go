@@ -0,0 +1,64 @@
+package process
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// The output of a process, which stops growing once it's limit is reached so
+// a process that writes forever doesn't use all of the agent's memory.
+// Anything written after that is dropped.
+type outputBuffer struct {
+	bytes.Buffer
+
+	// 0 means there's no limit
+	limit int
+
+	truncated int32
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.room(n); room < n {
+		p = p[:room]
+	}
+
+	if _, err := b.Buffer.Write(p); err != nil {
+		return 0, err
+	}
+
+	// The whole of it is written as far as the writer knows, otherwise
+	// copying the output would stop
+	return n, nil
+}
+
+func (b *outputBuffer) WriteString(s string) (int, error) {
+	n := len(s)
+	if room := b.room(n); room < n {
+		s = s[:room]
+	}
+
+	if _, err := b.Buffer.WriteString(s); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Returns how many of n bytes fit in the buffer
+func (b *outputBuffer) room(n int) int {
+	if b.limit <= 0 || b.Buffer.Len()+n <= b.limit {
+		return n
+	}
+
+	atomic.StoreInt32(&b.truncated, 1)
+
+	if room := b.limit - b.Buffer.Len(); room > 0 {
+		return room
+	}
+	return 0
+}
+
+func (b *outputBuffer) Truncated() bool {
+	return atomic.LoadInt32(&b.truncated) == 1
+}
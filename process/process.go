@@ -5,13 +5,12 @@ package process
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
-	"regexp"
 	"runtime"
 	"strconv"
 	"sync"
@@ -23,6 +22,9 @@ import (
 	"github.com/mattn/go-shellwords"
 )
 
+// The default for how long a process has to exit after being terminated
+const DefaultGracePeriod = 10 * time.Second
+
 type Process struct {
 	Pid        int
 	PTY        bool
@@ -31,30 +33,73 @@ type Process struct {
 	Env        []string
 	ExitStatus string
 
-	buffer bytes.Buffer
+	// The signal that killed the process, if it didn't exit by itself
+	Signal string
+
+	// How lines are timestamped when Timestamp is set, either
+	// TimestampFormatRFC3339 (the default) or TimestampFormatRelative
+	TimestampFormat string
+
+	// What's done with ANSI escape sequences in the output, one of
+	// ANSIOutputKeep (the default), ANSIOutputColors or ANSIOutputStrip
+	ANSIOutput string
+
+	// How long the process has to exit after Kill terminates it, before
+	// it's process group is killed
+	GracePeriod time.Duration
+
+	// The most bytes of output kept, after which the rest of it is dropped.
+	// 0 means there's no limit.
+	MaxOutputBytes int
+
+	// The user the process is run as, if it isn't run as the agent's
+	Credential *Credential
+
+	// Closed once the process has exited
+	done chan struct{}
+
+	buffer outputBuffer
 
 	command *exec.Cmd
 
+	// On Windows, the job object the process is in, which is how it's
+	// killed along with everything it starts
+	jobObject *JobObject
+
 	// This callback is called when the process offically starts
 	StartCallback func()
 
+	// Called with the pid as soon as the process has started, before any
+	// of it's output is read. If it returns an error the process is killed.
+	RunningCallback func(pid int) error
+
 	// For every line in the process output, this callback will be called
 	// with the contents of the line if its filter returns true.
 	LineCallback       func(string)
 	LinePreProcessor   func(string) string
 	LineCallbackFilter func(string) bool
 
+	// Runs within this process instead of the script when it's set, with
+	// the process's environment and output, and the signals it's sent. It
+	// returns the exit status, and the context is done if it's still
+	// running at the end of the grace period. There's no PID, so the
+	// running callback isn't called and there's no credential to run as.
+	Func func(ctx context.Context, env []string, output io.Writer, signals <-chan os.Signal) int
+
+	// What the Func is signalled and cancelled with
+	signals chan os.Signal
+	cancel  context.CancelFunc
+
 	// Running is stored as an int32 so we can use atomic operations to
 	// set/get it (it's accessed by multiple goroutines)
 	running int32
 }
 
-// If you change header parsing here make sure to change it in the
-// buildkite.com frontend logic, too
-
-var headerExpansionRegex = regexp.MustCompile("^(?:\\^\\^\\^\\s+\\+\\+\\+)$")
-
 func (p *Process) Start() error {
+	if p.Func != nil {
+		return p.startFunc()
+	}
+
 	args, err := shellwords.Parse(p.Script)
 	if err != nil {
 		return err
@@ -69,16 +114,19 @@ func (p *Process) Start() error {
 	currentEnv := os.Environ()
 	p.command.Env = append(currentEnv, p.Env...)
 
-	var waitGroup sync.WaitGroup
+	if p.Credential != nil {
+		if err := SetCredential(p.command, p.Credential); err != nil {
+			return err
+		}
+		p.command.Env = append(p.command.Env, p.Credential.Env()...)
+	}
 
-	lineReaderPipe, lineWriterPipe := io.Pipe()
+	p.done = make(chan struct{})
+	p.buffer.limit = p.MaxOutputBytes
 
-	var multiWriter io.Writer
-	if p.Timestamp {
-		multiWriter = io.MultiWriter(lineWriterPipe)
-	} else {
-		multiWriter = io.MultiWriter(&p.buffer, lineWriterPipe)
-	}
+	var waitGroup sync.WaitGroup
+
+	multiWriter, lineReaderPipe, lineWriterPipe, timestamps := p.newOutput()
 
 	// Toggle between running in a pty
 	if p.PTY {
@@ -120,6 +168,10 @@ func (p *Process) Start() error {
 		p.command.Stderr = multiWriter
 		p.command.Stdin = nil
 
+		// Run in it's own process group, so everything it starts can be
+		// killed along with it
+		setProcessGroup(p.command)
+
 		err := p.command.Start()
 		if err != nil {
 			p.ExitStatus = "1"
@@ -130,101 +182,32 @@ func (p *Process) Start() error {
 		p.setRunning(true)
 	}
 
+	if runtime.GOOS == "windows" {
+		p.assignJobObject()
+	}
+
+	if p.RunningCallback != nil {
+		if err := p.RunningCallback(p.Pid); err != nil {
+			// Nothing is reading the output yet, so it's discarded
+			lineWriterPipe.Close()
+			p.killProcessTree()
+			p.command.Wait()
+			timeoutWait(&waitGroup)
+
+			p.setRunning(false)
+			close(p.done)
+			p.ExitStatus = "1"
+			return err
+		}
+	}
+
 	logger.Info("[Process] Process is running with PID: %d", p.Pid)
 
 	// Add the line callback routine to the waitGroup
 	waitGroup.Add(1)
 
 	go func() {
-		logger.Debug("[LineScanner] Starting to read lines")
-
-		reader := bufio.NewReader(lineReaderPipe)
-
-		var appending []byte
-		var lineCallbackWaitGroup sync.WaitGroup
-
-		for {
-			line, isPrefix, err := reader.ReadLine()
-			if err != nil {
-				if err == io.EOF {
-					logger.Debug("[LineScanner] Encountered EOF")
-					break
-				}
-
-				logger.Error("[LineScanner] Failed to read: (%T: %v)", err, err)
-			}
-
-			// If isPrefix is true, that means we've got a really
-			// long line incoming, and we'll keep appending to it
-			// until isPrefix is false (which means the long line
-			// has ended.
-			if isPrefix && appending == nil {
-				logger.Debug("[LineScanner] Line is too long to read, going to buffer it until it finishes")
-				// bufio.ReadLine returns a slice which is only valid until the next invocation
-				// since it points to its own internal buffer array. To accumulate the entire
-				// result we make a copy of the first prefix, and insure there is spare capacity
-				// for future appends to minimize the need for resizing on append.
-				appending = make([]byte, len(line), (cap(line))*2)
-				copy(appending, line)
-
-				continue
-			}
-
-			// Should we be appending?
-			if appending != nil {
-				appending = append(appending, line...)
-
-				// No more isPrefix! Line is finished!
-				if !isPrefix {
-					logger.Debug("[LineScanner] Finished buffering long line")
-					line = appending
-
-					// Reset appending back to nil
-					appending = nil
-				} else {
-					continue
-				}
-			}
-
-			// If we're timestamping this main thread will take
-			// the hit of running the regex so we can build up
-			// the timestamped buffer without breaking headers,
-			// otherwise we let the goroutines take the perf hit.
-
-			checkedForCallback := false
-			lineHasCallback := false
-			lineString := p.LinePreProcessor(string(line))
-
-			// Create the prefixed buffer
-			if p.Timestamp {
-				lineHasCallback = p.LineCallbackFilter(lineString)
-				checkedForCallback = true
-				if lineHasCallback || headerExpansionRegex.MatchString(lineString) {
-					// Don't timestamp special lines (e.g. header)
-					p.buffer.WriteString(fmt.Sprintf("%s\n", line))
-				} else {
-					currentTime := time.Now().UTC().Format(time.RFC3339)
-					p.buffer.WriteString(fmt.Sprintf("[%s] %s\n", currentTime, line))
-				}
-			}
-
-			if lineHasCallback || !checkedForCallback {
-				lineCallbackWaitGroup.Add(1)
-				go func(line string) {
-					defer lineCallbackWaitGroup.Done()
-					if (checkedForCallback && lineHasCallback) || p.LineCallbackFilter(lineString) {
-						p.LineCallback(line)
-					}
-				}(lineString)
-			}
-		}
-
-		// We need to make sure all the line callbacks have finish before
-		// finish up the process
-		logger.Debug("[LineScanner] Waiting for callbacks to finish")
-		lineCallbackWaitGroup.Wait()
-
-		logger.Debug("[LineScanner] Finished")
+		p.scanLines(lineReaderPipe)
 		waitGroup.Done()
 	}()
 
@@ -240,9 +223,12 @@ func (p *Process) Start() error {
 
 	// The process is no longer running at this point
 	p.setRunning(false)
+	close(p.done)
+	p.jobObject.Close()
 
 	// Find the exit status of the script
 	p.ExitStatus = getExitStatus(waitResult)
+	p.Signal = getExitSignal(waitResult)
 
 	logger.Info("Process with PID: %d finished with Exit Status: %s", p.Pid, p.ExitStatus)
 
@@ -254,78 +240,164 @@ func (p *Process) Start() error {
 		logger.Debug("[Process] Timed out waiting for wait group: (%T: %v)", err, err)
 	}
 
+	// The start of the last line may still be held back by the
+	// timestamps
+	if timestamps != nil {
+		timestamps.Flush()
+	}
+
 	// No error occurred so we can return nil
 	return nil
 }
 
-func (p *Process) Output() string {
-	return p.buffer.String()
-}
+// Returns where the process's output is written, and the pipe the line
+// scanner reads it from
+func (p *Process) newOutput() (io.Writer, *io.PipeReader, *io.PipeWriter, *timestampWriter) {
+	lineReaderPipe, lineWriterPipe := io.Pipe()
 
-func (p *Process) Kill() error {
-	var err error
-	if runtime.GOOS == "windows" {
-		// Sending Interrupt on Windows is not implemented.
-		// https://golang.org/src/os/exec.go?s=3842:3884#L110
-		err = exec.Command("CMD", "/C", "TASKKILL", "/F", "/PID", strconv.Itoa(p.Pid)).Run()
-	} else {
-		// Send a sigterm
-		err = p.signal(syscall.SIGTERM)
+	// Lines are timestamped as they're written to the buffer, so the
+	// line scanner still sees them as they are
+	var output io.Writer = &p.buffer
+	var timestamps *timestampWriter
+	if p.Timestamp {
+		timestamps = newTimestampWriter(&p.buffer, p.TimestampFormat)
+		output = timestamps
 	}
-	if err != nil {
-		return err
+	multiWriter := io.MultiWriter(output, lineWriterPipe)
+
+	// Escape sequences are filtered out before anything else sees the
+	// output, so the timestamps and line scanner get what's kept
+	if p.ANSIOutput == ANSIOutputColors || p.ANSIOutput == ANSIOutputStrip {
+		multiWriter = newANSIFilter(multiWriter, p.ANSIOutput)
 	}
 
-	// Make a channel that we'll use as a timeout
-	c := make(chan int, 1)
-	checking := true
+	return multiWriter, lineReaderPipe, lineWriterPipe, timestamps
+}
 
-	// Start a routine that checks to see if the process
-	// is still alive.
-	go func() {
-		for checking {
-			logger.Debug("[Process] Checking to see if PID: %d is still alive", p.Pid)
+// Reads the output a line at a time, calling the line callback for the lines
+// that pass the filter, until the output is closed
+func (p *Process) scanLines(r io.Reader) {
+	logger.Debug("[LineScanner] Starting to read lines")
 
-			foundProcess, err := os.FindProcess(p.Pid)
+	reader := bufio.NewReader(r)
 
-			// Can't find the process at all
-			if err != nil {
-				logger.Debug("[Process] Could not find process with PID: %d", p.Pid)
+	var appending []byte
+	var lineCallbackWaitGroup sync.WaitGroup
 
+	for {
+		line, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			if err == io.EOF {
+				logger.Debug("[LineScanner] Encountered EOF")
 				break
 			}
 
-			// We have some information about the process
-			if foundProcess != nil {
-				processState, err := foundProcess.Wait()
+			logger.Error("[LineScanner] Failed to read: (%T: %v)", err, err)
+		}
+
+		// If isPrefix is true, that means we've got a really
+		// long line incoming, and we'll keep appending to it
+		// until isPrefix is false (which means the long line
+		// has ended.
+		if isPrefix && appending == nil {
+			logger.Debug("[LineScanner] Line is too long to read, going to buffer it until it finishes")
+			// bufio.ReadLine returns a slice which is only valid until the next invocation
+			// since it points to its own internal buffer array. To accumulate the entire
+			// result we make a copy of the first prefix, and insure there is spare capacity
+			// for future appends to minimize the need for resizing on append.
+			appending = make([]byte, len(line), (cap(line))*2)
+			copy(appending, line)
+
+			continue
+		}
+
+		// Should we be appending?
+		if appending != nil {
+			appending = append(appending, line...)
+
+			// No more isPrefix! Line is finished!
+			if !isPrefix {
+				logger.Debug("[LineScanner] Finished buffering long line")
+				line = appending
+
+				// Reset appending back to nil
+				appending = nil
+			} else {
+				continue
+			}
+		}
 
-				if err != nil || processState.Exited() {
-					logger.Debug("[Process] Process with PID: %d has exited.", p.Pid)
+		lineString := p.LinePreProcessor(string(line))
 
-					break
-				}
+		lineCallbackWaitGroup.Add(1)
+		go func(line string) {
+			defer lineCallbackWaitGroup.Done()
+			if p.LineCallbackFilter(line) {
+				p.LineCallback(line)
 			}
+		}(lineString)
+	}
+
+	// We need to make sure all the line callbacks have finish before
+	// finish up the process
+	logger.Debug("[LineScanner] Waiting for callbacks to finish")
+	lineCallbackWaitGroup.Wait()
+
+	logger.Debug("[LineScanner] Finished")
+}
+
+func (p *Process) Output() string {
+	return p.buffer.String()
+}
 
-			// Retry in a moment
-			sleepTime := time.Duration(1 * time.Second)
-			time.Sleep(sleepTime)
+// OutputTruncated returns whether there was more output than MaxOutputBytes,
+// so some of it was dropped
+func (p *Process) OutputTruncated() bool {
+	return p.buffer.Truncated()
+}
+
+// Kill terminates the process, giving it the grace period to exit before
+// killing it's whole process group
+func (p *Process) Kill() error {
+	if p.Func != nil {
+		return p.killFunc()
+	}
+
+	if runtime.GOOS == "windows" {
+		// Sending Interrupt on Windows is not implemented, so the process
+		// and it's children are killed straight away.
+		// https://golang.org/src/os/exec.go?s=3842:3884#L110
+		if p.jobObject != nil {
+			return p.jobObject.Terminate()
 		}
+		return exec.Command("CMD", "/C", "TASKKILL", "/F", "/T", "/PID", strconv.Itoa(p.Pid)).Run()
+	}
 
-		c <- 1
-	}()
+	// Send a sigterm, so the process can clean up
+	if err := p.signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	// The process hasn't been started, so there's nothing to wait for
+	if p.done == nil {
+		return nil
+	}
+
+	gracePeriod := p.GracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = DefaultGracePeriod
+	}
 
-	// Timeout this process after 3 seconds
 	select {
-	case _ = <-c:
+	case <-p.done:
 		// Was successfully terminated
-	case <-time.After(10 * time.Second):
-		// Stop checking in the routine above
-		checking = false
+		logger.Debug("[Process] Process with PID: %d has exited.", p.Pid)
+	case <-time.After(gracePeriod):
+		// Forcefully kill the process and anything it started
+		logger.Debug("[Process] Process with PID: %d didn't exit within %v, killing it's process group", p.Pid, gracePeriod)
 
-		// Forcefully kill the thing
-		err = p.signal(syscall.SIGKILL)
-
-		if err != nil {
+		if err := p.killProcessTree(); err != nil {
+			logger.Error("[Process] Failed to kill the process group of PID: %d (%T: %v)", p.Pid, err, err)
 			return err
 		}
 	}
@@ -333,6 +405,32 @@ func (p *Process) Kill() error {
 	return nil
 }
 
+// Adds the process to a job object on Windows, so it can be killed along with
+// everything it starts. If that fails it's killed with TASKKILL instead.
+func (p *Process) assignJobObject() {
+	job, err := NewJobObject()
+	if err == nil {
+		if err = job.Assign(p.command.Process); err != nil {
+			job.Close()
+		}
+	}
+	if err != nil {
+		logger.Warn("[Process] Failed to add PID: %d to a job object, processes it starts may not be killed with it (%v)", p.Pid, err)
+		return
+	}
+
+	p.jobObject = job
+}
+
+// Kills the process and everything it started, either through it's job
+// object or it's process group
+func (p *Process) killProcessTree() error {
+	if p.jobObject != nil {
+		return p.jobObject.Terminate()
+	}
+	return killProcessGroup(p.command)
+}
+
 func (p *Process) signal(sig os.Signal) error {
 	if p.command != nil && p.command.Process != nil {
 		logger.Debug("[Process] Sending signal: %s to PID: %d", sig.String(), p.Pid)
@@ -387,6 +485,35 @@ func getExitStatus(waitResult error) string {
 	return fmt.Sprintf("%d", exitStatus)
 }
 
+// The names Buildkite uses for the signals that usually kill jobs
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGTERM: "SIGTERM",
+}
+
+func signalName(sig syscall.Signal) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
+	}
+	return fmt.Sprintf("SIG%d", int(sig))
+}
+
+// Returns the name of the signal that killed the process, if it was killed
+func getExitSignal(waitResult error) string {
+	if err, ok := waitResult.(*exec.ExitError); ok {
+		if s, ok := err.Sys().(syscall.WaitStatus); ok && s.Signaled() {
+			return signalName(s.Signal())
+		}
+	}
+
+	return ""
+}
+
 func timeoutWait(waitGroup *sync.WaitGroup) error {
 	// Make a chanel that we'll use as a timeout
 	c := make(chan int, 1)
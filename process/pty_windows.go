@@ -0,0 +1,215 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+)
+
+var (
+	procCreatePseudoConsole               = modkernel32.NewProc("CreatePseudoConsole")
+	procClosePseudoConsole                = modkernel32.NewProc("ClosePseudoConsole")
+	procInitializeProcThreadAttributeList = modkernel32.NewProc("InitializeProcThreadAttributeList")
+	procUpdateProcThreadAttribute         = modkernel32.NewProc("UpdateProcThreadAttribute")
+	procDeleteProcThreadAttributeList     = modkernel32.NewProc("DeleteProcThreadAttributeList")
+)
+
+const (
+	extendedStartupInfoPresent       = 0x00080000
+	createUnicodeEnvironment         = 0x00000400
+	procThreadAttributePseudoConsole = 0x00020016
+)
+
+// The size of the pseudo console. ConPTY wraps lines at the width of the
+// console, so it's wide enough that build output isn't wrapped.
+const (
+	ptyColumns = 1000
+	ptyRows    = 50
+)
+
+// STARTUPINFOEX, which the pseudo console is passed to the process in
+type startupInfoEx struct {
+	syscall.StartupInfo
+	ProcThreadAttributeList *byte
+}
+
+// PTYSupported returns whether commands can be run in a PTY. On Windows that
+// needs ConPTY, which was added in Windows 10 1809.
+func PTYSupported() bool {
+	return procCreatePseudoConsole.Find() == nil
+}
+
+// StartPTY starts the command in a ConPTY pseudo console, returning the file
+// its output is read from. exec.Cmd can't pass a pseudo console to the
+// process, so it's created directly, and the returned file is closed once
+// the process exits, the same as a unix PTY.
+func StartPTY(c *exec.Cmd) (*os.File, error) {
+	if !PTYSupported() {
+		return nil, errors.New("PTY is only supported on Windows 10 1809 and later")
+	}
+
+	// The pseudo console reads input from one pipe and writes output to the
+	// other, which we keep the other ends of
+	var inputRead, inputWrite, outputRead, outputWrite syscall.Handle
+	if err := syscall.CreatePipe(&inputRead, &inputWrite, nil, 0); err != nil {
+		return nil, os.NewSyscallError("CreatePipe", err)
+	}
+	if err := syscall.CreatePipe(&outputRead, &outputWrite, nil, 0); err != nil {
+		syscall.CloseHandle(inputRead)
+		syscall.CloseHandle(inputWrite)
+		return nil, os.NewSyscallError("CreatePipe", err)
+	}
+
+	var console syscall.Handle
+	size := uintptr(ptyColumns) | uintptr(ptyRows)<<16
+	r, _, _ := procCreatePseudoConsole.Call(size, uintptr(inputRead), uintptr(outputWrite), 0, uintptr(unsafe.Pointer(&console)))
+
+	// The pseudo console has its own copies of these now
+	syscall.CloseHandle(inputRead)
+	syscall.CloseHandle(outputWrite)
+
+	if r != 0 {
+		syscall.CloseHandle(inputWrite)
+		syscall.CloseHandle(outputRead)
+		return nil, fmt.Errorf("CreatePseudoConsole: HRESULT 0x%x", r)
+	}
+
+	process, err := startPseudoConsoleProcess(c, console)
+	if err != nil {
+		procClosePseudoConsole.Call(uintptr(console))
+		syscall.CloseHandle(inputWrite)
+		syscall.CloseHandle(outputRead)
+		return nil, err
+	}
+
+	// Closing the pseudo console once the process has exited is what ends
+	// its output, so reading from it stops
+	go func() {
+		syscall.WaitForSingleObject(process, syscall.INFINITE)
+		procClosePseudoConsole.Call(uintptr(console))
+		syscall.CloseHandle(inputWrite)
+		syscall.CloseHandle(process)
+	}()
+
+	return os.NewFile(uintptr(outputRead), "conpty"), nil
+}
+
+// Creates the command's process attached to the pseudo console, and sets the
+// command's Process so it can be waited on and killed as usual
+func startPseudoConsoleProcess(c *exec.Cmd, console syscall.Handle) (syscall.Handle, error) {
+	// Find how big the attribute list needs to be, then create it
+	var listSize uintptr
+	procInitializeProcThreadAttributeList.Call(0, 1, 0, uintptr(unsafe.Pointer(&listSize)))
+	if listSize == 0 {
+		return 0, errors.New("InitializeProcThreadAttributeList: couldn't find the size of the attribute list")
+	}
+
+	list := make([]byte, listSize)
+	if ok, _, err := procInitializeProcThreadAttributeList.Call(uintptr(unsafe.Pointer(&list[0])), 1, 0, uintptr(unsafe.Pointer(&listSize))); ok == 0 {
+		return 0, os.NewSyscallError("InitializeProcThreadAttributeList", err)
+	}
+	defer procDeleteProcThreadAttributeList.Call(uintptr(unsafe.Pointer(&list[0])))
+
+	// The value of the attribute is the pseudo console handle itself
+	if ok, _, err := procUpdateProcThreadAttribute.Call(
+		uintptr(unsafe.Pointer(&list[0])),
+		0,
+		procThreadAttributePseudoConsole,
+		uintptr(console),
+		unsafe.Sizeof(console),
+		0,
+		0,
+	); ok == 0 {
+		return 0, os.NewSyscallError("UpdateProcThreadAttribute", err)
+	}
+
+	si := &startupInfoEx{ProcThreadAttributeList: &list[0]}
+	si.Cb = uint32(unsafe.Sizeof(*si))
+
+	commandLine, err := syscall.UTF16PtrFromString(makeCommandLine(c))
+	if err != nil {
+		return 0, err
+	}
+
+	var dir *uint16
+	if c.Dir != "" {
+		if dir, err = syscall.UTF16PtrFromString(c.Dir); err != nil {
+			return 0, err
+		}
+	}
+
+	environ := c.Env
+	if environ == nil {
+		environ = os.Environ()
+	}
+	envBlock := createEnvBlock(environ)
+
+	pi := &syscall.ProcessInformation{}
+	err = syscall.CreateProcess(
+		nil,
+		commandLine,
+		nil,
+		nil,
+		false,
+		extendedStartupInfoPresent|createUnicodeEnvironment,
+		&envBlock[0],
+		dir,
+		&si.StartupInfo,
+		pi,
+	)
+	runtime.KeepAlive(list)
+	if err != nil {
+		return 0, os.NewSyscallError("CreateProcess", err)
+	}
+	syscall.CloseHandle(pi.Thread)
+
+	// There's still a handle to the process, so it can always be found
+	c.Process, err = os.FindProcess(int(pi.ProcessId))
+	if err != nil {
+		syscall.TerminateProcess(pi.Process, 1)
+		syscall.CloseHandle(pi.Process)
+		return 0, err
+	}
+
+	return pi.Process, nil
+}
+
+// Returns the command line for the command, escaped the same way exec.Cmd
+// does it
+func makeCommandLine(c *exec.Cmd) string {
+	if c.SysProcAttr != nil && c.SysProcAttr.CmdLine != "" {
+		return c.SysProcAttr.CmdLine
+	}
+
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = syscall.EscapeArg(arg)
+	}
+	if len(args) == 0 {
+		args = []string{syscall.EscapeArg(c.Path)}
+	} else {
+		args[0] = syscall.EscapeArg(c.Path)
+	}
+
+	return strings.Join(args, " ")
+}
+
+// Returns the environment as a block of NUL terminated strings, ending with
+// an extra NUL
+func createEnvBlock(environ []string) []uint16 {
+	var block []uint16
+	for _, s := range environ {
+		block = append(block, utf16.Encode([]rune(s))...)
+		block = append(block, 0)
+	}
+	if len(block) == 0 {
+		block = append(block, 0)
+	}
+	return append(block, 0)
+}
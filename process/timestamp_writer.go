@@ -0,0 +1,173 @@
+package process
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// The formats lines can be timestamped with
+const (
+	TimestampFormatRFC3339  = "rfc3339"
+	TimestampFormatRelative = "relative"
+)
+
+// ValidateTimestampFormat returns an error if lines can't be timestamped with
+// the format
+func ValidateTimestampFormat(format string) error {
+	switch format {
+	case "", TimestampFormatRFC3339, TimestampFormatRelative:
+		return nil
+	default:
+		return fmt.Errorf("Unknown timestamp format %q, lines can be timestamped with %q or %q", format, TimestampFormatRFC3339, TimestampFormatRelative)
+	}
+}
+
+// The longest a header's prefix is, e.g. "--- " or "^^^ "
+const headerPrefixLength = 4
+
+// Color escape sequences can come before a header's prefix, and one that's
+// only been partly written yet needs to be waited for.
+//
+// If you change header parsing here make sure to change it in the
+// buildkite.com frontend logic, too
+var (
+	leadingANSIRegex  = regexp.MustCompile(`^(?:\x1b\[[;\d]*[mK])+`)
+	partialANSIRegex  = regexp.MustCompile(`^\x1b(?:\[[;\d]*)?$`)
+	headerPrefixRegex = regexp.MustCompile(`^(?:---|\+\+\+|~~~|\^\^\^)[ \t]`)
+)
+
+// Writes the output with a timestamp at the start of every line, as it's
+// written, so lines that are still being written show up straight away and
+// output from a PTY is timestamped the same as any other. Headers aren't
+// timestamped so Buildkite still finds them, which means the first few
+// characters of a line are held back until it's known whether it's a header.
+type timestampWriter struct {
+	w      io.Writer
+	format string
+	start  time.Time
+	now    func() time.Time
+
+	mu sync.Mutex
+
+	// Whether the next byte starts a new line
+	lineStart bool
+
+	// The start of a line that's held back until it's known whether it's
+	// a header
+	pending []byte
+}
+
+func newTimestampWriter(w io.Writer, format string) *timestampWriter {
+	return &timestampWriter{w: w, format: format, start: time.Now(), now: time.Now, lineStart: true}
+}
+
+func (t *timestampWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := len(p)
+
+	for len(p) > 0 {
+		if t.lineStart || t.pending != nil {
+			// Hold the start of the line back until there's enough
+			// of it to tell if it's a header
+			t.lineStart = false
+			if t.pending == nil {
+				t.pending = []byte{}
+			}
+
+			end := bytes.IndexByte(p, '\n')
+			if end < 0 {
+				t.pending = append(t.pending, p...)
+				p = nil
+			} else {
+				t.pending = append(t.pending, p[:end+1]...)
+				p = p[end+1:]
+			}
+
+			if end < 0 && !t.canTellIfHeader() {
+				break
+			}
+
+			if err := t.writePending(); err != nil {
+				return 0, err
+			}
+
+			if end >= 0 {
+				t.lineStart = true
+			}
+			continue
+		}
+
+		// The middle of a line is written as it is
+		end := bytes.IndexByte(p, '\n')
+		if end < 0 {
+			if _, err := t.w.Write(p); err != nil {
+				return 0, err
+			}
+			break
+		}
+
+		if _, err := t.w.Write(p[:end+1]); err != nil {
+			return 0, err
+		}
+		p = p[end+1:]
+		t.lineStart = true
+	}
+
+	return n, nil
+}
+
+// Whether enough of the line is held back to know if it's a header
+func (t *timestampWriter) canTellIfHeader() bool {
+	visible := leadingANSIRegex.ReplaceAll(t.pending, nil)
+	if partialANSIRegex.Match(visible) {
+		return false
+	}
+	return len(visible) >= headerPrefixLength
+}
+
+// Writes the held back start of the line, with a timestamp unless it's a
+// header
+func (t *timestampWriter) writePending() error {
+	pending := t.pending
+	t.pending = nil
+
+	visible := leadingANSIRegex.ReplaceAll(pending, nil)
+	if !headerPrefixRegex.Match(visible) {
+		if _, err := io.WriteString(t.w, t.timestamp()); err != nil {
+			return err
+		}
+	}
+
+	_, err := t.w.Write(pending)
+	return err
+}
+
+// Writes anything that's held back, for when there's no more output
+func (t *timestampWriter) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pending == nil {
+		return nil
+	}
+
+	return t.writePending()
+}
+
+func (t *timestampWriter) timestamp() string {
+	now := t.now()
+
+	if t.format == TimestampFormatRelative {
+		elapsed := now.Sub(t.start)
+		return fmt.Sprintf("[%02d:%02d:%02d.%03d] ",
+			int(elapsed.Hours()), int(elapsed.Minutes())%60, int(elapsed.Seconds())%60, int(elapsed.Nanoseconds()/int64(time.Millisecond))%1000)
+	}
+
+	return fmt.Sprintf("[%s] ", now.UTC().Format(time.RFC3339))
+}
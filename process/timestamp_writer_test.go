@@ -0,0 +1,69 @@
+package process
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTimestampWriter(format string) (*timestampWriter, *bytes.Buffer) {
+	var buf bytes.Buffer
+	start := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	t := newTimestampWriter(&buf, format)
+	t.start = start
+	t.now = func() time.Time { return start.Add(61*time.Second + 250*time.Millisecond) }
+
+	return t, &buf
+}
+
+func TestTimestampWriterTimestampsEveryLine(t *testing.T) {
+	t.Parallel()
+
+	w, buf := newTestTimestampWriter(TimestampFormatRFC3339)
+
+	// Lines can be split up however the output is read
+	for _, s := range []string{"llamas\nalp", "acas\n", "\n", "vicunas"} {
+		w.Write([]byte(s))
+	}
+	assert.Equal(t, "[2019-01-02T03:05:06Z] llamas\n[2019-01-02T03:05:06Z] alpacas\n[2019-01-02T03:05:06Z] \n[2019-01-02T03:05:06Z] vicunas", buf.String())
+}
+
+func TestTimestampWriterWithRelativeTimestamps(t *testing.T) {
+	t.Parallel()
+
+	w, buf := newTestTimestampWriter(TimestampFormatRelative)
+
+	w.Write([]byte("llamas\n"))
+	assert.Equal(t, "[00:01:01.250] llamas\n", buf.String())
+}
+
+func TestTimestampWriterDoesNotTimestampHeaders(t *testing.T) {
+	t.Parallel()
+
+	w, buf := newTestTimestampWriter(TimestampFormatRelative)
+
+	// Including when they're colored, and written a byte at a time
+	for _, b := range []byte("--- Building\n\x1b[32m+++ Testing\x1b[0m\n^^^ +++\n---\n") {
+		w.Write([]byte{b})
+	}
+	assert.Equal(t, "--- Building\n\x1b[32m+++ Testing\x1b[0m\n^^^ +++\n[00:01:01.250] ---\n", buf.String())
+}
+
+func TestTimestampWriterHoldsBackTheStartOfLinesUntilFlushed(t *testing.T) {
+	t.Parallel()
+
+	w, buf := newTestTimestampWriter(TimestampFormatRelative)
+
+	w.Write([]byte("llamas\nok"))
+	assert.Equal(t, "[00:01:01.250] llamas\n", buf.String())
+
+	w.Write([]byte("!!"))
+	assert.Equal(t, "[00:01:01.250] llamas\n[00:01:01.250] ok!!", buf.String())
+
+	w.Write([]byte("\nok"))
+	w.Flush()
+	assert.Equal(t, "[00:01:01.250] llamas\n[00:01:01.250] ok!!\n[00:01:01.250] ok", buf.String())
+}
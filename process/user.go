@@ -0,0 +1,67 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// ErrCredentialUnsupported is returned when processes can't be run as another
+// user on this platform
+var ErrCredentialUnsupported = errors.New("Processes can only be run as another user on unix")
+
+// Credential is the user a process is run as, along with the groups it's in
+type Credential struct {
+	Username string
+	HomeDir  string
+	UID      uint32
+	GID      uint32
+	Groups   []uint32
+}
+
+// LookupCredential returns the credential of a user, by their name or UID
+func LookupCredential(name string) (*Credential, error) {
+	u, err := user.Lookup(name)
+	if _, isUnknown := err.(user.UnknownUserError); isUnknown {
+		if _, parseErr := strconv.Atoi(name); parseErr == nil {
+			u, err = user.LookupId(name)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("The user %q couldn't be found (%v)", name, err)
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("The user %q doesn't have a numeric UID (%s)", name, u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("The user %q doesn't have a numeric GID (%s)", name, u.Gid)
+	}
+
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("The groups of user %q couldn't be found (%v)", name, err)
+	}
+
+	c := &Credential{Username: u.Username, HomeDir: u.HomeDir, UID: uint32(uid), GID: uint32(gid)}
+	for _, id := range groupIDs {
+		if group, err := strconv.ParseUint(id, 10, 32); err == nil {
+			c.Groups = append(c.Groups, uint32(group))
+		}
+	}
+
+	return c, nil
+}
+
+// Env returns the environment variables that say who the user is and where
+// their home is, so the process doesn't use the agent's
+func (c *Credential) Env() []string {
+	return []string{
+		"HOME=" + c.HomeDir,
+		"USER=" + c.Username,
+		"LOGNAME=" + c.Username,
+	}
+}
@@ -0,0 +1,30 @@
+package process
+
+import (
+	"os/user"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupCredential(t *testing.T) {
+	t.Parallel()
+
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("The current user couldn't be found (%v)", err)
+	}
+
+	// Users can be looked up by their name or UID
+	for _, name := range []string{current.Username, current.Uid} {
+		cred, err := LookupCredential(name)
+		if assert.NoError(t, err) {
+			assert.Equal(t, current.Username, cred.Username)
+			assert.Equal(t, current.HomeDir, cred.HomeDir)
+			assert.Contains(t, cred.Env(), "HOME="+current.HomeDir)
+		}
+	}
+
+	_, err = LookupCredential("llama-that-isnt-a-user")
+	assert.Error(t, err)
+}
@@ -3,12 +3,105 @@
 package process
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/kr/pty"
 )
 
+// PTYSupported returns whether commands can be run in a PTY, which they
+// always can outside of Windows
+func PTYSupported() bool {
+	return true
+}
+
 func StartPTY(c *exec.Cmd) (*os.File, error) {
 	return pty.Start(c)
 }
+
+// Starts the command in it's own process group. Commands started in a PTY
+// already are, as they lead their own session.
+func setProcessGroup(c *exec.Cmd) {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Setpgid = true
+}
+
+// SetCredential runs the command as the user, with their groups
+func SetCredential(c *exec.Cmd, cred *Credential) error {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Credential = &syscall.Credential{Uid: cred.UID, Gid: cred.GID, Groups: cred.Groups}
+	return nil
+}
+
+// Kills the command's process group, and the groups of anything it started
+// that are in their own, like the hooks and commands the bootstrap runs with
+// a timeout. They're found first, as once the command is killed they're no
+// longer it's descendants.
+func killProcessGroup(c *exec.Cmd) error {
+	if c == nil || c.Process == nil {
+		return errors.New("Process doesn't exist yet")
+	}
+
+	groups, findErr := descendantProcessGroups(c.Process.Pid)
+
+	err := syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	for _, pgid := range groups {
+		syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+
+	if err == nil && findErr != nil {
+		return fmt.Errorf("The processes it started in their own process groups couldn't be found (%v)", findErr)
+	}
+	return err
+}
+
+// Returns the process groups of the process's descendants that aren't in
+// it's group or the agent's
+func descendantProcessGroups(pid int) ([]int, error) {
+	out, err := exec.Command("ps", "-A", "-o", "pid=", "-o", "ppid=", "-o", "pgid=").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	children := map[int][]int{}
+	pgids := map[int]int{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+
+		var ids [3]int
+		for i, field := range fields {
+			if ids[i], err = strconv.Atoi(field); err != nil {
+				return nil, fmt.Errorf("Failed to parse the output of ps: %q", line)
+			}
+		}
+		children[ids[1]] = append(children[ids[1]], ids[0])
+		pgids[ids[0]] = ids[2]
+	}
+
+	groups := []int{}
+	seen := map[int]bool{pid: true, syscall.Getpgrp(): true}
+	queue := children[pid]
+	for len(queue) > 0 {
+		child := queue[0]
+		queue = append(queue[1:], children[child]...)
+
+		if pgid := pgids[child]; pgid > 1 && !seen[pgid] {
+			seen[pgid] = true
+			groups = append(groups, pgid)
+		}
+	}
+
+	return groups, nil
+}
@@ -0,0 +1,58 @@
+// +build !windows
+
+package process
+
+import (
+	"bufio"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKillingAProcessGroupKillsTheGroupsItStarted(t *testing.T) {
+	t.Parallel()
+
+	// Job control puts the background job in a process group of it's own,
+	// the same as the bootstrap does for commands with a timeout
+	cmd := exec.Command("/bin/bash", "-c", "set -m; sleep 100 & echo $!; wait")
+	setProcessGroup(cmd)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Kill(child, syscall.SIGKILL)
+
+	if pgid, _ := syscall.Getpgid(child); pgid == cmd.Process.Pid {
+		t.Fatalf("Expected the child to be in it's own process group")
+	}
+
+	if err := killProcessGroup(cmd); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Wait()
+
+	// Killed processes are gone once they've been reaped by init
+	for i := 0; i < 50; i++ {
+		if syscall.Kill(child, 0) == syscall.ESRCH {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Expected the child in it's own process group to be killed")
+}
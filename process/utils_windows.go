@@ -2,10 +2,23 @@ package process
 
 import (
 	"errors"
-	"os"
 	"os/exec"
 )
 
-func StartPTY(c *exec.Cmd) (*os.File, error) {
-	return nil, errors.New("PTY is not supported on Windows")
+// Windows doesn't have process groups like unix, processes are killed along
+// with their children with TASKKILL instead
+func setProcessGroup(c *exec.Cmd) {}
+
+// SetCredential isn't supported on Windows, and always returns
+// ErrCredentialUnsupported
+func SetCredential(c *exec.Cmd, cred *Credential) error {
+	return ErrCredentialUnsupported
+}
+
+func killProcessGroup(c *exec.Cmd) error {
+	if c == nil || c.Process == nil {
+		return errors.New("Process doesn't exist yet")
+	}
+
+	return c.Process.Kill()
 }
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+)
+
+// A destination that's connected to directly, rather than through the proxy
+type noProxyRule struct {
+	// A host name, which also matches it's subdomains
+	domain string
+
+	// Or an IP address or range
+	network *net.IPNet
+	ip      net.IP
+
+	// If set, only connections to this port match
+	port string
+
+	// Matches everything
+	any bool
+}
+
+// Parses NO_PROXY style rules. They can be * for every destination, a host
+// name like example.com (or .example.com) which also matches it's subdomains,
+// an IP address, or an IP range like 10.0.0.0/8. Host names and addresses can
+// have a port, like example.com:8080, so that only that port matches.
+func parseNoProxy(entries []string) []noProxyRule {
+	var rules []noProxyRule
+
+	for _, entry := range entries {
+		for _, s := range strings.Split(entry, ",") {
+			s = strings.ToLower(strings.TrimSpace(s))
+			if s == "" {
+				continue
+			}
+
+			if s == "*" {
+				rules = append(rules, noProxyRule{any: true})
+				continue
+			}
+
+			var rule noProxyRule
+
+			if _, network, err := net.ParseCIDR(s); err == nil {
+				rule.network = network
+				rules = append(rules, rule)
+				continue
+			}
+
+			if host, port, err := net.SplitHostPort(s); err == nil {
+				s, rule.port = host, port
+			}
+
+			if ip := net.ParseIP(strings.Trim(s, "[]")); ip != nil {
+				rule.ip = ip
+			} else {
+				rule.domain = strings.TrimPrefix(strings.TrimPrefix(s, "*"), ".")
+			}
+
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+func (r noProxyRule) matches(host, port string) bool {
+	if r.any {
+		return true
+	}
+
+	if r.port != "" && r.port != port {
+		return false
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if r.network != nil {
+			return r.network.Contains(ip)
+		}
+		return r.ip != nil && r.ip.Equal(ip)
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return r.domain != "" && (host == r.domain || strings.HasSuffix(host, "."+r.domain))
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoProxyRules(t *testing.T) {
+	rules := parseNoProxy([]string{"example.com, .internal.test,*.corp.test", "10.0.0.0/8,192.168.1.1", "builds.test:8080"})
+
+	matches := func(host, port string) bool {
+		for _, rule := range rules {
+			if rule.matches(host, port) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, tc := range []struct {
+		host, port string
+		expected   bool
+	}{
+		{"example.com", "443", true},
+		{"api.example.com", "443", true},
+		{"notexample.com", "443", false},
+		{"internal.test", "443", true},
+		{"git.internal.test", "443", true},
+		{"git.corp.test", "80", true},
+		{"10.1.2.3", "443", true},
+		{"11.1.2.3", "443", false},
+		{"192.168.1.1", "443", true},
+		{"192.168.1.2", "443", false},
+		{"builds.test", "8080", true},
+		{"builds.test", "443", false},
+		{"agent.buildkite.com", "443", false},
+	} {
+		assert.Equal(t, tc.expected, matches(tc.host, tc.port), "%s:%s", tc.host, tc.port)
+	}
+}
+
+func TestNoProxyWildcardMatchesEverything(t *testing.T) {
+	rules := parseNoProxy([]string{"*"})
+	assert.True(t, rules[0].matches("agent.buildkite.com", "443"))
+}
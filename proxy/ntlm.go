@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	ntlmNegotiateUnicode                 = 0x00000001
+	ntlmNegotiateOEM                     = 0x00000002
+	ntlmRequestTarget                    = 0x00000004
+	ntlmNegotiateNTLM                    = 0x00000200
+	ntlmNegotiateAlwaysSign              = 0x00008000
+	ntlmNegotiateExtendedSessionSecurity = 0x00080000
+
+	ntlmNegotiateFlags = ntlmNegotiateUnicode | ntlmNegotiateOEM | ntlmRequestTarget |
+		ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSessionSecurity
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// Used instead of time.Now and crypto/rand, for tests
+var (
+	ntlmNow             = time.Now
+	ntlmClientChallenge = func() ([]byte, error) {
+		challenge := make([]byte, 8)
+		_, err := rand.Read(challenge)
+		return challenge, err
+	}
+)
+
+// Opens a tunnel to addr through the proxy with CONNECT, authenticating with
+// NTLM. NTLM authenticates the connection rather than each request, so it
+// has to be done when connecting instead of with a Proxy-Authorization header.
+func (p *Proxy) dialNTLM(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+
+	conn, err := p.dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel, err := p.connectNTLM(conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to connect to %s through proxy %s (%v)", addr, redact(proxyURL), err)
+	}
+
+	return tunnel, nil
+}
+
+func (p *Proxy) connectNTLM(conn net.Conn, addr string) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+
+	// The proxy answers the negotiate message with a challenge
+	resp, err := connect(conn, r, addr, ntlmNegotiateMessage())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	} else if resp.StatusCode != http.StatusProxyAuthRequired {
+		return nil, errors.New(resp.Status)
+	}
+
+	challenge, err := ntlmChallengeFromHeader(resp.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	domain, username := p.ntlmUser()
+	authenticate, err := ntlmAuthenticateMessage(challenge, domain, username, p.password)
+	if err != nil {
+		return nil, err
+	}
+
+	// Which the tunnel is opened for, if the credentials are right
+	resp, err = connect(conn, r, addr, authenticate)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// Returns the domain and username, which can be given as DOMAIN\user
+func (p *Proxy) ntlmUser() (string, string) {
+	if parts := strings.SplitN(p.username, `\`, 2); len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return "", p.username
+}
+
+// Sends a CONNECT request with an NTLM message, and reads the response
+func connect(conn net.Conn, r *bufio.Reader, addr string, message []byte) (*http.Response, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{
+			"Proxy-Authorization": {"NTLM " + base64.StdEncoding.EncodeToString(message)},
+			"Proxy-Connection":    {"Keep-Alive"},
+		},
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The connection is kept open for the next message, so the body has to
+	// be read first
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	return resp, nil
+}
+
+// Returns the challenge from the proxy's Proxy-Authenticate header
+func ntlmChallengeFromHeader(header http.Header) ([]byte, error) {
+	for _, value := range header["Proxy-Authenticate"] {
+		if strings.HasPrefix(value, "NTLM ") {
+			return base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(value, "NTLM ")))
+		}
+	}
+	return nil, errors.New("The proxy didn't respond with an NTLM challenge")
+}
+
+// The first message, which asks the proxy for a challenge
+func ntlmNegotiateMessage() []byte {
+	message := make([]byte, 32)
+	copy(message, ntlmSignature)
+	binary.LittleEndian.PutUint32(message[8:], 1)
+	binary.LittleEndian.PutUint32(message[12:], ntlmNegotiateFlags)
+	return message
+}
+
+// The last message, which answers the challenge with an NTLMv2 response
+func ntlmAuthenticateMessage(challenge []byte, domain, username, password string) ([]byte, error) {
+	if len(challenge) < 32 || !bytes.Equal(challenge[:8], ntlmSignature) || binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, errors.New("The proxy's NTLM challenge is invalid")
+	}
+
+	serverChallenge := challenge[24:32]
+
+	// The target info is echoed back in the response. Older proxies don't
+	// send it.
+	var targetInfo []byte
+	if len(challenge) >= 48 {
+		length := int(binary.LittleEndian.Uint16(challenge[40:]))
+		offset := int(binary.LittleEndian.Uint32(challenge[44:]))
+		if offset+length > len(challenge) {
+			return nil, errors.New("The proxy's NTLM challenge is invalid")
+		}
+		targetInfo = challenge[offset : offset+length]
+	}
+
+	clientChallenge, err := ntlmClientChallenge()
+	if err != nil {
+		return nil, err
+	}
+
+	key := ntowfv2(password, username, domain)
+	nt := ntlmv2Response(key, serverChallenge, clientChallenge, ntlmNow(), targetInfo)
+	lm := append(hmacMD5(key, serverChallenge, clientChallenge), clientChallenge...)
+
+	// The header is followed by each of the fields in turn, which it has
+	// the length and offset of
+	fields := [][]byte{lm, nt, utf16le(domain), utf16le(username), nil, nil}
+	message := make([]byte, 64)
+	copy(message, ntlmSignature)
+	binary.LittleEndian.PutUint32(message[8:], 3)
+	for i, field := range fields {
+		header := message[12+i*8:]
+		binary.LittleEndian.PutUint16(header[0:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(header[2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(header[4:], uint32(len(message)))
+		message = append(message, field...)
+	}
+	binary.LittleEndian.PutUint32(message[60:], ntlmNegotiateFlags)
+
+	return message, nil
+}
+
+// The key the NTLMv2 responses are made with, from the password
+func ntowfv2(password, username, domain string) []byte {
+	return hmacMD5(md4Sum(utf16le(password)), utf16le(strings.ToUpper(username)+domain))
+}
+
+// Returns the MD4 digest of the data. It's broken as a hash, but NTLM is
+// built on it so there's no choice.
+func md4Sum(data []byte) []byte {
+	h := md4.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func ntlmv2Response(key, serverChallenge, clientChallenge []byte, now time.Time, targetInfo []byte) []byte {
+	// Windows time is in 100ns intervals since 1601
+	timestamp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timestamp, uint64(now.UnixNano()/100+116444736000000000))
+
+	var blob []byte
+	blob = append(blob, 1, 1, 0, 0, 0, 0, 0, 0)
+	blob = append(blob, timestamp...)
+	blob = append(blob, clientChallenge...)
+	blob = append(blob, 0, 0, 0, 0)
+	blob = append(blob, targetInfo...)
+	blob = append(blob, 0, 0, 0, 0)
+
+	return append(hmacMD5(key, serverChallenge, blob), blob...)
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func utf16le(s string) []byte {
+	encoded := utf16.Encode([]rune(s))
+	b := make([]byte, len(encoded)*2)
+	for i, c := range encoded {
+		binary.LittleEndian.PutUint16(b[i*2:], c)
+	}
+	return b
+}
+
+// A connection that reads anything the proxy sent after it's response first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
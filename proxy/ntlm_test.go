@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMD4(t *testing.T) {
+	// From RFC 1320
+	assert.Equal(t, "31d6cfe0d16ae931b73c59d7e0c089c0", hex.EncodeToString(md4Sum([]byte(""))))
+	assert.Equal(t, "a448017aaf21d8525fc10ae87aa6729d", hex.EncodeToString(md4Sum([]byte("abc"))))
+	assert.Equal(t, "e33b4ddc9c38f2199c3e7b164fcc0536", hex.EncodeToString(md4Sum([]byte("12345678901234567890123456789012345678901234567890123456789012345678901234567890"))))
+}
+
+func TestNTOWFv2(t *testing.T) {
+	// From the examples in MS-NLMP
+	assert.Equal(t, "0c868a403bfd7a93a3001ef22ef02e3f", hex.EncodeToString(ntowfv2("Password", "User", "Domain")))
+}
+
+func TestDialingThroughAnNTLMProxy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// A proxy that challenges the first CONNECT, and checks the user in the
+	// second before opening the tunnel
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		req, err := http.ReadRequest(r)
+		if err != nil || req.Method != "CONNECT" || req.Host != "agent.buildkite.com:443" {
+			return
+		}
+
+		challenge := make([]byte, 48)
+		copy(challenge, ntlmSignature)
+		binary.LittleEndian.PutUint32(challenge[8:], 2)
+		copy(challenge[24:], "12345678")
+		conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM " +
+			base64.StdEncoding.EncodeToString(challenge) + "\r\nContent-Length: 0\r\n\r\n"))
+
+		req, err = http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		message, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(req.Header.Get("Proxy-Authorization"), "NTLM "))
+		if len(message) < 64 || !strings.Contains(string(message), string(utf16le("buildkite"))) || !strings.Contains(string(message), string(utf16le("CORP"))) {
+			conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+			return
+		}
+
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhello"))
+	}()
+
+	p, err := New(Config{URL: "http://" + listener.Addr().String(), Auth: "ntlm", Username: `CORP\buildkite`, Password: "secret"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	conn, err := p.dialContext(context.Background(), "tcp", "agent.buildkite.com:443")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	// Anything after the proxy's response comes from the destination
+	b := make([]byte, 5)
+	_, err = conn.Read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+}
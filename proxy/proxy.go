@@ -0,0 +1,277 @@
+// Package proxy chooses which proxy the agent's HTTP requests go through, and
+// authenticates with it.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+)
+
+const (
+	AuthBasic = "basic"
+	AuthNTLM  = "ntlm"
+)
+
+// Link-local addresses, like the cloud metadata services, can't be reached
+// through a proxy
+var _, linkLocal, _ = net.ParseCIDR("169.254.0.0/16")
+
+// Config is how the agent's proxy is set up
+type Config struct {
+	// The proxy to use, i.e. http://proxy.example.com:3128. If it isn't
+	// set, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+	// are used instead.
+	URL string
+
+	// How to authenticate with the proxy, either basic or ntlm
+	Auth string
+
+	// The credentials to authenticate with. NTLM usernames can include the
+	// domain, i.e. CORP\buildkite.
+	Username string
+	Password string
+
+	// Destinations that are connected to directly, in the same form as
+	// NO_PROXY
+	NoProxy []string
+}
+
+// FromEnvironment returns the proxy config the agent passes on to jobs
+func FromEnvironment() Config {
+	var noProxy []string
+	if v := os.Getenv("BUILDKITE_NO_PROXY"); v != "" {
+		noProxy = []string{v}
+	}
+
+	return Config{
+		URL:      os.Getenv("BUILDKITE_PROXY"),
+		Auth:     os.Getenv("BUILDKITE_PROXY_AUTH"),
+		Username: os.Getenv("BUILDKITE_PROXY_USERNAME"),
+		Password: os.Getenv("BUILDKITE_PROXY_PASSWORD"),
+		NoProxy:  noProxy,
+	}
+}
+
+// Proxy picks the proxy for each request
+type Proxy struct {
+	// If set, which proxy each request goes through is logged
+	Debug bool
+
+	url      *url.URL
+	auth     string
+	username string
+	password string
+	noProxy  []noProxyRule
+	dialer   *net.Dialer
+}
+
+// New checks the config, and returns the proxy for it
+func New(c Config) (*Proxy, error) {
+	p := &Proxy{
+		auth:     strings.ToLower(c.Auth),
+		username: c.Username,
+		password: c.Password,
+		noProxy:  parseNoProxy(c.NoProxy),
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+	}
+
+	switch p.auth {
+	case "", AuthBasic, AuthNTLM:
+	default:
+		return nil, fmt.Errorf("Unknown proxy authentication %q, expected basic or ntlm", c.Auth)
+	}
+
+	if p.auth != "" && p.username == "" {
+		return nil, fmt.Errorf("The proxy needs a username to use %s authentication", p.auth)
+	}
+
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil || u.Host == "" {
+			// Like curl, a proxy without a scheme is a http one
+			if u, err = url.Parse("http://" + c.URL); err != nil || u.Host == "" {
+				return nil, fmt.Errorf("Invalid proxy %q", c.URL)
+			}
+		}
+		if p.auth == AuthNTLM && u.Scheme != "http" {
+			return nil, fmt.Errorf("NTLM authentication is only supported with http proxies, not %s", u.Scheme)
+		}
+		p.url = u
+	}
+
+	return p, nil
+}
+
+// Configure makes the transport's requests go through the proxy. A nil Proxy
+// leaves the transport as it was.
+func (p *Proxy) Configure(t *http.Transport) {
+	if p == nil {
+		return
+	}
+
+	if p.auth == AuthNTLM {
+		// HTTPS requests go through a tunnel, which is authenticated as
+		// it's opened. Plain HTTP requests are sent to the proxy as they
+		// are, as they would be without NTLM.
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			if req.URL.Scheme == "https" {
+				return nil, nil
+			}
+			return p.proxyForRequest(req)
+		}
+		t.DialTLS = func(network, addr string) (net.Conn, error) {
+			return p.dialTLS(context.Background(), t, network, addr)
+		}
+		return
+	}
+
+	t.Proxy = func(req *http.Request) (*url.URL, error) {
+		u, err := p.proxyForRequest(req)
+		if err != nil || u == nil {
+			return nil, err
+		}
+
+		if p.auth == AuthBasic {
+			authenticated := *u
+			authenticated.User = url.UserPassword(p.username, p.password)
+			u = &authenticated
+		}
+
+		return u, nil
+	}
+}
+
+// Returns the proxy to send the request through, or nil to send it directly
+func (p *Proxy) proxyForRequest(req *http.Request) (*url.URL, error) {
+	host, port := req.URL.Hostname(), req.URL.Port()
+	if port == "" {
+		port = defaultPort(req.URL.Scheme)
+	}
+	return p.proxyFor(req.URL.Scheme, host, port)
+}
+
+// Connects to addr with TLS, through a tunnel unless it's excluded
+func (p *Proxy) dialTLS(ctx context.Context, t *http.Transport, network, addr string) (net.Conn, error) {
+	conn, err := p.dialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{}
+	if t.TLSClientConfig != nil {
+		config = t.TLSClientConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// Connects to the HTTPS addr, through the proxy unless it's excluded
+func (p *Proxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := p.proxyFor("https", host, port)
+	if err != nil {
+		return nil, err
+	} else if u == nil {
+		return p.dialer.DialContext(ctx, network, addr)
+	}
+
+	return p.dialNTLM(ctx, u, addr)
+}
+
+// Returns the proxy to connect to the host through, or nil to connect
+// directly
+func (p *Proxy) proxyFor(scheme, host, port string) (*url.URL, error) {
+	addr := net.JoinHostPort(host, port)
+
+	if p.bypass(host, port) {
+		p.logf("Connecting to %s directly", addr)
+		return nil, nil
+	}
+
+	u := p.url
+	if u == nil {
+		var err error
+		u, err = http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: scheme, Host: addr}})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if u == nil {
+		p.logf("Connecting to %s directly", addr)
+	} else {
+		p.logf("Connecting to %s through proxy %s", addr, redact(u))
+	}
+
+	return u, nil
+}
+
+func (p *Proxy) bypass(host, port string) bool {
+	if ip := net.ParseIP(host); ip != nil && (ip.IsLoopback() || linkLocal.Contains(ip)) {
+		return true
+	}
+	if host == "localhost" {
+		return true
+	}
+
+	for _, rule := range p.noProxy {
+		if rule.matches(host, port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Proxy) logf(format string, v ...interface{}) {
+	if p.Debug {
+		logger.Debug("[Proxy] "+format, v...)
+	}
+}
+
+func defaultPort(scheme string) string {
+	if scheme == "http" {
+		return "80"
+	}
+	return "443"
+}
+
+// Returns the proxy's URL without it's password, for logging
+func redact(u *url.URL) string {
+	if u.User == nil {
+		return u.String()
+	}
+	redacted := *u
+	redacted.User = url.User(u.User.Username())
+	return redacted.String()
+}
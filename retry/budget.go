@@ -0,0 +1,59 @@
+package retry
+
+import (
+	"sync"
+	"time"
+)
+
+// Budget limits how many retries can be made over a period of time. It's
+// refilled gradually, so a steady trickle of retries is always allowed, but a
+// flood of them isn't. A nil Budget allows every retry.
+type Budget struct {
+	// How many retries can be made in each period
+	Retries int
+	Period  time.Duration
+
+	tokens float64
+	last   time.Time
+
+	// Used instead of time.Now, for tests
+	now func() time.Time
+
+	mutex sync.Mutex
+}
+
+// NewBudget creates a budget that's full
+func NewBudget(retries int, period time.Duration) *Budget {
+	return &Budget{Retries: retries, Period: period, tokens: float64(retries)}
+}
+
+// Allow uses up one retry, returning false if there aren't any left
+func (b *Budget) Allow() bool {
+	if b == nil || b.Retries <= 0 || b.Period <= 0 {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	if b.now != nil {
+		now = b.now()
+	}
+
+	// Refill the retries that have been earned since the last one
+	if !b.last.IsZero() {
+		b.tokens += float64(b.Retries) * float64(now.Sub(b.last)) / float64(b.Period)
+	}
+	if b.tokens > float64(b.Retries) {
+		b.tokens = float64(b.Retries)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
@@ -0,0 +1,46 @@
+package retry
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBudgetRefillsOverTime(t *testing.T) {
+	now := time.Now()
+	budget := NewBudget(2, time.Minute)
+	budget.now = func() time.Time { return now }
+
+	assert.True(t, budget.Allow())
+	assert.True(t, budget.Allow())
+	assert.False(t, budget.Allow())
+
+	now = now.Add(30 * time.Second)
+	assert.True(t, budget.Allow())
+	assert.False(t, budget.Allow())
+}
+
+func TestNilBudgetAllowsEverything(t *testing.T) {
+	var budget *Budget
+	assert.True(t, budget.Allow())
+}
+
+func TestDoStopsRetryingWhenTheBudgetIsUsedUp(t *testing.T) {
+	attempts := 0
+	err := Do(func(s *Stats) error {
+		attempts++
+		return errors.New("Failed")
+	}, &Config{Maximum: 10, Interval: time.Millisecond, Budget: NewBudget(2, time.Hour)})
+
+	assert.Error(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestExponentialIntervalIsCapped(t *testing.T) {
+	assert.Equal(t, time.Second, exponentialInterval(time.Second, 1, time.Minute))
+	assert.Equal(t, 8*time.Second, exponentialInterval(time.Second, 4, time.Minute))
+	assert.Equal(t, time.Minute, exponentialInterval(time.Second, 20, time.Minute))
+	assert.Equal(t, 1024*time.Second, exponentialInterval(time.Second, 11, 0))
+}
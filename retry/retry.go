@@ -19,6 +19,16 @@ type Config struct {
 	Interval time.Duration
 	Forever  bool
 	Jitter   bool
+
+	// Double the interval after every failed attempt
+	Exponential bool
+
+	// The most an exponential interval can grow to, if set
+	MaxInterval time.Duration
+
+	// Shared by the retries of everything that calls the same endpoint, so
+	// they give up once it's used up rather than all retrying at once
+	Budget *Budget
 }
 
 // A human readable representation often useful for debugging.
@@ -72,8 +82,11 @@ func Do(callback func(*Stats) error, config *Config) error {
 		// Preconfigure the interval that will be used (so that we have
 		// access to it in the callback)
 		stats.Interval = config.Interval
+		if config.Exponential {
+			stats.Interval = exponentialInterval(config.Interval, stats.Attempt, config.MaxInterval)
+		}
 		if config.Jitter {
-			stats.Interval = stats.Interval + (time.Duration(1000*random.Float32()) * time.Millisecond)
+			stats.Interval = stats.Interval + jitter(stats.Interval, random)
 		}
 
 		// Attempt the callback
@@ -88,6 +101,12 @@ func Do(callback func(*Stats) error, config *Config) error {
 			return err
 		}
 
+		// Give up if everything else calling the endpoint has been
+		// retrying too
+		if !config.Budget.Allow() {
+			return err
+		}
+
 		// Bump the attempt number
 		stats.Attempt = stats.Attempt + 1
 
@@ -104,3 +123,25 @@ func Do(callback func(*Stats) error, config *Config) error {
 
 	return err
 }
+
+// Doubles the interval for each attempt after the first, up to the maximum
+func exponentialInterval(interval time.Duration, attempt int, max time.Duration) time.Duration {
+	for i := 1; i < attempt; i++ {
+		interval *= 2
+		if max > 0 && interval >= max {
+			return max
+		}
+	}
+	return interval
+}
+
+// A random amount of time to add to the interval, so things that failed at the
+// same time don't all retry at the same time. It's up to a second, or a
+// quarter of longer intervals.
+func jitter(interval time.Duration, random *rand.Rand) time.Duration {
+	window := interval / 4
+	if window < time.Second {
+		window = time.Second
+	}
+	return time.Duration(random.Int63n(int64(window)))
+}
@@ -0,0 +1,247 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// SSM fetches parameters from AWS Systems Manager Parameter Store, decrypting
+// SecureStrings
+type SSM struct {
+	client *awsJSONClient
+}
+
+// NewSSM returns a provider that uses the session's region and credentials,
+// i.e. the instance role
+func NewSSM(sess *session.Session) *SSM {
+	return &SSM{client: newAWSJSONClient(sess, "ssm")}
+}
+
+// Fetch returns the value of the parameter at the path
+func (s *SSM) Fetch(path, field string) (string, error) {
+	if field != "" {
+		return "", fmt.Errorf("SSM parameters don't have fields, got %q", field)
+	}
+
+	var output struct {
+		Parameter struct {
+			Value string
+		}
+	}
+	input := map[string]interface{}{"Name": path, "WithDecryption": true}
+	if err := s.client.call("AmazonSSM.GetParameter", input, &output); err != nil {
+		return "", err
+	}
+
+	return output.Parameter.Value, nil
+}
+
+// SecretsManager fetches secrets from AWS Secrets Manager
+type SecretsManager struct {
+	client *awsJSONClient
+}
+
+// NewSecretsManager returns a provider that uses the session's region and
+// credentials, i.e. the instance role
+func NewSecretsManager(sess *session.Session) *SecretsManager {
+	return &SecretsManager{client: newAWSJSONClient(sess, "secretsmanager")}
+}
+
+// Fetch returns the value of the secret with the name or ARN. If there's a
+// field, the secret is parsed as a JSON object and the field's value is
+// returned, which is how Secrets Manager stores key/value pairs.
+func (s *SecretsManager) Fetch(name, field string) (string, error) {
+	var output struct {
+		SecretString string
+		SecretBinary string
+	}
+	input := map[string]interface{}{"SecretId": name}
+	if err := s.client.call("secretsmanager.GetSecretValue", input, &output); err != nil {
+		return "", err
+	}
+
+	value := output.SecretString
+	if value == "" && output.SecretBinary != "" {
+		decoded, err := base64.StdEncoding.DecodeString(output.SecretBinary)
+		if err != nil {
+			return "", fmt.Errorf("Failed to decode the binary secret: %v", err)
+		}
+		value = string(decoded)
+	}
+
+	if field == "" {
+		return value, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("The secret isn't a JSON object, so it doesn't have a %q field", field)
+	}
+
+	v, ok := fields[field]
+	if !ok || v == nil {
+		return "", fmt.Errorf("The secret doesn't have a %q field", field)
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// Calls the AWS APIs that use the JSON protocol, which both SSM and Secrets
+// Manager do
+type awsJSONClient struct {
+	sess    *session.Session
+	service string
+	client  *http.Client
+
+	// Used instead of the service's regional endpoint, i.e. in tests
+	endpoint string
+}
+
+func newAWSJSONClient(sess *session.Session, service string) *awsJSONClient {
+	return &awsJSONClient{
+		sess:    sess,
+		service: service,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *awsJSONClient) call(target string, input interface{}, output interface{}) error {
+	region := aws.StringValue(c.sess.Config.Region)
+
+	endpoint := c.endpoint
+	if endpoint == "" {
+		resolved, err := endpoints.DefaultResolver().EndpointFor(c.service, region, endpoints.ResolveUnknownServiceOption)
+		if err != nil {
+			return err
+		}
+		endpoint = resolved.URL
+	}
+
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+
+	signer := v4.NewSigner(c.sess.Config.Credentials)
+	if _, err := signer.Sign(req, bytes.NewReader(body), c.service, region, time.Now()); err != nil {
+		return fmt.Errorf("Failed to sign the request to %s: %v", c.service, err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Type         string `json:"__type"`
+			Message      string `json:"message"`
+			MessageUpper string `json:"Message"`
+		}
+		if json.Unmarshal(contents, &failure) != nil || failure.Type == "" {
+			return fmt.Errorf("%s returned %s", target, resp.Status)
+		}
+
+		// The type can be prefixed with a namespace, i.e.
+		// com.amazonaws.ssm#ParameterNotFound
+		errType := failure.Type[strings.LastIndex(failure.Type, "#")+1:]
+		if message := failure.Message + failure.MessageUpper; message != "" {
+			return fmt.Errorf("%s: %s", errType, message)
+		}
+		return fmt.Errorf("%s", errType)
+	}
+
+	if err := json.Unmarshal(contents, output); err != nil {
+		return fmt.Errorf("Failed to parse the response from %s: %v", target, err)
+	}
+
+	return nil
+}
+
+// ECR fetches the credentials docker logs in to Elastic Container Registry
+// with, which last for 12 hours
+type ECR struct {
+	sess *session.Session
+
+	// Used instead of the regional endpoint, i.e. in tests
+	endpoint string
+}
+
+// NewECR returns a registry credentials source that uses the session's
+// credentials, i.e. the instance role
+func NewECR(sess *session.Session) *ECR {
+	return &ECR{sess: sess}
+}
+
+var ecrRegistryRegex = regexp.MustCompile(`\A([0-9]{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?\z`)
+
+// Login returns the username and password for the registry, which is the
+// hostname of an account's registry, i.e. 012345678910.dkr.ecr.us-east-1.amazonaws.com
+func (e *ECR) Login(registry string) (string, string, error) {
+	match := ecrRegistryRegex.FindStringSubmatch(registry)
+	if match == nil {
+		return "", "", fmt.Errorf("%q isn't an ECR registry", registry)
+	}
+
+	// The token is for the registry's region, not the agent's
+	client := newAWSJSONClient(e.sess.Copy(&aws.Config{Region: aws.String(match[2])}), "ecr")
+	client.endpoint = e.endpoint
+
+	var output struct {
+		AuthorizationData []struct {
+			AuthorizationToken string `json:"authorizationToken"`
+		} `json:"authorizationData"`
+	}
+	input := map[string]interface{}{"registryIds": []string{match[1]}}
+	if err := client.call("AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken", input, &output); err != nil {
+		return "", "", err
+	}
+	if len(output.AuthorizationData) == 0 {
+		return "", "", fmt.Errorf("ECR didn't return a token for %s", registry)
+	}
+
+	// The token is the base64 encoded username:password
+	decoded, err := base64.StdEncoding.DecodeString(output.AuthorizationData[0].AuthorizationToken)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to decode the token for %s: %v", registry, err)
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("The token for %s isn't a username and password", registry)
+	}
+
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,138 @@
+package secrets
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/assert"
+)
+
+// A fake endpoint for the AWS JSON APIs, which checks requests are signed
+func newTestAWSServer(t *testing.T, service string, respond func(target string, input map[string]interface{}) (int, string)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/ap-southeast-2/"+service+"/aws4_request") {
+			t.Errorf("Unexpected Authorization header %q", auth)
+		}
+		assert.Equal(t, "application/x-amz-json-1.1", req.Header.Get("Content-Type"))
+
+		var input map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			t.Fatal(err)
+		}
+
+		status, body := respond(req.Header.Get("X-Amz-Target"), input)
+		rw.WriteHeader(status)
+		rw.Write([]byte(body))
+	}))
+}
+
+func newTestAWSSession(t *testing.T) *session.Session {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("ap-southeast-2"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+func TestSSM(t *testing.T) {
+	t.Parallel()
+
+	server := newTestAWSServer(t, "ssm", func(target string, input map[string]interface{}) (int, string) {
+		assert.Equal(t, "AmazonSSM.GetParameter", target)
+		assert.Equal(t, true, input["WithDecryption"])
+		if input["Name"] == "/prod/db/password" {
+			return 200, `{"Parameter":{"Name":"/prod/db/password","Type":"SecureString","Value":"hunter2"}}`
+		}
+		return 400, `{"__type":"ParameterNotFound","message":""}`
+	})
+	defer server.Close()
+
+	ssm := NewSSM(newTestAWSSession(t))
+	ssm.client.endpoint = server.URL
+
+	value, err := ssm.Fetch("/prod/db/password", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", value)
+
+	_, err = ssm.Fetch("/prod/db/missing", "")
+	assert.EqualError(t, err, "ParameterNotFound")
+
+	_, err = ssm.Fetch("/prod/db/password", "field")
+	assert.EqualError(t, err, `SSM parameters don't have fields, got "field"`)
+}
+
+func TestSecretsManager(t *testing.T) {
+	t.Parallel()
+
+	server := newTestAWSServer(t, "secretsmanager", func(target string, input map[string]interface{}) (int, string) {
+		assert.Equal(t, "secretsmanager.GetSecretValue", target)
+		switch input["SecretId"] {
+		case "prod/api":
+			return 200, `{"Name":"prod/api","SecretString":"{\"key\":\"abc123\",\"port\":443}"}`
+		case "prod/cert":
+			return 200, `{"Name":"prod/cert","SecretBinary":"Y2VydGlmaWNhdGU="}`
+		}
+		return 400, `{"__type":"com.amazonaws.secretsmanager#ResourceNotFoundException","Message":"Secrets Manager can't find the specified secret."}`
+	})
+	defer server.Close()
+
+	sm := NewSecretsManager(newTestAWSSession(t))
+	sm.client.endpoint = server.URL
+
+	value, err := sm.Fetch("prod/api", "")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"key":"abc123","port":443}`, value)
+
+	value, err = sm.Fetch("prod/api", "key")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc123", value)
+
+	value, err = sm.Fetch("prod/api", "port")
+	assert.NoError(t, err)
+	assert.Equal(t, "443", value)
+
+	_, err = sm.Fetch("prod/api", "missing")
+	assert.EqualError(t, err, `The secret doesn't have a "missing" field`)
+
+	value, err = sm.Fetch("prod/cert", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "certificate", value)
+
+	_, err = sm.Fetch("prod/cert", "key")
+	assert.EqualError(t, err, `The secret isn't a JSON object, so it doesn't have a "key" field`)
+
+	_, err = sm.Fetch("prod/missing", "")
+	assert.EqualError(t, err, "ResourceNotFoundException: Secrets Manager can't find the specified secret.")
+}
+
+func TestECR(t *testing.T) {
+	t.Parallel()
+
+	server := newTestAWSServer(t, "ecr", func(target string, input map[string]interface{}) (int, string) {
+		assert.Equal(t, "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken", target)
+		assert.Equal(t, []interface{}{"012345678910"}, input["registryIds"])
+		return 200, `{"authorizationData":[{"authorizationToken":"QVdTOmh1bnRlcjI=","proxyEndpoint":"https://012345678910.dkr.ecr.ap-southeast-2.amazonaws.com"}]}`
+	})
+	defer server.Close()
+
+	ecr := NewECR(newTestAWSSession(t))
+	ecr.endpoint = server.URL
+
+	username, password, err := ecr.Login("012345678910.dkr.ecr.ap-southeast-2.amazonaws.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "AWS", username)
+	assert.Equal(t, "hunter2", password)
+
+	_, _, err = ecr.Login("docker.io")
+	assert.EqualError(t, err, `"docker.io" isn't an ECR registry`)
+}
@@ -0,0 +1,139 @@
+// Package secrets fetches the secrets a job asks for from the providers the
+// agent is configured with, i.e. HashiCorp Vault or AWS SSM Parameter Store,
+// and the credentials for the registries jobs are logged in to.
+package secrets
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Secret is a value a job wants in an environment variable, which is fetched
+// from a provider before the job starts
+type Secret struct {
+	// The name of the environment variable the value goes in
+	Name string
+
+	// The provider it comes from, i.e. vault
+	Provider string
+
+	// Where the secret is in the provider, and which field of it to use.
+	// Providers decide what the field defaults to if it's empty.
+	Path  string
+	Field string
+}
+
+func (s Secret) String() string {
+	ref := s.Provider + "://" + s.Path
+	if s.Field != "" {
+		ref += "#" + s.Field
+	}
+	return ref
+}
+
+// Provider fetches secrets from somewhere
+type Provider interface {
+	Fetch(path, field string) (string, error)
+}
+
+// Providers are the providers that secrets can come from, by name
+type Providers map[string]Provider
+
+var secretNameRegex = regexp.MustCompile(`\A[a-zA-Z_][a-zA-Z0-9_]*\z`)
+
+// Parse reads the secrets a job asks for from a list of NAME=provider://path#field
+// separated by commas or new lines, i.e.
+// "DB_PASSWORD=vault://secret/data/db#password"
+func Parse(s string) ([]Secret, error) {
+	var secrets []Secret
+
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !secretNameRegex.MatchString(strings.TrimSpace(parts[0])) {
+			return nil, fmt.Errorf("Invalid secret %q, expected NAME=provider://path#field", entry)
+		}
+
+		ref := strings.SplitN(strings.TrimSpace(parts[1]), "://", 2)
+		if len(ref) != 2 || ref[0] == "" || ref[1] == "" {
+			return nil, fmt.Errorf("Invalid secret %q, expected NAME=provider://path#field", entry)
+		}
+
+		secret := Secret{Name: strings.TrimSpace(parts[0]), Provider: strings.ToLower(ref[0]), Path: ref[1]}
+		if i := strings.LastIndex(secret.Path, "#"); i >= 0 {
+			secret.Path, secret.Field = secret.Path[:i], secret.Path[i+1:]
+		}
+		if secret.Path == "" {
+			return nil, fmt.Errorf("Invalid secret %q, it doesn't have a path", entry)
+		}
+
+		secrets = append(secrets, secret)
+	}
+
+	return secrets, nil
+}
+
+// The providers environment variables can reference directly, by the prefix
+// their values start with, i.e. DB_PASSWORD=ssm:/prod/db/password
+var envPrefixes = map[string]string{
+	"ssm":         "ssm:",
+	"aws-secrets": "aws-secrets:",
+}
+
+// FromEnvironment returns the secrets for the environment variables whose
+// values reference one of the providers, in the form prefix:path#field. They're
+// sorted by name so they're fetched in a consistent order.
+func FromEnvironment(env map[string]string, providers ...string) []Secret {
+	var secrets []Secret
+
+	for name, value := range env {
+		for _, provider := range providers {
+			prefix, ok := envPrefixes[provider]
+			if !ok || !strings.HasPrefix(value, prefix) || !secretNameRegex.MatchString(name) {
+				continue
+			}
+
+			secret := Secret{Name: name, Provider: provider, Path: strings.TrimPrefix(value, prefix)}
+			if i := strings.LastIndex(secret.Path, "#"); i >= 0 {
+				secret.Path, secret.Field = secret.Path[:i], secret.Path[i+1:]
+			}
+			if secret.Path != "" {
+				secrets = append(secrets, secret)
+			}
+		}
+	}
+
+	sort.Slice(secrets, func(i, j int) bool {
+		return secrets[i].Name < secrets[j].Name
+	})
+
+	return secrets
+}
+
+// Fetch returns the values of the secrets in the same order, as KEY=value
+// environment variables
+func (p Providers) Fetch(secrets []Secret) ([]string, error) {
+	env := make([]string, 0, len(secrets))
+
+	for _, secret := range secrets {
+		provider, ok := p[secret.Provider]
+		if !ok || provider == nil {
+			return nil, fmt.Errorf("Failed to fetch %s from %s, the %s secrets provider isn't configured", secret.Name, secret, secret.Provider)
+		}
+
+		value, err := provider.Fetch(secret.Path, secret.Field)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to fetch %s from %s: %v", secret.Name, secret, err)
+		}
+
+		env = append(env, secret.Name+"="+value)
+	}
+
+	return env, nil
+}
@@ -0,0 +1,86 @@
+package secrets
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	secrets, err := Parse("DB_PASSWORD=vault://secret/data/db#password,\n API_KEY = VAULT://secret/api\n")
+	assert.NoError(t, err)
+	assert.Equal(t, []Secret{
+		{Name: "DB_PASSWORD", Provider: "vault", Path: "secret/data/db", Field: "password"},
+		{Name: "API_KEY", Provider: "vault", Path: "secret/api"},
+	}, secrets)
+
+	secrets, err = Parse("")
+	assert.NoError(t, err)
+	assert.Empty(t, secrets)
+}
+
+func TestParseInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []string{
+		"DB_PASSWORD",
+		"DB-PASSWORD=vault://secret/db",
+		"DB_PASSWORD=secret/db",
+		"DB_PASSWORD=vault://",
+		"DB_PASSWORD=vault://#password",
+	} {
+		_, err := Parse(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestFromEnvironment(t *testing.T) {
+	t.Parallel()
+
+	secrets := FromEnvironment(map[string]string{
+		"DB_PASSWORD":   "ssm:/prod/db/password",
+		"API_KEY":       "aws-secrets:prod/api#key",
+		"NOT_A_SECRET":  "ssmssm:/prod",
+		"VAULT_SECRET":  "vault:secret/db",
+		"EMPTY":         "ssm:",
+		"BUILDKITE_TAG": "v1",
+	}, "ssm", "aws-secrets", "vault")
+
+	assert.Equal(t, []Secret{
+		{Name: "API_KEY", Provider: "aws-secrets", Path: "prod/api", Field: "key"},
+		{Name: "DB_PASSWORD", Provider: "ssm", Path: "/prod/db/password"},
+	}, secrets)
+
+	assert.Empty(t, FromEnvironment(map[string]string{"DB_PASSWORD": "ssm:/prod/db/password"}, "aws-secrets"))
+}
+
+type testProvider map[string]string
+
+func (p testProvider) Fetch(path, field string) (string, error) {
+	if v, ok := p[path+"#"+field]; ok {
+		return v, nil
+	}
+	return "", errors.New("Not found")
+}
+
+func TestProvidersFetch(t *testing.T) {
+	t.Parallel()
+
+	providers := Providers{"test": testProvider{"a#b": "llamas", "c#": "alpacas"}}
+
+	env, err := providers.Fetch([]Secret{
+		{Name: "FIRST", Provider: "test", Path: "a", Field: "b"},
+		{Name: "SECOND", Provider: "test", Path: "c"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"FIRST=llamas", "SECOND=alpacas"}, env)
+
+	_, err = providers.Fetch([]Secret{{Name: "MISSING", Provider: "test", Path: "d"}})
+	assert.EqualError(t, err, "Failed to fetch MISSING from test://d: Not found")
+
+	_, err = providers.Fetch([]Secret{{Name: "OTHER", Provider: "vault", Path: "a"}})
+	assert.EqualError(t, err, "Failed to fetch OTHER from vault://a, the vault secrets provider isn't configured")
+}
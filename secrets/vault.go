@@ -0,0 +1,237 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	VaultAuthAppRole    = "approle"
+	VaultAuthKubernetes = "kubernetes"
+
+	// Where Kubernetes mounts the pod's service account token
+	defaultKubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// The field that's used if a secret doesn't say which one it wants
+	defaultVaultField = "value"
+)
+
+// VaultConfig is how the agent logs into Vault
+type VaultConfig struct {
+	// The address of the Vault server, i.e. https://vault.example.com:8200
+	Address string
+
+	// The Vault Enterprise namespace the secrets are in
+	Namespace string
+
+	// How to log in, either approle or kubernetes, and the path the auth
+	// method is mounted at if it isn't the default
+	AuthMethod string
+	AuthMount  string
+
+	// The credentials for approle
+	RoleID   string
+	SecretID string
+
+	// The role for kubernetes, and the service account token it logs in
+	// with, which defaults to the pod's
+	KubernetesRole      string
+	KubernetesTokenPath string
+}
+
+// Vault fetches secrets from HashiCorp Vault. It logs in the first time a
+// secret is fetched, and uses the same token from then on.
+type Vault struct {
+	config VaultConfig
+	client *http.Client
+
+	tokenLock sync.Mutex
+	token     string
+}
+
+// NewVault checks the config, and returns a provider for it
+func NewVault(c VaultConfig) (*Vault, error) {
+	if c.Address == "" {
+		return nil, errors.New("The Vault address is required")
+	}
+	c.Address = strings.TrimSuffix(c.Address, "/")
+	if !strings.Contains(c.Address, "://") {
+		c.Address = "https://" + c.Address
+	}
+
+	c.AuthMethod = strings.ToLower(c.AuthMethod)
+	if c.AuthMethod == "" {
+		c.AuthMethod = VaultAuthAppRole
+	}
+
+	switch c.AuthMethod {
+	case VaultAuthAppRole:
+		if c.RoleID == "" {
+			return nil, errors.New("Logging into Vault with approle needs a role ID")
+		}
+	case VaultAuthKubernetes:
+		if c.KubernetesRole == "" {
+			return nil, errors.New("Logging into Vault with kubernetes needs a role")
+		}
+		if c.KubernetesTokenPath == "" {
+			c.KubernetesTokenPath = defaultKubernetesTokenPath
+		}
+	default:
+		return nil, fmt.Errorf("Unknown Vault auth method %q, expected approle or kubernetes", c.AuthMethod)
+	}
+
+	if c.AuthMount == "" {
+		c.AuthMount = c.AuthMethod
+	}
+	c.AuthMount = strings.Trim(c.AuthMount, "/")
+
+	return &Vault{
+		config: c,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Fetch reads a secret, and returns the field of it. Secrets in both version
+// 1 and 2 of the key/value engine can be read, although the path for version
+// 2 needs to include the data/ part, i.e. secret/data/db.
+func (v *Vault) Fetch(path, field string) (string, error) {
+	if field == "" {
+		field = defaultVaultField
+	}
+
+	token, err := v.login()
+	if err != nil {
+		return "", err
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := v.request("GET", strings.TrimPrefix(path, "/"), token, nil, &secret); err != nil {
+		return "", err
+	}
+
+	data := secret.Data
+
+	// Version 2 of the key/value engine nests the secret with it's metadata
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	value, ok := data[field]
+	if !ok || value == nil {
+		return "", fmt.Errorf("The secret doesn't have a %q field", field)
+	}
+
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// Returns the token to fetch secrets with, logging in if it hasn't already
+func (v *Vault) login() (string, error) {
+	v.tokenLock.Lock()
+	defer v.tokenLock.Unlock()
+
+	if v.token != "" {
+		return v.token, nil
+	}
+
+	body := map[string]string{}
+
+	switch v.config.AuthMethod {
+	case VaultAuthAppRole:
+		body["role_id"] = v.config.RoleID
+		if v.config.SecretID != "" {
+			body["secret_id"] = v.config.SecretID
+		}
+	case VaultAuthKubernetes:
+		jwt, err := ioutil.ReadFile(v.config.KubernetesTokenPath)
+		if err != nil {
+			return "", fmt.Errorf("Failed to read the Kubernetes service account token: %v", err)
+		}
+		body["role"] = v.config.KubernetesRole
+		body["jwt"] = strings.TrimSpace(string(jwt))
+	}
+
+	var login struct {
+		Auth *struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := v.request("POST", "auth/"+v.config.AuthMount+"/login", "", body, &login); err != nil {
+		return "", fmt.Errorf("Failed to log into Vault with %s: %v", v.config.AuthMethod, err)
+	}
+
+	if login.Auth == nil || login.Auth.ClientToken == "" {
+		return "", fmt.Errorf("Failed to log into Vault with %s: no token was returned", v.config.AuthMethod)
+	}
+
+	v.token = login.Auth.ClientToken
+	return v.token, nil
+}
+
+// Makes a request to the Vault API, and decodes the response into result
+func (v *Vault) request(method, path, token string, body interface{}, result interface{}) error {
+	var encoded []byte
+	if body != nil {
+		var err error
+		if encoded, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, v.config.Address+"/v1/"+path, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.config.Namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(contents, &failure) == nil && len(failure.Errors) > 0 {
+			return fmt.Errorf("%s (%d)", strings.Join(failure.Errors, ", "), resp.StatusCode)
+		}
+		return fmt.Errorf("%s %s returned %s", method, path, resp.Status)
+	}
+
+	if err := json.Unmarshal(contents, result); err != nil {
+		return fmt.Errorf("Failed to parse the response from %s %s: %v", method, path, err)
+	}
+
+	return nil
+}
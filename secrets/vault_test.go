@@ -0,0 +1,150 @@
+package secrets
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A fake Vault server with an approle and kubernetes login, and a secret in
+// each version of the key/value engine
+func newTestVaultServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body map[string]string
+		if req.Method == "POST" {
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		switch req.URL.Path {
+		case "/v1/auth/approle/login":
+			if body["role_id"] != "role" || body["secret_id"] != "shh" {
+				rw.WriteHeader(http.StatusBadRequest)
+				rw.Write([]byte(`{"errors":["invalid role or secret ID"]}`))
+				return
+			}
+			rw.Write([]byte(`{"auth":{"client_token":"approle-token"}}`))
+		case "/v1/auth/k8s/login":
+			if body["role"] != "buildkite" || body["jwt"] != "service-account-jwt" {
+				rw.WriteHeader(http.StatusForbidden)
+				rw.Write([]byte(`{"errors":["permission denied"]}`))
+				return
+			}
+			rw.Write([]byte(`{"auth":{"client_token":"k8s-token"}}`))
+		case "/v1/secret/data/db":
+			if req.Header.Get("X-Vault-Token") == "" {
+				rw.WriteHeader(http.StatusForbidden)
+				return
+			}
+			assert.Equal(t, "team", req.Header.Get("X-Vault-Namespace"))
+			rw.Write([]byte(`{"data":{"data":{"password":"hunter2","port":5432},"metadata":{"version":3}}}`))
+		case "/v1/kv/api":
+			rw.Write([]byte(`{"data":{"value":"api-key"}}`))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+}
+
+func TestVaultAppRole(t *testing.T) {
+	t.Parallel()
+
+	server := newTestVaultServer(t)
+	defer server.Close()
+
+	vault, err := NewVault(VaultConfig{Address: server.URL, Namespace: "team", RoleID: "role", SecretID: "shh"})
+	assert.NoError(t, err)
+
+	value, err := vault.Fetch("secret/data/db", "password")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", value)
+
+	value, err = vault.Fetch("/secret/data/db", "port")
+	assert.NoError(t, err)
+	assert.Equal(t, "5432", value)
+
+	_, err = vault.Fetch("secret/data/db", "username")
+	assert.EqualError(t, err, `The secret doesn't have a "username" field`)
+
+	_, err = vault.Fetch("secret/data/missing", "")
+	assert.EqualError(t, err, "GET secret/data/missing returned 404 Not Found")
+}
+
+func TestVaultKeyValueVersion1(t *testing.T) {
+	t.Parallel()
+
+	server := newTestVaultServer(t)
+	defer server.Close()
+
+	vault, err := NewVault(VaultConfig{Address: server.URL, RoleID: "role", SecretID: "shh"})
+	assert.NoError(t, err)
+
+	value, err := vault.Fetch("kv/api", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "api-key", value)
+}
+
+func TestVaultAppRoleLoginFailure(t *testing.T) {
+	t.Parallel()
+
+	server := newTestVaultServer(t)
+	defer server.Close()
+
+	vault, err := NewVault(VaultConfig{Address: server.URL, RoleID: "role", SecretID: "wrong"})
+	assert.NoError(t, err)
+
+	_, err = vault.Fetch("kv/api", "")
+	assert.EqualError(t, err, "Failed to log into Vault with approle: invalid role or secret ID (400)")
+}
+
+func TestVaultKubernetes(t *testing.T) {
+	t.Parallel()
+
+	server := newTestVaultServer(t)
+	defer server.Close()
+
+	tokenFile, err := ioutil.TempFile("", "vault-k8s-token")
+	assert.NoError(t, err)
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("service-account-jwt\n")
+	tokenFile.Close()
+
+	vault, err := NewVault(VaultConfig{
+		Address:             server.URL,
+		Namespace:           "team",
+		AuthMethod:          "kubernetes",
+		AuthMount:           "/k8s/",
+		KubernetesRole:      "buildkite",
+		KubernetesTokenPath: tokenFile.Name(),
+	})
+	assert.NoError(t, err)
+
+	value, err := vault.Fetch("secret/data/db", "password")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", value)
+}
+
+func TestNewVaultValidatesConfig(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []VaultConfig{
+		{},
+		{Address: "https://vault.example.com"},
+		{Address: "https://vault.example.com", AuthMethod: "kubernetes"},
+		{Address: "https://vault.example.com", AuthMethod: "token"},
+	} {
+		_, err := NewVault(c)
+		assert.Error(t, err)
+	}
+
+	vault, err := NewVault(VaultConfig{Address: "vault.example.com:8200/", RoleID: "role"})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://vault.example.com:8200", vault.config.Address)
+}
@@ -0,0 +1,147 @@
+package tracing
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// The JSON encoding of an OTLP ExportTraceServiceRequest. Only the fields
+// that the agent uses are included.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+// The status codes of spans
+const (
+	otlpStatusUnset = 0
+	otlpStatusError = 2
+)
+
+// The name spans are grouped under in the export
+const instrumentationScope = "github.com/buildkite/agent"
+
+func (t *Tracer) exportRequest(spans []*Span) otlpRequest {
+	resource := map[string]interface{}{}
+	for k, v := range t.ResourceAttributes {
+		resource[k] = v
+	}
+
+	exported := make([]otlpSpan, len(spans))
+	for idx, s := range spans {
+		exported[idx] = s.otlp()
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: otlpAttributes(resource)},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: instrumentationScope},
+				Spans: exported,
+			}},
+		}},
+	}
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status := otlpStatus{Code: otlpStatusUnset}
+	if s.Error != nil {
+		status = otlpStatus{Code: otlpStatusError, Message: s.Error.Error()}
+	}
+
+	return otlpSpan{
+		TraceID:           s.TraceID,
+		SpanID:            s.SpanID,
+		ParentSpanID:      s.ParentSpanID,
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.Attributes),
+		Status:            status,
+	}
+}
+
+// Converts attributes into OTLP's typed values, sorted by key so exports are
+// consistent. Types that OTLP doesn't have are sent as strings.
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	converted := make([]otlpAttribute, 0, len(keys))
+	for _, k := range keys {
+		var value otlpValue
+
+		switch v := attributes[k].(type) {
+		case string:
+			value.StringValue = &v
+		case int:
+			i := strconv.Itoa(v)
+			value.IntValue = &i
+		case int64:
+			i := strconv.FormatInt(v, 10)
+			value.IntValue = &i
+		case bool:
+			value.BoolValue = &v
+		default:
+			str := fmt.Sprintf("%v", v)
+			value.StringValue = &str
+		}
+
+		converted = append(converted, otlpAttribute{Key: k, Value: value})
+	}
+
+	return converted
+}
@@ -0,0 +1,134 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The kinds of span, as numbered by OTLP
+const (
+	KindInternal = 1
+	KindClient   = 3
+)
+
+// Span is a timed operation within a trace. A nil span is valid and does
+// nothing, so code can be traced without checking whether tracing is enabled.
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Kind         int
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   map[string]interface{}
+
+	// Set if the operation the span covers failed
+	Error error
+
+	tracer *Tracer
+	ended  bool
+	mutex  sync.Mutex
+}
+
+// StartChild starts a span for an operation within this one
+func (s *Span) StartChild(name string) *Span {
+	if s == nil {
+		return nil
+	}
+
+	return s.tracer.startSpan(name, s.TraceID, s.SpanID)
+}
+
+// SetKind sets what kind of operation the span is, i.e. KindClient for
+// requests to another service
+func (s *Span) SetKind(kind int) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Kind = kind
+}
+
+// SetAttribute records a string, int or bool attribute on the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Attributes[key] = value
+}
+
+// End finishes the span, marking it as failed if there was an error, and
+// queues it to be exported. Ending a span more than once does nothing.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.Error = err
+	s.mutex.Unlock()
+
+	s.tracer.queue(s)
+}
+
+// Traceparent returns the span's context as a W3C traceparent header, which
+// is how it's passed to other processes
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+// Parses a W3C traceparent header into it's trace and parent span ids
+func parseTraceparent(traceparent string) (string, string, error) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || parts[0] == "ff" {
+		return "", "", fmt.Errorf("Invalid traceparent \"%s\"", traceparent)
+	}
+
+	traceID, spanID := parts[1], parts[2]
+	if !isHexID(traceID, 16) || !isHexID(spanID, 8) {
+		return "", "", fmt.Errorf("Invalid traceparent \"%s\"", traceparent)
+	}
+
+	return traceID, spanID, nil
+}
+
+// Whether the id is the right number of bytes of hex, and isn't all zeros
+// which the spec reserves as invalid
+func isHexID(id string, size int) bool {
+	decoded, err := hex.DecodeString(id)
+	if err != nil || len(decoded) != size {
+		return false
+	}
+
+	return strings.Trim(id, "0") != ""
+}
+
+func newID(size int) string {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
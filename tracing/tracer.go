@@ -0,0 +1,247 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/logger"
+)
+
+const (
+	// The environment variable that passes the current span to other
+	// processes, following the W3C trace context spec
+	TraceparentEnv = "TRACEPARENT"
+
+	// How many ended spans are queued up before they're exported
+	exportBatchSize = 256
+
+	defaultExportTimeout = 10 * time.Second
+)
+
+// Tracer collects spans and exports them to an OpenTelemetry collector using
+// OTLP over HTTP with JSON encoding. A nil tracer is valid and starts nil
+// spans.
+type Tracer struct {
+	// Where spans are sent, i.e. http://localhost:4318/v1/traces
+	Endpoint string
+
+	// Headers sent with every export, i.e. for authentication
+	Headers map[string]string
+
+	// How long an export can take before it's abandoned
+	Timeout time.Duration
+
+	// Describe what's generating the spans, including the service.name
+	ResourceAttributes map[string]string
+
+	spans     []*Span
+	mutex     sync.Mutex
+	exporting sync.WaitGroup
+	client    *http.Client
+}
+
+// NewTracerFromEnv creates a tracer configured with the standard OTEL_*
+// environment variables. If no OTLP endpoint is set, or tracing has been
+// turned off, it returns a nil tracer.
+func NewTracerFromEnv(serviceName string) (*Tracer, error) {
+	if strings.ToLower(os.Getenv("OTEL_SDK_DISABLED")) == "true" {
+		return nil, nil
+	}
+
+	switch exporter := os.Getenv("OTEL_TRACES_EXPORTER"); exporter {
+	case "", "otlp":
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Unsupported traces exporter \"%s\", only otlp is supported", exporter)
+	}
+
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if protocol != "" && protocol != "http/json" {
+		return nil, fmt.Errorf("Unsupported OTLP protocol \"%s\", only http/json is supported", protocol)
+	}
+
+	headers := parseKeyValues(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	for k, v := range parseKeyValues(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS")) {
+		headers[k] = v
+	}
+
+	timeout := defaultExportTimeout
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_TIMEOUT", "OTEL_EXPORTER_OTLP_TRACES_TIMEOUT"} {
+		if value := os.Getenv(name); value != "" {
+			milliseconds, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s \"%s\"", name, value)
+			}
+			timeout = time.Duration(milliseconds) * time.Millisecond
+		}
+	}
+
+	resource := parseKeyValues(os.Getenv("OTEL_RESOURCE_ATTRIBUTES"))
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		resource["service.name"] = name
+	} else if _, ok := resource["service.name"]; !ok {
+		resource["service.name"] = serviceName
+	}
+
+	return &Tracer{
+		Endpoint:           endpoint,
+		Headers:            headers,
+		Timeout:            timeout,
+		ResourceAttributes: resource,
+	}, nil
+}
+
+// StartSpan starts a span, which is the root of a new trace unless a
+// traceparent for a span in another process is given
+func (t *Tracer) StartSpan(name string, traceparent string) *Span {
+	if t == nil {
+		return nil
+	}
+
+	if traceparent != "" {
+		traceID, parentID, err := parseTraceparent(traceparent)
+		if err == nil {
+			return t.startSpan(name, traceID, parentID)
+		}
+		logger.Warn("Starting a new trace for %s (%s)", name, err)
+	}
+
+	return t.startSpan(name, newID(16), "")
+}
+
+func (t *Tracer) startSpan(name string, traceID string, parentID string) *Span {
+	return &Span{
+		TraceID:      traceID,
+		SpanID:       newID(8),
+		ParentSpanID: parentID,
+		Name:         name,
+		Kind:         KindInternal,
+		StartTime:    time.Now(),
+		Attributes:   map[string]interface{}{},
+		tracer:       t,
+	}
+}
+
+// Flush exports any queued spans and waits for exports that are already
+// running to finish
+func (t *Tracer) Flush() error {
+	if t == nil {
+		return nil
+	}
+
+	t.mutex.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mutex.Unlock()
+
+	err := t.export(spans)
+	t.exporting.Wait()
+
+	return err
+}
+
+// Queues an ended span, exporting the queue in the background once it's
+// big enough
+func (t *Tracer) queue(s *Span) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.spans = append(t.spans, s)
+	if len(t.spans) < exportBatchSize {
+		return
+	}
+
+	spans := t.spans
+	t.spans = nil
+
+	t.exporting.Add(1)
+	go func() {
+		defer t.exporting.Done()
+		if err := t.export(spans); err != nil {
+			logger.Warn("Failed to export %d spans (%s)", len(spans), err)
+		}
+	}()
+}
+
+func (t *Tracer) export(spans []*Span) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(t.exportRequest(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", t.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+
+	t.mutex.Lock()
+	if t.client == nil {
+		t.client = &http.Client{Timeout: t.Timeout}
+	}
+	client := t.client
+	t.mutex.Unlock()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with %s", t.Endpoint, resp.Status)
+	}
+
+	return nil
+}
+
+// Parses a list of key=value pairs separated by commas, as used by the
+// OTEL_* environment variables, with the values url encoded
+func parseKeyValues(list string) map[string]string {
+	values := map[string]string{}
+
+	for _, pair := range strings.Split(list, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			continue
+		}
+
+		value, err := url.QueryUnescape(strings.TrimSpace(parts[1]))
+		if err != nil {
+			value = strings.TrimSpace(parts[1])
+		}
+		values[strings.TrimSpace(parts[0])] = value
+	}
+
+	return values
+}
@@ -0,0 +1,139 @@
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportingSpans(t *testing.T) {
+	var requests []otlpRequest
+	var headers []http.Header
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		requests = append(requests, req)
+		headers = append(headers, r.Header)
+	}))
+	defer server.Close()
+
+	tracer := &Tracer{
+		Endpoint:           server.URL + "/v1/traces",
+		Headers:            map[string]string{"Authorization": "Bearer llamas"},
+		ResourceAttributes: map[string]string{"service.name": "buildkite-agent"},
+	}
+
+	job := tracer.StartSpan("job", "")
+	job.SetAttribute("buildkite.job_id", "abc")
+
+	checkout := job.StartChild("checkout")
+	checkout.SetAttribute("attempts", 2)
+	checkout.End(errors.New("Failed to clone"))
+	job.End(nil)
+
+	assert.NoError(t, tracer.Flush())
+	assert.Len(t, requests, 1)
+	assert.Equal(t, "Bearer llamas", headers[0].Get("Authorization"))
+
+	resource := requests[0].ResourceSpans[0]
+	assert.Equal(t, "service.name", resource.Resource.Attributes[0].Key)
+	assert.Equal(t, "buildkite-agent", *resource.Resource.Attributes[0].Value.StringValue)
+
+	spans := resource.ScopeSpans[0].Spans
+	assert.Len(t, spans, 2)
+
+	assert.Equal(t, "checkout", spans[0].Name)
+	assert.Equal(t, job.TraceID, spans[0].TraceID)
+	assert.Equal(t, job.SpanID, spans[0].ParentSpanID)
+	assert.Equal(t, otlpStatusError, spans[0].Status.Code)
+	assert.Equal(t, "Failed to clone", spans[0].Status.Message)
+	assert.Equal(t, "2", *spans[0].Attributes[0].Value.IntValue)
+
+	assert.Equal(t, "job", spans[1].Name)
+	assert.Equal(t, "", spans[1].ParentSpanID)
+	assert.Equal(t, otlpStatusUnset, spans[1].Status.Code)
+	assert.Equal(t, "abc", *spans[1].Attributes[0].Value.StringValue)
+}
+
+func TestContinuingTracesFromATraceparent(t *testing.T) {
+	tracer := &Tracer{}
+
+	parent := tracer.StartSpan("job", "")
+	child := tracer.StartSpan("bootstrap", parent.Traceparent())
+
+	assert.Equal(t, parent.TraceID, child.TraceID)
+	assert.Equal(t, parent.SpanID, child.ParentSpanID)
+
+	for _, traceparent := range []string{
+		"llamas",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b71692033-01",
+	} {
+		span := tracer.StartSpan("bootstrap", traceparent)
+		assert.Equal(t, "", span.ParentSpanID, traceparent)
+	}
+}
+
+func TestNilSpansDoNothing(t *testing.T) {
+	var tracer *Tracer
+
+	span := tracer.StartSpan("job", "")
+	span.SetAttribute("llamas", true)
+	span.StartChild("checkout").End(nil)
+	span.End(nil)
+
+	assert.Nil(t, span)
+	assert.Equal(t, "", span.Traceparent())
+	assert.NoError(t, tracer.Flush())
+}
+
+func TestCreatingTracersFromEnv(t *testing.T) {
+	for _, name := range []string{
+		"OTEL_SDK_DISABLED",
+		"OTEL_TRACES_EXPORTER",
+		"OTEL_EXPORTER_OTLP_ENDPOINT",
+		"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+		"OTEL_EXPORTER_OTLP_PROTOCOL",
+		"OTEL_EXPORTER_OTLP_HEADERS",
+		"OTEL_EXPORTER_OTLP_TIMEOUT",
+		"OTEL_RESOURCE_ATTRIBUTES",
+		"OTEL_SERVICE_NAME",
+	} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+
+	tracer, err := NewTracerFromEnv("buildkite-agent")
+	assert.NoError(t, err)
+	assert.Nil(t, tracer)
+
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318/")
+	os.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "x-api-key=abc%20123,broken")
+	os.Setenv("OTEL_RESOURCE_ATTRIBUTES", "deployment.environment=ci")
+
+	tracer, err = NewTracerFromEnv("buildkite-agent")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:4318/v1/traces", tracer.Endpoint)
+	assert.Equal(t, map[string]string{"x-api-key": "abc 123"}, tracer.Headers)
+	assert.Equal(t, map[string]string{
+		"deployment.environment": "ci",
+		"service.name":           "buildkite-agent",
+	}, tracer.ResourceAttributes)
+
+	os.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc")
+	_, err = NewTracerFromEnv("buildkite-agent")
+	assert.Error(t, err)
+
+	os.Setenv("OTEL_TRACES_EXPORTER", "none")
+	tracer, err = NewTracerFromEnv("buildkite-agent")
+	assert.NoError(t, err)
+	assert.Nil(t, tracer)
+}
@@ -0,0 +1,204 @@
+package untar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Extract extracts a tar into dir, refusing anything that would end up
+// outside of it. Nothing is written through a symlink, whether it came from
+// the tar or was already in dir, and the tar's own symlinks can only point
+// within it. Entries that skip returns true for are left out.
+func Extract(r io.Reader, dir string, skip func(header *tar.Header) bool) error {
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if skip != nil && skip(header) {
+			continue
+		}
+
+		name := filepath.FromSlash(header.Name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = Mkdir(dir, name, os.FileMode(header.Mode)|0700)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeFile(dir, name, tr, os.FileMode(header.Mode))
+		case tar.TypeSymlink:
+			err = Symlink(dir, name, filepath.FromSlash(header.Linkname))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writeFile(dir string, name string, r io.Reader, mode os.FileMode) error {
+	f, err := Create(dir, name, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Create creates a file within dir to write to, along with the directories
+// it's in. Whatever was at the path before is replaced rather than written
+// through, in case it's a link to somewhere else.
+func Create(dir string, name string, mode os.FileMode) (*os.File, error) {
+	path, rel, err := pathWithin(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := mkdirs(dir, filepath.Dir(rel), 0777); err != nil {
+		return nil, err
+	}
+	if err := removeFile(path); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+}
+
+// Mkdir creates a directory within dir, along with the ones it's in
+func Mkdir(dir string, name string, mode os.FileMode) error {
+	_, rel, err := pathWithin(dir, name)
+	if err != nil {
+		return err
+	}
+
+	return mkdirs(dir, rel, mode)
+}
+
+// Symlink creates a symlink within dir that points to target, which has to be
+// within dir too. The target can only go up from the link's directory before
+// it goes down, as going up from a directory that's another symlink would end
+// up somewhere else than it looks like it does.
+func Symlink(dir string, name string, target string) error {
+	path, rel, err := pathWithin(dir, name)
+	if err != nil {
+		return err
+	}
+
+	if filepath.IsAbs(target) || !isWithinDir(dir, filepath.Join(filepath.Dir(path), target)) || !onlyClimbsFirst(target) {
+		return fmt.Errorf("%s links to %s, which is outside of the archive", name, target)
+	}
+
+	if err := mkdirs(dir, filepath.Dir(rel), 0777); err != nil {
+		return err
+	}
+	if err := removeFile(path); err != nil {
+		return err
+	}
+
+	return os.Symlink(target, path)
+}
+
+// Returns the path of name within dir and the path relative to dir
+func pathWithin(dir string, name string) (string, string, error) {
+	path := filepath.Join(dir, name)
+	if !isWithinDir(dir, path) {
+		return "", "", fmt.Errorf("%s is outside of the archive", name)
+	}
+
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return "", "", err
+	}
+
+	return path, rel, nil
+}
+
+// Creates each of the directories in rel within dir, checking each of them
+// isn't a symlink rather than following them like os.MkdirAll does. The last
+// one is created with the mode.
+func mkdirs(dir string, rel string, mode os.FileMode) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+
+	var parts []string
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+
+	path := dir
+	for i, part := range parts {
+		path = filepath.Join(path, part)
+
+		info, err := os.Lstat(path)
+		switch {
+		case os.IsNotExist(err):
+			perm := os.FileMode(0777)
+			if i == len(parts)-1 {
+				perm = mode
+			}
+			if err := os.Mkdir(path, perm); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case info.Mode()&os.ModeSymlink != 0:
+			return fmt.Errorf("%s is a symlink, which nothing is extracted through", path)
+		case !info.IsDir():
+			return fmt.Errorf("%s isn't a directory", path)
+		}
+	}
+
+	return nil
+}
+
+// Removes whatever isn't a directory at the path, so it can be replaced
+func removeFile(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return os.Remove(path)
+}
+
+// Whether all of a path's ".." come before anything else in it
+func onlyClimbsFirst(path string) bool {
+	climbing := true
+	for _, part := range strings.Split(path, string(filepath.Separator)) {
+		switch part {
+		case "..":
+			if !climbing {
+				return false
+			}
+		case "", ".":
+		default:
+			climbing = false
+		}
+	}
+	return true
+}
+
+func isWithinDir(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
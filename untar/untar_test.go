@@ -0,0 +1,145 @@
+package untar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testTar(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for _, header := range headers {
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len("llamas"))
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			tw.Write([]byte("llamas"))
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtract(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "untar-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = Extract(testTar(t,
+		&tar.Header{Name: "node_modules/llamas/bin/llamas", Typeflag: tar.TypeReg, Mode: 0755},
+		&tar.Header{Name: "node_modules/.bin/llamas", Typeflag: tar.TypeSymlink, Linkname: "../llamas/bin/llamas"},
+		&tar.Header{Name: "skipped.txt", Typeflag: tar.TypeReg, Mode: 0644},
+	), dir, func(header *tar.Header) bool {
+		return header.Name == "skipped.txt"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "node_modules", ".bin", "llamas"))
+	assert.NoError(t, err)
+	assert.Equal(t, "llamas", string(data))
+
+	_, err = os.Stat(filepath.Join(dir, "skipped.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestExtractRefusesToEscapeThroughSymlinks(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("Symlinks need to be enabled on windows")
+	}
+
+	var testCases = [][]*tar.Header{
+		// Each link looks like it's within the archive on it's own
+		{
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "x/y", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "y/llamas.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		// The link is made before the one that it goes up from
+		{
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "y/.."},
+			{Name: "y", Typeflag: tar.TypeSymlink, Linkname: "."},
+		},
+		{
+			{Name: "out", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+		},
+	}
+
+	for _, headers := range testCases {
+		parent, err := ioutil.TempDir("", "untar-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(parent)
+
+		err = Extract(testTar(t, headers...), filepath.Join(parent, "out"), nil)
+		assert.Error(t, err, headers[0].Name)
+
+		_, err = os.Stat(filepath.Join(parent, "llamas.txt"))
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestExtractDoesntFollowSymlinksAlreadyThere(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("Symlinks need to be enabled on windows")
+	}
+
+	parent, err := ioutil.TempDir("", "untar-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+
+	dir := filepath.Join(parent, "checkout")
+	outside := filepath.Join(parent, "outside")
+	for _, path := range []string{dir, outside} {
+		if err := os.MkdirAll(path, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "vendor")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "llamas.txt"), filepath.Join(dir, "llamas.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	err = Extract(testTar(t, &tar.Header{Name: "vendor/llamas.txt", Typeflag: tar.TypeReg, Mode: 0644}), dir, nil)
+	assert.Error(t, err)
+
+	// Files are replaced rather than written through
+	err = Extract(testTar(t, &tar.Header{Name: "llamas.txt", Typeflag: tar.TypeReg, Mode: 0644}), dir, nil)
+	assert.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(outside, "llamas.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	info, err := os.Lstat(filepath.Join(dir, "llamas.txt"))
+	if assert.NoError(t, err) {
+		assert.True(t, info.Mode().IsRegular())
+	}
+}